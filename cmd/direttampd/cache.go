@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/famish99/direttampd/internal/cache"
+	"github.com/famish99/direttampd/internal/config"
+	"github.com/famish99/direttampd/internal/player"
+	"github.com/famish99/direttampd/internal/playlistfile"
+	"github.com/famish99/direttampd/internal/storedplaylist"
+)
+
+// cacheUsage lists the cache subcommands
+const cacheUsage = "list|stats|purge [source...]|verify|prewarm <playlist>"
+
+// runCacheCommand runs `cache <command>` on the configured cache directory
+func runCacheCommand(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s cache %s", os.Args[0], cacheUsage)
+	}
+	command, args := args[0], args[1:]
+	switch command {
+	case "list":
+		return listCache(cfg)
+	case "stats":
+		return showCacheStats(cfg)
+	case "purge":
+		return purgeCache(cfg, args)
+	case "verify":
+		return verifyCache(cfg)
+	case "prewarm":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s cache prewarm <playlist>", os.Args[0])
+		}
+		return prewarmCache(cfg, args[0])
+	}
+	return fmt.Errorf("unknown command %q (want %s)", command, cacheUsage)
+}
+
+// openCache opens the configured cache as the player would, but shared: a
+// running daemon may be using it, so its staged files and eviction are left alone
+func openCache(cfg *config.Config) (*cache.DiskCache, error) {
+	opts, err := player.CacheOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	opts.Shared = true
+	return cache.NewDiskCacheWithOptions(cfg.Cache.Directory, opts)
+}
+
+// interruptible returns a context cancelled by Ctrl-C, for commands that may run long
+func interruptible() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// listCache prints the cache's size and its entries, most recently used first
+// Hit and miss counts belong to a running daemon, which logs them
+func listCache(cfg *config.Config) error {
+	c, err := openCache(cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	stats := c.Stats()
+
+	fmt.Printf("\nCache %s: %d entries, %.1f of %.1f GB used\n\n", cfg.Cache.Directory,
+		stats.Entries, float64(stats.Bytes)/(1<<30), float64(stats.MaxBytes)/(1<<30))
+	for _, entry := range stats.EntryStats {
+		fmt.Printf("  %s  %8.1f MB  %6s  %-26s  %s\n", entry.LastAccess.Format("2006-01-02 15:04"),
+			float64(entry.Size)/(1<<20), formatSeconds(entry.Duration), entry.Format, entry.Source)
+	}
+	return nil
+}
+
+// showCacheStats prints a summary of what the cache holds
+func showCacheStats(cfg *config.Config) error {
+	c, err := openCache(cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	stats := c.Stats()
+
+	var seconds float64
+	unindexed := 0
+	for _, entry := range stats.EntryStats {
+		seconds += entry.Duration
+		if entry.Format == "" {
+			unindexed++
+		}
+	}
+	policy := cfg.Cache.Eviction
+	if policy == "" {
+		policy = cache.EvictLRU
+	}
+
+	fmt.Printf("\nCache %s\n", cfg.Cache.Directory)
+	fmt.Printf("  Entries:  %d (%d without an index)\n", stats.Entries, unindexed)
+	fmt.Printf("  Used:     %.1f of %.1f GB", float64(stats.Bytes)/(1<<30), float64(stats.MaxBytes)/(1<<30))
+	if stats.MaxBytes > 0 {
+		fmt.Printf(" (%.0f%%)", float64(stats.Bytes)*100/float64(stats.MaxBytes))
+	}
+	fmt.Printf("\n  Audio:    %s\n", formatSeconds(seconds))
+	fmt.Printf("  Eviction: %s\n", policy)
+	if n := len(stats.EntryStats); n > 0 {
+		fmt.Printf("  Last use: %s to %s\n", stats.EntryStats[n-1].LastAccess.Format("2006-01-02 15:04"),
+			stats.EntryStats[0].LastAccess.Format("2006-01-02 15:04"))
+	}
+	return nil
+}
+
+// purgeCache removes the entries of the given sources, or every entry if none are given
+func purgeCache(cfg *config.Config, sources []string) error {
+	c, err := openCache(cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if len(sources) == 0 {
+		removed, err := c.Clear()
+		fmt.Printf("Removed %d cache entries\n", removed)
+		return err
+	}
+
+	var errs []error
+	for _, source := range sources {
+		if _, err := os.Stat(c.GetPathForKey(source)); err != nil {
+			fmt.Printf("Not cached: %s\n", source)
+			continue
+		}
+		if err := c.Invalidate(source); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fmt.Printf("Removed: %s\n", source)
+	}
+	return errors.Join(errs...)
+}
+
+// verifyCache checks every entry against its checksum, removing corrupt ones
+func verifyCache(cfg *config.Config) error {
+	c, err := openCache(cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ctx, stop := interruptible()
+	defer stop()
+	checked, corrupt, err := c.Verify(ctx)
+	fmt.Printf("Verified %d cache entries, %d corrupt\n", checked, len(corrupt))
+	for _, source := range corrupt {
+		fmt.Printf("  Removed: %s\n", source)
+	}
+	return err
+}
+
+// prewarmCache decodes every track of a playlist into the cache for the
+// configured output, so a session can start without waiting on downloads
+// playlist names a stored playlist, or a playlist file or URL
+func prewarmCache(cfg *config.Config, name string) error {
+	var uris []string
+	var err error
+	if playlistfile.IsPlaylist(name) {
+		uris, err = playlistfile.Expand(name)
+	} else {
+		uris, err = storedplaylist.NewStore(cfg.PlaylistDirectory, cfg.PlaylistFormat).Load(name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load playlist %q: %w", name, err)
+	}
+
+	// Only the cache and the output's format limits are needed; the output
+	// itself is left alone
+	c, err := openCache(cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	prewarmer, err := player.NewPrewarmer(c, cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := interruptible()
+	defer stop()
+	cached, failed := 0, 0
+	for i, uri := range uris {
+		ok, err := prewarmer.Prewarm(ctx, uri)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err != nil:
+			failed++
+			fmt.Printf("[%d/%d] Failed: %s: %v\n", i+1, len(uris), uri, err)
+		case ok:
+			cached++
+			fmt.Printf("[%d/%d] Cached: %s\n", i+1, len(uris), uri)
+		default:
+			fmt.Printf("[%d/%d] Skipped stream: %s\n", i+1, len(uris), uri)
+		}
+	}
+	fmt.Printf("Prewarmed %d of %d tracks of %q (%d failed)\n", cached, len(uris), name, failed)
+	return nil
+}
+
+// formatSeconds formats a duration in seconds as h:mm:ss or m:ss, "-" if unknown
+func formatSeconds(seconds float64) string {
+	if seconds <= 0 {
+		return "-"
+	}
+	total := int(seconds + 0.5)
+	if total >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", total/3600, total/60%60, total%60)
+	}
+	return fmt.Sprintf("%d:%02d", total/60, total%60)
+}
@@ -11,9 +11,13 @@ import (
 	"syscall"
 
 	"github.com/famish99/direttampd/internal/config"
+	"github.com/famish99/direttampd/internal/decoder"
+	"github.com/famish99/direttampd/internal/icy"
 	"github.com/famish99/direttampd/internal/memoryplay"
 	"github.com/famish99/direttampd/internal/mpd"
 	"github.com/famish99/direttampd/internal/player"
+	"github.com/famish99/direttampd/internal/playlistfile"
+	"github.com/famish99/direttampd/internal/storedplaylist"
 )
 
 var (
@@ -23,9 +27,11 @@ var (
 	listHosts   = flag.Bool("list-hosts", false, "List available MemoryPlay hosts and exit")
 	listTargets = flag.Bool("list-targets", false, "List available targets from MemoryPlay host and exit")
 	playFile    = flag.String("play", "", "Play a file or URL directly")
-	mpdAddr     = flag.String("mpd-addr", "localhost:6600", "MPD server listen address")
+	mpdAddr     = flag.String("mpd-addr", "", "MPD server listen address, replacing the configured listen list (default: localhost:6600)")
 	daemonMode  = flag.Bool("daemon", false, "Run as MPD server daemon (otherwise play URLs and exit)")
 	useNative   = flag.Bool("native", false, "Use native Go implementation instead of CGo for MemoryPlay protocol")
+	backendName = flag.String("backend", "", "Playback backend: memoryplay, upnp, mirror or null (default: from config, else memoryplay)")
+	cacheStats  = flag.Bool("cache-stats", false, "Show cache usage and entries and exit")
 )
 
 func main() {
@@ -58,11 +64,24 @@ func main() {
 		return
 	}
 
+	// Handle cache-stats command
+	if *cacheStats {
+		if err := listCache(cfg); err != nil {
+			log.Fatalf("Failed to read cache: %v", err)
+		}
+		return
+	}
+
 	// Override host if specified
 	if *host != "" {
 		cfg.SetHost(*host)
 	}
 
+	// Override listen addresses if specified
+	if *mpdAddr != "" {
+		cfg.Listen = []string{*mpdAddr}
+	}
+
 	// Override target if specified
 	if *targetName != "" {
 		if err := cfg.SetPreferredTarget(*targetName); err != nil {
@@ -70,15 +89,33 @@ func main() {
 		}
 	}
 
+	if *useNative {
+		cfg.Host.Native = true
+	}
+	if *backendName != "" {
+		cfg.Backend = *backendName
+	}
+
+	detectTools(cfg)
+	configureHTTP(cfg)
+
+	// Handle cache subcommands, after the overrides as prewarming decodes for the target
+	if flag.Arg(0) == "cache" {
+		if err := runCacheCommand(cfg, flag.Args()[1:]); err != nil {
+			log.Fatalf("Cache: %v", err)
+		}
+		return
+	}
+
 	// Create player
-	p, err := player.NewPlayer(cfg, *useNative)
+	p, err := player.NewPlayer(cfg)
 	if err != nil {
 		log.Fatalf("Failed to create player: %v", err)
 	}
 
 	// Daemon mode: run MPD server
 	if *daemonMode {
-		runDaemon(p)
+		runDaemon(p, cfg)
 		return
 	}
 
@@ -93,6 +130,7 @@ func main() {
 	if len(urls) == 0 {
 		_, _ = fmt.Fprintf(os.Stderr, "Usage: %s [options] <url1> [url2] ...\n", os.Args[0])
 		_, _ = fmt.Fprintf(os.Stderr, "       %s --play <file|url>\n", os.Args[0])
+		_, _ = fmt.Fprintf(os.Stderr, "       %s cache %s\n", os.Args[0], cacheUsage)
 		_, _ = fmt.Fprintf(os.Stderr, "\nOptions:\n")
 		flag.PrintDefaults()
 		_, _ = fmt.Fprintf(os.Stderr, "\nExamples:\n")
@@ -108,30 +146,110 @@ func main() {
 		_, _ = fmt.Fprintf(os.Stderr, "  %s --daemon\n", os.Args[0])
 		_, _ = fmt.Fprintf(os.Stderr, "  mpc add http://stream.example.com/radio.mp3\n")
 		_, _ = fmt.Fprintf(os.Stderr, "  mpc play\n")
+		_, _ = fmt.Fprintf(os.Stderr, "\n  # Decode a stored playlist into the cache ahead of a listening session\n")
+		_, _ = fmt.Fprintf(os.Stderr, "  %s cache prewarm favourites\n", os.Args[0])
 		os.Exit(1)
 	}
 
 	runDirect(p, urls)
 }
 
+// detectTools finds ffmpeg and ffprobe before anything is decoded
+// Binaries configured under tools must work; missing ones found through PATH
+// only leave fewer formats playable
+func detectTools(cfg *config.Config) {
+	tools, err := decoder.DetectTools(cfg.Tools.FFmpeg, cfg.Tools.FFprobe)
+	if err != nil {
+		if (cfg.Tools.FFmpeg != "" && tools.FFmpegVersion == "") || (cfg.Tools.FFprobe != "" && tools.FFprobeVersion == "") {
+			log.Fatalf("Failed to find decoding tools: %v", err)
+		}
+		log.Printf("Error: %v", err)
+		log.Printf("Only FLAC files, and WAV, AIFF and DSD files the output takes as they are, can be played")
+	}
+	if tools.FFmpegVersion != "" {
+		log.Printf("Using ffmpeg %s (%s) with %d audio decoders", tools.FFmpegVersion, tools.FFmpeg, len(tools.Decoders))
+	}
+	if tools.FFprobeVersion != "" {
+		log.Printf("Using ffprobe %s (%s)", tools.FFprobeVersion, tools.FFprobe)
+	}
+}
+
+// configureHTTP has everything fetching URLs outside the cache, such as
+// radio, remote playlists, and ffmpeg and ffprobe, use the http config too
+func configureHTTP(cfg *config.Config) {
+	for _, configure := range []func(config.HTTPConfig) error{icy.Configure, playlistfile.ConfigureHTTP, decoder.ConfigureHTTP} {
+		if err := configure(cfg.HTTP); err != nil {
+			log.Fatalf("Invalid http config: %v", err)
+		}
+	}
+}
+
 // runDaemon runs the MPD server daemon
-func runDaemon(p *player.Player) {
+func runDaemon(p *player.Player, cfg *config.Config) {
+	// Restore the queue from the previous run before clients can connect
+	if cfg.StateFile != "" {
+		if err := p.RestoreState(cfg.StateFile); err != nil {
+			log.Printf("Failed to restore state: %v", err)
+		}
+	}
+
+	// Fall back to the configured default playlist if nothing was restored
+	if cfg.Playback.AutoloadPlaylist != "" && p.GetPlaylist().Length() == 0 {
+		autoloadPlaylist(p, cfg)
+	}
+
 	// Create and start MPD server
-	server := mpd.NewServer(*mpdAddr, p)
+	server := mpd.NewServer(cfg.ListenAddresses(), p, cfg)
 	if err := server.Start(); err != nil {
 		log.Fatalf("Failed to start MPD server: %v", err)
 	}
 	defer server.Stop()
 
 	log.Printf("Direttampd running in daemon mode")
-	log.Printf("Connect with MPD clients to %s", *mpdAddr)
+	log.Printf("Connect with MPD clients to %s", strings.Join(cfg.ListenAddresses(), ", "))
 
-	// Wait for interrupt signal
+	// Wait for interrupt signal or a client's kill command
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
-	<-sigChan
+	select {
+	case <-sigChan:
+	case <-server.Killed():
+	}
 	log.Printf("\nShutting down...")
+
+	// Save the queue so the next run picks up where this one stopped
+	if cfg.StateFile != "" {
+		if err := p.SaveState(cfg.StateFile); err != nil {
+			log.Printf("Failed to save state: %v", err)
+		}
+	}
+}
+
+// autoloadPlaylist loads the configured stored playlist into the queue
+// and optionally starts playback
+func autoloadPlaylist(p *player.Player, cfg *config.Config) {
+	name := cfg.Playback.AutoloadPlaylist
+	store := storedplaylist.NewStore(cfg.PlaylistDirectory, cfg.PlaylistFormat)
+
+	uris, err := store.Load(name)
+	if err != nil {
+		log.Printf("Failed to autoload playlist %q: %v", name, err)
+		return
+	}
+	if len(uris) == 0 {
+		log.Printf("Autoload playlist %q is empty", name)
+		return
+	}
+
+	p.AddURLs(uris)
+	log.Printf("Autoloaded playlist %q (%d tracks)", name, len(uris))
+
+	if cfg.Playback.AutoloadPlay {
+		if err := p.Play(); err != nil {
+			log.Printf("Failed to start autoloaded playlist: %v", err)
+		}
+	}
 }
 
 // runDirect plays URLs directly and exits
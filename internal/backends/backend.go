@@ -1,6 +1,15 @@
 package backends
 
-import "github.com/famish99/direttampd/internal/playlist"
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/famish99/direttampd/internal/cache"
+	"github.com/famish99/direttampd/internal/config"
+	"github.com/famish99/direttampd/internal/decoder"
+	"github.com/famish99/direttampd/internal/playlist"
+)
 
 // PlaybackBackend defines the interface that different audio backends must implement
 type PlaybackBackend interface {
@@ -8,27 +17,202 @@ type PlaybackBackend interface {
 	Close()
 
 	// Track preparation and playback
-	PrepareTrack(track *playlist.Track) error // Prepare/upload/queue a track
-	StartPlayback() error                     // Start playing prepared track(s)
+	PrepareTrack(track *playlist.Track) error     // Prepare/upload/queue a track
+	PrepareTracks(tracks []*playlist.Track) error // Prepare tracks to play back-to-back without gaps
+	StartPlayback() error                         // Start playing prepared track(s)
+	CurrentTrack() int                            // Index into the prepared tracks of the one playing
+
+	// Software gain in dB for each track, evaluated when the track is prepared
+	SetGainFunc(gain func(track *playlist.Track) float64)
+
+	// Seconds each prepared track overlaps the next (0 disables crossfading)
+	SetCrossfade(seconds float64)
 
 	// Playback control
-	Play() error                      // Resume playback
-	Pause() error                     // Pause playback
-	Stop() error                      // Quit current session
-	Seek(positionSeconds int64) error // Seek to absolute position in seconds
+	Play() error                 // Resume playback
+	Pause() error                // Pause playback
+	Stop() error                 // Quit current session
+	Seek(position float64) error // Seek to absolute position in seconds within the playing track
 
 	// Playback state queries
 	GetTrackDuration() (int64, error) // Returns total duration in seconds
 	GetElapsedTime() (int64, error)   // Returns elapsed time in seconds
 	IsTrackComplete() (bool, error)   // Returns true if track has finished
 
+	// Health supervision
+	CheckHealth() error // Probe the output; nil while it is reachable or nothing is open to probe
+	Reconnect() error   // Open the session to the output again after a failed probe
+
 	// Target/device selection
 	SelectTarget() error
+	Outputs() []Output                          // All targets playback can be sent to
+	EnableOutput(index int, enabled bool) error // Switch which output receives playback
 
 	// Backend information
+	Capabilities() Capabilities // What the output can play, used to choose decode formats
 	GetBackendName() string
 	GetOutputName() string // Returns the name of the output device
 }
 
-// BackendFactory creates a new backend instance
-type BackendFactory func() (PlaybackBackend, error)
+// StatusNotifier is implemented by backends whose output reports status changes as they happen
+// The player checks for track completion as soon as the channel is closed
+// instead of waiting for its next poll
+type StatusNotifier interface {
+	StatusChanged() <-chan struct{} // Closed the next time the status changes; nil if unknown
+}
+
+// StreamPlayer is implemented by backends that can play audio with no end, such
+// as internet radio, as it arrives
+// The stream is WAV with its sizes unset; the backend closes it when playback
+// of the track stops. The track has no duration and cannot be seeked
+type StreamPlayer interface {
+	PrepareStream(track *playlist.Track, stream io.ReadCloser) error
+}
+
+// BackendFactory creates a new backend instance playing tracks decoded into the cache
+type BackendFactory func(cache *cache.DiskCache, cfg *config.Config) (PlaybackBackend, error)
+
+// Output is a target a backend can send playback to
+type Output struct {
+	Name    string
+	Enabled bool
+}
+
+// Capabilities describes what a backend's output can play
+// Zero values mean the backend sets no limit
+type Capabilities struct {
+	MaxSampleRate int   // Highest sample rate in Hz
+	BitDepths     []int // Sample sizes in bits the output accepts
+	DSD           bool  // DSD is sent natively instead of being converted to PCM
+	DoP           bool  // DSD that is not sent natively goes as DoP instead of PCM
+	MultiFile     bool  // Several tracks can be prepared as one upload
+	Gapless       bool  // Tracks of one upload play back-to-back without gaps
+
+	// How sample rates are converted for this output, from the config
+	Resample decoder.Resampling
+	// Sample size and channel count every track is converted to, from the config (0 keeps the track's own)
+	BitDepth int
+	Channels int
+	// Highest channel count the output plays; tracks with more are mixed down (0 for no limit)
+	MaxChannels int
+}
+
+// WithDSDMode returns the capabilities under the playback.dsd_mode setting
+// "pcm" converts DSD even for outputs that play it natively and "dop" sends
+// DoP to those that don't; anything else leaves the capabilities as they are
+func (c Capabilities) WithDSDMode(mode string) Capabilities {
+	switch mode {
+	case "pcm":
+		c.DSD = false
+	case "dop":
+		c.DoP = true
+	}
+	return c
+}
+
+// WithResampling returns the capabilities resampling as a resample setting asks
+func (c Capabilities) WithResampling(resample config.ResampleConfig) Capabilities {
+	c.Resample = decoder.Resampling{
+		Mode:       resample.Mode,
+		Rate:       resample.Rate,
+		SameFamily: resample.SameFamily,
+		Quality:    resample.Quality,
+	}
+	return c
+}
+
+// WithOutputFormat returns the capabilities converting every track to a sample
+// size and channel count (0 keeps the track's own)
+func (c Capabilities) WithOutputFormat(bitDepth, channels int) Capabilities {
+	c.BitDepth, c.Channels = bitDepth, channels
+	return c
+}
+
+// WithDownmix returns the capabilities mixing tracks with more than two
+// channels down to stereo when downmix is set
+func (c Capabilities) WithDownmix(downmix bool) Capabilities {
+	if downmix {
+		c.MaxChannels = 2
+	}
+	return c
+}
+
+// FormatLimits returns the limits the decoder applies for this output
+func (c Capabilities) FormatLimits() decoder.FormatLimits {
+	limits := decoder.FormatLimits{
+		MaxSampleRate: c.MaxSampleRate,
+		BitDepths:     c.BitDepths,
+		BitDepth:      c.BitDepth,
+		Channels:      c.Channels,
+		MaxChannels:   c.MaxChannels,
+		Resample:      c.Resample,
+	}
+	switch {
+	case c.DSD:
+		limits.DSD = decoder.DSDNative
+	case c.DoP:
+		limits.DSD = decoder.DSDToDoP
+	}
+	return limits
+}
+
+// Decoder returns a cache decoder producing WAV files the output can play
+// Its params are the format limits, so outputs with other limits decode their own
+func (c Capabilities) Decoder() cache.Decoder {
+	limits := c.FormatLimits()
+	return cache.Decoder{
+		Params: limits.String(),
+		Decode: func(ctx context.Context, source cache.Source, dest string, progress func(float64)) (cache.Decoded, error) {
+			return decodeSource(ctx, source, dest, limits, nil, progress)
+		},
+	}
+}
+
+// StreamDecoder returns a cache decoder like Decoder that also passes the WAV
+// file to tee as it is written (see cache.DiskCache.StreamDecoded)
+func (c Capabilities) StreamDecoder() cache.StreamDecoder {
+	limits := c.FormatLimits()
+	return cache.StreamDecoder{
+		Params: limits.String(),
+		Decode: func(ctx context.Context, source cache.Source, dest string, tee io.Writer, progress func(float64)) (cache.Decoded, error) {
+			return decodeSource(ctx, source, dest, limits, tee, progress)
+		},
+	}
+}
+
+// decodeSource decodes a cache source to a WAV file at dest
+// A download still in progress is decoded as it arrives where the decoder
+// can, so playback need not wait for all of it, and is waited for otherwise
+func decodeSource(ctx context.Context, source cache.Source, dest string, limits decoder.FormatLimits, tee io.Writer, progress func(float64)) (cache.Decoded, error) {
+	if source.Partial != nil {
+		if _, complete := source.Partial.Size(); !complete {
+			r, err := source.Partial.Open(ctx)
+			if err != nil {
+				return cache.Decoded{}, err
+			}
+			format, err := decoder.DecodeReaderToWAVStream(ctx, r, dest, limits, tee, progress)
+			if !errors.Is(err, decoder.ErrWholeFileNeeded) {
+				return decoded(format, dest), err
+			}
+			if err := source.Partial.Wait(ctx); err != nil {
+				return cache.Decoded{}, err
+			}
+		}
+	}
+	format, err := decoder.DecodeToWAVStream(ctx, source.Path, dest, limits, tee, progress)
+	return decoded(format, dest), err
+}
+
+// decoded describes a file decodeSource wrote, for the cache index
+func decoded(format *decoder.AudioFormat, dest string) cache.Decoded {
+	if format == nil {
+		return cache.Decoded{}
+	}
+	result := cache.Decoded{Format: format.String()}
+	if info, err := decoder.ReadWAVInfo(dest); err == nil {
+		result.Duration = info.Duration()
+	} else if dsd, err := decoder.ReadDSDFile(dest); err == nil {
+		result.Duration = dsd.Duration()
+	}
+	return result
+}
@@ -59,31 +59,85 @@ func DiscoverAndSelectHost(cfg *config.Config) (*memoryplay.HostInfo, error) {
 	return selectedHost, nil
 }
 
-// DiscoverAndSelectTarget discovers available targets from a host and selects one based on config.
-// This function always performs discovery and returns the selected target info.
-func DiscoverAndSelectTarget(hostIP string, hostIfNum uint32, cfg *config.Config) (*memoryplay.TargetInfo, error) {
+// defaultTargetPort is used when a target's port is not configured or discovered
+const defaultTargetPort = "19644"
+
+// DiscoverOutputs lists every target playback can be sent to: the fully configured
+// targets followed by any others listTargets finds on the host
+// Discovery failures are logged so configured targets still work offline;
+// a nil listTargets uses the configured targets alone
+func DiscoverOutputs(listTargets func() ([]memoryplay.TargetInfo, error), cfg *config.Config) []memoryplay.Target {
+	var outputs []memoryplay.Target
+	seen := make(map[string]bool)
+
+	for _, target := range cfg.Targets {
+		if target.IP == "" || target.Interface == "" {
+			continue // Incomplete entries are only names to look for in discovery
+		}
+		port := target.Port
+		if port == "" {
+			port = defaultTargetPort
+		}
+		outputs = append(outputs, memoryplay.Target{
+			Name:      target.Name,
+			IP:        target.IP,
+			Port:      port,
+			Interface: target.Interface,
+		})
+		seen[target.Name] = true
+	}
+
+	if listTargets == nil {
+		return outputs
+	}
+
 	log.Printf("Discovering available targets...")
-	targets, err := memoryplay.ListTargets(hostIP, hostIfNum)
-	if err != nil || len(targets) == 0 {
-		return nil, fmt.Errorf("no targets found on host: %w", err)
+	targets, err := listTargets()
+	if err != nil {
+		log.Printf("Warning: target discovery failed: %v", err)
+		return outputs
+	}
+
+	for _, info := range targets {
+		if seen[info.TargetName] {
+			continue
+		}
+		seen[info.TargetName] = true
+
+		// Parse port from target IP (format: "IP,PORT")
+		target := memoryplay.Target{
+			Name:      info.TargetName,
+			IP:        info.IPAddress,
+			Port:      defaultTargetPort,
+			Interface: fmt.Sprintf("%d", info.InterfaceNumber),
+		}
+		if strings.Contains(target.IP, ",") {
+			parts := strings.SplitN(target.IP, ",", 2)
+			target.IP = parts[0]
+			target.Port = parts[1]
+		}
+		outputs = append(outputs, target)
+	}
+
+	return outputs
+}
+
+// SelectOutput returns the index of the output to play to at startup
+// Prefers the config preferred_target if specified, otherwise the first output
+func SelectOutput(outputs []memoryplay.Target, cfg *config.Config) (int, error) {
+	if len(outputs) == 0 {
+		return -1, fmt.Errorf("no targets found on host")
 	}
 
-	// Select target: prefer config preferred_target if specified, otherwise first
-	var selectedTarget *memoryplay.TargetInfo
 	if cfg.PreferredTarget != "" {
 		// Look for target matching config name
-		for i := range targets {
-			if targets[i].TargetName == cfg.PreferredTarget {
-				selectedTarget = &targets[i]
-				break
+		for i := range outputs {
+			if outputs[i].Name == cfg.PreferredTarget {
+				return i, nil
 			}
 		}
-		if selectedTarget == nil {
-			return nil, fmt.Errorf("configured target %s not found", cfg.PreferredTarget)
-		}
-	} else {
-		selectedTarget = &targets[0]
+		return -1, fmt.Errorf("configured target %s not found", cfg.PreferredTarget)
 	}
 
-	return selectedTarget, nil
+	return 0, nil
 }
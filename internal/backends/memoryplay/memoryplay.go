@@ -1,12 +1,18 @@
 package memoryplay
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"strings"
+	"math"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/famish99/direttampd/internal/backends"
 	"github.com/famish99/direttampd/internal/cache"
 	"github.com/famish99/direttampd/internal/config"
 	"github.com/famish99/direttampd/internal/decoder"
@@ -16,19 +22,37 @@ import (
 
 // Backend implements the backends.PlaybackBackend interface using the MemoryPlay protocol
 type Backend struct {
-	client               *memoryplay.Client
-	cache                *cache.DiskCache
-	config               *config.Config
-	hostIP               string
-	hostIfNum            uint32
-	targetIP             string
-	targetPort           string
-	targetIf             uint32
-	targetName           string
-	useNative            bool
-	currentTrackDuration int64 // Duration in seconds
-	seeking              bool  // True when a seek operation is in progress
-	seekMu               sync.Mutex
+	client         *memoryplay.Client
+	cache          *cache.DiskCache
+	config         *config.Config
+	hostIP         string
+	hostIfNum      uint32
+	outputs        []memoryplay.Target // Targets that can receive playback
+	active         int                 // Index of the enabled output, -1 if none
+	clientOutput   int                 // Index of the output the client was created for
+	outputMu       sync.Mutex
+	useNative      bool
+	library        bool                                // True when the C library was initialized
+	pending        *memoryplay.Upload                  // Native upload that may still be running in the background
+	prepared       []*playlist.Track                   // Tracks of the current upload, kept to upload again when seeking
+	trackOffsets   []float64                           // Start of each prepared track within the upload, in seconds
+	trackStarts    []float64                           // Song position in seconds where each prepared track's audio begins
+	trackDurations []float64                           // Duration of each prepared track in seconds
+	crossfade      atomic.Uint64                       // Seconds each track overlaps the next within an upload, as float64 bits (see crossfadeSeconds)
+	totalDuration  float64                             // Duration of the whole upload in seconds
+	live           io.Closer                           // Stream with no end being uploaded, nil for tracks
+	gainFunc       func(track *playlist.Track) float64 // Software gain in dB per track (0 leaves it bit-perfect)
+	seeking        bool                                // True when a seek operation is in progress
+	seekMu         sync.Mutex
+}
+
+func init() {
+	backends.Register("memoryplay", func(cache *cache.DiskCache, cfg *config.Config) (backends.PlaybackBackend, error) {
+		return New(cache, cfg, cfg.Host.Native)
+	})
+	backends.RegisterCapabilities("memoryplay", func(cfg *config.Config) backends.Capabilities {
+		return targetCapabilities(cfg, cfg.PreferredTarget, cfg.Host.Native)
+	})
 }
 
 // New creates a new MemoryPlay backend with discovery
@@ -37,93 +61,78 @@ func New(
 	cfg *config.Config,
 	useNative bool,
 ) (*Backend, error) {
-	// Initialize the MemoryPlay C library
-	if err := memoryplay.InitLibrary(true, false); err != nil {
-		return nil, fmt.Errorf("failed to initialize MemoryPlay library: %w", err)
+	b := &Backend{
+		cache:        cache,
+		config:       cfg,
+		clientOutput: -1,
+		useNative:    useNative,
 	}
 
-	// Perform host discovery
-	selectedHost, err := DiscoverAndSelectHost(cfg)
-	if err != nil {
-		memoryplay.CleanupLibrary()
-		return nil, fmt.Errorf("host discovery failed: %w", err)
+	if useNative {
+		memoryplay.ConfigureNative(memoryplay.NativeOptions{
+			ConnectTimeout: seconds(cfg.Host.ConnectTimeout),
+			RequestTimeout: seconds(cfg.Host.RequestTimeout),
+			Retries:        cfg.Host.Retries,
+			RetryDelay:     seconds(cfg.Host.RetryDelay),
+		})
+		if cfg.Host.TraceFile != "" {
+			if err := memoryplay.TraceFrames(cfg.Host.TraceFile); err != nil {
+				return nil, err
+			}
+		}
 	}
-	hostIP := selectedHost.IPAddress
-	hostIfNum := selectedHost.InterfaceNumber
-
-	// Check if we need to discover target or can use config
-	preferredTarget := cfg.GetPreferredTarget()
-	needTargetDiscovery := preferredTarget == nil ||
-		preferredTarget.IP == "" ||
-		preferredTarget.Port == "" ||
-		preferredTarget.Interface == ""
 
-	var targetIP, targetPort, targetName string
-	var targetIf uint32
+	// A native backend given the host's port needs nothing from the C library
+	if useNative && cfg.Host.Port != "" {
+		b.hostIP = cfg.Host.IP + "," + cfg.Host.Port
+		b.hostIfNum = cfg.Host.Interface
+	} else {
+		// Initialize the MemoryPlay C library
+		if err := memoryplay.InitLibrary(true, false); err != nil {
+			return nil, fmt.Errorf("failed to initialize MemoryPlay library: %w", err)
+		}
+		b.library = true
 
-	if needTargetDiscovery {
-		// Perform target discovery
-		selectedTarget, err := DiscoverAndSelectTarget(hostIP, hostIfNum, cfg)
+		// Perform host discovery
+		selectedHost, err := DiscoverAndSelectHost(cfg)
 		if err != nil {
 			memoryplay.CleanupLibrary()
-			return nil, fmt.Errorf("target discovery failed: %w", err)
-		}
-
-		// Parse port from target IP (format: "IP,PORT")
-		targetIP = selectedTarget.IPAddress
-		targetPort = "19644" // default
-		if strings.Contains(targetIP, ",") {
-			parts := strings.SplitN(targetIP, ",", 2)
-			targetIP = parts[0]
-			targetPort = parts[1]
+			return nil, fmt.Errorf("host discovery failed: %w", err)
 		}
-		targetName = selectedTarget.TargetName
-		targetIf = selectedTarget.InterfaceNumber
+		b.hostIP = selectedHost.IPAddress
+		b.hostIfNum = selectedHost.InterfaceNumber
+	}
 
-		log.Printf("Discovered target: %s (IP: %s,%s%%%d)",
-			targetName, targetIP, targetPort, targetIf)
-	} else {
-		// Use config values
-		targetIP = preferredTarget.IP
-		targetPort = preferredTarget.Port
-		if targetPort == "" {
-			targetPort = "19644" // default
+	// Every known target is an output; one of them receives playback at a time
+	listTargets := func() ([]memoryplay.TargetInfo, error) {
+		if useNative {
+			return memoryplay.ListTargetsNative(b.hostIP, b.hostIfNum)
 		}
-		targetName = preferredTarget.Name
+		return memoryplay.ListTargets(b.hostIP, b.hostIfNum)
+	}
+	b.outputs = DiscoverOutputs(listTargets, cfg)
+	active, err := SelectOutput(b.outputs, cfg)
+	if err != nil {
+		b.Close()
+		return nil, fmt.Errorf("target selection failed: %w", err)
+	}
+	b.active = active
 
-		// Parse interface number from string
-		var ifNum uint32
-		_, err := fmt.Sscanf(preferredTarget.Interface, "%d", &ifNum)
-		if err != nil {
-			return nil, err
-		}
-		targetIf = ifNum
+	log.Printf("Using target: %s (IP: %s,%s%%%s)",
+		b.outputs[active].Name, b.outputs[active].IP, b.outputs[active].Port, b.outputs[active].Interface)
 
-		log.Printf("Using configured target: %s (IP: %s,%s%%%d)",
-			targetName, targetIP, targetPort, targetIf)
-	}
+	return b, nil
+}
 
-	return &Backend{
-		cache:      cache,
-		config:     cfg,
-		hostIP:     hostIP,
-		hostIfNum:  hostIfNum,
-		targetIP:   targetIP,
-		targetPort: targetPort,
-		targetName: targetName,
-		targetIf:   targetIf,
-		useNative:  useNative,
-	}, nil
+// seconds converts a configured number of seconds to a duration
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
 }
 
 // Connect establishes the session to the MemoryPlay host
 func (b *Backend) Connect() error {
 	// Lazily create the client on first connect
 	// This ensures upload happens before client connection is established
-	if b.client == nil {
-		log.Printf("Creating MemoryPlay client for target: %s (native: %v)", b.targetName, b.useNative)
-	}
-
 	if b.client != nil {
 		if err := b.client.Connect(); err != nil {
 			return fmt.Errorf("failed to connect to MemoryPlay: %w", err)
@@ -145,76 +154,550 @@ func (b *Backend) Disconnect() error {
 // Close cleans up the backend resources
 func (b *Backend) Close() {
 	log.Printf("Cleaning up MemoryPlay backend")
-	memoryplay.CleanupLibrary()
+	b.cancelUpload()
+	if b.library {
+		memoryplay.CleanupLibrary()
+	}
 }
 
 // PrepareTrack fetches, decodes, and uploads a track for playback
 func (b *Backend) PrepareTrack(track *playlist.Track) error {
-	log.Printf("Preparing track: %s", track.URL)
+	return b.PrepareTracks([]*playlist.Track{track})
+}
 
-	// Fetch and decode to cached WAV file
-	wavPath, err := b.fetchDecodeAndCache(track)
+// PrepareTracks fetches, decodes, and uploads tracks as one upload so the host
+// plays them back-to-back without gaps
+// All tracks must decode to the same audio format
+func (b *Backend) PrepareTracks(tracks []*playlist.Track) error {
+	if len(tracks) == 0 {
+		return fmt.Errorf("no tracks to prepare")
+	}
+	return b.upload(tracks, 0, 0)
+}
+
+// upload decodes and uploads tracks[first:], starting startAt seconds into tracks[first]
+// Earlier tracks keep their place in the layout with no length, so track
+// indices stay the same as for the full upload
+func (b *Backend) upload(tracks []*playlist.Track, first int, startAt float64) error {
+
+	output := b.activeOutput()
+	if output < 0 {
+		return fmt.Errorf("no output enabled")
+	}
+
+	// Whatever is left of the previous upload is replaced by this one
+	b.cancelUpload()
+	b.switchOutput(output)
+
+	// Temporary files are only needed until the upload is done, which may be
+	// after this returns when the upload carries on in the background
+	var temps []string
+	var stream io.ReadCloser // The first track, read while it is decoded
+	defer func() {
+		if b.pending != nil {
+			go b.watchUpload(b.pending, tracks[first:], temps, stream)
+			return
+		}
+		if stream != nil {
+			stream.Close()
+		}
+		removeFiles(temps)
+	}()
+
+	paths := make([]string, len(tracks))
+	starts := make([]float64, len(tracks)) // Seconds of each track already mixed into the previous one, or skipped
+	for i := first; i < len(tracks); i++ {
+		track := tracks[i]
+		log.Printf("Preparing track: %s", track.URL)
+
+		if i == first && b.streamsFirst(tracks, first) {
+			if startAt <= 0 {
+				log.Printf("Uploading while decoding: %s", track.URL)
+				stream = b.cache.StreamDecoded(context.Background(), track.URL, b.Capabilities().StreamDecoder())
+				continue
+			}
+			// A FLAC file is decoded from the position instead of decoded whole and trimmed
+			if pcm, err := decoder.DecodeStreamAt(track.URL, b.Capabilities().FormatLimits(), startAt); err == nil {
+				log.Printf("Uploading from %.3f seconds while decoding: %s", startAt, track.URL)
+				stream = pcm.WAV()
+				starts[i] = startAt
+				continue
+			}
+		}
+
+		path, temp, err := b.trackPath(track)
+		if err != nil {
+			return err
+		}
+		if temp {
+			temps = append(temps, path)
+		}
+		paths[i] = path
+	}
+
+	durations := trackDurations(tracks)
+
+	// Mix the tail of each track with the head of the next
+	if crossfade := b.crossfadeSeconds(); crossfade > 0 && len(tracks) > 1 {
+		fades := crossfadeLengths(durations, crossfade)
+		// DSD passed through natively cannot be mixed
+		for i := first; i < len(fades); i++ {
+			if isDSD(paths[i]) || isDSD(paths[i+1]) {
+				fades[i] = 0
+			}
+		}
+		for i := first; i < len(paths); i++ {
+			next, fade := "", 0.0
+			if i+1 < len(paths) {
+				next, fade = paths[i+1], fades[i]
+			}
+			if i > 0 {
+				starts[i] = fades[i-1]
+			}
+			if starts[i] == 0 && fade == 0 {
+				continue
+			}
+
+			mixed, err := crossfadeTrack(paths[i], next, starts[i], fade)
+			if err != nil {
+				return fmt.Errorf("failed to crossfade: %w", err)
+			}
+			temps = append(temps, mixed)
+			paths[i] = mixed
+		}
+	}
+
+	// Cut the first track at the requested position on a sample boundary
+	if startAt > starts[first] {
+		trimmed, err := trimTrack(paths[first], startAt-starts[first])
+		if err != nil {
+			return fmt.Errorf("failed to trim track: %w", err)
+		}
+		temps = append(temps, trimmed)
+		paths[first] = trimmed
+		starts[first] = startAt
+	}
+
+	log.Printf("Uploading %d track(s) to MemoryPlay host...", len(paths)-first)
+	var err error
+	if b.useNative {
+		err = b.uploadNative(tracks[first:], first, paths[first:], stream)
+	} else {
+		err = b.uploadLibrary(tracks[first:], paths[first:])
+	}
 	if err != nil {
-		return fmt.Errorf("failed to fetch and decode: %w", err)
+		return err
 	}
 
-	log.Printf("Using WAV file: %s", wavPath)
+	b.ensureClient(output)
+
+	// Lay out the tracks on the upload's timeline
+	b.prepared = tracks
+	b.trackOffsets = make([]float64, len(tracks))
+	b.trackStarts = starts
+	b.trackDurations = durations
+	var offset float64
+	for i := first; i < len(tracks); i++ {
+		b.trackOffsets[i] = offset
+		offset += durations[i] - starts[i]
+	}
+	b.totalDuration = offset
 
-	// Open WAV file with C library
-	wavFile, err := memoryplay.OpenWavFile(wavPath)
+	return nil
+}
+
+// PrepareStream uploads audio with no end, such as internet radio, while it arrives
+// Only the native upload can send a stream; it returns once the pre-roll is on
+// the host (streamPreroll seconds when host.preroll_seconds is unset)
+func (b *Backend) PrepareStream(track *playlist.Track, stream io.ReadCloser) error {
+	if !b.useNative {
+		stream.Close()
+		return fmt.Errorf("playing a stream needs host.native")
+	}
+	output := b.activeOutput()
+	if output < 0 {
+		stream.Close()
+		return fmt.Errorf("no output enabled")
+	}
+
+	b.cancelUpload()
+	b.switchOutput(output)
+
+	preroll := b.config.Host.Preroll
+	if preroll <= 0 {
+		preroll = streamPreroll
+	}
+	title := track.Metadata["name"]
+	if title == "" {
+		title = track.URL
+	}
+
+	log.Printf("Uploading stream to MemoryPlay host: %s", track.URL)
+	uploads := []memoryplay.UploadTrack{{Stream: stream, Index: 1, Title: title}}
+	upload, err := memoryplay.StartUploadNative(b.hostIP, b.hostIfNum, uploads, preroll)
 	if err != nil {
-		// Invalidate cache - file may be corrupt
-		if invalidateErr := b.cache.Invalidate(track.URL); invalidateErr != nil {
-			log.Printf("Warning: failed to invalidate cache: %v", invalidateErr)
+		stream.Close()
+		return fmt.Errorf("failed to upload stream: %w", err)
+	}
+	b.pending = upload
+	go b.watchUpload(upload, nil, nil, stream)
+
+	b.ensureClient(output)
+
+	b.live = stream
+	b.prepared = []*playlist.Track{track}
+	b.trackOffsets = []float64{0}
+	b.trackStarts = []float64{0}
+	b.trackDurations = []float64{0}
+	b.totalDuration = 0
+	return nil
+}
+
+// streamPreroll is the audio buffered on the host before a stream starts playing,
+// in seconds, when no pre-roll is configured
+const streamPreroll = 2
+
+// switchOutput moves playback to a newly enabled output with the next upload
+func (b *Backend) switchOutput(output int) {
+	if b.client == nil || b.clientOutput == output {
+		return
+	}
+	log.Printf("Switching output from %s to %s", b.outputs[b.clientOutput].Name, b.outputs[output].Name)
+	// Quit the old target's session so it falls silent before the new one starts
+	if err := b.client.Quit(); err != nil {
+		log.Printf("Warning: failed to quit session on %s: %v", b.outputs[b.clientOutput].Name, err)
+	}
+	b.client.Disconnect()
+	b.client = nil
+}
+
+// ensureClient creates the client for an output if there is none yet
+func (b *Backend) ensureClient(output int) {
+	if b.client != nil {
+		return
+	}
+	target := b.outputs[output]
+	log.Printf("Creating MemoryPlay client for target: %s (native: %v)", target.Name, b.useNative)
+	b.client = memoryplay.NewClient(b.hostIP, &target, b.useNative)
+	b.clientOutput = output
+}
+
+// uploadNative uploads WAV files with the pure Go implementation
+// Tracks are numbered from first+1, so a partial upload after a seek keeps
+// the numbers the host showed for the whole group
+// With a pre-roll set it returns once that much audio is on the host and
+// leaves the rest of the upload pending
+// A stream, if given, replaces the first file and is read as it is decoded
+func (b *Backend) uploadNative(tracks []*playlist.Track, first int, paths []string, stream io.Reader) error {
+	uploads := make([]memoryplay.UploadTrack, len(paths))
+	for i, path := range paths {
+		title := tracks[i].Metadata["title"]
+		if title == "" {
+			title = tracks[i].URL
 		}
-		return fmt.Errorf("failed to open WAV file: %w", err)
+		uploads[i] = memoryplay.UploadTrack{Path: path, Index: first + i + 1, Title: title}
+		if i == 0 && stream != nil {
+			uploads[i].Stream = stream
+			continue
+		}
+		log.Printf("Using WAV file: %s", path)
 	}
-	defer wavFile.Close()
 
-	// Get format handle from WAV file
-	formatHandle, err := wavFile.GetFormat()
+	upload, err := memoryplay.StartUploadNative(b.hostIP, b.hostIfNum, uploads, b.config.Host.Preroll)
 	if err != nil {
-		// Invalidate cache - file may be corrupt
-		if invalidateErr := b.cache.Invalidate(track.URL); invalidateErr != nil {
-			log.Printf("Warning: failed to invalidate cache: %v", invalidateErr)
+		// Invalidate cache - file may be corrupt or incompatible
+		for _, track := range tracks {
+			b.invalidate(track)
 		}
+		return fmt.Errorf("failed to upload audio: %w", err)
+	}
+	if !upload.Finished() {
+		log.Printf("Pre-roll of %.1f seconds uploaded, uploading the rest in the background", upload.BufferedSeconds())
+		b.pending = upload
+	}
+	return nil
+}
+
+// watchUpload waits for a background upload to finish and removes its temporary files
+// A stream the upload read from is closed, leaving its decode to finish the cache file
+func (b *Backend) watchUpload(upload *memoryplay.Upload, tracks []*playlist.Track, temps []string, stream io.Closer) {
+	err := upload.Wait()
+	if stream != nil {
+		stream.Close()
+	}
+	removeFiles(temps)
+	if err == nil || errors.Is(err, memoryplay.ErrUploadCancelled) {
+		return
+	}
+
+	log.Printf("Background upload failed: %v", err)
+	for _, track := range tracks {
+		b.invalidate(track)
+	}
+}
+
+// cancelUpload abandons a background upload that is still running
+// A stream is closed first, as the upload may be waiting for it to send more
+func (b *Backend) cancelUpload() {
+	if b.live != nil {
+		b.live.Close()
+		b.live = nil
+	}
+	if b.pending != nil {
+		b.pending.Cancel()
+		b.pending = nil
+	}
+}
+
+// uploadedDuration returns the seconds of audio on the host
+// Until a background upload finishes that is what it has sent so far, and
+// for a stream, whose length is never known up front, it always is
+func (b *Backend) uploadedDuration() float64 {
+	if b.pending != nil && (!b.pending.Finished() || b.live != nil) {
+		return b.pending.BufferedSeconds()
+	}
+	return b.totalDuration
+}
+
+// removeFiles deletes temporary files
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// uploadLibrary uploads WAV files with the C library
+func (b *Backend) uploadLibrary(tracks []*playlist.Track, paths []string) error {
+	wavFiles := make([]*memoryplay.WavFile, 0, len(paths))
+	defer func() {
+		for _, wavFile := range wavFiles {
+			wavFile.Close()
+		}
+	}()
+
+	for i, path := range paths {
+		log.Printf("Using WAV file: %s", path)
+
+		// Open WAV file with C library
+		wavFile, err := memoryplay.OpenWavFile(path)
+		if err != nil {
+			// Invalidate cache - file may be corrupt
+			b.invalidate(tracks[i])
+			return fmt.Errorf("failed to open WAV file: %w", err)
+		}
+		wavFiles = append(wavFiles, wavFile)
+	}
+
+	// Get format handle from the first WAV file
+	formatHandle, err := wavFiles[0].GetFormat()
+	if err != nil {
+		// Invalidate cache - file may be corrupt
+		b.invalidate(tracks[0])
 		return fmt.Errorf("failed to get format: %w", err)
 	}
 	defer memoryplay.FreeFormat(formatHandle)
 
-	// Upload audio to MemoryPlay host
-	log.Printf("Uploading audio to MemoryPlay host...")
-
-	if err := memoryplay.UploadAudio(b.hostIP, b.hostIfNum, []*memoryplay.WavFile{wavFile}, formatHandle, false); err != nil {
+	if err := memoryplay.UploadAudio(b.hostIP, b.hostIfNum, wavFiles, formatHandle, false); err != nil {
 		// Invalidate cache - file may be corrupt or incompatible
-		if invalidateErr := b.cache.Invalidate(track.URL); invalidateErr != nil {
-			log.Printf("Warning: failed to invalidate cache: %v", invalidateErr)
+		for _, track := range tracks {
+			b.invalidate(track)
 		}
 		return fmt.Errorf("failed to upload audio: %w", err)
 	}
+	return nil
+}
+
+// streamsFirst reports whether tracks[first] can be uploaded while it is decoded
+// That takes the native upload, a track not in the cache yet, and nothing to
+// apply to the decoded file: no gain or crossfade. A start position is only
+// reached that way by FLAC files (see decoder.DecodeStreamAt)
+func (b *Backend) streamsFirst(tracks []*playlist.Track, first int) bool {
+	if !b.useNative || (b.crossfadeSeconds() > 0 && len(tracks) > 1) {
+		return false
+	}
 
-	// Create client if not already created
-	if b.client == nil {
-		mpTarget := &memoryplay.Target{
-			Name:      b.targetName,
-			IP:        b.targetIP,
-			Port:      b.targetPort,
-			Interface: fmt.Sprintf("%d", b.targetIf),
+	// Gain goes first, as working it out may decode the track
+	track := tracks[first]
+	if b.gainFunc != nil && b.gainFunc(track) != 0 {
+		return false
+	}
+	_, err := os.Stat(b.cache.GetPathForKey(track.URL))
+	return os.IsNotExist(err)
+}
+
+// trackPath decodes a track into the cache and applies its software gain
+// Returns the file to upload and whether it is a temporary copy
+func (b *Backend) trackPath(track *playlist.Track) (string, bool, error) {
+	// Fetch and decode to cached WAV file
+	wavPath, err := b.fetchDecodeAndCache(track)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to fetch and decode: %w", err)
+	}
+
+	// Apply software gain to a temporary copy so the cache keeps the decoded original
+	// DSD passed through natively has no PCM to scale, so it plays as it is
+	if b.gainFunc != nil && !isDSD(wavPath) {
+		if gainDB := b.gainFunc(track); gainDB != 0 {
+			gainPath, err := applyGain(wavPath, gainDB)
+			if err != nil {
+				return "", false, fmt.Errorf("failed to apply gain: %w", err)
+			}
+			return gainPath, true, nil
 		}
-		b.client = memoryplay.NewClient(b.hostIP, mpTarget, b.useNative)
 	}
 
-	// Get track duration from metadata
-	if durationStr, ok := track.Metadata["duration"]; ok && durationStr != "" {
-		// Parse duration as float and convert to integer seconds
-		var durationSec float64
-		if _, err := fmt.Sscanf(durationStr, "%f", &durationSec); err == nil {
-			b.currentTrackDuration = int64(durationSec)
-			log.Printf("Track duration: %d seconds (from metadata)", int64(durationSec))
+	return wavPath, false, nil
+}
+
+// trackDurations returns each track's duration in seconds from its metadata (0 if unknown)
+func trackDurations(tracks []*playlist.Track) []float64 {
+	durations := make([]float64, len(tracks))
+	for i, track := range tracks {
+		if durationStr, ok := track.Metadata["duration"]; ok && durationStr != "" {
+			// Parse duration as float seconds
+			if _, err := fmt.Sscanf(durationStr, "%f", &durations[i]); err == nil {
+				log.Printf("Track duration: %d seconds (from metadata)", int64(durations[i]))
+			}
 		}
 	}
+	return durations
+}
 
-	return nil
+// crossfadeLengths returns the fade in seconds between each track and the next
+// A pair is not faded when either track is too short to give up that much of itself
+func crossfadeLengths(durations []float64, seconds float64) []float64 {
+	fades := make([]float64, len(durations)-1)
+	var start float64
+	for i := range fades {
+		if durations[i]-start > seconds && durations[i+1] > 2*seconds {
+			fades[i] = seconds
+		}
+		start = fades[i]
+	}
+	return fades
+}
+
+// crossfadeTrack writes the crossfaded version of a track to a temporary file
+// Returns the temporary file path; the caller removes it once uploaded
+func crossfadeTrack(wavPath, nextPath string, skip, fade float64) (string, error) {
+	tmp, err := os.CreateTemp("", "direttampd-xfade-*.wav")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+
+	if err := decoder.CrossfadeTrack(wavPath, nextPath, skip, fade, tmp.Name()); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// trimTrack writes a copy of a track starting seconds into it to a temporary file
+// DSD passed through natively is cut to a DFF file, everything else to WAV
+// Returns the temporary file path; the caller removes it once uploaded
+func trimTrack(wavPath string, seconds float64) (string, error) {
+	trim, pattern := decoder.TrimWAV, "direttampd-seek-*.wav"
+	if isDSD(wavPath) {
+		trim, pattern = decoder.TrimDSD, "direttampd-seek-*.dff"
+	}
+
+	tmp, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+
+	if err := trim(wavPath, tmp.Name(), seconds); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// isDSD reports whether a decoded file holds DSD passed through natively rather than WAV
+func isDSD(path string) bool {
+	_, err := decoder.ReadDSDFile(path)
+	return err == nil
+}
+
+// invalidate drops a track's decoded file from the cache so it is decoded again next time
+func (b *Backend) invalidate(track *playlist.Track) {
+	if err := b.cache.Invalidate(track.URL); err != nil {
+		log.Printf("Warning: failed to invalidate cache: %v", err)
+	}
+}
+
+// SetGainFunc sets the function giving the software gain in dB for each prepared track
+func (b *Backend) SetGainFunc(gain func(track *playlist.Track) float64) {
+	b.gainFunc = gain
+}
+
+// applyGain writes a gain-adjusted copy of a cached WAV file to a temporary file
+// Returns the temporary file path; the caller removes it once uploaded
+func applyGain(wavPath string, gainDB float64) (string, error) {
+	tmp, err := os.CreateTemp("", "direttampd-gain-*.wav")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+
+	log.Printf("Applying %.2f dB gain", gainDB)
+	if err := decoder.ApplyGain(wavPath, tmp.Name(), gainDB); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// SetCrossfade sets how many seconds consecutive tracks in an upload overlap
+func (b *Backend) SetCrossfade(seconds float64) {
+	b.crossfade.Store(math.Float64bits(seconds))
+}
+
+// crossfadeSeconds returns the crossfade length SetCrossfade last set
+func (b *Backend) crossfadeSeconds() float64 {
+	return math.Float64frombits(b.crossfade.Load())
+}
+
+// CurrentTrack returns the index into the prepared tracks of the one playing
+// Returns 0 when the position is unknown
+func (b *Backend) CurrentTrack() int {
+	position, ok := b.uploadPosition()
+	if !ok {
+		return 0
+	}
+	return b.trackAt(position)
+}
+
+// uploadPosition returns the playback position in seconds within the whole upload
+// The host reports time remaining until the end of everything uploaded
+func (b *Backend) uploadPosition() (float64, bool) {
+	if b.client == nil {
+		return 0, false
+	}
+
+	remaining, err := b.client.GetCurrentTime()
+	if err != nil || remaining == -1 {
+		return 0, false
+	}
+
+	position := b.uploadedDuration() - float64(remaining)
+	if position < 0 {
+		position = 0
+	}
+	return position, true
+}
+
+// trackAt returns the index of the prepared track playing at position in the upload
+func (b *Backend) trackAt(position float64) int {
+	index := 0
+	for i, offset := range b.trackOffsets {
+		if position >= offset {
+			index = i
+		}
+	}
+	return index
 }
 
 // StartPlayback connects the session and starts playback
@@ -250,17 +733,24 @@ func (b *Backend) Pause() error {
 
 // Quit quits the current playback session
 func (b *Backend) Stop() error {
+	b.cancelUpload()
 	if b.client != nil {
 		return b.client.Quit()
 	}
 	return nil
 }
 
-// Seek seeks to an absolute position in seconds
-func (b *Backend) Seek(positionSeconds int64) error {
-	if b.client == nil {
+// Seek seeks to an absolute position in seconds within the playing track
+// Rather than asking the host to seek, which is coarse and does not survive
+// reconnects, the rest of the upload is sent again starting at the exact
+// sample frame; playback resumes from there
+func (b *Backend) Seek(position float64) error {
+	if b.client == nil || len(b.prepared) == 0 {
 		return fmt.Errorf("no client available")
 	}
+	if b.live != nil {
+		return fmt.Errorf("cannot seek in a stream")
+	}
 
 	// Set seeking flag to prevent track completion detection during seek
 	b.seekMu.Lock()
@@ -273,13 +763,28 @@ func (b *Backend) Seek(positionSeconds int64) error {
 		b.seekMu.Unlock()
 	}()
 
-	// Perform the seek
-	if err := b.client.SeekAbsolute(positionSeconds); err != nil {
+	// The upload is cut from the track playing now
+	index := 0
+	if uploaded, ok := b.uploadPosition(); ok {
+		index = b.trackAt(uploaded)
+	}
+	if position < 0 {
+		position = 0
+	}
+
+	log.Printf("Seeking to %.3f seconds by uploading again from track %d", position, index)
+	if err := b.Stop(); err != nil {
+		log.Printf("Warning: failed to stop session before seek: %v", err)
+	}
+	if err := b.upload(b.prepared, index, position); err != nil {
+		return err
+	}
+	if err := b.StartPlayback(); err != nil {
 		return err
 	}
 
 	// Wait for time reporting to resume after seek
-	// (MemoryPlay temporarily returns -1 during seek operation)
+	// (MemoryPlay returns -1 until the new upload starts playing)
 	maxRetries := 50 // 50 * 100ms = 5 seconds max wait
 	for i := 0; i < maxRetries; i++ {
 		time.Sleep(100 * time.Millisecond)
@@ -301,13 +806,21 @@ func (b *Backend) Seek(positionSeconds int64) error {
 
 // GetTrackDuration returns the total duration of the current track in seconds
 func (b *Backend) GetTrackDuration() (int64, error) {
-	if b.currentTrackDuration == 0 {
+	if len(b.trackDurations) == 0 {
 		return 0, fmt.Errorf("no track duration available")
 	}
-	return b.currentTrackDuration, nil
+
+	index := 0
+	if position, ok := b.uploadPosition(); ok {
+		index = b.trackAt(position)
+	}
+	if b.trackDurations[index] == 0 {
+		return 0, fmt.Errorf("no track duration available")
+	}
+	return int64(b.trackDurations[index]), nil
 }
 
-// GetElapsedTime returns the elapsed time in seconds
+// GetElapsedTime returns the elapsed time in seconds within the current track
 func (b *Backend) GetElapsedTime() (int64, error) {
 	if b.client == nil {
 		return -1, fmt.Errorf("no client available")
@@ -325,11 +838,18 @@ func (b *Backend) GetElapsedTime() (int64, error) {
 	}
 
 	// Calculate elapsed from duration - remaining
-	if b.currentTrackDuration == 0 {
+	// A stream has no duration; it is as long as what has been uploaded so far
+	if b.totalDuration == 0 && b.live == nil {
 		return -1, fmt.Errorf("no track duration available")
 	}
 
-	elapsed := b.currentTrackDuration - remaining
+	position := b.uploadedDuration() - float64(remaining)
+	if position < 0 {
+		position = 0
+	}
+
+	index := b.trackAt(position)
+	elapsed := int64(position - b.trackOffsets[index] + b.trackStarts[index])
 	if elapsed < 0 {
 		elapsed = 0
 	}
@@ -358,10 +878,47 @@ func (b *Backend) IsTrackComplete() (bool, error) {
 		return false, err
 	}
 
-	// Track is complete when GetCurrentTime returns -1
+	// Track is complete when GetCurrentTime returns -1, unless the host ran
+	// dry while the rest of the upload is still on its way
+	if remaining == -1 && b.pending != nil && !b.pending.Finished() {
+		return false, nil
+	}
 	return remaining == -1, nil
 }
 
+// CheckHealth probes the session with a play status request
+// Before a session is opened there is nothing to probe; a session that is
+// closed, as a failed Reconnect leaves it, is not healthy
+func (b *Backend) CheckHealth() error {
+	if b.client == nil {
+		return nil
+	}
+	if !b.client.IsConnected() {
+		return errors.New("not connected")
+	}
+	_, err := b.client.GetPlayStatus()
+	return err
+}
+
+// Reconnect replaces the session to the host with a new one
+// The target is selected again when playback next starts
+func (b *Backend) Reconnect() error {
+	if b.client == nil {
+		return nil
+	}
+	b.client.Disconnect()
+	return b.Connect()
+}
+
+// StatusChanged returns a channel closed when the host next reports a status change
+// Only the native session follows the host's status; otherwise it is nil
+func (b *Backend) StatusChanged() <-chan struct{} {
+	if b.client == nil {
+		return nil
+	}
+	return b.client.StatusChanged()
+}
+
 // SelectTarget connects to the target device
 func (b *Backend) SelectTarget() error {
 	if b.client != nil {
@@ -370,6 +927,28 @@ func (b *Backend) SelectTarget() error {
 	return fmt.Errorf("no client available")
 }
 
+// Capabilities reports what MemoryPlay uploads carry
+// Uploads are integer PCM WAV in the track's own rate; the target negotiates
+// the rest with the host. The C library reads DSF and DFF files itself, so
+// DSD goes natively through it; the native upload sends PCM or DoP
+// Resampling, sample size, channels and downmixing follow the enabled target's settings
+func (b *Backend) Capabilities() backends.Capabilities {
+	return targetCapabilities(b.config, b.GetOutputName(), b.useNative)
+}
+
+// targetCapabilities returns what uploads to the named target carry under its settings
+func targetCapabilities(cfg *config.Config, target string, native bool) backends.Capabilities {
+	return backends.Capabilities{
+		BitDepths: []int{16, 24, 32},
+		DSD:       !native,
+		MultiFile: true,
+		Gapless:   true,
+	}.WithDSDMode(cfg.Playback.DSDMode).
+		WithResampling(cfg.ResampleFor(target)).
+		WithOutputFormat(cfg.OutputFormatFor(target)).
+		WithDownmix(cfg.DownmixFor(target))
+}
+
 // GetBackendName returns the name of this backend
 func (b *Backend) GetBackendName() string {
 	return "MemoryPlay"
@@ -377,17 +956,54 @@ func (b *Backend) GetBackendName() string {
 
 // GetOutputName returns the name of the output device
 func (b *Backend) GetOutputName() string {
-	return b.targetName
+	output := b.activeOutput()
+	if output < 0 {
+		return ""
+	}
+	return b.outputs[output].Name
+}
+
+// Outputs returns every target playback can be sent to
+func (b *Backend) Outputs() []backends.Output {
+	active := b.activeOutput()
+	outputs := make([]backends.Output, len(b.outputs))
+	for i, target := range b.outputs {
+		outputs[i] = backends.Output{Name: target.Name, Enabled: i == active}
+	}
+	return outputs
+}
+
+// EnableOutput enables or disables an output by index
+// Only one target plays at a time, so enabling an output disables the others
+// The switch takes effect from the next upload
+func (b *Backend) EnableOutput(index int, enabled bool) error {
+	if index < 0 || index >= len(b.outputs) {
+		return fmt.Errorf("no such output: %d", index)
+	}
+
+	b.outputMu.Lock()
+	defer b.outputMu.Unlock()
+
+	if enabled {
+		b.active = index
+	} else if b.active == index {
+		b.active = -1
+	}
+	return nil
+}
+
+// activeOutput returns the index of the enabled output, -1 if none
+func (b *Backend) activeOutput() int {
+	b.outputMu.Lock()
+	defer b.outputMu.Unlock()
+	return b.active
 }
 
 // fetchDecodeAndCache fetches and decodes audio directly to a WAV file in the cache
 // Returns the WAV file path
 func (b *Backend) fetchDecodeAndCache(track *playlist.Track) (string, error) {
 	log.Printf("Fetching and decoding track: %s", track.URL)
-	cachePath, err := b.cache.EnsureDecoded(track.URL, func(source, dest string) error {
-		_, err := decoder.DecodeToWAVFile(source, dest)
-		return err
-	})
+	cachePath, err := b.cache.EnsureDecoded(context.Background(), track.URL, b.Capabilities().Decoder())
 	if err != nil {
 		return "", err
 	}
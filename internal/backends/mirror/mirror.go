@@ -0,0 +1,435 @@
+package mirror
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/famish99/direttampd/internal/backends"
+	"github.com/famish99/direttampd/internal/cache"
+	"github.com/famish99/direttampd/internal/config"
+	"github.com/famish99/direttampd/internal/playlist"
+)
+
+func init() {
+	backends.Register("mirror", func(cache *cache.DiskCache, cfg *config.Config) (backends.PlaybackBackend, error) {
+		return New(cache, cfg)
+	})
+	backends.RegisterCapabilities("mirror", configCapabilities)
+}
+
+// output is one mirrored backend and whether it receives playback
+type output struct {
+	name     string
+	backend  backends.PlaybackBackend
+	enabled  bool
+	uploaded bool // Took part in the current upload
+}
+
+// Backend implements the backends.PlaybackBackend interface by playing the
+// same tracks on several backends at once, e.g. Diretta targets in different rooms
+// Each mirrored backend is an MPD output that can be enabled on its own.
+// Tracks are prepared on every enabled output before any starts, then all
+// are started together, which aligns them as closely as their start latency allows.
+// Until the next upload, playback is controlled on the outputs that took part
+// in the current one, the first of which is the leader whose position the player follows
+type Backend struct {
+	mu      sync.Mutex
+	outputs []*output
+}
+
+// New creates the backends listed under mirror in the config
+// Each gets a copy of the config with its target as the preferred one
+func New(cache *cache.DiskCache, cfg *config.Config) (*Backend, error) {
+	if len(cfg.Mirror) == 0 {
+		return nil, fmt.Errorf("no mirror outputs configured")
+	}
+
+	b := &Backend{}
+	for _, mirrored := range cfg.Mirror {
+		if mirrored.Backend == "mirror" {
+			b.Close()
+			return nil, fmt.Errorf("mirror outputs cannot be mirrors themselves")
+		}
+
+		backend, err := backends.New(mirrored.Backend, cache, outputConfig(cfg, mirrored))
+		if err != nil {
+			b.Close()
+			return nil, fmt.Errorf("mirror output %q: %w", mirrored.Target, err)
+		}
+
+		name := mirrored.Target
+		if name == "" {
+			name = backend.GetOutputName()
+		}
+		log.Printf("Mirroring to %s (%s)", name, backend.GetBackendName())
+		b.outputs = append(b.outputs, &output{name: name, backend: backend, enabled: true})
+	}
+	return b, nil
+}
+
+// outputConfig returns a copy of the config for a mirrored output, with its
+// target as the preferred one
+func outputConfig(cfg *config.Config, mirrored config.MirrorOutput) *config.Config {
+	outputCfg := *cfg
+	outputCfg.Backend = mirrored.Backend
+	if mirrored.Target != "" {
+		outputCfg.PreferredTarget = mirrored.Target
+	}
+	return &outputCfg
+}
+
+// enabled returns the outputs receiving playback
+func (b *Backend) enabled() []backends.PlaybackBackend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var enabled []backends.PlaybackBackend
+	for _, out := range b.outputs {
+		if out.enabled {
+			enabled = append(enabled, out.backend)
+		}
+	}
+	return enabled
+}
+
+// playing returns the enabled outputs that took part in the current upload
+// An output enabled since joins with the next upload, having nothing to play until then
+func (b *Backend) playing() []backends.PlaybackBackend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var playing []backends.PlaybackBackend
+	for _, out := range b.outputs {
+		if out.enabled && out.uploaded {
+			playing = append(playing, out.backend)
+		}
+	}
+	return playing
+}
+
+// leader returns the output whose position the player follows, nil if none is playing
+func (b *Backend) leader() backends.PlaybackBackend {
+	if playing := b.playing(); len(playing) > 0 {
+		return playing[0]
+	}
+	return nil
+}
+
+// each runs fn on every enabled output at once and returns the first error
+func (b *Backend) each(fn func(backend backends.PlaybackBackend) error) error {
+	return eachOf(b.enabled(), fn)
+}
+
+// eachPlaying runs fn on every output of the current upload at once and returns the first error
+func (b *Backend) eachPlaying(fn func(backend backends.PlaybackBackend) error) error {
+	return eachOf(b.playing(), fn)
+}
+
+// eachOf runs fn on every one of outputs at once and returns the first error
+func eachOf(outputs []backends.PlaybackBackend, fn func(backend backends.PlaybackBackend) error) error {
+	errs := make([]error, len(outputs))
+
+	var wg sync.WaitGroup
+	for i, backend := range outputs {
+		wg.Add(1)
+		go func(i int, backend backends.PlaybackBackend) {
+			defer wg.Done()
+			errs[i] = fn(backend)
+		}(i, backend)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("%s: %w", outputs[i].GetOutputName(), err)
+		}
+	}
+	return nil
+}
+
+// Close cleans up every mirrored backend
+func (b *Backend) Close() {
+	for _, out := range b.outputs {
+		out.backend.Close()
+	}
+}
+
+// PrepareTrack prepares a track on every enabled output
+func (b *Backend) PrepareTrack(track *playlist.Track) error {
+	return b.PrepareTracks([]*playlist.Track{track})
+}
+
+// PrepareTracks prepares tracks on every enabled output, which make up the new upload
+func (b *Backend) PrepareTracks(tracks []*playlist.Track) error {
+	b.mu.Lock()
+	for _, out := range b.outputs {
+		out.uploaded = out.enabled
+	}
+	b.mu.Unlock()
+
+	if len(b.enabled()) == 0 {
+		return fmt.Errorf("no output enabled")
+	}
+	return b.each(func(backend backends.PlaybackBackend) error {
+		return backend.PrepareTracks(tracks)
+	})
+}
+
+// StartPlayback starts every output of the upload at the same moment
+// Preparation is already done, so what remains is each backend's own start latency
+func (b *Backend) StartPlayback() error {
+	enabled := b.playing()
+	if len(enabled) == 0 {
+		return fmt.Errorf("no output enabled")
+	}
+
+	start := make(chan struct{})
+	started := make([]time.Time, len(enabled))
+	errs := make([]error, len(enabled))
+
+	var wg sync.WaitGroup
+	for i, backend := range enabled {
+		wg.Add(1)
+		go func(i int, backend backends.PlaybackBackend) {
+			defer wg.Done()
+			<-start
+			errs[i] = backend.StartPlayback()
+			started[i] = time.Now()
+		}(i, backend)
+	}
+	close(start)
+	wg.Wait()
+
+	first, last := started[0], started[0]
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("%s: %w", enabled[i].GetOutputName(), err)
+		}
+		if started[i].Before(first) {
+			first = started[i]
+		}
+		if started[i].After(last) {
+			last = started[i]
+		}
+	}
+	log.Printf("Started %d mirrored output(s) within %v", len(enabled), last.Sub(first))
+	return nil
+}
+
+// CurrentTrack returns the index of the track the leader is playing
+func (b *Backend) CurrentTrack() int {
+	if leader := b.leader(); leader != nil {
+		return leader.CurrentTrack()
+	}
+	return 0
+}
+
+// SetGainFunc sets the software gain function on every output
+func (b *Backend) SetGainFunc(gain func(track *playlist.Track) float64) {
+	for _, out := range b.outputs {
+		out.backend.SetGainFunc(gain)
+	}
+}
+
+// SetCrossfade sets the crossfade length on every output
+func (b *Backend) SetCrossfade(seconds float64) {
+	for _, out := range b.outputs {
+		out.backend.SetCrossfade(seconds)
+	}
+}
+
+// Play resumes playback on every output of the upload
+func (b *Backend) Play() error {
+	return b.eachPlaying(backends.PlaybackBackend.Play)
+}
+
+// Pause pauses playback on every output of the upload
+func (b *Backend) Pause() error {
+	return b.eachPlaying(backends.PlaybackBackend.Pause)
+}
+
+// Stop stops playback on every enabled output
+func (b *Backend) Stop() error {
+	return b.each(backends.PlaybackBackend.Stop)
+}
+
+// Seek seeks every output of the upload to the same position
+func (b *Backend) Seek(position float64) error {
+	return b.eachPlaying(func(backend backends.PlaybackBackend) error {
+		return backend.Seek(position)
+	})
+}
+
+// GetTrackDuration returns the duration of the leader's current track
+func (b *Backend) GetTrackDuration() (int64, error) {
+	if leader := b.leader(); leader != nil {
+		return leader.GetTrackDuration()
+	}
+	return 0, fmt.Errorf("no output enabled")
+}
+
+// GetElapsedTime returns the leader's elapsed time
+func (b *Backend) GetElapsedTime() (int64, error) {
+	if leader := b.leader(); leader != nil {
+		return leader.GetElapsedTime()
+	}
+	return -1, fmt.Errorf("no output enabled")
+}
+
+// IsTrackComplete returns whether the leader has finished
+func (b *Backend) IsTrackComplete() (bool, error) {
+	if leader := b.leader(); leader != nil {
+		return leader.IsTrackComplete()
+	}
+	return true, nil
+}
+
+// StatusChanged returns the leader's status change channel, nil if it has none
+func (b *Backend) StatusChanged() <-chan struct{} {
+	if notifier, ok := b.leader().(backends.StatusNotifier); ok {
+		return notifier.StatusChanged()
+	}
+	return nil
+}
+
+// CheckHealth probes every enabled output
+func (b *Backend) CheckHealth() error {
+	return b.each(backends.PlaybackBackend.CheckHealth)
+}
+
+// Reconnect opens the sessions to every enabled output again
+func (b *Backend) Reconnect() error {
+	return b.each(backends.PlaybackBackend.Reconnect)
+}
+
+// SelectTarget connects every enabled output to its target
+func (b *Backend) SelectTarget() error {
+	return b.each(backends.PlaybackBackend.SelectTarget)
+}
+
+// Capabilities reports what every mirrored output can play, so one decode suits them all
+func (b *Backend) Capabilities() backends.Capabilities {
+	all := make([]backends.Capabilities, len(b.outputs))
+	for i, out := range b.outputs {
+		all[i] = out.backend.Capabilities()
+	}
+	return commonCapabilities(all)
+}
+
+// configCapabilities returns what the mirrored outputs can all play as far as
+// their configs tell
+func configCapabilities(cfg *config.Config) backends.Capabilities {
+	var all []backends.Capabilities
+	for _, mirrored := range cfg.Mirror {
+		if mirrored.Backend == "mirror" {
+			continue
+		}
+		caps, err := backends.ConfiguredCapabilities(mirrored.Backend, outputConfig(cfg, mirrored))
+		if err != nil {
+			continue
+		}
+		all = append(all, caps)
+	}
+	return commonCapabilities(all)
+}
+
+// commonCapabilities combines the capabilities of the mirrored outputs
+func commonCapabilities(all []backends.Capabilities) backends.Capabilities {
+	caps := backends.Capabilities{DSD: true, DoP: true, MultiFile: true, Gapless: true}
+	for i, outputCaps := range all {
+		if outputCaps.MaxSampleRate > 0 && (caps.MaxSampleRate == 0 || outputCaps.MaxSampleRate < caps.MaxSampleRate) {
+			caps.MaxSampleRate = outputCaps.MaxSampleRate
+		}
+		if outputCaps.MaxChannels > 0 && (caps.MaxChannels == 0 || outputCaps.MaxChannels < caps.MaxChannels) {
+			caps.MaxChannels = outputCaps.MaxChannels
+		}
+		if i == 0 {
+			// One decode serves every output, so the first output's conversions apply
+			caps.BitDepths = outputCaps.BitDepths
+			caps.Resample = outputCaps.Resample
+			caps.BitDepth, caps.Channels = outputCaps.BitDepth, outputCaps.Channels
+		} else {
+			caps.BitDepths = commonBitDepths(caps.BitDepths, outputCaps.BitDepths)
+		}
+		caps.DSD = caps.DSD && outputCaps.DSD
+		caps.DoP = caps.DoP && outputCaps.DoP
+		caps.MultiFile = caps.MultiFile && outputCaps.MultiFile
+		caps.Gapless = caps.Gapless && outputCaps.Gapless
+	}
+	return caps
+}
+
+// commonBitDepths returns the sample sizes accepted by both lists (empty means any)
+func commonBitDepths(a, b []int) []int {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	var common []int
+	for _, bits := range a {
+		for _, other := range b {
+			if bits == other {
+				common = append(common, bits)
+				break
+			}
+		}
+	}
+	return common
+}
+
+// GetBackendName returns the name of this backend
+func (b *Backend) GetBackendName() string {
+	return "Mirror"
+}
+
+// GetOutputName returns the names of the enabled outputs
+func (b *Backend) GetOutputName() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var names []string
+	for _, out := range b.outputs {
+		if out.enabled {
+			names = append(names, out.name)
+		}
+	}
+	return strings.Join(names, " + ")
+}
+
+// Outputs returns one output per mirrored backend
+func (b *Backend) Outputs() []backends.Output {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	outputs := make([]backends.Output, len(b.outputs))
+	for i, out := range b.outputs {
+		outputs[i] = backends.Output{Name: out.name, Enabled: out.enabled}
+	}
+	return outputs
+}
+
+// EnableOutput enables or disables one mirrored output
+// Unlike single-target backends any number can be enabled at once; a disabled
+// output is stopped right away and an enabled one joins with the next upload
+func (b *Backend) EnableOutput(index int, enabled bool) error {
+	b.mu.Lock()
+	if index < 0 || index >= len(b.outputs) {
+		b.mu.Unlock()
+		return fmt.Errorf("no such output: %d", index)
+	}
+	out := b.outputs[index]
+	wasEnabled := out.enabled
+	out.enabled = enabled
+	if !enabled {
+		out.uploaded = false
+	}
+	b.mu.Unlock()
+
+	if wasEnabled && !enabled {
+		if err := out.backend.Stop(); err != nil {
+			log.Printf("Warning: failed to stop %s: %v", out.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,404 @@
+package null
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/famish99/direttampd/internal/backends"
+	"github.com/famish99/direttampd/internal/cache"
+	"github.com/famish99/direttampd/internal/config"
+	"github.com/famish99/direttampd/internal/decoder"
+	"github.com/famish99/direttampd/internal/playlist"
+)
+
+// Backend implements the backends.PlaybackBackend interface without audio hardware
+// Tracks are decoded into the cache as for a real host, then "played" on the
+// wall clock: elapsed time advances in real time, pauses and seeks, and tracks
+// complete when their duration has passed. The PCM of each upload is appended
+// to a file if one is set, otherwise it is discarded.
+// Software gain and crossfading are not applied; the PCM is written as decoded
+type Backend struct {
+	cache *cache.DiskCache
+	path  string                // File receiving the PCM, "" to discard it
+	caps  backends.Capabilities // From the playback settings (see configCapabilities)
+
+	mu             sync.Mutex
+	enabled        bool              // The single output is enabled
+	prepared       []*playlist.Track // Tracks of the current upload, kept to upload again when seeking
+	trackOffsets   []float64         // Start of each prepared track within the upload, in seconds
+	trackStarts    []float64         // Song position in seconds where each prepared track's audio begins
+	trackDurations []float64         // Duration of each prepared track in seconds
+	totalDuration  float64           // Duration of the whole upload in seconds
+
+	// Simulated playback clock
+	started  bool      // An upload is playing or paused
+	playing  bool      // The clock is running
+	position float64   // Seconds into the upload at since
+	since    time.Time // When position was last set
+}
+
+func init() {
+	backends.Register("null", func(cache *cache.DiskCache, cfg *config.Config) (backends.PlaybackBackend, error) {
+		b := New(cache, cfg.Null.File)
+		b.caps = configCapabilities(cfg)
+		return b, nil
+	})
+	backends.RegisterCapabilities("null", configCapabilities)
+}
+
+// configCapabilities returns the capabilities the playback settings give the output
+func configCapabilities(cfg *config.Config) backends.Capabilities {
+	return backends.Capabilities{MultiFile: true, Gapless: true}.WithDSDMode(cfg.Playback.DSDMode).
+		WithResampling(cfg.Playback.Resample).WithOutputFormat(cfg.Playback.BitDepth, cfg.Playback.Channels).
+		WithDownmix(cfg.Playback.Downmix)
+}
+
+// New creates a null backend
+// PCM is appended to the file at path, or discarded if path is empty
+func New(cache *cache.DiskCache, path string) *Backend {
+	return &Backend{
+		cache:   cache,
+		path:    path,
+		caps:    backends.Capabilities{MultiFile: true, Gapless: true},
+		enabled: true,
+	}
+}
+
+// Close cleans up the backend resources
+func (b *Backend) Close() {
+	log.Printf("Cleaning up null backend")
+	b.Stop()
+}
+
+// PrepareTrack decodes a track for playback
+func (b *Backend) PrepareTrack(track *playlist.Track) error {
+	return b.PrepareTracks([]*playlist.Track{track})
+}
+
+// PrepareTracks decodes tracks to play back-to-back without gaps
+func (b *Backend) PrepareTracks(tracks []*playlist.Track) error {
+	if len(tracks) == 0 {
+		return fmt.Errorf("no tracks to prepare")
+	}
+	return b.upload(tracks, 0, 0)
+}
+
+// upload decodes tracks[first:], starting startAt seconds into tracks[first]
+// Earlier tracks keep their place in the layout with no length, so track
+// indices stay the same as for the full upload
+func (b *Backend) upload(tracks []*playlist.Track, first int, startAt float64) error {
+	b.mu.Lock()
+	enabled := b.enabled
+	b.mu.Unlock()
+	if !enabled {
+		return fmt.Errorf("no output enabled")
+	}
+
+	infos := make([]*decoder.WAVInfo, len(tracks))
+	paths := make([]string, len(tracks))
+	durations := make([]float64, len(tracks))
+	for i := first; i < len(tracks); i++ {
+		log.Printf("Preparing track: %s", tracks[i].URL)
+
+		path, err := b.fetchDecodeAndCache(tracks[i])
+		if err != nil {
+			return fmt.Errorf("failed to fetch and decode: %w", err)
+		}
+		info, err := decoder.ReadWAVInfo(path)
+		if err != nil {
+			b.invalidate(tracks[i])
+			return fmt.Errorf("failed to read WAV file: %w", err)
+		}
+		paths[i], infos[i], durations[i] = path, info, info.Duration()
+	}
+
+	if startAt < 0 {
+		startAt = 0
+	}
+	if err := b.writePCM(paths, infos, first, startAt); err != nil {
+		return fmt.Errorf("failed to write PCM: %w", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Lay out the tracks on the upload's timeline
+	b.prepared = tracks
+	b.trackOffsets = make([]float64, len(tracks))
+	b.trackStarts = make([]float64, len(tracks))
+	b.trackStarts[first] = startAt
+	b.trackDurations = durations
+	var offset float64
+	for i := first; i < len(tracks); i++ {
+		b.trackOffsets[i] = offset
+		offset += durations[i] - b.trackStarts[i]
+	}
+	b.totalDuration = offset
+	b.started = false
+	b.playing = false
+	b.position = 0
+
+	return nil
+}
+
+// writePCM appends the PCM data of paths[first:] to the output file, skipping
+// startAt seconds of the first track
+func (b *Backend) writePCM(paths []string, infos []*decoder.WAVInfo, first int, startAt float64) error {
+	if b.path == "" {
+		return nil
+	}
+
+	out, err := os.OpenFile(b.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	for i := first; i < len(paths) && err == nil; i++ {
+		var skip int64
+		if i == first {
+			skip = infos[i].FrameOffset(startAt)
+		}
+		err = copyPCM(out, paths[i], infos[i].DataStart+skip, infos[i].DataSize-skip)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// copyPCM copies length bytes from offset in the file at path to w
+func copyPCM(w io.Writer, path string, offset, length int64) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	_, err = io.Copy(w, io.NewSectionReader(in, offset, length))
+	return err
+}
+
+// invalidate drops a track's decoded file from the cache so it is decoded again next time
+func (b *Backend) invalidate(track *playlist.Track) {
+	if err := b.cache.Invalidate(track.URL); err != nil {
+		log.Printf("Warning: failed to invalidate cache: %v", err)
+	}
+}
+
+// fetchDecodeAndCache fetches and decodes audio directly to a WAV file in the cache
+// Returns the WAV file path
+func (b *Backend) fetchDecodeAndCache(track *playlist.Track) (string, error) {
+	return b.cache.EnsureDecoded(context.Background(), track.URL, b.Capabilities().Decoder())
+}
+
+// SetGainFunc is accepted for the interface; the null backend does not apply gain
+func (b *Backend) SetGainFunc(gain func(track *playlist.Track) float64) {}
+
+// SetCrossfade is accepted for the interface; the null backend does not crossfade
+func (b *Backend) SetCrossfade(seconds float64) {}
+
+// clock returns the simulated position in seconds within the whole upload
+// Callers hold b.mu
+func (b *Backend) clock() float64 {
+	position := b.position
+	if b.playing {
+		position += time.Since(b.since).Seconds()
+	}
+	if position > b.totalDuration {
+		position = b.totalDuration
+	}
+	return position
+}
+
+// trackAt returns the index of the prepared track playing at position in the upload
+// Callers hold b.mu
+func (b *Backend) trackAt(position float64) int {
+	index := 0
+	for i, offset := range b.trackOffsets {
+		if position >= offset {
+			index = i
+		}
+	}
+	return index
+}
+
+// CurrentTrack returns the index into the prepared tracks of the one playing
+func (b *Backend) CurrentTrack() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.started {
+		return 0
+	}
+	return b.trackAt(b.clock())
+}
+
+// StartPlayback starts the clock at the beginning of the upload
+func (b *Backend) StartPlayback() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.prepared) == 0 {
+		return fmt.Errorf("no tracks prepared")
+	}
+	b.started = true
+	b.playing = true
+	b.position = 0
+	b.since = time.Now()
+	return nil
+}
+
+// Play resumes the clock
+func (b *Backend) Play() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.started && !b.playing {
+		b.playing = true
+		b.since = time.Now()
+	}
+	return nil
+}
+
+// Pause stops the clock where it is
+func (b *Backend) Pause() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.playing {
+		b.position = b.clock()
+		b.playing = false
+	}
+	return nil
+}
+
+// Stop ends playback of the upload
+func (b *Backend) Stop() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.started = false
+	b.playing = false
+	return nil
+}
+
+// Seek seeks to an absolute position in seconds within the playing track
+// As on a real host, the rest of the upload is prepared again from that point
+// and playback resumes there
+func (b *Backend) Seek(position float64) error {
+	b.mu.Lock()
+	if !b.started || len(b.prepared) == 0 {
+		b.mu.Unlock()
+		return fmt.Errorf("nothing playing")
+	}
+	index := b.trackAt(b.clock())
+	tracks := b.prepared
+	b.mu.Unlock()
+
+	log.Printf("Seeking to %.3f seconds from track %d", position, index)
+	if err := b.upload(tracks, index, position); err != nil {
+		return err
+	}
+	return b.StartPlayback()
+}
+
+// GetTrackDuration returns the total duration of the current track in seconds
+func (b *Backend) GetTrackDuration() (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.trackDurations) == 0 {
+		return 0, fmt.Errorf("no track duration available")
+	}
+
+	index := 0
+	if b.started {
+		index = b.trackAt(b.clock())
+	}
+	return int64(b.trackDurations[index]), nil
+}
+
+// GetElapsedTime returns the elapsed time in seconds within the current track
+// Returns -1 when nothing is playing or the upload has finished
+func (b *Backend) GetElapsedTime() (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	position := b.clock()
+	if !b.started || position >= b.totalDuration {
+		return -1, nil
+	}
+
+	index := b.trackAt(position)
+	return int64(position - b.trackOffsets[index] + b.trackStarts[index]), nil
+}
+
+// IsTrackComplete returns true once the whole upload has played or playback stopped
+func (b *Backend) IsTrackComplete() (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.started || b.clock() >= b.totalDuration, nil
+}
+
+// CheckHealth always succeeds; there is no device to lose
+func (b *Backend) CheckHealth() error {
+	return nil
+}
+
+// Reconnect has no session to open again
+func (b *Backend) Reconnect() error {
+	return nil
+}
+
+// SelectTarget has no device to connect to
+func (b *Backend) SelectTarget() error {
+	return nil
+}
+
+// Capabilities reports no format limits; any decoded PCM can be "played"
+// DSD is converted to PCM, or to DoP under dsd_mode "dop"
+func (b *Backend) Capabilities() backends.Capabilities {
+	return b.caps
+}
+
+// GetBackendName returns the name of this backend
+func (b *Backend) GetBackendName() string {
+	return "Null"
+}
+
+// GetOutputName returns the name of the output device
+func (b *Backend) GetOutputName() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.enabled {
+		return ""
+	}
+	return b.outputName()
+}
+
+// outputName names the single output after where the PCM goes
+func (b *Backend) outputName() string {
+	if b.path == "" {
+		return "null"
+	}
+	return "file:" + b.path
+}
+
+// Outputs returns the single output
+func (b *Backend) Outputs() []backends.Output {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return []backends.Output{{Name: b.outputName(), Enabled: b.enabled}}
+}
+
+// EnableOutput enables or disables the single output
+// The change takes effect from the next upload
+func (b *Backend) EnableOutput(index int, enabled bool) error {
+	if index != 0 {
+		return fmt.Errorf("no such output: %d", index)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.enabled = enabled
+	return nil
+}
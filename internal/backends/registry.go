@@ -0,0 +1,91 @@
+package backends
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/famish99/direttampd/internal/cache"
+	"github.com/famish99/direttampd/internal/config"
+)
+
+// DefaultBackend is the backend used when the config does not name one
+const DefaultBackend = "memoryplay"
+
+// CapabilitiesFunc returns what a backend's output can play as far as the
+// config tells, without creating the backend
+type CapabilitiesFunc func(cfg *config.Config) Capabilities
+
+var (
+	registryMu   sync.Mutex
+	registry     = make(map[string]BackendFactory)
+	capabilities = make(map[string]CapabilitiesFunc)
+)
+
+// Register makes a backend available under name for the backend config field
+// Backend packages register themselves from init; registering a name twice panics
+func Register(name string, factory BackendFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, exists := registry[name]; exists {
+		panic("backends: Register called twice for " + name)
+	}
+	registry[name] = factory
+}
+
+// RegisterCapabilities makes the capabilities the config gives a backend's
+// output available under name, for tools that decode into the cache for it
+// without connecting to it (see ConfiguredCapabilities)
+func RegisterCapabilities(name string, fn CapabilitiesFunc) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, exists := capabilities[name]; exists {
+		panic("backends: RegisterCapabilities called twice for " + name)
+	}
+	capabilities[name] = fn
+}
+
+// ConfiguredCapabilities returns the capabilities the config gives the output
+// of the backend registered under name ("" selects DefaultBackend)
+// Only limits the config sets apply; those an output reports once connected do not
+func ConfiguredCapabilities(name string, cfg *config.Config) (Capabilities, error) {
+	if name == "" {
+		name = DefaultBackend
+	}
+
+	registryMu.Lock()
+	fn, ok := capabilities[name]
+	registryMu.Unlock()
+	if !ok {
+		return Capabilities{}, fmt.Errorf("unknown backend %q (available: %s)", name, strings.Join(Names(), ", "))
+	}
+	return fn(cfg), nil
+}
+
+// New creates the backend registered under name ("" selects DefaultBackend)
+func New(name string, cache *cache.DiskCache, cfg *config.Config) (PlaybackBackend, error) {
+	if name == "" {
+		name = DefaultBackend
+	}
+
+	registryMu.Lock()
+	factory, ok := registry[name]
+	registryMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q (available: %s)", name, strings.Join(Names(), ", "))
+	}
+	return factory(cache, cfg)
+}
+
+// Names returns the registered backend names in sorted order
+func Names() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,223 @@
+package upnp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/famish99/direttampd/internal/config"
+)
+
+// ssdpAddr is the SSDP multicast group
+const ssdpAddr = "239.255.255.250:1900"
+
+// avTransportType is the UPnP service type renderers are controlled through
+const avTransportType = "urn:schemas-upnp-org:service:AVTransport:1"
+
+// discoveryTimeout is how long SSDP responses and device descriptions are waited for
+const discoveryTimeout = 2 * time.Second
+
+// Renderer is a UPnP media renderer playback can be sent to
+type Renderer struct {
+	Name       string // Friendly name
+	Location   string // Device description URL
+	ControlURL string // AVTransport control URL
+}
+
+// DiscoverRenderers returns the renderers listed in the config followed by
+// those found with an SSDP search for the AVTransport service
+func DiscoverRenderers(cfg *config.Config) []Renderer {
+	locations := append([]string(nil), cfg.UPnP.Renderers...)
+
+	log.Printf("Discovering UPnP renderers...")
+	found, err := searchAVTransport(discoveryTimeout)
+	if err != nil {
+		log.Printf("Warning: UPnP discovery failed: %v", err)
+	}
+	locations = append(locations, found...)
+
+	// Fetch descriptions in parallel, keeping the order of locations
+	renderers := make([]*Renderer, len(locations))
+	var wg sync.WaitGroup
+	for i, location := range locations {
+		wg.Add(1)
+		go func(i int, location string) {
+			defer wg.Done()
+			renderer, err := FetchRenderer(location, discoveryTimeout)
+			if err != nil {
+				log.Printf("Warning: skipping renderer at %s: %v", location, err)
+				return
+			}
+			renderers[i] = renderer
+		}(i, location)
+	}
+	wg.Wait()
+
+	// A configured renderer may also answer the search
+	var result []Renderer
+	seen := make(map[string]bool)
+	for _, renderer := range renderers {
+		if renderer == nil || seen[renderer.ControlURL] {
+			continue
+		}
+		seen[renderer.ControlURL] = true
+		result = append(result, *renderer)
+	}
+	return result
+}
+
+// SelectRenderer returns the index of the preferred renderer
+// The preferred target names a renderer; without one the first renderer is used
+func SelectRenderer(renderers []Renderer, cfg *config.Config) (int, error) {
+	if len(renderers) == 0 {
+		return -1, fmt.Errorf("no UPnP renderers found")
+	}
+	if cfg.PreferredTarget == "" {
+		return 0, nil
+	}
+	for i, renderer := range renderers {
+		if renderer.Name == cfg.PreferredTarget {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("renderer %q not found", cfg.PreferredTarget)
+}
+
+// searchAVTransport sends an SSDP M-SEARCH for renderers and returns their description URLs
+func searchAVTransport(timeout time.Duration) ([]string, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UDP socket: %w", err)
+	}
+	defer conn.Close()
+
+	group, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	mx := int(timeout.Seconds())
+	if mx < 1 {
+		mx = 1
+	}
+	request := fmt.Sprintf("M-SEARCH * HTTP/1.1\r\n"+
+		"HOST: %s\r\n"+
+		"MAN: \"ssdp:discover\"\r\n"+
+		"MX: %d\r\n"+
+		"ST: %s\r\n\r\n", ssdpAddr, mx, avTransportType)
+
+	if _, err := conn.WriteToUDP([]byte(request), group); err != nil {
+		return nil, fmt.Errorf("failed to send M-SEARCH: %w", err)
+	}
+
+	// Collect unique devices (by UUID) until the timeout
+	var locations []string
+	seen := make(map[string]bool)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+
+	buf := make([]byte, 4096)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break // Deadline reached
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+
+		uuid := strings.SplitN(resp.Header.Get("USN"), "::", 2)[0]
+		if location := resp.Header.Get("LOCATION"); uuid != "" && location != "" && !seen[uuid] {
+			seen[uuid] = true
+			locations = append(locations, location)
+		}
+	}
+
+	return locations, nil
+}
+
+// deviceDescription is the part of a UPnP device description used to find the AVTransport service
+type deviceDescription struct {
+	URLBase string `xml:"URLBase"`
+	Device  device `xml:"device"`
+}
+
+type device struct {
+	FriendlyName string `xml:"friendlyName"`
+	Services     []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []device `xml:"deviceList>device"`
+}
+
+// avTransport finds the AVTransport service in the device or its embedded devices
+// Returns the name of the device providing it and the service's control URL
+func (d *device) avTransport() (string, string, bool) {
+	for _, service := range d.Services {
+		if strings.HasPrefix(service.ServiceType, "urn:schemas-upnp-org:service:AVTransport:") {
+			return strings.TrimSpace(d.FriendlyName), service.ControlURL, true
+		}
+	}
+	for i := range d.Devices {
+		if name, control, ok := d.Devices[i].avTransport(); ok {
+			if name == "" {
+				name = strings.TrimSpace(d.FriendlyName)
+			}
+			return name, control, true
+		}
+	}
+	return "", "", false
+}
+
+// FetchRenderer reads a renderer's device description
+func FetchRenderer(location string, timeout time.Duration) (*Renderer, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("device description: %s", resp.Status)
+	}
+
+	var description deviceDescription
+	if err := xml.NewDecoder(resp.Body).Decode(&description); err != nil {
+		return nil, fmt.Errorf("invalid device description: %w", err)
+	}
+
+	name, control, ok := description.Device.avTransport()
+	if !ok {
+		return nil, fmt.Errorf("no AVTransport service")
+	}
+
+	// Control URLs are relative to URLBase, or to the description without one
+	base := description.URLBase
+	if base == "" {
+		base = location
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL: %w", err)
+	}
+	controlURL, err := baseURL.Parse(control)
+	if err != nil {
+		return nil, fmt.Errorf("invalid control URL: %w", err)
+	}
+
+	if name == "" {
+		name = controlURL.Host
+	}
+	return &Renderer{Name: name, Location: location, ControlURL: controlURL.String()}, nil
+}
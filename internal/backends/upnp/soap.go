@@ -0,0 +1,197 @@
+package upnp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// soapTimeout bounds each action sent to a renderer
+const soapTimeout = 5 * time.Second
+
+// Transport states reported by GetTransportInfo
+const (
+	stateStopped        = "STOPPED"
+	statePlaying        = "PLAYING"
+	statePaused         = "PAUSED_PLAYBACK"
+	stateTransitioning  = "TRANSITIONING"
+	stateNoMediaPresent = "NO_MEDIA_PRESENT"
+)
+
+// avTransport sends AVTransport actions to a renderer
+type avTransport struct {
+	controlURL string
+	client     *http.Client
+}
+
+// newAVTransport creates a client for the renderer's AVTransport service
+func newAVTransport(renderer Renderer) *avTransport {
+	return &avTransport{
+		controlURL: renderer.ControlURL,
+		client:     &http.Client{Timeout: soapTimeout},
+	}
+}
+
+// call invokes an action on instance 0 with args given as name, value pairs
+// Returns the output arguments of the response by name
+func (t *avTransport) call(action string, args ...string) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?>`)
+	body.WriteString(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s"><InstanceID>0</InstanceID>`, action, avTransportType)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&body, "<%s>", args[i])
+		xml.EscapeText(&body, []byte(args[i+1]))
+		fmt.Fprintf(&body, "</%s>", args[i])
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequest(http.MethodPost, t.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, avTransportType, action))
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", action, err)
+	}
+	defer resp.Body.Close()
+
+	values, err := parseResponse(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", action, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if code := values["errorCode"]; code != "" {
+			return nil, fmt.Errorf("%s failed: UPnP error %s %s", action, code, values["errorDescription"])
+		}
+		return nil, fmt.Errorf("%s failed: %s", action, resp.Status)
+	}
+	return values, nil
+}
+
+// parseResponse collects the text of every leaf element in a SOAP response by name
+// Output arguments and fault details are both leaves, so one map serves either
+func parseResponse(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	decoder := xml.NewDecoder(r)
+
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid response: %w", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			values[t.Name.Local] = strings.TrimSpace(text.String())
+			text.Reset()
+		}
+	}
+}
+
+// setURI points the renderer at a stream with DIDL-Lite metadata describing it
+func (t *avTransport) setURI(uri, title, mimeType string) error {
+	_, err := t.call("SetAVTransportURI",
+		"CurrentURI", uri,
+		"CurrentURIMetaData", didl(uri, title, mimeType))
+	return err
+}
+
+// play starts or resumes playback
+func (t *avTransport) play() error {
+	_, err := t.call("Play", "Speed", "1")
+	return err
+}
+
+// pause pauses playback
+func (t *avTransport) pause() error {
+	_, err := t.call("Pause")
+	return err
+}
+
+// stop stops playback
+func (t *avTransport) stop() error {
+	_, err := t.call("Stop")
+	return err
+}
+
+// seek moves playback to seconds into the stream
+func (t *avTransport) seek(seconds float64) error {
+	_, err := t.call("Seek", "Unit", "REL_TIME", "Target", formatTime(seconds))
+	return err
+}
+
+// transportState returns the renderer's current transport state
+func (t *avTransport) transportState() (string, error) {
+	values, err := t.call("GetTransportInfo")
+	if err != nil {
+		return "", err
+	}
+	return values["CurrentTransportState"], nil
+}
+
+// position returns the playback position in seconds within the stream
+func (t *avTransport) position() (float64, error) {
+	values, err := t.call("GetPositionInfo")
+	if err != nil {
+		return 0, err
+	}
+	return parseTime(values["RelTime"])
+}
+
+// didl returns DIDL-Lite metadata for an audio item at uri
+// Several renderers refuse a URI without metadata giving its protocol info
+func didl(uri, title, mimeType string) string {
+	var b bytes.Buffer
+	b.WriteString(`<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">`)
+	b.WriteString(`<item id="0" parentID="-1" restricted="1"><dc:title>`)
+	xml.EscapeText(&b, []byte(title))
+	b.WriteString(`</dc:title><upnp:class>object.item.audioItem.musicTrack</upnp:class>`)
+	fmt.Fprintf(&b, `<res protocolInfo="http-get:*:%s:*">`, mimeType)
+	xml.EscapeText(&b, []byte(uri))
+	b.WriteString(`</res></item></DIDL-Lite>`)
+	return b.String()
+}
+
+// formatTime formats seconds as the H:MM:SS.mmm time UPnP uses
+func formatTime(seconds float64) string {
+	if seconds < 0 {
+		seconds = 0
+	}
+	millis := int64(seconds*1000 + 0.5)
+	return fmt.Sprintf("%d:%02d:%02d.%03d", millis/3600000, millis/60000%60, millis/1000%60, millis%1000)
+}
+
+// parseTime parses a UPnP H:MM:SS time with optional fraction into seconds
+func parseTime(value string) (float64, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+
+	var seconds float64
+	for _, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time %q", value)
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds, nil
+}
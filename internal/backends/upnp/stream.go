@@ -0,0 +1,175 @@
+package upnp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// streamMIMEType is the content type of the WAV stream renderers fetch
+const streamMIMEType = "audio/wav"
+
+// upload is a group of tracks served to the renderer as one WAV file
+type upload struct {
+	id     int
+	header []byte    // WAV header sized for the PCM of every part
+	parts  []pcmPart // PCM data of each track in order
+}
+
+// pcmPart is the PCM data of one track within its WAV file
+type pcmPart struct {
+	path   string
+	offset int64
+	length int64
+}
+
+// streamServer serves the current upload over HTTP for the renderer to fetch
+type streamServer struct {
+	listener net.Listener
+	server   *http.Server
+
+	mu      sync.Mutex
+	current *upload
+	nextID  int
+}
+
+// newStreamServer starts the stream server on port (0 picks a free port)
+func newStreamServer(port int) (*streamServer, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to start stream server: %w", err)
+	}
+
+	s := &streamServer{listener: listener}
+	s.server = &http.Server{Handler: s}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Stream server error: %v", err)
+		}
+	}()
+	log.Printf("UPnP stream server listening on %s", listener.Addr())
+	return s, nil
+}
+
+// Close stops the stream server
+func (s *streamServer) Close() error {
+	return s.server.Close()
+}
+
+// publish makes parts the current upload and returns its path on the server
+// Each upload gets a new path so renderers never play a stale copy
+func (s *streamServer) publish(header []byte, parts []pcmPart) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	s.current = &upload{id: s.nextID, header: header, parts: parts}
+	return fmt.Sprintf("/upload/%d.wav", s.nextID)
+}
+
+// URL returns the address the renderer at controlURL reaches path on
+// The local address is the one the system routes to the renderer from
+func (s *streamServer) URL(controlURL, path string) (string, error) {
+	renderer, err := url.Parse(controlURL)
+	if err != nil {
+		return "", err
+	}
+	port := renderer.Port()
+	if port == "" {
+		port = "80"
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort(renderer.Hostname(), port))
+	if err != nil {
+		return "", fmt.Errorf("no route to renderer: %w", err)
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+
+	listening := s.listener.Addr().(*net.TCPAddr).Port
+	return "http://" + net.JoinHostPort(local.String(), strconv.Itoa(listening)) + path, nil
+}
+
+// ServeHTTP serves the current upload, with range requests for renderers that seek
+func (s *streamServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	current := s.current
+	s.mu.Unlock()
+
+	if current == nil || r.URL.Path != fmt.Sprintf("/upload/%d.wav", current.id) {
+		http.NotFound(w, r)
+		return
+	}
+
+	sections := []*io.SectionReader{io.NewSectionReader(bytes.NewReader(current.header), 0, int64(len(current.header)))}
+	for _, part := range current.parts {
+		f, err := os.Open(part.path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		sections = append(sections, io.NewSectionReader(f, part.offset, part.length))
+	}
+
+	w.Header().Set("Content-Type", streamMIMEType)
+	w.Header().Set("transferMode.dlna.org", "Streaming")
+	http.ServeContent(w, r, "", time.Time{}, newConcatReader(sections))
+}
+
+// concatReader reads sections one after another as a single seekable stream
+type concatReader struct {
+	sections []*io.SectionReader
+	size     int64
+	pos      int64
+}
+
+func newConcatReader(sections []*io.SectionReader) *concatReader {
+	r := &concatReader{sections: sections}
+	for _, section := range sections {
+		r.size += section.Size()
+	}
+	return r
+}
+
+// Read reads from the section holding the current position
+func (r *concatReader) Read(p []byte) (int, error) {
+	start := int64(0)
+	for _, section := range r.sections {
+		if r.pos < start+section.Size() {
+			n, err := section.ReadAt(p, r.pos-start)
+			r.pos += int64(n)
+			if err == io.EOF && n > 0 {
+				err = nil
+			}
+			return n, err
+		}
+		start += section.Size()
+	}
+	return 0, io.EOF
+}
+
+// Seek sets the position for the next Read
+func (r *concatReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence")
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
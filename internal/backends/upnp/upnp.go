@@ -0,0 +1,515 @@
+package upnp
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/famish99/direttampd/internal/backends"
+	"github.com/famish99/direttampd/internal/cache"
+	"github.com/famish99/direttampd/internal/config"
+	"github.com/famish99/direttampd/internal/decoder"
+	"github.com/famish99/direttampd/internal/playlist"
+)
+
+// startTimeout is how long a renderer may take to start playing a new stream
+// before a stopped transport counts as the stream having ended
+const startTimeout = 10 * time.Second
+
+// Backend implements the backends.PlaybackBackend interface for UPnP AV renderers
+// Each upload is served by a built-in HTTP server as one WAV stream, so tracks
+// grouped for gapless playback play back-to-back; the renderer is driven with
+// AVTransport actions (SetAVTransportURI, Play, Pause, Stop, Seek)
+// Crossfading is not applied
+type Backend struct {
+	cache  *cache.DiskCache
+	stream *streamServer
+	caps   backends.Capabilities // From the config (see configCapabilities)
+
+	outputs   []Renderer // Renderers that can receive playback
+	active    int        // Index of the enabled output, -1 if none
+	transport *avTransport
+	current   int // Index of the output the prepared upload was sent to, -1 if none
+	outputMu  sync.Mutex
+
+	prepared       []*playlist.Track                   // Tracks of the current upload
+	trackOffsets   []float64                           // Start of each prepared track within the upload, in seconds
+	trackDurations []float64                           // Duration of each prepared track in seconds
+	temps          []string                            // Gain-adjusted copies served by the current upload
+	gainFunc       func(track *playlist.Track) float64 // Software gain in dB per track (0 leaves it bit-perfect)
+
+	// Playback of the current upload
+	mu         sync.Mutex
+	started    bool      // Play was sent for the upload
+	startedAt  time.Time // When Play was sent
+	sawPlaying bool      // The renderer has reported playing the upload
+}
+
+func init() {
+	backends.Register("upnp", func(cache *cache.DiskCache, cfg *config.Config) (backends.PlaybackBackend, error) {
+		return New(cache, cfg)
+	})
+	backends.RegisterCapabilities("upnp", configCapabilities)
+}
+
+// configCapabilities returns what renderers are sent: 16 or 24 bit PCM up to
+// upnp.max_sample_rate, under the playback settings
+func configCapabilities(cfg *config.Config) backends.Capabilities {
+	return backends.Capabilities{
+		MaxSampleRate: cfg.UPnP.MaxSampleRate,
+		BitDepths:     []int{16, 24},
+		MultiFile:     true,
+		Gapless:       true,
+	}.WithDSDMode(cfg.Playback.DSDMode).WithResampling(cfg.Playback.Resample).
+		WithOutputFormat(cfg.Playback.BitDepth, cfg.Playback.Channels).WithDownmix(cfg.Playback.Downmix)
+}
+
+// New creates a UPnP backend with discovery and starts its stream server
+func New(cache *cache.DiskCache, cfg *config.Config) (*Backend, error) {
+	outputs := DiscoverRenderers(cfg)
+	active, err := SelectRenderer(outputs, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("renderer selection failed: %w", err)
+	}
+	log.Printf("Using renderer: %s (%s)", outputs[active].Name, outputs[active].Location)
+
+	stream, err := newStreamServer(cfg.UPnP.StreamPort)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Backend{
+		cache:   cache,
+		stream:  stream,
+		caps:    configCapabilities(cfg),
+		outputs: outputs,
+		active:  active,
+		current: -1,
+	}, nil
+}
+
+// Close stops the renderer and the stream server
+func (b *Backend) Close() {
+	log.Printf("Cleaning up UPnP backend")
+	if b.transport != nil {
+		_ = b.transport.stop()
+	}
+	b.stream.Close()
+	b.removeTemps()
+}
+
+// PrepareTrack fetches and decodes a track and hands it to the renderer
+func (b *Backend) PrepareTrack(track *playlist.Track) error {
+	return b.PrepareTracks([]*playlist.Track{track})
+}
+
+// PrepareTracks fetches and decodes tracks and hands them to the renderer as
+// one stream so they play back-to-back without gaps
+// All tracks must decode to the same audio format
+func (b *Backend) PrepareTracks(tracks []*playlist.Track) error {
+	if len(tracks) == 0 {
+		return fmt.Errorf("no tracks to prepare")
+	}
+
+	output := b.activeOutput()
+	if output < 0 {
+		return fmt.Errorf("no output enabled")
+	}
+
+	// Playback moves to a newly enabled output with this upload
+	if b.transport != nil && b.current != output {
+		log.Printf("Switching output from %s to %s", b.outputs[b.current].Name, b.outputs[output].Name)
+		if err := b.transport.stop(); err != nil {
+			log.Printf("Warning: failed to stop %s: %v", b.outputs[b.current].Name, err)
+		}
+		b.transport = nil
+	}
+
+	var temps []string
+	parts := make([]pcmPart, len(tracks))
+	durations := make([]float64, len(tracks))
+	var first *decoder.WAVInfo
+	var dataSize int64
+	for i, track := range tracks {
+		log.Printf("Preparing track: %s", track.URL)
+
+		path, temp, err := b.trackPath(track)
+		if err != nil {
+			removeFiles(temps)
+			return err
+		}
+		if temp {
+			temps = append(temps, path)
+		}
+
+		info, err := decoder.ReadWAVInfo(path)
+		if err != nil {
+			removeFiles(temps)
+			b.invalidate(track)
+			return fmt.Errorf("failed to read WAV file: %w", err)
+		}
+		if first == nil {
+			first = info
+		} else if info.SampleRate != first.SampleRate || info.BlockAlign != first.BlockAlign {
+			removeFiles(temps)
+			return fmt.Errorf("tracks in one upload differ in format")
+		}
+
+		parts[i] = pcmPart{path: path, offset: info.DataStart, length: info.DataSize}
+		durations[i] = info.Duration()
+		dataSize += info.DataSize
+	}
+
+	if b.transport == nil {
+		b.transport = newAVTransport(b.outputs[output])
+		b.current = output
+	}
+
+	// Stop what is playing before the stream it reads from is replaced
+	b.setStarted(false)
+	_ = b.transport.stop()
+
+	path := b.stream.publish(first.HeaderFor(dataSize), parts)
+	uri, err := b.stream.URL(b.outputs[output].ControlURL, path)
+	if err != nil {
+		removeFiles(temps)
+		return err
+	}
+
+	log.Printf("Sending %d track(s) to %s: %s", len(tracks), b.outputs[output].Name, uri)
+	title := tracks[0].Metadata["title"]
+	if title == "" {
+		title = tracks[0].URL
+	}
+	if err := b.transport.setURI(uri, title, streamMIMEType); err != nil {
+		removeFiles(temps)
+		return fmt.Errorf("failed to set stream: %w", err)
+	}
+
+	// The previous upload's copies are no longer served
+	b.removeTemps()
+	b.temps = temps
+
+	// Lay out the tracks on the stream's timeline
+	b.prepared = tracks
+	b.trackOffsets = make([]float64, len(tracks))
+	b.trackDurations = durations
+	var offset float64
+	for i := range tracks {
+		b.trackOffsets[i] = offset
+		offset += durations[i]
+	}
+
+	return nil
+}
+
+// trackPath decodes a track into the cache and applies its software gain
+// Returns the file to serve and whether it is a temporary copy
+func (b *Backend) trackPath(track *playlist.Track) (string, bool, error) {
+	wavPath, err := b.cache.EnsureDecoded(context.Background(), track.URL, b.Capabilities().Decoder())
+	if err != nil {
+		return "", false, fmt.Errorf("failed to fetch and decode: %w", err)
+	}
+
+	// Apply software gain to a temporary copy so the cache keeps the decoded original
+	if b.gainFunc != nil {
+		if gainDB := b.gainFunc(track); gainDB != 0 {
+			tmp, err := os.CreateTemp("", "direttampd-gain-*.wav")
+			if err != nil {
+				return "", false, err
+			}
+			tmp.Close()
+
+			log.Printf("Applying %.2f dB gain", gainDB)
+			if err := decoder.ApplyGain(wavPath, tmp.Name(), gainDB); err != nil {
+				os.Remove(tmp.Name())
+				return "", false, fmt.Errorf("failed to apply gain: %w", err)
+			}
+			return tmp.Name(), true, nil
+		}
+	}
+
+	return wavPath, false, nil
+}
+
+// invalidate drops a track's decoded file from the cache so it is decoded again next time
+func (b *Backend) invalidate(track *playlist.Track) {
+	if err := b.cache.Invalidate(track.URL); err != nil {
+		log.Printf("Warning: failed to invalidate cache: %v", err)
+	}
+}
+
+// removeTemps deletes the temporary copies served by the current upload
+func (b *Backend) removeTemps() {
+	removeFiles(b.temps)
+	b.temps = nil
+}
+
+// removeFiles deletes temporary files
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// SetGainFunc sets the function giving the software gain in dB for each prepared track
+func (b *Backend) SetGainFunc(gain func(track *playlist.Track) float64) {
+	b.gainFunc = gain
+}
+
+// SetCrossfade is accepted for the interface; the UPnP backend does not crossfade
+func (b *Backend) SetCrossfade(seconds float64) {}
+
+// setStarted records whether Play was sent for the current upload
+func (b *Backend) setStarted(started bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.started = started
+	b.startedAt = time.Now()
+	b.sawPlaying = false
+}
+
+// playing returns whether the renderer is playing or paused in the current upload
+// Time reported in other states (stopped, loading) does not belong to it
+func (b *Backend) playing() (bool, error) {
+	b.mu.Lock()
+	started := b.started
+	b.mu.Unlock()
+	if !started || b.transport == nil {
+		return false, nil
+	}
+
+	state, err := b.transport.transportState()
+	if err != nil {
+		return false, err
+	}
+	if state == statePlaying {
+		b.mu.Lock()
+		b.sawPlaying = true
+		b.mu.Unlock()
+	}
+	return state == statePlaying || state == statePaused, nil
+}
+
+// trackAt returns the index of the prepared track playing at position in the stream
+func (b *Backend) trackAt(position float64) int {
+	index := 0
+	for i, offset := range b.trackOffsets {
+		if position >= offset {
+			index = i
+		}
+	}
+	return index
+}
+
+// streamPosition returns the renderer's position in seconds within the stream
+func (b *Backend) streamPosition() (float64, bool) {
+	if ok, err := b.playing(); !ok || err != nil {
+		return 0, false
+	}
+	position, err := b.transport.position()
+	if err != nil {
+		return 0, false
+	}
+	return position, true
+}
+
+// CurrentTrack returns the index into the prepared tracks of the one playing
+// Returns 0 when the position is unknown
+func (b *Backend) CurrentTrack() int {
+	position, ok := b.streamPosition()
+	if !ok {
+		return 0
+	}
+	return b.trackAt(position)
+}
+
+// StartPlayback starts the renderer playing the prepared stream
+func (b *Backend) StartPlayback() error {
+	if b.transport == nil {
+		return fmt.Errorf("no tracks prepared")
+	}
+	if err := b.transport.play(); err != nil {
+		return err
+	}
+	b.setStarted(true)
+	log.Printf("Renderer playback started")
+	return nil
+}
+
+// Play resumes playback
+func (b *Backend) Play() error {
+	if b.transport != nil {
+		return b.transport.play()
+	}
+	return nil
+}
+
+// Pause pauses playback
+func (b *Backend) Pause() error {
+	if b.transport != nil {
+		return b.transport.pause()
+	}
+	return nil
+}
+
+// Stop stops playback of the stream
+func (b *Backend) Stop() error {
+	b.setStarted(false)
+	if b.transport != nil {
+		return b.transport.stop()
+	}
+	return nil
+}
+
+// Seek seeks to an absolute position in seconds within the playing track
+// The renderer seeks within the stream; the WAV layout lets it fetch the
+// range holding that position
+func (b *Backend) Seek(position float64) error {
+	if b.transport == nil || len(b.prepared) == 0 {
+		return fmt.Errorf("no renderer available")
+	}
+
+	index := 0
+	if current, ok := b.streamPosition(); ok {
+		index = b.trackAt(current)
+	}
+	if position < 0 {
+		position = 0
+	}
+
+	log.Printf("Seeking to %.3f seconds in track %d", position, index)
+	return b.transport.seek(b.trackOffsets[index] + position)
+}
+
+// GetTrackDuration returns the total duration of the current track in seconds
+func (b *Backend) GetTrackDuration() (int64, error) {
+	if len(b.trackDurations) == 0 {
+		return 0, fmt.Errorf("no track duration available")
+	}
+	return int64(b.trackDurations[b.CurrentTrack()]), nil
+}
+
+// GetElapsedTime returns the elapsed time in seconds within the current track
+// Returns -1 while the renderer is not playing the stream
+func (b *Backend) GetElapsedTime() (int64, error) {
+	playing, err := b.playing()
+	if err != nil {
+		return -1, err
+	}
+	if !playing {
+		return -1, nil
+	}
+
+	position, err := b.transport.position()
+	if err != nil {
+		return -1, err
+	}
+	index := b.trackAt(position)
+	return int64(position - b.trackOffsets[index]), nil
+}
+
+// IsTrackComplete returns true once the renderer has stopped at the end of the stream
+// A renderer that never starts playing counts as finished after startTimeout
+func (b *Backend) IsTrackComplete() (bool, error) {
+	b.mu.Lock()
+	started := b.started
+	b.mu.Unlock()
+	if !started || b.transport == nil {
+		return true, nil
+	}
+
+	state, err := b.transport.transportState()
+	if err != nil {
+		return false, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if state == statePlaying {
+		b.sawPlaying = true
+	}
+	if state != stateStopped && state != stateNoMediaPresent {
+		return false, nil
+	}
+	return b.sawPlaying || time.Since(b.startedAt) > startTimeout, nil
+}
+
+// CheckHealth probes the renderer with a transport info request
+func (b *Backend) CheckHealth() error {
+	if b.transport == nil {
+		return nil
+	}
+	_, err := b.transport.transportState()
+	return err
+}
+
+// Reconnect has no session to open again; each action is a request of its own
+func (b *Backend) Reconnect() error {
+	return nil
+}
+
+// SelectTarget has nothing to connect; the renderer is addressed per action
+func (b *Backend) SelectTarget() error {
+	return nil
+}
+
+// Capabilities reports what renderers are sent
+// Renderers commonly reject 32-bit WAV, so tracks are served with at most
+// 24-bit samples at rates up to upnp.max_sample_rate; DSD goes as PCM or DoP
+func (b *Backend) Capabilities() backends.Capabilities {
+	return b.caps
+}
+
+// GetBackendName returns the name of this backend
+func (b *Backend) GetBackendName() string {
+	return "UPnP"
+}
+
+// GetOutputName returns the name of the output device
+func (b *Backend) GetOutputName() string {
+	output := b.activeOutput()
+	if output < 0 {
+		return ""
+	}
+	return b.outputs[output].Name
+}
+
+// Outputs returns every renderer playback can be sent to
+func (b *Backend) Outputs() []backends.Output {
+	active := b.activeOutput()
+	outputs := make([]backends.Output, len(b.outputs))
+	for i, renderer := range b.outputs {
+		outputs[i] = backends.Output{Name: renderer.Name, Enabled: i == active}
+	}
+	return outputs
+}
+
+// EnableOutput enables or disables an output by index
+// Only one renderer plays at a time, so enabling an output disables the others
+// The switch takes effect from the next upload
+func (b *Backend) EnableOutput(index int, enabled bool) error {
+	if index < 0 || index >= len(b.outputs) {
+		return fmt.Errorf("no such output: %d", index)
+	}
+
+	b.outputMu.Lock()
+	defer b.outputMu.Unlock()
+
+	if enabled {
+		b.active = index
+	} else if b.active == index {
+		b.active = -1
+	}
+	return nil
+}
+
+// activeOutput returns the index of the enabled output, -1 if none
+func (b *Backend) activeOutput() int {
+	b.outputMu.Lock()
+	defer b.outputMu.Unlock()
+	return b.active
+}
@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"log"
+	"os"
+)
+
+// blob returns the key of the file an entry shares with others through hard
+// links, "" if its file is its own
+func (e *Entry) blob() string {
+	if e.Info == nil {
+		return ""
+	}
+	return e.Info.Blob
+}
+
+// addSize counts an entry towards the cache size, once for all the entries
+// sharing a file
+// Caller must hold the lock
+func (c *DiskCache) addSize(entry *Entry) {
+	if blob := entry.blob(); blob != "" {
+		c.blobs[blob]++
+		if c.blobs[blob] > 1 {
+			return
+		}
+	}
+	c.currentSize += entry.Size
+}
+
+// removeSize takes an entry out of the cache size, its file only when no
+// other entry shares it
+// Caller must hold the lock
+func (c *DiskCache) removeSize(entry *Entry) {
+	if blob := entry.blob(); blob != "" {
+		c.blobs[blob]--
+		if c.blobs[blob] > 0 {
+			return
+		}
+		delete(c.blobs, blob)
+	}
+	c.currentSize -= entry.Size
+}
+
+// sizeToAdd returns how much the cache grows by registering an entry of
+// size bytes with info, nothing if it shares a file already counted
+// Caller must hold the lock
+func (c *DiskCache) sizeToAdd(info *EntryInfo, size int64) int64 {
+	if info != nil && info.Blob != "" && c.blobs[info.Blob] > 0 {
+		return 0
+	}
+	return size
+}
+
+// shareDecoded looks for an entry decoded from the same download content
+// with the same settings as info describes and, finding one, hard links its
+// file to dest instead of keeping another copy of the same audio
+// info then names the shared file in Blob, as does the entry's index
+// Returns whether dest is a link to an existing entry's file; if the file
+// system cannot link, the new copy is kept
+func (c *DiskCache) shareDecoded(info *EntryInfo, dest string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var match *Entry
+	for _, entry := range c.entries {
+		if entry.Info != nil && entry.Info.Content == info.Content && entry.Info.Params == info.Params &&
+			entry.Info.Checksum == info.Checksum {
+			match = entry
+			break
+		}
+	}
+	if match == nil {
+		return false
+	}
+	if err := os.Link(match.Path, dest); err != nil {
+		log.Printf("Could not share cached file of %s: %v", match.Info.URL, err)
+		return false
+	}
+
+	if match.Info.Blob == "" {
+		// The first share: the entry's file, already counted once, is now a blob
+		shared := *match.Info
+		shared.Blob = match.Key
+		if err := writeEntryInfo(match.Path, &shared); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		match.Info = &shared
+		c.blobs[shared.Blob] = 1
+	}
+	info.Blob = match.Info.Blob
+	log.Printf("Same audio as cached %s, sharing its file", match.Info.URL)
+	return true
+}
@@ -2,16 +2,20 @@ package cache
 
 import (
 	"container/list"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Entry represents a cache entry
@@ -19,72 +23,168 @@ type Entry struct {
 	Key     string
 	Path    string
 	Size    int64
+	Info    *EntryInfo // What the entry was made from, nil if it has no index
 	element *list.Element
+
+	Hits       int64     // Uses since the entry was added or loaded
+	LastAccess time.Time // Last use, from the file's modification time after a restart
+	Added      time.Time // When the entry was added; zero for entries loaded at startup
+
+	verified bool // The file matched its checksum since the cache was opened
 }
 
-// DiskCache implements LRU disk-based cache with persistence across sessions
+// DiskCache implements a disk-based cache with persistence across sessions,
+// evicting entries by a configurable policy (see Options)
 type DiskCache struct {
 	mu          sync.Mutex
 	cacheDir    string
-	maxSize     int64
+	opts        Options
 	currentSize int64
 
 	// LRU tracking
 	entries map[string]*Entry
 	lru     *list.List
 
+	// Entries sharing each hard linked file, by EntryInfo.Blob
+	blobs map[string]int
+
+	// Wakes the background evictor when an entry is added
+	added chan struct{}
+
+	// Counters for Stats since the cache was opened
+	hits, misses, evictions atomic.Int64
+
 	// Download synchronization - prevents concurrent downloads of same URL
 	downloadLocks sync.Map // map[string]*sync.Mutex
+
+	// Slots limiting how many downloads run at once, and the bandwidth cap
+	// they share (nil for none)
+	downloads chan struct{}
+	throttle  *throttle
+
+	// Fetches and decodes in progress, by URL
+	jobsMu sync.Mutex
+	jobs   map[string]*decodeJob
+
+	// Fraction done of each URL being fetched or decoded
+	progress sync.Map // map[string]float64
+
+	// Cancelled by Close to stop every fetch and decode
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Source is the local file a DecodeFunc decodes
+type Source struct {
+	Path string
+	// The download writing Path when the URL is remote, which may still be
+	// running: decoders that can read it as it arrives start at once, and the
+	// rest Wait for it first. nil for local files
+	Partial *PartialFile
+}
+
+// DecodeFunc decodes source into a cache file at dest, stopping when ctx is
+// cancelled, and tells progress of the fraction done as it goes
+// It returns what it wrote, which goes into the entry's index
+type DecodeFunc func(ctx context.Context, source Source, dest string, progress func(float64)) (Decoded, error)
+
+// StreamDecodeFunc is a DecodeFunc that also passes the file to tee as it is written
+type StreamDecodeFunc func(ctx context.Context, source Source, dest string, tee io.Writer, progress func(float64)) (Decoded, error)
+
+// Decoder decodes sources into cache files under one set of decode settings
+type Decoder struct {
+	Params string // The settings, kept in each entry's index; an entry made under others is decoded again
+	Decode DecodeFunc
+}
+
+// StreamDecoder is a Decoder whose function also passes the file to a tee (see StreamDecoded)
+type StreamDecoder struct {
+	Params string
+	Decode StreamDecodeFunc
 }
 
 // NewDiskCache creates a new disk-based LRU cache
 // On startup, it scans the cache directory and loads existing cached files
 func NewDiskCache(cacheDir string, maxSizeBytes int64) (*DiskCache, error) {
+	return NewDiskCacheWithOptions(cacheDir, Options{MaxSize: maxSizeBytes})
+}
+
+// NewDiskCacheWithOptions creates a new disk-based cache evicting by opts
+// Like NewDiskCache it loads existing cached files, and unless opts.Shared it
+// clears out abandoned temporary files and starts a background evictor that
+// runs until Close
+func NewDiskCacheWithOptions(cacheDir string, opts Options) (*DiskCache, error) {
+	if err := ValidatePolicy(opts.Policy); err != nil {
+		return nil, err
+	}
 	if err := os.MkdirAll(cacheDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create cache directory: %w", err)
 	}
+	if opts.TempDir == "" {
+		opts.TempDir = filepath.Join(cacheDir, "tmp")
+	}
+	if err := os.MkdirAll(opts.TempDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache temp directory: %w", err)
+	}
 
 	c := &DiskCache{
 		cacheDir: cacheDir,
-		maxSize:  maxSizeBytes,
+		opts:     opts.withDefaults(),
 		entries:  make(map[string]*Entry),
 		lru:      list.New(),
+		blobs:    make(map[string]int),
+		added:    make(chan struct{}, 1),
+		jobs:     make(map[string]*decodeJob),
 	}
+	c.downloads = make(chan struct{}, c.opts.MaxDownloads)
+	if c.opts.DownloadRate > 0 {
+		c.throttle = &throttle{rate: c.opts.DownloadRate}
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 
 	// Load existing cache entries from disk (persistence across sessions)
 	if err := c.scan(); err != nil {
 		return nil, fmt.Errorf("failed to scan cache: %w", err)
 	}
+	if c.opts.Shared {
+		return c, nil
+	}
+	c.sweepStaging()
 
+	go c.evictor()
 	return c, nil
 }
 
-// scan loads existing cache entries from disk
+// scan loads existing cache entries from disk, with their index where they
+// have one, moving those of a cache from before sharding into their shard
+// first
 func (c *DiskCache) scan() error {
-	return filepath.Walk(c.cacheDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return err
-		}
-
-		// Skip temporary files
-		if filepath.Ext(path) == ".tmp" {
-			return nil
-		}
-
-		// Use filename as key
-		key := filepath.Base(path)
+	if err := c.migrateFlat(); err != nil {
+		return fmt.Errorf("failed to move cache entries into subdirectories: %w", err)
+	}
+	loaded, err := c.scanShards()
+	if err != nil {
+		return err
+	}
 
-		entry := &Entry{
-			Key:  key,
-			Path: path,
-			Size: info.Size(),
-		}
+	// Most recently used first, as the modification times record
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].LastAccess.After(loaded[j].LastAccess)
+	})
+	indexed := 0
+	for _, entry := range loaded {
 		entry.element = c.lru.PushBack(entry)
-		c.entries[key] = entry
-		c.currentSize += info.Size()
+		c.entries[entry.Key] = entry
+		c.addSize(entry)
+		if entry.Info != nil {
+			indexed++
+		}
+	}
 
-		return nil
-	})
+	if len(c.entries) > 0 {
+		log.Printf("Loaded %d cache entries (%d indexed)", len(c.entries), indexed)
+	}
+	return nil
 }
 
 // hashKey creates a consistent hash for a key
@@ -93,14 +193,15 @@ func (c *DiskCache) hashKey(key string) string {
 	return hex.EncodeToString(hash[:])
 }
 
-// keyToPath converts a cache key to filesystem path
+// keyToPath converts a cache key to filesystem path, in its shard (see shardDir)
 func (c *DiskCache) keyToPath(key string) string {
 	hash := c.hashKey(key)
-	return filepath.Join(c.cacheDir, hash)
+	return filepath.Join(c.shardDir(hash), hash)
 }
 
 // GetPathForKey returns the filesystem path for a cache key
-// This allows external code to write directly to the cache location
+// This allows external code to write directly to the cache location, once
+// it has created the path's directory
 func (c *DiskCache) GetPathForKey(key string) string {
 	return c.keyToPath(key)
 }
@@ -128,25 +229,46 @@ func (c *DiskCache) RegisterFile(key string) error {
 	}
 
 	fileSize := info.Size()
+	entryInfo := readEntryInfo(path)
 
 	// Evict until there's space
-	for c.currentSize+fileSize > c.maxSize && c.lru.Len() > 0 {
-		c.evictOldest()
-	}
+	c.makeRoom(c.sizeToAdd(entryInfo, fileSize))
 
 	// Add to cache
+	now := time.Now()
 	entry := &Entry{
-		Key:  hash,
-		Path: path,
-		Size: fileSize,
+		Key:        hash,
+		Path:       path,
+		Size:       fileSize,
+		Info:       entryInfo,
+		LastAccess: now,
+		Added:      now,
 	}
 	entry.element = c.lru.PushFront(entry)
 	c.entries[hash] = entry
-	c.currentSize += fileSize
+	c.addSize(entry)
+	c.wakeEvictor()
 
 	return nil
 }
 
+// makeRoom evicts entries so size more bytes fit within the maximum, as far
+// as protection allows
+// Caller must hold the lock
+func (c *DiskCache) makeRoom(size int64) {
+	if !c.evictUntil(size, c.opts.MaxSize) {
+		log.Printf("Cache over its maximum size while all entries are protected")
+	}
+}
+
+// wakeEvictor tells the background evictor the cache has grown
+func (c *DiskCache) wakeEvictor() {
+	select {
+	case c.added <- struct{}{}:
+	default:
+	}
+}
+
 // Get retrieves a cache entry reader with format information
 func (c *DiskCache) Get(key string) (*CachedAudioReader, bool) {
 	c.mu.Lock()
@@ -156,11 +278,15 @@ func (c *DiskCache) Get(key string) (*CachedAudioReader, bool) {
 	hash := c.hashKey(key)
 	entry, exists := c.entries[hash]
 	if !exists {
+		c.misses.Add(1)
 		return nil, false
 	}
 
 	// Move to front (most recently used)
+	c.hits.Add(1)
 	c.lru.MoveToFront(entry.element)
+	entry.Hits++
+	entry.LastAccess = time.Now()
 
 	// Open file for reading
 	f, err := os.Open(entry.Path)
@@ -168,7 +294,7 @@ func (c *DiskCache) Get(key string) (*CachedAudioReader, bool) {
 		// File disappeared, remove from cache
 		delete(c.entries, hash)
 		c.lru.Remove(entry.element)
-		c.currentSize -= entry.Size
+		c.removeSize(entry)
 		return nil, false
 	}
 
@@ -179,8 +305,8 @@ func (c *DiskCache) Get(key string) (*CachedAudioReader, bool) {
 		// Invalid cache file, remove it
 		delete(c.entries, hash)
 		c.lru.Remove(entry.element)
-		c.currentSize -= entry.Size
-		os.Remove(entry.Path)
+		c.removeSize(entry)
+		removeEntry(entry.Path)
 		return nil, false
 	}
 
@@ -207,6 +333,9 @@ func (c *DiskCache) Put(key string, format *CachedAudioFormat, reader io.Reader)
 	// Create temp file
 	path := c.keyToPath(key)
 	tempPath := path + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
 
 	f, err := os.Create(tempPath)
 	if err != nil {
@@ -233,9 +362,7 @@ func (c *DiskCache) Put(key string, format *CachedAudioFormat, reader io.Reader)
 	totalSize := int64(cacheHeaderSize) + dataSize
 
 	// Evict until there's space
-	for c.currentSize+totalSize > c.maxSize && c.lru.Len() > 0 {
-		c.evictOldest()
-	}
+	c.makeRoom(totalSize)
 
 	// Rename temp file to final path (atomic)
 	if err := os.Rename(tempPath, path); err != nil {
@@ -244,33 +371,22 @@ func (c *DiskCache) Put(key string, format *CachedAudioFormat, reader io.Reader)
 	}
 
 	// Add to cache
+	now := time.Now()
 	entry := &Entry{
-		Key:  hash,
-		Path: path,
-		Size: totalSize,
+		Key:        hash,
+		Path:       path,
+		Size:       totalSize,
+		LastAccess: now,
+		Added:      now,
 	}
 	entry.element = c.lru.PushFront(entry)
 	c.entries[hash] = entry
-	c.currentSize += totalSize
+	c.addSize(entry)
+	c.wakeEvictor()
 
 	return nil
 }
 
-// evictOldest removes the least recently used entry
-func (c *DiskCache) evictOldest() {
-	element := c.lru.Back()
-	if element == nil {
-		return
-	}
-
-	entry := element.Value.(*Entry)
-	c.lru.Remove(element)
-	delete(c.entries, entry.Key)
-	c.currentSize -= entry.Size
-
-	os.Remove(entry.Path)
-}
-
 // Invalidate removes a cache entry both from memory and disk
 // Use this when a cached file is discovered to be corrupt or invalid
 func (c *DiskCache) Invalidate(key string) error {
@@ -287,10 +403,10 @@ func (c *DiskCache) Invalidate(key string) error {
 	// Remove from cache tracking
 	delete(c.entries, hash)
 	c.lru.Remove(entry.element)
-	c.currentSize -= entry.Size
+	c.removeSize(entry)
 
 	// Remove file from disk
-	if err := os.Remove(entry.Path); err != nil && !os.IsNotExist(err) {
+	if err := removeEntry(entry.Path); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to remove cache file: %w", err)
 	}
 
@@ -299,15 +415,57 @@ func (c *DiskCache) Invalidate(key string) error {
 }
 
 // Clear removes all cache entries
-func (c *DiskCache) Clear() error {
+// Only the entries' files go, so a cache directory shared with other files
+// is left as it was
+// Returns how many entries were removed
+func (c *DiskCache) Clear() (int, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	var errs []error
+	for _, entry := range c.entries {
+		if err := removeEntry(entry.Path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	removed := len(c.entries)
 	c.entries = make(map[string]*Entry)
 	c.lru = list.New()
+	c.blobs = make(map[string]int)
 	c.currentSize = 0
 
-	return os.RemoveAll(c.cacheDir)
+	return removed, errors.Join(errs...)
+}
+
+// Close stops every fetch and decode in progress; their callers get an error
+// and no partial file is left in the cache
+func (c *DiskCache) Close() {
+	c.cancel()
+}
+
+// Progress returns how much of a URL has been fetched and decoded, from 0 to 1
+// Returns false if the URL is not being fetched or decoded now, or its length is not known
+func (c *DiskCache) Progress(url string) (float64, bool) {
+	done, ok := c.progress.Load(url)
+	if !ok {
+		return 0, false
+	}
+	return done.(float64), true
+}
+
+// trackProgress returns a function recording a stage of a URL's job, mapping
+// the stage's own fraction done onto [from, to] of the whole job
+// Each quarter of the job is logged
+func (c *DiskCache) trackProgress(url, stage string, from, to float64) func(float64) {
+	logged := int(from * 4)
+	return func(done float64) {
+		total := from + (to-from)*done
+		c.progress.Store(url, total)
+		if quarter := int(total * 4); quarter > logged && quarter < 4 {
+			logged = quarter
+			log.Printf("%s %s: %d%%", stage, url, quarter*25)
+		}
+	}
 }
 
 // Size returns current cache size in bytes
@@ -323,102 +481,347 @@ func (c *DiskCache) getDownloadLock(url string) *sync.Mutex {
 	return lock.(*sync.Mutex)
 }
 
-// fetchToTempFile downloads a remote URL to a temporary file
-// Uses URL hash for consistent temp file naming to enable deduplication
-// Returns the temp file path
+// startFetch starts downloading a remote URL to a temporary file in
+// Options.TempDir and returns the file as it is written
+// Errors up to the response headers are returned; later ones end the
+// download with them. Cancelling ctx stops the download; progress is told of
+// the fraction downloaded when the server gives the length
+// Downloads beyond Options.MaxDownloads wait for a slot first, and together
+// they stay within Options.DownloadRate
 // NOTE: Caller must hold the download lock for this URL
-func (c *DiskCache) fetchToTempFile(url string) (string, error) {
+func (c *DiskCache) startFetch(ctx context.Context, url string, progress func(float64)) (*PartialFile, error) {
 	log.Printf("Starting download for: %s", url)
-	// Create temp file with hash-based name for consistency
-	urlHash := c.hashKey(url)
-	tempPath := filepath.Join(os.TempDir(), fmt.Sprintf("direttampd-fetch-%s.tmp", urlHash))
+	tempPath := c.stagingPath("fetch", url)
+
+	// Downloads remove their file when done, so one still there was cut
+	// short by a crash and cannot be trusted to be whole
+	if err := os.Remove(tempPath); err == nil {
+		log.Printf("Removed abandoned temp file: %s", tempPath)
+	}
 
-	// Check if file already exists (from another request or previous download)
-	if _, err := os.Stat(tempPath); err == nil {
-		log.Printf("Reusing existing temp file: %s", tempPath)
-		return tempPath, nil
+	release, err := c.acquireDownload(ctx, url)
+	if err != nil {
+		return nil, err
 	}
 
 	// Create the temp file
 	tempFile, err := os.Create(tempPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to create temp file: %w", err)
+		release()
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
 	}
 
 	// Download the URL
 	log.Printf("Downloading URL: %s", url)
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
+		release()
 		tempFile.Close()
 		os.Remove(tempPath)
-		return "", fmt.Errorf("failed to fetch URL: %w", err)
+		return nil, fmt.Errorf("failed to fetch URL: %w", err)
+	}
+	resp, err := c.opts.Client.Do(req)
+	if err != nil {
+		release()
+		tempFile.Close()
+		os.Remove(tempPath)
+		return nil, fmt.Errorf("failed to fetch URL: %w", err)
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		release()
+		resp.Body.Close()
 		tempFile.Close()
 		os.Remove(tempPath)
-		return "", fmt.Errorf("failed to fetch URL: HTTP %d", resp.StatusCode)
+		return nil, fmt.Errorf("failed to fetch URL: HTTP %d", resp.StatusCode)
 	}
 
-	// Copy response to temp file
-	_, err = io.Copy(tempFile, resp.Body)
-	tempFile.Close()
-	if err != nil {
-		os.Remove(tempPath)
-		return "", fmt.Errorf("failed to write temp file: %w", err)
+	// Copy response to temp file, where it can be read as it arrives
+	partial := newPartialFile(tempPath)
+	partial.etag = resp.Header.Get("ETag")
+	partial.lastModified = resp.Header.Get("Last-Modified")
+	go func() {
+		defer release()
+		defer resp.Body.Close()
+		var body io.Reader = resp.Body
+		if c.throttle != nil {
+			body = &throttledReader{ctx: ctx, r: body, t: c.throttle}
+		}
+		if resp.ContentLength > 0 {
+			body = &progressReader{r: body, total: resp.ContentLength, progress: progress}
+		}
+		writer := &partialWriter{f: tempFile, p: partial, hash: sha256.New()}
+		_, err := io.Copy(writer, body)
+		if closeErr := tempFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			partial.finish("", fmt.Errorf("failed to write temp file: %w", err))
+			return
+		}
+		log.Printf("Download complete: %s", tempPath)
+		partial.finish(hex.EncodeToString(writer.hash.Sum(nil)), nil)
+	}()
+	return partial, nil
+}
+
+// progressReader tells progress of the fraction of total bytes read
+type progressReader struct {
+	r        io.Reader
+	read     int64
+	total    int64
+	progress func(float64)
+}
+
+// Read reads from the underlying reader and reports the fraction read so far
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if n > 0 {
+		p.progress(min(float64(p.read)/float64(p.total), 1))
 	}
+	return n, err
+}
 
-	log.Printf("Download complete: %s", tempPath)
-	return tempPath, nil
+// decodeJob is the fetch and decode of one URL, shared by every caller waiting for it
+type decodeJob struct {
+	done    chan struct{} // Closed when the job ends
+	path    string
+	err     error
+	waiters int                // Callers still waiting; the job is cancelled when none are left
+	cancel  context.CancelFunc // Stops the job
 }
 
 // EnsureDecoded ensures a URL is decoded and cached
-// decodeFn should decode from source path to destination path
+// decoder should decode from source path to destination path; a cached file
+// made under other decode settings is dropped and decoded again under its own
+// Callers asking for a URL already being decoded the same way wait for the same job. A
+// caller whose ctx is cancelled stops waiting, and the job stops once no
+// caller is left or the cache is closed. While it runs its progress can be
+// read with Progress; remote URLs count the download as the first half, unless
+// decoding follows the download as it arrives (see Source)
+// A cached file is checked against its checksum on its first use, and decoded
+// again if it is corrupt
 // Returns the cached file path
-func (c *DiskCache) EnsureDecoded(url string, decodeFn func(source, dest string) error) (string, error) {
+func (c *DiskCache) EnsureDecoded(ctx context.Context, url string, decoder Decoder) (string, error) {
 	cachePath := c.GetPathForKey(url)
 
 	// Quick check if already cached (without lock)
-	if _, err := os.Stat(cachePath); err == nil {
+	if _, err := os.Stat(cachePath); err == nil && !c.stale(url) && c.decodedUnder(url, decoder.Params) && c.intact(ctx, url) {
+		c.hits.Add(1)
+		c.touch(url)
 		return cachePath, nil
 	}
+	c.misses.Add(1)
+
+	// Jobs are shared by URL and settings, so no caller gets a file decoded for another output
+	key := url + "|" + decoder.Params
+	c.jobsMu.Lock()
+	job, ok := c.jobs[key]
+	if !ok {
+		jobCtx, cancel := context.WithCancel(c.ctx)
+		job = &decodeJob{done: make(chan struct{}), cancel: cancel}
+		c.jobs[key] = job
+		go c.runJob(jobCtx, job, key, url, decoder)
+	}
+	job.waiters++
+	c.jobsMu.Unlock()
+
+	select {
+	case <-job.done:
+		return job.path, job.err
+	case <-ctx.Done():
+		c.jobsMu.Lock()
+		job.waiters--
+		if job.waiters == 0 {
+			// Nobody wants it any more; a later caller starts afresh
+			job.cancel()
+			if c.jobs[key] == job {
+				delete(c.jobs, key)
+			}
+		}
+		c.jobsMu.Unlock()
+		return "", ctx.Err()
+	}
+}
+
+// stale reports whether a cached source has changed since it was decoded, in
+// which case its entry is dropped to be decoded again
+// Local files are checked every time; remote URLs only every
+// Options.Revalidate, as that costs a request (see remoteChanged)
+func (c *DiskCache) stale(url string) bool {
+	c.mu.Lock()
+	var info *EntryInfo
+	if entry, ok := c.entries[c.hashKey(url)]; ok {
+		info = entry.Info
+	}
+	c.mu.Unlock()
+	if info == nil {
+		return false
+	}
+	if isRemote(url) {
+		if !c.remoteChanged(url, info) {
+			return false
+		}
+	} else if version := localVersion(url); info.Version == "" || version == "" || version == info.Version {
+		return false
+	}
 
-	// Get lock for this URL to prevent concurrent decode operations
+	log.Printf("Source changed since it was cached: %s", url)
+	if err := c.Invalidate(url); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return true
+}
+
+// decodedUnder reports whether the cached file of url was decoded under params
+// One made under other settings, for another output, is dropped to be decoded again
+func (c *DiskCache) decodedUnder(url string, params string) bool {
+	c.mu.Lock()
+	made, indexed := "", false
+	if entry, ok := c.entries[c.hashKey(url)]; ok && entry.Info != nil {
+		made, indexed = entry.Info.Params, true
+	}
+	c.mu.Unlock()
+	if !indexed || made == params {
+		return true
+	}
+
+	log.Printf("Cached %s was decoded for other settings (%s), decoding it again for %s", url, made, params)
+	if err := c.Invalidate(url); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return false
+}
+
+// runJob fetches and decodes a URL for a job and reports the outcome to its waiters
+// key is the job's entry in c.jobs
+func (c *DiskCache) runJob(ctx context.Context, job *decodeJob, key string, url string, decoder Decoder) {
+	job.path, job.err = c.decode(ctx, url, decoder)
+	job.cancel()
+
+	c.jobsMu.Lock()
+	if c.jobs[key] == job {
+		delete(c.jobs, key)
+	}
+	c.jobsMu.Unlock()
+	close(job.done)
+}
+
+// decode fetches and decodes a URL into the cache unless it is there already
+func (c *DiskCache) decode(ctx context.Context, url string, decoder Decoder) (string, error) {
+	cachePath := c.GetPathForKey(url)
+
+	// Get lock for this URL to prevent concurrent decode operations, such as
+	// a cancelled job still winding down
 	lock := c.getDownloadLock(url)
 	lock.Lock()
 	defer lock.Unlock()
 
 	// Check again after acquiring lock (another goroutine may have completed it)
-	if _, err := os.Stat(cachePath); err == nil {
+	if _, err := os.Stat(cachePath); err == nil && c.decodedUnder(url, decoder.Params) {
 		log.Printf("Using cached file: %s", cachePath)
 		return cachePath, nil
 	}
+	defer c.progress.Delete(url)
 
 	// Determine source path - fetch remote URLs locally first
-	sourcePath := url
-	var tempFile string
-	isRemote := strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
-
-	if isRemote {
-		// Fetch remote URL to temporary file first
+	source := Source{Path: url}
+	info := &EntryInfo{URL: url, Version: localVersion(url)}
+	var download *PartialFile
+	decodeProgress := c.trackProgress(url, "Decoding", 0, 1)
+
+	if isRemote(url) {
+		// Fetch remote URL to a temporary file, which decoding can start on
+		// before the download is complete
 		log.Printf("Fetching remote URL to local file: %s", url)
-		var err error
-		tempFile, err = c.fetchToTempFile(url)
+		fetchCtx, cancelFetch := context.WithCancel(ctx)
+		var following atomic.Bool // Decoding reads the download as it arrives
+		downloadProgress := c.trackProgress(url, "Downloading", 0, 0.5)
+		partial, err := c.startFetch(fetchCtx, url, func(done float64) {
+			if !following.Load() {
+				downloadProgress(done)
+			}
+		})
 		if err != nil {
+			cancelFetch()
 			return "", fmt.Errorf("failed to fetch remote URL: %w", err)
 		}
-		defer os.Remove(tempFile) // Clean up temp file when done
-		sourcePath = tempFile
-		log.Printf("Fetched to temporary file: %s", tempFile)
+		defer func() {
+			// Clean up temp file once the download has stopped
+			cancelFetch()
+			partial.Wait(context.Background())
+			os.Remove(partial.Path())
+		}()
+		source = Source{Path: partial.Path(), Partial: partial}
+		download = partial
+		info.ETag, info.LastModified = partial.etag, partial.lastModified
+		info.Version = info.ETag
+		if info.Version == "" {
+			info.Version = info.LastModified
+		}
+
+		// A decode that starts before the download is complete covers it, so
+		// its progress is the whole job's; otherwise it is the second half
+		var stage func(float64)
+		decodeProgress = func(done float64) {
+			if stage == nil {
+				if _, complete := partial.Size(); complete {
+					stage = c.trackProgress(url, "Decoding", 0.5, 1)
+				} else {
+					following.Store(true)
+					stage = c.trackProgress(url, "Decoding", 0, 1)
+				}
+			}
+			stage(done)
+		}
 	}
 
-	// Decode to cache
-	log.Printf("Decoding to cache: %s", sourcePath)
-	if err := decodeFn(sourcePath, cachePath); err != nil {
+	// Decode to a staging file, renamed into the cache once complete so a
+	// cache file is never one cut short
+	stagePath := c.stagingPath("decode", url)
+	log.Printf("Decoding to cache: %s", source.Path)
+	decoded, err := decoder.Decode(ctx, source, stagePath, decodeProgress)
+	if err != nil {
+		os.Remove(stagePath)
+		if ctx.Err() != nil {
+			log.Printf("Decoding cancelled: %s", url)
+		}
 		return "", fmt.Errorf("failed to decode: %w", err)
 	}
 
+	// Index the entry by its URL before it appears in the cache, and before
+	// registering it, which reads the index
+	info.Duration, info.Format, info.Params = decoded.Duration, decoded.Format, decoder.Params
+	info.Created = time.Now()
+	info.Checked = info.Created
+	if info.Checksum, err = checksumFile(ctx, stagePath); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	if download != nil {
+		info.Content = download.Content()
+	}
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		os.Remove(stagePath)
+		return "", fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	// The same track fetched before under another URL is linked to instead
+	shared := c.opts.Dedupe && info.Content != "" && info.Checksum != "" && c.shareDecoded(info, cachePath)
+	if shared {
+		os.Remove(stagePath)
+	}
+	if err := writeEntryInfo(cachePath, info); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	if !shared {
+		if err := moveFile(stagePath, cachePath); err != nil {
+			os.Remove(stagePath)
+			removeEntry(cachePath)
+			return "", fmt.Errorf("failed to move decoded file into cache: %w", err)
+		}
+	}
+
 	log.Printf("Decoded successfully to: %s", cachePath)
 
 	// Register the file with cache
@@ -426,7 +829,47 @@ func (c *DiskCache) EnsureDecoded(url string, decodeFn func(source, dest string)
 		log.Printf("Warning: failed to register cache file: %v", err)
 	} else {
 		log.Printf("Registered in cache: %s", url)
+		if info.Checksum != "" {
+			c.markVerified(url)
+		}
 	}
 
 	return cachePath, nil
 }
+
+// StreamDecoded decodes a URL into the cache like EnsureDecoded and returns a
+// reader receiving the decoded file while it is written, so it can be used
+// before decoding finishes
+// decoder writes dest and passes the same bytes to tee. A URL that is already
+// cached is read from its file. The reader fails with the decode error, if
+// any; closing it early leaves the decode running to complete the cache file
+// unless ctx is cancelled
+func (c *DiskCache) StreamDecoded(ctx context.Context, url string, decoder StreamDecoder) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		streamed := false
+		cachePath, err := c.EnsureDecoded(ctx, url, Decoder{Params: decoder.Params, Decode: func(ctx context.Context, source Source, dest string, progress func(float64)) (Decoded, error) {
+			streamed = true
+			return decoder.Decode(ctx, source, dest, pw, progress)
+		}})
+		if err == nil && !streamed {
+			err = copyFile(pw, cachePath)
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr
+}
+
+// copyFile writes the contents of a file to w
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,561 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestCache opens a cache in a fresh directory
+// The cache is opened shared so no background evictor runs: tests drive
+// eviction themselves
+func newTestCache(t *testing.T, opts Options) *DiskCache {
+	t.Helper()
+	opts.Shared = true
+	c, err := NewDiskCacheWithOptions(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("NewDiskCacheWithOptions: %v", err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// reopen opens the directory of a cache again, as after a restart
+func reopen(t *testing.T, c *DiskCache) *DiskCache {
+	t.Helper()
+	c.Close()
+	opts := c.opts
+	reopened, err := NewDiskCacheWithOptions(c.cacheDir, opts)
+	if err != nil {
+		t.Fatalf("NewDiskCacheWithOptions: %v", err)
+	}
+	t.Cleanup(reopened.Close)
+	return reopened
+}
+
+// copyDecoder returns a decoder under params that "decodes" a source by
+// copying it, counting its calls
+func copyDecoder(params string, calls *atomic.Int32) Decoder {
+	return Decoder{Params: params, Decode: func(ctx context.Context, source Source, dest string, progress func(float64)) (Decoded, error) {
+		calls.Add(1)
+		if source.Partial != nil {
+			if err := source.Partial.Wait(ctx); err != nil {
+				return Decoded{}, err
+			}
+		}
+		data, err := os.ReadFile(source.Path)
+		if err != nil {
+			return Decoded{}, err
+		}
+		return Decoded{Duration: 1, Format: "test"}, os.WriteFile(dest, data, 0644)
+	}}
+}
+
+// writeSource writes a source file for the cache to decode
+func writeSource(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// addEntry puts an indexed entry of size bytes for url straight into the cache
+func addEntry(t *testing.T, c *DiskCache, url string, size int) {
+	t.Helper()
+	path := c.GetPathForKey(url)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeEntryInfo(path, &EntryInfo{URL: url}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterFile(url); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sources returns the sources of a cache's entries, most recently used first
+func sources(c *DiskCache) []string {
+	var urls []string
+	for _, entry := range c.Stats().EntryStats {
+		urls = append(urls, entry.Source)
+	}
+	return urls
+}
+
+func TestEntryInfo(t *testing.T) {
+	tests := []struct {
+		name  string
+		index string // Sidecar contents, "" for none
+		want  *EntryInfo
+	}{
+		{"missing", "", nil},
+		{"not JSON", "{", nil},
+		{"without URL", `{"version": "1"}`, nil},
+		{"minimal", `{"url": "/music/a.flac"}`, &EntryInfo{URL: "/music/a.flac"}},
+		{"unknown fields", `{"url": "/music/a.flac", "future": true, "params": "p"}`, &EntryInfo{URL: "/music/a.flac", Params: "p"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "entry")
+			if tt.index != "" {
+				if err := os.WriteFile(indexPath(path), []byte(tt.index), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := readEntryInfo(path); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readEntryInfo = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// Everything written is read back
+	path := filepath.Join(t.TempDir(), "entry")
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	info := &EntryInfo{
+		URL: "http://host/a.flac", Version: `"etag"`, Duration: 12.5, Format: "44100 Hz, 16-bit, stereo",
+		Params: "p", Checksum: "crc32c:01234567", Created: created, Content: "abc", Blob: "def",
+		ETag: `"etag"`, LastModified: "Mon, 01 Jan 2024 00:00:00 GMT", Checked: created,
+	}
+	if err := writeEntryInfo(path, info); err != nil {
+		t.Fatal(err)
+	}
+	if got := readEntryInfo(path); !reflect.DeepEqual(got, info) {
+		t.Errorf("round trip = %+v, want %+v", got, info)
+	}
+	if _, err := os.Stat(indexPath(path) + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary index left behind: %v", err)
+	}
+}
+
+func TestCacheReopen(t *testing.T) {
+	c := newTestCache(t, Options{MaxSize: 1 << 20})
+	var calls atomic.Int32
+	decoder := copyDecoder("p", &calls)
+
+	first := writeSource(t, "first.raw", []byte("first"))
+	second := writeSource(t, "second.raw", []byte("second track"))
+	for _, source := range []string{first, second} {
+		if _, err := c.EnsureDecoded(context.Background(), source, decoder); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Use the first again so it is the most recently used, on disk too
+	time.Sleep(10 * time.Millisecond)
+	if _, err := c.EnsureDecoded(context.Background(), first, decoder); err != nil {
+		t.Fatal(err)
+	}
+
+	// An index without its entry is cleared out on the next scan
+	orphan := c.GetPathForKey("orphan")
+	if err := os.MkdirAll(filepath.Dir(orphan), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeEntryInfo(orphan, &EntryInfo{URL: "orphan"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c = reopen(t, c)
+	if got, want := sources(c), []string{first, second}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries after reopening = %q, want %q", got, want)
+	}
+	if got, want := c.Size(), int64(len("first")+len("second track")); got != want {
+		t.Errorf("Size() = %d, want %d", got, want)
+	}
+	if _, err := os.Stat(indexPath(orphan)); !os.IsNotExist(err) {
+		t.Errorf("orphaned index was not removed: %v", err)
+	}
+
+	entry := c.entries[c.hashKey(second)]
+	if entry.Info == nil || entry.Info.Params != "p" || entry.Info.Version != localVersion(second) || entry.Info.Checksum == "" {
+		t.Errorf("index after reopening = %+v", entry.Info)
+	}
+
+	// Reopened entries are used without decoding them again
+	if _, err := c.EnsureDecoded(context.Background(), second, decoder); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("decoded %d times, want 2", calls.Load())
+	}
+}
+
+func TestEnsureDecodedReuse(t *testing.T) {
+	tests := []struct {
+		name        string
+		change      func(t *testing.T, source string)
+		params      string
+		wantDecoded int32
+	}{
+		{"unchanged", func(t *testing.T, source string) {}, "p", 1},
+		{"other settings", func(t *testing.T, source string) {}, "q", 2},
+		{"source rewritten", func(t *testing.T, source string) {
+			if err := os.WriteFile(source, []byte("new contents"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, "p", 2},
+		{"source touched", func(t *testing.T, source string) {
+			later := time.Now().Add(time.Hour)
+			if err := os.Chtimes(source, later, later); err != nil {
+				t.Fatal(err)
+			}
+		}, "p", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t, Options{MaxSize: 1 << 20})
+			var calls atomic.Int32
+			source := writeSource(t, "track.raw", []byte("contents"))
+
+			if _, err := c.EnsureDecoded(context.Background(), source, copyDecoder("p", &calls)); err != nil {
+				t.Fatal(err)
+			}
+			tt.change(t, source)
+			path, err := c.EnsureDecoded(context.Background(), source, copyDecoder(tt.params, &calls))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if calls.Load() != tt.wantDecoded {
+				t.Errorf("decoded %d times, want %d", calls.Load(), tt.wantDecoded)
+			}
+			want, _ := os.ReadFile(source)
+			if got, _ := os.ReadFile(path); !bytes.Equal(got, want) {
+				t.Errorf("cached %q, want %q", got, want)
+			}
+			if stats := c.Stats(); stats.Entries != 1 || stats.Bytes != int64(len(want)) {
+				t.Errorf("cache holds %d entries of %d bytes", stats.Entries, stats.Bytes)
+			}
+		})
+	}
+}
+
+func TestEviction(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		protect time.Duration
+		old     []string // Entries added long enough ago to have lost their protection
+		want    []string // Entries left after adding d, most recently used first
+	}{
+		// a and c are used twice, then b once: a is the least recently used, b the least often
+		{"LRU", EvictLRU, -1, nil, []string{"d", "b", "c"}},
+		{"LFU", EvictLFU, -1, nil, []string{"d", "c", "a"}},
+		{"all protected", EvictLRU, time.Hour, nil, []string{"d", "b", "c", "a"}},
+		{"only old entries evicted", EvictLRU, time.Hour, []string{"c"}, []string{"d", "b", "a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t, Options{MaxSize: 300, Policy: tt.policy, Protect: tt.protect})
+			for _, url := range []string{"a", "b", "c"} {
+				addEntry(t, c, url, 100)
+			}
+			for _, url := range tt.old {
+				c.entries[c.hashKey(url)].Added = time.Now().Add(-2 * time.Hour)
+			}
+			for _, url := range []string{"a", "a", "c", "c", "b"} {
+				c.touch(url)
+			}
+
+			addEntry(t, c, "d", 100)
+			if got := sources(c); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("entries = %q, want %q", got, tt.want)
+			}
+			stats := c.Stats()
+			if stats.Bytes != int64(100*len(tt.want)) || stats.Evictions != int64(4-len(tt.want)) {
+				t.Errorf("%d bytes after %d evictions", stats.Bytes, stats.Evictions)
+			}
+
+			// Evicted entries are gone from the disk
+			for _, url := range []string{"a", "b", "c", "d"} {
+				_, err := os.Stat(c.GetPathForKey(url))
+				if kept := contains(tt.want, url); kept != (err == nil) {
+					t.Errorf("%s kept %v, file error %v", url, kept, err)
+				}
+			}
+		})
+	}
+}
+
+// contains reports whether list holds s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEvictPass(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   Options
+		unused []string // Entries last used an hour ago
+		want   []string
+	}{
+		{"under the watermark", Options{MaxSize: 1000, HighWatermark: 60}, nil, []string{"e", "d", "c", "b", "a"}},
+		{"over the watermark", Options{MaxSize: 1000, HighWatermark: 40}, nil, []string{"e", "d", "c"}},
+		{"TTL", Options{MaxSize: 1000, Policy: EvictTTL, TTL: time.Minute}, []string{"b", "d"}, []string{"e", "c", "a"}},
+		{"TTL spares protected entries", Options{MaxSize: 1000, Policy: EvictTTL, TTL: time.Minute, Protect: time.Hour}, []string{"b"}, []string{"e", "d", "c", "b", "a"}},
+		{"TTL and watermark", Options{MaxSize: 1000, Policy: EvictTTL, TTL: time.Minute, HighWatermark: 30}, []string{"e"}, []string{"d", "c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.opts.Protect == 0 {
+				tt.opts.Protect = -1
+			}
+			c := newTestCache(t, tt.opts)
+			for _, url := range []string{"a", "b", "c", "d", "e"} {
+				addEntry(t, c, url, 100)
+			}
+			for _, url := range tt.unused {
+				c.entries[c.hashKey(url)].LastAccess = time.Now().Add(-time.Hour)
+			}
+
+			c.evictPass()
+			if got := sources(c); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("entries = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	track := bytes.Repeat([]byte("the same track "), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.flac", "/mirror/a.flac":
+			w.Write(track)
+		case "/other.flac":
+			w.Write([]byte("another track"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		dedupe     bool
+		params     string // Decode settings of the mirror's copy
+		second     string
+		wantShared bool
+	}{
+		{"same content", true, "p", "/mirror/a.flac", true},
+		{"dedupe off", false, "p", "/mirror/a.flac", false},
+		{"other settings", true, "q", "/mirror/a.flac", false},
+		{"other content", true, "p", "/other.flac", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t, Options{MaxSize: 1 << 20, Dedupe: tt.dedupe})
+			var calls atomic.Int32
+			first, second := server.URL+"/a.flac", server.URL+tt.second
+
+			firstPath, err := c.EnsureDecoded(context.Background(), first, copyDecoder("p", &calls))
+			if err != nil {
+				t.Fatal(err)
+			}
+			secondPath, err := c.EnsureDecoded(context.Background(), second, copyDecoder(tt.params, &calls))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			firstStat, _ := os.Stat(firstPath)
+			secondStat, _ := os.Stat(secondPath)
+			if shared := os.SameFile(firstStat, secondStat); shared != tt.wantShared {
+				t.Fatalf("files shared %v, want %v", shared, tt.wantShared)
+			}
+
+			// A shared file counts once, also after a restart
+			want := firstStat.Size() + secondStat.Size()
+			if tt.wantShared {
+				want = firstStat.Size()
+			}
+			if got := c.Size(); got != want {
+				t.Errorf("Size() = %d, want %d", got, want)
+			}
+			c = reopen(t, c)
+			if got := c.Size(); got != want {
+				t.Errorf("Size() after reopening = %d, want %d", got, want)
+			}
+			if !tt.wantShared {
+				return
+			}
+
+			firstInfo, secondInfo := readEntryInfo(firstPath), readEntryInfo(secondPath)
+			if firstInfo.Blob == "" || firstInfo.Blob != secondInfo.Blob || firstInfo.Content != secondInfo.Content {
+				t.Errorf("indexes do not name the shared file: %+v, %+v", firstInfo, secondInfo)
+			}
+
+			// The file stays, and is counted, until its last entry goes
+			if err := c.Invalidate(first); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := os.ReadFile(secondPath); err != nil || !bytes.Equal(got, track) {
+				t.Errorf("shared file after invalidating the first entry: %v", err)
+			}
+			if got := c.Size(); got != want {
+				t.Errorf("Size() after invalidating the first entry = %d, want %d", got, want)
+			}
+			if err := c.Invalidate(second); err != nil {
+				t.Fatal(err)
+			}
+			if got := c.Size(); got != 0 {
+				t.Errorf("Size() after invalidating both = %d, want 0", got)
+			}
+		})
+	}
+}
+
+func TestChecksumFile(t *testing.T) {
+	large := make([]byte, 3*checksumChunk+123)
+	for i := range large {
+		large[i] = byte(i * 7)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "crc32c:00000000"},
+		{"check value", []byte("123456789"), "crc32c:e3069283"},
+		{"exactly one chunk", large[:checksumChunk], fmt.Sprintf("crc32c:%08x", crc32.Checksum(large[:checksumChunk], castagnoli))},
+		{"several chunks", large, fmt.Sprintf("crc32c:%08x", crc32.Checksum(large, castagnoli))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := checksumFile(context.Background(), writeSource(t, "file", tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("checksumFile = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := checksumFile(ctx, writeSource(t, "file", large)); err != context.Canceled {
+		t.Errorf("checksumFile with a cancelled context: %v", err)
+	}
+	if _, err := checksumFile(context.Background(), filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("checksumFile of a missing file succeeded")
+	}
+}
+
+func TestCorruptEntry(t *testing.T) {
+	c := newTestCache(t, Options{MaxSize: 1 << 20})
+	var calls atomic.Int32
+	decoder := copyDecoder("p", &calls)
+	source := writeSource(t, "track.raw", []byte("original audio"))
+
+	path, err := c.EnsureDecoded(context.Background(), source, decoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries are checked on their first use after the cache is opened
+	c = reopen(t, c)
+	corrupt := []byte("original audiX")
+	if err := os.WriteFile(path, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if path, err = c.EnsureDecoded(context.Background(), source, decoder); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("decoded %d times, want the corrupt file decoded again", calls.Load())
+	}
+	if got, _ := os.ReadFile(path); string(got) != "original audio" {
+		t.Errorf("cached %q after decoding again", got)
+	}
+
+	// Once checked, an entry is not read again until the cache is reopened
+	if err := os.WriteFile(path, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.EnsureDecoded(context.Background(), source, decoder); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("decoded %d times, want a checked entry used as it is", calls.Load())
+	}
+}
+
+func TestVerify(t *testing.T) {
+	c := newTestCache(t, Options{MaxSize: 1 << 20})
+	var calls atomic.Int32
+	decoder := copyDecoder("p", &calls)
+
+	paths := make(map[string]string)
+	for _, name := range []string{"intact", "corrupt", "legacy"} {
+		source := writeSource(t, name, []byte(name+" audio"))
+		path, err := c.EnsureDecoded(context.Background(), source, decoder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths[name] = path
+	}
+	corrupt := readEntryInfo(paths["corrupt"]).URL
+	if err := os.WriteFile(paths["corrupt"], []byte("corrupt audiX"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// An entry from before checksums is given one
+	legacy := readEntryInfo(paths["legacy"])
+	want := legacy.Checksum
+	legacy.Checksum = ""
+	if err := writeEntryInfo(paths["legacy"], legacy); err != nil {
+		t.Fatal(err)
+	}
+	c = reopen(t, c)
+
+	checked, removed, err := c.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 3 || !reflect.DeepEqual(removed, []string{corrupt}) {
+		t.Errorf("Verify checked %d and removed %q, want 3 and %q", checked, removed, corrupt)
+	}
+	if _, err := os.Stat(paths["corrupt"]); !os.IsNotExist(err) {
+		t.Errorf("corrupt file was not removed: %v", err)
+	}
+	if got := readEntryInfo(paths["legacy"]).Checksum; got != want {
+		t.Errorf("legacy entry checksum = %q, want %q", got, want)
+	}
+	if stats := c.Stats(); stats.Entries != 2 {
+		t.Errorf("%d entries left, want 2", stats.Entries)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if checked, _, err := c.Verify(ctx); err != context.Canceled || checked != 0 {
+		t.Errorf("Verify with a cancelled context checked %d: %v", checked, err)
+	}
+}
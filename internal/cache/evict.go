@@ -0,0 +1,236 @@
+package cache
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Eviction policies
+const (
+	EvictLRU = "lru" // Least recently used first
+	EvictLFU = "lfu" // Least often used first, least recently used among equals
+	EvictTTL = "ttl" // Least recently used first, and anything unused for Options.TTL
+)
+
+// evictInterval is how often the background evictor checks the cache
+const evictInterval = 30 * time.Second
+
+// Options configures a DiskCache
+// Zero values take the defaults noted
+type Options struct {
+	MaxSize int64  // Bytes the cache may hold
+	Policy  string // Which entries go first: EvictLRU (default), EvictLFU or EvictTTL
+
+	// With EvictTTL, how long an entry may go unused before it is removed
+	TTL time.Duration
+
+	// Client remote URLs are fetched with (nil for http.DefaultClient)
+	Client *http.Client
+
+	// Whether a remote track already cached under another URL, found by the
+	// hash of its download, shares that entry's file through a hard link
+	// instead of being stored again
+	Dedupe bool
+
+	// Directory downloads and decodes are written to until they are done, then
+	// renamed into the cache; best on the cache's filesystem, where that is
+	// atomic ("" means a "tmp" directory inside the cache directory)
+	TempDir string
+
+	// Downloads running at the same time; more wait their turn (0 means 3)
+	MaxDownloads int
+	// Bytes per second shared by all downloads (0 for no limit)
+	DownloadRate int64
+
+	// How long an entry of a remote URL is used before it is revalidated with
+	// the server, so a file replaced there is fetched again (0 never)
+	Revalidate time.Duration
+
+	// Percent of MaxSize above which the background evictor removes entries,
+	// down to ten points below it (0 means 90)
+	HighWatermark int
+
+	// Whether a running daemon may be using the cache directory too, as it may
+	// when a command line tool opens it: the cache then neither sweeps staged
+	// files, which may be the daemon's downloads in progress, nor runs the
+	// background evictor, leaving eviction to the daemon
+	Shared bool
+
+	// How long a newly decoded entry is kept from eviction, so tracks
+	// prefetched for the queue are still there when they play (0 means 10
+	// minutes, negative for none). Should every entry be protected, the
+	// cache grows past MaxSize until the first one's protection ends
+	Protect time.Duration
+}
+
+// ValidatePolicy checks an eviction policy name, where "" means EvictLRU
+func ValidatePolicy(policy string) error {
+	switch policy {
+	case "", EvictLRU, EvictLFU, EvictTTL:
+		return nil
+	}
+	return fmt.Errorf("unknown eviction policy %q (want lru, lfu or ttl)", policy)
+}
+
+// withDefaults returns the options with zero values replaced by their defaults
+func (o Options) withDefaults() Options {
+	if o.Policy == "" {
+		o.Policy = EvictLRU
+	}
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+	if o.MaxDownloads <= 0 {
+		o.MaxDownloads = 3
+	}
+	if o.HighWatermark <= 0 || o.HighWatermark > 100 {
+		o.HighWatermark = 90
+	}
+	switch {
+	case o.Protect == 0:
+		o.Protect = 10 * time.Minute
+	case o.Protect < 0:
+		o.Protect = 0
+	}
+	return o
+}
+
+// touch records a use of a cached URL: it becomes the most recently used, its
+// use count goes up, and its file's modification time marks the use so the
+// order survives a restart
+func (c *DiskCache) touch(url string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[c.hashKey(url)]
+	if !ok {
+		return
+	}
+	c.lru.MoveToFront(entry.element)
+	entry.Hits++
+	entry.LastAccess = time.Now()
+	os.Chtimes(entry.Path, entry.LastAccess, entry.LastAccess)
+}
+
+// protected reports whether an entry is too new to be evicted
+func (c *DiskCache) protected(entry *Entry, now time.Time) bool {
+	return now.Sub(entry.Added) < c.opts.Protect
+}
+
+// victim returns the entry the policy evicts next, skipping protected ones;
+// nil if there is none
+// Caller must hold the lock
+func (c *DiskCache) victim() *Entry {
+	now := time.Now()
+	var chosen *Entry
+	// From the least recently used on, so that is how ties are broken
+	for element := c.lru.Back(); element != nil; element = element.Prev() {
+		entry := element.Value.(*Entry)
+		if c.protected(entry, now) {
+			continue
+		}
+		if c.opts.Policy != EvictLFU {
+			return entry
+		}
+		if chosen == nil || entry.Hits < chosen.Hits {
+			chosen = entry
+		}
+	}
+	return chosen
+}
+
+// evictUntil evicts entries by the policy until size bytes fit within limit,
+// or only protected entries are left
+// Returns false in the latter case
+// Caller must hold the lock
+func (c *DiskCache) evictUntil(size, limit int64) bool {
+	for c.currentSize+size > limit {
+		entry := c.victim()
+		if entry == nil {
+			return false
+		}
+		c.evict(entry)
+	}
+	return true
+}
+
+// evict removes an entry from the cache and the disk
+// Caller must hold the lock
+func (c *DiskCache) evict(entry *Entry) {
+	c.evictions.Add(1)
+	c.lru.Remove(entry.element)
+	delete(c.entries, entry.Key)
+	c.removeSize(entry)
+
+	removeEntry(entry.Path)
+}
+
+// evictor keeps the cache under the high watermark, and with EvictTTL clears
+// out expired entries, until the cache is closed
+// It checks periodically and whenever an entry is added, logs the cache's
+// statistics every statsInterval and sweeps orphaned staged files every
+// sweepInterval
+func (c *DiskCache) evictor() {
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+	statsTicker := time.NewTicker(statsInterval)
+	defer statsTicker.Stop()
+	sweepTicker := time.NewTicker(sweepInterval)
+	defer sweepTicker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-statsTicker.C:
+			log.Printf("Cache: %s", c.Stats())
+			continue
+		case <-sweepTicker.C:
+			c.sweepStaging()
+			continue
+		case <-ticker.C:
+		case <-c.added:
+		}
+		c.evictPass()
+	}
+}
+
+// evictPass runs one round of background eviction
+func (c *DiskCache) evictPass() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.opts.Policy == EvictTTL && c.opts.TTL > 0 {
+		now := time.Now()
+		for element := c.lru.Back(); element != nil; {
+			entry := element.Value.(*Entry)
+			element = element.Prev()
+			if now.Sub(entry.LastAccess) > c.opts.TTL && !c.protected(entry, now) {
+				log.Printf("Evicting cache entry unused for %s: %s", c.opts.TTL, entryName(entry))
+				c.evict(entry)
+			}
+		}
+	}
+
+	high := c.opts.MaxSize * int64(c.opts.HighWatermark) / 100
+	if c.currentSize <= high {
+		return
+	}
+	low := c.opts.MaxSize * int64(c.opts.HighWatermark-10) / 100
+	before := c.currentSize
+	if !c.evictUntil(0, low) {
+		log.Printf("Cache above %d%% of its size with only protected entries left", c.opts.HighWatermark)
+	}
+	if freed := before - c.currentSize; freed > 0 {
+		log.Printf("Evicted %d MB from the cache to stay under %d%% of its size", freed>>20, c.opts.HighWatermark)
+	}
+}
+
+// entryName returns the original URL of an entry for logs, or its hash if it has no index
+func entryName(entry *Entry) string {
+	if entry.Info != nil {
+		return entry.Info.URL
+	}
+	return entry.Key
+}
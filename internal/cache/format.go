@@ -11,22 +11,24 @@ type CachedAudioFormat struct {
 	SampleRate    uint32
 	BitsPerSample uint32
 	Channels      uint32
+	ChannelMask   uint32 // Speaker positions (WAVE_FORMAT_EXTENSIBLE), 0 for the default layout of the channel count
 }
 
 // Cache file format:
 // - Magic bytes (4): "DPCA" (Diretta PCM Audio Cache)
-// - Version (1): 0x01
+// - Version (1): 0x02
 // - Sample Rate (4): uint32 little-endian
 // - Bits Per Sample (4): uint32 little-endian
 // - Channels (4): uint32 little-endian
+// - Channel Mask (4): uint32 little-endian (not in version 0x01 files, whose layout is the default)
 // - Reserved (3): padding for alignment
-// - Total header: 20 bytes
+// - Total header: 24 bytes (20 in version 0x01)
 // - Followed by raw PCM audio data
 
 const (
 	cacheMagic      = "DPCA"
-	cacheVersion    = 0x01
-	cacheHeaderSize = 20
+	cacheVersion    = 0x02
+	cacheHeaderSize = 24
 )
 
 // WriteCacheHeader writes the cache file header
@@ -56,6 +58,11 @@ func WriteCacheHeader(w io.Writer, format *CachedAudioFormat) error {
 		return fmt.Errorf("failed to write channels: %w", err)
 	}
 
+	// Channel layout
+	if err := binary.Write(w, binary.LittleEndian, format.ChannelMask); err != nil {
+		return fmt.Errorf("failed to write channel mask: %w", err)
+	}
+
 	// Reserved padding (3 bytes)
 	padding := []byte{0, 0, 0}
 	if _, err := w.Write(padding); err != nil {
@@ -81,7 +88,7 @@ func ReadCacheHeader(r io.Reader) (*CachedAudioFormat, error) {
 	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
 		return nil, fmt.Errorf("failed to read version: %w", err)
 	}
-	if version != cacheVersion {
+	if version != cacheVersion && version != 0x01 {
 		return nil, fmt.Errorf("unsupported cache version: %d", version)
 	}
 
@@ -100,6 +107,13 @@ func ReadCacheHeader(r io.Reader) (*CachedAudioFormat, error) {
 		return nil, fmt.Errorf("failed to read channels: %w", err)
 	}
 
+	// Version 0x01 files carry no layout
+	if version >= 0x02 {
+		if err := binary.Read(r, binary.LittleEndian, &format.ChannelMask); err != nil {
+			return nil, fmt.Errorf("failed to read channel mask: %w", err)
+		}
+	}
+
 	// Skip reserved padding (3 bytes)
 	padding := make([]byte, 3)
 	if _, err := io.ReadFull(r, padding); err != nil {
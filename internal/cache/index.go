@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// indexExt is the extension of the sidecar file describing each cache entry
+const indexExt = ".json"
+
+// EntryInfo describes what a cache entry was made from, kept in a sidecar
+// file beside it so entries can still be told apart after a restart, when
+// only their hashed file names are left
+type EntryInfo struct {
+	URL      string    `json:"url"`                // Original URL or path the entry was decoded from
+	Version  string    `json:"version,omitempty"`  // Source version: a file's modification time and size, a URL's ETag or Last-Modified
+	Duration float64   `json:"duration,omitempty"` // Seconds of audio
+	Format   string    `json:"format,omitempty"`   // Format decoded to, e.g. "96000 Hz, 24-bit, stereo"
+	Params   string    `json:"params,omitempty"`   // Decode settings the entry was made under
+	Checksum string    `json:"checksum,omitempty"` // Of the cache file, as "crc32c:<hex>"
+	Created  time.Time `json:"created"`
+
+	// SHA-256 of a remote source as downloaded, which finds the same track
+	// behind another URL, and the key of the file entries made from it
+	// share when Options.Dedupe links them ("" for a file of its own)
+	Content string `json:"content,omitempty"`
+	Blob    string `json:"blob,omitempty"`
+
+	// Validators of a remote source, sent back when revalidating the entry
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Checked      time.Time `json:"checked"` // When the source was last known to match the entry
+}
+
+// Decoded describes what a DecodeFunc wrote, for the entry's index
+type Decoded struct {
+	Duration float64
+	Format   string
+}
+
+// indexPath returns the sidecar path for a cache file
+func indexPath(path string) string {
+	return path + indexExt
+}
+
+// writeEntryInfo writes the sidecar of a cache file, replacing it whole
+func writeEntryInfo(path string, info *EntryInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempPath := indexPath(path) + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write cache index: %w", err)
+	}
+	if err := os.Rename(tempPath, indexPath(path)); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write cache index: %w", err)
+	}
+	return nil
+}
+
+// readEntryInfo reads the sidecar of a cache file, nil if it has none or it is unreadable
+func readEntryInfo(path string) *EntryInfo {
+	data, err := os.ReadFile(indexPath(path))
+	if err != nil {
+		return nil
+	}
+	var info EntryInfo
+	if err := json.Unmarshal(data, &info); err != nil || info.URL == "" {
+		return nil
+	}
+	return &info
+}
+
+// removeEntry removes a cache file and its sidecar
+func removeEntry(path string) error {
+	os.Remove(indexPath(path))
+	return os.Remove(path)
+}
+
+// isRemote reports whether a source is fetched over HTTP
+func isRemote(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// localVersion returns the version of a local source file, "" for remote URLs
+// or files that cannot be read
+func localVersion(source string) string {
+	if isRemote(source) {
+		return ""
+	}
+	stat, err := os.Stat(source)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", stat.ModTime().UnixNano(), stat.Size())
+}
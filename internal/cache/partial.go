@@ -0,0 +1,216 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+)
+
+// PartialFile is a file still being written by a download, which can be read
+// while it grows
+// Writing and reading meet through its size: the download records each write,
+// and readers past what is written so far wait for more until it ends
+type PartialFile struct {
+	path string
+
+	// Validators the server sent with the download, for revalidating the entry
+	etag         string
+	lastModified string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	size    int64  // Bytes written so far
+	done    bool   // The download has ended
+	err     error  // Why the download failed, if it did
+	content string // SHA-256 of the whole download, once it is complete
+}
+
+// newPartialFile returns a partial file at path with nothing written yet
+func newPartialFile(path string) *PartialFile {
+	p := &PartialFile{path: path}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// completeFile returns a partial file for a file already fully written
+func completeFile(path string, size int64) *PartialFile {
+	p := newPartialFile(path)
+	p.size, p.done = size, true
+	return p
+}
+
+// Path returns where the file is written
+func (p *PartialFile) Path() string {
+	return p.path
+}
+
+// grow records n more bytes written and wakes waiting readers
+func (p *PartialFile) grow(n int64) {
+	p.mu.Lock()
+	p.size += n
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+// finish records the end of the download, failed if err is not nil, and the
+// hash of its content when it succeeded
+func (p *PartialFile) finish(content string, err error) {
+	p.mu.Lock()
+	p.done, p.err, p.content = true, err, content
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+// Content returns the SHA-256 of the whole download in hex, "" until it has
+// completed or if it was not hashed
+func (p *PartialFile) Content() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.content
+}
+
+// Size returns how many bytes are written so far and whether that is all of them
+func (p *PartialFile) Size() (int64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size, p.done && p.err == nil
+}
+
+// WaitFor blocks until more than offset bytes are written or the download
+// ends, and returns the size then and whether the file is complete
+// Fails with the download's error, or ctx's if it is cancelled first
+func (p *PartialFile) WaitFor(ctx context.Context, offset int64) (int64, bool, error) {
+	defer p.wakeOnCancel(ctx)()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.size <= offset && !p.done && ctx.Err() == nil {
+		p.cond.Wait()
+	}
+	switch {
+	case p.err != nil:
+		return p.size, false, p.err
+	case p.size <= offset && !p.done:
+		return p.size, false, ctx.Err()
+	}
+	return p.size, p.done, nil
+}
+
+// Wait blocks until the download is complete
+// Fails with the download's error, or ctx's if it is cancelled first
+func (p *PartialFile) Wait(ctx context.Context) error {
+	defer p.wakeOnCancel(ctx)()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for !p.done && ctx.Err() == nil {
+		p.cond.Wait()
+	}
+	if !p.done {
+		return ctx.Err()
+	}
+	return p.err
+}
+
+// wakeOnCancel wakes waiters when ctx is cancelled, until the returned function is called
+func (p *PartialFile) wakeOnCancel(ctx context.Context) func() bool {
+	return context.AfterFunc(ctx, func() {
+		// Taking the lock orders the wake-up after the waiter's check of ctx
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.cond.Broadcast()
+	})
+}
+
+// Open returns a reader of the file that follows the download: reads past
+// what is written so far wait for more, and it ends where the download does
+// Reads fail if the download does, or once ctx is cancelled
+func (p *PartialFile) Open(ctx context.Context) (*PartialReader, error) {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return nil, err
+	}
+	return &PartialReader{p: p, f: f, ctx: ctx}, nil
+}
+
+// PartialReader reads a PartialFile as it is written
+type PartialReader struct {
+	p   *PartialFile
+	f   *os.File
+	ctx context.Context
+	pos int64
+}
+
+// Read reads from the current position, waiting for the download to get past it
+func (r *PartialReader) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	size, complete, err := r.p.WaitFor(r.ctx, r.pos)
+	if err != nil {
+		return 0, err
+	}
+	if r.pos >= size && complete {
+		return 0, io.EOF
+	}
+	if available := size - r.pos; int64(len(b)) > available {
+		b = b[:available]
+	}
+	n, err := r.f.ReadAt(b, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the position of the next Read
+// Seeking from the end waits for the download to complete, as only then is the end known
+func (r *PartialReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		if err := r.p.Wait(r.ctx); err != nil {
+			return r.pos, err
+		}
+		size, _ := r.p.Size()
+		pos = size + offset
+	default:
+		return r.pos, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return r.pos, errors.New("negative position")
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+// Close closes the file; the download carries on
+func (r *PartialReader) Close() error {
+	return r.f.Close()
+}
+
+// partialWriter writes a download to its file, hashing it, and records its growth
+type partialWriter struct {
+	f    *os.File
+	p    *PartialFile
+	hash hash.Hash
+}
+
+// Write writes to the file, and only then makes the bytes visible to readers
+func (w *partialWriter) Write(b []byte) (int, error) {
+	n, err := w.f.Write(b)
+	if n > 0 {
+		w.hash.Write(b[:n])
+		w.p.grow(int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// revalidateTimeout bounds the request checking whether a remote source changed
+const revalidateTimeout = 10 * time.Second
+
+// remoteChanged reports whether a remote source has changed since it was
+// cached, asking the server with a conditional GET once the entry has gone
+// Options.Revalidate without being checked
+// A 304 marks the entry current again; only a full response whose validators
+// differ counts as a change. Entries without validators, and requests that
+// fail, leave the entry in use
+func (c *DiskCache) remoteChanged(url string, info *EntryInfo) bool {
+	if c.opts.Revalidate <= 0 || (info.ETag == "" && info.LastModified == "") || time.Since(info.Checked) < c.opts.Revalidate {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, revalidateTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false
+	}
+	if info.ETag != "" {
+		req.Header.Set("If-None-Match", info.ETag)
+	}
+	if info.LastModified != "" {
+		req.Header.Set("If-Modified-Since", info.LastModified)
+	}
+	resp, err := c.opts.Client.Do(req)
+	if err != nil {
+		log.Printf("Could not revalidate cached %s: %v", url, err)
+		return false
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+	case http.StatusOK:
+		// Servers that ignore the conditions send the file regardless, so
+		// its validators decide
+		etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		if (info.ETag != "" && etag != info.ETag) || (info.ETag == "" && lastModified != info.LastModified) {
+			return true
+		}
+	default:
+		log.Printf("Could not revalidate cached %s: HTTP %d", url, resp.StatusCode)
+		return false
+	}
+
+	c.markChecked(url)
+	return false
+}
+
+// markChecked records that a cached URL was found to match its source
+func (c *DiskCache) markChecked(url string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[c.hashKey(url)]
+	if !ok || entry.Info == nil {
+		return
+	}
+	info := *entry.Info
+	info.Checked = time.Now()
+	if err := writeEntryInfo(entry.Path, &info); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	entry.Info = &info
+}
@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// scanWorkers is how many shard directories scan reads at once
+const scanWorkers = 8
+
+// shardDir returns the directory holding the cache file of a key hash: two
+// levels named after its first two bytes, so no directory grows past a few
+// entries however large the cache gets
+func (c *DiskCache) shardDir(hash string) string {
+	return filepath.Join(c.cacheDir, hash[0:2], hash[2:4])
+}
+
+// isHash reports whether a file name is a key hash, as cache files are named
+func isHash(name string) bool {
+	if len(name) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// isShard reports whether a directory name is a shard level's
+func isShard(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// migrateFlat moves cache files, and their index, from the top of the cache
+// directory where caches before sharding kept them into their shard
+func (c *DiskCache) migrateFlat() error {
+	files, err := os.ReadDir(c.cacheDir)
+	if err != nil {
+		return err
+	}
+
+	moved := 0
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !isHash(name) {
+			continue
+		}
+		dir := c.shardDir(name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(c.cacheDir, name), filepath.Join(dir, name)); err != nil {
+			return err
+		}
+		if err := os.Rename(indexPath(filepath.Join(c.cacheDir, name)), indexPath(filepath.Join(dir, name))); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: failed to move cache index: %v", err)
+		}
+		moved++
+	}
+	if moved > 0 {
+		log.Printf("Moved %d cache entries into subdirectories", moved)
+	}
+	return nil
+}
+
+// scanShard loads the entries under one top-level shard directory
+// Index files whose entry is gone are removed
+func scanShard(dir string) ([]*Entry, error) {
+	subdirs, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*Entry
+	for _, subdir := range subdirs {
+		if !subdir.IsDir() || !isShard(subdir.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, subdir.Name())
+		files, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		names := make(map[string]bool, len(files))
+		for _, file := range files {
+			names[file.Name()] = true
+		}
+		for _, file := range files {
+			name := file.Name()
+			if strings.HasSuffix(name, indexExt) {
+				if !names[strings.TrimSuffix(name, indexExt)] {
+					os.Remove(filepath.Join(path, name))
+				}
+				continue
+			}
+			if file.IsDir() || !isHash(name) {
+				continue
+			}
+			info, err := file.Info()
+			if err != nil {
+				continue // Removed since the directory was read
+			}
+			filePath := filepath.Join(path, name)
+			entries = append(entries, &Entry{
+				Key:        name,
+				Path:       filePath,
+				Size:       info.Size(),
+				Info:       readEntryInfo(filePath),
+				LastAccess: info.ModTime(),
+			})
+		}
+	}
+	return entries, nil
+}
+
+// scanShards loads the entries of every shard, scanWorkers at a time
+func (c *DiskCache) scanShards() ([]*Entry, error) {
+	shards, err := os.ReadDir(c.cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mu      sync.Mutex
+		entries []*Entry
+		errs    []error
+		wg      sync.WaitGroup
+		slots   = make(chan struct{}, scanWorkers)
+	)
+	for _, shard := range shards {
+		if !shard.IsDir() || !isShard(shard.Name()) {
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(dir string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			found, err := scanShard(dir)
+			mu.Lock()
+			defer mu.Unlock()
+			entries = append(entries, found...)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}(filepath.Join(c.cacheDir, shard.Name()))
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return entries, nil
+}
@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// stagingPrefix starts the name of every file staged for the cache
+	stagingPrefix = "direttampd-"
+	// orphanAge is how long a staged file goes unwritten before it is taken
+	// for one left behind by a crash; active downloads and decodes write
+	// far more often
+	orphanAge = time.Hour
+	// sweepInterval is how often orphaned staged files are looked for
+	sweepInterval = 15 * time.Minute
+)
+
+// stagingPath returns where a download or decode for the cache is written
+// before it is done, kind telling them apart
+func (c *DiskCache) stagingPath(kind, url string) string {
+	return filepath.Join(c.opts.TempDir, fmt.Sprintf("%s%s-%s.tmp", stagingPrefix, kind, c.hashKey(url)))
+}
+
+// sweepStaging removes staged files not written for orphanAge, left behind
+// when the daemon stopped part way through a download or decode
+// Downloads staged by older versions in the system temp directory are swept too
+func (c *DiskCache) sweepStaging() {
+	dirs := []string{c.opts.TempDir}
+	if legacy := os.TempDir(); filepath.Clean(legacy) != filepath.Clean(c.opts.TempDir) {
+		dirs = append(dirs, legacy)
+	}
+
+	now := time.Now()
+	removed, freed := 0, int64(0)
+	for i, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !strings.HasPrefix(name, stagingPrefix) || filepath.Ext(name) != ".tmp" {
+				continue
+			}
+			if i > 0 && !strings.HasPrefix(name, stagingPrefix+"fetch-") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || info.IsDir() || now.Sub(info.ModTime()) < orphanAge {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, name)); err == nil {
+				removed++
+				freed += info.Size()
+			}
+		}
+	}
+	if removed > 0 {
+		log.Printf("Removed %d abandoned temporary files (%d MB)", removed, freed>>20)
+	}
+}
+
+// moveFile moves a staged file to its place in the cache
+// When the staging directory is on another filesystem, so it cannot simply
+// be renamed, it is copied next to its destination and renamed from there,
+// which keeps a half-copied file from ever appearing at dest
+func moveFile(src, dest string) error {
+	if err := os.Rename(src, dest); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tempPath := dest + ".tmp"
+	out, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if err := os.Rename(tempPath, dest); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	os.Remove(src)
+	return nil
+}
@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"fmt"
+	"time"
+)
+
+// statsInterval is how often a cache logs its statistics while it is open
+const statsInterval = time.Hour
+
+// Stats is a snapshot of a cache's contents and use
+// Hits, misses and evictions count since the cache was opened; what is on
+// disk and when each entry was last used carries over restarts
+type Stats struct {
+	Entries   int
+	Bytes     int64 // Size of every entry
+	MaxBytes  int64 // Size the cache may hold
+	Hits      int64 // Lookups served from the cache
+	Misses    int64 // Lookups that had to fetch or decode
+	Evictions int64 // Entries removed to make room or, with EvictTTL, for going unused
+
+	EntryStats []EntryStats // Most recently used first
+}
+
+// EntryStats describes one cache entry
+type EntryStats struct {
+	Source     string // Original URL or path, or the file's hash for entries without an index
+	Size       int64
+	Hits       int64 // Uses since the cache was opened
+	LastAccess time.Time
+
+	// What the entry holds, from its index; empty for entries without one
+	Format   string
+	Duration float64 // Seconds
+}
+
+// HitRate returns the fraction of lookups served from the cache, 0 if there were none
+func (s Stats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// String summarises the statistics on one line, for logs
+func (s Stats) String() string {
+	return fmt.Sprintf("%d entries, %.1f of %.1f GB, %.0f%% hit rate (%d hits, %d misses), %d evictions",
+		s.Entries, float64(s.Bytes)/(1<<30), float64(s.MaxBytes)/(1<<30),
+		s.HitRate()*100, s.Hits, s.Misses, s.Evictions)
+}
+
+// Stats returns the cache's current statistics
+func (c *DiskCache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := Stats{
+		Entries:    len(c.entries),
+		Bytes:      c.currentSize,
+		MaxBytes:   c.opts.MaxSize,
+		Hits:       c.hits.Load(),
+		Misses:     c.misses.Load(),
+		Evictions:  c.evictions.Load(),
+		EntryStats: make([]EntryStats, 0, len(c.entries)),
+	}
+	for element := c.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*Entry)
+		entryStats := EntryStats{
+			Source:     entryName(entry),
+			Size:       entry.Size,
+			Hits:       entry.Hits,
+			LastAccess: entry.LastAccess,
+		}
+		if entry.Info != nil {
+			entryStats.Format, entryStats.Duration = entry.Info.Format, entry.Info.Duration
+		}
+		stats.EntryStats = append(stats.EntryStats, entryStats)
+	}
+	return stats
+}
@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// throttleChunk bounds each read of a throttled download, so the rate is
+// spread evenly instead of arriving in bursts
+const throttleChunk = 32 * 1024
+
+// acquireDownload waits for one of the Options.MaxDownloads download slots,
+// returning the function that gives it back
+// Fails with ctx's error if it is cancelled while waiting
+func (c *DiskCache) acquireDownload(ctx context.Context, url string) (func(), error) {
+	select {
+	case c.downloads <- struct{}{}:
+	default:
+		log.Printf("Waiting for a download slot: %s", url)
+		select {
+		case c.downloads <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-c.downloads }) }, nil
+}
+
+// throttle caps the bandwidth shared by every download
+type throttle struct {
+	rate int64 // Bytes per second
+
+	mu   sync.Mutex
+	next time.Time // When the bytes let through so far are paid for
+}
+
+// wait blocks until n more bytes fit within the rate, or ctx is cancelled
+func (t *throttle) wait(ctx context.Context, n int) error {
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(int64(n) * int64(time.Second) / t.rate))
+	delay := t.next.Sub(now)
+	t.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledReader reads a download no faster than its throttle allows
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	t   *throttle
+}
+
+// Read reads at most throttleChunk bytes, then waits until they are within the rate
+func (t *throttledReader) Read(b []byte) (int, error) {
+	if len(b) > throttleChunk {
+		b = b[:throttleChunk]
+	}
+	n, err := t.r.Read(b)
+	if n > 0 {
+		if waitErr := t.t.wait(t.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+)
+
+// checksumChunk is how much of a file is hashed between checks for cancellation
+const checksumChunk = 1 << 20
+
+// castagnoli is the CRC-32C table, which most CPUs compute in hardware
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumFile returns the checksum of a file as kept in EntryInfo.Checksum,
+// reading it a chunk at a time so a large file can be given up on part way
+func checksumFile(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := crc32.New(castagnoli)
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		n, err := io.CopyN(hash, f, checksumChunk)
+		if err == io.EOF || (err == nil && n < checksumChunk) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to checksum %s: %w", path, err)
+		}
+	}
+	return fmt.Sprintf("crc32c:%08x", hash.Sum32()), nil
+}
+
+// intact checks a cached URL's file against its checksum the first time it
+// is used after the cache is opened, so a corrupt file is found and decoded
+// again before it plays rather than when playback fails part way through
+// A corrupt entry is invalidated and false returned. Entries from before
+// checksums are given one now; entries without an index, and checks that
+// fail or are cancelled, are left in use
+func (c *DiskCache) intact(ctx context.Context, url string) bool {
+	c.mu.Lock()
+	entry, ok := c.entries[c.hashKey(url)]
+	c.mu.Unlock()
+	if !ok {
+		return true
+	}
+	return c.verifyEntry(ctx, entry)
+}
+
+// Verify checks every indexed entry against its checksum, even those already
+// checked, removing the corrupt ones
+// Returns how many entries were checked and the sources of those removed;
+// the error is ctx's if it was cancelled part way
+func (c *DiskCache) Verify(ctx context.Context) (int, []string, error) {
+	c.mu.Lock()
+	entries := make([]*Entry, 0, len(c.entries))
+	for element := c.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*Entry)
+		if entry.Info != nil {
+			entry.verified = false
+			entries = append(entries, entry)
+		}
+	}
+	c.mu.Unlock()
+
+	checked := 0
+	var corrupt []string
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return checked, corrupt, ctx.Err()
+		}
+		if !c.verifyEntry(ctx, entry) {
+			corrupt = append(corrupt, entry.Info.URL)
+		}
+		checked++
+	}
+	return checked, corrupt, ctx.Err()
+}
+
+// verifyEntry checks an entry's file against its checksum unless it was
+// already, invalidating it and returning false if it is corrupt (see intact)
+func (c *DiskCache) verifyEntry(ctx context.Context, entry *Entry) bool {
+	c.mu.Lock()
+	if entry.verified || entry.Info == nil {
+		c.mu.Unlock()
+		return true
+	}
+	url, path, want := entry.Info.URL, entry.Path, entry.Info.Checksum
+	c.mu.Unlock()
+
+	got, err := checksumFile(ctx, path)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Could not verify cached %s: %v", url, err)
+		}
+		return true
+	}
+	if want != "" && got != want {
+		log.Printf("Cached file is corrupt (checksum %s, expected %s): %s", got, want, url)
+		if err := c.Invalidate(url); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[entry.Key] == entry {
+		if want == "" {
+			info := *entry.Info
+			info.Checksum = got
+			if err := writeEntryInfo(path, &info); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+			entry.Info = &info
+		}
+		entry.verified = true
+	}
+	return true
+}
+
+// markVerified records that a cached URL's file is known to match its checksum
+func (c *DiskCache) markVerified(url string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[c.hashKey(url)]; ok {
+		entry.verified = true
+	}
+}
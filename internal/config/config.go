@@ -21,14 +21,67 @@ type Config struct {
 	// Cache settings
 	Cache CacheConfig `yaml:"cache"`
 
+	// Locations of the ffmpeg and ffprobe binaries
+	Tools ToolsConfig `yaml:"tools,omitempty"`
+
+	// HTTP client remote tracks are fetched with
+	HTTP HTTPConfig `yaml:"http,omitempty"`
+
+	// Playback backend: "memoryplay" (default), "upnp", "mirror" or "null"
+	Backend string `yaml:"backend,omitempty"`
+
+	// Outputs the mirror backend plays to at the same time
+	Mirror []MirrorOutput `yaml:"mirror,omitempty"`
+
+	// Null backend settings
+	Null NullConfig `yaml:"null,omitempty"`
+
+	// UPnP renderer backend settings
+	UPnP UPnPConfig `yaml:"upnp,omitempty"`
+
+	// MPD server listen addresses: TCP "host:port" entries and unix socket paths
+	// (default: localhost:6600)
+	Listen []string `yaml:"listen,omitempty"`
+
 	// Playback settings
 	Playback PlaybackConfig `yaml:"playback"`
+
+	// Root of the local music library scanned into the database; empty disables it
+	MusicDirectory string `yaml:"music_directory,omitempty"`
+
+	// File the scanned library is stored in so it survives restarts; empty keeps it in memory
+	DBFile string `yaml:"db_file,omitempty"`
+
+	// Watch music_directory and update the database when files change
+	AutoUpdate bool `yaml:"auto_update,omitempty"`
+
+	// Directory holding stored playlists (M3U files); empty disables them
+	PlaylistDirectory string `yaml:"playlist_directory,omitempty"`
+
+	// File format for newly saved stored playlists: "m3u" (default) or "xspf"
+	PlaylistFormat string `yaml:"playlist_format,omitempty"`
+
+	// File the queue and playback state are saved to on shutdown; empty disables it
+	StateFile string `yaml:"state_file,omitempty"`
 }
 
 // HostConfig represents MemoryPlay host connection settings
 type HostConfig struct {
-	IP        string `yaml:"ip"`                  // MemoryPlay host IP (default: ::1)
-	Interface uint32 `yaml:"interface,omitempty"` // Network interface number for link-local IPv6
+	IP        string  `yaml:"ip"`                        // MemoryPlay host IP (default: ::1); with native and port, also an IPv4 address or DNS name
+	Interface uint32  `yaml:"interface,omitempty"`       // Network interface number for link-local IPv6
+	Native    bool    `yaml:"native,omitempty"`          // Use the pure Go session and upload instead of the C library
+	Port      string  `yaml:"port,omitempty"`            // Host control port; with native, skips host discovery
+	Preroll   float64 `yaml:"preroll_seconds,omitempty"` // Seconds uploaded before playback starts, the rest in the background (native only; 0 uploads everything first)
+
+	// Timeouts and retries of the native implementation
+	ConnectTimeout float64 `yaml:"connect_timeout,omitempty"` // Seconds per attempt at connecting (0 means 5)
+	RequestTimeout float64 `yaml:"request_timeout,omitempty"` // Seconds to wait for the host to answer (0 means 1.5)
+	Retries        int     `yaml:"retries,omitempty"`         // Retries of unanswered requests and dropped connections (0 means 3, -1 disables)
+	RetryDelay     float64 `yaml:"retry_delay,omitempty"`     // Seconds before the first retry, doubling after each (0 means 0.25)
+
+	// File every frame of the native implementation is logged to, with a hex
+	// dump of its start, for diagnosing host problems; empty disables it
+	TraceFile string `yaml:"trace_file,omitempty"`
 }
 
 // Target represents a MemoryPlay audio output target
@@ -37,17 +90,192 @@ type Target struct {
 	IP        string `yaml:"ip"`
 	Port      string `yaml:"port,omitempty"`      // Target port (default: 19640)
 	Interface string `yaml:"interface,omitempty"` // Network interface number for link-local IPv6
+
+	// Resampling for this target instead of playback.resample
+	Resample *ResampleConfig `yaml:"resample,omitempty"`
+
+	// Sample size and channel count for this target instead of playback.bit_depth and playback.channels
+	BitDepth int `yaml:"bit_depth,omitempty"`
+	Channels int `yaml:"channels,omitempty"`
+
+	// Downmix for this target instead of playback.downmix
+	Downmix *bool `yaml:"downmix,omitempty"`
+}
+
+// ResampleConfig is how tracks are resampled for an output
+type ResampleConfig struct {
+	// "auto" (default) resamples only rates the output cannot play, "never"
+	// keeps native rates for bit-perfect output even where the output reports
+	// it cannot play them, "always" converts every track to rate
+	Mode string `yaml:"mode,omitempty"`
+	Rate int    `yaml:"rate,omitempty"` // Rate in Hz "always" converts to
+	// With "always", tracks of the other family (44.1 vs 48 kHz multiples) go to
+	// rate's counterpart in their own family, e.g. 192000 for a rate of 176400
+	SameFamily bool `yaml:"same_family,omitempty"`
+	// soxr precision: "low", "medium", "high" or "very_high" (needs ffmpeg
+	// built with libsoxr); empty uses ffmpeg's own resampler
+	Quality string `yaml:"quality,omitempty"`
 }
 
 // CacheConfig represents cache settings
 type CacheConfig struct {
 	Directory string `yaml:"directory"`
 	MaxSizeGB int    `yaml:"max_size_gb"`
+	// Where downloads and decodes are written until they are done, best on
+	// the cache's filesystem (default: "tmp" inside the cache directory)
+	TempDirectory string `yaml:"temp_directory,omitempty"`
+
+	// Store a remote track reachable under several URLs once, its entries
+	// hard linked to one file
+	Dedupe bool `yaml:"dedupe,omitempty"`
+
+	// Downloads of remote tracks running at the same time (0 means 3)
+	MaxDownloads int `yaml:"max_downloads,omitempty"`
+	// Bandwidth all downloads share, in KB per second (0 for no limit)
+	DownloadRateKB int `yaml:"download_rate_kb,omitempty"`
+
+	// Which entries are evicted first: "lru" (default), "lfu" or "ttl"
+	Eviction string `yaml:"eviction,omitempty"`
+	// With eviction "ttl", hours an entry may go unused before it is removed
+	TTLHours int `yaml:"ttl_hours,omitempty"`
+	// Hours a cached remote file is played before checking with its server,
+	// by ETag or Last-Modified, that it has not changed (0 never checks)
+	RevalidateHours int `yaml:"revalidate_hours,omitempty"`
+	// Percent of max_size_gb above which entries are evicted in the
+	// background, down to ten points below it (0 means 90)
+	HighWatermark int `yaml:"high_watermark,omitempty"`
+	// Minutes a newly decoded track is kept from eviction (0 means 10, -1 for none)
+	ProtectMinutes int `yaml:"protect_minutes,omitempty"`
+
+	// Queue entries decoded ahead of the playing one (0 means 3)
+	PrefetchTracks int `yaml:"prefetch_tracks,omitempty"`
+	// Tracks decoded at the same time while prefetching (0 means 2)
+	PrefetchWorkers int `yaml:"prefetch_workers,omitempty"`
+}
+
+// ToolsConfig locates the external binaries used for decoding
+type ToolsConfig struct {
+	FFmpeg  string `yaml:"ffmpeg,omitempty"`  // Path of ffmpeg (default: found in PATH)
+	FFprobe string `yaml:"ffprobe,omitempty"` // Path of ffprobe (default: found in PATH)
+}
+
+// HTTPConfig sets up the HTTP client remote tracks are downloaded with
+type HTTPConfig struct {
+	UserAgent      string            `yaml:"user_agent,omitempty"`      // Sent instead of Go's default
+	Headers        map[string]string `yaml:"headers,omitempty"`         // Sent with every request
+	Proxy          string            `yaml:"proxy,omitempty"`           // Proxy URL (default: from HTTP_PROXY, HTTPS_PROXY and NO_PROXY)
+	TimeoutSeconds int               `yaml:"timeout_seconds,omitempty"` // To connect and for the server to start responding (default: 30)
+
+	// TLS: certificates trusted besides the system's, in a PEM file, or no
+	// checking of server certificates at all
+	CAFile             string `yaml:"ca_file,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+
+	// Headers and credentials for particular servers; the first site whose
+	// prefix a URL starts with applies
+	Sites []HTTPSite `yaml:"sites,omitempty"`
+}
+
+// HTTPSite holds what requests to one server, or part of it, are sent with
+type HTTPSite struct {
+	Prefix      string            `yaml:"prefix"`                 // e.g. "https://music.example.com/rest/"
+	Headers     map[string]string `yaml:"headers,omitempty"`      // Added to the global headers
+	Username    string            `yaml:"username,omitempty"`     // Basic authentication
+	Password    string            `yaml:"password,omitempty"`     //
+	BearerToken string            `yaml:"bearer_token,omitempty"` // Sent as "Authorization: Bearer", instead of basic authentication
+}
+
+// MirrorOutput is one output of the mirror backend
+type MirrorOutput struct {
+	Backend string `yaml:"backend,omitempty"` // Backend playing this output (default: memoryplay)
+	Target  string `yaml:"target,omitempty"`  // Target or renderer it plays to, instead of preferred_target
+}
+
+// NullConfig represents settings for the null backend
+type NullConfig struct {
+	// File the PCM of every upload is appended to; empty discards it
+	File string `yaml:"file,omitempty"`
+}
+
+// UPnPConfig represents settings for the UPnP renderer backend
+type UPnPConfig struct {
+	// Device description URLs of renderers to use besides those found by SSDP discovery
+	Renderers []string `yaml:"renderers,omitempty"`
+	// Port of the HTTP server renderers fetch audio from (0 picks a free port)
+	StreamPort int `yaml:"stream_port,omitempty"`
+	// Highest sample rate sent to renderers; faster tracks are resampled (0 means no limit)
+	MaxSampleRate int `yaml:"max_sample_rate,omitempty"`
 }
 
 // PlaybackConfig represents playback settings
 type PlaybackConfig struct {
 	SilenceBufferSeconds int `yaml:"silence_buffer_seconds"`
+
+	// Stored playlist loaded when the daemon starts with an empty queue
+	AutoloadPlaylist string `yaml:"autoload_playlist,omitempty"`
+	// Start playback after autoloading the playlist
+	AutoloadPlay bool `yaml:"autoload_play,omitempty"`
+
+	// Upload following tracks with the current one so they play without gaps
+	// Tracks join while they are decoded already and share the current track's format
+	Gapless bool `yaml:"gapless,omitempty"`
+	// Most tracks uploaded together in gapless mode (0 means 16)
+	GaplessMaxTracks int `yaml:"gapless_max_tracks,omitempty"`
+
+	// Seconds into a track after which previous restarts it rather than going back
+	// (0 means 3, -1 always goes back)
+	PreviousRestartSeconds float64 `yaml:"previous_restart_seconds,omitempty"`
+
+	// Times a track that fails to prepare is tried again (0 gives up at once)
+	TrackRetries int `yaml:"track_retries,omitempty"`
+	// Move on to the next queue entry when a track fails instead of stopping playback
+	SkipFailedTracks bool `yaml:"skip_failed_tracks,omitempty"`
+
+	// Attempts at resuming the current track after the host session is lost
+	// (0 means 10, -1 disables resuming so playback stops instead)
+	ReconnectAttempts int `yaml:"reconnect_attempts,omitempty"`
+
+	// Seconds between health probes of the output (0 means 5, -1 disables probing)
+	HealthCheckSeconds int `yaml:"health_check_seconds,omitempty"`
+
+	// Mixer for setvol: "software" (default) or "none" for bit-perfect output
+	MixerType string `yaml:"mixer_type,omitempty"`
+
+	// Resampling for outputs without their own setting
+	Resample ResampleConfig `yaml:"resample,omitempty"`
+
+	// Sample size every track is converted to: 16, 24 or 32 (0 keeps the
+	// track's own, in whole bytes, where the output accepts it)
+	BitDepth int `yaml:"bit_depth,omitempty"`
+	// Channel count every track is mixed to with ffmpeg's standard down- and
+	// upmix matrices, e.g. 2 for stereo (0 keeps the track's own)
+	Channels int `yaml:"channels,omitempty"`
+	// Mix tracks with more than two channels, such as 5.1 and 7.1, down to
+	// stereo for outputs that only play stereo; stereo and mono tracks are
+	// left alone
+	Downmix bool `yaml:"downmix,omitempty"`
+
+	// What DSD (DSF and DFF) tracks are sent as: "native" (default) passes the
+	// files through untouched to outputs that play them and converts to PCM for
+	// the rest, "dop" sends DoP to the rest instead, and "pcm" always converts
+	// DoP is only intact when nothing changes the samples, so it needs
+	// mixer_type none, no ReplayGain or normalization and no crossfade
+	DSDMode string `yaml:"dsd_mode,omitempty"`
+
+	// ReplayGain mode at startup: off, track, album or auto
+	ReplayGainMode string `yaml:"replay_gain_mode,omitempty"`
+	// Gain in dB added to the ReplayGain tag values
+	ReplayGainPreamp float64 `yaml:"replay_gain_preamp,omitempty"`
+	// Gain in dB applied to tracks without ReplayGain tags
+	ReplayGainMissingPreamp float64 `yaml:"replay_gain_missing_preamp,omitempty"`
+	// Don't lower the gain to keep a track's tagged peak from clipping
+	ReplayGainAllowClipping bool `yaml:"replay_gain_allow_clipping,omitempty"`
+
+	// EBU R128 normalization target in LUFS (e.g. -18); 0 disables it
+	// When enabled it replaces ReplayGain, so untagged tracks are leveled too
+	LoudnessTarget float64 `yaml:"loudness_target,omitempty"`
+	// File caching measured track loudness; empty keeps measurements in memory
+	LoudnessFile string `yaml:"loudness_file,omitempty"`
 }
 
 // DefaultConfig returns default configuration
@@ -134,6 +362,40 @@ func (c *Config) GetTarget(name string) *Target {
 	return nil
 }
 
+// ResampleFor returns the resampling of the named target: its own resample
+// setting if it has one, otherwise playback.resample
+func (c *Config) ResampleFor(target string) ResampleConfig {
+	if t := c.GetTarget(target); t != nil && t.Resample != nil {
+		return *t.Resample
+	}
+	return c.Playback.Resample
+}
+
+// OutputFormatFor returns the sample size and channel count tracks are
+// converted to for the named target: its own settings where it has them,
+// otherwise playback.bit_depth and playback.channels (0 keeps the track's own)
+func (c *Config) OutputFormatFor(target string) (bitDepth, channels int) {
+	bitDepth, channels = c.Playback.BitDepth, c.Playback.Channels
+	if t := c.GetTarget(target); t != nil {
+		if t.BitDepth > 0 {
+			bitDepth = t.BitDepth
+		}
+		if t.Channels > 0 {
+			channels = t.Channels
+		}
+	}
+	return bitDepth, channels
+}
+
+// DownmixFor reports whether multichannel tracks are mixed down to stereo for
+// the named target: its own setting where it has one, otherwise playback.downmix
+func (c *Config) DownmixFor(target string) bool {
+	if t := c.GetTarget(target); t != nil && t.Downmix != nil {
+		return *t.Downmix
+	}
+	return c.Playback.Downmix
+}
+
 // SetPreferredTarget sets the preferred target by name
 func (c *Config) SetPreferredTarget(name string) error {
 	if c.GetTarget(name) == nil {
@@ -159,6 +421,14 @@ func (c *Config) RemoveTarget(name string) error {
 	return fmt.Errorf("target not found: %s", name)
 }
 
+// ListenAddresses returns the MPD server listen addresses, falling back to localhost:6600
+func (c *Config) ListenAddresses() []string {
+	if len(c.Listen) == 0 {
+		return []string{"localhost:6600"}
+	}
+	return c.Listen
+}
+
 // SetHost sets the MemoryPlay host IP address
 func (c *Config) SetHost(ip string) {
 	if ip != "" {
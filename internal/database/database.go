@@ -0,0 +1,543 @@
+package database
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/famish99/direttampd/internal/decoder"
+	"github.com/famish99/direttampd/internal/storage"
+)
+
+// audioExtensions lists the file extensions the scanner treats as songs
+var audioExtensions = map[string]bool{
+	".flac": true, ".mp3": true, ".mp2": true, ".aac": true, ".m4a": true,
+	".mp4": true, ".ogg": true, ".oga": true, ".opus": true, ".wav": true,
+	".aiff": true, ".aif": true, ".ape": true, ".wma": true, ".wv": true,
+	".dsf": true, ".dff": true,
+}
+
+// Song is a file in the music database
+type Song struct {
+	URI      string            // Path relative to the music directory, "/"-separated
+	Metadata map[string]string // Tags extracted by the decoder package
+	ModTime  time.Time
+}
+
+// Database indexes the songs below a music directory
+type Database struct {
+	root  string
+	store *bolt.DB // Persistent index (nil keeps it in memory only)
+
+	mu         sync.RWMutex
+	songs      map[string]*Song           // Keyed by URI
+	mounts     map[string]storage.Storage // Keyed by mount point URI
+	lastUpdate time.Time
+
+	// Update jobs run one at a time in the order they were started
+	jobMu      sync.Mutex
+	scanMu     sync.Mutex
+	nextJob    int
+	currentJob int // Job being scanned (0 if idle)
+}
+
+// New creates a database for the music directory at root
+// An empty root disables the database; every operation then returns an error
+func New(root string) *Database {
+	return &Database{
+		root:   root,
+		songs:  make(map[string]*Song),
+		mounts: make(map[string]storage.Storage),
+	}
+}
+
+// Root returns the music directory ("" if disabled)
+func (d *Database) Root() string {
+	return d.root
+}
+
+// Enabled returns true if a music directory is configured
+func (d *Database) Enabled() bool {
+	return d.root != ""
+}
+
+// checkEnabled returns an error if no music directory is configured
+func (d *Database) checkEnabled() error {
+	if d.root == "" {
+		return fmt.Errorf("database is disabled (no music_directory configured)")
+	}
+	return nil
+}
+
+// CleanURI normalizes a database URI, rejecting paths outside the music directory
+// The empty string denotes the music directory itself
+func CleanURI(uri string) (string, error) {
+	uri = strings.Trim(uri, "/")
+	if uri == "" {
+		return "", nil
+	}
+
+	cleaned := path.Clean(uri)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("invalid path: %s", uri)
+	}
+	return cleaned, nil
+}
+
+// AbsPath returns the filesystem path of a database URI
+func (d *Database) AbsPath(uri string) string {
+	return filepath.Join(d.root, filepath.FromSlash(uri))
+}
+
+// Locate returns the file path or URL a song can be played from
+// Songs on mounted storage resolve through their storage, all others to the music directory
+func (d *Database) Locate(uri string) string {
+	d.mu.RLock()
+	point, store := d.mountFor(uri)
+	d.mu.RUnlock()
+
+	if store != nil {
+		return store.Locate(strings.TrimPrefix(strings.TrimPrefix(uri, point), "/"))
+	}
+	return d.AbsPath(uri)
+}
+
+// RelativeURI returns the database URI of a filesystem path inside the music directory
+// Returns false if the path lies outside of it
+func (d *Database) RelativeURI(absPath string) (string, bool) {
+	if d.root == "" || !filepath.IsAbs(absPath) {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(d.root, absPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// Get returns the song with the given URI
+func (d *Database) Get(uri string) (*Song, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	song, ok := d.songs[uri]
+	return song, ok
+}
+
+// Songs returns all songs sorted by URI
+func (d *Database) Songs() []*Song {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	songs := make([]*Song, 0, len(d.songs))
+	for _, song := range d.songs {
+		songs = append(songs, song)
+	}
+	sort.Slice(songs, func(i, j int) bool {
+		return songs[i].URI < songs[j].URI
+	})
+	return songs
+}
+
+// LastUpdate returns the time the last update finished (zero if never)
+func (d *Database) LastUpdate() time.Time {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.lastUpdate
+}
+
+// UpdatingJob returns the ID of the running update job (0 if idle)
+func (d *Database) UpdatingJob() int {
+	d.jobMu.Lock()
+	defer d.jobMu.Unlock()
+	return d.currentJob
+}
+
+// StartUpdate scans the subtree at uri in the background and returns the job ID
+// With rescan set, unchanged files are re-read as well
+// done is called when the job finishes with whether the database changed
+func (d *Database) StartUpdate(uri string, rescan bool, done func(changed bool, err error)) (int, error) {
+	if err := d.checkEnabled(); err != nil {
+		return 0, err
+	}
+	uri, err := CleanURI(uri)
+	if err != nil {
+		return 0, err
+	}
+
+	d.jobMu.Lock()
+	d.nextJob++
+	job := d.nextJob
+	d.jobMu.Unlock()
+
+	go func() {
+		d.scanMu.Lock()
+		defer d.scanMu.Unlock()
+
+		d.jobMu.Lock()
+		d.currentJob = job
+		d.jobMu.Unlock()
+
+		changed, err := d.update(uri, rescan)
+
+		d.jobMu.Lock()
+		d.currentJob = 0
+		d.jobMu.Unlock()
+
+		if err != nil {
+			log.Printf("Database update %d failed: %v", job, err)
+		}
+		if done != nil {
+			done(changed, err)
+		}
+	}()
+
+	return job, nil
+}
+
+// update scans the subtree at uri and reconciles the index with the filesystem
+// Returns true if any song was added, changed or removed
+func (d *Database) update(uri string, rescan bool) (bool, error) {
+	log.Printf("Updating database: %q (rescan: %v)", uri, rescan)
+	start := time.Now()
+
+	// Snapshot the existing songs under the subtree so vanished files can be dropped
+	d.mu.RLock()
+	existing := make(map[string]*Song)
+	for key, song := range d.songs {
+		if isUnder(key, uri) {
+			existing[key] = song
+		}
+	}
+	d.mu.RUnlock()
+
+	d.mu.RLock()
+	point, store := d.mountFor(uri)
+	var nested []string // Mount points below uri, scanned along with it
+	for mountPoint := range d.mounts {
+		if mountPoint != point && isUnder(mountPoint, uri) {
+			nested = append(nested, mountPoint)
+		}
+	}
+	mounts := make(map[string]storage.Storage, len(d.mounts))
+	for mountPoint, mounted := range d.mounts {
+		mounts[mountPoint] = mounted
+	}
+	d.mu.RUnlock()
+
+	found := make(map[string]*Song)
+	if store != nil {
+		// uri lies on mounted storage
+		rel := strings.TrimPrefix(strings.TrimPrefix(uri, point), "/")
+		d.scanStorage(store, point, rel, existing, rescan, found)
+	} else if err := d.scanLocal(uri, mounts, existing, rescan, found); err != nil {
+		return false, err
+	}
+	for _, mountPoint := range nested {
+		d.scanStorage(mounts[mountPoint], mountPoint, "", existing, rescan, found)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var removed []string
+	for key := range existing {
+		if _, ok := found[key]; !ok {
+			delete(d.songs, key)
+			removed = append(removed, key)
+		}
+	}
+	updated := make(map[string]*Song)
+	for key, song := range found {
+		if d.songs[key] != song {
+			d.songs[key] = song
+			updated[key] = song
+		}
+	}
+	d.lastUpdate = time.Now()
+
+	if err := d.persist(updated, removed); err != nil {
+		log.Printf("Failed to save database: %v", err)
+	}
+
+	changed := len(removed) > 0 || len(updated) > 0
+
+	log.Printf("Database update finished in %v: %d songs under %q", time.Since(start), len(found), uri)
+	return changed, nil
+}
+
+// scanLocal walks the music directory below uri, adding songs to found
+// Directories shadowed by a mount point are skipped
+func (d *Database) scanLocal(uri string, mounts map[string]storage.Storage, existing map[string]*Song, rescan bool, found map[string]*Song) error {
+	walkErr := filepath.WalkDir(d.AbsPath(uri), func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Skipping %s: %v", p, err)
+			if entry != nil && entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		// Skip hidden files and directories
+		if strings.HasPrefix(entry.Name(), ".") && p != d.AbsPath(uri) {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(d.root, p)
+		if err != nil {
+			return nil
+		}
+		songURI := filepath.ToSlash(rel)
+
+		if entry.IsDir() {
+			if _, mounted := mounts[songURI]; mounted {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !audioExtensions[strings.ToLower(filepath.Ext(p))] {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+
+		d.probeSong(songURI, p, info.ModTime(), existing, rescan, found)
+		return nil
+	})
+
+	if walkErr != nil && !os.IsNotExist(walkErr) {
+		return fmt.Errorf("failed to scan %q: %w", uri, walkErr)
+	}
+	return nil
+}
+
+// scanStorage walks mounted storage below dir, adding songs to found
+// Unreachable directories are logged and skipped
+func (d *Database) scanStorage(store storage.Storage, point, dir string, existing map[string]*Song, rescan bool, found map[string]*Song) {
+	entries, err := store.List(dir)
+	if err != nil {
+		log.Printf("Skipping %s/%s: %v", point, dir, err)
+		return
+	}
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name, ".") {
+			continue
+		}
+
+		path := dir + "/" + entry.Name
+		if dir == "" {
+			path = entry.Name
+		}
+
+		if entry.IsDir {
+			d.scanStorage(store, point, path, existing, rescan, found)
+			continue
+		}
+		if !audioExtensions[strings.ToLower(filepath.Ext(entry.Name))] {
+			continue
+		}
+
+		d.probeSong(point+"/"+path, store.Locate(path), entry.ModTime, existing, rescan, found)
+	}
+}
+
+// probeSong adds the song at location to found, reading its tags unless an
+// unchanged copy is already indexed
+func (d *Database) probeSong(songURI, location string, modTime time.Time, existing map[string]*Song, rescan bool, found map[string]*Song) {
+	// Unchanged files keep their tags unless rescanning
+	if old, ok := existing[songURI]; ok && !rescan && old.ModTime.Equal(modTime) {
+		found[songURI] = old
+		return
+	}
+
+	metadata, err := decoder.ProbeMetadata(location)
+	if err != nil {
+		log.Printf("Failed to read tags from %s: %v", location, err)
+		metadata = make(map[string]string)
+	}
+
+	found[songURI] = &Song{
+		URI:      songURI,
+		Metadata: metadata,
+		ModTime:  modTime,
+	}
+}
+
+// isUnder returns true if uri is dir itself or inside it
+func isUnder(uri, dir string) bool {
+	return dir == "" || uri == dir || strings.HasPrefix(uri, dir+"/")
+}
+
+// SongsUnder returns the songs in the directory at uri and its subdirectories, sorted by URI
+func (d *Database) SongsUnder(uri string) []*Song {
+	var songs []*Song
+	for _, song := range d.Songs() {
+		if isUnder(song.URI, uri) {
+			songs = append(songs, song)
+		}
+	}
+	return songs
+}
+
+// IsDirectory returns true if uri is the music directory or contains songs
+func (d *Database) IsDirectory(uri string) bool {
+	if uri == "" {
+		return true
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for key := range d.songs {
+		if strings.HasPrefix(key, uri+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns the immediate subdirectories and songs of the directory at uri
+// Both are sorted by URI
+func (d *Database) List(uri string) ([]string, []*Song, error) {
+	if err := d.checkEnabled(); err != nil {
+		return nil, nil, err
+	}
+	if !d.IsDirectory(uri) {
+		return nil, nil, fmt.Errorf("no such directory: %s", uri)
+	}
+
+	prefix := ""
+	if uri != "" {
+		prefix = uri + "/"
+	}
+
+	dirSet := make(map[string]bool)
+	var songs []*Song
+	for _, song := range d.Songs() {
+		if !strings.HasPrefix(song.URI, prefix) {
+			continue
+		}
+
+		rest := strings.TrimPrefix(song.URI, prefix)
+		if i := strings.Index(rest, "/"); i >= 0 {
+			dirSet[prefix+rest[:i]] = true
+		} else {
+			songs = append(songs, song)
+		}
+	}
+
+	dirs := make([]string, 0, len(dirSet))
+	for dir := range dirSet {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	return dirs, songs, nil
+}
+
+// Entry is a directory or song visited by Walk
+type Entry struct {
+	Directory string // Set for directories
+	Song      *Song  // Set for songs
+}
+
+// Walk returns every directory and song below uri in URI order
+// Each directory is listed before the first song inside it
+func (d *Database) Walk(uri string) ([]Entry, error) {
+	if err := d.checkEnabled(); err != nil {
+		return nil, err
+	}
+	if !d.IsDirectory(uri) {
+		return nil, fmt.Errorf("no such directory: %s", uri)
+	}
+
+	prefix := ""
+	if uri != "" {
+		prefix = uri + "/"
+	}
+
+	var entries []Entry
+	emitted := make(map[string]bool)
+	for _, song := range d.Songs() {
+		if !strings.HasPrefix(song.URI, prefix) {
+			continue
+		}
+
+		// Emit every not yet listed directory between uri and the song
+		rest := strings.TrimPrefix(song.URI, prefix)
+		for i := 0; i < len(rest); i++ {
+			if rest[i] != '/' {
+				continue
+			}
+			dir := prefix + rest[:i]
+			if !emitted[dir] {
+				emitted[dir] = true
+				entries = append(entries, Entry{Directory: dir})
+			}
+		}
+
+		entries = append(entries, Entry{Song: song})
+	}
+	return entries, nil
+}
+
+// DirectoryModTime returns the modification time of a directory on disk
+func (d *Database) DirectoryModTime(uri string) (time.Time, bool) {
+	info, err := os.Stat(d.AbsPath(uri))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return info.ModTime(), true
+}
+
+// Stats summarizes the database contents
+type Stats struct {
+	Artists  int
+	Albums   int
+	Songs    int
+	PlayTime float64 // Sum of song durations in seconds
+}
+
+// Stats counts the distinct artists and albums, songs and total play time
+func (d *Database) Stats() Stats {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	artists := make(map[string]bool)
+	albums := make(map[string]bool)
+	stats := Stats{Songs: len(d.songs)}
+
+	for _, song := range d.songs {
+		if artist := song.Metadata["artist"]; artist != "" {
+			artists[artist] = true
+		}
+		if album := song.Metadata["album"]; album != "" {
+			albums[album] = true
+		}
+		if duration, err := strconv.ParseFloat(song.Metadata["duration"], 64); err == nil {
+			stats.PlayTime += duration
+		}
+	}
+
+	stats.Artists = len(artists)
+	stats.Albums = len(albums)
+	return stats
+}
@@ -0,0 +1,382 @@
+package database
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Filter selects songs from the database
+type Filter interface {
+	Match(song *Song) bool
+}
+
+// andFilter matches songs that match all of its filters
+type andFilter []Filter
+
+func (f andFilter) Match(song *Song) bool {
+	for _, filter := range f {
+		if !filter.Match(song) {
+			return false
+		}
+	}
+	return true
+}
+
+// notFilter inverts a filter
+type notFilter struct {
+	inner Filter
+}
+
+func (f notFilter) Match(song *Song) bool {
+	return !f.inner.Match(song)
+}
+
+// tagFilter compares a tag (or "any", "file") against a value
+type tagFilter struct {
+	tag      string // Lowercase tag name, "any" or "file"
+	op       string // "==", "!=", "contains", "starts_with", "=~" or "!~"
+	value    string
+	foldCase bool
+	re       *regexp.Regexp
+}
+
+func (f tagFilter) Match(song *Song) bool {
+	var values []string
+	switch f.tag {
+	case "file":
+		values = []string{song.URI}
+	case "any":
+		for key, value := range song.Metadata {
+			if key != "duration" {
+				values = append(values, value)
+			}
+		}
+	default:
+		values = []string{song.Metadata[f.tag]}
+	}
+
+	// Negated operators match only if no value matches the positive form
+	switch f.op {
+	case "!=":
+		return !f.matchAny(values, "==")
+	case "!~":
+		return !f.matchAny(values, "=~")
+	default:
+		return f.matchAny(values, f.op)
+	}
+}
+
+// matchAny returns true if any value satisfies op
+func (f tagFilter) matchAny(values []string, op string) bool {
+	for _, value := range values {
+		if f.foldCase {
+			value = strings.ToLower(value)
+		}
+
+		var ok bool
+		switch op {
+		case "==":
+			ok = value == f.value
+		case "contains":
+			ok = strings.Contains(value, f.value)
+		case "starts_with":
+			ok = strings.HasPrefix(value, f.value)
+		case "=~":
+			ok = f.re.MatchString(value)
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// baseFilter matches songs inside a directory
+type baseFilter struct {
+	dir string
+}
+
+func (f baseFilter) Match(song *Song) bool {
+	return isUnder(song.URI, f.dir)
+}
+
+// modifiedSinceFilter matches songs modified after a point in time
+type modifiedSinceFilter struct {
+	since time.Time
+}
+
+func (f modifiedSinceFilter) Match(song *Song) bool {
+	return song.ModTime.After(f.since)
+}
+
+// NewTagFilter builds a filter comparing tag against value with op
+// With foldCase set the comparison is case-insensitive (as for search)
+func NewTagFilter(tag, op, value string, foldCase bool) (Filter, error) {
+	tag = strings.ToLower(tag)
+
+	switch tag {
+	case "base":
+		dir, err := CleanURI(value)
+		if err != nil {
+			return nil, err
+		}
+		return baseFilter{dir: dir}, nil
+	case "modified-since":
+		since, err := parseSince(value)
+		if err != nil {
+			return nil, err
+		}
+		return modifiedSinceFilter{since: since}, nil
+	}
+
+	f := tagFilter{tag: tag, op: op, value: value, foldCase: foldCase}
+	switch op {
+	case "==", "!=", "contains", "starts_with":
+		if foldCase {
+			f.value = strings.ToLower(value)
+		}
+	case "=~", "!~":
+		pattern := value
+		if foldCase {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression: %w", err)
+		}
+		f.re = re
+	default:
+		return nil, fmt.Errorf("unknown filter operator: %s", op)
+	}
+	return f, nil
+}
+
+// And combines filters so that all of them must match
+func And(filters ...Filter) Filter {
+	if len(filters) == 1 {
+		return filters[0]
+	}
+	return andFilter(filters)
+}
+
+// parseSince parses a modified-since value (Unix time or RFC 3339)
+func parseSince(value string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time: %s", value)
+	}
+	return t, nil
+}
+
+// ParseFilter parses an MPD filter expression such as
+// ((Artist == 'X') AND (!(Album contains "Live")))
+func ParseFilter(expr string, foldCase bool) (Filter, error) {
+	p := &filterParser{input: expr, foldCase: foldCase}
+
+	f, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpaces()
+	if p.pos != len(p.input) {
+		return nil, fmt.Errorf("unexpected text after filter expression: %q", p.input[p.pos:])
+	}
+	return f, nil
+}
+
+// filterParser is a recursive descent parser for filter expressions
+type filterParser struct {
+	input    string
+	pos      int
+	foldCase bool
+}
+
+func (p *filterParser) skipSpaces() {
+	for p.pos < len(p.input) && p.input[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *filterParser) peek() byte {
+	if p.pos >= len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *filterParser) expect(c byte) error {
+	p.skipSpaces()
+	if p.peek() != c {
+		return fmt.Errorf("expected '%c' at offset %d", c, p.pos)
+	}
+	p.pos++
+	return nil
+}
+
+// parseExpression parses one parenthesized expression
+func (p *filterParser) parseExpression() (Filter, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+
+	switch p.peek() {
+	case '!':
+		// (!EXPRESSION)
+		p.pos++
+		inner, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(')'); err != nil {
+			return nil, err
+		}
+		return notFilter{inner: inner}, nil
+
+	case '(':
+		// (EXPRESSION1 AND EXPRESSION2 ...)
+		var filters []Filter
+		for {
+			f, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, f)
+
+			p.skipSpaces()
+			if p.peek() == ')' {
+				p.pos++
+				return And(filters...), nil
+			}
+			if word := p.parseWord(); word != "AND" {
+				return nil, fmt.Errorf("expected AND at offset %d", p.pos)
+			}
+		}
+	}
+
+	// (TAG OP 'VALUE'), (base 'VALUE') or (modified-since 'VALUE')
+	tag := p.parseWord()
+	if tag == "" {
+		return nil, fmt.Errorf("expected tag name at offset %d", p.pos)
+	}
+
+	op := "=="
+	switch strings.ToLower(tag) {
+	case "base", "modified-since":
+	default:
+		p.skipSpaces()
+		if op = p.parseOperator(); op == "" {
+			return nil, fmt.Errorf("expected operator at offset %d", p.pos)
+		}
+	}
+
+	value, err := p.parseString()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(')'); err != nil {
+		return nil, err
+	}
+
+	return NewTagFilter(tag, op, value, p.foldCase)
+}
+
+// parseWord reads a run of letters, digits, '-' and '_'
+func (p *filterParser) parseWord() string {
+	p.skipSpaces()
+	start := p.pos
+	for p.pos < len(p.input) {
+		c := rune(p.input[p.pos])
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '-' && c != '_' {
+			break
+		}
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+// parseOperator reads a comparison operator
+func (p *filterParser) parseOperator() string {
+	for _, op := range []string{"==", "!=", "=~", "!~"} {
+		if strings.HasPrefix(p.input[p.pos:], op) {
+			p.pos += len(op)
+			return op
+		}
+	}
+
+	start := p.pos
+	switch word := p.parseWord(); word {
+	case "contains", "starts_with":
+		return word
+	}
+	p.pos = start
+	return ""
+}
+
+// parseString reads a single- or double-quoted string with backslash escapes
+func (p *filterParser) parseString() (string, error) {
+	p.skipSpaces()
+	quote := p.peek()
+	if quote != '\'' && quote != '"' {
+		return "", fmt.Errorf("expected quoted value at offset %d", p.pos)
+	}
+	p.pos++
+
+	var value strings.Builder
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		p.pos++
+
+		switch {
+		case c == '\\' && p.pos < len(p.input):
+			value.WriteByte(p.input[p.pos])
+			p.pos++
+		case c == quote:
+			return value.String(), nil
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated string in filter expression")
+}
+
+// Find returns the songs matching filter, sorted by URI
+func (d *Database) Find(filter Filter) []*Song {
+	var songs []*Song
+	for _, song := range d.Songs() {
+		if filter.Match(song) {
+			songs = append(songs, song)
+		}
+	}
+	return songs
+}
+
+// SortSongs sorts songs by a tag, or by modification time for "Last-Modified"
+// A leading '-' sorts in descending order; ties keep URI order
+func SortSongs(songs []*Song, by string) {
+	descending := strings.HasPrefix(by, "-")
+	by = strings.ToLower(strings.TrimPrefix(by, "-"))
+
+	less := func(a, b *Song) bool {
+		if by == "last-modified" {
+			return a.ModTime.Before(b.ModTime)
+		}
+		return a.Metadata[by] < b.Metadata[by]
+	}
+
+	sort.SliceStable(songs, func(i, j int) bool {
+		if descending {
+			return less(songs[j], songs[i])
+		}
+		return less(songs[i], songs[j])
+	})
+}
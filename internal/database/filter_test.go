@@ -0,0 +1,159 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testSongs is a small library to run filters against
+func testSongs() []*Song {
+	added := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	return []*Song{
+		{
+			URI:      "Jazz/Kind of Blue/01 So What.flac",
+			Metadata: map[string]string{"artist": "Miles Davis", "album": "Kind of Blue", "title": "So What", "date": "1959", "duration": "562"},
+			ModTime:  added,
+		},
+		{
+			URI:      "Jazz/Kind of Blue/02 Freddie Freeloader.flac",
+			Metadata: map[string]string{"artist": "Miles Davis", "album": "Kind of Blue", "title": "Freddie Freeloader", "date": "1959"},
+			ModTime:  added,
+		},
+		{
+			URI:      "Jazz/Live/01 Blue in Green (Live).flac",
+			Metadata: map[string]string{"artist": "Bill Evans", "album": "Live at the Village Vanguard", "title": "Blue in Green"},
+			ModTime:  added.Add(48 * time.Hour),
+		},
+		{
+			URI:      "Rock/Paranoid.wav",
+			Metadata: map[string]string{"artist": "Black Sabbath", "title": "Paranoid", "date": "1970"},
+			ModTime:  added.Add(-48 * time.Hour),
+		},
+	}
+}
+
+// matching returns the URIs of the songs the filter matches
+func matching(f Filter, songs []*Song) []string {
+	var uris []string
+	for _, song := range songs {
+		if f.Match(song) {
+			uris = append(uris, song.URI)
+		}
+	}
+	return uris
+}
+
+func TestParseFilter(t *testing.T) {
+	const (
+		soWhat    = "Jazz/Kind of Blue/01 So What.flac"
+		freddie   = "Jazz/Kind of Blue/02 Freddie Freeloader.flac"
+		blueGreen = "Jazz/Live/01 Blue in Green (Live).flac"
+		paranoid  = "Rock/Paranoid.wav"
+	)
+
+	tests := []struct {
+		name     string
+		expr     string
+		foldCase bool
+		want     []string
+	}{
+		{"equals", `(Artist == "Miles Davis")`, false, []string{soWhat, freddie}},
+		{"single quotes", `(artist == 'Bill Evans')`, false, []string{blueGreen}},
+		{"equals is case sensitive", `(Artist == "miles davis")`, false, nil},
+		{"equals folding case", `(Artist == "miles davis")`, true, []string{soWhat, freddie}},
+		{"not equals", `(date != "1959")`, false, []string{blueGreen, paranoid}},
+		{"missing tag equals empty", `(album == "")`, false, []string{paranoid}},
+		{"contains", `(title contains "ree")`, false, []string{freddie, blueGreen}},
+		{"starts_with", `(album starts_with "Kind")`, false, []string{soWhat, freddie}},
+		{"regex", `(title =~ "^[A-F]")`, false, []string{freddie, blueGreen}},
+		{"negated regex", `(artist !~ "Davis$")`, false, []string{blueGreen, paranoid}},
+		{"regex folding case", `(title =~ "^so")`, true, []string{soWhat}},
+		{"any tag", `(any contains "Blue")`, false, []string{soWhat, freddie, blueGreen}},
+		{"any skips duration", `(any == "562")`, false, nil},
+		{"file", `(file == "Rock/Paranoid.wav")`, false, []string{paranoid}},
+		{"base", `(base "Jazz/Kind of Blue")`, false, []string{soWhat, freddie}},
+		{"base with slashes", `(base "/Jazz/")`, false, []string{soWhat, freddie, blueGreen}},
+		{"base is not a prefix match", `(base "Jaz")`, false, nil},
+		{"modified-since unix time", `(modified-since "1717243200")`, false, []string{blueGreen}},
+		{"modified-since RFC 3339", `(modified-since '2024-05-31T00:00:00Z')`, false, []string{soWhat, freddie, blueGreen}},
+		{"not", `(!(artist == "Miles Davis"))`, false, []string{blueGreen, paranoid}},
+		{"and", `((artist == "Miles Davis") AND (title contains "What"))`, false, []string{soWhat}},
+		{"and of three", `((base "Jazz") AND (!(album contains "Live")) AND (date == "1959"))`, false, []string{soWhat, freddie}},
+		{"nested", `((!((artist == "Miles Davis") AND (date == "1959"))) AND (base "Jazz"))`, false, []string{blueGreen}},
+		{"escaped quote in value", `(title == "Blue in \"Green\"")`, false, nil},
+		{"escaped parenthesis in regex", `(file =~ "\\(Live\\)")`, false, []string{blueGreen}},
+		{"extra spaces", `(  (artist   ==   "Black Sabbath")  AND  (date == '1970')  )`, false, []string{paranoid}},
+		{"tag names ignore case", `(TITLE == "Paranoid")`, false, []string{paranoid}},
+	}
+
+	songs := testSongs()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ParseFilter(tt.expr, tt.foldCase)
+			if err != nil {
+				t.Fatalf("ParseFilter(%s): %v", tt.expr, err)
+			}
+			if got := matching(f, songs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s matched %q, want %q", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+	}{
+		{"empty", ``},
+		{"no parentheses", `artist == "Foo"`},
+		{"unclosed", `(artist == "Foo"`},
+		{"missing operator", `(artist "Foo")`},
+		{"unknown operator", `(artist matches "Foo")`},
+		{"unquoted value", `(artist == Foo)`},
+		{"unterminated string", `(artist == "Foo)`},
+		{"missing tag", `(== "Foo")`},
+		{"or is not supported", `((artist == "A") OR (artist == "B"))`},
+		{"trailing text", `(artist == "Foo") extra`},
+		{"invalid regex", `(title =~ "(")`},
+		{"invalid modified-since", `(modified-since "yesterday")`},
+		{"base outside the library", `(base "../etc")`},
+		{"not without expression", `(!artist == "Foo")`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseFilter(tt.expr, false); err == nil {
+				t.Errorf("ParseFilter(%s) succeeded, want an error", tt.expr)
+			}
+		})
+	}
+}
+
+func TestSortSongs(t *testing.T) {
+	tests := []struct {
+		by   string
+		want []string
+	}{
+		{"title", []string{"Blue in Green", "Freddie Freeloader", "Paranoid", "So What"}},
+		{"-title", []string{"So What", "Paranoid", "Freddie Freeloader", "Blue in Green"}},
+		{"Date", []string{"Blue in Green", "So What", "Freddie Freeloader", "Paranoid"}},
+		{"Last-Modified", []string{"Paranoid", "So What", "Freddie Freeloader", "Blue in Green"}},
+		{"-Last-Modified", []string{"Blue in Green", "So What", "Freddie Freeloader", "Paranoid"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.by, func(t *testing.T) {
+			songs := testSongs()
+			SortSongs(songs, tt.by)
+			var got []string
+			for _, song := range songs {
+				got = append(got, song.Metadata["title"])
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SortSongs(%s) = %q, want %q", tt.by, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/famish99/direttampd/internal/storage"
+)
+
+// Mount is a storage mounted into the database tree
+type Mount struct {
+	Point string // Mount point URI in the database
+	URI   string // Storage URI
+}
+
+// mountFor returns the mount point and storage containing uri (nil if local)
+// Caller must hold the lock
+func (d *Database) mountFor(uri string) (string, storage.Storage) {
+	for point, store := range d.mounts {
+		if uri == point || strings.HasPrefix(uri, point+"/") {
+			return point, store
+		}
+	}
+	return "", nil
+}
+
+// Mount attaches the storage at storageURI to the database tree at point
+// The mounted files appear after the next update of point
+func (d *Database) Mount(point, storageURI string) error {
+	if err := d.checkEnabled(); err != nil {
+		return err
+	}
+
+	point, err := CleanURI(point)
+	if err != nil {
+		return err
+	}
+	if point == "" {
+		return fmt.Errorf("cannot mount on the root directory")
+	}
+
+	store, err := storage.New(storageURI)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for existing := range d.mounts {
+		if isUnder(point, existing) || isUnder(existing, point) {
+			closeStorage(store)
+			return fmt.Errorf("mount point overlaps existing mount: %s", existing)
+		}
+	}
+
+	d.mounts[point] = store
+	if err := d.persistMount(point, storageURI); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Unmount detaches the storage at point and drops its songs from the database
+func (d *Database) Unmount(point string) error {
+	if err := d.checkEnabled(); err != nil {
+		return err
+	}
+
+	point, err := CleanURI(point)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	store, ok := d.mounts[point]
+	if !ok {
+		return fmt.Errorf("not a mount point: %s", point)
+	}
+	delete(d.mounts, point)
+	closeStorage(store)
+
+	var removed []string
+	for uri := range d.songs {
+		if isUnder(uri, point) {
+			delete(d.songs, uri)
+			removed = append(removed, uri)
+		}
+	}
+
+	if err := d.persist(nil, removed); err != nil {
+		return err
+	}
+	return d.persistMount(point, "")
+}
+
+// closeStorage releases a storage that holds system resources, such as a mounted share
+func closeStorage(store storage.Storage) {
+	if closer, ok := store.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Failed to close storage %s: %v", store.URI(), err)
+		}
+	}
+}
+
+// Mounts returns the mounted storages sorted by mount point
+func (d *Database) Mounts() []Mount {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	mounts := make([]Mount, 0, len(d.mounts))
+	for point, store := range d.mounts {
+		mounts = append(mounts, Mount{Point: point, URI: store.URI()})
+	}
+	sort.Slice(mounts, func(i, j int) bool {
+		return mounts[i].Point < mounts[j].Point
+	})
+	return mounts
+}
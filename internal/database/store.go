@@ -0,0 +1,169 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/famish99/direttampd/internal/storage"
+)
+
+// Bucket and key names in the database file
+var (
+	songsBucket   = []byte("songs")
+	metaBucket    = []byte("meta")
+	mountsBucket  = []byte("mounts")
+	lastUpdateKey = []byte("last_update")
+)
+
+// storedSong is the on-disk form of a song; the URI is the bucket key
+type storedSong struct {
+	Metadata map[string]string `json:"metadata"`
+	ModTime  time.Time         `json:"mtime"`
+}
+
+// Open creates a database for the music directory at root backed by the
+// bbolt file at dbFile, loading the songs indexed by earlier runs
+// An empty dbFile keeps the index in memory only
+func Open(root, dbFile string) (*Database, error) {
+	d := New(root)
+	if dbFile == "" || root == "" {
+		return d, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dbFile), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+
+	store, err := bolt.Open(dbFile, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database file: %w", err)
+	}
+	d.store = store
+
+	if err := d.load(); err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	log.Printf("Loaded %d songs from %s", len(d.songs), dbFile)
+	return d, nil
+}
+
+// Close releases the database file, if any, and the mounted storages
+func (d *Database) Close() error {
+	d.mu.Lock()
+	for _, store := range d.mounts {
+		closeStorage(store)
+	}
+	d.mu.Unlock()
+
+	if d.store == nil {
+		return nil
+	}
+	return d.store.Close()
+}
+
+// load reads all songs and the last update time from the database file
+func (d *Database) load() error {
+	return d.store.Update(func(tx *bolt.Tx) error {
+		songs, err := tx.CreateBucketIfNotExists(songsBucket)
+		if err != nil {
+			return fmt.Errorf("failed to create songs bucket: %w", err)
+		}
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return fmt.Errorf("failed to create meta bucket: %w", err)
+		}
+
+		if raw := meta.Get(lastUpdateKey); raw != nil {
+			_ = d.lastUpdate.UnmarshalText(raw)
+		}
+
+		mounts, err := tx.CreateBucketIfNotExists(mountsBucket)
+		if err != nil {
+			return fmt.Errorf("failed to create mounts bucket: %w", err)
+		}
+		if err := mounts.ForEach(func(key, value []byte) error {
+			store, err := storage.New(string(value))
+			if err != nil {
+				log.Printf("Failed to restore mount %s: %v", key, err)
+				return nil
+			}
+			d.mounts[string(key)] = store
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		return songs.ForEach(func(key, value []byte) error {
+			var stored storedSong
+			if err := json.Unmarshal(value, &stored); err != nil {
+				log.Printf("Skipping corrupt database entry %s: %v", key, err)
+				return nil
+			}
+
+			uri := string(key)
+			d.songs[uri] = &Song{
+				URI:      uri,
+				Metadata: stored.Metadata,
+				ModTime:  stored.ModTime,
+			}
+			return nil
+		})
+	})
+}
+
+// persist writes the outcome of an update to the database file
+// Caller must hold the write lock
+func (d *Database) persist(changed map[string]*Song, removed []string) error {
+	if d.store == nil {
+		return nil
+	}
+
+	return d.store.Update(func(tx *bolt.Tx) error {
+		songs := tx.Bucket(songsBucket)
+		for _, uri := range removed {
+			if err := songs.Delete([]byte(uri)); err != nil {
+				return err
+			}
+		}
+
+		for uri, song := range changed {
+			value, err := json.Marshal(storedSong{Metadata: song.Metadata, ModTime: song.ModTime})
+			if err != nil {
+				return err
+			}
+			if err := songs.Put([]byte(uri), value); err != nil {
+				return err
+			}
+		}
+
+		lastUpdate, err := d.lastUpdate.MarshalText()
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucket).Put(lastUpdateKey, lastUpdate)
+	})
+}
+
+// persistMount records (or with an empty storageURI, forgets) a mount
+// Caller must hold the write lock
+func (d *Database) persistMount(point, storageURI string) error {
+	if d.store == nil {
+		return nil
+	}
+
+	return d.store.Update(func(tx *bolt.Tx) error {
+		mounts := tx.Bucket(mountsBucket)
+		if storageURI == "" {
+			return mounts.Delete([]byte(point))
+		}
+		return mounts.Put([]byte(point), []byte(storageURI))
+	})
+}
@@ -0,0 +1,177 @@
+package database
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchSettleDelay is how long the tree must be quiet before changes are scanned
+// Copying an album produces a burst of events that should become a single update
+const watchSettleDelay = 2 * time.Second
+
+// Watcher triggers incremental updates when files below the music directory change
+type Watcher struct {
+	db       *Database
+	watcher  *fsnotify.Watcher
+	onChange func(uri string) // Called with the directory URI to rescan
+
+	mu      sync.Mutex
+	pending map[string]bool // Directory URIs changed since the last flush
+	timer   *time.Timer
+	done    chan struct{}
+}
+
+// Watch starts watching the music directory recursively
+// onChange is called with a directory URI once changes below it have settled
+func (d *Database) Watch(onChange func(uri string)) (*Watcher, error) {
+	if err := d.checkEnabled(); err != nil {
+		return nil, err
+	}
+
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file watcher: %w", err)
+	}
+
+	w := &Watcher{
+		db:       d,
+		watcher:  fsw,
+		onChange: onChange,
+		pending:  make(map[string]bool),
+		done:     make(chan struct{}),
+	}
+
+	if err := w.addTree(d.root); err != nil {
+		fsw.Close()
+		return nil, err
+	}
+
+	go w.run()
+	log.Printf("Watching %s for changes", d.root)
+
+	return w, nil
+}
+
+// Close stops watching
+func (w *Watcher) Close() error {
+	close(w.done)
+
+	w.mu.Lock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.mu.Unlock()
+
+	return w.watcher.Close()
+}
+
+// addTree watches dir and every directory below it (fsnotify is not recursive)
+func (w *Watcher) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			return nil
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), ".") && path != dir {
+			return fs.SkipDir
+		}
+
+		if err := w.watcher.Add(path); err != nil {
+			log.Printf("Failed to watch %s: %v", path, err)
+		}
+		return nil
+	})
+}
+
+// run handles watcher events until Close is called
+func (w *Watcher) run() {
+	for {
+		select {
+		case <-w.done:
+			return
+
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.handleEvent(event)
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("File watcher error: %v", err)
+		}
+	}
+}
+
+// handleEvent records the directory affected by an event
+func (w *Watcher) handleEvent(event fsnotify.Event) {
+	if strings.HasPrefix(filepath.Base(event.Name), ".") {
+		return
+	}
+
+	// Start watching directories as they appear
+	if event.Op.Has(fsnotify.Create) {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			if err := w.addTree(event.Name); err != nil {
+				log.Printf("Failed to watch %s: %v", event.Name, err)
+			}
+		}
+	}
+
+	// Rescan the parent directory, which covers new, removed and renamed entries
+	rel, err := filepath.Rel(w.db.root, filepath.Dir(event.Name))
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return
+	}
+	uri := filepath.ToSlash(rel)
+	if uri == "." {
+		uri = ""
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending[uri] = true
+	if w.timer == nil {
+		w.timer = time.AfterFunc(watchSettleDelay, w.flush)
+	} else {
+		w.timer.Reset(watchSettleDelay)
+	}
+}
+
+// flush reports the changed directories, skipping those covered by a parent
+func (w *Watcher) flush() {
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = make(map[string]bool)
+	w.timer = nil
+	w.mu.Unlock()
+
+	for uri := range pending {
+		covered := false
+		for other := range pending {
+			if other != uri && isUnder(uri, other) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			w.onChange(uri)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package decoder
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// channelLayouts maps ffmpeg channel layout names to WAVE_FORMAT_EXTENSIBLE
+// channel masks, whose bits are speaker positions: front left, right and
+// centre (0x1, 0x2, 0x4), LFE (0x8), back left and right (0x10, 0x20), front
+// left and right of centre (0x40, 0x80), back centre (0x100) and side left
+// and right (0x200, 0x400)
+// Channels are interleaved in the order of the mask's bits, lowest first,
+// which is also ffmpeg's order for these layouts
+var channelLayouts = map[string]uint32{
+	"mono":           0x4,
+	"stereo":         0x3,
+	"2.1":            0xB,
+	"3.0":            0x7,
+	"3.0(back)":      0x103,
+	"4.0":            0x107,
+	"quad":           0x33,
+	"quad(side)":     0x603,
+	"3.1":            0xF,
+	"5.0":            0x37,
+	"5.0(side)":      0x607,
+	"4.1":            0x10F,
+	"5.1":            0x3F,
+	"5.1(side)":      0x60F,
+	"6.0":            0x707,
+	"6.1":            0x70F,
+	"6.1(back)":      0x13F,
+	"7.0":            0x637,
+	"7.1":            0x63F,
+	"7.1(wide)":      0xFF,
+	"7.1(wide-side)": 0x6CF,
+}
+
+// defaultLayouts names the layout ffmpeg assumes for a channel count when a
+// source does not say, which is also what "-ac" mixes to
+var defaultLayouts = map[int]string{
+	1: "mono",
+	2: "stereo",
+	3: "2.1",
+	4: "4.0",
+	5: "5.0",
+	6: "5.1",
+	7: "6.1",
+	8: "7.1",
+}
+
+// defaultChannelMask returns the channel mask of the default layout for a channel count
+// Counts without a default take the first positions in order
+func defaultChannelMask(channels int) uint32 {
+	if name, ok := defaultLayouts[channels]; ok {
+		return channelLayouts[name]
+	}
+	return 1<<uint(channels) - 1
+}
+
+// normalChannelMask returns mask as AudioFormat.ChannelMask holds it: 0 when
+// it is the default layout for the channel count or does not fit it, so
+// formats compare equal however their layout was learned
+func normalChannelMask(channels int, mask uint32) uint32 {
+	if mask == defaultChannelMask(channels) || bits.OnesCount32(mask) != channels {
+		return 0
+	}
+	return mask
+}
+
+// channelMask returns the speaker positions of a format's channels
+func (f *AudioFormat) channelMask() uint32 {
+	if f.ChannelMask != 0 {
+		return f.ChannelMask
+	}
+	return defaultChannelMask(f.Channels)
+}
+
+// ChannelLayout returns the ffmpeg name of a format's channel layout, such as
+// "stereo", "5.1(side)" or "7.1"
+func (f *AudioFormat) ChannelLayout() string {
+	mask := f.channelMask()
+	for name, layout := range channelLayouts {
+		if layout == mask {
+			return name
+		}
+	}
+	return fmt.Sprintf("%d channels", f.Channels)
+}
@@ -0,0 +1,498 @@
+package decoder
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+)
+
+// errNotDSD is returned by ReadDSDFile for files that are not uncompressed DSF or DFF
+var errNotDSD = errors.New("not a DSF or DFF file")
+
+// dsdPCMMaxRate is the highest rate DSD is converted to PCM at (DXD)
+const dsdPCMMaxRate = 352800
+
+// DoP markers, alternating from one PCM frame to the next
+const (
+	dopMarkerA = 0x05
+	dopMarkerB = 0xFA
+)
+
+// DSDFile is a DSF or DFF file of uncompressed 1-bit DSD
+type DSDFile struct {
+	Path       string
+	SampleRate int // DSD rate in Hz, 2822400 for DSD64
+	Channels   int
+	Frames     int64 // Bytes of DSD per channel, each holding 8 samples
+	dataStart  int64 // Offset of the DSD data in the file
+	blockSize  int   // DSF bytes per channel in each block; 0 for DFF, whose bytes are interleaved
+	lsbFirst   bool  // Each byte holds its first sample in the lowest bit (DSF)
+}
+
+// ReadDSDFile reads the header of a DSF or DFF file
+// DST-compressed DFF files are rejected, as are files of another type
+func ReadDSDFile(path string) (*DSDFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return nil, errNotDSD
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var dsd *DSDFile
+	switch string(magic) {
+	case "DSD ":
+		dsd, err = readDSF(f)
+	case "FRM8":
+		dsd, err = readDFF(f)
+	default:
+		return nil, errNotDSD
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	dsd.Path = path
+	return dsd, nil
+}
+
+// readDSF reads the DSD, fmt and data chunk headers of a DSF file
+func readDSF(f *os.File) (*DSDFile, error) {
+	header := make([]byte, 28+52+12)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, fmt.Errorf("truncated DSF header")
+	}
+	if binary.LittleEndian.Uint64(header[4:12]) != 28 || string(header[28:32]) != "fmt " ||
+		binary.LittleEndian.Uint64(header[32:40]) != 52 || string(header[80:84]) != "data" {
+		return nil, fmt.Errorf("invalid DSF header")
+	}
+
+	fmtChunk := header[40:80]
+	formatID := binary.LittleEndian.Uint32(fmtChunk[4:8])
+	channels := int(binary.LittleEndian.Uint32(fmtChunk[12:16]))
+	rate := int(binary.LittleEndian.Uint32(fmtChunk[16:20]))
+	sampleBits := binary.LittleEndian.Uint32(fmtChunk[20:24])
+	samples := int64(binary.LittleEndian.Uint64(fmtChunk[24:32]))
+	blockSize := int(binary.LittleEndian.Uint32(fmtChunk[32:36]))
+	if formatID != 0 || channels < 1 || channels > 6 || rate <= 0 || blockSize <= 0 || (sampleBits != 1 && sampleBits != 8) {
+		return nil, fmt.Errorf("unsupported DSF format")
+	}
+
+	dsd := &DSDFile{
+		SampleRate: rate,
+		Channels:   channels,
+		Frames:     (samples + 7) / 8,
+		dataStart:  int64(len(header)),
+		blockSize:  blockSize,
+		lsbFirst:   sampleBits == 1,
+	}
+
+	// The last block is padded, so whole blocks must be there
+	blocks := (dsd.Frames + int64(blockSize) - 1) / int64(blockSize)
+	dataSize := int64(binary.LittleEndian.Uint64(header[84:92])) - 12
+	if available := dataSize / int64(blockSize*channels); blocks > available {
+		dsd.Frames = available * int64(blockSize)
+	}
+	return dsd, nil
+}
+
+// readDFF reads the PROP chunk of a DFF file up to its DSD chunk
+func readDFF(f *os.File) (*DSDFile, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[12:16]) != "DSD " {
+		return nil, fmt.Errorf("invalid DFF header")
+	}
+
+	dsd := &DSDFile{}
+	offset := int64(16)
+	for {
+		chunk := make([]byte, 12)
+		if _, err := io.ReadFull(f, chunk); err != nil {
+			return nil, fmt.Errorf("no DSD chunk: %w", err)
+		}
+		id := string(chunk[0:4])
+		size := int64(binary.BigEndian.Uint64(chunk[4:12]))
+		offset += 12
+
+		switch id {
+		case "PROP":
+			body := make([]byte, size)
+			if _, err := io.ReadFull(f, body); err != nil {
+				return nil, fmt.Errorf("truncated PROP chunk")
+			}
+			if err := dsd.readDFFProperties(body); err != nil {
+				return nil, err
+			}
+
+		case "DSD ":
+			if dsd.SampleRate == 0 || dsd.Channels == 0 {
+				return nil, fmt.Errorf("DSD chunk before PROP chunk")
+			}
+			dsd.dataStart = offset
+			dsd.Frames = size / int64(dsd.Channels)
+			return dsd, nil
+
+		case "DST ":
+			return nil, fmt.Errorf("DST compression: %w", errNotDSD)
+		}
+
+		// Chunks are padded to an even length
+		next := offset + size + size%2
+		if _, err := f.Seek(next, io.SeekStart); err != nil {
+			return nil, err
+		}
+		offset = next
+	}
+}
+
+// readDFFProperties reads the sample rate and channel count from the body of a PROP chunk
+func (d *DSDFile) readDFFProperties(body []byte) error {
+	if len(body) < 4 || string(body[0:4]) != "SND " {
+		return fmt.Errorf("invalid PROP chunk")
+	}
+
+	for pos := 4; pos+12 <= len(body); {
+		id := string(body[pos : pos+4])
+		size := int(binary.BigEndian.Uint64(body[pos+4 : pos+12]))
+		pos += 12
+		if size < 0 || pos+size > len(body) {
+			return fmt.Errorf("truncated %q chunk", id)
+		}
+		data := body[pos : pos+size]
+
+		switch {
+		case id == "FS  " && size >= 4:
+			d.SampleRate = int(binary.BigEndian.Uint32(data))
+		case id == "CHNL" && size >= 2:
+			d.Channels = int(binary.BigEndian.Uint16(data))
+		case id == "CMPR" && size >= 4:
+			if string(data[0:4]) != "DSD " {
+				return fmt.Errorf("DFF compression %q: %w", data[0:4], errNotDSD)
+			}
+		}
+		pos += size + size%2
+	}
+
+	if d.SampleRate <= 0 || d.Channels < 1 {
+		return fmt.Errorf("invalid PROP chunk")
+	}
+	return nil
+}
+
+// Duration returns the length of the DSD data in seconds
+func (d *DSDFile) Duration() float64 {
+	return float64(d.Frames*8) / float64(d.SampleRate)
+}
+
+// Format returns the format of the DSD itself, as 1-bit samples
+func (d *DSDFile) Format() *AudioFormat {
+	return &AudioFormat{SampleRate: d.SampleRate, BitsPerSample: 1, Channels: d.Channels}
+}
+
+// PCMFormat returns the format DSD is converted to PCM in before any limits:
+// 24-bit at an eighth of the DSD rate, halved until it is no faster than DXD
+func (d *DSDFile) PCMFormat() *AudioFormat {
+	rate := d.SampleRate / 8
+	for rate > dsdPCMMaxRate && rate%2 == 0 {
+		rate /= 2
+	}
+	return &AudioFormat{SampleRate: rate, BitsPerSample: 24, Channels: d.Channels}
+}
+
+// Open returns a reader of the DSD as DFF holds it: a byte per channel in
+// turn, each with its first sample in the highest bit
+func (d *DSDFile) Open() (io.ReadCloser, error) {
+	f, err := os.Open(d.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	data := io.NewSectionReader(f, d.dataStart, 1<<62)
+	if d.blockSize == 0 {
+		return &pcmReader{Reader: io.LimitReader(data, d.Frames*int64(d.Channels)), f: f}, nil
+	}
+	return &pcmReader{Reader: &dsfInterleaver{r: bufio.NewReader(data), dsd: d, remaining: d.Frames}, f: f}, nil
+}
+
+// dsfInterleaver reads the per-channel blocks of a DSF file as interleaved bytes
+type dsfInterleaver struct {
+	r         io.Reader
+	dsd       *DSDFile
+	remaining int64  // Bytes per channel not yet read from the file
+	block     []byte // One block of every channel
+	buf       []byte // The block interleaved
+	out       []byte // Interleaved bytes not yet returned
+}
+
+// Read returns interleaved bytes, reading the next blocks when they run out
+func (d *dsfInterleaver) Read(p []byte) (int, error) {
+	if len(d.out) == 0 {
+		if d.remaining == 0 {
+			return 0, io.EOF
+		}
+
+		size, channels := d.dsd.blockSize, d.dsd.Channels
+		if d.block == nil {
+			d.block = make([]byte, size*channels)
+			d.buf = make([]byte, size*channels)
+		}
+		if _, err := io.ReadFull(d.r, d.block); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+
+		frames := size
+		if int64(frames) > d.remaining {
+			frames = int(d.remaining)
+		}
+		d.remaining -= int64(frames)
+
+		d.out = d.buf[:frames*channels]
+		for i := 0; i < frames; i++ {
+			for ch := 0; ch < channels; ch++ {
+				b := d.block[ch*size+i]
+				if d.dsd.lsbFirst {
+					b = bits.Reverse8(b)
+				}
+				d.out[i*channels+ch] = b
+			}
+		}
+	}
+
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// dopFormat returns the PCM format DSD is carried in as DoP under the limits
+// DoP puts 16 DSD samples in each PCM sample, so it runs at a sixteenth of the
+// DSD rate in 24-bit samples, or 32-bit ones with the low byte unused
+// Returns nil if the limits allow neither, are slower than that rate or
+// change the channels, none of which DoP survives
+func dopFormat(dsd *DSDFile, limits FormatLimits) *AudioFormat {
+	format := &AudioFormat{SampleRate: dsd.SampleRate / 16, BitsPerSample: 24, Channels: dsd.Channels}
+	if limits.MaxSampleRate > 0 && format.SampleRate > limits.MaxSampleRate {
+		return nil
+	}
+	if !limits.keepsChannels(dsd.Channels) {
+		return nil
+	}
+	switch limits.BitDepth {
+	case 0, 24:
+	case 32:
+		format.BitsPerSample = 32
+	default:
+		return nil
+	}
+	if len(limits.BitDepths) > 0 && !containsInt(limits.BitDepths, format.BitsPerSample) {
+		if !containsInt(limits.BitDepths, 32) {
+			return nil
+		}
+		format.BitsPerSample = 32
+	}
+	return format
+}
+
+// dopEncoder packs interleaved DSD bytes into little-endian DoP samples: two
+// bytes of a channel under the marker byte, in the top 24 bits of each sample
+type dopEncoder struct {
+	r        io.Reader
+	channels int
+	width    int  // Bytes per PCM sample, 3 or 4
+	marker   byte // Marker of the next PCM frame
+	in       []byte
+	buf      []byte
+	out      []byte // DoP not yet returned
+	err      error  // Error of the last read, returned once out is drained
+}
+
+// newDOPEncoder returns a reader of the DSD from r as DoP in samples of bits bits
+func newDOPEncoder(r io.Reader, channels, bits int) *dopEncoder {
+	return &dopEncoder{
+		r:        r,
+		channels: channels,
+		width:    bits / 8,
+		marker:   dopMarkerA,
+		in:       make([]byte, 2*channels*4096),
+	}
+}
+
+// Read returns DoP samples, packing the next DSD bytes when they run out
+func (e *dopEncoder) Read(p []byte) (int, error) {
+	if len(e.out) == 0 {
+		if e.err != nil {
+			return 0, e.err
+		}
+
+		n, err := io.ReadFull(e.r, e.in)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		e.err = err
+
+		// A trailing odd byte per channel cannot fill a sample and is dropped
+		frame := 2 * e.channels
+		n -= n % frame
+		e.out = e.buf[:0]
+		for i := 0; i < n; i += frame {
+			for ch := 0; ch < e.channels; ch++ {
+				if e.width == 4 {
+					e.out = append(e.out, 0)
+				}
+				e.out = append(e.out, e.in[i+e.channels+ch], e.in[i+ch], e.marker)
+			}
+			if e.marker == dopMarkerA {
+				e.marker = dopMarkerB
+			} else {
+				e.marker = dopMarkerA
+			}
+		}
+		e.buf = e.out
+		if len(e.out) == 0 {
+			return 0, e.err
+		}
+	}
+
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// copyDSD copies a DSD file untouched to outputPath, passing it to tee as it is
+// written like writeWAV
+func copyDSD(ctx context.Context, source, outputPath string, tee io.Writer, progress Progress) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = copyWithProgress(ctx, &teeWriter{file: out, tee: tee}, in, stat.Size(), progress)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(outputPath)
+	}
+	return err
+}
+
+// TrimDSD writes a copy of a DSF or DFF file that starts seconds into the
+// source, as a DFF file
+// The cut is made on a byte boundary of the DSD, every 8 samples, so the
+// samples after it are untouched
+func TrimDSD(source string, outputPath string, seconds float64) error {
+	dsd, err := ReadDSDFile(source)
+	if err != nil {
+		return err
+	}
+
+	skip := int64(seconds * float64(dsd.SampleRate) / 8)
+	if skip < 0 {
+		skip = 0
+	}
+	if skip > dsd.Frames {
+		skip = dsd.Frames
+	}
+
+	in, err := dsd.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if _, err := io.CopyN(io.Discard, in, skip*int64(dsd.Channels)); err != nil {
+		return fmt.Errorf("%s: %w", source, err)
+	}
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(out)
+	dataSize := (dsd.Frames - skip) * int64(dsd.Channels)
+	if _, err = w.Write(dffHeader(dsd, dataSize)); err == nil {
+		_, err = io.Copy(w, in)
+	}
+	if err == nil && dataSize%2 != 0 {
+		err = w.WriteByte(0)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(outputPath)
+		return err
+	}
+	return nil
+}
+
+// dffHeader returns the chunks of a DFF file of uncompressed DSD up to its
+// DSD chunk header, for dataSize bytes of interleaved DSD
+func dffHeader(dsd *DSDFile, dataSize int64) []byte {
+	chunk := func(id string, body []byte) []byte {
+		b := append([]byte(id), make([]byte, 8)...)
+		binary.BigEndian.PutUint64(b[4:12], uint64(len(body)))
+		b = append(b, body...)
+		if len(body)%2 != 0 {
+			b = append(b, 0)
+		}
+		return b
+	}
+
+	fs := binary.BigEndian.AppendUint32(nil, uint32(dsd.SampleRate))
+	chnl := binary.BigEndian.AppendUint16(nil, uint16(dsd.Channels))
+	for ch := 0; ch < dsd.Channels; ch++ {
+		switch {
+		case dsd.Channels == 2 && ch == 0:
+			chnl = append(chnl, "SLFT"...)
+		case dsd.Channels == 2 && ch == 1:
+			chnl = append(chnl, "SRGT"...)
+		default:
+			chnl = append(chnl, fmt.Sprintf("C%03d", ch)...)
+		}
+	}
+	cmpr := append([]byte("DSD "), 14)
+	cmpr = append(cmpr, "not compressed"...)
+
+	prop := []byte("SND ")
+	prop = append(prop, chunk("FS  ", fs)...)
+	prop = append(prop, chunk("CHNL", chnl)...)
+	prop = append(prop, chunk("CMPR", cmpr)...)
+
+	body := []byte("DSD ")
+	body = append(body, chunk("FVER", []byte{0x01, 0x05, 0x00, 0x00})...)
+	body = append(body, chunk("PROP", prop)...)
+	body = append(body, "DSD "...)
+	body = binary.BigEndian.AppendUint64(body, uint64(dataSize))
+
+	header := []byte("FRM8")
+	header = binary.BigEndian.AppendUint64(header, uint64(int64(len(body))+dataSize+dataSize%2))
+	return append(header, body...)
+}
@@ -2,7 +2,11 @@ package decoder
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"math"
+	"net/http"
 	"os"
 	"os/exec"
 	"strconv"
@@ -14,28 +18,92 @@ type AudioFormat struct {
 	SampleRate    int
 	BitsPerSample int
 	Channels      int
+	ChannelMask   uint32 // Speaker positions of the channels, 0 for the default layout of the count (see ChannelLayout)
+}
+
+// String describes the format as e.g. "96000 Hz, 24-bit, 5.1(side)", or
+// "2822400 Hz, DSD, stereo" for DSD
+func (f *AudioFormat) String() string {
+	depth := fmt.Sprintf("%d-bit", f.BitsPerSample)
+	if f.BitsPerSample == 1 {
+		depth = "DSD"
+	}
+	return fmt.Sprintf("%d Hz, %s, %s", f.SampleRate, depth, f.ChannelLayout())
 }
 
 // ProbeFormat detects the native audio format of a file/URL using ffprobe
+// The result is cached until the source changes (see probe)
 func ProbeFormat(source string) (*AudioFormat, error) {
-	// Check if file exists first (for non-URL sources)
-	// Skip check for HTTP/HTTPS URLs as ffprobe can handle them directly
-	isURL := strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
-	if !isURL {
-		if _, err := os.Stat(source); err != nil {
-			if os.IsNotExist(err) {
-				return nil, fmt.Errorf("file does not exist: %s", source)
-			}
-			return nil, fmt.Errorf("cannot access file: %w", err)
-		}
-	}
-
-	// Use bits_per_raw_sample which works for compressed formats like FLAC
-	cmd := exec.Command("ffprobe",
+	result, err := probe(source)
+	if err != nil {
+		return nil, err
+	}
+	if result.Format == nil {
+		return nil, fmt.Errorf("no audio stream in %s", source)
+	}
+	format := *result.Format
+	return &format, nil
+}
+
+// DecodeToWAVFile decodes audio to a WAV file at the specified path.
+//
+// Note: the WAV file holds only the audio; title, artist, album, etc. are read
+// from the source instead.
+//
+// Returns the audio format.
+func DecodeToWAVFile(source string, outputPath string) (*AudioFormat, error) {
+	return DecodeToWAVFileWithLimits(source, outputPath, FormatLimits{})
+}
+
+// DecodeToWAVFileWithLimits decodes audio to a WAV file in the native format,
+// resampled or requantized only as far as needed to fit limits
+// ffmpeg decodes to raw PCM on a pipe and the WAV file is written from it
+// (see DecodeToWAVStream), so the file carries no tags
+// Returns the format written.
+func DecodeToWAVFileWithLimits(source string, outputPath string, limits FormatLimits) (*AudioFormat, error) {
+	return DecodeToWAVStream(context.Background(), source, outputPath, limits, nil, nil)
+}
+
+// ProbeMetadata extracts metadata tags from an audio file using ffprobe
+// Returns a map of tag names to values (e.g., "artist", "album", "title", etc.),
+// along with the duration and bitrate. The map is the caller's own to change
+func ProbeMetadata(source string) (map[string]string, error) {
+	result, err := probe(source)
+	if err != nil {
+		return nil, err
+	}
+	metadata := make(map[string]string, len(result.Metadata))
+	for key, value := range result.Metadata {
+		metadata[key] = value
+	}
+	return metadata, nil
+}
+
+// Picture is an image embedded in an audio file
+type Picture struct {
+	Data     []byte
+	MIMEType string
+}
+
+// pictureMIMETypes maps ffprobe codec names of embedded pictures to MIME types
+var pictureMIMETypes = map[string]string{
+	"mjpeg": "image/jpeg",
+	"png":   "image/png",
+	"gif":   "image/gif",
+	"bmp":   "image/bmp",
+	"webp":  "image/webp",
+}
+
+// ExtractPicture extracts embedded cover art (ID3 APIC, FLAC PICTURE, MP4 covr)
+// ffmpeg exposes these as an attached picture video stream, which is copied out unchanged
+// Returns nil without error if the file has no embedded picture
+func ExtractPicture(source string) (*Picture, error) {
+	// Find the codec of the first video (attached picture) stream
+	cmd := exec.Command(ffprobePath(),
 		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=codec_name",
 		"-print_format", "default=noprint_wrappers=1:nokey=1",
-		"-select_streams", "a:0",
-		"-show_entries", "stream=sample_rate,channels,bits_per_raw_sample",
 		source,
 	)
 
@@ -48,158 +116,215 @@ func ProbeFormat(source string) (*AudioFormat, error) {
 		return nil, fmt.Errorf("ffprobe failed: %w\nstderr: %s", err, stderr.String())
 	}
 
-	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
-	if len(lines) < 2 {
-		return nil, fmt.Errorf("unexpected ffprobe output")
+	codec := strings.TrimSpace(out.String())
+	if codec == "" {
+		return nil, nil
 	}
 
-	sampleRate, err := strconv.Atoi(strings.TrimSpace(lines[0]))
-	if err != nil {
-		return nil, fmt.Errorf("invalid sample rate: %w", err)
+	// Copy the picture stream out without re-encoding
+	cmd = exec.Command(ffmpegPath(),
+		"-v", "error",
+		"-i", source,
+		"-map", "0:v:0",
+		"-c", "copy",
+		"-f", "image2pipe",
+		"-",
+	)
+
+	out.Reset()
+	stderr.Reset()
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w\nstderr: %s", err, stderr.String())
+	}
+	if out.Len() == 0 {
+		return nil, nil
 	}
 
-	channels, err := strconv.Atoi(strings.TrimSpace(lines[1]))
-	if err != nil {
-		return nil, fmt.Errorf("invalid channels: %w", err)
-	}
-
-	// bits_per_raw_sample gives the actual bit depth for compressed formats
-	bitsPerSample := 16 // default to 16-bit if not available
-	if len(lines) > 2 && lines[2] != "N/A" && strings.TrimSpace(lines[2]) != "" {
-		if bps, err := strconv.Atoi(strings.TrimSpace(lines[2])); err == nil && bps > 0 {
-			// 24-bit audio is typically stored in 32-bit containers
-			if bps == 24 {
-				bitsPerSample = 32
-			} else {
-				bitsPerSample = bps
-			}
-		}
-	}
-
-	return &AudioFormat{
-		SampleRate:    sampleRate,
-		BitsPerSample: bitsPerSample,
-		Channels:      channels,
+	mimeType, ok := pictureMIMETypes[codec]
+	if !ok {
+		mimeType = http.DetectContentType(out.Bytes())
+	}
+
+	return &Picture{
+		Data:     out.Bytes(),
+		MIMEType: mimeType,
 	}, nil
 }
 
-// DecodeToWAVFile decodes audio to a WAV file at the specified path.
-//
-// Note: WAV format has limited metadata support compared to formats like FLAC or MP3.
-// WAV files only support INFO chunks for metadata, which may not preserve all tags.
-// Title, artist, album, etc. may be lost or incomplete in the conversion.
-//
-// Returns the audio format.
-func DecodeToWAVFile(source string, outputPath string) (*AudioFormat, error) {
-	// First probe to get native format
-	nativeFormat, err := ProbeFormat(source)
+// fingerprintSeconds is how much audio is fingerprinted, matching fpcalc's default
+const fingerprintSeconds = 120
+
+// Fingerprint computes a compressed base64 Chromaprint fingerprint as used by AcoustID
+// fpcalc is used when installed, otherwise ffmpeg's chromaprint muxer
+func Fingerprint(source string) (string, error) {
+	var cmd *exec.Cmd
+	if _, err := exec.LookPath("fpcalc"); err == nil {
+		cmd = exec.Command("fpcalc",
+			"-plain",
+			"-length", strconv.Itoa(fingerprintSeconds),
+			source,
+		)
+	} else {
+		cmd = exec.Command(ffmpegPath(),
+			"-v", "error",
+			"-t", strconv.Itoa(fingerprintSeconds),
+			"-i", source,
+			"-map", "0:a:0",
+			"-f", "chromaprint",
+			"-fp_format", "base64",
+			"-",
+		)
+	}
+
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s failed: %w\nstderr: %s", cmd.Args[0], err, stderr.String())
+	}
+
+	fingerprint := strings.TrimSpace(out.String())
+	if fingerprint == "" {
+		return "", fmt.Errorf("%s produced no fingerprint", cmd.Args[0])
+	}
+	return fingerprint, nil
+}
+
+// ApplyGain writes a copy of a WAV file with its level changed by gainDB
+// The sample format is kept so the copy has the same bit depth as the source
+func ApplyGain(source string, outputPath string, gainDB float64) error {
+	codec, err := audioCodec(source)
 	if err != nil {
-		return nil, fmt.Errorf("failed to probe audio format: %w", err)
+		return err
 	}
 
-	// Build ffmpeg command to decode to WAV
-	// Note: -map_metadata attempts to preserve metadata, but WAV format
-	// only supports INFO chunks, so many tags may be lost
-	args := []string{
+	cmd := exec.Command(ffmpegPath(),
+		"-v", "error",
 		"-i", source,
+		"-af", fmt.Sprintf("volume=%.6f", math.Pow(10, gainDB/20)),
+		"-c:a", codec,
 		"-f", "wav",
-		"-map_metadata", "0",     // Attempt to preserve metadata (limited by WAV format)
-		"-write_id3v2", "1",      // Try to write ID3v2 tags if possible
-		"-id3v2_version", "3",    // Use ID3v2.3 for better compatibility
-		"-metadata:s:a:0", "encoder=ffmpeg", // Preserve stream metadata
-		"-y",                     // Overwrite output file
+		"-y",
 		outputPath,
-	}
-
-	cmd := exec.Command("ffmpeg", args...)
+	)
 
-	// Capture stderr for error messages
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 
 	if err := cmd.Run(); err != nil {
 		os.Remove(outputPath)
-		return nil, fmt.Errorf("ffmpeg failed: %w\nstderr: %s", err, stderr.String())
+		return fmt.Errorf("ffmpeg failed: %w\nstderr: %s", err, stderr.String())
 	}
 
-	return nativeFormat, nil
+	return nil
 }
 
-// ProbeMetadata extracts metadata tags from an audio file using ffprobe
-// Returns a map of tag names to values (e.g., "artist", "album", "title", etc.)
-func ProbeMetadata(source string) (map[string]string, error) {
-	// Check if file exists first (for non-URL sources)
-	// Skip check for HTTP/HTTPS URLs as ffprobe can handle them directly
-	isURL := strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
-	if !isURL {
-		if _, err := os.Stat(source); err != nil {
-			if os.IsNotExist(err) {
-				return nil, fmt.Errorf("file does not exist: %s", source)
-			}
-			return nil, fmt.Errorf("cannot access file: %w", err)
-		}
-	}
-
-	// Use ffprobe to extract metadata tags
-	// Format: key=value pairs
-	cmd := exec.Command("ffprobe",
-		"-v", "error",
-		"-print_format", "default=noprint_wrappers=1",
-		"-show_entries", "format_tags",
-		source,
-	)
+// CrossfadeTrack writes a copy of a WAV file with its first skip seconds removed
+// and its last fade seconds mixed with the first fade seconds of next
+// next may be empty (or fade 0) to only trim the head
+func CrossfadeTrack(source, next string, skip, fade float64, outputPath string) error {
+	codec, err := audioCodec(source)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"-v", "error", "-i", source}
+	if next != "" && fade > 0 {
+		args = append(args,
+			"-i", next,
+			"-filter_complex", fmt.Sprintf(
+				"[0:a]atrim=start=%.6f,asetpts=PTS-STARTPTS[a];"+
+					"[1:a]atrim=end=%.6f,asetpts=PTS-STARTPTS[b];"+
+					"[a][b]acrossfade=d=%.6f:c1=tri:c2=tri",
+				skip, fade, fade),
+		)
+	} else {
+		args = append(args, "-af", fmt.Sprintf("atrim=start=%.6f,asetpts=PTS-STARTPTS", skip))
+	}
+	args = append(args, "-c:a", codec, "-f", "wav", "-y", outputPath)
+
+	cmd := exec.Command(ffmpegPath(), args...)
 
-	var out bytes.Buffer
 	var stderr bytes.Buffer
-	cmd.Stdout = &out
 	cmd.Stderr = &stderr
 
 	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("ffprobe failed: %w\nstderr: %s", err, stderr.String())
+		os.Remove(outputPath)
+		return fmt.Errorf("ffmpeg failed: %w\nstderr: %s", err, stderr.String())
 	}
 
-	// Parse the output into a map
-	metadata := make(map[string]string)
-	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	return nil
+}
+
+// audioCodec returns the codec name of a file's first audio stream
+func audioCodec(source string) (string, error) {
+	result, err := probe(source)
+	if err != nil {
+		return "", err
+	}
+	if result.Codec == "" {
+		return "", fmt.Errorf("no audio stream in %s", source)
+	}
+	return result.Codec, nil
+}
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
+// Loudness is an EBU R128 measurement of a whole track
+type Loudness struct {
+	Integrated float64 // Integrated loudness in LUFS
+	TruePeak   float64 // True peak in dBTP
+}
 
-		// Split on first '=' to handle values that contain '='
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
-			continue
-		}
+// MeasureLoudness runs ffmpeg's loudnorm filter in analysis mode over the whole source
+func MeasureLoudness(source string) (*Loudness, error) {
+	cmd := exec.Command(ffmpegPath(),
+		"-hide_banner",
+		"-nostats",
+		"-i", source,
+		"-map", "0:a:0",
+		"-af", "loudnorm=print_format=json",
+		"-f", "null",
+		"-",
+	)
 
-		key := strings.ToLower(strings.TrimPrefix(parts[0], "TAG:"))
-		value := strings.TrimSpace(parts[1])
+	// loudnorm prints its JSON report to stderr after the log lines
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
 
-		if value != "" {
-			metadata[key] = value
-		}
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w\nstderr: %s", err, stderr.String())
 	}
 
-	// Also get duration
-	cmd = exec.Command("ffprobe",
-		"-v", "error",
-		"-print_format", "default=noprint_wrappers=1:nokey=1",
-		"-show_entries", "format=duration",
-		source,
-	)
+	output := stderr.String()
+	start := strings.LastIndex(output, "{")
+	end := strings.LastIndex(output, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("no loudnorm report in ffmpeg output")
+	}
 
-	out.Reset()
-	stderr.Reset()
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
+	var report struct {
+		InputI  string `json:"input_i"`
+		InputTP string `json:"input_tp"`
+	}
+	if err := json.Unmarshal([]byte(output[start:end+1]), &report); err != nil {
+		return nil, fmt.Errorf("failed to parse loudnorm report: %w", err)
+	}
 
-	if err := cmd.Run(); err == nil {
-		if duration := strings.TrimSpace(out.String()); duration != "" && duration != "N/A" {
-			metadata["duration"] = duration
-		}
+	integrated, err := strconv.ParseFloat(report.InputI, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid integrated loudness %q", report.InputI)
+	}
+	truePeak, err := strconv.ParseFloat(report.InputTP, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid true peak %q", report.InputTP)
 	}
 
-	return metadata, nil
+	return &Loudness{
+		Integrated: integrated,
+		TruePeak:   truePeak,
+	}, nil
 }
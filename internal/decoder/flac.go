@@ -0,0 +1,754 @@
+package decoder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+)
+
+// FLAC metadata block types
+const (
+	flacBlockStreamInfo = 0
+	flacBlockSeekTable  = 3
+)
+
+// flacPlaceholder marks an unused seek point
+const flacPlaceholder = 1<<64 - 1
+
+// errNotFLAC is returned by OpenFLAC for files that are not FLAC
+var errNotFLAC = errors.New("not a FLAC file")
+
+// FLACReader decodes a FLAC file in-process to interleaved little-endian PCM
+// Samples are left-justified in the output sample size, as ffmpeg produces
+// them, so 24-bit audio comes out as 32-bit samples by default
+type FLACReader struct {
+	f          io.ReadSeekCloser
+	br         *bitReader
+	sampleRate int
+	channels   int
+	bps        int    // Bits per sample in the stream
+	total      uint64 // Samples per channel, 0 if unknown
+	seekPoints []flacSeekPoint
+	firstFrame int64 // File offset of the first frame
+
+	outBits  int       // Sample size of the output
+	position uint64    // Samples per channel decoded so far
+	samples  [][]int64 // Decoded samples of the current frame, per channel
+	out      []byte    // Output of the current frame not yet read
+}
+
+// flacSeekPoint is an entry of the SEEKTABLE block
+type flacSeekPoint struct {
+	sample uint64 // First sample of the frame
+	offset int64  // Offset of the frame from the first frame
+}
+
+// OpenFLAC opens a FLAC file and reads its metadata
+func OpenFLAC(path string) (*FLACReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewFLACReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// NewFLACReader reads the metadata of a FLAC stream from f, which Close closes
+// Frames are read as they are decoded, so f may still be growing as long as
+// its reads wait for more rather than ending early
+func NewFLACReader(f io.ReadSeekCloser) (*FLACReader, error) {
+	r := &FLACReader{f: f}
+	if err := r.readMetadata(); err != nil {
+		return nil, err
+	}
+	r.outBits = containerBits(r.bps)
+	return r, nil
+}
+
+// containerBits returns the sample size FLAC audio of bps bits is decoded to:
+// the smallest whole number of bytes holding it, as ProbeFormat reports it
+func containerBits(bps int) int {
+	return (bps + 7) / 8 * 8
+}
+
+// readMetadata reads the metadata blocks up to the first frame
+func (r *FLACReader) readMetadata() error {
+	buffered := bufio.NewReaderSize(r.f, 64*1024)
+	var offset int64
+
+	// Tools writing ID3v2 tags put them before the stream marker
+	head := make([]byte, 10)
+	if _, err := io.ReadFull(buffered, head[:4]); err != nil {
+		return errNotFLAC
+	}
+	offset += 4
+	if string(head[:3]) == "ID3" {
+		if _, err := io.ReadFull(buffered, head[4:]); err != nil {
+			return errNotFLAC
+		}
+		size := int64(head[6]&0x7F)<<21 | int64(head[7]&0x7F)<<14 | int64(head[8]&0x7F)<<7 | int64(head[9]&0x7F)
+		if _, err := buffered.Discard(int(size)); err != nil {
+			return errNotFLAC
+		}
+		if _, err := io.ReadFull(buffered, head[:4]); err != nil {
+			return errNotFLAC
+		}
+		offset += 6 + size + 4
+	}
+	if string(head[:4]) != "fLaC" {
+		return errNotFLAC
+	}
+
+	haveInfo := false
+	for last := false; !last; {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(buffered, header); err != nil {
+			return fmt.Errorf("truncated metadata: %w", err)
+		}
+		last = header[0]&0x80 != 0
+		blockType := header[0] & 0x7F
+		length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		offset += 4 + int64(length)
+
+		body := make([]byte, length)
+		if _, err := io.ReadFull(buffered, body); err != nil {
+			return fmt.Errorf("truncated metadata: %w", err)
+		}
+
+		switch blockType {
+		case flacBlockStreamInfo:
+			if length < 34 {
+				return fmt.Errorf("STREAMINFO too short")
+			}
+			packed := binary.BigEndian.Uint64(body[10:18])
+			r.sampleRate = int(packed >> 44)
+			r.channels = int(packed>>41&0x7) + 1
+			r.bps = int(packed>>36&0x1F) + 1
+			r.total = packed & (1<<36 - 1)
+			haveInfo = true
+		case flacBlockSeekTable:
+			for i := 0; i+18 <= length; i += 18 {
+				sample := binary.BigEndian.Uint64(body[i : i+8])
+				if sample == flacPlaceholder {
+					continue
+				}
+				r.seekPoints = append(r.seekPoints, flacSeekPoint{
+					sample: sample,
+					offset: int64(binary.BigEndian.Uint64(body[i+8 : i+16])),
+				})
+			}
+		}
+	}
+	if !haveInfo || r.sampleRate == 0 {
+		return fmt.Errorf("no STREAMINFO")
+	}
+
+	r.firstFrame = offset
+	r.br = &bitReader{r: buffered}
+	return nil
+}
+
+// flacLayouts names FLAC's channel orders for the counts where they are not
+// ffmpeg's default
+var flacLayouts = map[int]string{
+	3: "3.0",
+	4: "quad",
+}
+
+// Format returns the format Read produces
+func (r *FLACReader) Format() *AudioFormat {
+	mask := normalChannelMask(r.channels, channelLayouts[flacLayouts[r.channels]])
+	return &AudioFormat{SampleRate: r.sampleRate, BitsPerSample: r.outBits, Channels: r.channels, ChannelMask: mask}
+}
+
+// SetBitsPerSample changes the output sample size (8, 16, 24 or 32), requantizing the audio
+func (r *FLACReader) SetBitsPerSample(bits int) {
+	r.outBits = bits
+}
+
+// TotalSamples returns the length of the stream in samples per channel, 0 if unknown
+func (r *FLACReader) TotalSamples() uint64 {
+	return r.total
+}
+
+// Close closes the file
+func (r *FLACReader) Close() error {
+	return r.f.Close()
+}
+
+// Read reads decoded PCM
+func (r *FLACReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		// Anything after the last sample, such as an ID3v1 tag, is not audio
+		if r.total > 0 && r.position >= r.total {
+			return 0, io.EOF
+		}
+		if err := r.decodeFrame(); err != nil {
+			return 0, err
+		}
+		r.out = r.interleave(r.samples, 0)
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// SeekSample positions the reader at a sample, counted per channel from the start
+// Decoding starts from the closest seek point before it, and the samples of the
+// frame ahead of the position are dropped, so the position is exact
+func (r *FLACReader) SeekSample(sample uint64) error {
+	if r.total > 0 && sample > r.total {
+		sample = r.total
+	}
+
+	start := flacSeekPoint{}
+	for _, point := range r.seekPoints {
+		if point.sample <= sample && point.sample >= start.sample {
+			start = point
+		}
+	}
+	if _, err := r.f.Seek(r.firstFrame+start.offset, io.SeekStart); err != nil {
+		return err
+	}
+	r.br.reset(bufio.NewReaderSize(r.f, 64*1024))
+	r.out = nil
+	r.position = start.sample
+
+	for r.position <= sample {
+		if r.total > 0 && r.position >= r.total {
+			return nil
+		}
+		frameStart := r.position
+		if err := r.decodeFrame(); err != nil {
+			if err == io.EOF && frameStart == sample {
+				return nil
+			}
+			return err
+		}
+		if r.position > sample {
+			r.out = r.interleave(r.samples, int(sample-frameStart))
+			return nil
+		}
+	}
+	return nil
+}
+
+// interleave converts decoded samples from skip on to output PCM
+func (r *FLACReader) interleave(samples [][]int64, skip int) []byte {
+	width := r.outBits / 8
+	frames := len(samples[0]) - skip
+	out := make([]byte, 0, frames*r.channels*width)
+	shift := 32 - r.bps
+
+	for i := skip; i < len(samples[0]); i++ {
+		for ch := 0; ch < r.channels; ch++ {
+			v := uint32(samples[ch][i]) << shift // Left-justified in 32 bits
+			switch width {
+			case 1:
+				out = append(out, byte(v>>24)^0x80) // 8-bit PCM is unsigned
+			case 2:
+				out = append(out, byte(v>>16), byte(v>>24))
+			case 3:
+				out = append(out, byte(v>>8), byte(v>>16), byte(v>>24))
+			default:
+				out = append(out, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+			}
+		}
+	}
+	return out
+}
+
+// decodeFrame decodes the next frame into r.samples
+// Returns io.EOF after the last frame
+func (r *FLACReader) decodeFrame() error {
+	br := r.br
+	br.crc8, br.crc16 = 0, 0 // Frames start on a byte boundary
+	sync, err := br.readBits(15)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return io.EOF
+		}
+		return err
+	}
+	if sync != 0x3FFE<<1 {
+		return fmt.Errorf("lost FLAC frame sync")
+	}
+
+	// Frame header
+	fields, err := br.readBits(17) // Blocking strategy, block size, rate, channels, sample size, reserved
+	if err != nil {
+		return err
+	}
+	blockCode := int(fields >> 12 & 0xF)
+	rateCode := int(fields >> 8 & 0xF)
+	channelCode := int(fields >> 4 & 0xF)
+	sizeCode := int(fields >> 1 & 0x7)
+
+	if err := br.skipCodedNumber(); err != nil {
+		return err
+	}
+
+	var blockSize int
+	switch {
+	case blockCode == 1:
+		blockSize = 192
+	case blockCode >= 2 && blockCode <= 5:
+		blockSize = 576 << (blockCode - 2)
+	case blockCode == 6:
+		v, err := br.readBits(8)
+		if err != nil {
+			return err
+		}
+		blockSize = int(v) + 1
+	case blockCode == 7:
+		v, err := br.readBits(16)
+		if err != nil {
+			return err
+		}
+		blockSize = int(v) + 1
+	case blockCode >= 8:
+		blockSize = 256 << (blockCode - 8)
+	default:
+		return fmt.Errorf("reserved FLAC block size")
+	}
+
+	switch rateCode {
+	case 12:
+		_, err = br.readBits(8)
+	case 13, 14:
+		_, err = br.readBits(16)
+	case 15:
+		err = fmt.Errorf("invalid FLAC sample rate")
+	}
+	if err != nil {
+		return err
+	}
+
+	bps := r.bps
+	switch sizeCode {
+	case 1:
+		bps = 8
+	case 2:
+		bps = 12
+	case 4:
+		bps = 16
+	case 5:
+		bps = 20
+	case 6:
+		bps = 24
+	case 7:
+		bps = 32
+	}
+	if bps != r.bps {
+		return fmt.Errorf("FLAC frame sample size %d differs from the stream's %d", bps, r.bps)
+	}
+
+	headerCRC := br.crc8
+	if crc, err := br.readBits(8); err != nil {
+		return err
+	} else if uint8(crc) != headerCRC {
+		return fmt.Errorf("FLAC frame header CRC mismatch")
+	}
+
+	channels := channelCode + 1
+	if channelCode >= 8 {
+		if channelCode > 10 {
+			return fmt.Errorf("reserved FLAC channel assignment")
+		}
+		channels = 2
+	}
+	if channels != r.channels {
+		return fmt.Errorf("FLAC frame has %d channels, the stream %d", channels, r.channels)
+	}
+
+	// Subframes; the side channel carries one more bit, 33 for 32-bit audio
+	if len(r.samples) != channels {
+		r.samples = make([][]int64, channels)
+	}
+	for ch := 0; ch < channels; ch++ {
+		subBits := bps
+		if (channelCode == 8 || channelCode == 10) && ch == 1 || channelCode == 9 && ch == 0 {
+			subBits++
+		}
+		if cap(r.samples[ch]) < blockSize {
+			r.samples[ch] = make([]int64, blockSize)
+		}
+		r.samples[ch] = r.samples[ch][:blockSize]
+		if err := br.decodeSubframe(r.samples[ch], subBits); err != nil {
+			return err
+		}
+	}
+
+	// Undo inter-channel decorrelation
+	switch channelCode {
+	case 8: // Left, side
+		left, side := r.samples[0], r.samples[1]
+		for i := range side {
+			side[i] = left[i] - side[i]
+		}
+	case 9: // Side, right
+		side, right := r.samples[0], r.samples[1]
+		for i := range side {
+			side[i] += right[i]
+		}
+	case 10: // Mid, side
+		mid, side := r.samples[0], r.samples[1]
+		for i := range mid {
+			m := mid[i]<<1 | side[i]&1
+			mid[i] = (m + side[i]) >> 1
+			side[i] = (m - side[i]) >> 1
+		}
+	}
+
+	// Padding to a byte boundary and the frame CRC-16
+	br.alignByte()
+	frameCRC := br.crc16
+	if crc, err := br.readBits(16); err != nil {
+		return err
+	} else if uint16(crc) != frameCRC {
+		return fmt.Errorf("FLAC frame CRC mismatch")
+	}
+	r.position += uint64(blockSize)
+	return nil
+}
+
+// decodeSubframe decodes one channel of a frame
+func (br *bitReader) decodeSubframe(samples []int64, bps int) error {
+	header, err := br.readBits(8)
+	if err != nil {
+		return err
+	}
+	if header&0x80 != 0 {
+		return fmt.Errorf("invalid FLAC subframe header")
+	}
+	kind := int(header >> 1 & 0x3F)
+
+	// Bits of silence below each sample
+	wasted := 0
+	if header&1 != 0 {
+		k, err := br.readUnary()
+		if err != nil {
+			return err
+		}
+		wasted = int(k) + 1
+		bps -= wasted
+	}
+
+	switch {
+	case kind == 0: // Constant
+		v, err := br.readSigned(bps)
+		if err != nil {
+			return err
+		}
+		for i := range samples {
+			samples[i] = v
+		}
+	case kind == 1: // Verbatim
+		for i := range samples {
+			if samples[i], err = br.readSigned(bps); err != nil {
+				return err
+			}
+		}
+	case kind >= 8 && kind <= 12: // Fixed predictor
+		err = br.decodeFixed(samples, bps, kind&7)
+	case kind >= 32: // Linear predictor
+		err = br.decodeLPC(samples, bps, kind&31+1)
+	default:
+		err = fmt.Errorf("reserved FLAC subframe type %d", kind)
+	}
+	if err != nil {
+		return err
+	}
+
+	if wasted > 0 {
+		for i := range samples {
+			samples[i] <<= wasted
+		}
+	}
+	return nil
+}
+
+// fixedCoefficients are the predictors of fixed subframes by order
+var fixedCoefficients = [][]int64{
+	{},
+	{1},
+	{2, -1},
+	{3, -3, 1},
+	{4, -6, 4, -1},
+}
+
+// decodeFixed decodes a subframe using one of the fixed polynomial predictors
+func (br *bitReader) decodeFixed(samples []int64, bps, order int) error {
+	if order > 4 || order > len(samples) {
+		return fmt.Errorf("invalid FLAC fixed predictor order %d", order)
+	}
+	for i := 0; i < order; i++ {
+		v, err := br.readSigned(bps)
+		if err != nil {
+			return err
+		}
+		samples[i] = v
+	}
+	if err := br.decodeResidual(samples, order); err != nil {
+		return err
+	}
+	predict(samples, fixedCoefficients[order], 0)
+	return nil
+}
+
+// decodeLPC decodes a subframe using a linear predictor stored in the subframe
+func (br *bitReader) decodeLPC(samples []int64, bps, order int) error {
+	if order > len(samples) {
+		return fmt.Errorf("invalid FLAC LPC order %d", order)
+	}
+	for i := 0; i < order; i++ {
+		v, err := br.readSigned(bps)
+		if err != nil {
+			return err
+		}
+		samples[i] = v
+	}
+
+	precision, err := br.readBits(4)
+	if err != nil {
+		return err
+	}
+	if precision == 15 {
+		return fmt.Errorf("invalid FLAC LPC precision")
+	}
+	shift, err := br.readSigned(5)
+	if err != nil {
+		return err
+	}
+	if shift < 0 {
+		return fmt.Errorf("negative FLAC LPC shift")
+	}
+
+	coefficients := make([]int64, order)
+	for i := range coefficients {
+		if coefficients[i], err = br.readSigned(int(precision) + 1); err != nil {
+			return err
+		}
+	}
+
+	if err := br.decodeResidual(samples, order); err != nil {
+		return err
+	}
+	predict(samples, coefficients, int(shift))
+	return nil
+}
+
+// predict adds the prediction from the previous samples to the residuals after the warm-up
+// coefficients[0] applies to the sample just before the one predicted
+func predict(samples []int64, coefficients []int64, shift int) {
+	order := len(coefficients)
+	for i := order; i < len(samples); i++ {
+		var sum int64
+		for j, c := range coefficients {
+			sum += c * samples[i-1-j]
+		}
+		samples[i] += sum >> shift
+	}
+}
+
+// decodeResidual reads the Rice-coded residuals following the warm-up samples
+func (br *bitReader) decodeResidual(samples []int64, order int) error {
+	method, err := br.readBits(2)
+	if err != nil {
+		return err
+	}
+	paramBits, escape := uint(4), uint64(15)
+	switch method {
+	case 0:
+	case 1:
+		paramBits, escape = 5, 31
+	default:
+		return fmt.Errorf("reserved FLAC residual coding method")
+	}
+
+	partitionOrder, err := br.readBits(4)
+	if err != nil {
+		return err
+	}
+	partitions := 1 << partitionOrder
+	partitionSize := len(samples) >> partitionOrder
+	if partitionSize < order || partitionSize*partitions != len(samples) {
+		return fmt.Errorf("invalid FLAC residual partition order")
+	}
+
+	i := order
+	for p := 0; p < partitions; p++ {
+		end := (p + 1) * partitionSize
+		param, err := br.readBits(paramBits)
+		if err != nil {
+			return err
+		}
+
+		if param == escape {
+			// Unencoded residuals of a fixed size
+			size, err := br.readBits(5)
+			if err != nil {
+				return err
+			}
+			for ; i < end; i++ {
+				if samples[i], err = br.readSigned(int(size)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		for ; i < end; i++ {
+			q, err := br.readUnary()
+			if err != nil {
+				return err
+			}
+			low, err := br.readBits(uint(param))
+			if err != nil {
+				return err
+			}
+			v := q<<param | low
+			samples[i] = int64(v>>1) ^ -int64(v&1) // Zigzag
+		}
+	}
+	return nil
+}
+
+// bitReader reads a stream MSB first
+// The CRCs of the bytes read go into crc8 and crc16, for the caller to reset
+type bitReader struct {
+	r     io.ByteReader
+	cache uint64 // The low n bits are unread
+	n     uint
+	crc8  uint8
+	crc16 uint16
+}
+
+// reset starts reading from r
+func (br *bitReader) reset(r io.ByteReader) {
+	br.r, br.cache, br.n = r, 0, 0
+}
+
+// readByte reads the next byte, adding it to the CRCs
+func (br *bitReader) readByte() (byte, error) {
+	b, err := br.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	br.crc8 = crc8Table[br.crc8^b]
+	br.crc16 = br.crc16<<8 ^ crc16Table[byte(br.crc16>>8)^b]
+	return b, nil
+}
+
+// readBits reads an unsigned value of up to 56 bits
+func (br *bitReader) readBits(n uint) (uint64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	for br.n < n {
+		b, err := br.readByte()
+		if err != nil {
+			return 0, err
+		}
+		br.cache = br.cache<<8 | uint64(b)
+		br.n += 8
+	}
+	br.n -= n
+	return br.cache >> br.n & (1<<n - 1), nil
+}
+
+// readSigned reads a two's complement value of n bits
+func (br *bitReader) readSigned(n int) (int64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	v, err := br.readBits(uint(n))
+	if err != nil {
+		return 0, err
+	}
+	return int64(v<<(64-n)) >> (64 - n), nil
+}
+
+// readUnary counts the zero bits before the next one bit
+func (br *bitReader) readUnary() (uint64, error) {
+	var count uint64
+	for {
+		if br.n == 0 {
+			b, err := br.readByte()
+			if err != nil {
+				return 0, err
+			}
+			br.cache = uint64(b)
+			br.n = 8
+		}
+		pending := br.cache & (1<<br.n - 1)
+		if pending == 0 {
+			count += uint64(br.n)
+			br.n = 0
+			continue
+		}
+		zeros := uint(bits.LeadingZeros64(pending)) - (64 - br.n)
+		count += uint64(zeros)
+		br.n -= zeros + 1
+		return count, nil
+	}
+}
+
+// skipCodedNumber skips the UTF-8 style frame or sample number of a frame header
+func (br *bitReader) skipCodedNumber() error {
+	first, err := br.readBits(8)
+	if err != nil {
+		return err
+	}
+	extra := bits.LeadingZeros8(^uint8(first)) - 1
+	if extra < 0 {
+		extra = 0
+	}
+	if extra > 6 {
+		return fmt.Errorf("invalid FLAC frame number")
+	}
+	_, err = br.readBits(uint(8 * extra))
+	return err
+}
+
+// alignByte skips the rest of a partly read byte
+func (br *bitReader) alignByte() {
+	br.n -= br.n % 8
+}
+
+// crc8Table and crc16Table are the CRCs of frame headers (polynomial 0x07)
+// and whole frames (polynomial 0x8005) for each byte value
+var crc8Table, crc16Table = crcTables()
+
+// crcTables computes crc8Table and crc16Table
+func crcTables() (t8 [256]uint8, t16 [256]uint16) {
+	for i := range t8 {
+		c8, c16 := uint8(i), uint16(i)<<8
+		for bit := 0; bit < 8; bit++ {
+			if c8&0x80 != 0 {
+				c8 = c8<<1 ^ 0x07
+			} else {
+				c8 <<= 1
+			}
+			if c16&0x8000 != 0 {
+				c16 = c16<<1 ^ 0x8005
+			} else {
+				c16 <<= 1
+			}
+		}
+		t8[i], t16[i] = c8, c16
+	}
+	return t8, t16
+}
@@ -0,0 +1,490 @@
+package decoder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Subframe types testFLAC encodes with
+const (
+	subVerbatim = iota
+	subConstant
+	subFixed
+	subLPC
+)
+
+// flacEncoding is how testFLAC lays out a stream
+type flacEncoding struct {
+	bps        int
+	blockSize  int
+	assignment int // Channel assignment code: 0 for independent, 8 left/side, 9 side/right, 10 mid/side
+	subframe   int
+	seekTable  bool
+}
+
+// bitWriter writes a stream MSB first
+type bitWriter struct {
+	buf  []byte
+	cur  uint64
+	bits uint
+}
+
+// write writes the low n bits of v
+func (w *bitWriter) write(v uint64, n uint) {
+	for n > 0 {
+		take := n
+		if take > 8 {
+			take = 8
+		}
+		n -= take
+		w.cur = w.cur<<take | v>>n&(1<<take-1)
+		w.bits += take
+		for w.bits >= 8 {
+			w.bits -= 8
+			w.buf = append(w.buf, byte(w.cur>>w.bits))
+		}
+	}
+}
+
+// writeSigned writes a two's complement value of n bits
+func (w *bitWriter) writeSigned(v int64, n int) {
+	w.write(uint64(v)&(1<<n-1), uint(n))
+}
+
+// writeUnary writes q zero bits and a one bit
+func (w *bitWriter) writeUnary(q uint64) {
+	for ; q > 0; q-- {
+		w.write(0, 1)
+	}
+	w.write(1, 1)
+}
+
+// align pads the stream with zero bits to a byte boundary
+func (w *bitWriter) align() {
+	if w.bits > 0 {
+		w.write(0, 8-w.bits)
+	}
+}
+
+// crc computes a CRC bit by bit, independently of the decoder's tables
+func crc(data []byte, poly uint32, width uint) uint32 {
+	var c uint32
+	top := uint32(1) << (width - 1)
+	mask := uint32(1)<<width - 1
+	for _, b := range data {
+		c ^= uint32(b) << (width - 8)
+		for i := 0; i < 8; i++ {
+			if c&top != 0 {
+				c = c<<1 ^ poly
+			} else {
+				c <<= 1
+			}
+			c &= mask
+		}
+	}
+	return c
+}
+
+// testFLAC encodes samples, given per channel, as a FLAC file
+// Returns the file and the offsets of its frames from the first one
+func testFLAC(t *testing.T, samples [][]int64, sampleRate int, enc flacEncoding) ([]byte, []int) {
+	t.Helper()
+	channels, total := len(samples), len(samples[0])
+
+	var frames bitWriter
+	var offsets []int
+	for start, number := 0, 0; start < total; start, number = start+enc.blockSize, number+1 {
+		end := start + enc.blockSize
+		if end > total {
+			end = total
+		}
+		offsets = append(offsets, len(frames.buf))
+		frameStart := len(frames.buf)
+
+		// Header
+		sizeCodes := map[int]uint64{8: 1, 12: 2, 16: 4, 20: 5, 24: 6, 32: 7}
+		channelCode := uint64(channels - 1)
+		if enc.assignment != 0 {
+			channelCode = uint64(enc.assignment)
+		}
+		frames.write(0x3FFE<<2, 16) // Sync, reserved bit, fixed blocking
+		frames.write(7<<4|0, 8)     // 16-bit block size at the end, rate from STREAMINFO
+		frames.write(channelCode<<4|sizeCodes[enc.bps]<<1, 8)
+		if number >= 0x80 {
+			t.Fatalf("frame number %d needs a longer coded number", number)
+		}
+		frames.write(uint64(number), 8)
+		frames.write(uint64(end-start-1), 16)
+		frames.write(uint64(crc(frames.buf[frameStart:], 0x07, 8)), 8)
+
+		// Subframes
+		block := make([][]int64, channels)
+		for ch := range block {
+			block[ch] = samples[ch][start:end]
+		}
+		subBits := make([]int, channels)
+		for ch := range subBits {
+			subBits[ch] = enc.bps
+		}
+		if channels == 2 {
+			left, right := block[0], block[1]
+			side := make([]int64, len(left))
+			for i := range side {
+				side[i] = left[i] - right[i]
+			}
+			switch enc.assignment {
+			case 8:
+				block[1], subBits[1] = side, enc.bps+1
+			case 9:
+				block[0], subBits[0] = side, enc.bps+1
+			case 10:
+				mid := make([]int64, len(left))
+				for i := range mid {
+					mid[i] = (left[i] + right[i]) >> 1
+				}
+				block[0], block[1], subBits[1] = mid, side, enc.bps+1
+			}
+		}
+		for ch := range block {
+			writeSubframe(&frames, block[ch], subBits[ch], enc.subframe)
+		}
+
+		frames.align()
+		frames.write(uint64(crc(frames.buf[frameStart:], 0x8005, 16)), 16)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("fLaC")
+	info := make([]byte, 34)
+	binary.BigEndian.PutUint16(info[0:2], uint16(enc.blockSize))
+	binary.BigEndian.PutUint16(info[2:4], uint16(enc.blockSize))
+	binary.BigEndian.PutUint64(info[10:18], uint64(sampleRate)<<44|uint64(channels-1)<<41|uint64(enc.bps-1)<<36|uint64(total))
+	last := byte(0x80)
+	if enc.seekTable {
+		last = 0
+	}
+	out.Write([]byte{last | flacBlockStreamInfo, 0, 0, 34})
+	out.Write(info)
+	if enc.seekTable {
+		length := 18 * len(offsets)
+		out.Write([]byte{0x80 | flacBlockSeekTable, byte(length >> 16), byte(length >> 8), byte(length)})
+		for i, offset := range offsets {
+			point := make([]byte, 18)
+			binary.BigEndian.PutUint64(point[0:8], uint64(i*enc.blockSize))
+			binary.BigEndian.PutUint64(point[8:16], uint64(offset))
+			out.Write(point)
+		}
+	}
+	out.Write(frames.buf)
+	return out.Bytes(), offsets
+}
+
+// writeSubframe encodes one channel of a frame
+// Blocks the kind cannot hold, such as a constant block that varies, are verbatim
+func writeSubframe(w *bitWriter, samples []int64, bps, kind int) {
+	constant := true
+	for _, v := range samples {
+		constant = constant && v == samples[0]
+	}
+	if kind == subConstant && !constant || (kind == subFixed || kind == subLPC) && len(samples) <= 2 {
+		kind = subVerbatim
+	}
+
+	switch kind {
+	case subVerbatim:
+		w.write(1<<1, 8)
+		for _, v := range samples {
+			w.writeSigned(v, bps)
+		}
+	case subConstant:
+		w.write(0, 8)
+		w.writeSigned(samples[0], bps)
+	case subFixed, subLPC:
+		// Second order prediction: 2*x[n-1] - x[n-2]
+		if kind == subFixed {
+			w.write((8|2)<<1, 8)
+		} else {
+			w.write((32|1)<<1, 8)
+		}
+		w.writeSigned(samples[0], bps)
+		w.writeSigned(samples[1], bps)
+		if kind == subLPC {
+			w.write(14, 4)      // 15-bit coefficients
+			w.writeSigned(2, 5) // Shift
+			w.writeSigned(8, 15)
+			w.writeSigned(-4, 15)
+		}
+		residuals := make([]uint64, 0, len(samples))
+		var sum uint64
+		for i := 2; i < len(samples); i++ {
+			r := samples[i] - (2*samples[i-1] - samples[i-2])
+			z := uint64(r<<1) ^ uint64(r>>63) // Zigzag
+			residuals = append(residuals, z)
+			sum += z
+		}
+		param := uint(0)
+		for mean := sum / uint64(len(residuals)); mean > 1 && param < 30; mean >>= 1 {
+			param++
+		}
+		w.write(1, 2) // 5-bit Rice parameters
+		w.write(0, 4) // One partition
+		w.write(uint64(param), 5)
+		for _, z := range residuals {
+			w.writeUnary(z >> param)
+			w.write(z&(1<<param-1), param)
+		}
+	}
+}
+
+// testSignal returns channels of bps-bit audio mixing a tone with noise
+func testSignal(channels, length, bps int, seed int64) [][]int64 {
+	rng := rand.New(rand.NewSource(seed))
+	peak := float64(int64(1)<<(bps-1) - 1)
+	samples := make([][]int64, channels)
+	for ch := range samples {
+		samples[ch] = make([]int64, length)
+		for i := range samples[ch] {
+			tone := math.Sin(float64(i)*0.05*float64(ch+1)) * 0.7
+			noise := (rng.Float64()*2 - 1) * 0.05
+			samples[ch][i] = int64((tone + noise) * peak)
+		}
+	}
+	return samples
+}
+
+// referencePCM interleaves samples as little-endian PCM of their container size
+// 8-bit PCM is unsigned
+func referencePCM(samples [][]int64, bps int, from int) []byte {
+	width := containerBits(bps) / 8
+	var out []byte
+	for i := from; i < len(samples[0]); i++ {
+		for ch := range samples {
+			v := uint64(samples[ch][i]) << (width*8 - bps)
+			if width == 1 {
+				v ^= 0x80
+			}
+			for b := 0; b < width; b++ {
+				out = append(out, byte(v>>(8*b)))
+			}
+		}
+	}
+	return out
+}
+
+// writeTestFile writes data to a file in a temporary directory
+func writeTestFile(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.flac")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFLACCRCTables(t *testing.T) {
+	check := []byte("123456789")
+	var c8 uint8
+	var c16 uint16
+	for _, b := range check {
+		c8 = crc8Table[c8^b]
+		c16 = c16<<8 ^ crc16Table[byte(c16>>8)^b]
+	}
+	if c8 != 0xF4 {
+		t.Errorf("CRC-8 of %q = %#x, want 0xf4", check, c8)
+	}
+	if c16 != 0xFEE8 {
+		t.Errorf("CRC-16 of %q = %#x, want 0xfee8", check, c16)
+	}
+}
+
+func TestFLACDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		channels int
+		enc      flacEncoding
+	}{
+		{"mono verbatim 16-bit", 1, flacEncoding{bps: 16, blockSize: 1024, subframe: subVerbatim}},
+		{"mono fixed 8-bit", 1, flacEncoding{bps: 8, blockSize: 576, subframe: subFixed}},
+		{"stereo fixed 16-bit", 2, flacEncoding{bps: 16, blockSize: 1152, subframe: subFixed}},
+		{"stereo LPC 24-bit", 2, flacEncoding{bps: 24, blockSize: 4096, subframe: subLPC}},
+		{"left/side 16-bit", 2, flacEncoding{bps: 16, blockSize: 1000, assignment: 8, subframe: subFixed}},
+		{"side/right 24-bit", 2, flacEncoding{bps: 24, blockSize: 1000, assignment: 9, subframe: subFixed}},
+		{"mid/side 24-bit", 2, flacEncoding{bps: 24, blockSize: 1000, assignment: 10, subframe: subLPC}},
+		{"mid/side 12-bit verbatim", 2, flacEncoding{bps: 12, blockSize: 333, assignment: 10, subframe: subVerbatim}},
+		{"6 channels 24-bit", 6, flacEncoding{bps: 24, blockSize: 2048, subframe: subFixed}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples := testSignal(tt.channels, 10000, tt.enc.bps, 1)
+			data, _ := testFLAC(t, samples, 44100, tt.enc)
+
+			r, err := OpenFLAC(writeTestFile(t, data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			format := r.Format()
+			if format.SampleRate != 44100 || format.Channels != tt.channels || format.BitsPerSample != containerBits(tt.enc.bps) {
+				t.Errorf("format = %v", format)
+			}
+			if r.TotalSamples() != 10000 {
+				t.Errorf("TotalSamples() = %d, want 10000", r.TotalSamples())
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := referencePCM(samples, tt.enc.bps, 0); !bytes.Equal(got, want) {
+				t.Errorf("decoded %d bytes that differ from the %d of the reference", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestFLACDecodeConstant(t *testing.T) {
+	samples := [][]int64{make([]int64, 3000), make([]int64, 3000)}
+	for i := range samples[0] {
+		samples[0][i], samples[1][i] = -1234, 5678
+	}
+	data, _ := testFLAC(t, samples, 48000, flacEncoding{bps: 16, blockSize: 1024, subframe: subConstant})
+
+	r, err := OpenFLAC(writeTestFile(t, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, referencePCM(samples, 16, 0)) {
+		t.Error("decoded PCM differs from the reference")
+	}
+}
+
+// The side channel of 32-bit audio needs 33 bits
+func TestFLACDecode32BitSide(t *testing.T) {
+	samples := [][]int64{make([]int64, 512), make([]int64, 512)}
+	for i := range samples[0] {
+		if i%2 == 0 {
+			samples[0][i], samples[1][i] = math.MaxInt32, math.MinInt32
+		} else {
+			samples[0][i], samples[1][i] = math.MinInt32, math.MaxInt32
+		}
+	}
+
+	for _, assignment := range []int{8, 9, 10} {
+		data, _ := testFLAC(t, samples, 192000, flacEncoding{bps: 32, blockSize: 256, assignment: assignment, subframe: subVerbatim})
+		r, err := OpenFLAC(writeTestFile(t, data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("assignment %d: %v", assignment, err)
+		}
+		if !bytes.Equal(got, referencePCM(samples, 32, 0)) {
+			t.Errorf("assignment %d: decoded PCM differs from the reference", assignment)
+		}
+	}
+}
+
+func TestFLACSeekSample(t *testing.T) {
+	samples := testSignal(2, 20000, 24, 2)
+	for _, seekTable := range []bool{false, true} {
+		data, _ := testFLAC(t, samples, 96000, flacEncoding{bps: 24, blockSize: 1024, assignment: 10, subframe: subFixed, seekTable: seekTable})
+		path := writeTestFile(t, data)
+
+		for _, sample := range []uint64{0, 1, 1023, 1024, 1025, 9999, 19999, 20000} {
+			r, err := OpenFLAC(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.SeekSample(sample); err != nil {
+				t.Fatalf("SeekSample(%d): %v", sample, err)
+			}
+			got, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatalf("reading after SeekSample(%d): %v", sample, err)
+			}
+			if want := referencePCM(samples, 24, int(sample)); !bytes.Equal(got, want) {
+				t.Errorf("seek table %v: after SeekSample(%d) got %d bytes that differ from the %d expected", seekTable, sample, len(got), len(want))
+			}
+		}
+	}
+}
+
+func TestFLACCRCMismatch(t *testing.T) {
+	samples := testSignal(2, 4096, 16, 3)
+	data, offsets := testFLAC(t, samples, 44100, flacEncoding{bps: 16, blockSize: 1024, subframe: subFixed})
+	firstFrame := 4 + 4 + 34 // After the marker and STREAMINFO
+
+	tests := []struct {
+		name   string
+		offset int // Byte flipped, from the first frame
+		want   string
+	}{
+		{"header", offsets[1] + 4, "header CRC"},
+		{"subframe", offsets[2] + 20, "frame CRC"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			corrupt := append([]byte(nil), data...)
+			corrupt[firstFrame+tt.offset] ^= 0x01
+
+			r, err := OpenFLAC(writeTestFile(t, corrupt))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			_, err = io.ReadAll(r)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want a %s mismatch", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeStreamAt(t *testing.T) {
+	samples := testSignal(2, 48000, 16, 4)
+	data, _ := testFLAC(t, samples, 48000, flacEncoding{bps: 16, blockSize: 4096, assignment: 8, subframe: subLPC, seekTable: true})
+	path := writeTestFile(t, data)
+
+	stream, err := DecodeStreamAt(path, FormatLimits{}, 0.25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wav := stream.WAV()
+	defer wav.Close()
+
+	info, err := ReadWAVStreamInfo(wav)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := referencePCM(samples, 16, 12000)
+	if info.DataSize != int64(len(want)) {
+		t.Errorf("data size = %d, want %d", info.DataSize, len(want))
+	}
+	got, err := io.ReadAll(wav)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("PCM from 0.25 seconds differs from the reference")
+	}
+
+	if _, err := DecodeStreamAt(writeTestFile(t, []byte("RIFF")), FormatLimits{}, 1); err != ErrWholeFileNeeded {
+		t.Errorf("non-FLAC source: err = %v, want ErrWholeFileNeeded", err)
+	}
+}
@@ -0,0 +1,199 @@
+package decoder
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FormatLimits constrains the format tracks are decoded to
+// Zero values leave that part of the native format alone
+type FormatLimits struct {
+	MaxSampleRate int       // Highest sample rate in Hz
+	BitDepths     []int     // Sample sizes in bits the output accepts
+	BitDepth      int       // Sample size every track is converted to: 8, 16, 24 or 32 (0 keeps the native one)
+	Channels      int       // Channel count every track is mixed to (0 keeps the native one)
+	MaxChannels   int       // Highest channel count; tracks with more are mixed down to it, e.g. 2 for stereo-only outputs
+	DSD           DSDOutput // What DSF and DFF files become
+	Resample      Resampling
+}
+
+// Resampling is a policy for converting sample rates
+type Resampling struct {
+	Mode       string // ResampleNever, ResampleAlways or "" to resample only rates above the maximum
+	Rate       int    // Rate ResampleAlways converts to
+	SameFamily bool   // ResampleAlways keeps 44.1 and 48 kHz families apart, taking Rate's counterpart in the other family
+	Quality    string // soxr precision: "low", "medium", "high" or "very_high"; "" uses ffmpeg's own resampler
+}
+
+// Resampling modes
+const (
+	ResampleNever  = "never"  // Native rates always, even above the maximum, for bit-perfect output
+	ResampleAlways = "always" // Every track to Resampling.Rate, still within the maximum
+)
+
+// soxrPrecision maps resampler qualities to soxr precision in bits
+var soxrPrecision = map[string]int{
+	"low":       16,
+	"medium":    20,
+	"high":      28,
+	"very_high": 33,
+}
+
+// DSDOutput is what DSD sources are decoded to
+type DSDOutput int
+
+const (
+	DSDToPCM  DSDOutput = iota // PCM converted by ffmpeg
+	DSDToDoP                   // DSD over PCM, for DACs that unpack it; PCM where the limits rule it out
+	DSDNative                  // The DSF or DFF file itself, for outputs that play it
+)
+
+// TargetFormat returns the format native audio is decoded to under the limits
+// The resampling policy picks the rate first. Rates above the maximum are then
+// halved until they fit, staying in the same family (44.1 or 48 kHz
+// multiples), unless the policy never resamples. A forced sample size and
+// channel count replace the native ones, and more channels than the maximum
+// are mixed down to it, into the default layout for the new count; a sample
+// size that is not accepted becomes the largest accepted one below it, or else
+// the smallest accepted one
+func (l FormatLimits) TargetFormat(native *AudioFormat) *AudioFormat {
+	target := *native
+	if containsInt([]int{8, 16, 24, 32}, l.BitDepth) {
+		target.BitsPerSample = l.BitDepth
+	}
+	if l.Channels > 0 {
+		target.Channels = l.Channels
+	}
+	if l.MaxChannels > 0 && target.Channels > l.MaxChannels {
+		target.Channels = l.MaxChannels
+	}
+	if target.Channels != native.Channels {
+		target.ChannelMask = 0
+	}
+
+	if l.Resample.Mode == ResampleAlways && l.Resample.Rate > 0 {
+		target.SampleRate = l.Resample.rateFor(native.SampleRate)
+	}
+
+	if l.MaxSampleRate > 0 && l.Resample.Mode != ResampleNever {
+		for target.SampleRate > l.MaxSampleRate && target.SampleRate%2 == 0 {
+			target.SampleRate /= 2
+		}
+		if target.SampleRate > l.MaxSampleRate {
+			target.SampleRate = l.MaxSampleRate
+		}
+	}
+
+	if len(l.BitDepths) > 0 && !containsInt(l.BitDepths, target.BitsPerSample) {
+		below, smallest := 0, 0
+		for _, bits := range l.BitDepths {
+			if bits < target.BitsPerSample && bits > below {
+				below = bits
+			}
+			if smallest == 0 || bits < smallest {
+				smallest = bits
+			}
+		}
+		if below > 0 {
+			target.BitsPerSample = below
+		} else {
+			target.BitsPerSample = smallest
+		}
+	}
+
+	return &target
+}
+
+// String describes the limits as space-separated settings, leaving out those
+// that are unset, e.g. "max_rate=192000 bit_depths=16,24 dsd=dop resample=auto"
+func (l FormatLimits) String() string {
+	var parts []string
+	if l.MaxSampleRate > 0 {
+		parts = append(parts, fmt.Sprintf("max_rate=%d", l.MaxSampleRate))
+	}
+	if len(l.BitDepths) > 0 {
+		depths := make([]string, len(l.BitDepths))
+		for i, bits := range l.BitDepths {
+			depths[i] = strconv.Itoa(bits)
+		}
+		parts = append(parts, "bit_depths="+strings.Join(depths, ","))
+	}
+	if l.BitDepth > 0 {
+		parts = append(parts, fmt.Sprintf("bit_depth=%d", l.BitDepth))
+	}
+	if l.Channels > 0 {
+		parts = append(parts, fmt.Sprintf("channels=%d", l.Channels))
+	}
+	if l.MaxChannels > 0 {
+		parts = append(parts, fmt.Sprintf("max_channels=%d", l.MaxChannels))
+	}
+	parts = append(parts, "dsd="+[]string{"pcm", "dop", "native"}[l.DSD])
+
+	mode := l.Resample.Mode
+	if mode == "" {
+		mode = "auto"
+	}
+	resample := "resample=" + mode
+	if l.Resample.Mode == ResampleAlways {
+		resample += fmt.Sprintf(":%d", l.Resample.Rate)
+		if l.Resample.SameFamily {
+			resample += ":same_family"
+		}
+	}
+	if l.Resample.Quality != "" {
+		resample += ":" + l.Resample.Quality
+	}
+	return strings.Join(append(parts, resample), " ")
+}
+
+// keepsChannels reports whether audio with a channel count is played with
+// those channels under the limits
+func (l FormatLimits) keepsChannels(channels int) bool {
+	return (l.Channels == 0 || l.Channels == channels) && (l.MaxChannels == 0 || channels <= l.MaxChannels)
+}
+
+// rateFor returns the rate ResampleAlways converts a native rate to
+func (r Resampling) rateFor(native int) int {
+	if !r.SameFamily {
+		return r.Rate
+	}
+	switch {
+	case r.Rate%44100 == 0 && native%48000 == 0 && native%44100 != 0:
+		return r.Rate / 44100 * 48000
+	case r.Rate%48000 == 0 && native%44100 == 0 && native%48000 != 0:
+		return r.Rate / 48000 * 44100
+	}
+	return r.Rate
+}
+
+// filter returns the ffmpeg audio filter resampling at the policy's quality, "" for ffmpeg's default
+func (r Resampling) filter() string {
+	precision, ok := soxrPrecision[r.Quality]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("aresample=resampler=soxr:precision=%d", precision)
+}
+
+// containsInt reports whether values holds v
+func containsInt(values []int, v int) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// rawFormat returns the ffmpeg raw PCM muxer for a sample size
+func rawFormat(bits int) string {
+	switch bits {
+	case 8:
+		return "u8"
+	case 16, 24, 32:
+		return fmt.Sprintf("s%dle", bits)
+	default:
+		return "s24le"
+	}
+}
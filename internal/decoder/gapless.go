@@ -0,0 +1,285 @@
+package decoder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// errNoGapless is returned by ReadGapless for files that carry no gapless information
+var errNoGapless = errors.New("no gapless information")
+
+// mp3DecoderDelay is the delay of the MP3 synthesis filterbank in samples, which
+// the LAME tag leaves out of the encoder delay it reports
+const mp3DecoderDelay = 529
+
+// Gapless is the silence a lossy encoder added around the audio: Delay samples
+// before it and Padding after, per channel at the file's own rate
+type Gapless struct {
+	Delay   int64
+	Padding int64
+}
+
+// ReadGapless reads the gapless information of an MP3 file's LAME tag or an
+// MP4 (AAC) file's iTunSMPB tag
+// The delay includes the decoder's own, so trimming it from the decoded audio
+// leaves exactly what was encoded
+func ReadGapless(path string) (*Gapless, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return nil, errNoGapless
+	}
+	if string(magic[4:8]) == "ftyp" {
+		return readITunSMPB(f, stat.Size())
+	}
+	return readLAMETag(f)
+}
+
+// readLAMETag reads the encoder delay and padding from the LAME extension of
+// the Xing or Info header in an MP3 file's first frame
+func readLAMETag(f *os.File) (*Gapless, error) {
+	// Skip an ID3v2 tag, whose size is stored in 7-bit bytes
+	offset := int64(0)
+	header := make([]byte, 10)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return nil, errNoGapless
+	}
+	if string(header[0:3]) == "ID3" {
+		offset = 10 + (int64(header[6])<<21 | int64(header[7])<<14 | int64(header[8])<<7 | int64(header[9]))
+		if header[5]&0x10 != 0 {
+			offset += 10 // Footer
+		}
+	}
+
+	// The first frame follows the tag, perhaps after some padding
+	search := make([]byte, 4096)
+	n, _ := f.ReadAt(search, offset)
+	search = search[:n]
+	start := -1
+	for i := 0; i+1 < len(search); i++ {
+		if search[i] == 0xFF && search[i+1]&0xE6 == 0xE2 { // Frame sync, Layer III
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil, errNoGapless
+	}
+
+	frame := make([]byte, 4+32+120+24)
+	if _, err := f.ReadAt(frame, offset+int64(start)); err != nil {
+		return nil, errNoGapless
+	}
+
+	// The Xing header follows the side information, whose size depends on
+	// the MPEG version and whether the frame is mono
+	mpeg1 := frame[1]&0x18 == 0x18
+	mono := frame[3]&0xC0 == 0xC0
+	side := 32
+	switch {
+	case mpeg1 && mono:
+		side = 17
+	case !mpeg1 && mono:
+		side = 9
+	case !mpeg1:
+		side = 17
+	}
+
+	xing := frame[4+side:]
+	if tag := string(xing[0:4]); tag != "Xing" && tag != "Info" {
+		return nil, errNoGapless
+	}
+	flags := binary.BigEndian.Uint32(xing[4:8])
+	pos := 8
+	for _, field := range []struct {
+		flag uint32
+		size int
+	}{{1, 4}, {2, 4}, {4, 100}, {8, 4}} { // Frames, bytes, seek table, quality
+		if flags&field.flag != 0 {
+			pos += field.size
+		}
+	}
+
+	lame := xing[pos:]
+	if len(lame) < 24 {
+		return nil, errNoGapless
+	}
+	switch string(lame[0:4]) {
+	case "LAME", "Lavf", "Lavc":
+	default:
+		return nil, errNoGapless
+	}
+	delay := int64(lame[21])<<4 | int64(lame[22])>>4
+	padding := int64(lame[22]&0x0F)<<8 | int64(lame[23])
+	if delay == 0 && padding == 0 {
+		return nil, errNoGapless
+	}
+
+	gapless := &Gapless{Delay: delay + mp3DecoderDelay, Padding: padding - mp3DecoderDelay}
+	if gapless.Padding < 0 {
+		gapless.Padding = 0
+	}
+	return gapless, nil
+}
+
+// readITunSMPB reads the iTunSMPB tag of an MP4 file from the freeform
+// ("----") atoms of moov/udta/meta/ilst
+// Its value is hexadecimal fields, the second and third being delay and padding
+func readITunSMPB(f *os.File, size int64) (*Gapless, error) {
+	start, end := int64(0), size
+	for _, path := range []string{"moov", "udta", "meta", "ilst"} {
+		var ok bool
+		if start, end, ok = findAtom(f, start, end, path); !ok {
+			return nil, errNoGapless
+		}
+		if path == "meta" {
+			start += 4 // Version and flags
+		}
+	}
+
+	for start < end {
+		atomStart, atomEnd, ok := findAtom(f, start, end, "----")
+		if !ok {
+			break
+		}
+		start = atomEnd
+
+		body := make([]byte, atomEnd-atomStart)
+		if _, err := f.ReadAt(body, atomStart); err != nil {
+			return nil, errNoGapless
+		}
+		name, value := freeformAtom(body)
+		if name != "iTunSMPB" {
+			continue
+		}
+
+		fields := strings.Fields(value)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("invalid iTunSMPB tag")
+		}
+		delay, err1 := strconv.ParseInt(fields[1], 16, 64)
+		padding, err2 := strconv.ParseInt(fields[2], 16, 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid iTunSMPB tag")
+		}
+		if delay == 0 && padding == 0 {
+			return nil, errNoGapless
+		}
+		return &Gapless{Delay: delay, Padding: padding}, nil
+	}
+	return nil, errNoGapless
+}
+
+// findAtom returns the body of the first atom of a type between start and end
+func findAtom(f *os.File, start, end int64, kind string) (int64, int64, bool) {
+	header := make([]byte, 16)
+	for start+8 <= end {
+		if _, err := f.ReadAt(header[:8], start); err != nil {
+			return 0, 0, false
+		}
+		size := int64(binary.BigEndian.Uint32(header[0:4]))
+		body := start + 8
+		switch size {
+		case 0: // Runs to the end
+			size = end - start
+		case 1: // 64-bit size follows the type
+			if _, err := f.ReadAt(header[8:16], start+8); err != nil {
+				return 0, 0, false
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			body += 8
+		}
+		if size < body-start || start+size > end {
+			return 0, 0, false
+		}
+		if string(header[4:8]) == kind {
+			return body, start + size, true
+		}
+		start += size
+	}
+	return 0, 0, false
+}
+
+// freeformAtom returns the name and text value of a "----" atom's body, made
+// of "mean", "name" and "data" atoms
+func freeformAtom(body []byte) (string, string) {
+	var name, value string
+	for len(body) >= 8 {
+		size := int(binary.BigEndian.Uint32(body[0:4]))
+		if size < 8 || size > len(body) {
+			break
+		}
+		switch string(body[4:8]) {
+		case "name":
+			if size >= 12 {
+				name = string(body[12:size])
+			}
+		case "data":
+			if size >= 16 {
+				value = string(bytes.TrimRight(body[16:size], "\x00"))
+			}
+		}
+		body = body[size:]
+	}
+	return name, value
+}
+
+// gaplessTrimmer drops the encoder delay from the start of decoded PCM and
+// holds back the padding until the end, where it is dropped too
+type gaplessTrimmer struct {
+	r       io.Reader
+	skip    int64  // Bytes still to drop from the start
+	hold    int    // Bytes kept back for the padding
+	pending []byte // PCM read but not yet returned, ending with the bytes held back
+	err     error
+}
+
+// newGaplessTrimmer trims delay and padding, in bytes, from r
+func newGaplessTrimmer(r io.Reader, delay, padding int64) *gaplessTrimmer {
+	return &gaplessTrimmer{r: r, skip: delay, hold: int(padding)}
+}
+
+// Read returns PCM that is neither delay nor, as far as can be told yet, padding
+func (t *gaplessTrimmer) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if t.skip > 0 {
+		n, err := io.CopyN(io.Discard, t.r, t.skip)
+		t.skip -= n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for len(t.pending) <= t.hold {
+		if t.err != nil {
+			return 0, t.err
+		}
+		buf := make([]byte, len(p)+t.hold)
+		n, err := t.r.Read(buf[len(t.pending):])
+		copy(buf, t.pending)
+		t.pending = buf[:len(t.pending)+n]
+		t.err = err
+	}
+
+	n := copy(p, t.pending[:len(t.pending)-t.hold])
+	t.pending = t.pending[n:]
+	return n, nil
+}
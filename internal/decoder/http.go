@@ -0,0 +1,81 @@
+package decoder
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/famish99/direttampd/internal/config"
+	"github.com/famish99/direttampd/internal/httpclient"
+)
+
+// versionTimeout bounds asking a server whether a URL changed
+const versionTimeout = 10 * time.Second
+
+var (
+	httpMu     sync.RWMutex
+	httpConfig config.HTTPConfig
+	httpClient = &http.Client{Timeout: versionTimeout}
+)
+
+// ConfigureHTTP sets up the requests decoding makes for URLs, its own and
+// ffmpeg's and ffprobe's, such as those for HLS playlists and their segments,
+// so they carry the headers and credentials of the http config and go
+// through its proxy
+func ConfigureHTTP(cfg config.HTTPConfig) error {
+	client, err := httpclient.New(cfg)
+	if err != nil {
+		return err
+	}
+	client.Timeout = versionTimeout
+
+	httpMu.Lock()
+	defer httpMu.Unlock()
+	httpConfig, httpClient = cfg, client
+	return nil
+}
+
+// currentHTTP returns the config and client set up by ConfigureHTTP
+func currentHTTP() (config.HTTPConfig, *http.Client) {
+	httpMu.RLock()
+	defer httpMu.RUnlock()
+	return httpConfig, httpClient
+}
+
+// isURL reports whether a source is fetched over HTTP
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// inputArgs returns the options ffmpeg and ffprobe take ahead of a source to
+// fetch it as configured, none for local files, which would reject them
+func inputArgs(source string) []string {
+	if !isURL(source) {
+		return nil
+	}
+	cfg, _ := currentHTTP()
+
+	var args []string
+	header := httpclient.Headers(cfg, source)
+	if len(header) > 0 {
+		names := make([]string, 0, len(header))
+		for name := range header {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var lines strings.Builder
+		for _, name := range names {
+			lines.WriteString(name + ": " + header.Get(name) + "\r\n")
+		}
+		args = append(args, "-headers", lines.String())
+	}
+	if cfg.Proxy != "" {
+		args = append(args, "-http_proxy", cfg.Proxy)
+	}
+	if cfg.CAFile != "" {
+		args = append(args, "-ca_file", cfg.CAFile)
+	}
+	return args
+}
@@ -0,0 +1,242 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// errNotPCM is returned by ReadPCMFile for files that are not uncompressed integer PCM
+var errNotPCM = errors.New("not a PCM WAV or AIFF file")
+
+// PCMFile is a WAV or AIFF file of uncompressed integer PCM, whose samples can
+// be used without decoding
+type PCMFile struct {
+	Path      string
+	Format    *AudioFormat // Sample size is that of the stored samples, in whole bytes
+	DataStart int64        // Offset of the samples in the file
+	DataSize  int64        // Length of the samples in bytes
+	bigEndian bool         // Samples are stored most significant byte first (AIFF)
+	signed8   bool         // 8-bit samples are signed (AIFF) rather than unsigned (WAV)
+}
+
+// ReadPCMFile reads the header of a WAV or AIFF (or uncompressed AIFF-C) file
+// Files of another type, or holding compressed or floating point audio, are rejected
+func ReadPCMFile(path string) (*PCMFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, 12)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return nil, errNotPCM
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var pcm *PCMFile
+	switch {
+	case string(magic[0:4]) == "RIFF" && string(magic[8:12]) == "WAVE":
+		pcm, err = readWAVPCM(f, stat.Size())
+	case string(magic[0:4]) == "FORM" && (string(magic[8:12]) == "AIFF" || string(magic[8:12]) == "AIFC"):
+		pcm, err = readAIFFPCM(f, stat.Size(), string(magic[8:12]) == "AIFC")
+	default:
+		return nil, errNotPCM
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	pcm.Path = path
+	return pcm, nil
+}
+
+// readWAVPCM reads the layout of a WAV file, which must hold integer PCM
+func readWAVPCM(f *os.File, fileSize int64) (*PCMFile, error) {
+	info, err := readWAVLayout(f, fileSize)
+	if err != nil {
+		return nil, err
+	}
+	if info.Encoding != wavFormatPCM {
+		return nil, fmt.Errorf("WAV format %#x: %w", info.Encoding, errNotPCM)
+	}
+
+	width := int(info.BlockAlign) / int(info.Channels)
+	if width < 1 || width > 4 || width*int(info.Channels) != int(info.BlockAlign) {
+		return nil, fmt.Errorf("unsupported WAV sample layout")
+	}
+
+	return &PCMFile{
+		Format: &AudioFormat{
+			SampleRate:    int(info.SampleRate),
+			BitsPerSample: width * 8,
+			Channels:      int(info.Channels),
+			ChannelMask:   info.ChannelMask,
+		},
+		DataStart: info.DataStart,
+		DataSize:  info.DataSize - info.DataSize%int64(info.BlockAlign),
+	}, nil
+}
+
+// readAIFFPCM reads the COMM and SSND chunks of an AIFF or AIFF-C file
+func readAIFFPCM(f *os.File, fileSize int64, compressed bool) (*PCMFile, error) {
+	if _, err := f.Seek(12, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	pcm := &PCMFile{bigEndian: true, signed8: true}
+	var frames uint32
+	offset := int64(12)
+	haveComm := false
+
+	for {
+		chunk := make([]byte, 8)
+		if _, err := io.ReadFull(f, chunk); err != nil {
+			return nil, fmt.Errorf("no SSND chunk: %w", err)
+		}
+		id := string(chunk[0:4])
+		size := int64(binary.BigEndian.Uint32(chunk[4:8]))
+		offset += 8
+
+		switch id {
+		case "COMM":
+			body := make([]byte, size)
+			if _, err := io.ReadFull(f, body); err != nil || size < 18 {
+				return nil, fmt.Errorf("truncated COMM chunk")
+			}
+			channels := int(binary.BigEndian.Uint16(body[0:2]))
+			frames = binary.BigEndian.Uint32(body[2:6])
+			bits := int(binary.BigEndian.Uint16(body[6:8]))
+			rate := extendedToFloat(body[8:18])
+
+			if compressed {
+				if size < 22 {
+					return nil, fmt.Errorf("truncated COMM chunk")
+				}
+				switch string(body[18:22]) {
+				case "NONE", "twos":
+				case "sowt":
+					pcm.bigEndian = false
+				default:
+					return nil, fmt.Errorf("AIFF-C compression %q: %w", body[18:22], errNotPCM)
+				}
+			}
+			if channels == 0 || bits < 1 || bits > 32 || rate < 1 || rate != math.Trunc(rate) {
+				return nil, fmt.Errorf("invalid COMM chunk")
+			}
+			pcm.Format = &AudioFormat{SampleRate: int(rate), BitsPerSample: (bits + 7) / 8 * 8, Channels: channels}
+			haveComm = true
+
+		case "SSND":
+			if !haveComm {
+				return nil, fmt.Errorf("SSND chunk before COMM chunk")
+			}
+			header := make([]byte, 8)
+			if _, err := io.ReadFull(f, header); err != nil {
+				return nil, fmt.Errorf("truncated SSND chunk")
+			}
+			skip := int64(binary.BigEndian.Uint32(header[0:4]))
+			blockAlign := int64(pcm.Format.Channels * pcm.Format.BitsPerSample / 8)
+
+			pcm.DataStart = offset + 8 + skip
+			pcm.DataSize = int64(frames) * blockAlign
+			if available := fileSize - pcm.DataStart; pcm.DataSize > available {
+				pcm.DataSize = available - available%blockAlign
+			}
+			return pcm, nil
+		}
+
+		// Chunks are padded to an even length
+		next := offset + size + size%2
+		if _, err := f.Seek(next, io.SeekStart); err != nil {
+			return nil, err
+		}
+		offset = next
+	}
+}
+
+// extendedToFloat converts an 80-bit IEEE 754 extended precision number, as
+// AIFF stores its sample rate
+func extendedToFloat(b []byte) float64 {
+	exponent := int(binary.BigEndian.Uint16(b[0:2]) & 0x7FFF)
+	mantissa := binary.BigEndian.Uint64(b[2:10])
+	if exponent == 0 && mantissa == 0 {
+		return 0
+	}
+	value := math.Ldexp(float64(mantissa), exponent-16383-63)
+	if b[0]&0x80 != 0 {
+		value = -value
+	}
+	return value
+}
+
+// Open returns a reader of the samples as little-endian PCM, as a WAV file holds them
+func (p *PCMFile) Open() (io.ReadCloser, error) {
+	f, err := os.Open(p.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	data := io.NewSectionReader(f, p.DataStart, p.DataSize)
+	width := p.Format.BitsPerSample / 8
+	if p.bigEndian && width > 1 || p.signed8 && width == 1 {
+		return &pcmReader{Reader: &sampleSwapper{r: data, width: width}, f: f}, nil
+	}
+	return &pcmReader{Reader: data, f: f}, nil
+}
+
+// pcmReader reads samples from a file and closes it
+type pcmReader struct {
+	io.Reader
+	f *os.File
+}
+
+// Close closes the file
+func (r *pcmReader) Close() error {
+	return r.f.Close()
+}
+
+// sampleSwapper converts AIFF samples to WAV samples: big-endian ones to
+// little-endian, and signed 8-bit ones to unsigned
+type sampleSwapper struct {
+	r     io.Reader
+	width int
+}
+
+// Read reads whole samples and converts them
+func (s *sampleSwapper) Read(p []byte) (int, error) {
+	size := len(p) - len(p)%s.width
+	if size == 0 {
+		return 0, io.ErrShortBuffer
+	}
+
+	n, err := io.ReadFull(s.r, p[:size])
+	n -= n % s.width
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	if s.width == 1 {
+		for i := 0; i < n; i++ {
+			p[i] ^= 0x80
+		}
+		return n, err
+	}
+	for i := 0; i < n; i += s.width {
+		sample := p[i : i+s.width]
+		for a, b := 0, s.width-1; a < b; a, b = a+1, b-1 {
+			sample[a], sample[b] = sample[b], sample[a]
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,192 @@
+package decoder
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// probeCacheSize bounds how many probe results are kept
+const probeCacheSize = 4096
+
+// probeResult is what one ffprobe run reports about a source
+type probeResult struct {
+	Metadata map[string]string // Format tags with lower-case keys, plus duration and bitrate
+	Format   *AudioFormat      // First audio stream, nil if there is none
+	Codec    string            // Codec of the first audio stream
+}
+
+// probeCache keeps probe results by source and version, so a track is only
+// probed again once it changes
+// Files are versioned by modification time and size, URLs by ETag or Last-Modified
+type probeCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // Most recently used first
+}
+
+// probeEntry is a cached result and its key
+type probeEntry struct {
+	key    string
+	result *probeResult
+}
+
+// probes is the cache shared by everything that probes audio
+var probes = &probeCache{entries: make(map[string]*list.Element), order: list.New()}
+
+// get returns the cached result for key
+func (c *probeCache) get(key string) (*probeResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*probeEntry).result, true
+}
+
+// put stores a result, dropping the least recently used once the cache is full
+func (c *probeCache) put(key string, result *probeResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*probeEntry).result = result
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&probeEntry{key: key, result: result})
+	for c.order.Len() > probeCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*probeEntry).key)
+	}
+}
+
+// probe runs ffprobe on a source once for its tags, duration, bitrate and
+// first audio stream, or returns the result of an earlier run if the source
+// has not changed since
+// Failures are not cached
+func probe(source string) (*probeResult, error) {
+	version, err := sourceVersion(source)
+	if err != nil {
+		return nil, err
+	}
+	key := source + "\x00" + version
+	if result, ok := probes.get(key); ok {
+		return result, nil
+	}
+
+	result, err := runProbe(source)
+	if err != nil {
+		return nil, err
+	}
+	probes.put(key, result)
+	return result, nil
+}
+
+// sourceVersion returns what identifies the current content of a file or URL
+// A URL whose server offers no validator is taken not to change
+func sourceVersion(source string) (string, error) {
+	if isURL(source) {
+		_, client := currentHTTP()
+		resp, err := client.Head(source)
+		if err != nil {
+			return "", nil
+		}
+		resp.Body.Close()
+		if etag := resp.Header.Get("ETag"); etag != "" {
+			return etag, nil
+		}
+		return resp.Header.Get("Last-Modified"), nil
+	}
+
+	stat, err := os.Stat(source)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("file does not exist: %s", source)
+		}
+		return "", fmt.Errorf("cannot access file: %w", err)
+	}
+	return fmt.Sprintf("%d:%d", stat.ModTime().UnixNano(), stat.Size()), nil
+}
+
+// runProbe runs ffprobe on a source
+func runProbe(source string) (*probeResult, error) {
+	args := append([]string{"-v", "error"}, inputArgs(source)...)
+	args = append(args,
+		"-print_format", "json",
+		"-select_streams", "a:0",
+		"-show_entries", "stream=codec_name,sample_rate,channels,channel_layout,bits_per_raw_sample:format=duration,bit_rate:format_tags",
+		source,
+	)
+	cmd := exec.Command(ffprobePath(), args...)
+
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffprobe failed: %w\nstderr: %s", err, stderr.String())
+	}
+
+	var report struct {
+		Streams []struct {
+			CodecName        string `json:"codec_name"`
+			SampleRate       string `json:"sample_rate"`
+			Channels         int    `json:"channels"`
+			ChannelLayout    string `json:"channel_layout"`
+			BitsPerRawSample string `json:"bits_per_raw_sample"`
+		} `json:"streams"`
+		Format struct {
+			Duration string            `json:"duration"`
+			BitRate  string            `json:"bit_rate"`
+			Tags     map[string]string `json:"tags"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		return nil, fmt.Errorf("unexpected ffprobe output: %w", err)
+	}
+
+	result := &probeResult{Metadata: make(map[string]string)}
+	for key, value := range report.Format.Tags {
+		if value = strings.TrimSpace(value); value != "" {
+			result.Metadata[strings.ToLower(key)] = value
+		}
+	}
+	if duration := report.Format.Duration; duration != "" && duration != "N/A" {
+		result.Metadata["duration"] = duration
+	}
+	// Stored in kbit/s, the unit MPD reports
+	if bps, err := strconv.ParseInt(report.Format.BitRate, 10, 64); err == nil && bps > 0 {
+		result.Metadata["bitrate"] = strconv.FormatInt((bps+500)/1000, 10)
+	}
+
+	if len(report.Streams) > 0 {
+		stream := report.Streams[0]
+		result.Codec = stream.CodecName
+		if rate, err := strconv.Atoi(stream.SampleRate); err == nil && stream.Channels > 0 {
+			// bits_per_raw_sample gives the actual bit depth for compressed formats
+			// It is rounded up to whole bytes; the output's bit depth setting, not
+			// this, decides whether 24-bit audio goes out in 32-bit samples
+			bitsPerSample := 16 // default to 16-bit if not available
+			if bps, err := strconv.Atoi(stream.BitsPerRawSample); err == nil && bps > 0 {
+				bitsPerSample = (bps + 7) / 8 * 8
+			}
+			result.Format = &AudioFormat{
+				SampleRate:    rate,
+				BitsPerSample: bitsPerSample,
+				Channels:      stream.Channels,
+				ChannelMask:   normalChannelMask(stream.Channels, channelLayouts[stream.ChannelLayout]),
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,462 @@
+package decoder
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// PCMStream is audio decoded to raw little-endian PCM, read while it is produced
+type PCMStream struct {
+	Format *AudioFormat
+	Frames int64 // Length in sample frames, 0 if not known
+	r      io.Reader
+	close  func() error
+}
+
+// Progress receives the fraction of a decode done so far, from 0 to 1
+type Progress func(done float64)
+
+// DecodeStream starts decoding audio to PCM in its native format, resampled or
+// requantized only as far as needed to fit limits
+// WAV and AIFF files of PCM the limits allow are passed through untouched,
+// FLAC files that need no resampling or mixing are decoded in-process (see FLACReader),
+// DSD is packed as DoP if the limits ask for it, and everything else is
+// decoded by ffmpeg. The samples can be read before decoding finishes; Close
+// waits for the decoder. Cancelling ctx stops ffmpeg
+func DecodeStream(ctx context.Context, source string, limits FormatLimits) (*PCMStream, error) {
+	if limits.DSD == DSDToDoP {
+		if dsd, err := ReadDSDFile(source); err == nil {
+			if format := dopFormat(dsd, limits); format != nil {
+				samples, err := dsd.Open()
+				if err != nil {
+					return nil, err
+				}
+				dop := newDOPEncoder(samples, dsd.Channels, format.BitsPerSample)
+				frames := int64(dsd.Duration() * float64(format.SampleRate))
+				return &PCMStream{Format: format, Frames: frames, r: dop, close: samples.Close}, nil
+			}
+		}
+	}
+
+	if pcm, err := ReadPCMFile(source); err == nil && *limits.TargetFormat(pcm.Format) == *pcm.Format {
+		samples, err := pcm.Open()
+		if err != nil {
+			return nil, err
+		}
+		frames := pcm.DataSize / int64(pcm.Format.Channels*pcm.Format.BitsPerSample/8)
+		return &PCMStream{Format: pcm.Format, Frames: frames, r: samples, close: samples.Close}, nil
+	}
+
+	if flac, err := OpenFLAC(source); err == nil {
+		target := limits.TargetFormat(flac.Format())
+		if target.SampleRate == flac.Format().SampleRate && target.Channels == flac.Format().Channels {
+			flac.SetBitsPerSample(target.BitsPerSample)
+			return &PCMStream{Format: target, Frames: int64(flac.TotalSamples()), r: flac, close: flac.Close}, nil
+		}
+		flac.Close()
+	}
+	return decodeFFmpegStream(ctx, source, limits)
+}
+
+// DecodeStreamAt starts decoding audio like DecodeStream, seconds into it
+// Only FLAC that needs no resampling or mixing starts there without decoding
+// what comes before, seeking through its seek table to the exact sample;
+// anything else returns ErrWholeFileNeeded, to be decoded whole and trimmed
+func DecodeStreamAt(source string, limits FormatLimits, seconds float64) (*PCMStream, error) {
+	flac, err := OpenFLAC(source)
+	if err != nil {
+		return nil, ErrWholeFileNeeded
+	}
+	target := limits.TargetFormat(flac.Format())
+	if target.SampleRate != flac.Format().SampleRate || target.Channels != flac.Format().Channels {
+		flac.Close()
+		return nil, ErrWholeFileNeeded
+	}
+	flac.SetBitsPerSample(target.BitsPerSample)
+
+	sample := uint64(0)
+	if seconds > 0 {
+		sample = uint64(seconds * float64(target.SampleRate))
+	}
+	if err := flac.SeekSample(sample); err != nil {
+		flac.Close()
+		return nil, fmt.Errorf("failed to seek %s: %w", source, err)
+	}
+	var frames int64
+	if total := flac.TotalSamples(); total > sample {
+		frames = int64(total - sample)
+	}
+	return &PCMStream{Format: target, Frames: frames, r: flac, close: flac.Close}, nil
+}
+
+// decodeFFmpegStream starts ffmpeg decoding audio to PCM on a pipe
+func decodeFFmpegStream(ctx context.Context, source string, limits FormatLimits) (*PCMStream, error) {
+	result, err := probe(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to probe audio format: %w", err)
+	}
+	if result.Format == nil {
+		return nil, fmt.Errorf("failed to probe audio format: no audio stream in %s", source)
+	}
+	nativeFormat := result.Format
+	target := limits.TargetFormat(nativeFormat)
+
+	// ffmpeg decodes DSD at an eighth of its rate, which is brought down to DXD
+	if dsd, err := ReadDSDFile(source); err == nil {
+		target = limits.TargetFormat(dsd.PCMFormat())
+	}
+
+	// Encoder delay and padding are trimmed here rather than by ffmpeg, which
+	// does so for some formats only, so it is told to leave them
+	gapless, _ := ReadGapless(source)
+
+	args := []string{"-v", "error"}
+	if gapless != nil {
+		args = append(args, "-flags2", "+skip_manual")
+	}
+	args = append(args, inputArgs(source)...)
+	args = append(args, "-i", source, "-map", "0:a:0")
+	if target.Channels != nativeFormat.Channels {
+		args = append(args, "-ac", strconv.Itoa(target.Channels))
+	}
+	if target.SampleRate != nativeFormat.SampleRate {
+		if filter := limits.Resample.filter(); filter != "" {
+			args = append(args, "-af", filter)
+		}
+		args = append(args, "-ar", strconv.Itoa(target.SampleRate))
+	}
+	args = append(args, "-f", rawFormat(target.BitsPerSample), "-")
+
+	cmd := exec.CommandContext(ctx, ffmpegPath(), args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	var r io.Reader = stdout
+	if gapless != nil {
+		// Samples counted at the source's rate are scaled to the output's
+		frame := int64(target.Channels * target.BitsPerSample / 8)
+		scale := func(samples int64) int64 {
+			return samples * int64(target.SampleRate) / int64(nativeFormat.SampleRate) * frame
+		}
+		r = newGaplessTrimmer(stdout, scale(gapless.Delay), scale(gapless.Padding))
+	}
+
+	// The length is only known from the container's duration
+	var frames int64
+	if duration, err := strconv.ParseFloat(result.Metadata["duration"], 64); err == nil {
+		frames = int64(duration * float64(target.SampleRate))
+	}
+
+	return &PCMStream{
+		Format: target,
+		Frames: frames,
+		r:      r,
+		close: func() error {
+			stdout.Close()
+			if err := cmd.Wait(); err != nil {
+				return fmt.Errorf("ffmpeg failed: %w\nstderr: %s", err, stderr.String())
+			}
+			return nil
+		},
+	}, nil
+}
+
+// DecodeLiveStream starts ffmpeg decoding audio with no end, such as internet
+// radio, to a WAV stream whose sizes are left unset
+// The audio is lossy, so it is decoded to 16 bits at its own rate and channels
+// unless the limits force otherwise. Close stops the decode and closes source
+func DecodeLiveStream(source io.ReadCloser, limits FormatLimits) (io.ReadCloser, error) {
+	return decodeLive("pipe:0", source, &AudioFormat{BitsPerSample: 16}, limits)
+}
+
+// DecodeLiveURL starts ffmpeg following a stream it reads from the URL itself,
+// such as an HLS playlist or DASH manifest, like DecodeLiveStream
+// Live playlists are reloaded as they grow, so the decode may never end. The
+// format is probed first so lossless streams keep their sample size
+func DecodeLiveURL(url string, limits FormatLimits) (io.ReadCloser, error) {
+	native, err := ProbeFormat(url)
+	if err != nil {
+		native = &AudioFormat{BitsPerSample: 16}
+	}
+	return decodeLive(url, nil, native, limits)
+}
+
+// decodeLive starts ffmpeg decoding input, or source on its stdin, to WAV on a pipe
+// Rate and channels left at 0 in native are kept as ffmpeg finds them
+func decodeLive(input string, source io.ReadCloser, native *AudioFormat, limits FormatLimits) (io.ReadCloser, error) {
+	target := limits.TargetFormat(native)
+
+	args := append([]string{"-v", "error"}, inputArgs(input)...)
+	args = append(args, "-i", input, "-map", "0:a:0")
+	if target.Channels != native.Channels {
+		args = append(args, "-ac", strconv.Itoa(target.Channels))
+	}
+	if target.SampleRate != native.SampleRate {
+		if filter := limits.Resample.filter(); filter != "" {
+			args = append(args, "-af", filter)
+		}
+		args = append(args, "-ar", strconv.Itoa(target.SampleRate))
+	}
+	args = append(args, "-c:a", "pcm_"+rawFormat(target.BitsPerSample), "-f", "wav", "-")
+
+	cmd := exec.Command(ffmpegPath(), args...)
+	if source != nil {
+		cmd.Stdin = source
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	return &liveStream{ReadCloser: stdout, cmd: cmd, source: source}, nil
+}
+
+// liveStream reads ffmpeg's output until it is stopped
+type liveStream struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	source io.Closer
+}
+
+// Close stops ffmpeg and closes its source
+// A live decode never finishes on its own, so how it ended is not reported
+func (l *liveStream) Close() error {
+	l.cmd.Process.Kill()
+	if l.source != nil {
+		l.source.Close()
+	}
+	l.ReadCloser.Close()
+	l.cmd.Wait()
+	return nil
+}
+
+// Read reads decoded PCM
+func (s *PCMStream) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+// Close waits for the decoder to finish and returns its failure, if any
+// Closing before the end of the audio stops the decode
+func (s *PCMStream) Close() error {
+	return s.close()
+}
+
+// WAV returns the stream as a WAV file, read as it is decoded
+// The header carries the length when it is known; closing closes the stream
+func (s *PCMStream) WAV() io.ReadCloser {
+	size := int64(-1)
+	if s.Frames > 0 {
+		size = s.Frames * int64(s.Format.Channels*s.Format.BitsPerSample/8)
+	}
+	header := bytes.NewReader(NewWAVHeader(s.Format, size))
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(header, s), s}
+}
+
+// DecodeToWAVStream decodes audio to a WAV file like DecodeToWAVFileWithLimits
+// and, unless tee is nil, passes the file to tee as it is written
+// tee sees the header with the length unset, as it is not known until the end.
+// Should tee fail, for instance because its reader went away, it is dropped and
+// the file is still finished
+// DSF and DFF files are copied as they are instead when the limits ask for DSD
+// natively and keep their channels, so the output path then holds DSD rather than WAV
+// Cancelling ctx stops the decode and removes the file. Unless progress is nil
+// it is told of each whole percent done, when the length is known
+// Returns the format written.
+func DecodeToWAVStream(ctx context.Context, source string, outputPath string, limits FormatLimits, tee io.Writer, progress Progress) (*AudioFormat, error) {
+	if limits.DSD == DSDNative {
+		if dsd, err := ReadDSDFile(source); err == nil && limits.keepsChannels(dsd.Channels) {
+			if err := copyDSD(ctx, source, outputPath, tee, progress); err != nil {
+				return nil, err
+			}
+			return dsd.Format(), nil
+		}
+	}
+
+	stream, err := DecodeStream(ctx, source, limits)
+	if err != nil {
+		return nil, err
+	}
+	return decodeToWAV(ctx, stream, outputPath, tee, progress)
+}
+
+// ErrWholeFileNeeded is returned by DecodeReaderToWAVStream for sources that
+// cannot be decoded before they are complete
+var ErrWholeFileNeeded = errors.New("decoding needs the whole file")
+
+// DecodeReaderToWAVStream decodes audio read from r, which may still be
+// growing, such as a download in progress, to a WAV file like DecodeToWAVStream
+// Only FLAC that needs no resampling or mixing is decoded this way, in-process
+// as it arrives; anything else returns ErrWholeFileNeeded without creating the
+// file, to be decoded from its path once complete. r is closed either way
+func DecodeReaderToWAVStream(ctx context.Context, r io.ReadSeekCloser, outputPath string, limits FormatLimits, tee io.Writer, progress Progress) (*AudioFormat, error) {
+	flac, err := NewFLACReader(r)
+	if err != nil {
+		r.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, errNotFLAC) {
+			return nil, ErrWholeFileNeeded
+		}
+		return nil, err
+	}
+	target := limits.TargetFormat(flac.Format())
+	if target.SampleRate != flac.Format().SampleRate || target.Channels != flac.Format().Channels {
+		flac.Close()
+		return nil, ErrWholeFileNeeded
+	}
+	flac.SetBitsPerSample(target.BitsPerSample)
+	stream := &PCMStream{Format: target, Frames: int64(flac.TotalSamples()), r: flac, close: flac.Close}
+	return decodeToWAV(ctx, stream, outputPath, tee, progress)
+}
+
+// decodeToWAV writes a decoding stream to a WAV file and closes it, removing
+// the file if the decode fails
+func decodeToWAV(ctx context.Context, stream *PCMStream, outputPath string, tee io.Writer, progress Progress) (*AudioFormat, error) {
+	err := writeWAV(ctx, stream, outputPath, tee, progress)
+	if closeErr := stream.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err() // ffmpeg was killed rather than failing
+	}
+	if err != nil {
+		os.Remove(outputPath)
+		return nil, err
+	}
+	return stream.Format, nil
+}
+
+// writeWAV writes a PCM stream to a WAV file, filling in the sizes at the end
+func writeWAV(ctx context.Context, stream *PCMStream, outputPath string, tee io.Writer, progress Progress) error {
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+
+	w := &teeWriter{file: out, tee: tee}
+	var size int64
+	if _, err = w.Write(NewWAVHeader(stream.Format, -1)); err == nil {
+		total := stream.Frames * int64(stream.Format.Channels*stream.Format.BitsPerSample/8)
+		size, err = copyWithProgress(ctx, w, stream, total, progress)
+	}
+	if err == nil {
+		_, err = out.WriteAt(NewWAVHeader(stream.Format, size), 0)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// copyWithProgress copies r to w until r ends or ctx is cancelled, telling
+// progress of each whole percent of total bytes copied
+// A total of 0 or a nil progress copies without reporting
+func copyWithProgress(ctx context.Context, w io.Writer, r io.Reader, total int64, progress Progress) (int64, error) {
+	buf := make([]byte, 256*1024)
+	var written int64
+	reported := -1
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+			if progress != nil && total > 0 {
+				if percent := int(min(written*100/total, 100)); percent > reported {
+					reported = percent
+					progress(float64(percent) / 100)
+				}
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// teeWriter writes to a file and, until it fails, a second writer
+type teeWriter struct {
+	file io.Writer
+	tee  io.Writer
+}
+
+// Write writes p to the file and passes what was written on to the tee
+func (t *teeWriter) Write(p []byte) (int, error) {
+	n, err := t.file.Write(p)
+	if t.tee != nil && n > 0 {
+		if _, teeErr := t.tee.Write(p[:n]); teeErr != nil {
+			t.tee = nil
+		}
+	}
+	return n, err
+}
+
+// NewWAVHeader returns the header of a WAV file holding dataSize bytes of PCM,
+// ending with the data chunk header
+// A dataSize of -1 leaves the sizes unset, for a file still being written.
+// Like ffmpeg, formats of more than 16 bits or 2 channels, or with a channel
+// layout that is not the default, use WAVE_FORMAT_EXTENSIBLE
+func NewWAVHeader(format *AudioFormat, dataSize int64) []byte {
+	blockAlign := format.Channels * format.BitsPerSample / 8
+	extensible := format.BitsPerSample > 16 || format.Channels > 2 || format.ChannelMask != 0
+
+	fmtChunk := make([]byte, 16, 40)
+	binary.LittleEndian.PutUint16(fmtChunk[0:2], wavFormatPCM)
+	binary.LittleEndian.PutUint16(fmtChunk[2:4], uint16(format.Channels))
+	binary.LittleEndian.PutUint32(fmtChunk[4:8], uint32(format.SampleRate))
+	binary.LittleEndian.PutUint32(fmtChunk[8:12], uint32(format.SampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(fmtChunk[12:14], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(fmtChunk[14:16], uint16(format.BitsPerSample))
+	if extensible {
+		binary.LittleEndian.PutUint16(fmtChunk[0:2], wavFormatExtensible)
+		ext := make([]byte, 24)
+		binary.LittleEndian.PutUint16(ext[0:2], 22)
+		binary.LittleEndian.PutUint16(ext[2:4], uint16(format.BitsPerSample))
+		binary.LittleEndian.PutUint32(ext[4:8], format.channelMask())
+		// KSDATAFORMAT_SUBTYPE_PCM
+		copy(ext[8:], []byte{0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xaa, 0x00, 0x38, 0x9b, 0x71})
+		fmtChunk = append(fmtChunk, ext...)
+	}
+
+	header := make([]byte, 0, 12+8+len(fmtChunk)+8)
+	header = append(header, "RIFF\x00\x00\x00\x00WAVE"...)
+	header = append(header, "fmt "...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(fmtChunk)))
+	header = append(header, fmtChunk...)
+	header = append(header, "data\x00\x00\x00\x00"...)
+
+	if dataSize < 0 {
+		binary.LittleEndian.PutUint32(header[4:8], streamedDataSize)
+		binary.LittleEndian.PutUint32(header[len(header)-4:], streamedDataSize)
+		return header
+	}
+	return (&WAVInfo{Header: header}).HeaderFor(dataSize)
+}
@@ -0,0 +1,153 @@
+package decoder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// toolTimeout bounds each run of ffmpeg or ffprobe made while detecting them
+const toolTimeout = 10 * time.Second
+
+// Tools describes the ffmpeg and ffprobe binaries decoding relies on
+type Tools struct {
+	FFmpeg         string          // Path ffmpeg is run from
+	FFprobe        string          // Path ffprobe is run from
+	FFmpegVersion  string          // e.g. "6.1.1", empty if ffmpeg was not found
+	FFprobeVersion string          // Empty if ffprobe was not found
+	Decoders       map[string]bool // Audio decoders ffmpeg was built with, nil until detected
+}
+
+var (
+	toolsMu sync.RWMutex
+	tools   = Tools{FFmpeg: "ffmpeg", FFprobe: "ffprobe"}
+)
+
+// DetectTools finds ffmpeg and ffprobe, at the given paths or else in PATH,
+// and reads their versions and ffmpeg's audio decoders
+// Decoding uses what was found from then on. If either binary is missing or
+// does not run, the error says which; the other one's details are still kept
+func DetectTools(ffmpeg, ffprobe string) (Tools, error) {
+	detected := Tools{FFmpeg: "ffmpeg", FFprobe: "ffprobe"}
+	var errs []error
+
+	if path, version, err := findTool("ffmpeg", ffmpeg); err != nil {
+		errs = append(errs, err)
+	} else {
+		detected.FFmpeg, detected.FFmpegVersion = path, version
+		if detected.Decoders, err = audioDecoders(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if path, version, err := findTool("ffprobe", ffprobe); err != nil {
+		errs = append(errs, err)
+	} else {
+		detected.FFprobe, detected.FFprobeVersion = path, version
+	}
+	if detected.Decoders == nil {
+		detected.Decoders = map[string]bool{}
+	}
+
+	toolsMu.Lock()
+	tools = detected
+	toolsMu.Unlock()
+	return detected, errors.Join(errs...)
+}
+
+// findTool resolves a binary and reads its version from the first line of
+// "-version", which reads e.g. "ffmpeg version 6.1.1 Copyright ..."
+func findTool(name, configured string) (string, string, error) {
+	path := configured
+	if path == "" {
+		path = name
+	}
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		if configured != "" {
+			return "", "", fmt.Errorf("%s not found at %s: %w", name, configured, err)
+		}
+		return "", "", fmt.Errorf("%s not found in PATH; install it or set tools.%s to its location", name, name)
+	}
+
+	out, err := runTool(resolved, "-hide_banner", "-version")
+	if err != nil {
+		return "", "", fmt.Errorf("%s at %s does not run: %w", name, resolved, err)
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[1] != "version" {
+		return "", "", fmt.Errorf("%s at %s does not look like %s: %q", name, resolved, name, line)
+	}
+	return resolved, fields[2], nil
+}
+
+// audioDecoders lists the audio decoders of an ffmpeg binary
+// "-decoders" prints a legend, a "------" rule, then one decoder per line
+// with its flags first; audio decoders' flags start with "A"
+func audioDecoders(ffmpeg string) (map[string]bool, error) {
+	out, err := runTool(ffmpeg, "-hide_banner", "-decoders")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ffmpeg decoders: %w", err)
+	}
+
+	decoders := make(map[string]bool)
+	listed := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			if len(fields) == 1 && strings.HasPrefix(fields[0], "---") {
+				listed = true
+			}
+			continue
+		}
+		if listed && strings.HasPrefix(fields[0], "A") {
+			decoders[fields[1]] = true
+		}
+	}
+	return decoders, nil
+}
+
+// runTool runs a binary with a timeout and returns its output
+func runTool(path string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), toolTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w\nstderr: %s", err, stderr.String())
+	}
+	return out, nil
+}
+
+// CurrentTools returns the binaries decoding uses, as last detected
+func CurrentTools() Tools {
+	toolsMu.RLock()
+	defer toolsMu.RUnlock()
+	return tools
+}
+
+// HasDecoder reports whether ffmpeg can decode a codec, by its decoder name
+// Before DetectTools has run every decoder is assumed to be there
+func HasDecoder(name string) bool {
+	current := CurrentTools()
+	return current.Decoders == nil || current.Decoders[name]
+}
+
+// ffmpegPath returns the ffmpeg binary to run
+func ffmpegPath() string {
+	return CurrentTools().FFmpeg
+}
+
+// ffprobePath returns the ffprobe binary to run
+func ffprobePath() string {
+	return CurrentTools().FFprobe
+}
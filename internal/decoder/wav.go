@@ -0,0 +1,191 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// TrimWAV writes a copy of a WAV file that starts seconds into the source
+// The cut is made on a sample frame boundary in the PCM data, so unlike a
+// filter it is exact and leaves the samples untouched
+func TrimWAV(source string, outputPath string, seconds float64) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	info, err := readWAVLayout(in, stat.Size())
+	if err != nil {
+		return fmt.Errorf("%s: %w", source, err)
+	}
+
+	// Skip whole frames; a position past the end leaves no audio
+	skip := info.FrameOffset(seconds)
+	remaining := info.DataSize - skip
+
+	// Sizes in the header are rewritten for the shorter data chunk
+	header := info.HeaderFor(remaining)
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := out.Write(header); err == nil {
+		_, err = io.Copy(out, io.NewSectionReader(in, info.DataStart+skip, remaining))
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(outputPath)
+		return err
+	}
+	return nil
+}
+
+// WAV format tags
+const (
+	wavFormatPCM        = 1
+	wavFormatExtensible = 0xFFFE
+)
+
+// streamedDataSize is the chunk size a WAV writer leaves while the length is not yet known
+const streamedDataSize = 0xFFFFFFFF
+
+// WAVInfo describes where the PCM data of a WAV file lies and how it is framed
+type WAVInfo struct {
+	Header      []byte // Chunks before the PCM data, ending with the data chunk header
+	SampleRate  uint32
+	Channels    uint16
+	ChannelMask uint32 // Speaker positions from WAVE_FORMAT_EXTENSIBLE, 0 for the default layout of the channel count
+	Encoding    uint16 // Format tag, taken from the subformat of WAVE_FORMAT_EXTENSIBLE (1 is integer PCM)
+	BlockAlign  uint16 // Bytes per sample frame, all channels
+	DataStart   int64  // Offset of the PCM data in the file
+	DataSize    int64  // Length of the PCM data in bytes, -1 while a stream is still being written
+}
+
+// Duration returns the length of the PCM data in seconds
+func (w *WAVInfo) Duration() float64 {
+	return float64(w.DataSize/int64(w.BlockAlign)) / float64(w.SampleRate)
+}
+
+// FrameOffset returns the byte offset into the PCM data of the sample frame at seconds
+// Positions outside the data are clamped to its start or end
+func (w *WAVInfo) FrameOffset(seconds float64) int64 {
+	frames := int64(seconds * float64(w.SampleRate))
+	if frames < 0 {
+		frames = 0
+	}
+	offset := frames * int64(w.BlockAlign)
+	if offset > w.DataSize {
+		offset = w.DataSize
+	}
+	return offset
+}
+
+// HeaderFor returns a copy of the header with the sizes rewritten for dataSize bytes of PCM data
+func (w *WAVInfo) HeaderFor(dataSize int64) []byte {
+	header := append([]byte(nil), w.Header...)
+	binary.LittleEndian.PutUint32(header[4:8], uint32(int64(len(header))-8+dataSize))
+	binary.LittleEndian.PutUint32(header[len(header)-4:], uint32(dataSize))
+	return header
+}
+
+// ReadWAVInfo reads the layout of a WAV file's PCM data
+func ReadWAVInfo(path string) (*WAVInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	info, err := readWAVLayout(f, stat.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return info, nil
+}
+
+// ReadWAVStreamInfo reads the layout of a WAV stream up to its PCM data, which
+// the reader is left at
+// A length left unset by the writer is reported as a DataSize of -1
+func ReadWAVStreamInfo(r io.Reader) (*WAVInfo, error) {
+	return readWAVLayout(r, -1)
+}
+
+// readWAVLayout reads the chunks of a WAV file up to its PCM data
+// fileSize bounds the data of a complete file; it is -1 for a stream
+func readWAVLayout(f io.Reader, fileSize int64) (*WAVInfo, error) {
+	riff := make([]byte, 12)
+	if _, err := io.ReadFull(f, riff); err != nil {
+		return nil, fmt.Errorf("failed to read WAV header: %w", err)
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return nil, fmt.Errorf("not a WAV file")
+	}
+	info := &WAVInfo{Header: riff}
+
+	for {
+		chunk := make([]byte, 8)
+		if _, err := io.ReadFull(f, chunk); err != nil {
+			return nil, fmt.Errorf("no data chunk: %w", err)
+		}
+		id := string(chunk[0:4])
+		size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+		info.Header = append(info.Header, chunk...)
+
+		if id == "data" {
+			if info.BlockAlign == 0 {
+				return nil, fmt.Errorf("data chunk before fmt chunk")
+			}
+			info.DataStart = int64(len(info.Header))
+			// Streamed output may leave the size unset; the data then runs to the end
+			unset := size == 0 || size == streamedDataSize
+			if fileSize < 0 {
+				if unset {
+					size = -1
+				}
+			} else if available := fileSize - info.DataStart; unset || size > available {
+				size = available
+			}
+			info.DataSize = size
+			return info, nil
+		}
+
+		// Chunks are padded to an even length
+		body := make([]byte, size+size%2)
+		if _, err := io.ReadFull(f, body); err != nil {
+			return nil, fmt.Errorf("truncated %q chunk: %w", id, err)
+		}
+		info.Header = append(info.Header, body...)
+
+		if id == "fmt " {
+			if size < 16 {
+				return nil, fmt.Errorf("fmt chunk too short")
+			}
+			info.Encoding = binary.LittleEndian.Uint16(body[0:2])
+			info.Channels = binary.LittleEndian.Uint16(body[2:4])
+			if info.Encoding == wavFormatExtensible && size >= 26 {
+				info.ChannelMask = normalChannelMask(int(info.Channels), binary.LittleEndian.Uint32(body[20:24]))
+				info.Encoding = binary.LittleEndian.Uint16(body[24:26])
+			}
+			info.SampleRate = binary.LittleEndian.Uint32(body[4:8])
+			info.BlockAlign = binary.LittleEndian.Uint16(body[12:14])
+			if info.BlockAlign == 0 || info.SampleRate == 0 || info.Channels == 0 {
+				return nil, fmt.Errorf("invalid fmt chunk")
+			}
+		}
+	}
+}
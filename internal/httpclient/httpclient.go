@@ -0,0 +1,156 @@
+package httpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/famish99/direttampd/internal/config"
+)
+
+// defaultTimeout bounds connecting and waiting for a response when the config sets none
+const defaultTimeout = 30 * time.Second
+
+// New creates the client remote tracks are fetched with, as cfg sets it up
+// The timeout covers connecting and the server starting to respond, not the
+// download itself, which takes as long as the file needs
+func New(cfg config.HTTPConfig) (*http.Client, error) {
+	return NewWithConn(cfg, nil)
+}
+
+// NewWithConn creates a client like New whose connections are passed through
+// wrap, above TLS for https, so it can read what the server sends before
+// net/http does; a nil wrap leaves them as they are
+func NewWithConn(cfg config.HTTPConfig, wrap func(net.Conn) net.Conn) (*http.Client, error) {
+	timeout := defaultTimeout
+	if cfg.TimeoutSeconds > 0 {
+		timeout = time.Duration(cfg.TimeoutSeconds) * time.Second
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = timeout
+	transport.ResponseHeaderTimeout = timeout
+
+	if cfg.Proxy != "" {
+		proxy, err := url.Parse(cfg.Proxy)
+		if err != nil || proxy.Host == "" {
+			return nil, fmt.Errorf("invalid http proxy %q", cfg.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if cfg.CAFile != "" || cfg.InsecureSkipVerify {
+		tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+		if cfg.CAFile != "" {
+			pem, err := os.ReadFile(cfg.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read http ca_file: %w", err)
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in http ca_file %s", cfg.CAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	for _, site := range cfg.Sites {
+		if site.Prefix == "" {
+			return nil, fmt.Errorf("http site without a prefix")
+		}
+	}
+
+	if wrap != nil {
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return wrap(conn), nil
+		}
+		// net/http cannot see the protocol a wrapped connection negotiated, so it must be HTTP/1.1
+		tlsConfig := &tls.Config{}
+		if transport.TLSClientConfig != nil {
+			tlsConfig = transport.TLSClientConfig.Clone()
+		}
+		tlsConfig.NextProtos = []string{"http/1.1"}
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: tlsConfig}
+		transport.ForceAttemptHTTP2 = false
+		transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := tlsDialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return wrap(conn), nil
+		}
+	}
+
+	return &http.Client{Transport: &authTransport{next: transport, cfg: cfg}}, nil
+}
+
+// Headers returns the headers cfg adds to a request for a URL: the user agent,
+// the global headers, and those and the credentials of the site it falls under
+// Tools making their own requests, such as ffmpeg, are passed these
+func Headers(cfg config.HTTPConfig, rawURL string) http.Header {
+	header := make(http.Header)
+	if cfg.UserAgent != "" {
+		header.Set("User-Agent", cfg.UserAgent)
+	}
+	for name, value := range cfg.Headers {
+		header.Set(name, value)
+	}
+	if site := site(cfg, rawURL); site != nil {
+		for name, value := range site.Headers {
+			header.Set(name, value)
+		}
+		switch {
+		case site.BearerToken != "":
+			header.Set("Authorization", "Bearer "+site.BearerToken)
+		case site.Username != "":
+			credentials := base64.StdEncoding.EncodeToString([]byte(site.Username + ":" + site.Password))
+			header.Set("Authorization", "Basic "+credentials)
+		}
+	}
+	return header
+}
+
+// authTransport adds the configured user agent, headers and credentials to
+// each request, those of a site only going to URLs under its prefix, which
+// keeps them from following a redirect to another server
+type authTransport struct {
+	next http.RoundTripper
+	cfg  config.HTTPConfig
+}
+
+// RoundTrip sends a copy of the request with the configured additions
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, values := range Headers(t.cfg, req.URL.String()) {
+		req.Header[name] = values
+	}
+	return t.next.RoundTrip(req)
+}
+
+// site returns the first configured site a URL falls under, nil if none
+func site(cfg config.HTTPConfig, rawURL string) *config.HTTPSite {
+	for i := range cfg.Sites {
+		if strings.HasPrefix(rawURL, cfg.Sites[i].Prefix) {
+			return &cfg.Sites[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package icy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/famish99/direttampd/internal/config"
+	"github.com/famish99/direttampd/internal/httpclient"
+)
+
+// ErrNotStream is returned by Open for URLs that are not http(s) or serve an ordinary file
+var ErrNotStream = errors.New("not an internet radio stream")
+
+var (
+	clientMu sync.Mutex
+	client   *http.Client // nil until first used or configured
+)
+
+// Configure sets up the client stations are opened with from the http config,
+// so its proxy, TLS options, headers and credentials apply to radio too
+func Configure(cfg config.HTTPConfig) error {
+	c, err := newClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	client = c
+	return nil
+}
+
+// newClient creates a client that accepts SHOUTcast's "ICY 200 OK" status line
+func newClient(cfg config.HTTPConfig) (*http.Client, error) {
+	return httpclient.NewWithConn(cfg, func(conn net.Conn) net.Conn {
+		return &icyConn{Conn: conn}
+	})
+}
+
+// currentClient returns the client set up by Configure, or one with the
+// defaults, which cannot fail to set up, if it was not called
+func currentClient() *http.Client {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	if client == nil {
+		client, _ = newClient(config.HTTPConfig{})
+	}
+	return client
+}
+
+// Stream is the audio of an Icecast or SHOUTcast station with its in-band
+// metadata taken out
+// Reading never reaches the end while the station is on air
+type Stream struct {
+	Name        string // Station name (icy-name)
+	Genre       string // Station genre (icy-genre)
+	ContentType string // Audio type, e.g. audio/mpeg
+
+	body    io.ReadCloser
+	r       *bufio.Reader
+	metaint int // Audio bytes between metadata blocks, 0 when the station sends none
+	left    int // Audio bytes before the next metadata block
+
+	mu      sync.Mutex
+	title   string
+	onTitle func(title string)
+}
+
+// Open connects to a URL and returns its audio if it is internet radio
+// A response is radio when it carries an icy-metaint or icy-name header;
+// otherwise it is closed and ErrNotStream is returned
+func Open(url string) (*Stream, error) {
+	resp, err := request(url, false)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Stream{
+		Name:        resp.Header.Get("icy-name"),
+		Genre:       resp.Header.Get("icy-genre"),
+		ContentType: resp.Header.Get("Content-Type"),
+		body:        resp.Body,
+		r:           bufio.NewReader(resp.Body),
+	}
+	if metaint, err := strconv.Atoi(resp.Header.Get("icy-metaint")); err == nil && metaint > 0 {
+		s.metaint = metaint
+		s.left = metaint
+	}
+	return s, nil
+}
+
+// Probe tells whether a URL is internet radio like Open, returning the
+// station's name and genre, without reading any audio
+// The request asks for the first byte only, so a file is not downloaded
+// to find out; stations ignore the range and their response is dropped
+func Probe(url string) (name, genre string, err error) {
+	resp, err := request(url, true)
+	if err != nil {
+		return "", "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("icy-name"), resp.Header.Get("icy-genre"), nil
+}
+
+// request asks a URL for its audio with in-band metadata, returning the
+// response of a station and ErrNotStream for anything else
+func request(url string, probe bool) (*http.Response, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, ErrNotStream
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Icy-MetaData", "1")
+	if probe {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+
+	resp, err := currentClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		// Only a file has a range to give
+		resp.Body.Close()
+		return nil, ErrNotStream
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to open stream: HTTP %d", resp.StatusCode)
+	}
+	if !isStream(resp) {
+		resp.Body.Close()
+		return nil, ErrNotStream
+	}
+	return resp, nil
+}
+
+// isStream reports whether a response is a station rather than a file
+// Only stations send icy-metaint, when asked for metadata, or icy-name
+func isStream(resp *http.Response) bool {
+	return resp.Header.Get("icy-metaint") != "" || resp.Header.Get("icy-name") != ""
+}
+
+// OnTitle sets a function called with each new StreamTitle the station sends
+// It runs on the goroutine reading the stream
+func (s *Stream) OnTitle(fn func(title string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onTitle = fn
+}
+
+// Title returns the last StreamTitle the station sent
+func (s *Stream) Title() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.title
+}
+
+// Read reads audio, passing over metadata blocks
+func (s *Stream) Read(p []byte) (int, error) {
+	if s.metaint == 0 {
+		return s.r.Read(p)
+	}
+	if s.left == 0 {
+		if err := s.readMetadata(); err != nil {
+			return 0, err
+		}
+		s.left = s.metaint
+	}
+	if len(p) > s.left {
+		p = p[:s.left]
+	}
+	n, err := s.r.Read(p)
+	s.left -= n
+	return n, err
+}
+
+// readMetadata reads a metadata block: a length byte counting 16-byte units,
+// then that many bytes of fields such as StreamTitle='Artist - Title';
+func (s *Stream) readMetadata() error {
+	length, err := s.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if length == 0 {
+		return nil
+	}
+
+	block := make([]byte, int(length)*16)
+	if _, err := io.ReadFull(s.r, block); err != nil {
+		return fmt.Errorf("truncated stream metadata: %w", err)
+	}
+	title, ok := streamTitle(strings.TrimRight(string(block), "\x00"))
+	if !ok {
+		return nil
+	}
+
+	s.mu.Lock()
+	changed := title != s.title
+	s.title = title
+	onTitle := s.onTitle
+	s.mu.Unlock()
+
+	if changed && onTitle != nil {
+		onTitle(title)
+	}
+	return nil
+}
+
+// streamTitle returns the StreamTitle field of a metadata block
+// Titles may hold quotes themselves, so the value runs to the next "';"
+func streamTitle(metadata string) (string, bool) {
+	const field = "StreamTitle='"
+	start := strings.Index(metadata, field)
+	if start < 0 {
+		return "", false
+	}
+	value := metadata[start+len(field):]
+	if end := strings.Index(value, "';"); end >= 0 {
+		value = value[:end]
+	} else {
+		value = strings.TrimSuffix(value, "'")
+	}
+	return strings.TrimSpace(value), true
+}
+
+// Close disconnects from the station
+func (s *Stream) Close() error {
+	return s.body.Close()
+}
+
+// icyConn rewrites the "ICY" status line of SHOUTcast v1 servers to HTTP/1.0
+// so net/http accepts the response
+type icyConn struct {
+	net.Conn
+	checked bool
+	pending []byte
+}
+
+// Read reads from the connection, replacing an ICY status line's protocol
+func (c *icyConn) Read(p []byte) (int, error) {
+	if !c.checked {
+		c.checked = true
+		head := make([]byte, 4)
+		n, err := io.ReadFull(c.Conn, head)
+		if n == 4 && string(head) == "ICY " {
+			c.pending = []byte("HTTP/1.0 ")
+		} else {
+			c.pending = head[:n]
+		}
+		if err != nil && err != io.ErrUnexpectedEOF && n == 0 {
+			return 0, err
+		}
+	}
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
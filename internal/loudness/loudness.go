@@ -0,0 +1,170 @@
+package loudness
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/famish99/direttampd/internal/decoder"
+)
+
+// maxTruePeak is the ceiling in dBTP that normalization won't push a track past
+const maxTruePeak = -1.0
+
+// Measurement is the cached analysis of one track
+type Measurement struct {
+	Integrated float64 `json:"integrated"` // LUFS
+	TruePeak   float64 `json:"true_peak"`  // dBTP
+	ModTime    int64   `json:"mod_time,omitempty"`
+}
+
+// Analyzer measures track loudness and remembers the results
+// Measurements are keyed by track URL; local files are re-measured when they change
+type Analyzer struct {
+	path string // JSON file the measurements are saved to; empty keeps them in memory
+
+	mu       sync.Mutex
+	results  map[string]Measurement
+	inflight map[string]*sync.WaitGroup // Analyses in progress, so each track is measured once
+}
+
+// NewAnalyzer creates an analyzer, loading earlier measurements from path if it exists
+func NewAnalyzer(path string) *Analyzer {
+	a := &Analyzer{
+		path:     path,
+		results:  make(map[string]Measurement),
+		inflight: make(map[string]*sync.WaitGroup),
+	}
+
+	if path == "" {
+		return a
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read loudness cache: %v", err)
+		}
+		return a
+	}
+	if err := json.Unmarshal(data, &a.results); err != nil {
+		log.Printf("Warning: ignoring corrupt loudness cache %s: %v", path, err)
+		a.results = make(map[string]Measurement)
+	}
+
+	return a
+}
+
+// Measure returns the loudness of the track at url, analyzing source if needed
+// source is the file to analyze, typically the decoded copy in the audio cache
+func (a *Analyzer) Measure(url, source string) (Measurement, error) {
+	modTime := localModTime(url)
+
+	for {
+		a.mu.Lock()
+		if m, ok := a.results[url]; ok && m.ModTime == modTime {
+			a.mu.Unlock()
+			return m, nil
+		}
+		wg, busy := a.inflight[url]
+		if !busy {
+			wg = &sync.WaitGroup{}
+			wg.Add(1)
+			a.inflight[url] = wg
+			a.mu.Unlock()
+			break
+		}
+		a.mu.Unlock()
+
+		// Another caller is analyzing this track; use its result
+		wg.Wait()
+	}
+
+	m, err := a.analyze(url, source, modTime)
+
+	a.mu.Lock()
+	wg := a.inflight[url]
+	delete(a.inflight, url)
+	a.mu.Unlock()
+	wg.Done()
+
+	return m, err
+}
+
+// analyze measures source and stores the result
+func (a *Analyzer) analyze(url, source string, modTime int64) (Measurement, error) {
+	log.Printf("Measuring loudness: %s", url)
+	loudness, err := decoder.MeasureLoudness(source)
+	if err != nil {
+		return Measurement{}, fmt.Errorf("failed to measure loudness: %w", err)
+	}
+
+	m := Measurement{
+		Integrated: loudness.Integrated,
+		TruePeak:   loudness.TruePeak,
+		ModTime:    modTime,
+	}
+	log.Printf("Loudness of %s: %.1f LUFS, %.1f dBTP", url, m.Integrated, m.TruePeak)
+
+	a.mu.Lock()
+	a.results[url] = m
+	err = a.save()
+	a.mu.Unlock()
+	if err != nil {
+		log.Printf("Warning: failed to save loudness cache: %v", err)
+	}
+
+	return m, nil
+}
+
+// save writes all measurements to the cache file
+// Caller must hold the lock
+func (a *Analyzer) save() error {
+	if a.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(a.results)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(a.path), 0755); err != nil {
+		return err
+	}
+
+	tempPath := a.path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return os.Rename(tempPath, a.path)
+}
+
+// Gain returns the gain in dB that brings a measured track to target LUFS
+// The gain is lowered if needed to keep the true peak under -1 dBTP
+func Gain(m Measurement, target float64) float64 {
+	// Silence measures as -inf; leave it alone
+	if math.IsInf(m.Integrated, 0) || math.IsNaN(m.Integrated) {
+		return 0
+	}
+
+	gain := target - m.Integrated
+	if !math.IsInf(m.TruePeak, 0) && m.TruePeak+gain > maxTruePeak {
+		gain = maxTruePeak - m.TruePeak
+	}
+	return gain
+}
+
+// localModTime returns the modification time of a local file URL, or 0 for remote URLs
+func localModTime(url string) int64 {
+	info, err := os.Stat(url)
+	if err != nil {
+		return 0
+	}
+	return info.ModTime().UnixNano()
+}
@@ -1,4 +1,4 @@
-//go:build linux
+//go:build linux && cgo && !purego
 
 package memoryplay
 
@@ -12,7 +12,6 @@ package memoryplay
 import "C"
 import (
 	"fmt"
-	"log"
 	"sync"
 	"unsafe"
 )
@@ -33,7 +32,7 @@ func CreateSession(hostAddress string, interfaceNumber uint32) (*Session, error)
 	var handle C.MPCSessionHandle
 	ret := C.mpc_session_create(cHostAddr, C.uint32_t(interfaceNumber), &handle)
 	if ret != C.MPC_SUCCESS {
-		return nil, fmt.Errorf("mpc_session_create failed: %s", C.GoString(C.mpc_error_string(ret)))
+		return nil, sessionError("mpc_session_create", ret)
 	}
 
 	return &Session{
@@ -59,27 +58,14 @@ func isConnectionError(ret C.int) bool {
 	return ret == C.MPC_ERROR_CONNECTION || ret == C.MPC_ERROR_TIMEOUT
 }
 
-// recreateSession attempts to recreate the session after a connection error
-func (s *Session) recreateSession() error {
-	// Close old handle if it exists
-	if s.handle != nil {
-		C.mpc_session_close(s.handle)
-		s.handle = nil
-	}
-
-	// Create new session
-	cHostAddr := C.CString(s.hostAddress)
-	defer C.free(unsafe.Pointer(cHostAddr))
-
-	var handle C.MPCSessionHandle
-	ret := C.mpc_session_create(cHostAddr, C.uint32_t(s.interfaceNumber), &handle)
-	if ret != C.MPC_SUCCESS {
-		return fmt.Errorf("failed to recreate session: %s", C.GoString(C.mpc_error_string(ret)))
+// sessionError describes a failed library call
+// Connection and timeout failures wrap ErrConnectionLost; the session is not
+// recreated here, the backend's health supervisor reconnects instead
+func sessionError(call string, ret C.int) error {
+	if isConnectionError(ret) {
+		return fmt.Errorf("%s failed: %s: %w", call, C.GoString(C.mpc_error_string(ret)), ErrConnectionLost)
 	}
-
-	s.handle = handle
-	log.Printf("Session recreated after connection error")
-	return nil
+	return fmt.Errorf("%s failed: %s", call, C.GoString(C.mpc_error_string(ret)))
 }
 
 // ConnectTarget connects to a specific Diretta target
@@ -89,7 +75,7 @@ func (s *Session) ConnectTarget(targetAddress string, interfaceNumber uint32) er
 
 	ret := C.mpc_session_connect_target(s.handle, cTargetAddr, C.uint32_t(interfaceNumber))
 	if ret != C.MPC_SUCCESS {
-		return fmt.Errorf("mpc_session_connect_target failed: %s", C.GoString(C.mpc_error_string(ret)))
+		return sessionError("mpc_session_connect_target", ret)
 	}
 	return nil
 }
@@ -100,17 +86,8 @@ func (s *Session) Play() error {
 	defer s.mu.Unlock()
 
 	ret := C.mpc_session_play(s.handle)
-	if isConnectionError(ret) {
-		log.Printf("Connection error during Play, attempting to recreate session")
-		if err := s.recreateSession(); err != nil {
-			return fmt.Errorf("mpc_session_play failed: %s (reconnect failed: %w)", C.GoString(C.mpc_error_string(ret)), err)
-		}
-		// Retry once after reconnection
-		ret = C.mpc_session_play(s.handle)
-	}
-
 	if ret != C.MPC_SUCCESS {
-		return fmt.Errorf("mpc_session_play failed: %s", C.GoString(C.mpc_error_string(ret)))
+		return sessionError("mpc_session_play", ret)
 	}
 	return nil
 }
@@ -121,17 +98,8 @@ func (s *Session) Pause() error {
 	defer s.mu.Unlock()
 
 	ret := C.mpc_session_pause(s.handle)
-	if isConnectionError(ret) {
-		log.Printf("Connection error during Pause, attempting to recreate session")
-		if err := s.recreateSession(); err != nil {
-			return fmt.Errorf("mpc_session_pause failed: %s (reconnect failed: %w)", C.GoString(C.mpc_error_string(ret)), err)
-		}
-		// Retry once after reconnection
-		ret = C.mpc_session_pause(s.handle)
-	}
-
 	if ret != C.MPC_SUCCESS {
-		return fmt.Errorf("mpc_session_pause failed: %s", C.GoString(C.mpc_error_string(ret)))
+		return sessionError("mpc_session_pause", ret)
 	}
 	return nil
 }
@@ -142,17 +110,8 @@ func (s *Session) Seek(offsetSeconds int64) error {
 	defer s.mu.Unlock()
 
 	ret := C.mpc_session_seek(s.handle, C.int64_t(offsetSeconds))
-	if isConnectionError(ret) {
-		log.Printf("Connection error during Seek, attempting to recreate session")
-		if err := s.recreateSession(); err != nil {
-			return fmt.Errorf("mpc_session_seek failed: %s (reconnect failed: %w)", C.GoString(C.mpc_error_string(ret)), err)
-		}
-		// Retry once after reconnection
-		ret = C.mpc_session_seek(s.handle, C.int64_t(offsetSeconds))
-	}
-
 	if ret != C.MPC_SUCCESS {
-		return fmt.Errorf("mpc_session_seek failed: %s", C.GoString(C.mpc_error_string(ret)))
+		return sessionError("mpc_session_seek", ret)
 	}
 	return nil
 }
@@ -161,7 +120,7 @@ func (s *Session) Seek(offsetSeconds int64) error {
 func (s *Session) SeekToStart() error {
 	ret := C.mpc_session_seek_to_start(s.handle)
 	if ret != C.MPC_SUCCESS {
-		return fmt.Errorf("mpc_session_seek_to_start failed: %s", C.GoString(C.mpc_error_string(ret)))
+		return sessionError("mpc_session_seek_to_start", ret)
 	}
 	return nil
 }
@@ -172,17 +131,8 @@ func (s *Session) SeekAbsolute(positionSeconds int64) error {
 	defer s.mu.Unlock()
 
 	ret := C.mpc_session_seek_absolute(s.handle, C.int64_t(positionSeconds))
-	if isConnectionError(ret) {
-		log.Printf("Connection error during SeekAbsolute, attempting to recreate session")
-		if err := s.recreateSession(); err != nil {
-			return fmt.Errorf("mpc_session_seek_absolute failed: %s (reconnect failed: %w)", C.GoString(C.mpc_error_string(ret)), err)
-		}
-		// Retry once after reconnection
-		ret = C.mpc_session_seek_absolute(s.handle, C.int64_t(positionSeconds))
-	}
-
 	if ret != C.MPC_SUCCESS {
-		return fmt.Errorf("mpc_session_seek_absolute failed: %s", C.GoString(C.mpc_error_string(ret)))
+		return sessionError("mpc_session_seek_absolute", ret)
 	}
 	return nil
 }
@@ -191,7 +141,7 @@ func (s *Session) SeekAbsolute(positionSeconds int64) error {
 func (s *Session) Quit() error {
 	ret := C.mpc_session_quit(s.handle)
 	if ret != C.MPC_SUCCESS {
-		return fmt.Errorf("mpc_session_quit failed: %s", C.GoString(C.mpc_error_string(ret)))
+		return sessionError("mpc_session_quit", ret)
 	}
 	return nil
 }
@@ -203,17 +153,8 @@ func (s *Session) GetPlayStatus() (PlaybackStatus, error) {
 
 	var status C.MPCPlaybackStatus
 	ret := C.mpc_session_get_play_status(s.handle, &status)
-	if isConnectionError(ret) {
-		log.Printf("Connection error during GetPlayStatus, attempting to recreate session")
-		if err := s.recreateSession(); err != nil {
-			return StatusDisconnected, fmt.Errorf("mpc_session_get_play_status failed: %s (reconnect failed: %w)", C.GoString(C.mpc_error_string(ret)), err)
-		}
-		// Retry once after reconnection
-		ret = C.mpc_session_get_play_status(s.handle, &status)
-	}
-
 	if ret != C.MPC_SUCCESS {
-		return StatusDisconnected, fmt.Errorf("mpc_session_get_play_status failed: %s", C.GoString(C.mpc_error_string(ret)))
+		return StatusDisconnected, sessionError("mpc_session_get_play_status", ret)
 	}
 	return PlaybackStatus(status), nil
 }
@@ -225,17 +166,8 @@ func (s *Session) GetCurrentTime() (int64, error) {
 
 	var timeSeconds C.int64_t
 	ret := C.mpc_session_get_current_time(s.handle, &timeSeconds)
-	if isConnectionError(ret) {
-		log.Printf("Connection error during GetCurrentTime, attempting to recreate session")
-		if err := s.recreateSession(); err != nil {
-			return -1, fmt.Errorf("mpc_session_get_current_time failed: %s (reconnect failed: %w)", C.GoString(C.mpc_error_string(ret)), err)
-		}
-		// Retry once after reconnection
-		ret = C.mpc_session_get_current_time(s.handle, &timeSeconds)
-	}
-
 	if ret != C.MPC_SUCCESS {
-		return -1, fmt.Errorf("mpc_session_get_current_time failed: %s", C.GoString(C.mpc_error_string(ret)))
+		return -1, sessionError("mpc_session_get_current_time", ret)
 	}
 	return int64(timeSeconds), nil
 }
@@ -245,7 +177,7 @@ func (s *Session) GetTagList() ([]TagInfo, error) {
 	var tagList *C.MPCTagList
 	ret := C.mpc_session_get_tag_list(s.handle, &tagList)
 	if ret != C.MPC_SUCCESS {
-		return nil, fmt.Errorf("mpc_session_get_tag_list failed: %s", C.GoString(C.mpc_error_string(ret)))
+		return nil, sessionError("mpc_session_get_tag_list", ret)
 	}
 	defer C.mpc_free_tag_list(tagList)
 
@@ -1,10 +1,10 @@
-//go:build !linux
+//go:build !linux || !cgo || purego
 
 package memoryplay
 
 import "fmt"
 
-var errUnsupported = fmt.Errorf("CGo MemoryPlay bindings are only supported on Linux")
+var errUnsupported = fmt.Errorf("CGo MemoryPlay bindings are not available (non-Linux, CGo disabled or purego build); use the native implementation")
 
 // InitLibrary initializes the MemoryPlay controller library
 func InitLibrary(enableLogging, verboseMode bool) error {
@@ -129,6 +129,13 @@ func (c *Client) Disconnect() error {
 	return nil
 }
 
+// IsConnected returns whether a session to the host is open
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected && c.session != nil
+}
+
 // Play sends play command
 func (c *Client) Play() error {
 	c.mu.Lock()
@@ -229,6 +236,18 @@ func (c *Client) GetTagList() ([]TagInfo, error) {
 	return c.session.GetTagList()
 }
 
+// StatusChanged returns a channel closed the next time the host reports a different status
+// Returns nil (never ready) when the session does not track the host's status
+func (c *Client) StatusChanged() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if notifier, ok := c.session.(interface{ StatusChanged() <-chan struct{} }); ok {
+		return notifier.StatusChanged()
+	}
+	return nil
+}
+
 // SetStatusCallback sets callback for status updates
 func (c *Client) SetStatusCallback(fn func(status string)) {
 	c.mu.Lock()
@@ -247,7 +266,13 @@ func (c *Client) GetTargetList() ([]string, error) {
 		fmt.Sscanf(c.target.Interface, "%d", &interfaceNum)
 	}
 
-	targets, err := ListTargets(hostIP, interfaceNum)
+	var targets []TargetInfo
+	var err error
+	if c.useNative {
+		targets, err = ListTargetsNative(hostIP, interfaceNum)
+	} else {
+		targets, err = ListTargets(hostIP, interfaceNum)
+	}
 	if err != nil {
 		return nil, err
 	}
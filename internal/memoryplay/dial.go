@@ -0,0 +1,100 @@
+package memoryplay
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dialTarget is one address to try when connecting to a host
+type dialTarget struct {
+	network string // "tcp4", "tcp6", or "tcp" for a name left to the resolver
+	address string
+}
+
+// dialHost opens a TCP connection to a host given as "HOST,PORT"
+// HOST is an IPv4 or IPv6 address or a DNS name. A "%IFNO" suffix, as host
+// discovery reports addresses, is ignored in favour of interfaceNumber, which
+// scopes IPv6 addresses (0 leaves them unscoped)
+// Each address is given timeout to answer
+func dialHost(hostAddress string, interfaceNumber uint32, timeout time.Duration) (net.Conn, error) {
+	host, port, err := splitHostAddress(hostAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	targets, err := dialTargets(host, port, interfaceNumber)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w: %w", host, ErrConnectionLost, err)
+	}
+
+	// A name may resolve to several addresses; the first to answer wins
+	for _, target := range targets {
+		var conn net.Conn
+		if conn, err = net.DialTimeout(target.network, target.address, timeout); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to connect to %s: %w: %w", hostAddress, ErrConnectionLost, err)
+}
+
+// splitHostAddress splits "HOST,PORT" into its parts
+// Brackets around an IPv6 address and a "%IFNO" suffix on the port are dropped
+func splitHostAddress(hostAddress string) (host, port string, err error) {
+	lastComma := strings.LastIndex(hostAddress, ",")
+	if lastComma == -1 {
+		return "", "", fmt.Errorf("invalid host address format: expected HOST,PORT, got %s", hostAddress)
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(hostAddress[:lastComma], "["), "]")
+	port = hostAddress[lastComma+1:]
+	if i := strings.Index(port, "%"); i >= 0 {
+		port = port[:i]
+	}
+	return host, port, nil
+}
+
+// dialTargets returns the addresses to try for a host
+// IPv4 addresses are dialed over tcp4 and IPv6 addresses over tcp6 with the
+// interface as their zone. A name is left to the resolver unless it needs
+// scoping, in which case it is resolved here so its IPv6 addresses get the zone
+func dialTargets(host, port string, interfaceNumber uint32) ([]dialTarget, error) {
+	// A zone given with the address wins over the interface number
+	zone := ""
+	if interfaceNumber != 0 {
+		zone = strconv.FormatUint(uint64(interfaceNumber), 10)
+	}
+	if i := strings.Index(host, "%"); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return []dialTarget{ipTarget(ip, zone, port)}, nil
+	}
+	if zone == "" {
+		return []dialTarget{{network: "tcp", address: net.JoinHostPort(host, port)}}, nil
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]dialTarget, len(ips))
+	for i, ip := range ips {
+		targets[i] = ipTarget(ip, zone, port)
+	}
+	return targets, nil
+}
+
+// ipTarget returns the address to dial for an IP, scoping IPv6 addresses to zone
+func ipTarget(ip net.IP, zone, port string) dialTarget {
+	if ip.To4() != nil {
+		return dialTarget{network: "tcp4", address: net.JoinHostPort(ip.String(), port)}
+	}
+	host := ip.String()
+	if zone != "" {
+		host += "%" + zone
+	}
+	return dialTarget{network: "tcp6", address: net.JoinHostPort(host, port)}
+}
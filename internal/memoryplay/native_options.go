@@ -0,0 +1,76 @@
+package memoryplay
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// NativeOptions tunes the timeouts and retries of the pure Go implementation
+type NativeOptions struct {
+	ConnectTimeout time.Duration // Limit on each attempt at connecting to a host
+	RequestTimeout time.Duration // Wait for the host to answer a request
+	Retries        int           // Further attempts at an unanswered request or dropped connection (negative disables)
+	RetryDelay     time.Duration // Wait before the first retry, doubling after each
+}
+
+// DefaultNativeOptions returns the timeouts and retries used unless configured
+func DefaultNativeOptions() NativeOptions {
+	return NativeOptions{
+		ConnectTimeout: 5 * time.Second,
+		RequestTimeout: 1500 * time.Millisecond,
+		Retries:        3,
+		RetryDelay:     250 * time.Millisecond,
+	}
+}
+
+var (
+	nativeMu   sync.Mutex
+	nativeOpts = DefaultNativeOptions()
+)
+
+// ConfigureNative sets the timeouts and retries of native sessions and uploads created afterwards
+// Zero fields keep their defaults
+func ConfigureNative(opts NativeOptions) {
+	defaults := DefaultNativeOptions()
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = defaults.ConnectTimeout
+	}
+	if opts.RequestTimeout <= 0 {
+		opts.RequestTimeout = defaults.RequestTimeout
+	}
+	if opts.Retries == 0 {
+		opts.Retries = defaults.Retries
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = defaults.RetryDelay
+	}
+
+	nativeMu.Lock()
+	defer nativeMu.Unlock()
+	nativeOpts = opts
+}
+
+// nativeOptions returns the configured timeouts and retries
+func nativeOptions() NativeOptions {
+	nativeMu.Lock()
+	defer nativeMu.Unlock()
+	return nativeOpts
+}
+
+// errTimeout is wrapped by errors of requests the host did not answer in time
+var errTimeout = errors.New("timeout waiting for response")
+
+// retry runs fn until it succeeds, fails with an error retryable rejects, or
+// the retries run out; the wait between attempts starts at RetryDelay and doubles
+func (o NativeOptions) retry(fn func() error, retryable func(error) bool) error {
+	delay := o.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= o.Retries || !retryable(err) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -4,57 +4,94 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"log"
 	"net"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+// statusPollInterval is how often the session asks the host for its status
+// The requests double as the keepalive of the connection
+const statusPollInterval = 250 * time.Millisecond
+
+// keepaliveTimeout is the silence from the host after which the connection is presumed dropped
+const keepaliveTimeout = 3 * time.Second
+
 // NativeSession implements a MemoryPlay control session using native Go TCP
+// A receive goroutine reads every frame the host sends: status reports update
+// a snapshot that queries read without a round trip, anything else is routed
+// to the pending request waiting for it, so callers can share the session
+// A dropped connection is dialed again, like the C library's session used to
+// be recreated; the host keeps playing meanwhile, so the snapshot carries over,
+// and the target selected on the old connection is selected again
 type NativeSession struct {
-	conn      net.Conn
-	reader    *bufio.Reader
-	mu        sync.Mutex
-	connected bool
+	hostAddress     string
+	interfaceNumber uint32
+	opts            NativeOptions
+	conn            net.Conn
+	mu              sync.Mutex
+	connected       bool
+	redialing       bool          // A redial is dialing outside mu
+	redialed        chan struct{} // Closed when the redial in progress finishes
+	target          *FrameMessage // Connect command of the selected target, nil if none
+
+	state     sessionState
+	stateMu   sync.Mutex
+	lastRecv  time.Time         // When the host last sent anything
+	reported  chan struct{}     // Closed once the first status report arrived
+	changed   chan struct{}     // Closed and replaced whenever the status changes
+	pending   []*pendingRequest // Requests waiting for responses, oldest first
+	pendingMu sync.Mutex
+	done      chan struct{} // Closed when the receive goroutine exits
+	err       error         // Why the receive goroutine exited
+	stop      chan struct{} // Closed by Close to end the status poller
+}
+
+// pendingRequest is a request waiting for the host to respond
+type pendingRequest struct {
+	identifier uint32          // Identifier responses carry, 0 if none
+	keys       []string        // Header keys of the expected responses
+	queue      []*FrameMessage // Responses routed to it and not yet read, guarded by pendingMu
+	ready      chan struct{}   // Signalled when the queue grows
+}
+
+// sessionState is the host's playback state as last reported
+type sessionState struct {
+	status   PlaybackStatus
+	lastTime int64 // Seconds remaining, -1 when nothing is playing
+	tags     []TagInfo
 }
 
 // CreateNativeSession creates a new control session to a MemoryPlay host
-// hostAddress should be in the format "IP,PORT" (e.g., "::1,34133")
+// hostAddress should be in the format "HOST,PORT" (e.g., "::1,34133",
+// "192.168.1.10,34133" or "memoryplay.local,34133")
 // interfaceNumber specifies the network interface to use (0 for default)
 func CreateNativeSession(hostAddress string, interfaceNumber uint32) (*NativeSession, error) {
-	// Parse the address format: IP,PORT
-	// Example: "::1,34133"
-
-	// Split IP and PORT
-	lastComma := strings.LastIndex(hostAddress, ",")
-	if lastComma == -1 {
-		return nil, fmt.Errorf("invalid host address format: expected IP,PORT, got %s", hostAddress)
-	}
-
-	ipAddr := hostAddress[:lastComma]
-	portStr := hostAddress[lastComma+1:]
-
-	// Build the TCP address
-	// For IPv6 with scope, format is: [ipv6%interface]:port
-	var addr string
-	if interfaceNumber != 0 {
-		addr = fmt.Sprintf("[%s%%%d]:%s", ipAddr, interfaceNumber, portStr)
-	} else {
-		addr = fmt.Sprintf("[%s]:%s", ipAddr, portStr)
-	}
-
-	// Connect to the MemoryPlay host
-	conn, err := net.DialTimeout("tcp6", addr, 5*time.Second)
+	opts := nativeOptions()
+	conn, err := dialHost(hostAddress, interfaceNumber, opts.ConnectTimeout)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+		return nil, err
 	}
 
-	return &NativeSession{
-		conn:      conn,
-		reader:    bufio.NewReader(conn),
-		connected: true,
-	}, nil
+	s := &NativeSession{
+		hostAddress:     hostAddress,
+		interfaceNumber: interfaceNumber,
+		opts:            opts,
+		conn:            conn,
+		connected:       true,
+		state:           sessionState{status: StatusDisconnected, lastTime: -1},
+		lastRecv:        time.Now(),
+		reported:        make(chan struct{}),
+		changed:         make(chan struct{}),
+		done:            make(chan struct{}),
+		stop:            make(chan struct{}),
+	}
+	go s.receiveLoop()
+	go s.pollStatus()
+	return s, nil
 }
 
 // Close closes the session and releases resources
@@ -62,69 +99,415 @@ func (s *NativeSession) Close() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.connected = false
-	if s.conn != nil {
-		s.conn.Close()
-		s.conn = nil
+	if !s.connected {
+		return
 	}
+	s.connected = false
+	close(s.stop)
+	s.conn.Close()
 }
 
-// sendCommand sends a command frame message to the host
-func (s *NativeSession) sendCommand(msg *FrameMessage) error {
+// currentConn returns the open connection, nil once the session is closed
+func (s *NativeSession) currentConn() net.Conn {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if !s.connected {
+		return nil
+	}
+	return s.conn
+}
 
+// redial replaces a dropped connection with a new one
+// Callers pass the connection that failed and why; if another caller
+// already replaced it, the new one is kept, and callers arriving while
+// it is dialed wait for it. The dialing and its backoff run without mu
+// held, so Close is not held up by them
+func (s *NativeSession) redial(failed net.Conn, cause error) error {
+	s.mu.Lock()
+	for s.redialing {
+		redialed := s.redialed
+		s.mu.Unlock()
+		<-redialed
+		s.mu.Lock()
+	}
 	if !s.connected {
+		s.mu.Unlock()
 		return fmt.Errorf("session not connected")
 	}
+	if s.conn != failed {
+		s.mu.Unlock()
+		return nil
+	}
+	failed.Close()
+	s.redialing = true
+	s.redialed = make(chan struct{})
+	s.mu.Unlock()
+	log.Printf("Native session to %s lost (%v), reconnecting", s.hostAddress, cause)
+
+	attempt := 0
+	var conn net.Conn
+	err := s.opts.retry(func() error {
+		attempt++
+		var err error
+		conn, err = dialHost(s.hostAddress, s.interfaceNumber, s.opts.ConnectTimeout)
+		if err == nil {
+			err = s.restore(conn)
+		}
+		return err
+	}, func(error) bool { return s.currentConn() != nil })
 
-	encoded := msg.Encode()
-	_, err := s.conn.Write(encoded)
-	return err
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.redialing = false
+	close(s.redialed)
+	if err != nil {
+		return err
+	}
+	if !s.connected {
+		conn.Close()
+		return fmt.Errorf("session not connected")
+	}
+	s.conn = conn
+
+	log.Printf("Native session to %s reconnected (attempt %d)", s.hostAddress, attempt)
+	s.stateMu.Lock()
+	s.lastRecv = time.Now()
+	s.stateMu.Unlock()
+	return nil
 }
 
-// receiveMessages receives and processes messages until the handler returns true or timeout occurs
-// Similar to receiveMessages in C++ lib_memory_play_controller.cpp:32
-func (s *NativeSession) receiveMessages(handler func(key, value string) bool, timeoutMs int) error {
-	if timeoutMs == 0 {
-		timeoutMs = 500 // Default timeout from C++ implementation
+// restore selects the session's target again on a new connection
+// A connection that fails to take it is closed
+func (s *NativeSession) restore(conn net.Conn) error {
+	s.mu.Lock()
+	target := s.target
+	s.mu.Unlock()
+	if target == nil {
+		return nil
 	}
 
-	deadline := time.Now().Add(time.Duration(timeoutMs) * time.Millisecond)
-	lastRecv := time.Now()
+	if _, err := conn.Write(target.Encode()); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// sendCommand sends a command frame message to the host
+// A failed write dials the host again and is retried once
+func (s *NativeSession) sendCommand(msg *FrameMessage) error {
+	encoded := msg.Encode()
+
+	conn := s.currentConn()
+	if conn == nil {
+		return fmt.Errorf("session not connected")
+	}
+	_, err := conn.Write(encoded)
+	if err == nil {
+		return nil
+	}
+
+	if err := s.redial(conn, err); err != nil {
+		return fmt.Errorf("%w: %w", ErrConnectionLost, err)
+	}
+	if conn = s.currentConn(); conn == nil {
+		return fmt.Errorf("session not connected")
+	}
+	if _, err := conn.Write(encoded); err != nil {
+		return fmt.Errorf("%w: %w", ErrConnectionLost, err)
+	}
+	return nil
+}
+
+// receiveLoop reads frames from the host until the session is closed or the
+// connection cannot be restored
+func (s *NativeSession) receiveLoop() {
+	defer close(s.done)
 
 	for {
-		// Set read timeout
-		remaining := time.Until(deadline)
-		if remaining <= 0 {
-			return fmt.Errorf("timeout waiting for response")
+		conn := s.currentConn()
+		if conn == nil {
+			s.err = fmt.Errorf("%w: session closed", ErrConnectionLost)
+			return
 		}
 
-		s.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		err := s.receiveFrom(bufio.NewReader(conn))
+		if s.currentConn() == nil {
+			s.err = fmt.Errorf("%w: session closed", ErrConnectionLost)
+			return
+		}
 
-		// Try to read a message
-		msg, err := ParseFrameMessage(s.reader)
+		if redialErr := s.redial(conn, err); redialErr != nil {
+			s.err = fmt.Errorf("%w: %w", ErrConnectionLost, redialErr)
+			return
+		}
+	}
+}
+
+// receiveFrom reads frames from one connection until it fails
+func (s *NativeSession) receiveFrom(reader *bufio.Reader) error {
+	for {
+		msg, err := ParseFrameMessage(reader)
+		if errors.Is(err, errNotCommand) {
+			s.received()
+			continue
+		}
 		if err != nil {
-			// Check if it's a timeout error (need to unwrap to find net.Error)
-			var netErr net.Error
-			if errors.As(err, &netErr) && netErr.Timeout() {
-				// Check if we've exceeded the total timeout
-				if time.Since(lastRecv) >= time.Duration(timeoutMs)*time.Millisecond {
-					return fmt.Errorf("timeout waiting for response")
-				}
-				continue
+			return err
+		}
+		s.received()
+
+		if s.updateState(msg) {
+			continue
+		}
+		s.dispatch(msg)
+	}
+}
+
+// dispatch hands a response to the pending request it answers
+// A response carrying a request's identifier goes to that request; otherwise
+// it goes to the oldest request expecting one of its keys. Responses nobody
+// waits for are dropped rather than stalling status updates
+func (s *NativeSession) dispatch(msg *FrameMessage) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+
+	if target := s.answers(msg); target != nil {
+		target.deliver(msg)
+	}
+}
+
+// deliver queues a response for the request and wakes its reader
+// Callers hold pendingMu
+func (p *pendingRequest) deliver(msg *FrameMessage) {
+	p.queue = append(p.queue, msg)
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+}
+
+// answers returns the pending request a response answers, nil if none
+// Callers hold pendingMu
+func (s *NativeSession) answers(msg *FrameMessage) *pendingRequest {
+	if msg.Identifier != 0 {
+		for _, p := range s.pending {
+			if p.identifier == msg.Identifier {
+				return p
+			}
+		}
+	}
+	for _, p := range s.pending {
+		for _, key := range p.keys {
+			if _, ok := msg.Get(key); ok {
+				return p
 			}
-			return fmt.Errorf("connection error: %w", err)
 		}
+	}
+	return nil
+}
+
+// addPending registers a request for the responses dispatch routes to it
+func (s *NativeSession) addPending(identifier uint32, keys []string) *pendingRequest {
+	p := &pendingRequest{identifier: identifier, keys: keys, ready: make(chan struct{}, 1)}
 
-		// Successfully received a message
-		lastRecv = time.Now()
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	s.pending = append(s.pending, p)
+	return p
+}
+
+// removePending stops routing responses to a request
+// Responses routed to it but not read, such as the answer to another caller's
+// identical request, are routed again
+func (s *NativeSession) removePending(p *pendingRequest) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	for i, other := range s.pending {
+		if other == p {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			break
+		}
+	}
+
+	leftover := p.queue
+	p.queue = nil
+	for _, msg := range leftover {
+		if target := s.answers(msg); target != nil {
+			target.deliver(msg)
+		}
+	}
+}
 
-		// Process all headers in the message
-		for key, value := range msg.Headers {
-			if handler(key, value) {
+// nextFrame takes the oldest response queued for a request, nil if none
+func (s *NativeSession) nextFrame(p *pendingRequest) *FrameMessage {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	if len(p.queue) == 0 {
+		return nil
+	}
+	msg := p.queue[0]
+	p.queue = p.queue[1:]
+	return msg
+}
+
+// received notes that the host is still talking
+func (s *NativeSession) received() {
+	s.stateMu.Lock()
+	s.lastRecv = time.Now()
+	s.stateMu.Unlock()
+}
+
+// pollStatus asks the host for its status until the session is closed
+// The host only reports its state when asked; the receive goroutine picks
+// up the answers. A host that stops answering has its connection closed so
+// the receive goroutine dials it again
+func (s *NativeSession) pollStatus() {
+	ticker := time.NewTicker(statusPollInterval)
+	defer ticker.Stop()
+
+	for {
+		msg := NewFrameMessage()
+		msg.AddHeader(HeaderRequest, RequestStatus)
+		if err := s.sendCommand(msg); err != nil {
+			return
+		}
+
+		s.stateMu.Lock()
+		silent := time.Since(s.lastRecv)
+		s.stateMu.Unlock()
+		if silent > keepaliveTimeout {
+			log.Printf("No response from %s for %v, dropping the connection", s.hostAddress, silent.Round(time.Second))
+			if conn := s.currentConn(); conn != nil {
+				conn.Close()
+			}
+			s.received() // Give the new connection its own grace period
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// updateState applies a status report to the snapshot
+// Returns false if the message is not a status report
+func (s *NativeSession) updateState(msg *FrameMessage) bool {
+	value, ok := msg.Get(HeaderStatus)
+	if !ok {
+		return false
+	}
+
+	state := sessionState{status: StatusDisconnected, lastTime: -1}
+	switch value {
+	case StatusPlay:
+		state.status = StatusPlaying
+	case StatusPause:
+		state.status = StatusPaused
+	}
+	if state.status != StatusDisconnected {
+		if t, err := strconv.ParseInt(msg.Headers[HeaderLastTime], 10, 64); err == nil {
+			state.lastTime = t
+		}
+	}
+	for _, tag := range msg.Values(HeaderTag) {
+		state.tags = append(state.tags, TagInfo{Tag: tag})
+	}
+
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+
+	select {
+	case <-s.reported:
+	default:
+		close(s.reported)
+	}
+	if state.status != s.state.status || state.lastTime != s.state.lastTime || !slices.Equal(state.tags, s.state.tags) {
+		close(s.changed)
+		s.changed = make(chan struct{})
+	}
+	s.state = state
+	return true
+}
+
+// currentState returns the last status report, waiting briefly for the first one
+func (s *NativeSession) currentState() (sessionState, error) {
+	select {
+	case <-s.reported:
+	case <-s.done:
+		return sessionState{}, s.err
+	case <-time.After(s.opts.RequestTimeout):
+		return sessionState{}, errTimeout
+	}
+
+	select {
+	case <-s.done:
+		return sessionState{}, s.err
+	default:
+	}
+
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	return s.state, nil
+}
+
+// StatusChanged returns a channel closed the next time the host reports a different status
+func (s *NativeSession) StatusChanged() <-chan struct{} {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	return s.changed
+}
+
+// request sends a command and passes the responses with any of keys (or the
+// command's identifier, when set) to the handler until it returns true
+// A request the host leaves unanswered is sent again, backing off between
+// attempts; a dropped connection is dialed again by sendCommand
+func (s *NativeSession) request(msg *FrameMessage, keys []string, handler func(msg *FrameMessage) bool) error {
+	p := s.addPending(msg.Identifier, keys)
+	defer s.removePending(p)
+
+	return s.opts.retry(func() error {
+		if err := s.sendCommand(msg); err != nil {
+			return err
+		}
+		return s.receiveFrames(p, handler, s.opts.RequestTimeout)
+	}, func(err error) bool {
+		return errors.Is(err, errTimeout)
+	})
+}
+
+// receiveFrames waits for responses routed to a request until the handler
+// returns true or no message arrives within the timeout
+// Similar to receiveMessages in C++ lib_memory_play_controller.cpp:32
+func (s *NativeSession) receiveFrames(p *pendingRequest, handler func(msg *FrameMessage) bool, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		for msg := s.nextFrame(p); msg != nil; msg = s.nextFrame(p) {
+			if handler(msg) {
 				return nil
 			}
+			// Drain a timer that fired while the message was handled so the reset takes effect
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(timeout)
+		}
+
+		select {
+		case <-p.ready:
+		case <-s.done:
+			return s.err
+		case <-timer.C:
+			return errTimeout
 		}
 	}
 }
@@ -135,6 +518,9 @@ func (s *NativeSession) ConnectTarget(targetAddress string, interfaceNumber uint
 	msg := NewFrameMessage()
 	msg.AddHeader(HeaderConnect, fmt.Sprintf("%s %d", targetAddress, interfaceNumber))
 
+	s.mu.Lock()
+	s.target = msg
+	s.mu.Unlock()
 	return s.sendCommand(msg)
 }
 
@@ -192,102 +578,91 @@ func (s *NativeSession) Quit() error {
 	msg := NewFrameMessage()
 	msg.AddHeader(HeaderSeek, SeekQuit)
 
+	s.mu.Lock()
+	s.target = nil
+	s.mu.Unlock()
 	return s.sendCommand(msg)
 }
 
 // GetPlayStatus returns the current playback status
 func (s *NativeSession) GetPlayStatus() (PlaybackStatus, error) {
-	// Request status from host
-	msg := NewFrameMessage()
-	msg.AddHeader(HeaderRequest, RequestStatus)
-
-	if err := s.sendCommand(msg); err != nil {
-		return StatusDisconnected, err
-	}
-
-	// Process status response
-	var status PlaybackStatus = StatusDisconnected
-	handler := func(key, value string) bool {
-		if key == HeaderStatus {
-			switch value {
-			case StatusDisconnect:
-				status = StatusDisconnected
-			case StatusPlay:
-				status = StatusPlaying
-			case StatusPause:
-				status = StatusPaused
-			}
-			return true
-		}
-		return false
-	}
-
-	if err := s.receiveMessages(handler, 500); err != nil {
+	state, err := s.currentState()
+	if err != nil {
 		return StatusDisconnected, err
 	}
-
-	return status, nil
+	return state.status, nil
 }
 
 // GetCurrentTime returns the current playback time in seconds
 func (s *NativeSession) GetCurrentTime() (int64, error) {
-	// Request status from host
-	msg := NewFrameMessage()
-	msg.AddHeader(HeaderRequest, RequestStatus)
-
-	if err := s.sendCommand(msg); err != nil {
+	state, err := s.currentState()
+	if err != nil {
 		return -1, err
 	}
+	return state.lastTime, nil
+}
 
-	// Process time response
-	var timeSeconds int64 = -1
-	handler := func(key, value string) bool {
-		if key == HeaderStatus {
-			if value == StatusDisconnect || value == StatusPause {
-				return true
-			}
-		}
-		if key == HeaderLastTime {
-			// Parse the time value
-			if t, err := strconv.ParseInt(value, 10, 64); err == nil {
-				timeSeconds = t
+// GetTagList returns the list of tags from the current playlist
+func (s *NativeSession) GetTagList() ([]TagInfo, error) {
+	state, err := s.currentState()
+	if err != nil {
+		return nil, err
+	}
+	return state.tags, nil
+}
+
+// GetTargetList returns the Diretta targets the host can play to
+// Every target arrives as a TargetList value of one message
+func (s *NativeSession) GetTargetList() ([]TargetInfo, error) {
+	msg := NewFrameMessage()
+	msg.AddHeader(HeaderRequest, RequestTargetList)
+
+	var targets []TargetInfo
+	handler := func(msg *FrameMessage) bool {
+		values := msg.Values(HeaderTargetList)
+		for _, value := range values {
+			if target, ok := parseTargetEntry(value); ok {
+				targets = append(targets, target)
 			}
-			return true
 		}
-		return false
+		return len(values) > 0
 	}
 
-	// Use longer timeout for time queries
-	if err := s.receiveMessages(handler, 1500); err != nil {
-		return -1, err
+	if err := s.request(msg, []string{HeaderTargetList}, handler); err != nil {
+		return nil, err
 	}
 
-	return timeSeconds, nil
+	return targets, nil
 }
 
-// GetTagList returns the list of tags from the current playlist
-func (s *NativeSession) GetTagList() ([]TagInfo, error) {
-	// Request status from host
-	msg := NewFrameMessage()
-	msg.AddHeader(HeaderRequest, RequestStatus)
-
-	if err := s.sendCommand(msg); err != nil {
-		return nil, err
+// parseTargetEntry parses a TargetList value: "IP_ADDRESS IF_NUMBER TARGET_NAME"
+// The name may contain spaces
+func parseTargetEntry(value string) (TargetInfo, bool) {
+	fields := strings.SplitN(value, " ", 3)
+	if len(fields) < 3 {
+		return TargetInfo{}, false
 	}
 
-	// Process tag responses
-	var tags []TagInfo
-	handler := func(key, value string) bool {
-		if key == HeaderTag {
-			tags = append(tags, TagInfo{Tag: value})
-			return false // Continue collecting tags
-		}
-		return true // Stop on other messages
+	ifNum, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return TargetInfo{}, false
 	}
 
-	if err := s.receiveMessages(handler, 500); err != nil {
+	return TargetInfo{
+		IPAddress:       fields[0],
+		InterfaceNumber: uint32(ifNum),
+		TargetName:      fields[2],
+	}, true
+}
+
+// ListTargetsNative lists the Diretta targets of a host over a session of its own
+// hostAddress should be in the format "IP,PORT" (e.g., "::1,34133")
+func ListTargetsNative(hostAddress string, interfaceNumber uint32) ([]TargetInfo, error) {
+	session, err := CreateNativeSession(hostAddress, interfaceNumber)
+	if err != nil {
 		return nil, err
 	}
+	defer session.Close()
 
-	return tags, nil
-}
\ No newline at end of file
+	return session.GetTargetList()
+}
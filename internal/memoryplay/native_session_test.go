@@ -0,0 +1,519 @@
+package memoryplay
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hostFrame is a frame a fake host received, with the connection it came on
+type hostFrame struct {
+	conn int // 1 for the first connection, 2 for the next, ...
+	msg  *FrameMessage
+}
+
+// fakeHost is a MemoryPlay host on the loopback interface
+// It reports its status when asked and passes every other frame to respond,
+// which may answer on the connection, and to the received channel
+type fakeHost struct {
+	ln       net.Listener
+	respond  func(conn net.Conn, msg *FrameMessage)
+	received chan hostFrame
+
+	mu     sync.Mutex
+	conns  []net.Conn
+	status []string // Key/value pairs of the status reports
+}
+
+// newFakeHost starts a fake host; respond may be nil
+func newFakeHost(t *testing.T, respond func(conn net.Conn, msg *FrameMessage)) *fakeHost {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &fakeHost{
+		ln:       ln,
+		respond:  respond,
+		received: make(chan hostFrame, 100),
+		status:   []string{HeaderStatus, StatusDisconnect},
+	}
+	t.Cleanup(h.close)
+	go h.accept()
+	return h
+}
+
+// address returns the host's address as sessions take it
+func (h *fakeHost) address() string {
+	return "127.0.0.1," + strconv.Itoa(h.ln.Addr().(*net.TCPAddr).Port)
+}
+
+func (h *fakeHost) accept() {
+	for {
+		conn, err := h.ln.Accept()
+		if err != nil {
+			return
+		}
+		h.mu.Lock()
+		h.conns = append(h.conns, conn)
+		number := len(h.conns)
+		h.mu.Unlock()
+		go h.serve(conn, number)
+	}
+}
+
+func (h *fakeHost) serve(conn net.Conn, number int) {
+	reader := bufio.NewReader(conn)
+	for {
+		msg, err := ParseFrameMessage(reader)
+		if err != nil {
+			return
+		}
+		if request, _ := msg.Get(HeaderRequest); request == RequestStatus {
+			h.mu.Lock()
+			status := h.status
+			h.mu.Unlock()
+			sendFrame(conn, 0, status...)
+			continue
+		}
+		h.received <- hostFrame{conn: number, msg: msg}
+		if h.respond != nil {
+			h.respond(conn, msg)
+		}
+	}
+}
+
+// setStatus changes the status the host reports
+func (h *fakeHost) setStatus(pairs ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status = pairs
+}
+
+// drop closes the host's end of every connection
+func (h *fakeHost) drop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, conn := range h.conns {
+		conn.Close()
+	}
+}
+
+// close stops the host, dropping its connections
+func (h *fakeHost) close() {
+	h.ln.Close()
+	h.drop()
+}
+
+// next returns the next frame the host received other than a status request
+func (h *fakeHost) next(t *testing.T) hostFrame {
+	t.Helper()
+	select {
+	case frame := <-h.received:
+		return frame
+	case <-time.After(2 * time.Second):
+		t.Fatal("host received nothing")
+		return hostFrame{}
+	}
+}
+
+// sendFrame writes a command frame of key/value pairs to conn
+func sendFrame(conn net.Conn, identifier uint32, pairs ...string) {
+	msg := NewFrameMessage()
+	msg.Identifier = identifier
+	for i := 0; i+1 < len(pairs); i += 2 {
+		msg.AddHeader(pairs[i], pairs[i+1])
+	}
+	conn.Write(msg.Encode())
+}
+
+// useTestOptions makes sessions created by the test give up quickly
+func useTestOptions(t *testing.T) {
+	ConfigureNative(NativeOptions{
+		ConnectTimeout: time.Second,
+		RequestTimeout: 100 * time.Millisecond,
+		Retries:        2,
+		RetryDelay:     10 * time.Millisecond,
+	})
+	t.Cleanup(func() { ConfigureNative(DefaultNativeOptions()) })
+}
+
+// newTestSession connects a session to a fake host
+func newTestSession(t *testing.T, h *fakeHost) *NativeSession {
+	t.Helper()
+	s, err := CreateNativeSession(h.address(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestFrameMessageRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		pairs      []string
+		identifier uint32
+	}{
+		{"empty", nil, 0},
+		{"single header", []string{HeaderPlay, ""}, 0},
+		{"status report", []string{HeaderStatus, StatusPlay, HeaderLastTime, "120", HeaderTag, "0:0:Intro"}, 0},
+		{"repeated key", []string{HeaderTargetList, "10.0.0.2,1 3 Left", HeaderTargetList, "10.0.0.3,1 3 Right Room"}, 7},
+		{"value with equals sign", []string{"Key", "a=b"}, 0x01020304},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := NewFrameMessage()
+			msg.Identifier = tt.identifier
+			msg.Dependency = 3
+			msg.Weight = 9
+			for i := 0; i < len(tt.pairs); i += 2 {
+				msg.AddHeader(tt.pairs[i], tt.pairs[i+1])
+			}
+
+			got, err := ParseFrameMessage(bufio.NewReader(bytes.NewReader(msg.Encode())))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Identifier != tt.identifier || got.Dependency != 3 || got.Weight != 9 {
+				t.Errorf("identifier %d, dependency %d, weight %d", got.Identifier, got.Dependency, got.Weight)
+			}
+			if !reflect.DeepEqual(got.entries, msg.entries) {
+				t.Errorf("entries = %q, want %q", got.entries, msg.entries)
+			}
+		})
+	}
+}
+
+func TestParseFrameMessageSkipsOtherFrames(t *testing.T) {
+	status := NewFrameMessage()
+	status.AddHeader(HeaderStatus, StatusPause)
+
+	var stream bytes.Buffer
+	stream.Write((&AudioDataMessage{Format: &FormatID{SampleRate: 44100, BitsPerSample: 16, Channels: 2}, Data: make([]byte, 64)}).Encode())
+	stream.Write((&TagMessage{Data: []byte("0:0:Title")}).Encode())
+	stream.Write(status.Encode())
+	stream.Write(status.Encode()[:PayloadHeaderSize+3]) // Cut short
+
+	reader := bufio.NewReader(&stream)
+	for _, want := range []error{errNotCommand, errNotCommand, nil} {
+		msg, err := ParseFrameMessage(reader)
+		if !errors.Is(err, want) {
+			t.Fatalf("ParseFrameMessage error = %v, want %v", err, want)
+		}
+		if want == nil {
+			if value, _ := msg.Get(HeaderStatus); value != StatusPause {
+				t.Errorf("status = %q after skipped frames", value)
+			}
+		}
+	}
+	if _, err := ParseFrameMessage(reader); err == nil || errors.Is(err, errNotCommand) {
+		t.Errorf("truncated frame: %v", err)
+	}
+}
+
+func TestDispatchRouting(t *testing.T) {
+	s := &NativeSession{}
+	byID := s.addPending(5, []string{HeaderTargetList})
+	byKey := s.addPending(0, []string{HeaderTargetList})
+	other := s.addPending(0, []string{"Other"})
+
+	tests := []struct {
+		name       string
+		identifier uint32
+		key        string
+		want       *pendingRequest
+	}{
+		{"identifier", 5, HeaderTargetList, byID},
+		{"identifier wins over keys", 5, "Other", byID},
+		{"oldest request with the key", 0, HeaderTargetList, byID},
+		{"unknown identifier falls back to keys", 9, "Other", other},
+		{"nobody waiting", 0, "Unrelated", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := NewFrameMessage()
+			msg.Identifier = tt.identifier
+			msg.AddHeader(tt.key, "x")
+			if got := s.answers(msg); got != tt.want {
+				t.Errorf("routed to %p, want %p", got, tt.want)
+			}
+		})
+	}
+
+	// An unread response goes to the next request expecting it once its own leaves
+	msg := NewFrameMessage()
+	msg.AddHeader(HeaderTargetList, "x")
+	s.dispatch(msg)
+	s.removePending(byID)
+	if got := s.nextFrame(byKey); got != msg {
+		t.Errorf("leftover response not routed again: %v", got)
+	}
+	if got := s.nextFrame(other); got != nil {
+		t.Errorf("response routed to a request for other keys: %v", got)
+	}
+}
+
+func TestStatusChanged(t *testing.T) {
+	tests := []struct {
+		name        string
+		before      []string
+		after       []string
+		wantChanged bool
+	}{
+		{"same report", []string{HeaderStatus, StatusPlay, HeaderLastTime, "10"}, []string{HeaderStatus, StatusPlay, HeaderLastTime, "10"}, false},
+		{"status", []string{HeaderStatus, StatusPlay, HeaderLastTime, "10"}, []string{HeaderStatus, StatusPause, HeaderLastTime, "10"}, true},
+		{"time", []string{HeaderStatus, StatusPlay, HeaderLastTime, "10"}, []string{HeaderStatus, StatusPlay, HeaderLastTime, "9"}, true},
+		{"tag added", []string{HeaderStatus, StatusPlay, HeaderTag, "0:0:A"}, []string{HeaderStatus, StatusPlay, HeaderTag, "0:0:A", HeaderTag, "1:60:B"}, true},
+		{"tag replaced", []string{HeaderStatus, StatusPlay, HeaderTag, "0:0:A"}, []string{HeaderStatus, StatusPlay, HeaderTag, "0:0:B"}, true},
+		{"same tags", []string{HeaderStatus, StatusPlay, HeaderTag, "0:0:A"}, []string{HeaderStatus, StatusPlay, HeaderTag, "0:0:A"}, false},
+		{"time ignored when disconnected", []string{HeaderStatus, StatusDisconnect, HeaderLastTime, "10"}, []string{HeaderStatus, StatusDisconnect, HeaderLastTime, "9"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &NativeSession{reported: make(chan struct{}), changed: make(chan struct{})}
+			report := func(pairs []string) {
+				msg := NewFrameMessage()
+				for i := 0; i < len(pairs); i += 2 {
+					msg.AddHeader(pairs[i], pairs[i+1])
+				}
+				if !s.updateState(msg) {
+					t.Fatal("status report not taken")
+				}
+			}
+
+			report(tt.before)
+			changed := s.StatusChanged()
+			report(tt.after)
+			select {
+			case <-changed:
+				if !tt.wantChanged {
+					t.Error("change signalled")
+				}
+			default:
+				if tt.wantChanged {
+					t.Error("change not signalled")
+				}
+			}
+		})
+	}
+}
+
+func TestSessionState(t *testing.T) {
+	useTestOptions(t)
+	h := newFakeHost(t, nil)
+	h.setStatus(HeaderStatus, StatusPlay, HeaderLastTime, "42", HeaderTag, "0:0:First", HeaderTag, "1:180:Second")
+	s := newTestSession(t, h)
+
+	status, err := s.GetPlayStatus()
+	if err != nil || status != StatusPlaying {
+		t.Errorf("GetPlayStatus = %v, %v", status, err)
+	}
+	if seconds, err := s.GetCurrentTime(); err != nil || seconds != 42 {
+		t.Errorf("GetCurrentTime = %d, %v", seconds, err)
+	}
+	tags, err := s.GetTagList()
+	if want := []TagInfo{{Tag: "0:0:First"}, {Tag: "1:180:Second"}}; err != nil || !reflect.DeepEqual(tags, want) {
+		t.Errorf("GetTagList = %v, %v", tags, err)
+	}
+
+	// A new report is picked up by the poller
+	changed := s.StatusChanged()
+	h.setStatus(HeaderStatus, StatusPause, HeaderLastTime, "41")
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("status change not signalled")
+	}
+	if status, _ := s.GetPlayStatus(); status != StatusPaused {
+		t.Errorf("GetPlayStatus after the change = %v", status)
+	}
+}
+
+func TestGetTargetList(t *testing.T) {
+	want := []TargetInfo{
+		{IPAddress: "fe80::1,19644", InterfaceNumber: 3, TargetName: "Living Room"},
+		{IPAddress: "10.0.0.2,19644", InterfaceNumber: 0, TargetName: "DAC"},
+	}
+
+	tests := []struct {
+		name     string
+		ignore   int  // Requests left unanswered before one is answered
+		noise    bool // Whether unrelated frames come first
+		wantErr  bool
+		requests int
+	}{
+		{"answered", 0, false, false, 1},
+		{"among unrelated frames", 0, true, false, 1},
+		{"answered on retry", 1, false, false, 2},
+		{"never answered", 10, false, true, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestOptions(t)
+			var mu sync.Mutex
+			seen := 0
+			h := newFakeHost(t, func(conn net.Conn, msg *FrameMessage) {
+				mu.Lock()
+				seen++
+				answer := seen > tt.ignore
+				mu.Unlock()
+				if !answer {
+					return
+				}
+				if tt.noise {
+					sendFrame(conn, 0, "Unrelated", "1")
+					sendFrame(conn, 0, HeaderStatus, StatusPlay, HeaderLastTime, "5")
+					sendFrame(conn, 0, HeaderTargetList) // Key without a value pair is dropped
+				}
+				sendFrame(conn, 0, HeaderTargetList, "fe80::1,19644 3 Living Room", HeaderTargetList, "10.0.0.2,19644 0 DAC", HeaderTargetList, "malformed")
+			})
+			s := newTestSession(t, h)
+
+			targets, err := s.GetTargetList()
+			if tt.wantErr {
+				if !errors.Is(err, errTimeout) {
+					t.Errorf("GetTargetList error = %v, want a timeout", err)
+				}
+			} else if err != nil || !reflect.DeepEqual(targets, want) {
+				t.Errorf("GetTargetList = %+v, %v", targets, err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if seen != tt.requests {
+				t.Errorf("host got %d requests, want %d", seen, tt.requests)
+			}
+		})
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	useTestOptions(t)
+	h := newFakeHost(t, func(conn net.Conn, msg *FrameMessage) {
+		// Answers arrive behind status reports and in one burst at the end
+		time.Sleep(20 * time.Millisecond)
+		sendFrame(conn, 0, HeaderStatus, StatusPlay)
+		sendFrame(conn, 0, HeaderTargetList, "10.0.0.2,19644 0 DAC")
+	})
+	s := newTestSession(t, h)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			targets, err := s.GetTargetList()
+			if err == nil && len(targets) != 1 {
+				err = errors.New("wrong number of targets: " + strconv.Itoa(len(targets)))
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(s *NativeSession) error
+		want  []string // Headers of the frames on the new connection, in order
+	}{
+		{"without a target", func(s *NativeSession) error { return nil }, []string{HeaderPlay}},
+		{"target selected again", func(s *NativeSession) error { return s.ConnectTarget("10.0.0.2,19644", 0) }, []string{HeaderConnect, HeaderPlay}},
+		{"target given up", func(s *NativeSession) error {
+			if err := s.ConnectTarget("10.0.0.2,19644", 0); err != nil {
+				return err
+			}
+			return s.Quit()
+		}, []string{HeaderPlay}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestOptions(t)
+			h := newFakeHost(t, nil)
+			h.setStatus(HeaderStatus, StatusPlay, HeaderLastTime, "30")
+			s := newTestSession(t, h)
+			if err := tt.setup(s); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.GetPlayStatus(); err != nil {
+				t.Fatal(err)
+			}
+			// Take what the first connection received
+			for drained := false; !drained; {
+				select {
+				case <-h.received:
+				case <-time.After(50 * time.Millisecond):
+					drained = true
+				}
+			}
+
+			h.drop()
+			for s.currentConn() != nil {
+				h.mu.Lock()
+				redialed := len(h.conns) > 1
+				h.mu.Unlock()
+				if redialed {
+					break
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			if err := s.Play(); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, header := range tt.want {
+				frame := h.next(t)
+				if _, ok := frame.msg.Get(header); !ok || frame.conn != 2 {
+					t.Fatalf("host got %v on connection %d, want %s on connection 2", frame.msg.Headers, frame.conn, header)
+				}
+			}
+
+			// The state carries over the new connection
+			if status, err := s.GetPlayStatus(); err != nil || status != StatusPlaying {
+				t.Errorf("GetPlayStatus after reconnecting = %v, %v", status, err)
+			}
+		})
+	}
+}
+
+func TestHostGone(t *testing.T) {
+	useTestOptions(t)
+	h := newFakeHost(t, nil)
+	s := newTestSession(t, h)
+	if _, err := s.GetPlayStatus(); err != nil {
+		t.Fatal(err)
+	}
+
+	h.close()
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session still running with the host gone")
+	}
+	if _, err := s.GetPlayStatus(); !errors.Is(err, ErrConnectionLost) {
+		t.Errorf("GetPlayStatus error = %v, want ErrConnectionLost", err)
+	}
+	if err := s.Play(); err == nil {
+		t.Error("Play succeeded with the host gone")
+	}
+}
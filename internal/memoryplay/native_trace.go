@@ -0,0 +1,93 @@
+package memoryplay
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// traceHexBytes is how much of a frame's payload the trace dumps
+const traceHexBytes = 64
+
+var (
+	traceMu     sync.Mutex
+	traceFile   *os.File
+	traceLogger *log.Logger
+)
+
+// TraceFrames logs every frame the pure Go implementation encodes or decodes
+// to a file, appending to it: type, length, identifier, the key=value pairs of
+// command frames and the start of the payload in hex
+// This shows what went over the wire when a host misbehaves, without a packet
+// capture. An empty path stops tracing
+func TraceFrames(path string) error {
+	traceMu.Lock()
+	defer traceMu.Unlock()
+
+	if traceFile != nil {
+		if traceFile.Name() == path {
+			return nil
+		}
+		traceFile.Close()
+		traceFile, traceLogger = nil, nil
+	}
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open trace file: %w", err)
+	}
+	traceFile = f
+	traceLogger = log.New(f, "", log.LstdFlags|log.Lmicroseconds)
+	return nil
+}
+
+// traceFrame logs a frame to the trace file, if tracing
+// direction is "encode" for frames built to send, "decode" for frames read
+func traceFrame(direction string, header *PayloadHeader, payload []byte) {
+	traceMu.Lock()
+	defer traceMu.Unlock()
+	if traceLogger == nil {
+		return
+	}
+
+	var line strings.Builder
+	fmt.Fprintf(&line, "%s %s len=%d flags=%d id=%d", direction, frameTypeName(header.Type), header.Length, header.Flags, header.Identifier)
+
+	if header.Type == MessageTypeCommand {
+		if msgHeader, err := DecodeMessageHeader(payload); err == nil {
+			fmt.Fprintf(&line, " dep=%d weight=%d", msgHeader.Dependency, msgHeader.Weight)
+			pairs := strings.Split(strings.TrimSuffix(string(payload[MessageHeaderSize:]), "\r\n"), "\r\n")
+			fmt.Fprintf(&line, " headers=[%s]", strings.Join(pairs, "; "))
+		}
+	}
+
+	dump := payload
+	if len(dump) > traceHexBytes {
+		dump = dump[:traceHexBytes]
+	}
+	fmt.Fprintf(&line, " payload=% x", dump)
+	if len(payload) > len(dump) {
+		fmt.Fprintf(&line, " ... (%d more bytes)", len(payload)-len(dump))
+	}
+
+	traceLogger.Print(line.String())
+}
+
+// frameTypeName names a payload header message type for the trace
+func frameTypeName(messageType uint8) string {
+	switch messageType {
+	case MessageTypeData:
+		return "data"
+	case MessageTypeCommand:
+		return "command"
+	case MessageTypeTag:
+		return "tag"
+	default:
+		return fmt.Sprintf("type%d", messageType)
+	}
+}
@@ -0,0 +1,373 @@
+package memoryplay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/famish99/direttampd/internal/decoder"
+)
+
+// Tag strings with special meaning to the host
+const (
+	TagQuit = "@@Diretta-TAG-QUIT@@" // Ends an upload
+	TagLoop = "@@Diretta-TAG-LOOP@@" // Plays the upload in a loop
+)
+
+// Acknowledgement headers the host sends for uploaded frames
+const (
+	HeaderDataStack = "DataStack" // Count of audio frames received
+	HeaderDataTag   = "DataTag"   // Count of audio frames received, after a tag
+)
+
+// ErrUploadCancelled is returned by Upload.Wait after Cancel
+var ErrUploadCancelled = errors.New("upload cancelled")
+
+// uploadAckTimeout bounds the wait for the host to acknowledge a frame
+const uploadAckTimeout = 5 * time.Second
+
+// UploadTrack is a decoded WAV file to upload and how the host lists it
+type UploadTrack struct {
+	Path   string
+	Stream io.Reader // WAV read while it is decoded, instead of the file at Path
+	Index  int       // Track number the host shows (1-based)
+	Title  string
+}
+
+// FormatTag returns the tag the host lists a track under: "INDEX:TIME:NAME",
+// with TIME the track's length in whole seconds, as GetTagList reports it
+func FormatTag(index int, seconds float64, name string) string {
+	return fmt.Sprintf("%d:%d:%s", index, int64(seconds), name)
+}
+
+// UploadAudioNative uploads WAV files to a MemoryPlay host without the C library
+// The sequence matches mpc_upload_audio: a data frame carrying only the
+// format, one second of PCM per data frame, each acknowledged with the count of
+// frames so far, a tag frame after each track and a quit tag at the end.
+// Where the C library tags a track with its title alone, the tag here carries
+// the track number, length and title (see FormatTag). Like the C library, PCM of up to two channels is sent as 32-bit
+// stereo. All tracks must share the first track's format.
+func UploadAudioNative(hostAddress string, interfaceNumber uint32, tracks []UploadTrack) error {
+	upload, err := StartUploadNative(hostAddress, interfaceNumber, tracks, 0)
+	if err != nil {
+		return err
+	}
+	return upload.Wait()
+}
+
+// StartUploadNative begins uploading WAV files like UploadAudioNative and
+// returns once prerollSeconds of audio are buffered on the host, leaving the
+// rest to upload in the background while the target plays
+// A prerollSeconds of 0 or less returns when the upload is complete
+func StartUploadNative(hostAddress string, interfaceNumber uint32, tracks []UploadTrack, prerollSeconds float64) (*Upload, error) {
+	if len(tracks) == 0 {
+		return nil, fmt.Errorf("no audio files provided")
+	}
+
+	infos := make([]*decoder.WAVInfo, len(tracks))
+	for i, track := range tracks {
+		info, err := readTrackInfo(track)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && (info.SampleRate != infos[0].SampleRate || info.BlockAlign != infos[0].BlockAlign || info.ChannelMask != infos[0].ChannelMask) {
+			return nil, fmt.Errorf("%s: format differs from the first track", track.Title)
+		}
+		infos[i] = info
+	}
+
+	layout, err := newPCMLayout(infos[0])
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialHost(hostAddress, interfaceNumber, nativeOptions().ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &Upload{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		format:  layout.format(),
+		preroll: prerollSeconds,
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go u.run(tracks, infos, layout)
+
+	select {
+	case <-u.ready:
+		return u, nil
+	case <-u.done:
+		if u.err != nil {
+			return nil, u.err
+		}
+		return u, nil
+	}
+}
+
+// readTrackInfo reads the layout of a track's WAV file or stream
+// A stream is left at its PCM data
+func readTrackInfo(track UploadTrack) (*decoder.WAVInfo, error) {
+	if track.Stream == nil {
+		return decoder.ReadWAVInfo(track.Path)
+	}
+	info, err := decoder.ReadWAVStreamInfo(track.Stream)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", track.Title, err)
+	}
+	return info, nil
+}
+
+// pcmLayout describes how WAV samples are converted for the host
+type pcmLayout struct {
+	sampleRate  uint32
+	channels    int
+	channelMask uint32 // Speaker positions, 0 for the default layout
+	width       int    // Bytes per sample in the file
+	widen       bool   // Samples are converted to 32-bit stereo
+}
+
+// newPCMLayout works out the conversion for a WAV file's format
+func newPCMLayout(info *decoder.WAVInfo) (*pcmLayout, error) {
+	layout := &pcmLayout{sampleRate: info.SampleRate, channels: int(info.Channels), channelMask: info.ChannelMask}
+	if int(info.BlockAlign)%layout.channels != 0 {
+		return nil, fmt.Errorf("invalid WAV channel layout")
+	}
+	layout.width = int(info.BlockAlign) / layout.channels
+	layout.widen = layout.width < 4 && layout.channels <= 2
+	return layout, nil
+}
+
+// format returns the FormatID the host receives
+func (l *pcmLayout) format() *FormatID {
+	if l.widen {
+		return &FormatID{SampleRate: l.sampleRate, BitsPerSample: 32, Channels: 2, Format: FormatPCM}
+	}
+	return &FormatID{
+		SampleRate:    l.sampleRate,
+		BitsPerSample: uint32(l.width * 8),
+		Channels:      uint32(l.channels),
+		Format:        FormatPCM,
+		ChannelMask:   l.channelMask,
+	}
+}
+
+// convert returns PCM as the host receives it
+// Narrower samples are left-justified in 32 bits and mono is duplicated
+func (l *pcmLayout) convert(pcm []byte) []byte {
+	if !l.widen {
+		return pcm
+	}
+
+	frames := len(pcm) / (l.width * l.channels)
+	out := make([]byte, frames*8)
+	for frame := 0; frame < frames; frame++ {
+		for ch := 0; ch < 2; ch++ {
+			src := (frame*l.channels + ch%l.channels) * l.width
+			var sample uint32
+			for b := 0; b < l.width; b++ {
+				sample |= uint32(pcm[src+b]) << (8 * (4 - l.width + b))
+			}
+			binary.LittleEndian.PutUint32(out[(frame*2+ch)*4:], sample)
+		}
+	}
+	return out
+}
+
+// Upload is a transfer of audio to the host, possibly still running
+type Upload struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	format    *FormatID
+	transfers int     // Audio frames sent so far
+	preroll   float64 // Seconds buffered on the host before ready closes
+
+	mu        sync.Mutex
+	buffered  float64 // Seconds of audio the host acknowledged
+	cancelled bool
+	ready     chan struct{}
+	done      chan struct{}
+	err       error
+}
+
+// run sends every frame of the upload, closing done when finished
+func (u *Upload) run(tracks []UploadTrack, infos []*decoder.WAVInfo, layout *pcmLayout) {
+	defer close(u.done)
+	defer u.conn.Close()
+
+	err := u.sendAll(tracks, infos, layout)
+
+	u.mu.Lock()
+	if u.cancelled {
+		err = ErrUploadCancelled
+	}
+	u.mu.Unlock()
+	u.err = err
+}
+
+// sendAll sends the format, each track with its tag, and the quit tag
+func (u *Upload) sendAll(tracks []UploadTrack, infos []*decoder.WAVInfo, layout *pcmLayout) error {
+	// The format goes first on its own; the host acknowledges audio frames only
+	if err := u.send((&AudioDataMessage{Format: u.format}).Encode()); err != nil {
+		return err
+	}
+
+	for i, track := range tracks {
+		seconds, err := u.sendTrack(track, infos[i], layout)
+		if err != nil {
+			return err
+		}
+		if err := u.sendTag(FormatTag(track.Index, seconds, track.Title)); err != nil {
+			return err
+		}
+	}
+	return u.sendTag(TagQuit)
+}
+
+// Wait blocks until the upload has finished and returns its error
+func (u *Upload) Wait() error {
+	<-u.done
+	return u.err
+}
+
+// Cancel abandons the upload and waits for its goroutine to stop
+// Wait then returns ErrUploadCancelled
+func (u *Upload) Cancel() {
+	u.mu.Lock()
+	u.cancelled = true
+	u.mu.Unlock()
+
+	u.conn.Close()
+	<-u.done
+}
+
+// Finished reports whether every frame has been sent
+func (u *Upload) Finished() bool {
+	select {
+	case <-u.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// BufferedSeconds returns how many seconds of audio the host has acknowledged
+func (u *Upload) BufferedSeconds() float64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.buffered
+}
+
+// send writes an encoded frame
+func (u *Upload) send(frame []byte) error {
+	if _, err := u.conn.Write(frame); err != nil {
+		return fmt.Errorf("%w: %w", ErrConnectionLost, err)
+	}
+	return nil
+}
+
+// sendTrack sends a track's PCM in one-second frames
+// Returns the seconds of audio sent, which for a stream is only known at its end
+func (u *Upload) sendTrack(track UploadTrack, info *decoder.WAVInfo, layout *pcmLayout) (float64, error) {
+	data := track.Stream
+	if data == nil {
+		f, err := os.Open(track.Path)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		data = io.NewSectionReader(f, info.DataStart, info.DataSize)
+	} else if info.DataSize >= 0 {
+		data = io.LimitReader(data, info.DataSize)
+	}
+
+	// A frame's length field has 24 bits, which caps a second of wide multichannel audio
+	size := int(info.SampleRate) * int(info.BlockAlign)
+	if limit := (1<<24 - 1 - DataHeaderSize - 16) / 2; size > limit {
+		size = limit - limit%int(info.BlockAlign)
+	}
+
+	chunk := make([]byte, size)
+	var sent float64
+	for {
+		n, err := io.ReadFull(data, chunk)
+		if n > 0 {
+			n -= n % int(info.BlockAlign)
+			seconds := float64(n/int(info.BlockAlign)) / float64(info.SampleRate)
+			if sendErr := u.sendAudio(layout.convert(chunk[:n]), seconds); sendErr != nil {
+				return sent, sendErr
+			}
+			sent += seconds
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sent, nil
+		}
+		if err != nil {
+			return sent, err
+		}
+	}
+}
+
+// sendAudio sends one data frame of seconds of audio and waits for it to be acknowledged
+func (u *Upload) sendAudio(pcm []byte, seconds float64) error {
+	if err := u.send((&AudioDataMessage{Format: u.format, Data: pcm}).Encode()); err != nil {
+		return err
+	}
+	u.transfers++
+	if err := u.waitAck(); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	u.buffered += seconds
+	if u.preroll > 0 && u.buffered >= u.preroll && u.buffered-seconds < u.preroll {
+		close(u.ready)
+	}
+	u.mu.Unlock()
+	return nil
+}
+
+// sendTag sends a tag frame, acknowledged with the current frame count
+func (u *Upload) sendTag(tag string) error {
+	if err := u.send((&TagMessage{Data: []byte(tag)}).Encode()); err != nil {
+		return err
+	}
+	return u.waitAck()
+}
+
+// waitAck reads host messages until one acknowledges every frame sent
+func (u *Upload) waitAck() error {
+	u.conn.SetReadDeadline(time.Now().Add(uploadAckTimeout))
+	defer u.conn.SetReadDeadline(time.Time{})
+
+	for {
+		msg, err := ParseFrameMessage(u.reader)
+		if errors.Is(err, errNotCommand) {
+			continue
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return fmt.Errorf("timeout waiting for upload acknowledgement")
+			}
+			return fmt.Errorf("%w: %w", ErrConnectionLost, err)
+		}
+
+		for _, key := range []string{HeaderDataStack, HeaderDataTag} {
+			if value, ok := msg.Get(key); ok {
+				if count, err := strconv.Atoi(value); err == nil && count == u.transfers {
+					return nil
+				}
+			}
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -51,13 +52,19 @@ type FormatID struct {
 	BitsPerSample uint32 // Bits per sample (8, 16, 24, 32)
 	Channels      uint32 // Number of channels
 	Format        uint32 // Format type (FormatPCM, etc.)
+
+	// Speaker positions of the channels (WAVE_FORMAT_EXTENSIBLE), 0 for the
+	// default layout of the count; not part of the wire format, as the host
+	// takes the channels in the order they are interleaved
+	ChannelMask uint32
 }
 
 // Response headers (Host → Client)
 const (
-	HeaderStatus   = "Status"
-	HeaderLastTime = "LastTime"
-	HeaderTag      = "Tag"
+	HeaderStatus     = "Status"
+	HeaderLastTime   = "LastTime"
+	HeaderTag        = "Tag"
+	HeaderTargetList = "TargetList" // One target per value: "IP,PORT IFNO NAME"
 
 	// Status values
 	StatusPlay       = "Play"
@@ -124,9 +131,33 @@ func (h *MessageHeader) Encode() []byte {
 	return buf
 }
 
+// DecodeMessageHeader reads a MessageHeader from bytes
+func DecodeMessageHeader(data []byte) (*MessageHeader, error) {
+	if len(data) < MessageHeaderSize {
+		return nil, fmt.Errorf("insufficient data for message header")
+	}
+	return &MessageHeader{
+		Pad:        data[0],
+		Dependency: binary.BigEndian.Uint32(data[1:5]),
+		Weight:     data[5],
+	}, nil
+}
+
 // FrameMessage represents a command message with key=value pairs
+// Pairs are encoded in the order they were added, so a message always encodes
+// to the same bytes. Headers holds the last value of each key; keys repeated in
+// one message (such as TargetList) are all kept in order for Values
 type FrameMessage struct {
-	Headers map[string]string
+	Headers    map[string]string
+	Identifier uint32 // Payload header identifier
+	Dependency uint32 // Identifier of the frame this one depends on (0 for none)
+	Weight     uint8  // Priority relative to frames with the same dependency
+	entries    []frameEntry
+}
+
+// frameEntry is one key=value pair of a command message
+type frameEntry struct {
+	key, value string
 }
 
 // NewFrameMessage creates a new command frame message
@@ -136,9 +167,11 @@ func NewFrameMessage() *FrameMessage {
 	}
 }
 
-// AddHeader adds a key=value pair to the message
+// AddHeader appends a key=value pair to the message
+// A key added twice is sent twice
 func (msg *FrameMessage) AddHeader(key, value string) {
 	msg.Headers[key] = value
+	msg.entries = append(msg.entries, frameEntry{key, value})
 }
 
 // Encode serializes FrameMessage to wire format with frame wrapper
@@ -146,18 +179,18 @@ func (msg *FrameMessage) AddHeader(key, value string) {
 func (msg *FrameMessage) Encode() []byte {
 	// Build the payload (key=value\r\n pairs)
 	var payload bytes.Buffer
-	for key, value := range msg.Headers {
-		payload.WriteString(key)
+	for _, entry := range msg.entries {
+		payload.WriteString(entry.key)
 		payload.WriteByte('=')
-		payload.WriteString(value)
+		payload.WriteString(entry.value)
 		payload.WriteString("\r\n")
 	}
 
 	// Create message header
 	msgHeader := &MessageHeader{
 		Pad:        0,
-		Dependency: 0,
-		Weight:     0,
+		Dependency: msg.Dependency,
+		Weight:     msg.Weight,
 	}
 	msgHeaderBytes := msgHeader.Encode()
 
@@ -169,7 +202,7 @@ func (msg *FrameMessage) Encode() []byte {
 		Length:     payloadLength,
 		Type:       MessageTypeCommand,
 		Flags:      0,
-		Identifier: 0,
+		Identifier: msg.Identifier,
 	}
 	frameHeaderBytes := frameHeader.Encode()
 
@@ -179,6 +212,7 @@ func (msg *FrameMessage) Encode() []byte {
 	result = append(result, msgHeaderBytes...)
 	result = append(result, payload.Bytes()...)
 
+	traceFrame("encode", frameHeader, result[PayloadHeaderSize:])
 	return result
 }
 
@@ -194,8 +228,9 @@ func EncodeFormatID(format *FormatID) []byte {
 
 // AudioDataMessage wraps FormatID + audio payload for transmission
 type AudioDataMessage struct {
-	Format *FormatID
-	Data   []byte
+	Format     *FormatID
+	Data       []byte
+	Identifier uint32 // Payload header identifier
 }
 
 // Encode serializes AudioDataMessage to wire format with frame wrapper
@@ -215,7 +250,7 @@ func (msg *AudioDataMessage) Encode() []byte {
 		Length:     payloadLength,
 		Type:       MessageTypeData,
 		Flags:      0,
-		Identifier: 0,
+		Identifier: msg.Identifier,
 	}
 	frameHeaderBytes := frameHeader.Encode()
 
@@ -226,12 +261,14 @@ func (msg *AudioDataMessage) Encode() []byte {
 	result = append(result, formatBytes...)
 	result = append(result, msg.Data...)
 
+	traceFrame("encode", frameHeader, result[PayloadHeaderSize:])
 	return result
 }
 
 // TagMessage wraps tag/metadata for transmission
 type TagMessage struct {
-	Data []byte
+	Data       []byte
+	Identifier uint32 // Payload header identifier
 }
 
 // Encode serializes TagMessage to wire format with frame wrapper
@@ -247,7 +284,7 @@ func (msg *TagMessage) Encode() []byte {
 		Length:     payloadLength,
 		Type:       MessageTypeTag,
 		Flags:      0,
-		Identifier: 0,
+		Identifier: msg.Identifier,
 	}
 	frameHeaderBytes := frameHeader.Encode()
 
@@ -257,9 +294,13 @@ func (msg *TagMessage) Encode() []byte {
 	result = append(result, dataHeader...)
 	result = append(result, msg.Data...)
 
+	traceFrame("encode", frameHeader, result[PayloadHeaderSize:])
 	return result
 }
 
+// errNotCommand is returned by ParseFrameMessage for frames other than command messages
+var errNotCommand = errors.New("not a command message")
+
 // ParseFrameMessage reads a framed message from a reader
 func ParseFrameMessage(r *bufio.Reader) (*FrameMessage, error) {
 	// Read payload header (9 bytes)
@@ -278,20 +319,25 @@ func ParseFrameMessage(r *bufio.Reader) (*FrameMessage, error) {
 	if _, err := io.ReadFull(r, payloadBuf); err != nil {
 		return nil, fmt.Errorf("failed to read payload: %w", err)
 	}
+	traceFrame("decode", header, payloadBuf)
 
-	// Only parse command messages (type 1)
+	// Only parse command messages (type 1); the frame is consumed either way
 	if header.Type != MessageTypeCommand {
-		return nil, fmt.Errorf("unexpected message type: %d (expected command type 1)", header.Type)
+		return nil, fmt.Errorf("message type %d: %w", header.Type, errNotCommand)
 	}
 
-	// Skip message header (6 bytes)
-	if len(payloadBuf) < MessageHeaderSize {
+	// Read message header (6 bytes)
+	msgHeader, err := DecodeMessageHeader(payloadBuf)
+	if err != nil {
 		return nil, fmt.Errorf("payload too short for message header")
 	}
 	payloadData := payloadBuf[MessageHeaderSize:]
 
 	// Parse key=value\r\n pairs
 	msg := NewFrameMessage()
+	msg.Identifier = header.Identifier
+	msg.Dependency = msgHeader.Dependency
+	msg.Weight = msgHeader.Weight
 	var key, value strings.Builder
 	inValue := false
 
@@ -335,3 +381,14 @@ func (msg *FrameMessage) Get(key string) (string, bool) {
 	val, ok := msg.Headers[key]
 	return val, ok
 }
+
+// Values returns every value given for a header key, in the order received
+func (msg *FrameMessage) Values(key string) []string {
+	var values []string
+	for _, entry := range msg.entries {
+		if entry.key == key {
+			values = append(values, entry.value)
+		}
+	}
+	return values
+}
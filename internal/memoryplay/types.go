@@ -1,5 +1,11 @@
 package memoryplay
 
+import "errors"
+
+// ErrConnectionLost is wrapped by session errors caused by losing the connection
+// to the host, as opposed to the host rejecting a command
+var ErrConnectionLost = errors.New("connection to MemoryPlay host lost")
+
 // HostInfo represents a discovered MemoryPlay host
 type HostInfo struct {
 	IPAddress       string
@@ -0,0 +1,41 @@
+package mpd
+
+import (
+	"fmt"
+)
+
+// ackCode is an MPD protocol error code (MPD's enum ack)
+type ackCode int
+
+const (
+	ackErrorNotList       ackCode = 1
+	ackErrorArg           ackCode = 2
+	ackErrorPassword      ackCode = 3
+	ackErrorPermission    ackCode = 4
+	ackErrorUnknown       ackCode = 5
+	ackErrorNoExist       ackCode = 50
+	ackErrorPlaylistMax   ackCode = 51
+	ackErrorSystem        ackCode = 52
+	ackErrorPlaylistLoad  ackCode = 53
+	ackErrorUpdateAlready ackCode = 54
+	ackErrorPlayerSync    ackCode = 55
+	ackErrorExist         ackCode = 56
+)
+
+// ackError is an error response to a command
+type ackError struct {
+	code    ackCode
+	index   int    // Position of the failing command within a command list (0 outside one)
+	command string // Name of the failing command
+	message string
+}
+
+// Error formats the error as an MPD ACK line
+func (e *ackError) Error() string {
+	return fmt.Sprintf("ACK [%d@%d] {%s} %s\n", e.code, e.index, e.command, e.message)
+}
+
+// ack returns the error for a failed command
+func ack(code ackCode, command string, format string, args ...interface{}) *ackError {
+	return &ackError{code: code, command: command, message: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,179 @@
+package mpd
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/famish99/direttampd/internal/backends"
+	"github.com/famish99/direttampd/internal/backends/null"
+	"github.com/famish99/direttampd/internal/cache"
+	"github.com/famish99/direttampd/internal/config"
+	"github.com/famish99/direttampd/internal/player"
+)
+
+// newTestServer creates a server on the null backend with an empty queue,
+// no music database and a stored playlist directory of its own
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	cfg := &config.Config{PlaylistDirectory: t.TempDir()}
+	cfg.Cache.Directory = t.TempDir()
+	cfg.Cache.MaxSizeGB = 1
+	cfg.Playback.HealthCheckSeconds = -1
+
+	p, err := player.NewPlayerWithBackend(cfg, func(c *cache.DiskCache) (backends.PlaybackBackend, error) {
+		return null.New(c, ""), nil
+	})
+	if err != nil {
+		t.Fatalf("NewPlayerWithBackend: %v", err)
+	}
+	t.Cleanup(p.Close)
+	return NewServer(nil, p, cfg)
+}
+
+// testConn is a client connected to a test server over an in-memory pipe,
+// which counts as a remote TCP client
+type testConn struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dial connects a client to the server and reads the greeting
+func dial(t *testing.T, s *Server) *testConn {
+	t.Helper()
+	client, server := net.Pipe()
+	go s.handleConnection(server)
+	t.Cleanup(func() { client.Close() })
+
+	c := &testConn{t: t, conn: client, reader: bufio.NewReader(client)}
+	if greeting := c.readLine(); !strings.HasPrefix(greeting, "OK MPD ") {
+		t.Fatalf("greeting = %q", greeting)
+	}
+	return c
+}
+
+// readLine reads one response line without its newline
+func (c *testConn) readLine() string {
+	c.t.Helper()
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+// command sends the lines of a request and returns its response up to and
+// including the final OK or ACK line
+func (c *testConn) command(lines ...string) []string {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(strings.Join(lines, "\n") + "\n")); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+
+	var response []string
+	for {
+		line := c.readLine()
+		response = append(response, line)
+		if line == "OK" || strings.HasPrefix(line, "ACK ") {
+			return response
+		}
+	}
+}
+
+// last returns the final line of a response
+func last(response []string) string {
+	return response[len(response)-1]
+}
+
+func TestACKCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    string
+	}{
+		{"unknown command", "bogus", "ACK [5@0] {bogus} unknown command"},
+		{"unknown command is lowercased", "BoGuS 1", "ACK [5@0] {bogus} unknown command"},
+		{"malformed quoting", `add "abc`, `ACK [2@0] {add} missing closing '"'`},
+		{"invalid position", "play abc", "ACK [2@0] {play} invalid position"},
+		{"position past the queue", "play 5", "ACK [50@0] {play} failed to seek to position 5: invalid track index: 5"},
+		{"missing song ID", "moveid 7 0", "ACK [50@0] {moveid} No such song: 7"},
+		{"invalid volume", "setvol 200", "ACK [2@0] {setvol} Invalid volume value"},
+		{"invalid time", "seekcur x", "ACK [2@0] {seekcur} invalid time"},
+		{"binary limit too small", "binarylimit 10", "ACK [2@0] {binarylimit} Value too small (minimum 64)"},
+		{"missing arguments", "addtagid 0", "ACK [2@0] {addtagid} missing arguments"},
+		{"missing playlist name", "save", "ACK [2@0] {save} missing playlist name"},
+		{"missing playlist", "load nosuch", "ACK [50@0] {load} no such playlist: nosuch"},
+		{"no database", "list artist", "ACK [50@0] {list} No database"},
+		{"invalid channel name", `subscribe "bad name!"`, "ACK [2@0] {subscribe} invalid channel name"},
+		{"no subscribers", "sendmessage nochan hi", "ACK [50@0] {sendmessage} nobody is subscribed to this channel"},
+		{"admin command over TCP", "kill", "ACK [4@0] {kill} Permission denied"},
+		{"config over TCP", "config", "ACK [4@0] {config} Permission denied"},
+	}
+
+	c := dial(t, newTestServer(t))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := last(c.command(tt.command)); got != tt.want {
+				t.Errorf("%s: got %q, want %q", tt.command, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestACKPlaylistExists(t *testing.T) {
+	c := dial(t, newTestServer(t))
+	if got := last(c.command("save mine")); got != "OK" {
+		t.Fatalf("save mine: %q", got)
+	}
+	if got, want := last(c.command("save mine")), "ACK [56@0] {save} playlist already exists: mine"; got != want {
+		t.Errorf("second save: got %q, want %q", got, want)
+	}
+}
+
+func TestACKCommandList(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string
+	}{
+		{
+			"all succeed",
+			[]string{"command_list_begin", "ping", "ping", "command_list_end"},
+			[]string{"OK"},
+		},
+		{
+			"list_OK after each command",
+			[]string{"command_list_ok_begin", "ping", "ping", "command_list_end"},
+			[]string{"list_OK", "list_OK", "OK"},
+		},
+		{
+			"failure reports its position",
+			[]string{"command_list_begin", "ping", "ping", "play abc", "command_list_end"},
+			[]string{"ACK [2@2] {play} invalid position"},
+		},
+		{
+			"commands after a failure are skipped",
+			[]string{"command_list_ok_begin", "ping", "bogus", "save skipped", "command_list_end"},
+			[]string{"list_OK", "ACK [5@1] {bogus} unknown command"},
+		},
+	}
+
+	s := newTestServer(t)
+	c := dial(t, s)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := c.command(tt.lines...)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// The index starts over with the next list, and skipped commands never ran
+	if got := last(c.command("load skipped")); got != "ACK [50@0] {load} no such playlist: skipped" {
+		t.Errorf("load skipped: %q", got)
+	}
+}
@@ -0,0 +1,105 @@
+package mpd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Binary chunk size limits for binarylimit (MPD's defaults)
+const (
+	defaultBinaryLimit = 8192
+	minBinaryLimit     = 64
+)
+
+// clientState holds settings that belong to a single client connection
+type clientState struct {
+	out         *responseWriter // Buffered output to the client; listings stream into it
+	binaryLimit int             // Largest binary payload per response
+	local       bool            // Connected over the unix socket, trusted with local paths and admin commands
+	closing     bool            // Set by commands after which the connection is closed without a response
+
+	features map[string]bool // Protocol features enabled with the protocol command
+	tags     map[string]bool // Tag types enabled with the tagtypes command
+
+	// Channel messaging; other connections deliver messages here
+	mu            sync.Mutex
+	subscriptions map[string]bool // Channels the client is subscribed to
+	messages      []message       // Messages not yet read with readmessages
+}
+
+// newClientState returns the settings of a freshly connected client
+func newClientState(conn net.Conn) *clientState {
+	return &clientState{
+		out:           newResponseWriter(conn),
+		binaryLimit:   defaultBinaryLimit,
+		local:         isLocalAddr(conn.RemoteAddr()),
+		subscriptions: make(map[string]bool),
+		features:      make(map[string]bool),
+		tags:          allTagTypes(),
+	}
+}
+
+// hasMessages reports whether the client has unread messages
+func (c *clientState) hasMessages() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.messages) > 0
+}
+
+// writeBinaryChunk formats the chunk of data starting at offset for a binary response
+// The chunk is at most the client's binary limit; header lines (e.g. "type: image/png")
+// are sent between the total size and the binary payload
+func (c *clientState) writeBinaryChunk(data []byte, offset int, header string) string {
+	end := offset + c.binaryLimit
+	if end > len(data) {
+		end = len(data)
+	}
+	chunk := data[offset:end]
+
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("size: %d\n", len(data)))
+	response.WriteString(header)
+	response.WriteString(fmt.Sprintf("binary: %d\n", len(chunk)))
+	response.Write(chunk)
+	response.WriteString("\nOK\n")
+
+	return response.String()
+}
+
+// cmdBinaryLimit handles the 'binarylimit' command
+// binarylimit {SIZE} - set the largest binary chunk sent to this client
+func (s *Server) cmdBinaryLimit(client *clientState, args []string) (string, *ackError) {
+	if len(args) == 0 {
+		return "", ack(ackErrorArg, "binarylimit", "missing argument")
+	}
+
+	arg := args[0]
+
+	limit, err := strconv.Atoi(arg)
+	if err != nil {
+		return "", ack(ackErrorArg, "binarylimit", "invalid size")
+	}
+	if limit < minBinaryLimit {
+		return "", ack(ackErrorArg, "binarylimit", "Value too small (minimum %d)", minBinaryLimit)
+	}
+
+	client.binaryLimit = limit
+	return "OK\n", nil
+}
+
+// maxLoggedResponse is the longest response logged in full
+const maxLoggedResponse = 1024
+
+// responseForLog returns a response with any binary payload elided and long responses cut short
+func responseForLog(response string) string {
+	if i := strings.Index(response, "binary: "); i >= 0 {
+		return response[:i] + "binary: <elided>\n"
+	}
+	if len(response) > maxLoggedResponse {
+		return fmt.Sprintf("%s... <%d bytes>\n", response[:maxLoggedResponse], len(response))
+	}
+	return response
+}
@@ -18,6 +18,11 @@ func (s *Server) handleConnection(conn net.Conn) {
 	// Send MPD greeting
 	fmt.Fprintf(conn, "OK MPD 0.25.0\n")
 
+	// Per-connection settings (binarylimit, ...)
+	client := newClientState(conn)
+	s.registerClient(client)
+	defer s.unregisterClient(client)
+
 	// Create connection-specific idle state
 	var currentIdle *idleConnection
 	var idleMu sync.Mutex
@@ -25,7 +30,8 @@ func (s *Server) handleConnection(conn net.Conn) {
 	scanner := bufio.NewScanner(conn)
 	inCommandList := false
 	commandListOk := false // Track if we need list_OK after each command
-	var commandListResponses strings.Builder
+	commandListIndex := 0  // Position of the next command in the list, reported in ACKs
+	commandListFailed := false
 
 	// Cleanup idle connection on disconnect
 	defer func() {
@@ -45,35 +51,39 @@ func (s *Server) handleConnection(conn net.Conn) {
 		log.Printf("MPD command: %s", line)
 
 		// Handle command list mode
-		if line == "command_list_begin" {
-			inCommandList = true
-			commandListOk = false
-			commandListResponses.Reset()
-			continue
-		}
-
-		if line == "command_list_ok_begin" {
+		if line == "command_list_begin" || line == "command_list_ok_begin" {
 			inCommandList = true
-			commandListOk = true
-			commandListResponses.Reset()
+			commandListOk = line == "command_list_ok_begin"
+			commandListIndex = 0
+			commandListFailed = false
 			continue
 		}
 
 		if line == "command_list_end" {
 			if inCommandList {
-				// Send all buffered responses
-				fmt.Fprint(conn, commandListResponses.String())
-				fmt.Fprint(conn, "OK\n")
+				// Send the list's responses; a failed list ends with its ACK instead of OK
+				if !commandListFailed {
+					client.out.writeResponse("OK\n")
+				}
 				inCommandList = false
 				commandListOk = false
-				commandListResponses.Reset()
+				if err := client.out.Flush(); err != nil {
+					log.Printf("Failed to send response: %v", err)
+					break
+				}
 			}
 			continue
 		}
 
+		// Commands after a failure in a command list are not executed
+		if inCommandList && commandListFailed {
+			continue
+		}
+
 		// Check for idle/noidle commands which need special handling
-		parts := strings.Fields(line)
+		parts, _ := tokenize(line) // Malformed lines are reported by handleCommand
 		var response string
+		var ackErr *ackError
 
 		if len(parts) > 0 {
 			cmd := strings.ToLower(parts[0])
@@ -99,6 +109,12 @@ func (s *Server) handleConnection(conn net.Conn) {
 					subsystems: subsystems,
 					notify:     make(chan string, 10),
 					cancel:     make(chan struct{}),
+					client:     client,
+				}
+
+				// Messages that arrived before idle was entered are reported straight away
+				if (len(subsystems) == 0 || subsystems["message"]) && client.hasMessages() {
+					idle.notify <- "message"
 				}
 				currentIdle = idle
 				s.registerIdle(idle)
@@ -132,28 +148,52 @@ func (s *Server) handleConnection(conn net.Conn) {
 
 			} else {
 				// Normal command processing
-				response = s.handleCommand(line)
+				response, ackErr = s.handleCommand(client, line)
 			}
 		} else {
-			response = s.handleCommand(line)
+			response, ackErr = s.handleCommand(client, line)
 		}
 
-		log.Printf(response)
+		if streamed := client.out.takeStreamed(); streamed > 0 {
+			log.Printf("Streamed %d bytes", streamed)
+		}
+		if client.closing {
+			break
+		}
+		if ackErr != nil {
+			// Report the failing command's position and stop the list there
+			if inCommandList {
+				ackErr.index = commandListIndex
+				commandListFailed = true
+			}
+			response = ackErr.Error()
+		}
+		log.Printf("%s", responseForLog(response))
 
 		if inCommandList {
-			// Buffer response (strip the final OK)
+			if ackErr != nil {
+				client.out.writeResponse(response)
+				continue
+			}
+			commandListIndex++
+
+			// Queue response until the list ends (strip the final OK)
 			if strings.HasSuffix(response, "OK\n") {
 				response = strings.TrimSuffix(response, "OK\n")
 			}
-			commandListResponses.WriteString(response)
+			client.out.writeResponse(response)
 
 			// For command_list_ok_begin, add list_OK after each command
 			if commandListOk {
-				commandListResponses.WriteString("list_OK\n")
+				client.out.writeResponse("list_OK\n")
 			}
 		} else {
 			// Send response immediately
-			fmt.Fprint(conn, response)
+			client.out.writeResponse(response)
+			if err := client.out.Flush(); err != nil {
+				log.Printf("Failed to send response: %v", err)
+				break
+			}
 		}
 	}
 
@@ -162,4 +202,12 @@ func (s *Server) handleConnection(conn net.Conn) {
 	}
 
 	log.Printf("MPD client disconnected: %s", conn.RemoteAddr())
+}
+
+// isLocalAddr reports whether a client connected over the unix socket
+// Loopback TCP does not count: any user on the machine, or a proxy forwarding
+// remote clients, can reach it, while the socket's file permissions limit who connects
+func isLocalAddr(addr net.Addr) bool {
+	_, ok := addr.(*net.UnixAddr)
+	return ok
 }
\ No newline at end of file
@@ -0,0 +1,158 @@
+package mpd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/famish99/direttampd/internal/decoder"
+)
+
+// coverFileNames lists the cover art file names looked up next to a track, in order
+var coverFileNames = []string{
+	"cover.png", "cover.jpg", "cover.jpeg", "cover.webp",
+	"folder.png", "folder.jpg", "folder.jpeg", "folder.webp",
+	"front.png", "front.jpg", "front.jpeg",
+	"albumart.jpg", "albumart.png",
+}
+
+// pictureCache keeps the last extracted embedded picture
+// Clients fetch a picture in many readpicture calls, which would otherwise
+// run ffmpeg once per chunk
+type pictureCache struct {
+	mu      sync.Mutex
+	uri     string
+	picture *decoder.Picture // nil if the file has no picture
+}
+
+// get returns the embedded picture of the file at source, extracting it if needed
+func (c *pictureCache) get(source string) (*decoder.Picture, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.uri == source {
+		return c.picture, nil
+	}
+
+	picture, err := decoder.ExtractPicture(source)
+	if err != nil {
+		return nil, err
+	}
+
+	c.uri = source
+	c.picture = picture
+	return picture, nil
+}
+
+// localFilePath returns the filesystem path of a song URI
+// Database URIs, absolute paths and file:// URIs are local; anything else is not
+func (s *Server) localFilePath(uri string) (string, bool) {
+	path := strings.TrimPrefix(s.resolveURI(uri), "file://")
+	if !filepath.IsAbs(path) {
+		return "", false
+	}
+	return path, true
+}
+
+// findCoverFile returns the cover art file in the directory of a track
+// File names are matched case-insensitively
+func findCoverFile(trackPath string) (string, bool) {
+	entries, err := os.ReadDir(filepath.Dir(trackPath))
+	if err != nil {
+		return "", false
+	}
+
+	byName := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			byName[strings.ToLower(entry.Name())] = entry.Name()
+		}
+	}
+
+	for _, name := range coverFileNames {
+		if actual, ok := byName[name]; ok {
+			return filepath.Join(filepath.Dir(trackPath), actual), true
+		}
+	}
+	return "", false
+}
+
+// parseOffsetArg parses the OFFSET argument of a binary command
+func parseOffsetArg(arg string) (int, error) {
+	offset, err := strconv.Atoi(arg)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid offset")
+	}
+	return offset, nil
+}
+
+// cmdAlbumArt handles the 'albumart' command
+// albumart {URI} {OFFSET} - read the cover image file next to a song, in chunks
+func (s *Server) cmdAlbumArt(client *clientState, args []string) (string, *ackError) {
+	if len(args) < 2 {
+		return "", ack(ackErrorArg, "albumart", "missing arguments")
+	}
+
+	offset, err := parseOffsetArg(args[1])
+	if err != nil {
+		return "", ack(ackErrorArg, "albumart", "invalid offset")
+	}
+
+	trackPath, ok := s.localFilePath(args[0])
+	if !ok {
+		return "", ack(ackErrorNoExist, "albumart", "No file exists")
+	}
+
+	coverPath, ok := findCoverFile(trackPath)
+	if !ok {
+		return "", ack(ackErrorNoExist, "albumart", "No file exists")
+	}
+
+	data, err := os.ReadFile(coverPath)
+	if err != nil {
+		return "", ack(ackErrorSystem, "albumart", "%v", err)
+	}
+	if offset > len(data) {
+		return "", ack(ackErrorArg, "albumart", "Offset too large")
+	}
+
+	return client.writeBinaryChunk(data, offset, ""), nil
+}
+
+// cmdReadPicture handles the 'readpicture' command
+// readpicture {URI} {OFFSET} - read the picture embedded in a song, in chunks
+// Responds with just OK if the song has no embedded picture
+func (s *Server) cmdReadPicture(client *clientState, args []string) (string, *ackError) {
+	if len(args) < 2 {
+		return "", ack(ackErrorArg, "readpicture", "missing arguments")
+	}
+
+	offset, err := parseOffsetArg(args[1])
+	if err != nil {
+		return "", ack(ackErrorArg, "readpicture", "invalid offset")
+	}
+
+	source, ok := s.localFilePath(args[0])
+	if !ok {
+		source = args[0]
+		if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+			return "", ack(ackErrorNoExist, "readpicture", "No file exists")
+		}
+	}
+
+	picture, err := s.pictures.get(source)
+	if err != nil {
+		return "", ack(ackErrorNoExist, "readpicture", "%v", err)
+	}
+	if picture == nil {
+		return "OK\n", nil
+	}
+	if offset > len(picture.Data) {
+		return "", ack(ackErrorArg, "readpicture", "Offset too large")
+	}
+
+	return client.writeBinaryChunk(picture.Data, offset, fmt.Sprintf("type: %s\n", picture.MIMEType)), nil
+}
@@ -0,0 +1,575 @@
+package mpd
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/famish99/direttampd/internal/database"
+	"github.com/famish99/direttampd/internal/playlist"
+)
+
+// cmdUpdate handles the 'update' command
+// update [URI] - scan the music directory (or a subtree) for changed files
+func (s *Server) cmdUpdate(args []string) (string, *ackError) {
+	return s.startDatabaseUpdate("update", args, false)
+}
+
+// cmdRescan handles the 'rescan' command
+// rescan [URI] - like update, but also re-reads tags of unmodified files
+func (s *Server) cmdRescan(args []string) (string, *ackError) {
+	return s.startDatabaseUpdate("rescan", args, true)
+}
+
+// startDatabaseUpdate starts a background database update and reports its job ID
+func (s *Server) startDatabaseUpdate(command string, args []string, rescan bool) (string, *ackError) {
+	uri := ""
+	if len(args) > 0 {
+		uri = args[0]
+	}
+
+	job, err := s.db.StartUpdate(uri, rescan, s.databaseUpdated)
+	if err != nil {
+		return "", ack(ackErrorArg, command, "%v", err)
+	}
+
+	// Notify idle connections that an update started
+	s.NotifySubsystemChange("update")
+
+	return fmt.Sprintf("updating_db: %d\nOK\n", job), nil
+}
+
+// autoUpdateDirectory starts an update for a directory the file watcher saw change
+func (s *Server) autoUpdateDirectory(uri string) {
+	if _, err := s.db.StartUpdate(uri, false, s.databaseUpdated); err != nil {
+		log.Printf("Failed to start automatic database update: %v", err)
+		return
+	}
+
+	// Notify idle connections that an update started
+	s.NotifySubsystemChange("update")
+}
+
+// databaseUpdated is called when a database update job finishes
+func (s *Server) databaseUpdated(changed bool, _ error) {
+	if changed {
+		s.NotifySubsystemChange("database")
+	}
+	s.NotifySubsystemChange("update")
+}
+
+// parseDatabaseURIArg returns the normalized database URI in args[0] ("" for the root)
+func parseDatabaseURIArg(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", nil
+	}
+
+	uri := args[0]
+	return database.CleanURI(uri)
+}
+
+// databaseTrack wraps a database song in a track so it can use formatSongInfo
+func databaseTrack(song *database.Song) *playlist.Track {
+	return &playlist.Track{
+		ID:       -1,
+		URL:      song.URI,
+		Metadata: song.Metadata,
+	}
+}
+
+// formatDatabaseSong formats a database song with its modification time
+func (s *Server) formatDatabaseSong(client *clientState, song *database.Song) string {
+	return s.formatSongInfo(client, databaseTrack(song)) +
+		fmt.Sprintf("Last-Modified: %s\n", song.ModTime.UTC().Format(time.RFC3339))
+}
+
+// formatDatabaseDirectory formats a directory entry with its modification time
+func (s *Server) formatDatabaseDirectory(uri string) string {
+	entry := fmt.Sprintf("directory: %s\n", uri)
+	if modTime, ok := s.db.DirectoryModTime(uri); ok {
+		entry += fmt.Sprintf("Last-Modified: %s\n", modTime.UTC().Format(time.RFC3339))
+	}
+	return entry
+}
+
+// cmdLsInfo handles the 'lsinfo' command
+// lsinfo [URI] - list the directories, songs and (at the root) stored playlists in a directory
+func (s *Server) cmdLsInfo(client *clientState, args []string) (string, *ackError) {
+	uri, err := parseDatabaseURIArg(args)
+	if err != nil {
+		return "", ack(ackErrorArg, "lsinfo", "%v", err)
+	}
+
+	var response strings.Builder
+
+	if s.db.Enabled() {
+		// A song URI describes just that song
+		if song, ok := s.db.Get(uri); ok {
+			response.WriteString(s.formatDatabaseSong(client, song))
+			response.WriteString("OK\n")
+			return response.String(), nil
+		}
+
+		dirs, songs, err := s.db.List(uri)
+		if err != nil {
+			return "", ack(ackErrorNoExist, "lsinfo", "No such directory")
+		}
+		for _, dir := range dirs {
+			response.WriteString(s.formatDatabaseDirectory(dir))
+		}
+		for _, song := range songs {
+			response.WriteString(s.formatDatabaseSong(client, song))
+		}
+	} else if uri != "" {
+		return "", ack(ackErrorNoExist, "lsinfo", "No such directory")
+	}
+
+	// The root also lists stored playlists, for clients that browse them this way
+	// Clients that use listplaylists instead can hide them with the protocol command
+	if uri == "" && !client.features["hide_playlists_in_root"] {
+		if playlists, err := s.playlists.List(); err == nil {
+			for _, info := range playlists {
+				response.WriteString(fmt.Sprintf("playlist: %s\n", info.Name))
+				response.WriteString(fmt.Sprintf("Last-Modified: %s\n", info.LastModified.UTC().Format(time.RFC3339)))
+			}
+		}
+	}
+
+	response.WriteString("OK\n")
+	return response.String(), nil
+}
+
+// cmdListAll handles the 'listall' command
+// listall [URI] - recursively list all directories and files below URI
+func (s *Server) cmdListAll(client *clientState, args []string) (string, *ackError) {
+	return s.listAllDatabase(client, "listall", args, false)
+}
+
+// cmdListAllInfo handles the 'listallinfo' command
+// listallinfo [URI] - like listall, but with song metadata
+func (s *Server) cmdListAllInfo(client *clientState, args []string) (string, *ackError) {
+	return s.listAllDatabase(client, "listallinfo", args, true)
+}
+
+// listAllDatabase implements listall and listallinfo
+func (s *Server) listAllDatabase(client *clientState, command string, args []string, withInfo bool) (string, *ackError) {
+	uri, err := parseDatabaseURIArg(args)
+	if err != nil {
+		return "", ack(ackErrorArg, command, "%v", err)
+	}
+
+	var response strings.Builder
+
+	// A song URI lists just that song
+	if song, ok := s.db.Get(uri); ok {
+		if withInfo {
+			response.WriteString(s.formatDatabaseSong(client, song))
+		} else {
+			response.WriteString(fmt.Sprintf("file: %s\n", song.URI))
+		}
+		response.WriteString("OK\n")
+		return response.String(), nil
+	}
+
+	entries, err := s.db.Walk(uri)
+	if err != nil {
+		return "", ack(ackErrorNoExist, command, "%v", err)
+	}
+
+	for _, entry := range entries {
+		switch {
+		case entry.Song == nil && withInfo:
+			client.out.WriteString(s.formatDatabaseDirectory(entry.Directory))
+		case entry.Song == nil:
+			client.out.WriteString(fmt.Sprintf("directory: %s\n", entry.Directory))
+		case withInfo:
+			client.out.WriteString(s.formatDatabaseSong(client, entry.Song))
+		default:
+			client.out.WriteString(fmt.Sprintf("file: %s\n", entry.Song.URI))
+		}
+	}
+
+	return "OK\n", nil
+}
+
+// songQuery is a parsed find/search request
+type songQuery struct {
+	filter      database.Filter
+	sortBy      string // Tag to sort by ("" for URI order)
+	windowStart int
+	windowEnd   int // -1 for no upper bound
+}
+
+// parseSongQuery parses the arguments shared by find, search and their variants:
+// either a filter expression or legacy TYPE VALUE pairs, then optional
+// "sort TYPE" and "window START:END" arguments
+// foldCase selects search semantics (case-insensitive, legacy pairs match substrings)
+func parseSongQuery(args []string, foldCase bool) (*songQuery, error) {
+	query := &songQuery{windowEnd: -1}
+
+	// Split off trailing sort/window arguments
+	var filterArgs []string
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "sort":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("missing sort type")
+			}
+			query.sortBy = args[i+1]
+			i++
+			continue
+		case "window":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("missing window range")
+			}
+			start, end, err := parseRangeArg(args[i+1])
+			if err != nil || start < 0 {
+				return nil, fmt.Errorf("invalid window range")
+			}
+			query.windowStart, query.windowEnd = start, end
+			i++
+			continue
+		}
+		filterArgs = append(filterArgs, args[i])
+	}
+
+	filter, err := parseFilterArgs(filterArgs, foldCase)
+	if err != nil {
+		return nil, err
+	}
+	query.filter = filter
+
+	return query, nil
+}
+
+// parseFilterArgs parses already split filter arguments: either one filter
+// expression or legacy TYPE VALUE pairs (exact match, or substring match with foldCase)
+func parseFilterArgs(filterArgs []string, foldCase bool) (database.Filter, error) {
+	if len(filterArgs) == 0 {
+		return nil, fmt.Errorf("missing filter")
+	}
+
+	// Modern filter expression
+	if strings.HasPrefix(filterArgs[0], "(") {
+		if len(filterArgs) > 1 {
+			return nil, fmt.Errorf("unexpected arguments after filter expression")
+		}
+		return database.ParseFilter(filterArgs[0], foldCase)
+	}
+
+	if len(filterArgs)%2 != 0 {
+		return nil, fmt.Errorf("incorrect number of filter arguments")
+	}
+	op := "=="
+	if foldCase {
+		op = "contains"
+	}
+
+	var filters []database.Filter
+	for i := 0; i < len(filterArgs); i += 2 {
+		filter, err := database.NewTagFilter(filterArgs[i], op, filterArgs[i+1], foldCase)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+	return database.And(filters...), nil
+}
+
+// run returns the database songs matching the query, sorted and windowed
+func (q *songQuery) run(db *database.Database) []*database.Song {
+	songs := db.Find(q.filter)
+	if q.sortBy != "" {
+		database.SortSongs(songs, q.sortBy)
+	}
+
+	end := q.windowEnd
+	if end < 0 || end > len(songs) {
+		end = len(songs)
+	}
+	if q.windowStart >= end {
+		return nil
+	}
+	return songs[q.windowStart:end]
+}
+
+// cmdFind handles the 'find' command
+// find {FILTER} [sort TYPE] [window START:END] - list songs exactly matching the filter
+func (s *Server) cmdFind(client *clientState, args []string) (string, *ackError) {
+	return s.findSongs(client, "find", args, false)
+}
+
+// cmdSearch handles the 'search' command
+// search {FILTER} [sort TYPE] [window START:END] - like find, but case-insensitive
+func (s *Server) cmdSearch(client *clientState, args []string) (string, *ackError) {
+	return s.findSongs(client, "search", args, true)
+}
+
+// findSongs implements find and search
+func (s *Server) findSongs(client *clientState, command string, args []string, foldCase bool) (string, *ackError) {
+	if !s.db.Enabled() {
+		return "", ack(ackErrorNoExist, command, "No database")
+	}
+
+	query, err := parseSongQuery(args, foldCase)
+	if err != nil {
+		return "", ack(ackErrorArg, command, "%v", err)
+	}
+
+	for _, song := range query.run(s.db) {
+		client.out.WriteString(s.formatDatabaseSong(client, song))
+	}
+
+	return "OK\n", nil
+}
+
+// cmdFindAdd handles the 'findadd' command
+// findadd {FILTER} [sort TYPE] [window START:END] [position POS] - queue songs exactly matching the filter
+func (s *Server) cmdFindAdd(args []string) (string, *ackError) {
+	return s.addFoundSongs("findadd", args, false)
+}
+
+// cmdSearchAdd handles the 'searchadd' command
+// searchadd {FILTER} [sort TYPE] [window START:END] [position POS] - like findadd, but case-insensitive
+func (s *Server) cmdSearchAdd(args []string) (string, *ackError) {
+	return s.addFoundSongs("searchadd", args, true)
+}
+
+// addFoundSongs implements findadd and searchadd
+func (s *Server) addFoundSongs(command string, args []string, foldCase bool) (string, *ackError) {
+	if !s.db.Enabled() {
+		return "", ack(ackErrorNoExist, command, "No database")
+	}
+
+	// Split off the trailing "position POS" argument
+	var position *int
+	if n := len(args); n >= 2 && strings.EqualFold(args[n-2], "position") {
+		pos, err := parseIntArg(args[n-1])
+		if err != nil || pos < 0 {
+			return "", ack(ackErrorArg, command, "invalid position")
+		}
+		position = &pos
+		args = args[:n-2]
+	}
+
+	query, err := parseSongQuery(args, foldCase)
+	if err != nil {
+		return "", ack(ackErrorArg, command, "%v", err)
+	}
+
+	songs := query.run(s.db)
+	for i, song := range songs {
+		if position != nil {
+			pos := *position + i
+			s.addTrackToPlaylist(s.db.Locate(song.URI), &pos)
+		} else {
+			s.addTrackToPlaylist(s.db.Locate(song.URI), nil)
+		}
+	}
+
+	if len(songs) > 0 {
+		// Notify idle connections of playlist change
+		s.NotifySubsystemChange("playlist")
+	}
+
+	return "OK\n", nil
+}
+
+// listValue returns the value of a list type for a song
+// The type "file" lists song URIs; anything else is a tag
+func listValue(tag string, song *database.Song) string {
+	if tag == "file" {
+		return song.URI
+	}
+	return song.Metadata[tag]
+}
+
+// cmdList handles the 'list' command
+// list {TYPE} [FILTER] [group GROUPTYPE ...] - list the unique values of a tag
+// The legacy form "list album ARTIST" restricts albums to one artist
+func (s *Server) cmdList(args []string) (string, *ackError) {
+	if !s.db.Enabled() {
+		return "", ack(ackErrorNoExist, "list", "No database")
+	}
+
+	if len(args) == 0 {
+		return "", ack(ackErrorArg, "list", "missing tag type")
+	}
+
+	listTag := strings.ToLower(args[0])
+	if listTag != "file" {
+		tag, ok := parseTagArg(args[0])
+		if !ok {
+			return "", ack(ackErrorArg, "list", "unknown tag type: %s", args[0])
+		}
+		listTag = tag
+	}
+
+	// Split off "group TYPE" arguments; the first group is the outermost
+	var groups, filterArgs []string
+	for i := 1; i < len(args); i++ {
+		if strings.EqualFold(args[i], "group") {
+			if i+1 >= len(args) {
+				return "", ack(ackErrorArg, "list", "missing group type")
+			}
+			tag, ok := parseTagArg(args[i+1])
+			if !ok {
+				return "", ack(ackErrorArg, "list", "unknown tag type: %s", args[i+1])
+			}
+			groups = append(groups, tag)
+			i++
+			continue
+		}
+		filterArgs = append(filterArgs, args[i])
+	}
+
+	// Legacy "list album ARTIST"
+	if listTag == "album" && len(filterArgs) == 1 && !strings.HasPrefix(filterArgs[0], "(") {
+		filterArgs = []string{"artist", filterArgs[0]}
+	}
+
+	songs := s.db.Songs()
+	if len(filterArgs) > 0 {
+		filter, err := parseFilterArgs(filterArgs, false)
+		if err != nil {
+			return "", ack(ackErrorArg, "list", "%v", err)
+		}
+		songs = s.db.Find(filter)
+	}
+
+	// Collect unique (group values..., value) rows
+	seen := make(map[string]bool)
+	var rows [][]string
+	for _, song := range songs {
+		value := listValue(listTag, song)
+		if value == "" {
+			continue
+		}
+
+		row := make([]string, 0, len(groups)+1)
+		for _, group := range groups {
+			row = append(row, song.Metadata[group])
+		}
+		row = append(row, value)
+
+		key := strings.Join(row, "\x00")
+		if !seen[key] {
+			seen[key] = true
+			rows = append(rows, row)
+		}
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		for k := range rows[i] {
+			if rows[i][k] != rows[j][k] {
+				return rows[i][k] < rows[j][k]
+			}
+		}
+		return false
+	})
+
+	field := "file"
+	if listTag != "file" {
+		field = metadataFields[listTag]
+	}
+
+	// Print group headers only when they change from the previous row
+	var response strings.Builder
+	var previous []string
+	for _, row := range rows {
+		for k, group := range groups {
+			if previous == nil || changedAt(previous, row, k) {
+				response.WriteString(fmt.Sprintf("%s: %s\n", metadataFields[group], row[k]))
+			}
+		}
+		response.WriteString(fmt.Sprintf("%s: %s\n", field, row[len(row)-1]))
+		previous = row
+	}
+	response.WriteString("OK\n")
+
+	return response.String(), nil
+}
+
+// changedAt returns true if row differs from previous in any column up to and including k
+func changedAt(previous, row []string, k int) bool {
+	for i := 0; i <= k; i++ {
+		if previous[i] != row[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// cmdMount handles the 'mount' command
+// mount {PATH} {URI} - mount storage (file://, http(s)://, dav(s)://, nfs://, smb://, upnp://) into the database tree
+// NFS and SMB shares are mounted with the system mount helpers, which needs root or CAP_SYS_ADMIN
+func (s *Server) cmdMount(args []string) (string, *ackError) {
+	if len(args) < 2 {
+		return "", ack(ackErrorArg, "mount", "missing arguments")
+	}
+
+	if err := s.db.Mount(args[0], args[1]); err != nil {
+		return "", ack(ackErrorArg, "mount", "%v", err)
+	}
+
+	// Notify idle connections of mount change
+	s.NotifySubsystemChange("mount")
+
+	// Index the new storage right away
+	s.autoUpdateDirectory(args[0])
+
+	return "OK\n", nil
+}
+
+// cmdUnmount handles the 'unmount' command
+// unmount {PATH} - unmount storage and remove its songs from the database
+func (s *Server) cmdUnmount(args []string) (string, *ackError) {
+	if len(args) == 0 {
+		return "", ack(ackErrorArg, "unmount", "missing mount point")
+	}
+
+	if err := s.db.Unmount(args[0]); err != nil {
+		return "", ack(ackErrorArg, "unmount", "%v", err)
+	}
+
+	// Notify idle connections of mount and database change
+	s.NotifySubsystemChange("mount")
+	s.NotifySubsystemChange("database")
+
+	return "OK\n", nil
+}
+
+// cmdListMounts handles the 'listmounts' command
+// Lists the music directory (mounted at the root) and all mounted storages
+func (s *Server) cmdListMounts(_ []string) (string, *ackError) {
+	if !s.db.Enabled() {
+		return "", ack(ackErrorNoExist, "listmounts", "No database")
+	}
+
+	var response strings.Builder
+	response.WriteString("mount: \n")
+	response.WriteString(fmt.Sprintf("storage: %s\n", s.db.Root()))
+	for _, mount := range s.db.Mounts() {
+		response.WriteString(fmt.Sprintf("mount: %s\n", mount.Point))
+		response.WriteString(fmt.Sprintf("storage: %s\n", mount.URI))
+	}
+	response.WriteString("OK\n")
+
+	return response.String(), nil
+}
+
+// cmdListNeighbors handles the 'listneighbors' command
+// Usage: listneighbors
+// Lists SMB shares, WebDAV servers and UPnP media servers found on the local network, ready to mount
+func (s *Server) cmdListNeighbors(_ []string) (string, *ackError) {
+	var response strings.Builder
+	for _, neighbor := range s.neighbors.Neighbors() {
+		response.WriteString(fmt.Sprintf("neighbor: %s\n", neighbor.URI))
+		response.WriteString(fmt.Sprintf("name: %s\n", neighbor.Name))
+	}
+	response.WriteString("OK\n")
+
+	return response.String(), nil
+}
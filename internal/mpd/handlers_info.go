@@ -5,22 +5,38 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/famish99/direttampd/internal/player"
+	"github.com/famish99/direttampd/internal/replaygain"
 )
 
 // cmdStatus handles the 'status' command
-func (s *Server) cmdStatus(_ []string) string {
+func (s *Server) cmdStatus(_ []string) (string, *ackError) {
 	pl := s.player.GetPlaylist()
 
 	var status strings.Builder
-	status.WriteString("volume: 100\n")
-	status.WriteString("repeat: 0\n")
-	status.WriteString("random: 0\n")
+	// Without a mixer the volume line is omitted, as MPD does
+	if volume := s.player.GetVolume(); volume >= 0 {
+		status.WriteString(fmt.Sprintf("volume: %d\n", volume))
+	}
+	if s.player.IsRepeat() {
+		status.WriteString("repeat: 1\n")
+	} else {
+		status.WriteString("repeat: 0\n")
+	}
+	if s.player.IsRandom() {
+		status.WriteString("random: 1\n")
+	} else {
+		status.WriteString("random: 0\n")
+	}
 	status.WriteString("single: 0\n")
 	status.WriteString("consume: 0\n")
 	status.WriteString(fmt.Sprintf("playlist: %d\n", pl.GetVersion()))
 	status.WriteString(fmt.Sprintf("playlistlength: %d\n", pl.Length()))
+	if crossfade := s.player.GetCrossfade(); crossfade > 0 {
+		status.WriteString(fmt.Sprintf("xfade: %d\n", crossfade))
+	}
 
 	// Get actual playback state
 	state := s.player.GetState()
@@ -38,7 +54,9 @@ func (s *Server) cmdStatus(_ []string) string {
 	status.WriteString(fmt.Sprintf("state: %s\n", stateStr))
 
 	status.WriteString(fmt.Sprintf("song: %d\n", pl.CurrentIndex()))
-	status.WriteString(fmt.Sprintf("songid: %d\n", pl.CurrentIndex()))
+	if track, err := pl.Current(); err == nil {
+		status.WriteString(fmt.Sprintf("songid: %d\n", track.ID))
+	}
 
 	// Add timing information if available
 	timing := s.player.GetPlaybackTiming()
@@ -47,131 +65,299 @@ func (s *Server) cmdStatus(_ []string) string {
 		status.WriteString(fmt.Sprintf("time: %d:%d\n", int(timing.Elapsed), int(timing.Duration)))
 
 		// MPD protocol uses "elapsed" for current position and "duration" for total length
-		status.WriteString(fmt.Sprintf("elapsed: %d\n", int(timing.Elapsed)))
+		status.WriteString(fmt.Sprintf("elapsed: %.3f\n", timing.Elapsed))
 		status.WriteString(fmt.Sprintf("duration: %d\n", int(timing.Duration)))
 	}
 
+	// Source bitrate of the song being played
+	if state != player.StateStopped {
+		if track, err := pl.Current(); err == nil && track.Metadata["bitrate"] != "" {
+			status.WriteString(fmt.Sprintf("bitrate: %s\n", track.Metadata["bitrate"]))
+		}
+	}
+
+	// Not part of MPD's status; shows how far along a track still being decoded is
+	if percent, ok := s.player.DecodeProgress(); ok {
+		status.WriteString(fmt.Sprintf("decoding: %d\n", percent))
+	}
+
+	if job := s.db.UpdatingJob(); job > 0 {
+		status.WriteString(fmt.Sprintf("updating_db: %d\n", job))
+	}
+
+	if message := s.player.GetError(); message != "" {
+		status.WriteString(fmt.Sprintf("error: %s\n", message))
+	}
+
 	status.WriteString("OK\n")
 
-	return status.String()
+	return status.String(), nil
 }
 
 // cmdOutputs handles the 'outputs' command
-// Returns the list of audio outputs (in this case, the Diretta target)
-func (s *Server) cmdOutputs(_ []string) string {
-	// Get output name from player
-	outputName := s.player.GetOutputName()
+// Returns the list of audio outputs (one per Diretta target)
+func (s *Server) cmdOutputs(_ []string) (string, *ackError) {
+	var response strings.Builder
+	for id, output := range s.player.GetOutputs() {
+		response.WriteString(fmt.Sprintf("outputid: %d\n", id))
+		response.WriteString(fmt.Sprintf("outputname: %s\n", output.Name))
+		response.WriteString("plugin: diretta\n")
+		if output.Enabled {
+			response.WriteString("outputenabled: 1\n")
+		} else {
+			response.WriteString("outputenabled: 0\n")
+		}
+	}
+	response.WriteString("OK\n")
 
-	// If no output name is available, use a default
-	if outputName == "" {
-		outputName = "Diretta Output"
+	return response.String(), nil
+}
+
+// cmdEnableOutput handles the 'enableoutput' command
+// Usage: enableoutput ID
+func (s *Server) cmdEnableOutput(args []string) (string, *ackError) {
+	return s.setOutput("enableoutput", args, func(bool) bool { return true })
+}
+
+// cmdDisableOutput handles the 'disableoutput' command
+// Usage: disableoutput ID
+func (s *Server) cmdDisableOutput(args []string) (string, *ackError) {
+	return s.setOutput("disableoutput", args, func(bool) bool { return false })
+}
+
+// cmdToggleOutput handles the 'toggleoutput' command
+// Usage: toggleoutput ID
+func (s *Server) cmdToggleOutput(args []string) (string, *ackError) {
+	return s.setOutput("toggleoutput", args, func(enabled bool) bool { return !enabled })
+}
+
+// setOutput enables or disables the output given by args[0]
+// state maps the output's current enabled flag to the new one
+func (s *Server) setOutput(cmd string, args []string, state func(enabled bool) bool) (string, *ackError) {
+	if len(args) == 0 {
+		return "", ack(ackErrorArg, cmd, "missing argument")
+	}
+
+	arg := args[0]
+
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		return "", ack(ackErrorArg, cmd, "invalid argument")
+	}
+
+	outputs := s.player.GetOutputs()
+	if id < 0 || id >= len(outputs) {
+		return "", ack(ackErrorNoExist, cmd, "No such audio output")
+	}
+
+	enabled := state(outputs[id].Enabled)
+	if err := s.player.EnableOutput(id, enabled); err != nil {
+		return "", ack(ackErrorSystem, cmd, "%v", err)
+	}
+	log.Printf("Output %d (%s) enabled: %v", id, outputs[id].Name, enabled)
+
+	// Notify idle connections of output change
+	s.NotifySubsystemChange("output")
+
+	return "OK\n", nil
+}
+
+// cmdConfig handles the 'config' command
+// Reports local paths so clients on the same machine can manage files directly;
+// remote clients are refused, as in MPD
+func (s *Server) cmdConfig(client *clientState) (string, *ackError) {
+	if !client.local {
+		return "", ack(ackErrorPermission, "config", "Permission denied")
 	}
 
 	var response strings.Builder
-	response.WriteString("outputid: 0\n")
-	response.WriteString(fmt.Sprintf("outputname: %s\n", outputName))
-	response.WriteString("outputenabled: 1\n")
+	if s.musicDirectory != "" {
+		response.WriteString(fmt.Sprintf("music_directory: %s\n", s.musicDirectory))
+	}
+	if s.playlistDirectory != "" {
+		response.WriteString(fmt.Sprintf("playlist_directory: %s\n", s.playlistDirectory))
+	}
 	response.WriteString("OK\n")
 
-	return response.String()
+	return response.String(), nil
+}
+
+// cmdKill handles the 'kill' command
+// Requests a clean daemon shutdown; only local clients have this admin permission
+func (s *Server) cmdKill(client *clientState) (string, *ackError) {
+	if !client.local {
+		return "", ack(ackErrorPermission, "kill", "Permission denied")
+	}
+
+	log.Printf("Shutdown requested by client")
+	s.killOnce.Do(func() { close(s.killed) })
+
+	// MPD closes the connection without a response
+	client.closing = true
+	return "", nil
+}
+
+// cmdStats handles the 'stats' command
+// Reports database totals, daemon uptime and time spent playing
+func (s *Server) cmdStats(_ []string) (string, *ackError) {
+	dbStats := s.db.Stats()
+
+	var stats strings.Builder
+	stats.WriteString(fmt.Sprintf("artists: %d\n", dbStats.Artists))
+	stats.WriteString(fmt.Sprintf("albums: %d\n", dbStats.Albums))
+	stats.WriteString(fmt.Sprintf("songs: %d\n", dbStats.Songs))
+	stats.WriteString(fmt.Sprintf("uptime: %d\n", int64(time.Since(s.startTime).Seconds())))
+	stats.WriteString(fmt.Sprintf("db_playtime: %d\n", int64(dbStats.PlayTime)))
+	if lastUpdate := s.db.LastUpdate(); !lastUpdate.IsZero() {
+		stats.WriteString(fmt.Sprintf("db_update: %d\n", lastUpdate.Unix()))
+	}
+	stats.WriteString(fmt.Sprintf("playtime: %d\n", int64(s.player.GetPlayTime().Seconds())))
+	stats.WriteString("OK\n")
+
+	return stats.String(), nil
 }
 
 // cmdSingle handles the 'single' command
 // Sets single mode (play one song and stop)
-func (s *Server) cmdSingle(args []string) string {
+func (s *Server) cmdSingle(args []string) (string, *ackError) {
 	if len(args) == 0 {
-		return "ACK [2@0] {single} missing argument\n"
+		return "", ack(ackErrorArg, "single", "missing argument")
 	}
 
 	// Parse the argument (0 or 1)
 	arg := args[0]
-	if unquoted, err := strconv.Unquote(arg); err == nil {
-		arg = unquoted
-	}
 
 	// Validate argument
 	if arg != "0" && arg != "1" {
-		return "ACK [2@0] {single} invalid argument\n"
+		return "", ack(ackErrorArg, "single", "invalid argument")
 	}
 
 	// For now, accept the command but don't implement the behavior
 	// Single mode would require stopping after one track completes
 	log.Printf("Single mode set to: %s (not implemented)", arg)
 
-	return "OK\n"
+	return "OK\n", nil
 }
 
 // cmdConsume handles the 'consume' command
 // Sets consume mode (remove songs from playlist after playing)
-func (s *Server) cmdConsume(args []string) string {
+func (s *Server) cmdConsume(args []string) (string, *ackError) {
 	if len(args) == 0 {
-		return "ACK [2@0] {consume} missing argument\n"
+		return "", ack(ackErrorArg, "consume", "missing argument")
 	}
 
 	// Parse the argument (0 or 1)
 	arg := args[0]
-	if unquoted, err := strconv.Unquote(arg); err == nil {
-		arg = unquoted
-	}
 
 	// Validate argument
 	if arg != "0" && arg != "1" {
-		return "ACK [2@0] {consume} invalid argument\n"
+		return "", ack(ackErrorArg, "consume", "invalid argument")
 	}
 
 	// For now, accept the command but don't implement the behavior
 	// Consume mode would require removing tracks from playlist after playing
 	log.Printf("Consume mode set to: %s (not implemented)", arg)
 
-	return "OK\n"
+	return "OK\n", nil
 }
 
 // cmdRepeat handles the 'repeat' command
 // Sets repeat mode (repeat playlist)
-func (s *Server) cmdRepeat(args []string) string {
+func (s *Server) cmdRepeat(args []string) (string, *ackError) {
 	if len(args) == 0 {
-		return "ACK [2@0] {repeat} missing argument\n"
+		return "", ack(ackErrorArg, "repeat", "missing argument")
 	}
 
 	// Parse the argument (0 or 1)
 	arg := args[0]
-	if unquoted, err := strconv.Unquote(arg); err == nil {
-		arg = unquoted
-	}
 
 	// Validate argument
 	if arg != "0" && arg != "1" {
-		return "ACK [2@0] {repeat} invalid argument\n"
+		return "", ack(ackErrorArg, "repeat", "invalid argument")
 	}
 
-	// For now, accept the command but don't implement the behavior
-	// Repeat mode would require restarting playlist after last track
-	log.Printf("Repeat mode set to: %s (not implemented)", arg)
+	s.player.SetRepeat(arg == "1")
+	log.Printf("Repeat mode set to: %s", arg)
+
+	// Notify idle connections of options change
+	s.NotifySubsystemChange("options")
 
-	return "OK\n"
+	return "OK\n", nil
 }
 
 // cmdRandom handles the 'random' command
 // Sets random mode (shuffle playlist)
-func (s *Server) cmdRandom(args []string) string {
+func (s *Server) cmdRandom(args []string) (string, *ackError) {
 	if len(args) == 0 {
-		return "ACK [2@0] {random} missing argument\n"
+		return "", ack(ackErrorArg, "random", "missing argument")
 	}
 
 	// Parse the argument (0 or 1)
 	arg := args[0]
-	if unquoted, err := strconv.Unquote(arg); err == nil {
-		arg = unquoted
-	}
 
 	// Validate argument
 	if arg != "0" && arg != "1" {
-		return "ACK [2@0] {random} invalid argument\n"
+		return "", ack(ackErrorArg, "random", "invalid argument")
 	}
 
-	// For now, accept the command but don't implement the behavior
-	// Random mode would require shuffling track order
-	log.Printf("Random mode set to: %s (not implemented)", arg)
+	s.player.SetRandom(arg == "1")
+	log.Printf("Random mode set to: %s", arg)
+
+	// Notify idle connections of options change
+	s.NotifySubsystemChange("options")
+
+	return "OK\n", nil
+}
+
+// cmdCrossfade handles the 'crossfade' command
+// Usage: crossfade SECONDS (0 disables crossfading)
+func (s *Server) cmdCrossfade(args []string) (string, *ackError) {
+	if len(args) == 0 {
+		return "", ack(ackErrorArg, "crossfade", "missing argument")
+	}
+
+	arg := args[0]
+
+	seconds, err := strconv.Atoi(arg)
+	if err != nil || seconds < 0 {
+		return "", ack(ackErrorArg, "crossfade", "invalid argument")
+	}
+
+	if err := s.player.SetCrossfade(seconds); err != nil {
+		return "", ack(ackErrorArg, "crossfade", "%v", err)
+	}
+	log.Printf("Crossfade set to: %d seconds", seconds)
+
+	// Notify idle connections of options change
+	s.NotifySubsystemChange("options")
+
+	return "OK\n", nil
+}
+
+// cmdReplayGainMode handles the 'replay_gain_mode' command
+// Usage: replay_gain_mode off|track|album|auto
+func (s *Server) cmdReplayGainMode(args []string) (string, *ackError) {
+	if len(args) == 0 {
+		return "", ack(ackErrorArg, "replay_gain_mode", "missing argument")
+	}
+
+	arg := args[0]
+
+	mode, err := replaygain.ParseMode(arg)
+	if err != nil || arg == "" {
+		return "", ack(ackErrorArg, "replay_gain_mode", "Unrecognized replay gain mode")
+	}
+
+	s.player.SetReplayGainMode(mode)
+	log.Printf("ReplayGain mode set to: %s", mode)
+
+	// Notify idle connections of options change
+	s.NotifySubsystemChange("options")
+
+	return "OK\n", nil
+}
 
-	return "OK\n"
+// cmdReplayGainStatus handles the 'replay_gain_status' command
+func (s *Server) cmdReplayGainStatus(_ []string) (string, *ackError) {
+	return fmt.Sprintf("replay_gain_mode: %s\nOK\n", s.player.GetReplayGainMode()), nil
 }
@@ -10,7 +10,7 @@ import (
 
 // cmdPlay handles the 'play' command
 // play [POS] - start playback at optional position
-func (s *Server) cmdPlay(args []string) string {
+func (s *Server) cmdPlay(args []string) (string, *ackError) {
 	var err error
 
 	// Check if we have a pending playlist to transition to
@@ -19,21 +19,18 @@ func (s *Server) cmdPlay(args []string) string {
 		log.Printf("Completing playlist transition")
 		err = s.player.CompleteTransition()
 		if err != nil {
-			return fmt.Sprintf("ACK [50@0] {play} transition failed: %s\n", err.Error())
+			return "", ack(ackErrorNoExist, "play", "transition failed: %v", err)
 		}
-		return "OK\n"
+		return "OK\n", nil
 	}
 
 	if len(args) > 0 {
 		// Parse position argument
 		posArg := args[0]
-		if unquoted, parseErr := strconv.Unquote(posArg); parseErr == nil {
-			posArg = unquoted
-		}
 
 		pos64, parseErr := strconv.ParseInt(posArg, 10, 32)
 		if parseErr != nil {
-			return "ACK [2@0] {play} invalid position\n"
+			return "", ack(ackErrorArg, "play", "invalid position")
 		}
 
 		// Play at specific position
@@ -43,7 +40,7 @@ func (s *Server) cmdPlay(args []string) string {
 		state := s.player.GetState()
 		if state == player.StatePlaying {
 			// Already playing, nothing to do
-			return "OK\n"
+			return "OK\n", nil
 		} else if state == player.StatePaused {
 			// Resume from pause
 			err = s.player.Resume()
@@ -54,27 +51,24 @@ func (s *Server) cmdPlay(args []string) string {
 	}
 
 	if err != nil {
-		return fmt.Sprintf("ACK [50@0] {play} %s\n", err.Error())
+		return "", ack(ackErrorNoExist, "play", "%v", err)
 	}
 
-	return "OK\n"
+	return "OK\n", nil
 }
 
 // cmdPause handles the 'pause' command
 // pause 0 = resume, pause 1 = pause, no arg = toggle
-func (s *Server) cmdPause(args []string) string {
+func (s *Server) cmdPause(args []string) (string, *ackError) {
 	var shouldPause bool
 
 	if len(args) > 0 {
 		// Parse argument
 		arg := args[0]
-		if unquoted, err := strconv.Unquote(arg); err == nil {
-			arg = unquoted
-		}
 
 		// Validate argument (0 or 1)
 		if arg != "0" && arg != "1" {
-			return "ACK [2@0] {pause} invalid argument\n"
+			return "", ack(ackErrorArg, "pause", "invalid argument")
 		}
 
 		shouldPause = (arg == "1")
@@ -95,23 +89,23 @@ func (s *Server) cmdPause(args []string) string {
 	}
 
 	if err != nil {
-		return fmt.Sprintf("ACK [50@0] {pause} %s\n", err.Error())
+		return "", ack(ackErrorNoExist, "pause", "%v", err)
 	}
 
-	return "OK\n"
+	return "OK\n", nil
 }
 
 // cmdStop handles the 'stop' command
-func (s *Server) cmdStop(_ []string) string {
+func (s *Server) cmdStop(_ []string) (string, *ackError) {
 	if err := s.player.Stop(); err != nil {
-		return fmt.Sprintf("ACK [50@0] {stop} %s\n", err.Error())
+		return "", ack(ackErrorNoExist, "stop", "%v", err)
 	}
 
-	return "OK\n"
+	return "OK\n", nil
 }
 
 // cmdNext handles the 'next' command
-func (s *Server) cmdNext(_ []string) string {
+func (s *Server) cmdNext(_ []string) (string, *ackError) {
 	// Cancel any pending transition (user wants to navigate current playlist)
 	if s.player.GetPendingPlaylist() != nil {
 		s.player.CancelTransition()
@@ -119,15 +113,15 @@ func (s *Server) cmdNext(_ []string) string {
 	}
 
 	if err := s.player.Next(); err != nil {
-		return fmt.Sprintf("ACK [50@0] {next} %s\n", err.Error())
+		return "", ack(ackErrorNoExist, "next", "%v", err)
 	}
 
 	// Player will notify subsystem change automatically
-	return "OK\n"
+	return "OK\n", nil
 }
 
 // cmdPrevious handles the 'previous' command
-func (s *Server) cmdPrevious(_ []string) string {
+func (s *Server) cmdPrevious(_ []string) (string, *ackError) {
 	// Cancel any pending transition (user wants to navigate current playlist)
 	if s.player.GetPendingPlaylist() != nil {
 		s.player.CancelTransition()
@@ -135,53 +129,46 @@ func (s *Server) cmdPrevious(_ []string) string {
 	}
 
 	if err := s.player.Previous(); err != nil {
-		return fmt.Sprintf("ACK [50@0] {previous} %s\n", err.Error())
+		return "", ack(ackErrorNoExist, "previous", "%v", err)
 	}
 
 	// Player will notify subsystem change automatically
-	return "OK\n"
+	return "OK\n", nil
 }
 
 // cmdSeek handles the 'seek' command
 // seek {SONGPOS} {TIME} - seek to TIME (in seconds) within song SONGPOS
-func (s *Server) cmdSeek(args []string) string {
+func (s *Server) cmdSeek(args []string) (string, *ackError) {
 	if len(args) < 2 {
-		return "ACK [2@0] {seek} missing arguments\n"
+		return "", ack(ackErrorArg, "seek", "missing arguments")
 	}
 
 	// Parse song position
 	songPos := args[0]
-	if unquoted, err := strconv.Unquote(songPos); err == nil {
-		songPos = unquoted
-	}
 	pos64, err := strconv.ParseInt(songPos, 10, 32)
 	if err != nil {
-		return "ACK [2@0] {seek} invalid song position\n"
+		return "", ack(ackErrorArg, "seek", "invalid song position")
 	}
 
 	// Parse time argument (can be float, e.g., "120.5")
 	timeArg := args[1]
-	if unquoted, err := strconv.Unquote(timeArg); err == nil {
-		timeArg = unquoted
-	}
 	timeFloat, err := strconv.ParseFloat(timeArg, 64)
 	if err != nil {
-		return "ACK [2@0] {seek} invalid time\n"
+		return "", ack(ackErrorArg, "seek", "invalid time")
 	}
-	timeSeconds := int64(timeFloat)
 
 	// Verify that the requested song position matches the current position
 	currentPos := s.player.GetPlaylist().CurrentIndex()
 	if int(pos64) != currentPos {
-		return fmt.Sprintf("ACK [2@0] {seek} can only seek within current song (current: %d, requested: %d)\n", currentPos, pos64)
+		return "", ack(ackErrorArg, "seek", "can only seek within current song (current: %d, requested: %d)", currentPos, pos64)
 	}
 
 	// Perform the seek
-	if err := s.player.Seek(timeSeconds); err != nil {
-		return fmt.Sprintf("ACK [50@0] {seek} %s\n", err.Error())
+	if err := s.player.Seek(timeFloat); err != nil {
+		return "", ack(ackErrorNoExist, "seek", "%v", err)
 	}
 
-	return "OK\n"
+	return "OK\n", nil
 }
 
 // cmdSeekCur handles the 'seekcur' command
@@ -190,16 +177,13 @@ func (s *Server) cmdSeek(args []string) string {
 //   - absolute: "120" = seek to 120 seconds
 //   - relative positive: "+10" = seek forward 10 seconds
 //   - relative negative: "-10" = seek backward 10 seconds
-func (s *Server) cmdSeekCur(args []string) string {
+func (s *Server) cmdSeekCur(args []string) (string, *ackError) {
 	if len(args) < 1 {
-		return "ACK [2@0] {seekcur} missing argument\n"
+		return "", ack(ackErrorArg, "seekcur", "missing argument")
 	}
 
 	// Parse time argument
 	timeArg := args[0]
-	if unquoted, err := strconv.Unquote(timeArg); err == nil {
-		timeArg = unquoted
-	}
 
 	// Check if it's relative (starts with + or -)
 	isRelative := len(timeArg) > 0 && (timeArg[0] == '+' || timeArg[0] == '-')
@@ -207,22 +191,147 @@ func (s *Server) cmdSeekCur(args []string) string {
 	// Parse as float (can be "120.5")
 	timeFloat, err := strconv.ParseFloat(timeArg, 64)
 	if err != nil {
-		return "ACK [2@0] {seekcur} invalid time\n"
+		return "", ack(ackErrorArg, "seekcur", "invalid time")
 	}
-	timeSeconds := int64(timeFloat)
 
 	var seekErr error
 	if isRelative {
 		// Relative seek
-		seekErr = s.player.SeekCur(timeSeconds)
+		seekErr = s.player.SeekCur(timeFloat)
 	} else {
 		// Absolute seek
-		seekErr = s.player.Seek(timeSeconds)
+		seekErr = s.player.Seek(timeFloat)
 	}
 
 	if seekErr != nil {
-		return fmt.Sprintf("ACK [50@0] {seekcur} %s\n", seekErr.Error())
+		return "", ack(ackErrorNoExist, "seekcur", "%v", seekErr)
+	}
+
+	return "OK\n", nil
+}
+
+// cmdPlayId handles the 'playid' command
+// playid [SONGID] - start playback at the song with SONGID
+func (s *Server) cmdPlayId(args []string) (string, *ackError) {
+	// Without an ID, playid behaves like play
+	if len(args) == 0 {
+		return s.cmdPlay(args)
+	}
+
+	id, err := parseIntArg(args[0])
+	if err != nil {
+		return "", ack(ackErrorArg, "playid", "invalid song id")
 	}
 
-	return "OK\n"
+	if err := s.player.PlayID(id); err != nil {
+		return "", ack(ackErrorNoExist, "playid", "%v", err)
+	}
+
+	return "OK\n", nil
+}
+
+// cmdSeekId handles the 'seekid' command
+// seekid {SONGID} {TIME} - seek to TIME (in seconds) within song SONGID
+func (s *Server) cmdSeekId(args []string) (string, *ackError) {
+	if len(args) < 2 {
+		return "", ack(ackErrorArg, "seekid", "missing arguments")
+	}
+
+	id, err := parseIntArg(args[0])
+	if err != nil {
+		return "", ack(ackErrorArg, "seekid", "invalid song id")
+	}
+
+	// Parse time argument (can be float, e.g., "120.5")
+	timeArg := args[1]
+	timeFloat, err := strconv.ParseFloat(timeArg, 64)
+	if err != nil {
+		return "", ack(ackErrorArg, "seekid", "invalid time")
+	}
+
+	if err := s.player.SeekID(id, timeFloat); err != nil {
+		return "", ack(ackErrorNoExist, "seekid", "%v", err)
+	}
+
+	return "OK\n", nil
+}
+
+// cmdClearError handles the 'clearerror' command
+// Clears the error shown in status
+func (s *Server) cmdClearError(_ []string) (string, *ackError) {
+	s.player.ClearError()
+
+	// Notify idle connections of player change
+	s.NotifySubsystemChange("player")
+
+	return "OK\n", nil
+}
+
+// cmdSetVol handles the 'setvol' command
+// Usage: setvol VOL (0-100)
+func (s *Server) cmdSetVol(args []string) (string, *ackError) {
+	if len(args) == 0 {
+		return "", ack(ackErrorArg, "setvol", "missing argument")
+	}
+
+	arg := args[0]
+
+	volume, err := strconv.Atoi(arg)
+	if err != nil || volume < 0 || volume > 100 {
+		return "", ack(ackErrorArg, "setvol", "Invalid volume value")
+	}
+
+	return s.setVolume("setvol", volume)
+}
+
+// cmdVolume handles the deprecated 'volume' command
+// Usage: volume CHANGE (relative, -100 to +100)
+func (s *Server) cmdVolume(args []string) (string, *ackError) {
+	if len(args) == 0 {
+		return "", ack(ackErrorArg, "volume", "missing argument")
+	}
+
+	arg := args[0]
+
+	change, err := strconv.Atoi(arg)
+	if err != nil || change < -100 || change > 100 {
+		return "", ack(ackErrorArg, "volume", "Invalid volume value")
+	}
+
+	current := s.player.GetVolume()
+	if current < 0 {
+		return "", ack(ackErrorSystem, "volume", "No mixer")
+	}
+
+	volume := current + change
+	if volume < 0 {
+		volume = 0
+	}
+	if volume > 100 {
+		volume = 100
+	}
+
+	return s.setVolume("volume", volume)
+}
+
+// cmdGetVol handles the 'getvol' command
+func (s *Server) cmdGetVol(_ []string) (string, *ackError) {
+	volume := s.player.GetVolume()
+	if volume < 0 {
+		return "", ack(ackErrorSystem, "getvol", "No mixer")
+	}
+	return fmt.Sprintf("volume: %d\nOK\n", volume), nil
+}
+
+// setVolume applies a mixer volume on behalf of command cmd
+func (s *Server) setVolume(cmd string, volume int) (string, *ackError) {
+	if err := s.player.SetVolume(volume); err != nil {
+		return "", ack(ackErrorSystem, cmd, "%v", err)
+	}
+	log.Printf("Volume set to: %d", volume)
+
+	// Notify idle connections of mixer change
+	s.NotifySubsystemChange("mixer")
+
+	return "OK\n", nil
 }
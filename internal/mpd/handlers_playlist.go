@@ -8,42 +8,71 @@ import (
 
 	"github.com/famish99/direttampd/internal/player"
 	"github.com/famish99/direttampd/internal/playlist"
+	"github.com/famish99/direttampd/internal/playlistfile"
 )
 
 // cmdAdd handles the 'add' command
-func (s *Server) cmdAdd(args []string) string {
+func (s *Server) cmdAdd(args []string) (string, *ackError) {
 	if len(args) == 0 {
-		return "ACK [2@0] {add} missing URI\n"
+		return "", ack(ackErrorArg, "add", "missing URI")
 	}
 
-	uri := strings.Join(args, " ")
+	uri := args[0]
 
-	// Try to unquote if it's a quoted string, otherwise use as-is
-	if unquoted, err := strconv.Unquote(uri); err == nil {
-		uri = unquoted
+	if !supportedURI(uri) {
+		return "", ack(ackErrorNoExist, "add", "Unsupported URI scheme")
 	}
 
-	s.addTrackToPlaylist(uri, nil)
+	// Database directories add every song below them
+	uris := s.databaseDirectorySongs(uri)
+	if uris == nil {
+		uri = s.resolveURI(uri)
+		uris = []string{uri}
+	}
+
+	// Expand playlist files into their tracks instead of queueing them as audio
+	// HLS playlists are a single stream and are queued as one song
+	if playlistfile.IsPlaylist(uri) && !playlistfile.IsStreamManifest(uri) {
+		entries, err := playlistfile.Expand(uri)
+		if err != nil {
+			return "", ack(ackErrorNoExist, "add", "%v", err)
+		}
+		uris = entries
+	}
+
+	for _, uri := range uris {
+		if !supportedURI(uri) {
+			log.Printf("Skipping playlist entry with unsupported URI scheme: %s", uri)
+			continue
+		}
+		s.addTrackToPlaylist(s.resolveURI(uri), nil)
+	}
 
 	// Notify idle connections of playlist change
 	s.NotifySubsystemChange("playlist")
 
-	return "OK\n"
+	return "OK\n", nil
 }
 
 // cmdAddId handles the 'addid' command
 // Like 'add' but returns the song ID of the added track
 // Supports optional position argument: addid URI [POS]
-func (s *Server) cmdAddId(args []string) string {
+func (s *Server) cmdAddId(args []string) (string, *ackError) {
 	if len(args) == 0 {
-		return "ACK [2@0] {addid} missing URI\n"
+		return "", ack(ackErrorArg, "addid", "missing URI")
 	}
 
 	uri := args[0]
 
-	// Try to unquote if it's a quoted string, otherwise use as-is
-	if unquoted, err := strconv.Unquote(uri); err == nil {
-		uri = unquoted
+	if !supportedURI(uri) {
+		return "", ack(ackErrorNoExist, "addid", "Unsupported URI scheme")
+	}
+
+	uri = s.resolveURI(uri)
+
+	// A playlist file expands to many songs, so it cannot yield a single ID
+	if playlistfile.IsPlaylist(uri) && !playlistfile.IsStreamManifest(uri) {
+		return "", ack(ackErrorArg, "addid", "cannot add a playlist file; use add or load")
 	}
 
 	var position *int
@@ -51,13 +80,10 @@ func (s *Server) cmdAddId(args []string) string {
 	if len(args) > 1 {
 		// Parse position argument
 		posArg := args[1]
-		if unquoted, err := strconv.Unquote(posArg); err == nil {
-			posArg = unquoted
-		}
 
 		pos64, err := strconv.ParseInt(posArg, 10, 32)
 		if err != nil {
-			return "ACK [2@0] {addid} invalid position\n"
+			return "", ack(ackErrorArg, "addid", "invalid position")
 		}
 		pos := int(pos64)
 		position = &pos
@@ -69,11 +95,11 @@ func (s *Server) cmdAddId(args []string) string {
 	s.NotifySubsystemChange("playlist")
 
 	// Return the ID of the added song
-	return fmt.Sprintf("Id: %d\nOK\n", songId)
+	return fmt.Sprintf("Id: %d\nOK\n", songId), nil
 }
 
 // cmdClear handles the 'clear' command
-func (s *Server) cmdClear(args []string) string {
+func (s *Server) cmdClear(args []string) (string, *ackError) {
 	state := s.player.GetState()
 
 	// If playing, create a pending playlist for transition
@@ -88,72 +114,404 @@ func (s *Server) cmdClear(args []string) string {
 	// Notify idle connections of playlist change
 	s.NotifySubsystemChange("playlist")
 
-	return "OK\n"
+	return "OK\n", nil
 }
 
 // cmdPlaylistInfo handles the 'playlistinfo' command
-func (s *Server) cmdPlaylistInfo(args []string) string {
+func (s *Server) cmdPlaylistInfo(client *clientState, args []string) (string, *ackError) {
 	pl := s.player.GetPlaylist()
 	tracks := pl.GetAll()
 
-	var info strings.Builder
 	for i, track := range tracks {
-		info.WriteString(s.formatTrackInfo(&track, i))
+		client.out.WriteString(s.formatTrackInfo(client, &track, i))
 	}
-	info.WriteString("OK\n")
 
-	return info.String()
+	return "OK\n", nil
 }
 
 // cmdCurrentSong handles the 'currentsong' command
-func (s *Server) cmdCurrentSong(args []string) string {
+func (s *Server) cmdCurrentSong(client *clientState, args []string) (string, *ackError) {
 	pl := s.player.GetPlaylist()
 	track, err := pl.Current()
 	if err != nil {
-		return "OK\n" // No current song
+		return "OK\n", nil // No current song
 	}
 
 	var info strings.Builder
-	info.WriteString(s.formatTrackInfo(track, pl.CurrentIndex()))
+	info.WriteString(s.formatTrackInfo(client, track, pl.CurrentIndex()))
 	info.WriteString("OK\n")
 
-	return info.String()
+	return info.String(), nil
 }
 
 // cmdPlChanges handles the 'plchanges' command
 // Returns changed songs in playlist since given version
-func (s *Server) cmdPlChanges(args []string) string {
+func (s *Server) cmdPlChanges(client *clientState, args []string) (string, *ackError) {
 	if len(args) == 0 {
-		return "ACK [2@0] {plchanges} missing playlist version argument\n"
+		return "", ack(ackErrorArg, "plchanges", "missing playlist version argument")
 	}
 
 	// Parse version argument
 	versionStr := args[0]
 
-	// Try to unquote if it's a quoted string, otherwise use as-is
-	if unquoted, err := strconv.Unquote(versionStr); err == nil {
-		versionStr = unquoted
-	}
-
 	// Parse as uint32
 	version64, err := strconv.ParseUint(versionStr, 10, 32)
 	if err != nil {
 		log.Printf("Invalid version argument: %s", args[0])
-		return "ACK [2@0] {plchanges} invalid playlist version number\n"
+		return "", ack(ackErrorArg, "plchanges", "invalid playlist version number")
 	}
 	requestedVersion := uint32(version64)
 
 	pl := s.player.GetPlaylist()
 	changes := pl.GetChangesSince(requestedVersion)
 
-	var info strings.Builder
 	for _, event := range changes {
-		// Only return "add" events; "clear" events don't have tracks to show
-		if event.Operation == "add" && event.Track != nil {
-			info.WriteString(s.formatTrackInfo(event.Track, event.Position))
+		// Only return events that carry a track; "clear" events don't have tracks to show
+		if event.Track != nil {
+			client.out.WriteString(s.formatTrackInfo(client, event.Track, event.Position))
+		}
+	}
+
+	return "OK\n", nil
+}
+
+// cmdMove handles the 'move' command
+// move {FROM} {TO} - move the song at position FROM to position TO
+func (s *Server) cmdMove(args []string) (string, *ackError) {
+	if len(args) < 2 {
+		return "", ack(ackErrorArg, "move", "missing arguments")
+	}
+
+	from, err := parseIntArg(args[0])
+	if err != nil {
+		return "", ack(ackErrorArg, "move", "invalid source position")
+	}
+
+	to, err := parseIntArg(args[1])
+	if err != nil {
+		return "", ack(ackErrorArg, "move", "invalid destination position")
+	}
+
+	if err := s.editablePlaylist().Move(from, to); err != nil {
+		return "", ack(ackErrorArg, "move", "%v", err)
+	}
+
+	// Notify idle connections of playlist change
+	s.NotifySubsystemChange("playlist")
+
+	return "OK\n", nil
+}
+
+// cmdMoveId handles the 'moveid' command
+// moveid {ID} {TO} - move the song with ID to position TO
+func (s *Server) cmdMoveId(args []string) (string, *ackError) {
+	if len(args) < 2 {
+		return "", ack(ackErrorArg, "moveid", "missing arguments")
+	}
+
+	id, err := parseIntArg(args[0])
+	if err != nil {
+		return "", ack(ackErrorArg, "moveid", "invalid song id")
+	}
+
+	to, err := parseIntArg(args[1])
+	if err != nil {
+		return "", ack(ackErrorArg, "moveid", "invalid destination position")
+	}
+
+	pl := s.editablePlaylist()
+	from := pl.FindByID(id)
+	if from < 0 {
+		return "", ack(ackErrorNoExist, "moveid", "No such song: %d", id)
+	}
+
+	if err := pl.Move(from, to); err != nil {
+		return "", ack(ackErrorArg, "moveid", "%v", err)
+	}
+
+	// Notify idle connections of playlist change
+	s.NotifySubsystemChange("playlist")
+
+	return "OK\n", nil
+}
+
+// cmdShuffle handles the 'shuffle' command
+// shuffle [START:END] - shuffle the whole queue or the given range
+func (s *Server) cmdShuffle(args []string) (string, *ackError) {
+	start, end := 0, -1
+	if len(args) > 0 {
+		var err error
+		start, end, err = parseRangeArg(args[0])
+		if err != nil {
+			return "", ack(ackErrorArg, "shuffle", "invalid range")
 		}
 	}
+
+	if err := s.editablePlaylist().Shuffle(start, end); err != nil {
+		return "", ack(ackErrorArg, "shuffle", "%v", err)
+	}
+
+	// Notify idle connections of playlist change
+	s.NotifySubsystemChange("playlist")
+
+	return "OK\n", nil
+}
+
+// cmdSwap handles the 'swap' command
+// swap {POS1} {POS2} - swap the songs at positions POS1 and POS2
+func (s *Server) cmdSwap(args []string) (string, *ackError) {
+	if len(args) < 2 {
+		return "", ack(ackErrorArg, "swap", "missing arguments")
+	}
+
+	pos1, err := parseIntArg(args[0])
+	if err != nil {
+		return "", ack(ackErrorArg, "swap", "invalid position")
+	}
+
+	pos2, err := parseIntArg(args[1])
+	if err != nil {
+		return "", ack(ackErrorArg, "swap", "invalid position")
+	}
+
+	if err := s.editablePlaylist().Swap(pos1, pos2); err != nil {
+		return "", ack(ackErrorArg, "swap", "%v", err)
+	}
+
+	// Notify idle connections of playlist change
+	s.NotifySubsystemChange("playlist")
+
+	return "OK\n", nil
+}
+
+// cmdSwapId handles the 'swapid' command
+// swapid {ID1} {ID2} - swap the songs with IDs ID1 and ID2
+func (s *Server) cmdSwapId(args []string) (string, *ackError) {
+	if len(args) < 2 {
+		return "", ack(ackErrorArg, "swapid", "missing arguments")
+	}
+
+	id1, err := parseIntArg(args[0])
+	if err != nil {
+		return "", ack(ackErrorArg, "swapid", "invalid song id")
+	}
+
+	id2, err := parseIntArg(args[1])
+	if err != nil {
+		return "", ack(ackErrorArg, "swapid", "invalid song id")
+	}
+
+	pl := s.editablePlaylist()
+	pos1 := pl.FindByID(id1)
+	if pos1 < 0 {
+		return "", ack(ackErrorNoExist, "swapid", "No such song: %d", id1)
+	}
+	pos2 := pl.FindByID(id2)
+	if pos2 < 0 {
+		return "", ack(ackErrorNoExist, "swapid", "No such song: %d", id2)
+	}
+
+	if err := pl.Swap(pos1, pos2); err != nil {
+		return "", ack(ackErrorArg, "swapid", "%v", err)
+	}
+
+	// Notify idle connections of playlist change
+	s.NotifySubsystemChange("playlist")
+
+	return "OK\n", nil
+}
+
+// cmdPlaylistId handles the 'playlistid' command
+// playlistid [ID] - display the song with ID, or the whole queue if no ID is given
+func (s *Server) cmdPlaylistId(client *clientState, args []string) (string, *ackError) {
+	pl := s.player.GetPlaylist()
+
+	if len(args) == 0 {
+		return s.cmdPlaylistInfo(client, args)
+	}
+
+	id, err := parseIntArg(args[0])
+	if err != nil {
+		return "", ack(ackErrorArg, "playlistid", "invalid song id")
+	}
+
+	pos := pl.FindByID(id)
+	if pos < 0 {
+		return "", ack(ackErrorNoExist, "playlistid", "No such song: %d", id)
+	}
+
+	track, err := pl.TrackAt(pos)
+	if err != nil {
+		return "", ack(ackErrorNoExist, "playlistid", "%v", err)
+	}
+
+	var info strings.Builder
+	info.WriteString(s.formatTrackInfo(client, track, pos))
 	info.WriteString("OK\n")
 
-	return info.String()
-}
\ No newline at end of file
+	return info.String(), nil
+}
+
+// parsePriorityArg parses a queue priority argument (0-255)
+func parsePriorityArg(arg string) (int, error) {
+	priority, err := parseIntArg(arg)
+	if err != nil {
+		return 0, err
+	}
+	if priority < 0 || priority > 255 {
+		return 0, fmt.Errorf("priority out of range: %d", priority)
+	}
+	return priority, nil
+}
+
+// cmdPrio handles the 'prio' command
+// prio {PRIORITY} {START:END...} - set the priority of the songs in the given ranges
+func (s *Server) cmdPrio(args []string) (string, *ackError) {
+	if len(args) < 2 {
+		return "", ack(ackErrorArg, "prio", "missing arguments")
+	}
+
+	priority, err := parsePriorityArg(args[0])
+	if err != nil {
+		return "", ack(ackErrorArg, "prio", "invalid priority")
+	}
+
+	pl := s.editablePlaylist()
+	for _, arg := range args[1:] {
+		start, end, err := parseRangeArg(arg)
+		if err != nil {
+			return "", ack(ackErrorArg, "prio", "invalid range")
+		}
+		if err := pl.SetPriority(start, end, priority); err != nil {
+			return "", ack(ackErrorArg, "prio", "%v", err)
+		}
+	}
+
+	// Notify idle connections of playlist change
+	s.NotifySubsystemChange("playlist")
+
+	return "OK\n", nil
+}
+
+// cmdPrioId handles the 'prioid' command
+// prioid {PRIORITY} {ID...} - set the priority of the songs with the given IDs
+func (s *Server) cmdPrioId(args []string) (string, *ackError) {
+	if len(args) < 2 {
+		return "", ack(ackErrorArg, "prioid", "missing arguments")
+	}
+
+	priority, err := parsePriorityArg(args[0])
+	if err != nil {
+		return "", ack(ackErrorArg, "prioid", "invalid priority")
+	}
+
+	pl := s.editablePlaylist()
+	for _, arg := range args[1:] {
+		id, err := parseIntArg(arg)
+		if err != nil {
+			return "", ack(ackErrorArg, "prioid", "invalid song id")
+		}
+		if err := pl.SetPriorityByID(id, priority); err != nil {
+			return "", ack(ackErrorNoExist, "prioid", "%v", err)
+		}
+	}
+
+	// Notify idle connections of playlist change
+	s.NotifySubsystemChange("playlist")
+
+	return "OK\n", nil
+}
+
+// cmdRangeId handles the 'rangeid' command
+// rangeid {ID} {START:END} - play only the given time range of the song with ID
+// An empty range (":") removes a previously set range
+func (s *Server) cmdRangeId(args []string) (string, *ackError) {
+	if len(args) < 2 {
+		return "", ack(ackErrorArg, "rangeid", "missing arguments")
+	}
+
+	id, err := parseIntArg(args[0])
+	if err != nil {
+		return "", ack(ackErrorArg, "rangeid", "invalid song id")
+	}
+
+	start, end, err := parseTimeRangeArg(args[1])
+	if err != nil {
+		return "", ack(ackErrorArg, "rangeid", "invalid range")
+	}
+
+	// The range of the playing song can't be changed, like MPD
+	pl := s.editablePlaylist()
+	if current, err := pl.Current(); err == nil && current.ID == id && s.player.GetState() != player.StateStopped {
+		return "", ack(ackErrorArg, "rangeid", "Cannot edit the current song")
+	}
+
+	if err := pl.SetRangeByID(id, start, end); err != nil {
+		return "", ack(ackErrorNoExist, "rangeid", "%v", err)
+	}
+
+	// Notify idle connections of playlist change
+	s.NotifySubsystemChange("playlist")
+
+	return "OK\n", nil
+}
+
+// cmdAddTagId handles the 'addtagid' command
+// addtagid {SONGID} {TAG} {VALUE} - attach a tag to the song with SONGID
+func (s *Server) cmdAddTagId(args []string) (string, *ackError) {
+	if len(args) < 3 {
+		return "", ack(ackErrorArg, "addtagid", "missing arguments")
+	}
+
+	id, err := parseIntArg(args[0])
+	if err != nil {
+		return "", ack(ackErrorArg, "addtagid", "invalid song id")
+	}
+
+	tag, ok := parseTagArg(args[1])
+	if !ok {
+		return "", ack(ackErrorArg, "addtagid", "Unknown tag type: %s", args[1])
+	}
+
+	value := args[2]
+
+	if err := s.editablePlaylist().AddTagByID(id, tag, value); err != nil {
+		return "", ack(ackErrorNoExist, "addtagid", "%v", err)
+	}
+
+	// Notify idle connections of playlist change
+	s.NotifySubsystemChange("playlist")
+
+	return "OK\n", nil
+}
+
+// cmdClearTagId handles the 'cleartagid' command
+// cleartagid {SONGID} [TAG] - remove one or all client-supplied tags from the song with SONGID
+func (s *Server) cmdClearTagId(args []string) (string, *ackError) {
+	if len(args) == 0 {
+		return "", ack(ackErrorArg, "cleartagid", "missing arguments")
+	}
+
+	id, err := parseIntArg(args[0])
+	if err != nil {
+		return "", ack(ackErrorArg, "cleartagid", "invalid song id")
+	}
+
+	var tag string
+	if len(args) > 1 {
+		var ok bool
+		tag, ok = parseTagArg(args[1])
+		if !ok {
+			return "", ack(ackErrorArg, "cleartagid", "Unknown tag type: %s", args[1])
+		}
+	}
+
+	if err := s.editablePlaylist().ClearTagsByID(id, tag); err != nil {
+		return "", ack(ackErrorNoExist, "cleartagid", "%v", err)
+	}
+
+	// Notify idle connections of playlist change
+	s.NotifySubsystemChange("playlist")
+
+	return "OK\n", nil
+}
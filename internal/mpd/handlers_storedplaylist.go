@@ -0,0 +1,302 @@
+package mpd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/famish99/direttampd/internal/playlist"
+	"github.com/famish99/direttampd/internal/playlistfile"
+	"github.com/famish99/direttampd/internal/storedplaylist"
+)
+
+// playlistEntryFor converts a queue track into a stored playlist entry
+// Client-supplied tags override probed metadata, as in formatSongInfo
+func playlistEntryFor(track *playlist.Track) playlistfile.Entry {
+	metadata := make(map[string]string, len(track.Metadata)+len(track.Tags))
+	for key, value := range track.Metadata {
+		metadata[key] = value
+	}
+	for key, value := range track.Tags {
+		metadata[key] = value
+	}
+	return playlistfile.Entry{URI: track.URL, Metadata: metadata}
+}
+
+// cmdListPlaylists handles the 'listplaylists' command
+// Lists stored playlists with their last modification time
+func (s *Server) cmdListPlaylists(_ []string) (string, *ackError) {
+	playlists, err := s.playlists.List()
+	if err != nil {
+		return "", ack(ackErrorSystem, "listplaylists", "%v", err)
+	}
+
+	var response strings.Builder
+	for _, info := range playlists {
+		response.WriteString(fmt.Sprintf("playlist: %s\n", info.Name))
+		response.WriteString(fmt.Sprintf("Last-Modified: %s\n", info.LastModified.UTC().Format(time.RFC3339)))
+	}
+	response.WriteString("OK\n")
+
+	return response.String(), nil
+}
+
+// cmdListPlaylist handles the 'listplaylist' command
+// listplaylist {NAME} - lists the files in a stored playlist
+func (s *Server) cmdListPlaylist(args []string) (string, *ackError) {
+	if len(args) == 0 {
+		return "", ack(ackErrorArg, "listplaylist", "missing playlist name")
+	}
+
+	uris, err := s.playlists.Load(args[0])
+	if err != nil {
+		return "", ack(ackErrorNoExist, "listplaylist", "%v", err)
+	}
+
+	var response strings.Builder
+	for _, uri := range uris {
+		response.WriteString(fmt.Sprintf("file: %s\n", uri))
+	}
+	response.WriteString("OK\n")
+
+	return response.String(), nil
+}
+
+// cmdListPlaylistInfo handles the 'listplaylistinfo' command
+// listplaylistinfo {NAME} - lists the songs in a stored playlist with metadata
+func (s *Server) cmdListPlaylistInfo(client *clientState, args []string) (string, *ackError) {
+	if len(args) == 0 {
+		return "", ack(ackErrorArg, "listplaylistinfo", "missing playlist name")
+	}
+
+	uris, err := s.playlists.Load(args[0])
+	if err != nil {
+		return "", ack(ackErrorNoExist, "listplaylistinfo", "%v", err)
+	}
+
+	var response strings.Builder
+	for _, uri := range uris {
+		track := playlist.NewTrack(uri)
+		response.WriteString(s.formatSongInfo(client, &track))
+	}
+	response.WriteString("OK\n")
+
+	return response.String(), nil
+}
+
+// cmdSave handles the 'save' command
+// save {NAME} [MODE] - save the queue to a stored playlist
+// MODE is "create" (default), "append" or "replace"
+func (s *Server) cmdSave(args []string) (string, *ackError) {
+	if len(args) == 0 {
+		return "", ack(ackErrorArg, "save", "missing playlist name")
+	}
+
+	mode := storedplaylist.SaveCreate
+	if len(args) > 1 {
+		switch strings.ToLower(args[1]) {
+		case "create":
+			mode = storedplaylist.SaveCreate
+		case "append":
+			mode = storedplaylist.SaveAppend
+		case "replace":
+			mode = storedplaylist.SaveReplace
+		default:
+			return "", ack(ackErrorArg, "save", "invalid save mode")
+		}
+	}
+
+	tracks := s.player.GetPlaylist().GetAll()
+	entries := make([]playlistfile.Entry, len(tracks))
+	for i, track := range tracks {
+		entries[i] = playlistEntryFor(&track)
+	}
+
+	name := args[0]
+	if err := s.playlists.Save(name, entries, mode); err != nil {
+		if s.playlists.Exists(name) && mode == storedplaylist.SaveCreate {
+			return "", ack(ackErrorExist, "save", "%v", err)
+		}
+		return "", ack(ackErrorSystem, "save", "%v", err)
+	}
+
+	// Notify idle connections of stored playlist change
+	s.NotifySubsystemChange("stored_playlist")
+
+	return "OK\n", nil
+}
+
+// cmdLoad handles the 'load' command
+// load {NAME} [START:END] - add the songs of a stored playlist to the queue
+func (s *Server) cmdLoad(args []string) (string, *ackError) {
+	if len(args) == 0 {
+		return "", ack(ackErrorArg, "load", "missing playlist name")
+	}
+
+	uris, err := s.playlists.Load(args[0])
+	if err != nil {
+		return "", ack(ackErrorNoExist, "load", "%v", err)
+	}
+
+	// Restrict to the requested range, if any
+	if len(args) > 1 {
+		start, end, err := parseRangeArg(args[1])
+		if err != nil {
+			return "", ack(ackErrorArg, "load", "invalid range")
+		}
+		if end < 0 || end > len(uris) {
+			end = len(uris)
+		}
+		if start < 0 || start > end {
+			return "", ack(ackErrorArg, "load", "Bad song index")
+		}
+		uris = uris[start:end]
+	}
+
+	for _, uri := range uris {
+		s.addTrackToPlaylist(uri, nil)
+	}
+
+	// Notify idle connections of playlist change
+	s.NotifySubsystemChange("playlist")
+
+	return "OK\n", nil
+}
+
+// cmdRm handles the 'rm' command
+// rm {NAME} - delete a stored playlist
+func (s *Server) cmdRm(args []string) (string, *ackError) {
+	if len(args) == 0 {
+		return "", ack(ackErrorArg, "rm", "missing playlist name")
+	}
+
+	if err := s.playlists.Delete(args[0]); err != nil {
+		return "", ack(ackErrorNoExist, "rm", "%v", err)
+	}
+
+	// Notify idle connections of stored playlist change
+	s.NotifySubsystemChange("stored_playlist")
+
+	return "OK\n", nil
+}
+
+// cmdRename handles the 'rename' command
+// rename {NAME} {NEW_NAME} - rename a stored playlist
+func (s *Server) cmdRename(args []string) (string, *ackError) {
+	if len(args) < 2 {
+		return "", ack(ackErrorArg, "rename", "missing arguments")
+	}
+
+	from := args[0]
+	to := args[1]
+	if err := s.playlists.Rename(from, to); err != nil {
+		if s.playlists.Exists(to) {
+			return "", ack(ackErrorExist, "rename", "%v", err)
+		}
+		return "", ack(ackErrorNoExist, "rename", "%v", err)
+	}
+
+	// Notify idle connections of stored playlist change
+	s.NotifySubsystemChange("stored_playlist")
+
+	return "OK\n", nil
+}
+
+// cmdPlaylistAdd handles the 'playlistadd' command
+// playlistadd {NAME} {URI} [POS] - add a song to a stored playlist
+func (s *Server) cmdPlaylistAdd(args []string) (string, *ackError) {
+	if len(args) < 2 {
+		return "", ack(ackErrorArg, "playlistadd", "missing arguments")
+	}
+
+	pos := -1
+	if len(args) > 2 {
+		var err error
+		if pos, err = parseIntArg(args[2]); err != nil || pos < 0 {
+			return "", ack(ackErrorArg, "playlistadd", "invalid position")
+		}
+	}
+
+	uri := args[1]
+	if err := s.playlists.Add(args[0], []string{uri}, pos); err != nil {
+		return "", ack(ackErrorArg, "playlistadd", "%v", err)
+	}
+
+	// Notify idle connections of stored playlist change
+	s.NotifySubsystemChange("stored_playlist")
+
+	return "OK\n", nil
+}
+
+// cmdPlaylistClear handles the 'playlistclear' command
+// playlistclear {NAME} - remove all songs from a stored playlist
+func (s *Server) cmdPlaylistClear(args []string) (string, *ackError) {
+	if len(args) == 0 {
+		return "", ack(ackErrorArg, "playlistclear", "missing playlist name")
+	}
+
+	if err := s.playlists.Clear(args[0]); err != nil {
+		return "", ack(ackErrorSystem, "playlistclear", "%v", err)
+	}
+
+	// Notify idle connections of stored playlist change
+	s.NotifySubsystemChange("stored_playlist")
+
+	return "OK\n", nil
+}
+
+// cmdPlaylistDelete handles the 'playlistdelete' command
+// playlistdelete {NAME} {POS|START:END} - remove songs from a stored playlist
+func (s *Server) cmdPlaylistDelete(args []string) (string, *ackError) {
+	if len(args) < 2 {
+		return "", ack(ackErrorArg, "playlistdelete", "missing arguments")
+	}
+
+	start, end, err := parseRangeArg(args[1])
+	if err != nil {
+		return "", ack(ackErrorArg, "playlistdelete", "invalid position")
+	}
+
+	name := args[0]
+	if err := s.playlists.DeleteRange(name, start, end); err != nil {
+		if !s.playlists.Exists(name) {
+			return "", ack(ackErrorNoExist, "playlistdelete", "%v", err)
+		}
+		return "", ack(ackErrorArg, "playlistdelete", "%v", err)
+	}
+
+	// Notify idle connections of stored playlist change
+	s.NotifySubsystemChange("stored_playlist")
+
+	return "OK\n", nil
+}
+
+// cmdPlaylistMove handles the 'playlistmove' command
+// playlistmove {NAME} {FROM} {TO} - move a song within a stored playlist
+func (s *Server) cmdPlaylistMove(args []string) (string, *ackError) {
+	if len(args) < 3 {
+		return "", ack(ackErrorArg, "playlistmove", "missing arguments")
+	}
+
+	from, err := parseIntArg(args[1])
+	if err != nil {
+		return "", ack(ackErrorArg, "playlistmove", "invalid position")
+	}
+	to, err := parseIntArg(args[2])
+	if err != nil {
+		return "", ack(ackErrorArg, "playlistmove", "invalid position")
+	}
+
+	name := args[0]
+	if err := s.playlists.Move(name, from, to); err != nil {
+		if !s.playlists.Exists(name) {
+			return "", ack(ackErrorNoExist, "playlistmove", "%v", err)
+		}
+		return "", ack(ackErrorArg, "playlistmove", "%v", err)
+	}
+
+	// Notify idle connections of stored playlist change
+	s.NotifySubsystemChange("stored_playlist")
+
+	return "OK\n", nil
+}
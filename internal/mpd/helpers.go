@@ -1,7 +1,14 @@
 package mpd
 
 import (
+	"fmt"
 	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/famish99/direttampd/internal/database"
+	"github.com/famish99/direttampd/internal/playlist"
 )
 
 // addTrackToPlaylist adds a track to either the pending or current playlist
@@ -12,16 +19,166 @@ func (s *Server) addTrackToPlaylist(uri string, position *int) int {
 	if pending != nil {
 		// Add to pending playlist
 		pending.AddMultiple([]string{uri})
-		s.player.BackgroundCacheTrack(uri)
+		s.player.Prefetch()
 		log.Printf("Added track to pending playlist: %s", uri)
-		return pending.Length() - 1
+		return songIDAt(pending, pending.Length()-1)
 	}
 
 	// Add to current playlist
 	if position != nil {
-		return s.player.AddURLAt(uri, *position)
+		pos := s.player.AddURLAt(uri, *position)
+		return songIDAt(s.player.GetPlaylist(), pos)
 	}
 
 	s.player.AddURLs([]string{uri})
-	return s.player.GetPlaylist().Length() - 1
-}
\ No newline at end of file
+	pl := s.player.GetPlaylist()
+	return songIDAt(pl, pl.Length()-1)
+}
+
+// resolveURI maps a music database URI to the file it names
+// file:// URIs become local paths; other URIs that are not database songs
+// (URLs, absolute paths) are returned unchanged
+func (s *Server) resolveURI(uri string) string {
+	if strings.HasPrefix(uri, "file://") {
+		if u, err := url.Parse(uri); err == nil {
+			return u.Path
+		}
+	}
+
+	if !s.db.Enabled() {
+		return uri
+	}
+
+	cleaned, err := database.CleanURI(uri)
+	if err != nil {
+		return uri
+	}
+	if _, ok := s.db.Get(cleaned); ok {
+		return s.db.Locate(cleaned)
+	}
+	return uri
+}
+
+// supportedURI reports whether a URI's scheme is listed in urlHandlers
+func supportedURI(uri string) bool {
+	i := strings.Index(uri, "://")
+	if i < 0 {
+		return true // Local path or database URI
+	}
+
+	scheme := strings.ToLower(uri[:i+len("://")])
+	for _, handler := range urlHandlers {
+		if scheme == handler {
+			return true
+		}
+	}
+	return false
+}
+
+// displayURI returns the URI clients see for a track
+// Files inside the music directory are shown by their database URI so they
+// match what lsinfo and find report
+func (s *Server) displayURI(url string) string {
+	if uri, ok := s.db.RelativeURI(url); ok {
+		return uri
+	}
+	return url
+}
+
+// databaseDirectorySongs returns the file paths of the songs below a database directory
+// Returns nil if uri does not name a database directory with songs in it
+func (s *Server) databaseDirectorySongs(uri string) []string {
+	if !s.db.Enabled() {
+		return nil
+	}
+
+	cleaned, err := database.CleanURI(uri)
+	if err != nil {
+		return nil
+	}
+	if _, ok := s.db.Get(cleaned); ok {
+		return nil // A song, not a directory
+	}
+
+	var paths []string
+	for _, song := range s.db.SongsUnder(cleaned) {
+		paths = append(paths, s.db.Locate(song.URI))
+	}
+	return paths
+}
+
+// editablePlaylist returns the playlist that queue edits should apply to
+// While a transition is pending, edits go to the pending playlist
+func (s *Server) editablePlaylist() *playlist.Playlist {
+	if pending := s.player.GetPendingPlaylist(); pending != nil {
+		return pending
+	}
+	return s.player.GetPlaylist()
+}
+
+// songIDAt returns the song ID of the track at position, or -1 if there is none
+func songIDAt(pl *playlist.Playlist, position int) int {
+	track, err := pl.TrackAt(position)
+	if err != nil {
+		return -1
+	}
+	return track.ID
+}
+
+// parseIntArg parses an integer command argument
+func parseIntArg(arg string) (int, error) {
+	value, err := strconv.ParseInt(arg, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return int(value), nil
+}
+
+// parseRangeArg parses a "START:END" range argument
+// END may be omitted ("START:") to mean the end of the playlist, returned as -1
+// A bare "POS" is treated as the single-element range POS:POS+1
+func parseRangeArg(arg string) (int, int, error) {
+	startStr, endStr, isRange := strings.Cut(arg, ":")
+
+	start, err := strconv.ParseInt(startStr, 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if !isRange {
+		return int(start), int(start) + 1, nil
+	}
+
+	if endStr == "" {
+		return int(start), -1, nil
+	}
+
+	end, err := strconv.ParseInt(endStr, 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(start), int(end), nil
+}
+
+// parseTimeRangeArg parses a "START:END" time range in (fractional) seconds
+// Either side may be omitted and is returned as 0, meaning unbounded
+func parseTimeRangeArg(arg string) (float64, float64, error) {
+	startStr, endStr, isRange := strings.Cut(arg, ":")
+	if !isRange {
+		return 0, 0, fmt.Errorf("missing ':' in range: %s", arg)
+	}
+
+	var start, end float64
+	var err error
+	if startStr != "" {
+		if start, err = strconv.ParseFloat(startStr, 64); err != nil {
+			return 0, 0, err
+		}
+	}
+	if endStr != "" {
+		if end, err = strconv.ParseFloat(endStr, 64); err != nil {
+			return 0, 0, err
+		}
+	}
+	return start, end, nil
+}
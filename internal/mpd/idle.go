@@ -9,6 +9,7 @@ type idleConnection struct {
 	subsystems map[string]bool // Subsystems to watch (empty = all)
 	notify     chan string     // Channel to send subsystem changes
 	cancel     chan struct{}   // Channel to cancel idle wait
+	client     *clientState    // Client the connection belongs to
 }
 
 // registerIdle registers an idle connection to receive notifications
@@ -27,6 +28,26 @@ func (s *Server) unregisterIdle(idle *idleConnection) {
 	log.Printf("Unregistered idle connection (total: %d)", len(s.idleConns))
 }
 
+// notifyClient notifies the idle connection of a single client about a subsystem change
+// Used for events only one client cares about, such as a message on its channels
+func (s *Server) notifyClient(client *clientState, subsystem string) {
+	s.idleMu.RLock()
+	defer s.idleMu.RUnlock()
+
+	for idle := range s.idleConns {
+		if idle.client != client {
+			continue
+		}
+		if len(idle.subsystems) == 0 || idle.subsystems[subsystem] {
+			select {
+			case idle.notify <- subsystem:
+			default:
+				log.Printf("Warning: idle notification channel full")
+			}
+		}
+	}
+}
+
 // NotifySubsystemChange notifies all idle connections about a subsystem change
 // This should be called whenever a relevant subsystem changes (playlist, player, etc.)
 func (s *Server) NotifySubsystemChange(subsystem string) {
@@ -0,0 +1,195 @@
+package mpd
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// maxPendingMessages is how many unread messages a client may hold, as in MPD
+const maxPendingMessages = 64
+
+// message is a client-to-client message waiting to be read
+type message struct {
+	channel string
+	text    string
+}
+
+// validChannelName reports whether name may be used as a channel name
+// MPD allows letters, digits and "_-.:"
+func validChannelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("_-.:", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// registerClient tracks a connected client so messages can be delivered to it
+func (s *Server) registerClient(client *clientState) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	s.clients[client] = true
+}
+
+// unregisterClient forgets a disconnected client and its subscriptions
+func (s *Server) unregisterClient(client *clientState) {
+	s.clientsMu.Lock()
+	_, registered := s.clients[client]
+	delete(s.clients, client)
+	s.clientsMu.Unlock()
+
+	client.mu.Lock()
+	hadChannels := len(client.subscriptions) > 0
+	client.mu.Unlock()
+
+	// Notify idle connections of subscription change
+	if registered && hadChannels {
+		s.NotifySubsystemChange("subscription")
+	}
+}
+
+// cmdSubscribe handles the 'subscribe' command
+// Usage: subscribe CHANNEL
+func (s *Server) cmdSubscribe(client *clientState, args []string) (string, *ackError) {
+	if len(args) == 0 {
+		return "", ack(ackErrorArg, "subscribe", "missing argument")
+	}
+
+	channel := args[0]
+	if !validChannelName(channel) {
+		return "", ack(ackErrorArg, "subscribe", "invalid channel name")
+	}
+
+	client.mu.Lock()
+	if client.subscriptions[channel] {
+		client.mu.Unlock()
+		return "", ack(ackErrorExist, "subscribe", "already subscribed to this channel")
+	}
+	client.subscriptions[channel] = true
+	client.mu.Unlock()
+
+	// Notify idle connections of subscription change
+	s.NotifySubsystemChange("subscription")
+
+	return "OK\n", nil
+}
+
+// cmdUnsubscribe handles the 'unsubscribe' command
+// Usage: unsubscribe CHANNEL
+func (s *Server) cmdUnsubscribe(client *clientState, args []string) (string, *ackError) {
+	if len(args) == 0 {
+		return "", ack(ackErrorArg, "unsubscribe", "missing argument")
+	}
+
+	channel := args[0]
+
+	client.mu.Lock()
+	if !client.subscriptions[channel] {
+		client.mu.Unlock()
+		return "", ack(ackErrorNoExist, "unsubscribe", "not subscribed to this channel")
+	}
+	delete(client.subscriptions, channel)
+	client.mu.Unlock()
+
+	// Notify idle connections of subscription change
+	s.NotifySubsystemChange("subscription")
+
+	return "OK\n", nil
+}
+
+// cmdChannels handles the 'channels' command
+// Lists every channel at least one client is subscribed to
+func (s *Server) cmdChannels(_ []string) (string, *ackError) {
+	channels := make(map[string]bool)
+
+	s.clientsMu.Lock()
+	for client := range s.clients {
+		client.mu.Lock()
+		for channel := range client.subscriptions {
+			channels[channel] = true
+		}
+		client.mu.Unlock()
+	}
+	s.clientsMu.Unlock()
+
+	names := make([]string, 0, len(channels))
+	for channel := range channels {
+		names = append(names, channel)
+	}
+	sort.Strings(names)
+
+	var response strings.Builder
+	for _, channel := range names {
+		response.WriteString(fmt.Sprintf("channel: %s\n", channel))
+	}
+	response.WriteString("OK\n")
+
+	return response.String(), nil
+}
+
+// cmdReadMessages handles the 'readmessages' command
+// Returns and clears the messages received on the client's channels
+func (s *Server) cmdReadMessages(client *clientState) (string, *ackError) {
+	client.mu.Lock()
+	messages := client.messages
+	client.messages = nil
+	client.mu.Unlock()
+
+	var response strings.Builder
+	for _, msg := range messages {
+		response.WriteString(fmt.Sprintf("channel: %s\n", msg.channel))
+		response.WriteString(fmt.Sprintf("message: %s\n", msg.text))
+	}
+	response.WriteString("OK\n")
+
+	return response.String(), nil
+}
+
+// cmdSendMessage handles the 'sendmessage' command
+// Usage: sendmessage CHANNEL TEXT
+func (s *Server) cmdSendMessage(args []string) (string, *ackError) {
+	if len(args) < 2 {
+		return "", ack(ackErrorArg, "sendmessage", "missing argument")
+	}
+
+	channel, text := args[0], args[1]
+	if !validChannelName(channel) {
+		return "", ack(ackErrorArg, "sendmessage", "invalid channel name")
+	}
+
+	var recipients []*clientState
+	s.clientsMu.Lock()
+	for client := range s.clients {
+		client.mu.Lock()
+		if client.subscriptions[channel] {
+			if len(client.messages) < maxPendingMessages {
+				client.messages = append(client.messages, message{channel: channel, text: text})
+			} else {
+				log.Printf("Dropping message on %s: client has too many unread messages", channel)
+			}
+			recipients = append(recipients, client)
+		}
+		client.mu.Unlock()
+	}
+	s.clientsMu.Unlock()
+
+	if len(recipients) == 0 {
+		return "", ack(ackErrorNoExist, "sendmessage", "nobody is subscribed to this channel")
+	}
+
+	// Notify the recipients' idle connections of the new message
+	for _, client := range recipients {
+		s.notifyClient(client, "message")
+	}
+
+	return "OK\n", nil
+}
@@ -2,9 +2,11 @@ package mpd
 
 import (
 	"fmt"
-	"strconv"
+	"log"
+	"os"
 	"strings"
 
+	"github.com/famish99/direttampd/internal/decoder"
 	"github.com/famish99/direttampd/internal/playlist"
 )
 
@@ -20,6 +22,22 @@ var metadataFields = map[string]string{
 	"composer":    "Composer",
 	"performer":   "Performer",
 	"disc":        "Disc",
+	"name":        "Name",
+}
+
+// tagTypes lists the keys of metadataFields in the order MPD reports tag types
+var tagTypes = []string{
+	"artist",
+	"album",
+	"albumartist",
+	"title",
+	"track",
+	"name",
+	"genre",
+	"date",
+	"composer",
+	"performer",
+	"disc",
 }
 
 // decoderInfo represents a decoder plugin with its supported formats
@@ -27,87 +45,113 @@ type decoderInfo struct {
 	plugin    string
 	suffixes  []string
 	mimeTypes []string
+	builtin   bool     // Played without ffmpeg, at least when the output takes the samples as they are
+	codecs    []string // ffmpeg decoders of which one is needed otherwise
 }
 
-// supportedDecoders lists all audio formats supported via ffmpeg
+// supportedDecoders lists all audio formats supported in-process or via ffmpeg
 var supportedDecoders = []decoderInfo{
 	{
 		plugin:    "flac",
 		suffixes:  []string{"flac"},
 		mimeTypes: []string{"audio/flac", "audio/x-flac"},
+		builtin:   true,
+		codecs:    []string{"flac"},
 	},
 	{
 		plugin:    "mp3",
 		suffixes:  []string{"mp3", "mp2"},
 		mimeTypes: []string{"audio/mpeg"},
+		codecs:    []string{"mp3float", "mp3"},
 	},
 	{
 		plugin:    "aac",
 		suffixes:  []string{"aac", "m4a", "mp4"},
 		mimeTypes: []string{"audio/aac", "audio/mp4", "audio/x-m4a"},
+		codecs:    []string{"aac"},
 	},
 	{
 		plugin:    "vorbis",
 		suffixes:  []string{"ogg", "oga"},
 		mimeTypes: []string{"audio/ogg", "audio/vorbis", "application/ogg"},
+		codecs:    []string{"vorbis", "libvorbis"},
 	},
 	{
 		plugin:    "opus",
 		suffixes:  []string{"opus"},
 		mimeTypes: []string{"audio/opus"},
+		codecs:    []string{"opus", "libopus"},
 	},
 	{
 		plugin:    "wav",
 		suffixes:  []string{"wav"},
 		mimeTypes: []string{"audio/wav", "audio/x-wav"},
+		builtin:   true,
+		codecs:    []string{"pcm_s16le", "pcm_s24le"},
 	},
 	{
 		plugin:    "aiff",
 		suffixes:  []string{"aiff", "aif"},
 		mimeTypes: []string{"audio/aiff", "audio/x-aiff"},
+		builtin:   true,
+		codecs:    []string{"pcm_s16be", "pcm_s24be"},
 	},
 	{
 		plugin:    "ape",
 		suffixes:  []string{"ape"},
 		mimeTypes: []string{"audio/ape", "audio/x-ape"},
+		codecs:    []string{"ape"},
 	},
 	{
 		plugin:    "wma",
 		suffixes:  []string{"wma"},
 		mimeTypes: []string{"audio/x-ms-wma"},
+		codecs:    []string{"wmav2", "wmav1"},
 	},
 	{
 		plugin:    "alac",
 		suffixes:  []string{"m4a"},
 		mimeTypes: []string{"audio/mp4"},
+		codecs:    []string{"alac"},
 	},
 	{
 		plugin:    "dsd",
 		suffixes:  []string{"dsf", "dff"},
 		mimeTypes: []string{"audio/dsd", "audio/x-dsd"},
+		builtin:   true,
+		codecs:    []string{"dsd_lsbf", "dsd_msbf"},
 	},
 }
 
-// formatTrackInfo formats track information with metadata for MPD protocol
-// Outputs standard MPD fields in the correct order and format
+// urlHandlers lists the URI schemes that can be queued
+// Local paths and database URIs carry no scheme and are always accepted
+var urlHandlers = []string{
+	"file://",
+	"http://",
+	"https://",
+}
+
+// formatSongInfo formats song information with metadata for MPD protocol
+// Outputs the file, enabled tags and duration shared by queue and stored playlist entries
 // Only outputs tags that are enabled via tagtypes command
-func (s *Server) formatTrackInfo(track *playlist.Track, pos int) string {
+func (s *Server) formatSongInfo(client *clientState, track *playlist.Track) string {
 	var info strings.Builder
 
 	// Required fields
-	info.WriteString(fmt.Sprintf("file: %s\n", track.URL))
-
-	// Get read lock for tag types
-	s.tagTypesMu.RLock()
-	defer s.tagTypesMu.RUnlock()
+	info.WriteString(fmt.Sprintf("file: %s\n", s.displayURI(track.URL)))
 
 	// Output metadata fields that are enabled
 	for tag, mpdField := range metadataFields {
 		// Check if this tag type is enabled
-		if !s.enabledTags[tag] {
+		if !client.tags[tag] {
 			continue
 		}
-		if value, ok := track.Metadata[tag]; ok && value != "" {
+		// Client-supplied tags (addtagid) override probed metadata
+		value, ok := track.Tags[tag]
+		if !ok {
+			value = track.Metadata[tag]
+		}
+		if value != "" {
 			info.WriteString(fmt.Sprintf("%s: %s\n", mpdField, value))
 		}
 	}
@@ -122,89 +166,123 @@ func (s *Server) formatTrackInfo(track *playlist.Track, pos int) string {
 		}
 	}
 
+	return info.String()
+}
+
+// formatTrackInfo formats queue track information with metadata for MPD protocol
+// Adds the queue-specific fields (range, priority, position, ID) to formatSongInfo
+func (s *Server) formatTrackInfo(client *clientState, track *playlist.Track, pos int) string {
+	var info strings.Builder
+	info.WriteString(s.formatSongInfo(client, track))
+
+	// Playback range - only output when set, like MPD
+	if track.RangeStart > 0 || track.RangeEnd > 0 {
+		if track.RangeEnd > 0 {
+			info.WriteString(fmt.Sprintf("Range: %.3f-%.3f\n", track.RangeStart, track.RangeEnd))
+		} else {
+			info.WriteString(fmt.Sprintf("Range: %.3f-\n", track.RangeStart))
+		}
+	}
+
+	// Priority - only output when set, like MPD
+	if track.Priority > 0 {
+		info.WriteString(fmt.Sprintf("Prio: %d\n", track.Priority))
+	}
+
 	// Position and ID - always output
 	info.WriteString(fmt.Sprintf("Pos: %d\n", pos))
-	info.WriteString(fmt.Sprintf("Id: %d\n", pos))
+	info.WriteString(fmt.Sprintf("Id: %d\n", track.ID))
 
 	return info.String()
 }
 
 // cmdTagTypes handles the 'tagtypes' command
-// Controls which metadata tags are returned in responses
-func (s *Server) cmdTagTypes(args []string) string {
+// tagtypes - list the tag types enabled for this client
+// tagtypes available - list every supported tag type
+// tagtypes enable|disable NAME... - change the enabled tag types
+// tagtypes reset NAME... - enable only the given tag types
+// tagtypes clear|all - disable or enable every tag type
+func (s *Server) cmdTagTypes(client *clientState, args []string) (string, *ackError) {
 	if len(args) == 0 {
-		// List all enabled tag types
-		s.tagTypesMu.RLock()
-		defer s.tagTypesMu.RUnlock()
-
-		var response strings.Builder
-		for tag, enabled := range s.enabledTags {
-			if enabled {
-				response.WriteString(fmt.Sprintf("tagtype: %s\n", tag))
-			}
-		}
-		response.WriteString("OK\n")
-		return response.String()
+		return formatTagTypes(client.tags), nil
 	}
 
 	// Handle subcommands
 	subcommand := strings.ToLower(args[0])
 
-	// Try to unquote if it's a quoted string, otherwise use as-is
-	if unquoted, err := strconv.Unquote(subcommand); err == nil {
-		subcommand = unquoted
-	}
-
 	switch subcommand {
+	case "available":
+		return formatTagTypes(nil), nil
+
 	case "clear":
 		// Disable all tag types
-		s.tagTypesMu.Lock()
-		for tag := range s.enabledTags {
-			s.enabledTags[tag] = false
-		}
-		s.tagTypesMu.Unlock()
-		return "OK\n"
-
-	case "enable":
-		// Enable specified tag types
-		s.tagTypesMu.Lock()
-		for _, tag := range args[1:] {
-			tagLower := strings.ToLower(tag)
-			s.enabledTags[tagLower] = true
-		}
-		s.tagTypesMu.Unlock()
-		return "OK\n"
-
-	case "disable":
-		// Disable specified tag types
-		s.tagTypesMu.Lock()
-		for _, tag := range args[1:] {
-			tagLower := strings.ToLower(tag)
-			s.enabledTags[tagLower] = false
-		}
-		s.tagTypesMu.Unlock()
-		return "OK\n"
+		client.tags = make(map[string]bool)
+		return "OK\n", nil
 
 	case "all":
 		// Enable all tag types
-		s.tagTypesMu.Lock()
-		for tag := range s.enabledTags {
-			s.enabledTags[tag] = true
+		client.tags = allTagTypes()
+		return "OK\n", nil
+
+	case "enable", "disable", "reset":
+		// Validate every tag type before changing any
+		tags := make([]string, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			tag := strings.ToLower(arg)
+			if _, ok := metadataFields[tag]; !ok {
+				return "", ack(ackErrorArg, "tagtypes", "Unknown tag type: %s", arg)
+			}
+			tags = append(tags, tag)
 		}
-		s.tagTypesMu.Unlock()
-		return "OK\n"
+
+		if subcommand == "reset" {
+			client.tags = make(map[string]bool)
+		}
+		for _, tag := range tags {
+			if subcommand == "disable" {
+				delete(client.tags, tag)
+			} else {
+				client.tags[tag] = true
+			}
+		}
+		return "OK\n", nil
 
 	default:
-		return fmt.Sprintf("ACK [2@0] {tagtypes} unknown subcommand: %s\n", subcommand)
+		return "", ack(ackErrorArg, "tagtypes", "unknown subcommand: %s", subcommand)
+	}
+}
+
+// formatTagTypes lists tag types in MPD's order, only those in enabled unless it is nil
+func formatTagTypes(enabled map[string]bool) string {
+	var response strings.Builder
+	for _, tag := range tagTypes {
+		if enabled == nil || enabled[tag] {
+			response.WriteString(fmt.Sprintf("tagtype: %s\n", metadataFields[tag]))
+		}
 	}
+	response.WriteString("OK\n")
+	return response.String()
+}
+
+// allTagTypes returns a tag type set with every supported tag enabled
+func allTagTypes() map[string]bool {
+	tags := make(map[string]bool, len(tagTypes))
+	for _, tag := range tagTypes {
+		tags[tag] = true
+	}
+	return tags
 }
 
 // cmdDecoders handles the 'decoders' command
-// Returns the list of supported audio decoders (based on ffmpeg capabilities)
-func (s *Server) cmdDecoders(args []string) string {
+// Returns the list of supported audio decoders: those played in-process,
+// and those the ffmpeg found at startup was built to decode
+func (s *Server) cmdDecoders(args []string) (string, *ackError) {
 	var response strings.Builder
 
 	for _, decoder := range supportedDecoders {
+		if !decoder.available() {
+			continue
+		}
 		response.WriteString(fmt.Sprintf("plugin: %s\n", decoder.plugin))
 		for _, suffix := range decoder.suffixes {
 			response.WriteString(fmt.Sprintf("suffix: %s\n", suffix))
@@ -215,5 +293,70 @@ func (s *Server) cmdDecoders(args []string) string {
 	}
 
 	response.WriteString("OK\n")
-	return response.String()
-}
\ No newline at end of file
+	return response.String(), nil
+}
+
+// available reports whether files of a decoder plugin can be played
+func (d decoderInfo) available() bool {
+	if d.builtin {
+		return true
+	}
+	for _, codec := range d.codecs {
+		if decoder.HasDecoder(codec) {
+			return true
+		}
+	}
+	return false
+}
+
+// cmdURLHandlers handles the 'urlhandlers' command
+// Returns the URI schemes accepted by add and addid
+func (s *Server) cmdURLHandlers(args []string) (string, *ackError) {
+	var response strings.Builder
+
+	for _, handler := range urlHandlers {
+		response.WriteString(fmt.Sprintf("handler: %s\n", handler))
+	}
+
+	response.WriteString("OK\n")
+	return response.String(), nil
+}
+
+// cmdGetFingerprint handles the 'getfingerprint' command
+// Usage: getfingerprint URI
+// Returns the Chromaprint fingerprint of the song for AcoustID lookups
+func (s *Server) cmdGetFingerprint(args []string) (string, *ackError) {
+	if len(args) == 0 {
+		return "", ack(ackErrorArg, "getfingerprint", "missing URI")
+	}
+
+	source, ok := s.localFilePath(args[0])
+	if ok {
+		if _, err := os.Stat(source); err != nil {
+			return "", ack(ackErrorNoExist, "getfingerprint", "No such song")
+		}
+	} else {
+		source = s.resolveURI(args[0])
+		if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+			return "", ack(ackErrorNoExist, "getfingerprint", "No such song")
+		}
+	}
+
+	fingerprint, err := decoder.Fingerprint(source)
+	if err != nil {
+		log.Printf("Failed to fingerprint %s: %v", source, err)
+		return "", ack(ackErrorSystem, "getfingerprint", "Failed to compute fingerprint")
+	}
+
+	return fmt.Sprintf("chromaprint: %s\nOK\n", fingerprint), nil
+}
+
+// parseTagArg converts an MPD tag name (e.g. "Artist") to its internal key
+// Returns false if the tag is not supported
+func parseTagArg(arg string) (string, bool) {
+	tag := strings.ToLower(arg)
+	if _, ok := metadataFields[tag]; !ok {
+		return "", false
+	}
+	return tag, true
+}
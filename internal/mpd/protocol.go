@@ -0,0 +1,84 @@
+package mpd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// protocolFeatures lists the optional protocol features clients can enable (MPD 0.24)
+var protocolFeatures = []string{
+	"hide_playlists_in_root", // lsinfo on the root omits stored playlists
+}
+
+// cmdProtocol handles the 'protocol' command
+// protocol - list the features enabled for this client
+// protocol available - list every supported feature
+// protocol enable|disable FEATURE... - change the enabled features
+// protocol all|clear - enable or disable every feature
+func (s *Server) cmdProtocol(client *clientState, args []string) (string, *ackError) {
+	if len(args) == 0 {
+		var response strings.Builder
+		for _, feature := range protocolFeatures {
+			if client.features[feature] {
+				response.WriteString(fmt.Sprintf("feature: %s\n", feature))
+			}
+		}
+		response.WriteString("OK\n")
+		return response.String(), nil
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "available":
+		var response strings.Builder
+		for _, feature := range protocolFeatures {
+			response.WriteString(fmt.Sprintf("feature: %s\n", feature))
+		}
+		response.WriteString("OK\n")
+		return response.String(), nil
+
+	case "all":
+		for _, feature := range protocolFeatures {
+			client.features[feature] = true
+		}
+		return "OK\n", nil
+
+	case "clear":
+		client.features = make(map[string]bool)
+		return "OK\n", nil
+
+	case "enable", "disable":
+		if len(args) < 2 {
+			return "", ack(ackErrorArg, "protocol", "missing feature name")
+		}
+
+		// Validate every feature before changing any
+		for _, name := range args[1:] {
+			if !knownProtocolFeature(name) {
+				return "", ack(ackErrorArg, "protocol", "Unknown protocol feature: %s", name)
+			}
+		}
+
+		enable := strings.ToLower(args[0]) == "enable"
+		for _, name := range args[1:] {
+			if enable {
+				client.features[name] = true
+			} else {
+				delete(client.features, name)
+			}
+		}
+		return "OK\n", nil
+
+	default:
+		return "", ack(ackErrorArg, "protocol", "unknown sub command: %s", args[0])
+	}
+}
+
+// knownProtocolFeature reports whether name is a supported protocol feature
+func knownProtocolFeature(name string) bool {
+	for _, feature := range protocolFeatures {
+		if feature == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package mpd
+
+import (
+	"bufio"
+	"io"
+)
+
+// responseBufferSize is how much response data is held before it is sent to the client
+const responseBufferSize = 64 * 1024
+
+// responseWriter buffers a client's responses and sends them in chunks
+// Listing handlers write their entries here as they go, so a large queue or
+// database listing never has to be built in memory as one string
+type responseWriter struct {
+	w        *bufio.Writer
+	streamed int // Bytes written by handlers for the current command, for logging
+}
+
+// newResponseWriter returns a response writer sending to w
+func newResponseWriter(w io.Writer) *responseWriter {
+	return &responseWriter{w: bufio.NewWriterSize(w, responseBufferSize)}
+}
+
+// WriteString writes part of a response, sending the buffer whenever it fills up
+func (r *responseWriter) WriteString(s string) {
+	n, _ := r.w.WriteString(s) // Write errors resurface on Flush
+	r.streamed += n
+}
+
+// writeResponse writes the string a handler returned
+// It is not counted as streamed since the connection logs it itself
+func (r *responseWriter) writeResponse(s string) {
+	r.w.WriteString(s)
+}
+
+// Flush sends everything buffered to the client
+func (r *responseWriter) Flush() error {
+	return r.w.Flush()
+}
+
+// takeStreamed returns the bytes streamed since the last call and resets the count
+func (r *responseWriter) takeStreamed() int {
+	n := r.streamed
+	r.streamed = 0
+	return n
+}
@@ -1,15 +1,18 @@
 package mpd
 
 import (
-	"fmt"
 	"strings"
 )
 
-// handleCommand processes a single MPD command
-func (s *Server) handleCommand(line string) string {
-	parts := strings.Fields(line)
+// handleCommand processes a single MPD command for a client
+func (s *Server) handleCommand(client *clientState, line string) (string, *ackError) {
+	parts, err := tokenize(line)
+	if err != nil {
+		name, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+		return "", ack(ackErrorArg, strings.ToLower(name), "%v", err)
+	}
 	if len(parts) == 0 {
-		return "OK\n"
+		return "OK\n", nil
 	}
 
 	command := strings.ToLower(parts[0])
@@ -17,7 +20,7 @@ func (s *Server) handleCommand(line string) string {
 
 	switch command {
 	case "ping":
-		return "OK\n"
+		return "OK\n", nil
 
 	case "add":
 		return s.cmdAdd(args)
@@ -28,6 +31,9 @@ func (s *Server) handleCommand(line string) string {
 	case "play":
 		return s.cmdPlay(args)
 
+	case "playid":
+		return s.cmdPlayId(args)
+
 	case "pause":
 		return s.cmdPause(args)
 
@@ -43,6 +49,9 @@ func (s *Server) handleCommand(line string) string {
 	case "seek":
 		return s.cmdSeek(args)
 
+	case "seekid":
+		return s.cmdSeekId(args)
+
 	case "seekcur":
 		return s.cmdSeekCur(args)
 
@@ -50,26 +59,167 @@ func (s *Server) handleCommand(line string) string {
 		return s.cmdStatus(args)
 
 	case "playlistinfo":
-		return s.cmdPlaylistInfo(args)
+		return s.cmdPlaylistInfo(client, args)
+
+	case "playlistid":
+		return s.cmdPlaylistId(client, args)
 
 	case "clear":
 		return s.cmdClear(args)
 
+	case "move":
+		return s.cmdMove(args)
+
+	case "moveid":
+		return s.cmdMoveId(args)
+
+	case "swap":
+		return s.cmdSwap(args)
+
+	case "swapid":
+		return s.cmdSwapId(args)
+
+	case "prio":
+		return s.cmdPrio(args)
+
+	case "prioid":
+		return s.cmdPrioId(args)
+
+	case "rangeid":
+		return s.cmdRangeId(args)
+
+	case "addtagid":
+		return s.cmdAddTagId(args)
+
+	case "cleartagid":
+		return s.cmdClearTagId(args)
+
+	case "shuffle":
+		return s.cmdShuffle(args)
+
 	case "currentsong":
-		return s.cmdCurrentSong(args)
+		return s.cmdCurrentSong(client, args)
 
 	case "plchanges":
-		return s.cmdPlChanges(args)
+		return s.cmdPlChanges(client, args)
+
+	case "listplaylists":
+		return s.cmdListPlaylists(args)
+
+	case "listplaylist":
+		return s.cmdListPlaylist(args)
+
+	case "listplaylistinfo":
+		return s.cmdListPlaylistInfo(client, args)
+
+	case "save":
+		return s.cmdSave(args)
+
+	case "load":
+		return s.cmdLoad(args)
+
+	case "rm":
+		return s.cmdRm(args)
+
+	case "rename":
+		return s.cmdRename(args)
+
+	case "playlistadd":
+		return s.cmdPlaylistAdd(args)
+
+	case "playlistclear":
+		return s.cmdPlaylistClear(args)
+
+	case "playlistdelete":
+		return s.cmdPlaylistDelete(args)
+
+	case "playlistmove":
+		return s.cmdPlaylistMove(args)
+
+	case "update":
+		return s.cmdUpdate(args)
+
+	case "rescan":
+		return s.cmdRescan(args)
+
+	case "lsinfo":
+		return s.cmdLsInfo(client, args)
+
+	case "listall":
+		return s.cmdListAll(client, args)
+
+	case "listallinfo":
+		return s.cmdListAllInfo(client, args)
+
+	case "find":
+		return s.cmdFind(client, args)
+
+	case "search":
+		return s.cmdSearch(client, args)
+
+	case "findadd":
+		return s.cmdFindAdd(args)
+
+	case "searchadd":
+		return s.cmdSearchAdd(args)
+
+	case "list":
+		return s.cmdList(args)
+
+	case "stats":
+		return s.cmdStats(args)
+
+	case "albumart":
+		return s.cmdAlbumArt(client, args)
+
+	case "readpicture":
+		return s.cmdReadPicture(client, args)
+
+	case "protocol":
+		return s.cmdProtocol(client, args)
+
+	case "binarylimit":
+		return s.cmdBinaryLimit(client, args)
+
+	case "mount":
+		return s.cmdMount(args)
+
+	case "unmount":
+		return s.cmdUnmount(args)
+
+	case "listmounts":
+		return s.cmdListMounts(args)
+
+	case "listneighbors":
+		return s.cmdListNeighbors(args)
 
 	case "tagtypes":
-		return s.cmdTagTypes(args)
+		return s.cmdTagTypes(client, args)
 
 	case "outputs":
 		return s.cmdOutputs(args)
 
+	case "config":
+		return s.cmdConfig(client)
+
+	case "enableoutput":
+		return s.cmdEnableOutput(args)
+
+	case "disableoutput":
+		return s.cmdDisableOutput(args)
+
+	case "toggleoutput":
+		return s.cmdToggleOutput(args)
+
 	case "decoders":
 		return s.cmdDecoders(args)
 
+	case "urlhandlers":
+		return s.cmdURLHandlers(args)
+
+	case "getfingerprint":
+		return s.cmdGetFingerprint(args)
+
 	case "single":
 		return s.cmdSingle(args)
 
@@ -82,11 +232,51 @@ func (s *Server) handleCommand(line string) string {
 	case "random":
 		return s.cmdRandom(args)
 
+	case "crossfade":
+		return s.cmdCrossfade(args)
+
+	case "clearerror":
+		return s.cmdClearError(args)
+
+	case "setvol":
+		return s.cmdSetVol(args)
+
+	case "volume":
+		return s.cmdVolume(args)
+
+	case "getvol":
+		return s.cmdGetVol(args)
+
+	case "replay_gain_mode":
+		return s.cmdReplayGainMode(args)
+
+	case "replay_gain_status":
+		return s.cmdReplayGainStatus(args)
+
 	case "close":
-		return "" // Client will close connection
+		client.closing = true
+		return "", nil
+
+	case "subscribe":
+		return s.cmdSubscribe(client, args)
+
+	case "unsubscribe":
+		return s.cmdUnsubscribe(client, args)
+
+	case "channels":
+		return s.cmdChannels(args)
+
+	case "readmessages":
+		return s.cmdReadMessages(client)
+
+	case "sendmessage":
+		return s.cmdSendMessage(args)
+
+	case "kill":
+		return s.cmdKill(client)
 
 	default:
 		// 		log.Fatalf("Unknown MPD command received: %s (full line: %s)", command, line)
-		return fmt.Sprintf("ACK [5@0] {%s} unknown command\n", command)
+		return "", ack(ackErrorUnknown, command, "unknown command")
 	}
 }
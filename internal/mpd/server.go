@@ -4,20 +4,47 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/famish99/direttampd/internal/config"
+	"github.com/famish99/direttampd/internal/database"
+	"github.com/famish99/direttampd/internal/neighbors"
 	"github.com/famish99/direttampd/internal/player"
+	"github.com/famish99/direttampd/internal/storedplaylist"
 )
 
+// defaultPort is used for TCP listen addresses given without a port
+const defaultPort = "6600"
+
 // Server implements MPD protocol server
 type Server struct {
-	mu           sync.Mutex
-	listener     net.Listener
-	player       *player.Player
-	addr         string
-	running      bool
-	enabledTags  map[string]bool // Track which tag types are enabled
-	tagTypesMu   sync.RWMutex    // Protects enabledTags
+	mu         sync.Mutex
+	listeners  []net.Listener
+	player     *player.Player
+	addrs      []string // TCP addresses and unix socket paths to listen on
+	running    bool
+	playlists  *storedplaylist.Store
+	db         *database.Database
+	startTime  time.Time // For the uptime reported by stats
+	autoUpdate bool      // Watch the music directory for changes
+	watcher    *database.Watcher
+	pictures   pictureCache // Last embedded picture served by readpicture
+	neighbors  *neighbors.Finder
+
+	// Connected clients, for channel messaging
+	clientsMu sync.Mutex
+	clients   map[*clientState]bool
+
+	// Closed when a client asks the daemon to shut down (kill command)
+	killed   chan struct{}
+	killOnce sync.Once
+
+	// Directories reported to local clients by the config command
+	musicDirectory    string
+	playlistDirectory string
 
 	// Idle connection management
 	idleMu      sync.RWMutex
@@ -26,27 +53,23 @@ type Server struct {
 }
 
 // NewServer creates a new MPD protocol server
-func NewServer(addr string, p *player.Player) *Server {
-	// Initialize with all tags enabled by default
-	enabledTags := map[string]bool{
-		"artist":      true,
-		"albumartist": true,
-		"album":       true,
-		"title":       true,
-		"track":       true,
-		"name":        true,
-		"genre":       true,
-		"date":        true,
-		"composer":    true,
-		"performer":   true,
-		"disc":        true,
-	}
-
+// Each address is a TCP "host:port" (the port defaults to 6600) or a unix socket path
+func NewServer(addrs []string, p *player.Player, cfg *config.Config) *Server {
 	s := &Server{
-		addr:        addr,
-		player:      p,
-		enabledTags: enabledTags,
-		idleConns:   make(map[*idleConnection]bool),
+		addrs:      addrs,
+		player:     p,
+		playlists:  storedplaylist.NewStore(cfg.PlaylistDirectory, cfg.PlaylistFormat),
+		db:         openDatabase(cfg),
+		idleConns:  make(map[*idleConnection]bool),
+		startTime:  time.Now(),
+		autoUpdate: cfg.AutoUpdate,
+		neighbors:  neighbors.NewFinder(2*time.Second, time.Minute),
+
+		clients: make(map[*clientState]bool),
+		killed:  make(chan struct{}),
+
+		musicDirectory:    cfg.MusicDirectory,
+		playlistDirectory: cfg.PlaylistDirectory,
 	}
 
 	// Set up player notification callback for idle connections
@@ -56,6 +79,17 @@ func NewServer(addr string, p *player.Player) *Server {
 	return s
 }
 
+// openDatabase opens the music database, falling back to an in-memory index
+// if the database file cannot be used
+func openDatabase(cfg *config.Config) *database.Database {
+	db, err := database.Open(cfg.MusicDirectory, cfg.DBFile)
+	if err != nil {
+		log.Printf("Failed to open database file, using in-memory index: %v", err)
+		return database.New(cfg.MusicDirectory)
+	}
+	return db
+}
+
 // Start starts the MPD server
 func (s *Server) Start() error {
 	s.mu.Lock()
@@ -65,17 +99,44 @@ func (s *Server) Start() error {
 		return fmt.Errorf("server already running")
 	}
 
-	listener, err := net.Listen("tcp", s.addr)
-	if err != nil {
-		return fmt.Errorf("failed to start MPD server: %w", err)
+	if len(s.addrs) == 0 {
+		return fmt.Errorf("no listen addresses configured")
+	}
+
+	for _, addr := range s.addrs {
+		listener, err := listen(addr)
+		if err != nil {
+			for _, opened := range s.listeners {
+				opened.Close()
+			}
+			s.listeners = nil
+			return fmt.Errorf("failed to start MPD server on %s: %w", addr, err)
+		}
+		s.listeners = append(s.listeners, listener)
+		log.Printf("MPD server listening on %s", addr)
 	}
 
-	s.listener = listener
 	s.running = true
+	for _, listener := range s.listeners {
+		go s.acceptLoop(listener)
+	}
 
-	log.Printf("MPD server listening on %s", s.addr)
+	// Build the music database in the background unless a saved index was loaded
+	if s.db.Enabled() && s.db.LastUpdate().IsZero() {
+		if _, err := s.db.StartUpdate("", false, s.databaseUpdated); err != nil {
+			log.Printf("Failed to start database update: %v", err)
+		}
+	}
 
-	go s.acceptLoop()
+	// Keep the database in sync with the music directory
+	if s.db.Enabled() && s.autoUpdate {
+		watcher, err := s.db.Watch(s.autoUpdateDirectory)
+		if err != nil {
+			log.Printf("Failed to watch music directory: %v", err)
+		} else {
+			s.watcher = watcher
+		}
+	}
 
 	return nil
 }
@@ -90,17 +151,52 @@ func (s *Server) Stop() error {
 	}
 
 	s.running = false
-	if s.listener != nil {
-		return s.listener.Close()
+	if s.watcher != nil {
+		s.watcher.Close()
+		s.watcher = nil
 	}
-    s.player.Quit()
-	return nil
+	if err := s.db.Close(); err != nil {
+		log.Printf("Failed to close database: %v", err)
+	}
+	// Closing a listener ends its accept loop; unix socket files are removed
+	var firstErr error
+	for _, listener := range s.listeners {
+		if err := listener.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.listeners = nil
+	s.player.Quit()
+	return firstErr
+}
+
+// listen opens a listener for a TCP address or, for a path, a unix socket
+func listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "/") {
+		// Remove a socket left behind by an unclean shutdown
+		if info, err := os.Stat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+		return net.Listen("unix", addr)
+	}
+
+	// Accept a bare host (including an unbracketed IPv6 address) with the default port
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, defaultPort)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Killed returns a channel that is closed when a client sends the kill command
+// The daemon should then shut down as it does on SIGTERM
+func (s *Server) Killed() <-chan struct{} {
+	return s.killed
 }
 
-// acceptLoop accepts incoming connections
-func (s *Server) acceptLoop() {
+// acceptLoop accepts incoming connections on one listener
+func (s *Server) acceptLoop(listener net.Listener) {
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			s.mu.Lock()
 			running := s.running
@@ -114,4 +210,4 @@ func (s *Server) acceptLoop() {
 
 		go s.handleConnection(conn)
 	}
-}
\ No newline at end of file
+}
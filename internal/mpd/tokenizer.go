@@ -0,0 +1,68 @@
+package mpd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// tokenize splits a command line into the command name and its arguments
+// Arguments are separated by whitespace; a double-quoted argument may contain
+// spaces, and within it a backslash escapes the next character (\" or \\)
+// The quotes and escapes are removed, so a quoted filter expression such as
+// "(Artist == \"Foo Bar\")" reaches the handler as (Artist == "Foo Bar")
+func tokenize(line string) ([]string, error) {
+	var tokens []string
+
+	for i := 0; i < len(line); {
+		// Skip whitespace between tokens
+		if line[i] == ' ' || line[i] == '\t' {
+			i++
+			continue
+		}
+
+		if line[i] != '"' {
+			end := strings.IndexAny(line[i:], " \t")
+			if end < 0 {
+				end = len(line) - i
+			}
+			word := line[i : i+end]
+			if strings.ContainsRune(word, '"') {
+				return nil, fmt.Errorf("unexpected '\"' in %s", word)
+			}
+			tokens = append(tokens, word)
+			i += end
+			continue
+		}
+
+		// Quoted argument
+		var token strings.Builder
+		i++
+		closed := false
+		for i < len(line) {
+			c := line[i]
+			i++
+			if c == '\\' {
+				if i == len(line) {
+					break
+				}
+				token.WriteByte(line[i])
+				i++
+				continue
+			}
+			if c == '"' {
+				closed = true
+				break
+			}
+			token.WriteByte(c)
+		}
+		if !closed {
+			return nil, fmt.Errorf("missing closing '\"'")
+		}
+		if i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			return nil, fmt.Errorf("space expected after closing '\"'")
+		}
+		tokens = append(tokens, token.String())
+	}
+
+	return tokens, nil
+}
@@ -0,0 +1,63 @@
+package mpd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"blank", " \t ", nil},
+		{"command only", "status", []string{"status"}},
+		{"bare arguments", "play 3", []string{"play", "3"}},
+		{"tabs and repeated spaces", "move\t1  \t2", []string{"move", "1", "2"}},
+		{"quoted argument with spaces", `add "Some Artist/Some Album/01 Song.flac"`, []string{"add", "Some Artist/Some Album/01 Song.flac"}},
+		{"empty quoted argument", `find artist ""`, []string{"find", "artist", ""}},
+		{"escaped quote", `find title "say \"hi\""`, []string{"find", "title", `say "hi"`}},
+		{"escaped backslash", `add "a\\b"`, []string{"add", `a\b`}},
+		{"escaped ordinary character", `add "\a"`, []string{"add", "a"}},
+		{"filter expression", `find "(Artist == \"Foo Bar\")"`, []string{"find", `(Artist == "Foo Bar")`}},
+		{"nested escapes", `find "(Title == \"a \\\"b\\\"\")"`, []string{"find", `(Title == "a \"b\"")`}},
+		{"quoted then bare", `sticker get song "a b" rating`, []string{"sticker", "get", "song", "a b", "rating"}},
+		{"single quotes are literal", `find artist 'Foo'`, []string{"find", "artist", "'Foo'"}},
+		{"utf-8", `add "Björk/Début"`, []string{"add", "Björk/Début"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tokenize(tt.line)
+			if err != nil {
+				t.Fatalf("tokenize(%q): %v", tt.line, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tokenize(%q) = %q, want %q", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenizeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"unterminated quote", `add "abc`},
+		{"trailing backslash", `add "abc\`},
+		{"quote inside bare word", `add ab"c"`},
+		{"no space after closing quote", `add "a"b`},
+		{"quote right after quote", `add "a""b"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := tokenize(tt.line); err == nil {
+				t.Errorf("tokenize(%q) = %q, want an error", tt.line, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package neighbors
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// mdnsAddr is the mDNS IPv4 multicast group
+const mdnsAddr = "224.0.0.251:5353"
+
+// mdnsServices maps the DNS-SD service types browsed to their URI scheme
+var mdnsServices = map[string]string{
+	"_smb._tcp.local.":     "smb",
+	"_webdav._tcp.local.":  "dav",
+	"_webdavs._tcp.local.": "davs",
+}
+
+// mdnsService is a service instance assembled from mDNS records
+type mdnsService struct {
+	scheme string
+	target string // Host name from the SRV record
+	port   uint16
+	path   string // "path" TXT attribute (WebDAV)
+}
+
+// discoverMDNS browses for SMB and WebDAV shares with multicast DNS
+func discoverMDNS(timeout time.Duration) ([]Neighbor, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UDP socket: %w", err)
+	}
+	defer conn.Close()
+
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := buildMDNSQuery()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(query, group); err != nil {
+		return nil, fmt.Errorf("failed to send mDNS query: %w", err)
+	}
+
+	// Records may arrive in any order and across packets, so gather them all first
+	instances := make(map[string]*mdnsService) // Keyed by instance name
+	hosts := make(map[string]net.IP)           // A records keyed by host name
+
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break // Deadline reached
+		}
+
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil {
+			continue
+		}
+
+		records := append(append(msg.Answers, msg.Additionals...), msg.Authorities...)
+		for _, record := range records {
+			collectRecord(record, instances, hosts)
+		}
+	}
+
+	var neighbors []Neighbor
+	for instance, service := range instances {
+		if service.target == "" {
+			continue
+		}
+
+		host := strings.TrimSuffix(service.target, ".")
+		if ip, ok := hosts[service.target]; ok {
+			host = ip.String()
+		}
+
+		// An SMB server is mounted a share at a time, so list its shares if it tells them
+		if service.scheme == "smb" {
+			if shares := smbShares(host, timeout); len(shares) > 0 {
+				for _, share := range shares {
+					neighbors = append(neighbors, Neighbor{
+						URI:  fmt.Sprintf("smb://%s/%s", host, url.PathEscape(share)),
+						Name: instanceLabel(instance) + ": " + share,
+					})
+				}
+				continue
+			}
+		}
+
+		uri := fmt.Sprintf("%s://%s", service.scheme, host)
+		if service.scheme != "smb" && service.port != 0 {
+			uri = fmt.Sprintf("%s:%d", uri, service.port)
+		}
+		uri += "/" + strings.TrimPrefix(service.path, "/")
+
+		neighbors = append(neighbors, Neighbor{
+			URI:  uri,
+			Name: instanceLabel(instance),
+		})
+	}
+
+	return neighbors, nil
+}
+
+// smbShares lists the disk shares of an SMB server as a guest with smbclient,
+// returning none if smbclient is not installed or the server refuses
+func smbShares(host string, timeout time.Duration) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// -g prints one "type|name|comment" line per share
+	output, err := exec.CommandContext(ctx, "smbclient", "-g", "-N", "-L", host).Output()
+	if err != nil {
+		return nil
+	}
+
+	var shares []string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Split(line, "|")
+		// Shares ending in $ are administrative
+		if len(fields) >= 2 && fields[0] == "Disk" && !strings.HasSuffix(fields[1], "$") {
+			shares = append(shares, fields[1])
+		}
+	}
+	return shares
+}
+
+// buildMDNSQuery builds a PTR query for every browsed service type
+// The unicast-response bit asks responders to reply to our ephemeral port
+func buildMDNSQuery() ([]byte, error) {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+
+	for service := range mdnsServices {
+		name, err := dnsmessage.NewName(service)
+		if err != nil {
+			return nil, err
+		}
+		if err := builder.Question(dnsmessage.Question{
+			Name:  name,
+			Type:  dnsmessage.TypePTR,
+			Class: dnsmessage.ClassINET | (1 << 15),
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return builder.Finish()
+}
+
+// collectRecord merges one resource record into the discovered instances and hosts
+func collectRecord(record dnsmessage.Resource, instances map[string]*mdnsService, hosts map[string]net.IP) {
+	name := record.Header.Name.String()
+
+	switch body := record.Body.(type) {
+	case *dnsmessage.PTRResource:
+		if scheme, ok := mdnsServices[name]; ok {
+			instance := body.PTR.String()
+			if instances[instance] == nil {
+				instances[instance] = &mdnsService{scheme: scheme}
+			}
+		}
+
+	case *dnsmessage.SRVResource:
+		if service := instanceFor(name, instances); service != nil {
+			service.target = body.Target.String()
+			service.port = body.Port
+		}
+
+	case *dnsmessage.TXTResource:
+		if service := instanceFor(name, instances); service != nil {
+			for _, txt := range body.TXT {
+				if path, ok := strings.CutPrefix(txt, "path="); ok {
+					service.path = path
+				}
+			}
+		}
+
+	case *dnsmessage.AResource:
+		hosts[name] = net.IP(body.A[:])
+	}
+}
+
+// instanceFor returns the instance a record belongs to, creating it if the
+// record arrived before its PTR
+func instanceFor(name string, instances map[string]*mdnsService) *mdnsService {
+	if service, ok := instances[name]; ok {
+		return service
+	}
+	for serviceType, scheme := range mdnsServices {
+		if strings.HasSuffix(name, "."+serviceType) {
+			service := &mdnsService{scheme: scheme}
+			instances[name] = service
+			return service
+		}
+	}
+	return nil
+}
+
+// instanceLabel returns the human-readable part of a DNS-SD instance name
+func instanceLabel(instance string) string {
+	for serviceType := range mdnsServices {
+		if label, ok := strings.CutSuffix(instance, "."+serviceType); ok {
+			return strings.ReplaceAll(label, `\ `, " ")
+		}
+	}
+	return instance
+}
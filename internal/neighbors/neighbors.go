@@ -0,0 +1,86 @@
+package neighbors
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Neighbor is a media server or file share found on the local network
+type Neighbor struct {
+	URI  string // Storage URI to pass to mount
+	Name string // Human-readable name
+}
+
+// Finder discovers neighbors and caches the result for a while,
+// since each discovery round waits for network responses
+type Finder struct {
+	timeout time.Duration
+	ttl     time.Duration
+
+	mu        sync.Mutex
+	neighbors []Neighbor
+	updated   time.Time
+}
+
+// NewFinder creates a finder that waits timeout for responses and reuses
+// results for ttl
+func NewFinder(timeout, ttl time.Duration) *Finder {
+	return &Finder{timeout: timeout, ttl: ttl}
+}
+
+// Neighbors returns the neighbors on the network, discovering them if the
+// cached list is stale
+func (f *Finder) Neighbors() []Neighbor {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.neighbors != nil && time.Since(f.updated) < f.ttl {
+		return f.neighbors
+	}
+
+	f.neighbors = Discover(f.timeout)
+	f.updated = time.Now()
+	return f.neighbors
+}
+
+// Discover queries the network for UPnP media servers (SSDP) and SMB/WebDAV
+// shares (mDNS), waiting up to timeout for responses
+func Discover(timeout time.Duration) []Neighbor {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	found := make(map[string]Neighbor)
+
+	collect := func(name string, discover func(time.Duration) ([]Neighbor, error)) {
+		defer wg.Done()
+
+		neighbors, err := discover(timeout)
+		if err != nil {
+			log.Printf("%s neighbor discovery failed: %v", name, err)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, neighbor := range neighbors {
+			found[neighbor.URI] = neighbor
+		}
+	}
+
+	wg.Add(2)
+	go collect("UPnP", discoverUPnP)
+	go collect("mDNS", discoverMDNS)
+	wg.Wait()
+
+	neighbors := make([]Neighbor, 0, len(found))
+	for _, neighbor := range found {
+		neighbors = append(neighbors, neighbor)
+	}
+	sort.Slice(neighbors, func(i, j int) bool {
+		return neighbors[i].URI < neighbors[j].URI
+	})
+
+	log.Printf("Found %d neighbors", len(neighbors))
+	return neighbors
+}
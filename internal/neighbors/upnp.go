@@ -0,0 +1,119 @@
+package neighbors
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ssdpAddr is the SSDP multicast group
+const ssdpAddr = "239.255.255.250:1900"
+
+// mediaServerType is the UPnP device type of media servers
+const mediaServerType = "urn:schemas-upnp-org:device:MediaServer:1"
+
+// discoverUPnP finds UPnP media servers with an SSDP M-SEARCH
+// Each is listed as upnp://<uuid>/, which storage.New browses by looking the
+// server up again, wherever it is by then
+func discoverUPnP(timeout time.Duration) ([]Neighbor, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UDP socket: %w", err)
+	}
+	defer conn.Close()
+
+	group, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	mx := int(timeout.Seconds())
+	if mx < 1 {
+		mx = 1
+	}
+	request := fmt.Sprintf("M-SEARCH * HTTP/1.1\r\n"+
+		"HOST: %s\r\n"+
+		"MAN: \"ssdp:discover\"\r\n"+
+		"MX: %d\r\n"+
+		"ST: %s\r\n\r\n", ssdpAddr, mx, mediaServerType)
+
+	if _, err := conn.WriteToUDP([]byte(request), group); err != nil {
+		return nil, fmt.Errorf("failed to send M-SEARCH: %w", err)
+	}
+
+	// Collect unique servers (by UUID) until the timeout
+	locations := make(map[string]string)
+	deadline := time.Now().Add(timeout)
+	_ = conn.SetReadDeadline(deadline)
+
+	buf := make([]byte, 4096)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break // Deadline reached
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+
+		uuid := strings.TrimPrefix(strings.SplitN(resp.Header.Get("USN"), "::", 2)[0], "uuid:")
+		if location := resp.Header.Get("LOCATION"); uuid != "" && location != "" {
+			locations[uuid] = location
+		}
+	}
+
+	// Fetch friendly names in parallel, falling back to the UUID
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	neighbors := make([]Neighbor, 0, len(locations))
+	for uuid, location := range locations {
+		wg.Add(1)
+		go func(uuid, location string) {
+			defer wg.Done()
+
+			name := fetchFriendlyName(location, timeout)
+			if name == "" {
+				name = uuid
+			}
+
+			mu.Lock()
+			neighbors = append(neighbors, Neighbor{
+				URI:  "upnp://" + uuid + "/",
+				Name: name,
+			})
+			mu.Unlock()
+		}(uuid, location)
+	}
+	wg.Wait()
+
+	return neighbors, nil
+}
+
+// fetchFriendlyName reads the friendlyName from a UPnP device description
+func fetchFriendlyName(location string, timeout time.Duration) string {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(location)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+
+	var description struct {
+		Device struct {
+			FriendlyName string `xml:"friendlyName"`
+		} `xml:"device"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&description); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(description.Device.FriendlyName)
+}
@@ -0,0 +1,9 @@
+package player
+
+// Backends available to the backend config field; each registers itself
+import (
+	_ "github.com/famish99/direttampd/internal/backends/memoryplay"
+	_ "github.com/famish99/direttampd/internal/backends/mirror"
+	_ "github.com/famish99/direttampd/internal/backends/null"
+	_ "github.com/famish99/direttampd/internal/backends/upnp"
+)
@@ -0,0 +1,125 @@
+package player
+
+import (
+	"context"
+	"fmt"
+)
+
+// command is a playback request run on the player's command goroutine
+type command struct {
+	run  func() error
+	done chan error
+}
+
+// commandLoop runs playback commands one at a time until the player is closed
+// MPD clients, the playback loop and state restore all go through it, so
+// their changes to the playback state and loop never interleave
+func (p *Player) commandLoop() {
+	for {
+		select {
+		case cmd := <-p.commands:
+			cmd.done <- cmd.run()
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+// do runs fn on the command goroutine and waits for its result
+// Commands must not call do themselves; they call the unexported implementations
+func (p *Player) do(fn func() error) error {
+	cmd := command{run: fn, done: make(chan error, 1)}
+	select {
+	case p.commands <- cmd:
+	case <-p.closed:
+		return fmt.Errorf("player closed")
+	}
+	return <-cmd.done
+}
+
+// fromLoop runs fn on the command goroutine on behalf of the playback loop that owns ctx
+// A loop that was replaced by a newer one in the meantime changes nothing; ctx's error is returned
+func (p *Player) fromLoop(ctx context.Context, fn func() error) error {
+	return p.do(func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn()
+	})
+}
+
+// stopFromLoop stops playback on behalf of the playback loop that owns ctx
+// A loop that was replaced by a newer one in the meantime leaves it playing
+func (p *Player) stopFromLoop(ctx context.Context) {
+	_ = p.fromLoop(ctx, p.stop)
+}
+
+// Play starts playback from the current queue position
+func (p *Player) Play() error {
+	return p.do(p.play)
+}
+
+// PlayAt starts playback at a queue position
+func (p *Player) PlayAt(position int) error {
+	return p.do(func() error { return p.playAt(position) })
+}
+
+// PlayID starts playback of the track with the given song ID
+func (p *Player) PlayID(id int) error {
+	return p.do(func() error { return p.playID(id) })
+}
+
+// Pause pauses playback (can be resumed with Resume)
+func (p *Player) Pause() error {
+	return p.do(p.pause)
+}
+
+// Resume resumes playback from pause
+func (p *Player) Resume() error {
+	return p.do(p.resume)
+}
+
+// Next skips to the next track in the playlist
+func (p *Player) Next() error {
+	return p.do(p.next)
+}
+
+// Previous skips to the previous track in the playlist
+func (p *Player) Previous() error {
+	return p.do(p.previous)
+}
+
+// Stop stops playback completely (cannot be resumed, unlike Pause)
+func (p *Player) Stop() error {
+	return p.do(p.stop)
+}
+
+// Quit quits the current playback session
+func (p *Player) Quit() error {
+	return p.do(p.quit)
+}
+
+// Seek seeks to an absolute position in seconds within the current track
+func (p *Player) Seek(position float64) error {
+	return p.do(func() error { return p.seek(position) })
+}
+
+// SeekCur seeks relative to the current position (offsetSeconds can be positive or negative)
+func (p *Player) SeekCur(offsetSeconds float64) error {
+	return p.do(func() error { return p.seekCur(offsetSeconds) })
+}
+
+// SeekID seeks to an absolute position in seconds within the track with the given song ID
+func (p *Player) SeekID(id int, seconds float64) error {
+	return p.do(func() error { return p.seekID(id, seconds) })
+}
+
+// EnableOutput enables or disables an output by index
+func (p *Player) EnableOutput(index int, enabled bool) error {
+	return p.do(func() error { return p.enableOutput(index, enabled) })
+}
+
+// SwitchTarget moves playback to the output with the given name
+func (p *Player) SwitchTarget(name string) error {
+	return p.do(func() error { return p.switchTarget(name) })
+}
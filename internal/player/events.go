@@ -0,0 +1,99 @@
+package player
+
+import (
+	"sync"
+	"time"
+
+	"github.com/famish99/direttampd/internal/playlist"
+)
+
+// EventType identifies what happened in the player
+type EventType int
+
+const (
+	EventTrackStarted  EventType = iota // A track began playing
+	EventTrackFinished                  // A track ended, naturally or interrupted
+	EventStateChanged                   // Playback state changed (play, pause, stop)
+	EventError                          // Playback failed
+	EventOutputChanged                  // A different output receives playback
+)
+
+// String returns the event type name
+func (t EventType) String() string {
+	switch t {
+	case EventTrackStarted:
+		return "track-started"
+	case EventTrackFinished:
+		return "track-finished"
+	case EventStateChanged:
+		return "state-changed"
+	case EventError:
+		return "error"
+	case EventOutputChanged:
+		return "output-changed"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is something that happened in the player
+// Only the fields relevant to Type are set
+type Event struct {
+	Type   EventType
+	Time   time.Time
+	Track  *playlist.Track // Copy of the track started or finished
+	State  PlaybackState   // New state for EventStateChanged
+	Error  string          // Failure message for EventError
+	Output string          // Name of the output now in use for EventOutputChanged
+}
+
+// eventBus fans player events out to subscribers
+type eventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]bool
+}
+
+// Subscribe returns a channel receiving player events and a function ending the subscription
+// Events are dropped for a subscriber whose buffer is full, so a slow reader
+// never holds up playback; the channel is closed when the subscription ends
+func (p *Player) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+
+	p.events.mu.Lock()
+	if p.events.subscribers == nil {
+		p.events.subscribers = make(map[chan Event]bool)
+	}
+	p.events.subscribers[ch] = true
+	p.events.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			p.events.mu.Lock()
+			delete(p.events.subscribers, ch)
+			p.events.mu.Unlock()
+			close(ch)
+		})
+	}
+	return ch, unsubscribe
+}
+
+// publish delivers an event to every subscriber without blocking
+func (p *Player) publish(event Event) {
+	event.Time = time.Now()
+
+	p.events.mu.Lock()
+	defer p.events.mu.Unlock()
+	for ch := range p.events.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// publishTrack delivers a track event carrying a copy of the track
+func (p *Player) publishTrack(eventType EventType, track *playlist.Track) {
+	copied := *track
+	p.publish(Event{Type: eventType, Track: &copied})
+}
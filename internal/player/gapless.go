@@ -0,0 +1,117 @@
+package player
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+
+	"github.com/famish99/direttampd/internal/decoder"
+	"github.com/famish99/direttampd/internal/playlist"
+)
+
+// defaultGaplessMaxTracks limits a gapless upload when gapless_max_tracks is unset
+const defaultGaplessMaxTracks = 16
+
+// errQueueChanged reports that the queue no longer matches the gapless group being played
+var errQueueChanged = errors.New("queue changed during playback")
+
+// gaplessGroup returns the tracks to upload together, starting with track
+// Following tracks join while they are already decoded in the cache, share the
+// first track's audio format and have no playback range
+// Crossfading needs the following tracks in the same upload, so it groups them too
+// Backends that cannot play several tracks of one upload gaplessly get one at a time,
+// and internet radio, or a track not yet probed, always plays on its own
+func (p *Player) gaplessGroup(pl *playlist.Playlist, track *playlist.Track) []*playlist.Track {
+	group := []*playlist.Track{track}
+	if (!p.config.Playback.Gapless && p.GetCrossfade() == 0) || hasRange(track) || track.Stream {
+		return group
+	}
+	if caps := p.backend.Capabilities(); !caps.MultiFile || !caps.Gapless {
+		return group
+	}
+
+	maxTracks := p.config.Playback.GaplessMaxTracks
+	if maxTracks <= 0 {
+		maxTracks = defaultGaplessMaxTracks
+	}
+
+	// The first track is needed anyway, so decode it now to learn its format
+	wavPath, err := p.fetchDecodeAndCache(track)
+	if err != nil {
+		return group
+	}
+	format, err := decoder.ProbeFormat(wavPath)
+	if err != nil {
+		return group
+	}
+
+	for _, next := range pl.Upcoming(maxTracks - 1) {
+		next := next
+		if hasRange(&next) || next.MetadataPending || next.Stream {
+			break
+		}
+
+		nextPath := p.cache.GetPathForKey(next.URL)
+		if _, err := os.Stat(nextPath); err != nil {
+			break // Not decoded yet; playing it gaplessly would delay the current track
+		}
+		nextFormat, err := decoder.ProbeFormat(nextPath)
+		if err != nil || *nextFormat != *format {
+			break
+		}
+
+		group = append(group, &next)
+	}
+
+	if len(group) > 1 {
+		log.Printf("Gapless: uploading %d tracks together", len(group))
+	}
+	return group
+}
+
+// advanceGapless moves the queue on to the next track of a gapless group as the host reaches it
+// Returns false if the queue no longer matches the group because it was edited during playback;
+// the current track is then staged so the playback loop prepares it again
+func (p *Player) advanceGapless(ctx context.Context, pl *playlist.Playlist, next *playlist.Track) bool {
+	var finished, current *playlist.Track
+	err := p.fromLoop(ctx, func() error {
+		finished, _ = pl.Current()
+		if err := pl.CommitStaged(); err != nil {
+			return err
+		}
+
+		var err error
+		current, err = pl.Current()
+		if err != nil || current.ID != next.ID {
+			log.Printf("Gapless: queue changed during playback, restarting at the current track")
+			_ = pl.Seek(pl.CurrentIndex())
+			return errQueueChanged
+		}
+		return nil
+	})
+	if err != nil {
+		return false
+	}
+
+	log.Printf("Gapless: now playing %s", next.URL)
+	if finished != nil {
+		p.publishTrack(EventTrackFinished, finished)
+	}
+	p.publishTrack(EventTrackStarted, current)
+	p.Prefetch()
+
+	// Notify that player state changed (track started)
+	p.mu.Lock()
+	if p.notifySubsystem != nil {
+		p.notifySubsystem("player")
+	}
+	p.mu.Unlock()
+
+	return true
+}
+
+// hasRange reports whether playback of a track is restricted to part of it
+func hasRange(track *playlist.Track) bool {
+	return track.RangeStart > 0 || track.RangeEnd > 0
+}
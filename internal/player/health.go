@@ -0,0 +1,113 @@
+package player
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const defaultHealthCheckSeconds = 5 // Seconds between probes of a reachable output
+
+// healthInterval returns how often the backend is probed, 0 if probing is disabled
+func (p *Player) healthInterval() time.Duration {
+	seconds := p.config.Playback.HealthCheckSeconds
+	switch {
+	case seconds < 0:
+		return 0
+	case seconds == 0:
+		seconds = defaultHealthCheckSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// healthLoop probes the backend until the player is closed
+// A failed probe reports the output as unreachable and opens the session
+// again, waiting twice as long after each further failure; once a probe
+// succeeds the output is reported as back
+func (p *Player) healthLoop(interval time.Duration) {
+	failures := 0
+	delay := interval
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-p.closed:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		p.backendMu.Lock()
+		err := p.backend.CheckHealth()
+		p.backendMu.Unlock()
+		if err == nil {
+			if failures > 0 {
+				p.outputRecovered()
+			}
+			failures = 0
+			delay = interval
+			continue
+		}
+
+		failures++
+		if failures == 1 {
+			p.outputLost(err)
+		}
+
+		// Reconnecting runs as a command so it never interleaves with playback commands
+		if err := p.do(p.reconnect); err != nil {
+			log.Printf("Reconnect attempt %d failed: %v", failures, err)
+		}
+
+		delay = time.Second << (failures - 1)
+		if delay > reconnectMaxDelay || delay <= 0 {
+			delay = reconnectMaxDelay
+		}
+	}
+}
+
+// reconnect opens the session to the output again
+func (p *Player) reconnect() error {
+	p.backendMu.Lock()
+	defer p.backendMu.Unlock()
+	return p.backend.Reconnect()
+}
+
+// outputLost reports that the output stopped answering probes
+func (p *Player) outputLost(err error) {
+	output := p.backend.GetOutputName()
+	log.Printf("Output %s is unreachable: %v", output, err)
+
+	message := fmt.Sprintf("Output %s unreachable: %v", output, err)
+	p.mu.Lock()
+	p.outputError = message
+	p.mu.Unlock()
+	p.setError(message)
+
+	p.notifyOutput()
+}
+
+// outputRecovered reports that the output answers probes again
+// The error set when it was lost is cleared unless a newer one replaced it
+func (p *Player) outputRecovered() {
+	log.Printf("Output %s is reachable again", p.backend.GetOutputName())
+
+	p.mu.Lock()
+	if p.lastError == p.outputError {
+		p.lastError = ""
+	}
+	p.outputError = ""
+	p.mu.Unlock()
+
+	p.notifyOutput()
+}
+
+// notifyOutput tells idle clients that the state of the outputs changed
+func (p *Player) notifyOutput() {
+	p.mu.Lock()
+	notify := p.notifySubsystem
+	p.mu.Unlock()
+
+	if notify != nil {
+		notify("output")
+	}
+}
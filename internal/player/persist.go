@@ -0,0 +1,129 @@
+package player
+
+import (
+	"log"
+
+	"github.com/famish99/direttampd/internal/statefile"
+)
+
+// SaveState writes the queue, current song, elapsed time and options to path
+// While a transition is pending the pending playlist is saved without a current song
+func (p *Player) SaveState(path string) error {
+	p.mu.Lock()
+	pl := p.pl
+	pending := p.pendingPlaylist
+	playState := p.state
+	elapsed := p.interpolatedElapsed()
+	random := p.random
+	repeat := p.repeat
+	volume := p.volume
+	crossfade := p.crossfade
+	p.mu.Unlock()
+
+	state := &statefile.State{
+		PlayState: statefile.StateStop,
+		Current:   pl.CurrentIndex(),
+		Random:    random,
+		Repeat:    repeat,
+		Volume:    volume,
+		Crossfade: crossfade,
+	}
+
+	switch playState {
+	case StatePlaying:
+		state.PlayState = statefile.StatePlay
+	case StatePaused:
+		state.PlayState = statefile.StatePause
+	}
+	if playState != StateStopped && elapsed > 0 {
+		state.Elapsed = elapsed
+	}
+
+	if pending != nil {
+		pl = pending
+		state.PlayState = statefile.StateStop
+		state.Current = -1
+	}
+
+	for _, track := range pl.GetAll() {
+		state.Songs = append(state.Songs, statefile.Song{
+			URI:        track.URL,
+			Priority:   track.Priority,
+			RangeStart: track.RangeStart,
+			RangeEnd:   track.RangeEnd,
+			Tags:       track.Tags,
+		})
+	}
+
+	if state.Current >= len(state.Songs) {
+		state.Current = -1
+	}
+
+	if err := statefile.Write(path, state); err != nil {
+		return err
+	}
+	log.Printf("Saved state (%d songs) to %s", len(state.Songs), path)
+	return nil
+}
+
+// RestoreState loads a state file written by SaveState into the player
+// Should be called once at startup, before clients can edit the queue
+// A missing state file is not an error
+func (p *Player) RestoreState(path string) error {
+	state, err := statefile.Read(path)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		log.Printf("No state file at %s, starting with an empty queue", path)
+		return nil
+	}
+
+	urls := make([]string, len(state.Songs))
+	for i, song := range state.Songs {
+		urls[i] = song.URI
+	}
+	p.AddURLs(urls)
+
+	// Reapply per-song attributes to the restored tracks
+	for i, song := range state.Songs {
+		track, err := p.pl.TrackAt(i)
+		if err != nil {
+			break
+		}
+		if song.Priority > 0 {
+			_ = p.pl.SetPriorityByID(track.ID, song.Priority)
+		}
+		if song.RangeStart > 0 || song.RangeEnd > 0 {
+			if err := p.pl.SetRangeByID(track.ID, song.RangeStart, song.RangeEnd); err != nil {
+				log.Printf("Ignoring saved range for %s: %v", song.URI, err)
+			}
+		}
+		for tag, value := range song.Tags {
+			_ = p.pl.AddTagByID(track.ID, tag, value)
+		}
+	}
+
+	p.SetRandom(state.Random)
+	p.SetRepeat(state.Repeat)
+	if state.Volume >= 0 {
+		_ = p.SetVolume(state.Volume) // Fails only when the mixer is disabled
+	}
+	_ = p.SetCrossfade(state.Crossfade)
+	log.Printf("Restored %d songs from %s", len(state.Songs), path)
+
+	if state.Current < 0 || state.Current >= p.pl.Length() {
+		return nil
+	}
+
+	// Resume playback where it left off; a paused queue comes back stopped
+	// on the same song since the output cannot start in a paused state
+	if state.PlayState == statefile.StatePlay {
+		return p.do(func() error { return p.playAtOffset(state.Current, state.Elapsed) })
+	}
+
+	if err := p.pl.Seek(state.Current); err != nil {
+		return err
+	}
+	return p.pl.CommitStaged()
+}
@@ -4,39 +4,72 @@ import (
 	"context"
 	"fmt"
 	"log"
+
+	"github.com/famish99/direttampd/internal/playlistfile"
 )
 
-// AddURLs adds URLs to the playlist and starts background caching
+// defaultPreviousRestartSeconds is how far into a track previous restarts it when unset
+const defaultPreviousRestartSeconds = 3
+
+// AddURLs adds URLs to the playlist and updates the prefetch window
+// Playlist files (M3U/M3U8/PLS) are expanded into their tracks, except HLS
+// playlists, which are one stream
 func (p *Player) AddURLs(urls []string) {
-	p.pl.AddMultiple(urls)
-	log.Printf("Added %d URLs to playlist", len(urls))
+	// Playlist files may be remote, so they are read before taking a turn
+	urls = expandPlaylistFiles(urls)
+	_ = p.do(func() error {
+		p.pl.AddMultiple(urls)
+		log.Printf("Added %d URLs to playlist", len(urls))
+
+		// Decode the added tracks ahead if they are coming up soon
+		p.Prefetch()
+		return nil
+	})
+}
 
-	// Start background caching for all added tracks
+// expandPlaylistFiles replaces playlist file URLs with the tracks they list
+// Playlists that cannot be read are logged and dropped
+func expandPlaylistFiles(urls []string) []string {
+	expanded := make([]string, 0, len(urls))
 	for _, url := range urls {
-		go p.backgroundCache(url)
+		if !playlistfile.IsPlaylist(url) || playlistfile.IsStreamManifest(url) {
+			expanded = append(expanded, url)
+			continue
+		}
+
+		entries, err := playlistfile.Expand(url)
+		if err != nil {
+			log.Printf("Failed to expand playlist %s: %v", url, err)
+			continue
+		}
+		log.Printf("Expanded playlist %s into %d tracks", url, len(entries))
+		expanded = append(expanded, entries...)
 	}
+	return expanded
 }
 
-// AddURLAt adds a URL at a specific position and starts background caching
+// AddURLAt adds a URL at a specific position and updates the prefetch window
 // Returns the position where the track was added
 // If adding at or before current position while playing, restarts playback
 func (p *Player) AddURLAt(url string, position int) int {
-	// Add track at position
-	actualPosition := p.pl.AddAt(url, position)
-	log.Printf("Added URL at position %d: %s", actualPosition, url)
-
-	// Start background caching
-	go p.backgroundCache(url)
-
+	actualPosition := position
+	_ = p.do(func() error {
+		actualPosition = p.pl.AddAt(url, position)
+		log.Printf("Added URL at position %d: %s", actualPosition, url)
+
+		// Decode the track ahead if it is coming up soon
+		p.Prefetch()
+		return nil
+	})
 	return actualPosition
 }
 
-// Play starts playback of a new track
-func (p *Player) Play() error {
+// play starts playback of a new track
+func (p *Player) play() error {
 	p.mu.Lock()
 
 	// Start new playback from current position
-	p.state = StatePlaying
+	p.setState(StatePlaying)
 
 	// Create cancellable context for playback loop
 	ctx, cancel := context.WithCancel(context.Background())
@@ -53,8 +86,13 @@ func (p *Player) Play() error {
 	return nil
 }
 
-// PlayAt seeks to a specific position and starts playback
-func (p *Player) PlayAt(position int) error {
+// playAt seeks to a specific position and starts playback
+func (p *Player) playAt(position int) error {
+	return p.playAtOffset(position, 0)
+}
+
+// playAtOffset starts playback at a queue position, offset seconds into the track
+func (p *Player) playAtOffset(position int, offset float64) error {
 	// If already playing, cancel the playback loop
 	p.mu.Lock()
 	wasPlaying := p.state == StatePlaying
@@ -67,6 +105,7 @@ func (p *Player) PlayAt(position int) error {
 			p.playbackCtx = nil
 		}
 	}
+	p.resumeOffset = offset
 	p.mu.Unlock()
 
 	// Seek to the position (stages the track)
@@ -80,11 +119,11 @@ func (p *Player) PlayAt(position int) error {
 	}
 
 	// Now call Play() to start playback
-	return p.Play()
+	return p.play()
 }
 
-// Pause pauses playback (can be resumed with Resume)
-func (p *Player) Pause() error {
+// pause pauses playback (can be resumed with Resume)
+func (p *Player) pause() error {
 	p.mu.Lock()
 
 	if p.state != StatePlaying {
@@ -93,13 +132,15 @@ func (p *Player) Pause() error {
 	}
 
 	log.Printf("Pausing playback")
-	p.state = StatePaused
+	p.setState(StatePaused)
+	p.mu.Unlock()
 
 	var err error
 	if p.backend != nil {
+		p.backendMu.Lock()
 		err = p.backend.Pause()
+		p.backendMu.Unlock()
 	}
-	p.mu.Unlock()
 
 	// Notify subsystem change
 	if p.notifySubsystem != nil {
@@ -109,8 +150,8 @@ func (p *Player) Pause() error {
 	return err
 }
 
-// Resume resumes playback from pause
-func (p *Player) Resume() error {
+// resume resumes playback from pause
+func (p *Player) resume() error {
 	p.mu.Lock()
 
 	if p.state != StatePaused {
@@ -118,30 +159,32 @@ func (p *Player) Resume() error {
 		return nil // Not paused, nothing to resume
 	}
 
+	p.mu.Unlock()
+
 	log.Printf("Resuming playback from pause")
 	if p.backend != nil {
-		if err := p.backend.Play(); err != nil {
-			p.mu.Unlock()
+		p.backendMu.Lock()
+		err := p.backend.Play()
+		p.backendMu.Unlock()
+		if err != nil {
 			return fmt.Errorf("failed to resume playback: %w", err)
 		}
 
-		// Unlock before waiting
-		p.mu.Unlock()
-
 		// Wait for playback to actually start
 		if !p.waitForPlaybackStart() {
 			p.mu.Lock()
-			p.state = StatePaused // Restore paused state on failure
+			p.setState(StatePaused) // Restore paused state on failure
 			p.mu.Unlock()
 			return fmt.Errorf("timeout waiting for playback to resume")
 		}
 
 		// Only change to playing state after playback confirmed
 		p.mu.Lock()
-		p.state = StatePlaying
+		p.setState(StatePlaying)
 		p.mu.Unlock()
 	} else {
-		p.state = StatePlaying
+		p.mu.Lock()
+		p.setState(StatePlaying)
 		p.mu.Unlock()
 	}
 
@@ -153,11 +196,16 @@ func (p *Player) Resume() error {
 	return nil
 }
 
-// Next skips to the next track in the playlist
-func (p *Player) Next() error {
+// next skips to the next track in the playlist
+// Past the last track playback stops, as in MPD; with repeat on it wraps around
+func (p *Player) next() error {
 	// Stage next track in playlist
 	err := p.pl.Next()
 	if err != nil {
+		if p.pl.Length() > 0 && p.GetState() != StateStopped {
+			log.Printf("Next past the end of the queue, stopping")
+			return p.stop()
+		}
 		return err
 	}
 
@@ -167,11 +215,27 @@ func (p *Player) Next() error {
 	return nil
 }
 
-// Previous skips to the previous track in the playlist
-func (p *Player) Previous() error {
+// previous skips to the previous track in the playlist
+// Once the current track has played past previous_restart_seconds it starts
+// over instead, as it does at the start of the queue
+func (p *Player) previous() error {
+	state := p.GetState()
+	if state != StateStopped {
+		threshold := p.previousRestartSeconds()
+		p.mu.Lock()
+		elapsed := p.interpolatedElapsed()
+		p.mu.Unlock()
+		if threshold >= 0 && elapsed > threshold {
+			return p.restartCurrent()
+		}
+	}
+
 	// Stage previous track in playlist
 	err := p.pl.Previous()
 	if err != nil {
+		if p.pl.Length() > 0 && state != StateStopped {
+			return p.restartCurrent()
+		}
 		return err
 	}
 
@@ -181,11 +245,33 @@ func (p *Player) Previous() error {
 	return nil
 }
 
-// Stop stops playback completely (cannot be resumed, unlike Pause)
-func (p *Player) Stop() error {
+// previousRestartSeconds returns how far into a track previous restarts it, or -1 if it never does
+func (p *Player) previousRestartSeconds() float64 {
+	seconds := p.config.Playback.PreviousRestartSeconds
+	switch {
+	case seconds < 0:
+		return -1
+	case seconds == 0:
+		return defaultPreviousRestartSeconds
+	}
+	return seconds
+}
+
+// restartCurrent plays the current track again from its start
+func (p *Player) restartCurrent() error {
+	start := 0.0
+	if track, err := p.pl.Current(); err == nil {
+		start = track.RangeStart
+	}
+	log.Printf("Restarting the current track")
+	return p.seek(start)
+}
+
+// stop stops playback completely (cannot be resumed, unlike Pause)
+func (p *Player) stop() error {
 	p.mu.Lock()
 
-	p.state = StateStopped
+	p.setState(StateStopped)
 
 	// Cancel playback loop via context (cleaner than interrupt)
 	if p.playbackCancel != nil {
@@ -208,16 +294,38 @@ func (p *Player) Stop() error {
 	return nil
 }
 
-// Quit quits the current playback session
-func (p *Player) Quit() error {
+// quit quits the current playback session
+func (p *Player) quit() error {
 	if p.backend != nil {
+		p.backendMu.Lock()
+		defer p.backendMu.Unlock()
 		return p.backend.Stop()
 	}
 	return nil
 }
 
-// Seek seeks to an absolute position in seconds within the current track
-func (p *Player) Seek(positionSeconds int64) error {
+// reloadCurrent prepares the playing track again from its current position
+// Used when the software gain or the output changes so it takes effect without waiting for the next track
+func (p *Player) reloadCurrent() {
+	p.mu.Lock()
+	if p.state != StatePlaying || p.lastElapsedTime < 0 {
+		p.mu.Unlock()
+		return
+	}
+	p.resumeOffset = p.interpolatedElapsed()
+	p.mu.Unlock()
+
+	if err := p.pl.Seek(p.pl.CurrentIndex()); err != nil || !p.pl.SignalInterrupt(false, false) {
+		// Nothing to reload, or another interrupt is already pending
+		p.mu.Lock()
+		p.resumeOffset = 0
+		p.mu.Unlock()
+	}
+}
+
+// seek seeks to an absolute position in seconds within the current track
+// A paused track stays paused at the new position
+func (p *Player) seek(position float64) error {
 	p.mu.Lock()
 
 	if p.backend == nil {
@@ -230,10 +338,11 @@ func (p *Player) Seek(positionSeconds int64) error {
 		return fmt.Errorf("not playing or paused")
 	}
 
-	log.Printf("Seeking to position %d seconds", positionSeconds)
-	err := p.backend.Seek(positionSeconds)
 	p.mu.Unlock()
 
+	log.Printf("Seeking to position %.3f seconds", position)
+	err := p.seekTo(position)
+
 	// Notify subsystem change so MPD clients update their display
 	if err == nil && p.notifySubsystem != nil {
 		p.notifySubsystem("player")
@@ -242,8 +351,8 @@ func (p *Player) Seek(positionSeconds int64) error {
 	return err
 }
 
-// SeekCur seeks relative to current position (offsetSeconds can be positive or negative)
-func (p *Player) SeekCur(offsetSeconds int64) error {
+// seekCur seeks relative to current position (offsetSeconds can be positive or negative)
+func (p *Player) seekCur(offsetSeconds float64) error {
 	p.mu.Lock()
 
 	if p.backend == nil {
@@ -256,22 +365,15 @@ func (p *Player) SeekCur(offsetSeconds int64) error {
 		return fmt.Errorf("not playing or paused")
 	}
 
-	// Get current elapsed time
-	elapsed, err := p.backend.GetElapsedTime()
-	if err != nil {
-		p.mu.Unlock()
-		return fmt.Errorf("failed to get current time: %w", err)
-	}
-
-	// Calculate new absolute position
-	newPosition := elapsed + offsetSeconds
+	// Offset from the position clients see, which the backend reports only in whole seconds
+	newPosition := p.interpolatedElapsed() + offsetSeconds
+	p.mu.Unlock()
 	if newPosition < 0 {
 		newPosition = 0
 	}
 
-	log.Printf("Seeking by %d seconds to position %d seconds", offsetSeconds, newPosition)
-	err = p.backend.Seek(newPosition)
-	p.mu.Unlock()
+	log.Printf("Seeking by %.3f seconds to position %.3f seconds", offsetSeconds, newPosition)
+	err := p.seekTo(newPosition)
 
 	// Notify subsystem change so MPD clients update their display
 	if err == nil && p.notifySubsystem != nil {
@@ -280,3 +382,51 @@ func (p *Player) SeekCur(offsetSeconds int64) error {
 
 	return err
 }
+
+// playID starts playback of the track with the given song ID
+func (p *Player) playID(id int) error {
+	position := p.pl.FindByID(id)
+	if position < 0 {
+		return fmt.Errorf("no such song: %d", id)
+	}
+
+	return p.playAt(position)
+}
+
+// seekID seeks to an absolute position in seconds within the track with the given song ID
+// Any other track (or the current one while stopped) starts playing from there, as in MPD
+func (p *Player) seekID(id int, seconds float64) error {
+	position := p.pl.FindByID(id)
+	if position < 0 {
+		return fmt.Errorf("no such song: %d", id)
+	}
+
+	if position != p.pl.CurrentIndex() || p.GetState() == StateStopped {
+		log.Printf("Switching to song %d at %.3f seconds", id, seconds)
+		return p.playAtOffset(position, seconds)
+	}
+
+	return p.seek(seconds)
+}
+
+// seekTo has the backend seek and restores a pause, since seeking starts playback again
+// p.mu is not held while the backend uploads, so status queries are answered meanwhile
+func (p *Player) seekTo(position float64) error {
+	p.backendMu.Lock()
+	defer p.backendMu.Unlock()
+
+	if err := p.backend.Seek(position); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.lastElapsedTime = int64(position)
+	p.anchorElapsed(position)
+	paused := p.state == StatePaused
+	p.mu.Unlock()
+
+	if paused {
+		return p.backend.Pause()
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"time"
 
+	"github.com/famish99/direttampd/internal/backends"
 	"github.com/famish99/direttampd/internal/playlist"
 )
 
@@ -16,12 +17,13 @@ func (p *Player) playbackLoop(ctx context.Context, pl *playlist.Playlist) {
 	// Get interrupt channel from the closed-over playlist
 	interruptCh := pl.GetInterruptChannel()
 
+	var failures trackFailures
 	for {
 		// Check if context cancelled (transition to new playlist)
 		select {
 		case <-ctx.Done():
 			log.Printf("Playback loop cancelled via context")
-			_ = p.backend.Stop()
+			p.stopBackend()
 			return
 		default:
 		}
@@ -39,20 +41,53 @@ func (p *Player) playbackLoop(ctx context.Context, pl *playlist.Playlist) {
 		track, err := pl.Current()
 		if err != nil {
 			log.Printf("Invalid current track")
-			_ = p.Stop()
+			p.stopFromLoop(ctx)
 			return
 		}
 
-		// Play the track
+		// A track added moments ago may still be probed for its metadata,
+		// which decides among other things whether it is internet radio
+		if track.MetadataPending {
+			pl.WaitForMetadata(track.ID)
+			if track, err = pl.Current(); err != nil {
+				log.Printf("Invalid current track")
+				p.stopFromLoop(ctx)
+				return
+			}
+		}
+
+		// Move the prefetch window along with the queue position
+		p.Prefetch()
+
+		// Play the track, along with the ones after it in gapless mode
 		currentIndex := pl.CurrentIndex()
 		log.Printf("Playing track %d: %s", currentIndex, track.URL)
-		err = p.PlayTrack(track)
+		group := p.gaplessGroup(pl, track)
+		if len(group) > 1 {
+			err = p.PlayTracks(group)
+		} else {
+			err = p.PlayTrack(track)
+		}
 		if err != nil {
 			log.Printf("Error playing track %s: %v", track.URL, err)
+			// The host may still be coming back from a lost session
+			if p.retryResume(ctx) {
+				continue
+			}
+			// Otherwise retry or skip the track as configured
+			if p.trackFailed(ctx, pl, track, err, &failures) {
+				continue
+			}
+			p.stopFromLoop(ctx)
 			return
 		}
+		failures = trackFailures{}
+		if p.endResume() {
+			log.Printf("Playback resumed after the session was lost")
+		}
 
 		// Notify that player state changed (track started)
+		p.publishTrack(EventTrackStarted, track)
 		p.mu.Lock()
 		if p.notifySubsystem != nil {
 			p.notifySubsystem("player")
@@ -60,7 +95,10 @@ func (p *Player) playbackLoop(ctx context.Context, pl *playlist.Playlist) {
 		p.mu.Unlock()
 
 		// Wait for track to finish playing or be interrupted
-		shouldNotify, shouldExit := p.waitForTrackCompletion(ctx, interruptCh)
+		shouldNotify, shouldExit := p.waitForTrackCompletion(ctx, interruptCh, pl, group)
+		if finished, err := pl.Current(); err == nil {
+			p.publishTrack(EventTrackFinished, finished)
+		}
 
 		// Notify that player state changed (track finished) if requested
 		if shouldNotify {
@@ -74,20 +112,27 @@ func (p *Player) playbackLoop(ctx context.Context, pl *playlist.Playlist) {
 		// Exit loop if interrupt requested it (e.g., Stop or PlayAt)
 		if shouldExit {
 			log.Printf("Playback loop exiting due to interrupt")
-			_ = p.backend.Stop()
+			p.stopBackend()
 			return
 		}
 
 		// Commit staged track (from interrupt) or auto-advance to next
-		err = pl.CommitStaged()
+		err = p.fromLoop(ctx, pl.CommitStaged)
 		if err != nil {
 			// Reached end of playlist or error
-			_ = p.Stop()
+			p.stopFromLoop(ctx)
 			return
 		}
 	}
 }
 
+// stopBackend quits the backend's session
+func (p *Player) stopBackend() {
+	p.backendMu.Lock()
+	defer p.backendMu.Unlock()
+	_ = p.backend.Stop()
+}
+
 // waitForCondition polls backend until checkFn returns true or timeout occurs
 func (p *Player) waitForCondition(checkFn func() (bool, error), timeout time.Duration, successMsg, timeoutMsg string) bool {
 	if p.backend == nil {
@@ -124,7 +169,9 @@ func (p *Player) waitForCondition(checkFn func() (bool, error), timeout time.Dur
 func (p *Player) waitForPlaybackStart() bool {
 	return p.waitForCondition(
 		func() (bool, error) {
+			p.backendMu.Lock()
 			elapsed, err := p.backend.GetElapsedTime()
+			p.backendMu.Unlock()
 			if err != nil {
 				return false, nil // No error, just not started yet
 			}
@@ -136,11 +183,21 @@ func (p *Player) waitForPlaybackStart() bool {
 	)
 }
 
+// statusChanged returns the backend's status change channel, nil if it reports none
+func (p *Player) statusChanged() <-chan struct{} {
+	if notifier, ok := p.backend.(backends.StatusNotifier); ok {
+		return notifier.StatusChanged()
+	}
+	return nil
+}
+
 // waitForPlaybackStop waits for playback to actually stop
 // Returns true if playback stopped, false on timeout
 func (p *Player) waitForPlaybackStop() bool {
 	return p.waitForCondition(
 		func() (bool, error) {
+			p.backendMu.Lock()
+			defer p.backendMu.Unlock()
 			return p.backend.IsTrackComplete()
 		},
 		2*time.Second,
@@ -149,13 +206,22 @@ func (p *Player) waitForPlaybackStop() bool {
 	)
 }
 
-// waitForTrackCompletion polls until the track finishes or is interrupted
+// waitForTrackCompletion polls until the prepared tracks finish or are interrupted
+// Honors the first track's playback range by seeking to its start and completing at its end
+// For a gapless group the queue advances as the host moves from one track to the next
 // Returns (shouldNotify, shouldExitLoop) - whether to notify subsystem and whether to exit playback loop
-func (p *Player) waitForTrackCompletion(ctx context.Context, interruptCh <-chan playlist.InterruptEvent) (bool, bool) {
+func (p *Player) waitForTrackCompletion(ctx context.Context, interruptCh <-chan playlist.InterruptEvent, pl *playlist.Playlist, group []*playlist.Track) (bool, bool) {
 	if p.backend == nil {
 		return true, true // Default to notify, don't exit
 	}
 
+	track := group[0]
+	playing := 0 // Index into group of the track the queue says is current
+
+	// Snapshot the range now, the track may be edited while it plays
+	rangeStart := int64(track.RangeStart)
+	rangeEnd := int64(track.RangeEnd)
+
 	// Wait for playback to actually start
 	log.Printf("waitForTrackCompletion: waiting for playback to start")
 	if !p.waitForPlaybackStart() {
@@ -164,7 +230,28 @@ func (p *Player) waitForTrackCompletion(ctx context.Context, interruptCh <-chan
 	}
 	log.Printf("waitForTrackCompletion: playback started successfully")
 
-	// Poll current time until it returns -1 (track finished) or interrupt received
+	// A pending resume offset (from a restored state) wins over the range start
+	startAt := float64(rangeStart)
+	p.mu.Lock()
+	if p.resumeOffset > 0 {
+		startAt = p.resumeOffset
+		p.resumeOffset = 0
+	}
+	p.mu.Unlock()
+
+	// Jump to the start position, if any; a stream only plays from where it is now
+	if startAt > 0 && !track.Stream {
+		log.Printf("waitForTrackCompletion: seeking to %.3f seconds", startAt)
+		p.backendMu.Lock()
+		err := p.backend.Seek(startAt)
+		p.backendMu.Unlock()
+		if err != nil {
+			log.Printf("Error seeking to start position: %v", err)
+		}
+	}
+
+	// Poll current time until it returns -1 (track finished) or interrupt received;
+	// backends reporting status changes are checked as soon as one arrives
 	ticker := time.NewTicker(500 * time.Millisecond)
 	defer ticker.Stop()
 
@@ -181,41 +268,64 @@ func (p *Player) waitForTrackCompletion(ctx context.Context, interruptCh <-chan
 			return event.ShouldNotify, event.ShouldExitLoop
 
 		case <-ticker.C:
-			// Check if we should stop polling
-			p.mu.Lock()
-			state := p.state
-			p.mu.Unlock()
+		case <-p.statusChanged():
+			// The output reported a change; check it without waiting for the next poll
+		}
 
-			// Stop polling if explicitly stopped or playback ended
-			if state == StateStopped {
-				return false, true
-			}
+		// Check if we should stop polling
+		p.mu.Lock()
+		state := p.state
+		p.mu.Unlock()
 
-			// If paused, just continue waiting (don't check timing)
-			if state == StatePaused {
-				continue
-			}
+		// Stop polling if explicitly stopped or playback ended
+		if state == StateStopped {
+			return false, true
+		}
 
-			// Check if track is complete
-			complete, err := p.backend.IsTrackComplete()
-			if err != nil {
-				log.Printf("Error checking track completion: %v", err)
-				return false, true
-			}
+		// If paused, just continue waiting (don't check timing)
+		if state == StatePaused {
+			continue
+		}
 
-			// Cache elapsed time for GetPlaybackTiming to use
-			elapsed, elapsedErr := p.backend.GetElapsedTime()
-			if elapsedErr == nil {
-				p.mu.Lock()
-				p.lastElapsedTime = elapsed
-				p.mu.Unlock()
+		// Check if track is complete, which track of the upload is playing and how far it is
+		p.backendMu.Lock()
+		complete, err := p.backend.IsTrackComplete()
+		index := p.backend.CurrentTrack()
+		elapsed, elapsedErr := p.backend.GetElapsedTime()
+		p.backendMu.Unlock()
+		if err != nil {
+			log.Printf("Error checking track completion: %v", err)
+			// Play the track again from where it was once the host is back
+			if p.sessionLost(ctx, pl, err) {
+				return false, false
 			}
+			return false, true
+		}
 
-			// Track is finished when IsTrackComplete returns true
-			if complete {
-				log.Printf("Track finished naturally")
-				return true, false // Natural completion - notify, don't exit
+		// Follow the host through a gapless group
+		for ; playing < index && playing+1 < len(group); playing++ {
+			if !p.advanceGapless(ctx, pl, group[playing+1]) {
+				return true, false
 			}
 		}
+
+		// Cache elapsed time for GetPlaybackTiming to use
+		if elapsedErr == nil {
+			p.mu.Lock()
+			p.updateElapsed(elapsed)
+			p.mu.Unlock()
+		}
+
+		// Reaching the end of the range counts as completion
+		if rangeEnd > 0 && elapsedErr == nil && elapsed >= rangeEnd {
+			log.Printf("Track reached range end at %d seconds", rangeEnd)
+			return true, false
+		}
+
+		// Track is finished when IsTrackComplete returns true
+		if complete {
+			log.Printf("Track finished naturally")
+			return true, false // Natural completion - notify, don't exit
+		}
 	}
 }
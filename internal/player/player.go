@@ -5,12 +5,15 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/famish99/direttampd/internal/backends"
-	"github.com/famish99/direttampd/internal/backends/memoryplay"
 	"github.com/famish99/direttampd/internal/cache"
 	"github.com/famish99/direttampd/internal/config"
+	"github.com/famish99/direttampd/internal/httpclient"
+	"github.com/famish99/direttampd/internal/loudness"
 	"github.com/famish99/direttampd/internal/playlist"
+	"github.com/famish99/direttampd/internal/replaygain"
 )
 
 // Player coordinates audio playback using a pluggable backend
@@ -21,6 +24,12 @@ type Player struct {
 	cache   *cache.DiskCache
 	pl      *playlist.Playlist
 
+	// Held around calls that upload to, control or poll the backend's session,
+	// so the playback loop and commands never interleave them; taken before mu
+	// and never while holding it, since uploads ask the player for track gains
+	// Queries status answers (duration, outputs) skip it so they never wait for an upload
+	backendMu sync.Mutex
+
 	// Playlist transition support
 	pendingPlaylist *playlist.Playlist // New playlist being built during transition (nil if not transitioning)
 	playbackCtx     context.Context    // Controls current playback loop
@@ -29,36 +38,152 @@ type Player struct {
 	// Playback state
 	state PlaybackState
 
+	// Playtime accounting for stats
+	playTime     time.Duration // Total time spent playing, excluding the current stretch
+	playingSince time.Time     // When the current stretch of playing began
+
+	// Playback options
+	random         bool            // Random mode, applied to every playlist the player uses
+	repeat         bool            // Repeat mode, applied to every playlist the player uses
+	replayGainMode replaygain.Mode // Which ReplayGain tags set each track's gain
+	volume         int             // Software mixer volume (0-100), -1 when the mixer is disabled
+	crossfade      int             // Seconds consecutive tracks overlap (0 disables crossfading)
+
+	// Decodes the next queue entries into the cache ahead of playback
+	prefetch *prefetcher
+
+	// EBU R128 analysis; nil unless loudness normalization is enabled
+	loudness *loudness.Analyzer
+
+	// Last playback failure reported to clients until cleared (empty if none)
+	lastError string
+
 	// Cached timing info (updated by polling loop)
-	lastElapsedTime int64 // Elapsed time in seconds (from backend polling)
+	lastElapsedTime int64     // Elapsed time in seconds (from backend polling)
+	elapsedBase     float64   // Elapsed seconds at elapsedAt, the anchor for interpolating between polls
+	elapsedAt       time.Time // When elapsedBase was taken; zero while playback is not advancing
+
+	// One-shot start offset in seconds for the next track (set when restoring state)
+	resumeOffset float64
+
+	// Recovery of a lost host session (see supervisor.go)
+	reconnecting   bool // The current track is being played again after the session failed
+	reconnectTries int  // Failed attempts at playing it again so far
+
+	// Error reported while the output fails health probes (see health.go)
+	outputError string
 
 	// Subsystem change notification callback (e.g., for MPD idle notifications)
 	notifySubsystem func(subsystem string)
+	metadataNotify  *time.Timer // Pending notification of probed metadata, nil if none
+
+	// Subscribers to player events (see Subscribe)
+	events eventBus
+
+	// Playback commands, run one at a time by commandLoop
+	commands  chan command
+	closed    chan struct{} // Closed when the player is closed, ending commandLoop
+	closeOnce sync.Once
 }
 
-// NewPlayer creates a new player instance with a MemoryPlay backend
-func NewPlayer(cfg *config.Config, useNative bool) (*Player, error) {
+// CacheOptions returns the options the player's cache is opened with
+// Fails if the HTTP client cannot be set up as configured
+func CacheOptions(cfg *config.Config) (cache.Options, error) {
+	client, err := httpclient.New(cfg.HTTP)
+	if err != nil {
+		return cache.Options{}, err
+	}
+	return cache.Options{
+		MaxSize:       int64(cfg.Cache.MaxSizeGB) * 1024 * 1024 * 1024,
+		Client:        client,
+		TempDir:       cfg.Cache.TempDirectory,
+		Dedupe:        cfg.Cache.Dedupe,
+		MaxDownloads:  cfg.Cache.MaxDownloads,
+		DownloadRate:  int64(cfg.Cache.DownloadRateKB) * 1024,
+		Policy:        cfg.Cache.Eviction,
+		TTL:           time.Duration(cfg.Cache.TTLHours) * time.Hour,
+		Revalidate:    time.Duration(cfg.Cache.RevalidateHours) * time.Hour,
+		HighWatermark: cfg.Cache.HighWatermark,
+		Protect:       time.Duration(cfg.Cache.ProtectMinutes) * time.Minute,
+	}, nil
+}
+
+// newAnalyzer returns the loudness analyzer for loudness_target, nil if it is not set
+func newAnalyzer(cfg *config.Config) *loudness.Analyzer {
+	if cfg.Playback.LoudnessTarget == 0 {
+		return nil
+	}
+	return loudness.NewAnalyzer(cfg.Playback.LoudnessFile)
+}
+
+// NewPlayer creates a new player instance with the backend named in the config
+func NewPlayer(cfg *config.Config) (*Player, error) {
+	return NewPlayerWithBackend(cfg, func(c *cache.DiskCache) (backends.PlaybackBackend, error) {
+		// Backends handle their own init and discovery
+		return backends.New(cfg.Backend, c, cfg)
+	})
+}
+
+// NewPlayerWithBackend creates a new player instance playing through the
+// backend newBackend creates on the player's cache
+// The null backend, for one, lets the player run without audio hardware
+func NewPlayerWithBackend(cfg *config.Config, newBackend func(c *cache.DiskCache) (backends.PlaybackBackend, error)) (*Player, error) {
 	// Create cache
-	cacheSize := int64(cfg.Cache.MaxSizeGB) * 1024 * 1024 * 1024
-	c, err := cache.NewDiskCache(cfg.Cache.Directory, cacheSize)
+	opts, err := CacheOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c, err := cache.NewDiskCacheWithOptions(cfg.Cache.Directory, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create cache: %w", err)
 	}
 
-	// Create the MemoryPlay backend (handles init and discovery internally)
-	backend, err := memoryplay.New(c, cfg, useNative)
+	backend, err := newBackend(c)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create backend: %w", err)
 	}
 
-	return &Player{
+	replayGainMode, err := replaygain.ParseMode(cfg.Playback.ReplayGainMode)
+	if err != nil {
+		log.Printf("Warning: %v, disabling ReplayGain", err)
+	}
+
+	// The software mixer is on unless disabled for bit-perfect output
+	volume := 100
+	switch cfg.Playback.MixerType {
+	case "", "software":
+	case "none":
+		volume = -1
+	default:
+		log.Printf("Warning: unknown mixer type %q, using software", cfg.Playback.MixerType)
+	}
+
+	p := &Player{
 		config:          cfg,
 		backend:         backend,
 		cache:           c,
 		pl:              playlist.NewPlaylist(),
 		state:           StateStopped,
+		replayGainMode:  replayGainMode,
+		volume:          volume,
+		loudness:        newAnalyzer(cfg),
 		notifySubsystem: nil,
-	}, nil
+		commands:        make(chan command),
+		closed:          make(chan struct{}),
+	}
+	go p.commandLoop()
+	p.watchMetadata(p.pl)
+
+	p.prefetch = newPrefetcher(prefetchWorkers(cfg), p.backgroundCache)
+
+	if interval := p.healthInterval(); interval > 0 {
+		go p.healthLoop(interval)
+	}
+
+	// Gain is worked out per track as it is prepared, so settings changes apply to the next upload
+	backend.SetGainFunc(p.trackGain)
+
+	return p, nil
 }
 
 // SetNotifySubsystem sets the callback for subsystem change notifications
@@ -69,11 +194,63 @@ func (p *Player) SetNotifySubsystem(callback func(subsystem string)) {
 	p.notifySubsystem = callback
 }
 
+// metadataNotifyDelay gathers tracks probed in a burst, such as an album
+// being added, into one playlist notification
+const metadataNotifyDelay = 250 * time.Millisecond
+
+// watchMetadata has a playlist report tracks whose metadata arrives in the
+// background: idle clients learn of the new tags, and a track in the prefetch
+// window is decoded ahead once known, unless it turns out to be internet radio
+func (p *Player) watchMetadata(pl *playlist.Playlist) {
+	pl.SetMetadataCallback(func(id int) {
+		p.mu.Lock()
+		if p.metadataNotify == nil {
+			p.metadataNotify = time.AfterFunc(metadataNotifyDelay, p.notifyMetadata)
+		}
+		p.mu.Unlock()
+
+		if p.inPrefetchWindow(pl, id) {
+			p.Prefetch()
+		}
+	})
+}
+
+// notifyMetadata tells idle clients of the metadata probed since the last time
+func (p *Player) notifyMetadata() {
+	p.mu.Lock()
+	p.metadataNotify = nil
+	notify := p.notifySubsystem
+	p.mu.Unlock()
+	if notify != nil {
+		notify("playlist")
+	}
+}
+
+// inPrefetchWindow reports whether a playlist's track, by song ID, is the
+// current one or among those decoded ahead after it
+func (p *Player) inPrefetchWindow(pl *playlist.Playlist, id int) bool {
+	if current, err := pl.Current(); err == nil && current.ID == id {
+		return true
+	}
+	for _, track := range pl.Upcoming(p.prefetchTracks()) {
+		if track.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
 // Close cleans up the player resources
 func (p *Player) Close() {
 	log.Printf("Closing player")
+	p.closeOnce.Do(func() { close(p.closed) })
+	p.prefetch.stop()
+	log.Printf("Cache: %s", p.cache.Stats())
+	p.cache.Close()
 	if p.backend != nil {
+		p.backendMu.Lock()
 		p.backend.Close()
+		p.backendMu.Unlock()
 	}
 }
 
@@ -89,3 +266,86 @@ func (p *Player) GetOutputName() string {
 	}
 	return ""
 }
+
+// GetOutputs returns every output the backend can play to
+func (p *Player) GetOutputs() []backends.Output {
+	if p.backend != nil {
+		return p.backend.Outputs()
+	}
+	return nil
+}
+
+// enableOutput enables or disables an output by index
+// Enabling a different output switches playback to it, as SwitchTarget does
+func (p *Player) enableOutput(index int, enabled bool) error {
+	if p.backend == nil {
+		return fmt.Errorf("no backend available")
+	}
+	return p.moveOutput(func() error {
+		p.backendMu.Lock()
+		defer p.backendMu.Unlock()
+		return p.backend.EnableOutput(index, enabled)
+	})
+}
+
+// switchTarget moves playback to the output with the given name
+// The session on the old target is quit; a playing track starts again on the
+// new target at the position it had reached, and a paused one is stopped there
+// so the next play continues from that position on the new target
+func (p *Player) switchTarget(name string) error {
+	if p.backend == nil {
+		return fmt.Errorf("no backend available")
+	}
+
+	for index, output := range p.backend.Outputs() {
+		if output.Name == name {
+			return p.enableOutput(index, true)
+		}
+	}
+	return fmt.Errorf("no such output: %s", name)
+}
+
+// moveOutput runs change and, if it moved playback to another output,
+// carries the current track over to it
+// Playback stops if no output is left enabled, rather than stalling on an upload with nowhere to go
+func (p *Player) moveOutput(change func() error) error {
+	before := p.backend.GetOutputName()
+	if err := change(); err != nil {
+		return err
+	}
+
+	output := p.backend.GetOutputName()
+	if output == before {
+		return nil
+	}
+	p.publish(Event{Type: EventOutputChanged, Output: output})
+
+	p.mu.Lock()
+	state := p.state
+	position := p.interpolatedElapsed()
+	p.mu.Unlock()
+
+	if output == "" {
+		log.Printf("Output %q disabled, no output is left", before)
+		if state == StateStopped {
+			return nil
+		}
+		return p.stop()
+	}
+	log.Printf("Switching playback from %q to %q", before, output)
+
+	switch state {
+	case StatePlaying:
+		// The backend quits the old session when it uploads for the new target
+		p.reloadCurrent()
+	case StatePaused:
+		// The new target cannot start paused, so stop and resume from here on play
+		if err := p.stop(); err != nil {
+			return err
+		}
+		p.mu.Lock()
+		p.resumeOffset = position
+		p.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,448 @@
+package player
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/famish99/direttampd/internal/backends"
+	"github.com/famish99/direttampd/internal/backends/null"
+	"github.com/famish99/direttampd/internal/cache"
+	"github.com/famish99/direttampd/internal/config"
+	"github.com/famish99/direttampd/internal/playlist"
+)
+
+// serialBackend is the null backend, recording whether calls that drive its
+// session ever overlap
+type serialBackend struct {
+	*null.Backend
+	active     atomic.Int32
+	overlapped atomic.Bool
+}
+
+// enter marks a session call as running, noting any other still in progress
+// The call is drawn out a little so overlapping calls are caught reliably
+func (b *serialBackend) enter() func() {
+	if b.active.Add(1) > 1 {
+		b.overlapped.Store(true)
+	}
+	time.Sleep(time.Millisecond)
+	return func() { b.active.Add(-1) }
+}
+
+func (b *serialBackend) PrepareTrack(track *playlist.Track) error {
+	defer b.enter()()
+	return b.Backend.PrepareTrack(track)
+}
+
+func (b *serialBackend) PrepareTracks(tracks []*playlist.Track) error {
+	defer b.enter()()
+	return b.Backend.PrepareTracks(tracks)
+}
+
+func (b *serialBackend) StartPlayback() error {
+	defer b.enter()()
+	return b.Backend.StartPlayback()
+}
+
+func (b *serialBackend) CurrentTrack() int {
+	defer b.enter()()
+	return b.Backend.CurrentTrack()
+}
+
+func (b *serialBackend) Play() error {
+	defer b.enter()()
+	return b.Backend.Play()
+}
+
+func (b *serialBackend) Pause() error {
+	defer b.enter()()
+	return b.Backend.Pause()
+}
+
+func (b *serialBackend) Stop() error {
+	defer b.enter()()
+	return b.Backend.Stop()
+}
+
+func (b *serialBackend) SetCrossfade(seconds float64) {
+	defer b.enter()()
+	b.Backend.SetCrossfade(seconds)
+}
+
+func (b *serialBackend) Seek(position float64) error {
+	defer b.enter()()
+	return b.Backend.Seek(position)
+}
+
+func (b *serialBackend) GetElapsedTime() (int64, error) {
+	defer b.enter()()
+	return b.Backend.GetElapsedTime()
+}
+
+func (b *serialBackend) IsTrackComplete() (bool, error) {
+	defer b.enter()()
+	return b.Backend.IsTrackComplete()
+}
+
+// newTestPlayer returns a player on the null backend, caching in a temporary directory
+func newTestPlayer(t *testing.T) *Player {
+	p, _ := newSerialTestPlayer(t)
+	return p
+}
+
+// newSerialTestPlayer is newTestPlayer, also returning the backend to check its calls
+func newSerialTestPlayer(t *testing.T) (*Player, *serialBackend) {
+	t.Helper()
+
+	cfg := &config.Config{}
+	cfg.Cache.Directory = t.TempDir()
+	cfg.Cache.MaxSizeGB = 1
+	cfg.Playback.HealthCheckSeconds = -1
+
+	backend := &serialBackend{}
+	p, err := NewPlayerWithBackend(cfg, func(c *cache.DiskCache) (backends.PlaybackBackend, error) {
+		backend.Backend = null.New(c, "")
+		return backend, nil
+	})
+	if err != nil {
+		t.Fatalf("NewPlayerWithBackend: %v", err)
+	}
+	t.Cleanup(p.Close)
+	return p, backend
+}
+
+// writeTestWAV writes seconds of 16-bit stereo silence at 8 kHz and returns its path
+func writeTestWAV(t *testing.T, name string, seconds int) string {
+	t.Helper()
+
+	const rate, channels, bits = 8000, 2, 16
+	dataSize := uint32(seconds * rate * channels * bits / 8)
+	header := []interface{}{
+		[4]byte{'R', 'I', 'F', 'F'}, 36 + dataSize, [4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '}, uint32(16), uint16(1), uint16(channels), uint32(rate),
+		uint32(rate * channels * bits / 8), uint16(channels * bits / 8), uint16(bits),
+		[4]byte{'d', 'a', 't', 'a'}, dataSize,
+	}
+
+	path := filepath.Join(t.TempDir(), name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, field := range header {
+		if err := binary.Write(f, binary.LittleEndian, field); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := f.Write(make([]byte, dataSize)); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// queueTestTracks adds n tracks of seconds each to the player's queue
+func queueTestTracks(t *testing.T, p *Player, n, seconds int) {
+	t.Helper()
+
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = writeTestWAV(t, fmt.Sprintf("track%d.wav", i), seconds)
+	}
+	p.AddURLs(urls)
+}
+
+// waitFor polls cond until it holds, failing the test after timeout
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestConcurrentCommands drives the player from several clients at once while
+// the playback loop polls and advances the backend; run with -race
+// Calls into the backend's session must never overlap
+func TestConcurrentCommands(t *testing.T) {
+	p, backend := newSerialTestPlayer(t)
+	queueTestTracks(t, p, 4, 3)
+
+	if err := p.Play(); err != nil {
+		t.Fatalf("Play: %v", err)
+	}
+	waitFor(t, 5*time.Second, "playback to start", func() bool { return p.GetPlaybackTiming() != nil })
+
+	commands := []func() error{
+		p.Pause,
+		p.Resume,
+		func() error { return p.Seek(1) },
+		func() error { return p.SeekCur(0.5) },
+		p.Next,
+		p.Previous,
+		func() error { return p.SetVolume(50) },
+		func() error { return p.SetCrossfade(1) },
+		func() error {
+			p.SetRandom(true)
+			p.SetRepeat(true)
+			return nil
+		},
+	}
+
+	var wg sync.WaitGroup
+	for client := 0; client < 4; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			for i := 0; i < 12; i++ {
+				// Commands fail while nothing is playing; only races and deadlocks matter here
+				_ = commands[(client+i)%len(commands)]()
+				p.GetPlaybackTiming()
+				p.GetState()
+			}
+		}(client)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("commands deadlocked")
+	}
+
+	if err := p.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if state := p.GetState(); state != StateStopped {
+		t.Errorf("state after Stop = %v, want stopped", state)
+	}
+	if backend.overlapped.Load() {
+		t.Error("calls into the backend's session overlapped")
+	}
+}
+
+// TestPlayPauseResume checks the clock stops while paused and runs on after resuming
+func TestPlayPauseResume(t *testing.T) {
+	p := newTestPlayer(t)
+	queueTestTracks(t, p, 1, 10)
+
+	if err := p.Play(); err != nil {
+		t.Fatalf("Play: %v", err)
+	}
+	waitFor(t, 5*time.Second, "playback to start", func() bool { return p.GetPlaybackTiming() != nil })
+	if state := p.GetState(); state != StatePlaying {
+		t.Fatalf("state after Play = %v, want playing", state)
+	}
+
+	if err := p.Pause(); err != nil {
+		t.Fatalf("Pause: %v", err)
+	}
+	if state := p.GetState(); state != StatePaused {
+		t.Fatalf("state after Pause = %v, want paused", state)
+	}
+	paused := p.GetPlaybackTiming().Elapsed
+	time.Sleep(300 * time.Millisecond)
+	if elapsed := p.GetPlaybackTiming().Elapsed; elapsed != paused {
+		t.Errorf("elapsed moved from %.3f to %.3f while paused", paused, elapsed)
+	}
+
+	if err := p.Resume(); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if state := p.GetState(); state != StatePlaying {
+		t.Fatalf("state after Resume = %v, want playing", state)
+	}
+	waitFor(t, 2*time.Second, "the clock to run again", func() bool {
+		return p.GetPlaybackTiming().Elapsed > paused
+	})
+}
+
+// TestSeek checks seeking moves playback within the track, and keeps a pause
+func TestSeek(t *testing.T) {
+	p := newTestPlayer(t)
+	queueTestTracks(t, p, 1, 10)
+
+	if err := p.Seek(5); err == nil {
+		t.Error("Seek while stopped succeeded")
+	}
+
+	if err := p.Play(); err != nil {
+		t.Fatalf("Play: %v", err)
+	}
+	waitFor(t, 5*time.Second, "playback to start", func() bool { return p.GetPlaybackTiming() != nil })
+
+	if err := p.Seek(6); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if elapsed := p.GetPlaybackTiming().Elapsed; elapsed < 6 || elapsed >= 7 {
+		t.Errorf("elapsed after Seek(6) = %.3f", elapsed)
+	}
+
+	if err := p.Pause(); err != nil {
+		t.Fatalf("Pause: %v", err)
+	}
+	if err := p.SeekCur(-4); err != nil {
+		t.Fatalf("SeekCur: %v", err)
+	}
+	if state := p.GetState(); state != StatePaused {
+		t.Errorf("state after seeking while paused = %v, want paused", state)
+	}
+	if elapsed := p.GetPlaybackTiming().Elapsed; elapsed < 2 || elapsed >= 3 {
+		t.Errorf("elapsed after SeekCur(-4) = %.3f", elapsed)
+	}
+}
+
+// TestNext checks skipping moves through the queue, and that playback moves on
+// by itself when a track ends and stops after the last one
+func TestNext(t *testing.T) {
+	p := newTestPlayer(t)
+	queueTestTracks(t, p, 3, 1)
+	pl := p.GetPlaylist()
+
+	if err := p.Play(); err != nil {
+		t.Fatalf("Play: %v", err)
+	}
+	waitFor(t, 5*time.Second, "playback to start", func() bool { return p.GetPlaybackTiming() != nil })
+
+	if err := p.Next(); err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	waitFor(t, 5*time.Second, "the second track", func() bool { return pl.CurrentIndex() == 1 })
+	if state := p.GetState(); state != StatePlaying {
+		t.Errorf("state after Next = %v, want playing", state)
+	}
+
+	waitFor(t, 5*time.Second, "the third track", func() bool { return pl.CurrentIndex() == 2 })
+	waitFor(t, 5*time.Second, "playback to stop at the end of the queue", func() bool {
+		return p.GetState() == StateStopped
+	})
+}
+
+// TestStop checks stopping ends playback and Play starts it again
+func TestStop(t *testing.T) {
+	p := newTestPlayer(t)
+	queueTestTracks(t, p, 2, 10)
+
+	if err := p.PlayAt(1); err != nil {
+		t.Fatalf("PlayAt: %v", err)
+	}
+	waitFor(t, 5*time.Second, "playback to start", func() bool { return p.GetPlaybackTiming() != nil })
+
+	if err := p.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if state := p.GetState(); state != StateStopped {
+		t.Fatalf("state after Stop = %v, want stopped", state)
+	}
+	if index := p.GetPlaylist().CurrentIndex(); index != 1 {
+		t.Errorf("queue position after Stop = %d, want 1", index)
+	}
+
+	if err := p.Play(); err != nil {
+		t.Fatalf("Play: %v", err)
+	}
+	waitFor(t, 5*time.Second, "playback to start again", func() bool {
+		return p.GetState() == StatePlaying && p.GetPlaybackTiming() != nil
+	})
+}
+
+// TestCommandsRunOneAtATime checks commands from many goroutines never run concurrently
+func TestCommandsRunOneAtATime(t *testing.T) {
+	p := newTestPlayer(t)
+
+	var running, overlapped atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = p.do(func() error {
+				if running.Add(1) > 1 {
+					overlapped.Add(1)
+				}
+				time.Sleep(time.Millisecond)
+				running.Add(-1)
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+
+	if n := overlapped.Load(); n > 0 {
+		t.Errorf("%d commands ran while another was running", n)
+	}
+}
+
+// TestDisableOutput checks disabling the only enabled output stops playback
+// instead of leaving it stalled, and that it plays again once enabled
+func TestDisableOutput(t *testing.T) {
+	p := newTestPlayer(t)
+	queueTestTracks(t, p, 1, 10)
+
+	if err := p.Play(); err != nil {
+		t.Fatalf("Play: %v", err)
+	}
+	waitFor(t, 5*time.Second, "playback to start", func() bool { return p.GetPlaybackTiming() != nil })
+
+	if err := p.EnableOutput(0, false); err != nil {
+		t.Fatalf("EnableOutput: %v", err)
+	}
+	if state := p.GetState(); state != StateStopped {
+		t.Fatalf("state after disabling the output = %v, want stopped", state)
+	}
+
+	if err := p.EnableOutput(0, true); err != nil {
+		t.Fatalf("EnableOutput: %v", err)
+	}
+	if err := p.Play(); err != nil {
+		t.Fatalf("Play: %v", err)
+	}
+	waitFor(t, 5*time.Second, "playback to start again", func() bool { return p.GetPlaybackTiming() != nil })
+}
+
+// TestProbeWhilePlaying starts playback of a track whose metadata is still being
+// probed and reads the current track meanwhile, as a currentsong client would,
+// so the probe fills it in while it is being read; run with -race
+// The server holds back its answer to the probe, which finds a radio station
+func TestProbeWhilePlaying(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "bytes=0-0" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Header().Set("icy-name", "Test Radio")
+		w.Write([]byte{0})
+	}))
+	defer server.Close()
+
+	p := newTestPlayer(t)
+	for round := 0; round < 3; round++ {
+		p.GetPlaylist().Clear()
+		p.AddURLs([]string{fmt.Sprintf("%s/stream%d", server.URL, round)})
+		if err := p.Play(); err != nil {
+			t.Fatalf("Play: %v", err)
+		}
+		waitFor(t, 5*time.Second, "the probe to finish", func() bool {
+			track, err := p.GetPlaylist().Current()
+			return err == nil && !track.MetadataPending && track.Metadata["name"] == "Test Radio"
+		})
+		if err := p.Stop(); err != nil {
+			t.Fatalf("Stop: %v", err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package player
+
+import (
+	"context"
+	"sync"
+
+	"github.com/famish99/direttampd/internal/config"
+)
+
+const (
+	defaultPrefetchTracks  = 3 // Queue entries decoded ahead of the current one
+	defaultPrefetchWorkers = 2 // Tracks decoded at the same time
+)
+
+// prefetcher decodes upcoming queue entries into the cache with a fixed pool of workers
+// Only the latest window is kept: entries that fell out of it before a worker
+// picked them up are dropped when the window is re-evaluated, and those being
+// decoded have their decode cancelled
+type prefetcher struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []string                      // URLs waiting for a worker, nearest first
+	active  map[string]context.CancelFunc // URLs being decoded now
+	closed  bool
+
+	fetch func(ctx context.Context, url string)
+}
+
+// newPrefetcher starts workers goroutines that run fetch for scheduled URLs
+func newPrefetcher(workers int, fetch func(ctx context.Context, url string)) *prefetcher {
+	f := &prefetcher{
+		active: make(map[string]context.CancelFunc),
+		fetch:  fetch,
+	}
+	f.cond = sync.NewCond(&f.mu)
+
+	for i := 0; i < workers; i++ {
+		go f.worker()
+	}
+	return f
+}
+
+// schedule replaces the waiting URLs with a new window, nearest first
+// URLs already being decoded are skipped, and those no longer in the window cancelled
+func (f *prefetcher) schedule(urls []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	seen := make(map[string]bool, len(urls))
+	f.pending = f.pending[:0]
+	for _, url := range urls {
+		if seen[url] {
+			continue
+		}
+		seen[url] = true
+		if f.active[url] == nil {
+			f.pending = append(f.pending, url)
+		}
+	}
+	for url, cancel := range f.active {
+		if !seen[url] {
+			cancel()
+		}
+	}
+	f.cond.Broadcast()
+}
+
+// stop ends the workers, cancelling the tracks they are decoding
+func (f *prefetcher) stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	f.pending = nil
+	for _, cancel := range f.active {
+		cancel()
+	}
+	f.cond.Broadcast()
+}
+
+// worker decodes scheduled URLs one at a time until the prefetcher stops
+func (f *prefetcher) worker() {
+	for {
+		f.mu.Lock()
+		for len(f.pending) == 0 && !f.closed {
+			f.cond.Wait()
+		}
+		if f.closed {
+			f.mu.Unlock()
+			return
+		}
+		url := f.pending[0]
+		f.pending = f.pending[1:]
+		ctx, cancel := context.WithCancel(context.Background())
+		f.active[url] = cancel
+		f.mu.Unlock()
+
+		f.fetch(ctx, url)
+
+		f.mu.Lock()
+		delete(f.active, url)
+		f.mu.Unlock()
+		cancel()
+	}
+}
+
+// Prefetch re-evaluates which queue entries are decoded ahead of playback
+// The window is the current track plus the next entries in play order;
+// while a new queue is being built it covers that queue instead
+func (p *Player) Prefetch() {
+	p.mu.Lock()
+	pl := p.pl
+	if p.pendingPlaylist != nil {
+		pl = p.pendingPlaylist
+	}
+	p.mu.Unlock()
+
+	// Internet radio never ends, so it is not decoded ahead; tracks still
+	// being probed may turn out to be radio and wait until they are known
+	var urls []string
+	if current, err := pl.Current(); err == nil && !current.Stream && !current.MetadataPending {
+		urls = append(urls, current.URL)
+	}
+	for _, track := range pl.Upcoming(p.prefetchTracks()) {
+		if !track.Stream && !track.MetadataPending {
+			urls = append(urls, track.URL)
+		}
+	}
+	p.prefetch.schedule(urls)
+}
+
+// prefetchTracks returns how many entries after the current one are prefetched
+func (p *Player) prefetchTracks() int {
+	if p.config.Cache.PrefetchTracks > 0 {
+		return p.config.Cache.PrefetchTracks
+	}
+	return defaultPrefetchTracks
+}
+
+// prefetchWorkers returns how many tracks are decoded ahead at the same time
+func prefetchWorkers(cfg *config.Config) int {
+	if cfg.Cache.PrefetchWorkers > 0 {
+		return cfg.Cache.PrefetchWorkers
+	}
+	return defaultPrefetchWorkers
+}
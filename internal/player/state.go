@@ -1,5 +1,12 @@
 package player
 
+import (
+	"fmt"
+	"time"
+
+	"github.com/famish99/direttampd/internal/replaygain"
+)
+
 // PlaybackState represents the current playback state
 type PlaybackState int
 
@@ -9,6 +16,37 @@ const (
 	StatePaused
 )
 
+// setState changes the playback state, accounting playtime
+// Caller must hold the lock
+func (p *Player) setState(state PlaybackState) {
+	if p.state == StatePlaying && state != StatePlaying {
+		p.playTime += time.Since(p.playingSince)
+		// Hold the interpolated elapsed time where it is
+		p.elapsedBase = p.interpolatedElapsed()
+		p.elapsedAt = time.Time{}
+	}
+	if p.state != StatePlaying && state == StatePlaying {
+		p.playingSince = time.Now()
+		p.elapsedAt = p.playingSince
+	}
+	if p.state != state {
+		p.publish(Event{Type: EventStateChanged, State: state})
+	}
+	p.state = state
+}
+
+// GetPlayTime returns the total time spent playing since the player was created
+func (p *Player) GetPlayTime() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	total := p.playTime
+	if p.state == StatePlaying {
+		total += time.Since(p.playingSince)
+	}
+	return total
+}
+
 // GetState returns the current playback state
 func (p *Player) GetState() PlaybackState {
 	p.mu.Lock()
@@ -16,11 +54,182 @@ func (p *Player) GetState() PlaybackState {
 	return p.state
 }
 
+// SetRandom enables or disables random mode
+func (p *Player) SetRandom(random bool) {
+	_ = p.do(func() error {
+		p.setRandom(random)
+		return nil
+	})
+}
+
+// setRandom enables or disables random mode
+func (p *Player) setRandom(random bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.random = random
+	p.pl.SetRandom(random)
+	if p.pendingPlaylist != nil {
+		p.pendingPlaylist.SetRandom(random)
+	}
+}
+
+// SetRepeat enables or disables repeat mode
+func (p *Player) SetRepeat(repeat bool) {
+	_ = p.do(func() error {
+		p.setRepeat(repeat)
+		return nil
+	})
+}
+
+// setRepeat enables or disables repeat mode
+func (p *Player) setRepeat(repeat bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.repeat = repeat
+	p.pl.SetRepeat(repeat)
+	if p.pendingPlaylist != nil {
+		p.pendingPlaylist.SetRepeat(repeat)
+	}
+}
+
+// IsRepeat returns true if repeat mode is enabled
+func (p *Player) IsRepeat() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.repeat
+}
+
+// IsRandom returns true if random mode is enabled
+func (p *Player) IsRandom() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.random
+}
+
+// SetReplayGainMode sets which ReplayGain values are applied
+// Takes effect from the next track prepared for playback
+func (p *Player) SetReplayGainMode(mode replaygain.Mode) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.replayGainMode = mode
+}
+
+// GetReplayGainMode returns the ReplayGain mode
+func (p *Player) GetReplayGainMode() replaygain.Mode {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.replayGainMode
+}
+
+// SetVolume sets the software mixer volume (0-100)
+// The new gain is heard from the current position if a track is playing
+func (p *Player) SetVolume(volume int) error {
+	return p.do(func() error { return p.setVolume(volume) })
+}
+
+// setVolume sets the software mixer volume, reloading the playing track
+func (p *Player) setVolume(volume int) error {
+	if volume < 0 || volume > 100 {
+		return fmt.Errorf("volume out of range: %d", volume)
+	}
+
+	p.mu.Lock()
+	if p.volume < 0 {
+		p.mu.Unlock()
+		return fmt.Errorf("no mixer")
+	}
+	changed := p.volume != volume
+	p.volume = volume
+	p.mu.Unlock()
+
+	if changed {
+		p.reloadCurrent()
+	}
+	return nil
+}
+
+// GetVolume returns the software mixer volume (0-100), or -1 if the mixer is disabled
+func (p *Player) GetVolume() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.volume
+}
+
+// SetCrossfade sets how many seconds consecutive tracks overlap
+// Takes effect from the next upload
+func (p *Player) SetCrossfade(seconds int) error {
+	return p.do(func() error { return p.setCrossfade(seconds) })
+}
+
+// setCrossfade sets the crossfade length and passes it to the backend
+func (p *Player) setCrossfade(seconds int) error {
+	if seconds < 0 {
+		return fmt.Errorf("crossfade out of range: %d", seconds)
+	}
+
+	p.mu.Lock()
+	p.crossfade = seconds
+	p.mu.Unlock()
+
+	p.backendMu.Lock()
+	defer p.backendMu.Unlock()
+	p.backend.SetCrossfade(float64(seconds))
+	return nil
+}
+
+// GetCrossfade returns the crossfade length in seconds (0 if disabled)
+func (p *Player) GetCrossfade() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.crossfade
+}
+
+// setError records a playback failure and notifies clients
+func (p *Player) setError(message string) {
+	p.mu.Lock()
+	p.lastError = message
+	notify := p.notifySubsystem
+	p.mu.Unlock()
+
+	p.publish(Event{Type: EventError, Error: message})
+	if notify != nil {
+		notify("player")
+	}
+}
+
+// GetError returns the last playback error, or "" if there is none
+func (p *Player) GetError() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastError
+}
+
+// ClearError forgets the last playback error
+func (p *Player) ClearError() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastError = ""
+}
+
+// DecodeProgress returns how much of the current track has been fetched and
+// decoded into the cache, in percent
+// Returns false unless the current track is being decoded now
+func (p *Player) DecodeProgress() (int, bool) {
+	track, err := p.GetPlaylist().Current()
+	if err != nil {
+		return 0, false
+	}
+	done, ok := p.cache.Progress(track.URL)
+	return int(done * 100), ok
+}
+
 // PlaybackTiming contains current playback timing information
 type PlaybackTiming struct {
-	Elapsed   int64 // Elapsed time in seconds
-	Duration  int64 // Total duration in seconds
-	Remaining int64 // Remaining time in seconds
+	Elapsed   float64 // Elapsed time in seconds, interpolated between backend polls
+	Duration  int64   // Total duration in seconds
+	Remaining int64   // Remaining time in seconds
 }
 
 // GetPlaybackTiming returns current playback timing information
@@ -35,16 +244,20 @@ func (p *Player) GetPlaybackTiming() *PlaybackTiming {
 
 	// Get cached elapsed time from polling loop
 	p.mu.Lock()
-	elapsed := p.lastElapsedTime
+	polled := p.lastElapsedTime
+	elapsed := p.interpolatedElapsed()
 	p.mu.Unlock()
 
 	// Return nil if elapsed time is negative (not yet set or track finished)
-	if elapsed < 0 {
+	if polled < 0 {
 		return nil
 	}
+	if elapsed > float64(duration) {
+		elapsed = float64(duration)
+	}
 
 	// Calculate remaining time
-	remaining := duration - elapsed
+	remaining := duration - int64(elapsed)
 	if remaining < 0 {
 		remaining = 0
 	}
@@ -55,3 +268,44 @@ func (p *Player) GetPlaybackTiming() *PlaybackTiming {
 		Remaining: remaining,
 	}
 }
+
+// updateElapsed records an elapsed time polled from the backend
+// The backend reports whole seconds, so the local clock is only re-anchored
+// when it is outside the reported second; otherwise it keeps counting smoothly
+// Caller must hold the lock
+func (p *Player) updateElapsed(elapsed int64) {
+	p.lastElapsedTime = elapsed
+	if clock := p.clockElapsed(); clock < float64(elapsed) || clock >= float64(elapsed+1) {
+		p.anchorElapsed(float64(elapsed))
+	}
+}
+
+// anchorElapsed restarts the local clock at a known position
+// Caller must hold the lock
+func (p *Player) anchorElapsed(elapsed float64) {
+	p.elapsedBase = elapsed
+	p.elapsedAt = time.Time{}
+	if p.state == StatePlaying {
+		p.elapsedAt = time.Now()
+	}
+}
+
+// clockElapsed returns the elapsed time in seconds advanced on the monotonic clock since the anchor
+// Caller must hold the lock
+func (p *Player) clockElapsed() float64 {
+	if p.elapsedAt.IsZero() {
+		return p.elapsedBase
+	}
+	return p.elapsedBase + time.Since(p.elapsedAt).Seconds()
+}
+
+// interpolatedElapsed returns the elapsed time in seconds between backend polls
+// It never runs a full second past the last polled value, in case the host stalled
+// Caller must hold the lock
+func (p *Player) interpolatedElapsed() float64 {
+	elapsed := p.clockElapsed()
+	if limit := float64(p.lastElapsedTime + 1); elapsed > limit {
+		elapsed = limit
+	}
+	return elapsed
+}
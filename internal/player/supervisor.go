@@ -0,0 +1,148 @@
+package player
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/famish99/direttampd/internal/playlist"
+)
+
+const (
+	defaultReconnectAttempts = 10               // Attempts at restoring a lost session before playback stops
+	reconnectMaxDelay        = 30 * time.Second // Longest wait between attempts
+	trackRetryDelay          = time.Second      // Wait before preparing a failed track again
+)
+
+// trackFailures counts failures in the playback loop
+type trackFailures struct {
+	attempts int // Failed attempts at the current track
+	skipped  int // Tracks skipped in a row
+}
+
+// trackFailed decides what the playback loop does after a track failed to prepare
+// The track is tried again up to track_retries times; after that it is reported
+// as failed and, with skip_failed_tracks, the queue moves on to the next entry
+// Returns true if the loop should carry on playing
+func (p *Player) trackFailed(ctx context.Context, pl *playlist.Playlist, track *playlist.Track, err error, failures *trackFailures) bool {
+	retries := p.config.Playback.TrackRetries
+	if failures.attempts < retries {
+		failures.attempts++
+		log.Printf("Retrying %s (attempt %d/%d)", track.URL, failures.attempts, retries)
+		return sleepContext(ctx, trackRetryDelay)
+	}
+	failures.attempts = 0
+
+	p.setError(fmt.Sprintf("Failed to play %s: %v", track.URL, err))
+	if !p.config.Playback.SkipFailedTracks {
+		return false
+	}
+
+	// Stop rather than cycle through a queue where nothing plays
+	failures.skipped++
+	if failures.skipped >= pl.Length() {
+		log.Printf("Every track in the queue failed, stopping playback")
+		return false
+	}
+
+	log.Printf("Skipping failed track %s", track.URL)
+	return p.fromLoop(ctx, pl.CommitStaged) == nil
+}
+
+// sleepContext waits for d, returning false if ctx is cancelled first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// reconnectAttempts returns how many times a lost session is restored, or -1 if resuming is disabled
+func (p *Player) reconnectAttempts() int {
+	attempts := p.config.Playback.ReconnectAttempts
+	switch {
+	case attempts < 0:
+		return -1
+	case attempts == 0:
+		return defaultReconnectAttempts
+	}
+	return attempts
+}
+
+// sessionLost stages the playing track to start again where it was after the
+// session with the host failed (host restart, network outage)
+// Returns false when resuming is disabled, leaving the playback loop to stop
+func (p *Player) sessionLost(ctx context.Context, pl *playlist.Playlist, err error) bool {
+	if p.reconnectAttempts() < 0 {
+		return false
+	}
+
+	p.mu.Lock()
+	p.reconnecting = true
+	if p.lastElapsedTime > 0 {
+		p.resumeOffset = float64(p.lastElapsedTime)
+	}
+	offset := p.resumeOffset
+	p.mu.Unlock()
+
+	log.Printf("Session lost (%v), resuming the current track at %.3f seconds", err, offset)
+	p.backendMu.Lock()
+	_ = p.backend.Stop()
+	p.backendMu.Unlock()
+
+	// Staging the current track makes the playback loop prepare it again
+	stage := func() error { return pl.Seek(pl.CurrentIndex()) }
+	if seekErr := p.fromLoop(ctx, stage); seekErr != nil {
+		p.endResume()
+		return false
+	}
+	return true
+}
+
+// retryResume waits before another attempt at playing the track of a lost session
+// The wait doubles with each attempt
+// Returns false if no session is being restored, attempts ran out, or playback was cancelled
+func (p *Player) retryResume(ctx context.Context) bool {
+	p.mu.Lock()
+	if !p.reconnecting {
+		p.mu.Unlock()
+		return false
+	}
+	p.reconnectTries++
+	attempt := p.reconnectTries
+	p.mu.Unlock()
+
+	if attempt > p.reconnectAttempts() {
+		log.Printf("Giving up on resuming playback after %d attempts", attempt-1)
+		p.endResume()
+		return false
+	}
+
+	delay := time.Second << (attempt - 1)
+	if delay > reconnectMaxDelay || delay <= 0 {
+		delay = reconnectMaxDelay
+	}
+	log.Printf("Resume attempt %d/%d in %v", attempt, p.reconnectAttempts(), delay)
+
+	if !sleepContext(ctx, delay) {
+		p.endResume()
+		return false
+	}
+	return true
+}
+
+// endResume ends recovery of a lost session
+// Returns true if a session was being restored
+func (p *Player) endResume() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	wasReconnecting := p.reconnecting
+	p.reconnecting = false
+	p.reconnectTries = 0
+	return wasReconnecting
+}
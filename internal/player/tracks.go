@@ -1,15 +1,32 @@
 package player
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
 
+	"github.com/famish99/direttampd/internal/backends"
+	"github.com/famish99/direttampd/internal/cache"
+	"github.com/famish99/direttampd/internal/config"
 	"github.com/famish99/direttampd/internal/decoder"
+	"github.com/famish99/direttampd/internal/icy"
+	"github.com/famish99/direttampd/internal/loudness"
 	"github.com/famish99/direttampd/internal/playlist"
+	"github.com/famish99/direttampd/internal/replaygain"
 )
 
 // PlayTrack plays a single track using the backend
 func (p *Player) PlayTrack(track *playlist.Track) error {
 	log.Printf("Playing track: %s", track.URL)
+	if track.Stream {
+		return p.playStream(track)
+	}
+
+	p.backendMu.Lock()
+	defer p.backendMu.Unlock()
 
 	// Prepare the track (decode, upload)
 	if err := p.backend.PrepareTrack(track); err != nil {
@@ -20,17 +37,193 @@ func (p *Player) PlayTrack(track *playlist.Track) error {
 	return p.backend.StartPlayback()
 }
 
-// backgroundCache pre-fetches and decodes a track in the background
-func (p *Player) backgroundCache(url string) {
-	log.Printf("Background cache: starting for: %s", url)
-	_, err := p.cache.EnsureDecoded(url, func(source, dest string) error {
-		_, err := decoder.DecodeToWAVFile(source, dest)
+// playStream plays internet radio, or an HLS or DASH stream, as it arrives
+// Each title a station sends becomes the track's title, and clients are told of it
+func (p *Player) playStream(track *playlist.Track) error {
+	streamer, ok := p.backend.(backends.StreamPlayer)
+	if !ok {
+		return fmt.Errorf("%s backend cannot play streams", p.backend.GetBackendName())
+	}
+	limits := p.backend.Capabilities().FormatLimits()
+
+	stream, err := icy.Open(track.URL)
+	if errors.Is(err, icy.ErrNotStream) {
+		// HLS and DASH segments are fetched by ffmpeg itself
+		wav, err := decoder.DecodeLiveURL(track.URL, limits)
+		if err != nil {
+			return err
+		}
+		return p.startStream(streamer, track, wav)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %w", err)
+	}
+	// Titles arrive on the decoder's goroutine, which stopping playback waits
+	// for, so the callback must not take the player's lock
+	p.mu.Lock()
+	pl, notify := p.pl, p.notifySubsystem
+	p.mu.Unlock()
+	id := track.ID
+	stream.OnTitle(func(title string) {
+		log.Printf("Stream title: %s", title)
+		if err := pl.SetMetadataByID(id, "title", title); err != nil {
+			return
+		}
+		if notify != nil {
+			notify("playlist")
+			notify("player")
+		}
+	})
+
+	wav, err := decoder.DecodeLiveStream(stream, limits)
+	if err != nil {
+		stream.Close()
+		return err
+	}
+	return p.startStream(streamer, track, wav)
+}
+
+// startStream hands a decoded stream to the backend and starts playback
+func (p *Player) startStream(streamer backends.StreamPlayer, track *playlist.Track, wav io.ReadCloser) error {
+	p.backendMu.Lock()
+	defer p.backendMu.Unlock()
+
+	if err := streamer.PrepareStream(track, wav); err != nil {
+		return err
+	}
+	return p.backend.StartPlayback()
+}
+
+// PlayTracks plays tracks back-to-back from a single gapless upload
+func (p *Player) PlayTracks(tracks []*playlist.Track) error {
+	log.Printf("Playing %d tracks gaplessly, starting with: %s", len(tracks), tracks[0].URL)
+
+	p.backendMu.Lock()
+	defer p.backendMu.Unlock()
+
+	// Prepare all tracks in one upload
+	if err := p.backend.PrepareTracks(tracks); err != nil {
 		return err
+	}
+
+	// Start playback
+	return p.backend.StartPlayback()
+}
+
+// trackGain returns the software gain in dB for a track
+// Combines loudness normalization (or ReplayGain when it is off) with the software mixer volume
+func (p *Player) trackGain(track *playlist.Track) float64 {
+	p.mu.Lock()
+	mode := p.replayGainMode.Resolve(p.random)
+	volume := p.volume
+	p.mu.Unlock()
+
+	if p.loudness != nil && !track.Stream {
+		return p.loudnessGain(track) + volumeGain(volume)
+	}
+
+	gain := replaygain.Gain(track.Metadata, mode, replaygain.Settings{
+		Preamp:        p.config.Playback.ReplayGainPreamp,
+		MissingPreamp: p.config.Playback.ReplayGainMissingPreamp,
+		AllowClipping: p.config.Playback.ReplayGainAllowClipping,
 	})
+
+	return gain + volumeGain(volume)
+}
+
+// loudnessGain returns the gain that normalizes a track to the configured loudness target
+// The track is decoded into the cache first so the analysis reads a local file
+func (p *Player) loudnessGain(track *playlist.Track) float64 {
+	wavPath, err := p.fetchDecodeAndCache(track)
+	if err != nil {
+		log.Printf("Loudness: failed to decode %s: %v", track.URL, err)
+		return 0
+	}
+
+	m, err := p.loudness.Measure(track.URL, wavPath)
+	if err != nil {
+		log.Printf("Loudness: %v", err)
+		return 0
+	}
+	return loudness.Gain(m, p.config.Playback.LoudnessTarget)
+}
+
+// volumeGain converts a mixer volume (0-100) to dB
+// Amplitude follows the square of the volume so steps sound even across the range
+// A disabled mixer (-1) and full volume leave the signal untouched
+func volumeGain(volume int) float64 {
+	if volume < 0 || volume >= 100 {
+		return 0
+	}
+	if volume == 0 {
+		return math.Inf(-1)
+	}
+	return 40 * math.Log10(float64(volume)/100)
+}
+
+// decoder returns the cache decoder for the backend's output
+// Tracks are decoded to their native format unless the output cannot play it
+func (p *Player) decoder() cache.Decoder {
+	return p.backend.Capabilities().Decoder()
+}
+
+// Prewarmer decodes tracks into the cache as prefetching would, so they start
+// at once when they are played later
+// It needs neither a player nor the output: the format limits come from the
+// config, so the cache can be filled while the output is off
+type Prewarmer struct {
+	cache    *cache.DiskCache
+	decoder  cache.Decoder
+	loudness *loudness.Analyzer // nil unless loudness normalization is enabled
+}
+
+// NewPrewarmer creates a prewarmer decoding into c for the output of the configured backend
+func NewPrewarmer(c *cache.DiskCache, cfg *config.Config) (*Prewarmer, error) {
+	caps, err := backends.ConfiguredCapabilities(cfg.Backend, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Prewarmer{cache: c, decoder: caps.Decoder(), loudness: newAnalyzer(cfg)}, nil
+}
+
+// Prewarm decodes a track into the cache
+// Streams, which are never cached, are skipped
+// Returns whether the track is now cached
+func (w *Prewarmer) Prewarm(ctx context.Context, url string) (bool, error) {
+	if track := playlist.NewTrack(url); track.Stream {
+		return false, nil
+	}
+	if _, err := w.cache.EnsureDecoded(ctx, url, w.decoder); err != nil {
+		return false, err
+	}
+	if w.loudness != nil {
+		if _, err := w.loudness.Measure(url, w.cache.GetPathForKey(url)); err != nil {
+			log.Printf("Prewarm: %v", err)
+		}
+	}
+	return true, nil
+}
+
+// backgroundCache pre-fetches and decodes a track for a prefetch worker
+// ctx is cancelled when the track leaves the prefetch window
+func (p *Player) backgroundCache(ctx context.Context, url string) {
+	log.Printf("Background cache: starting for: %s", url)
+	_, err := p.cache.EnsureDecoded(ctx, url, p.decoder())
+	if ctx.Err() != nil {
+		log.Printf("Background cache: cancelled for %s", url)
+		return
+	}
 	if err != nil {
 		log.Printf("Background cache: failed for %s: %v", url, err)
-	} else {
-		log.Printf("Background cache: completed for: %s", url)
+		return
+	}
+	log.Printf("Background cache: completed for: %s", url)
+
+	// Analyze ahead of playback so starting the track doesn't wait for it
+	if p.loudness != nil {
+		if _, err := p.loudness.Measure(url, p.cache.GetPathForKey(url)); err != nil {
+			log.Printf("Background cache: %v", err)
+		}
 	}
 }
 
@@ -38,19 +231,10 @@ func (p *Player) backgroundCache(url string) {
 // Returns the WAV file path
 func (p *Player) fetchDecodeAndCache(track *playlist.Track) (string, error) {
 	log.Printf("Fetching and decoding track: %s", track.URL)
-	cachePath, err := p.cache.EnsureDecoded(track.URL, func(source, dest string) error {
-		_, err := decoder.DecodeToWAVFile(source, dest)
-		return err
-	})
+	cachePath, err := p.cache.EnsureDecoded(context.Background(), track.URL, p.decoder())
 	if err != nil {
 		return "", err
 	}
 	log.Printf("Using cached WAV file: %s", cachePath)
 	return cachePath, nil
 }
-
-// BackgroundCacheTrack is a public wrapper for background caching
-// Exposes backgroundCache for MPD commands to use
-func (p *Player) BackgroundCacheTrack(url string) {
-	p.backgroundCache(url)
-}
@@ -6,7 +6,6 @@ import (
 	"log"
 	"time"
 
-	"github.com/famish99/direttampd/internal/decoder"
 	"github.com/famish99/direttampd/internal/playlist"
 )
 
@@ -22,6 +21,9 @@ func (p *Player) BeginTransition() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	p.pendingPlaylist = playlist.NewPlaylist()
+	p.watchMetadata(p.pendingPlaylist)
+	p.pendingPlaylist.SetRandom(p.random)
+	p.pendingPlaylist.SetRepeat(p.repeat)
 	log.Printf("Created new pending playlist for transition")
 }
 
@@ -40,6 +42,9 @@ func (p *Player) CancelTransition() {
 func (p *Player) ReplacePlaylist(newPl *playlist.Playlist) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	newPl.SetRandom(p.random)
+	newPl.SetRepeat(p.repeat)
+	p.watchMetadata(newPl)
 	p.pl = newPl
 	log.Printf("Replaced playlist with new instance")
 }
@@ -60,15 +65,22 @@ func (p *Player) CompleteTransition() error {
 		return fmt.Errorf("no tracks in pending playlist: %w", err)
 	}
 
+	// Whether the track is internet radio is only known once it is probed
+	pending.WaitForMetadata(firstTrack.ID)
+	if firstTrack, err = pending.Current(); err != nil {
+		return fmt.Errorf("no tracks in pending playlist: %w", err)
+	}
+
 	log.Printf("Completing transition - waiting for cache: %s", firstTrack.URL)
 
-	// Wait for cache with timeout
+	// Wait for cache with timeout; internet radio is not cached
 	done := make(chan error, 1)
 	go func() {
-		_, err := p.cache.EnsureDecoded(firstTrack.URL, func(source, dest string) error {
-			_, err := decoder.DecodeToWAVFile(source, dest)
-			return err
-		})
+		if firstTrack.Stream {
+			done <- nil
+			return
+		}
+		_, err := p.cache.EnsureDecoded(context.Background(), firstTrack.URL, p.decoder())
 		done <- err
 	}()
 
@@ -82,9 +94,18 @@ func (p *Player) CompleteTransition() error {
 	}
 
 	log.Printf("Cache ready, swapping playlists")
+	return p.do(func() error { return p.swapPlaylist(pending) })
+}
 
-	// Cancel old playback loop if running
+// swapPlaylist cancels the old playback loop and starts a new one on the pending playlist
+func (p *Player) swapPlaylist(pending *playlist.Playlist) error {
 	p.mu.Lock()
+	if p.pendingPlaylist != pending {
+		p.mu.Unlock()
+		return fmt.Errorf("transition cancelled")
+	}
+
+	// Cancel old playback loop if running
 	if p.playbackCancel != nil {
 		log.Printf("Cancelling old playback loop")
 		p.playbackCancel()
@@ -100,7 +121,7 @@ func (p *Player) CompleteTransition() error {
 	ctx, cancel := context.WithCancel(context.Background())
 	p.playbackCtx = ctx
 	p.playbackCancel = cancel
-	p.state = StatePlaying
+	p.setState(StatePlaying)
 
 	// Capture playlist for closure
 	pl := p.pl
@@ -117,4 +138,4 @@ func (p *Player) CompleteTransition() error {
 
 	log.Printf("Transition complete")
 	return nil
-}
\ No newline at end of file
+}
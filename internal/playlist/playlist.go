@@ -3,25 +3,45 @@ package playlist
 import (
 	"fmt"
 	"log"
+	"math/rand"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
 	"github.com/famish99/direttampd/internal/decoder"
+	"github.com/famish99/direttampd/internal/icy"
+	"github.com/famish99/direttampd/internal/playlistfile"
 )
 
 // Track represents a single audio track
 type Track struct {
+	ID       int // Stable song ID, unique within the playlist
 	URL      string
 	Metadata map[string]string
+	Priority int // Queue priority (0-255), higher plays first in random mode
+
+	// Client-supplied tags (addtagid) that override probed metadata
+	Tags map[string]string
+
+	// Playback range in seconds (0 means unbounded)
+	RangeStart float64
+	RangeEnd   float64
+
+	// Internet radio or an HLS/DASH stream, played as it arrives instead of
+	// being decoded into the cache
+	Stream bool
+
+	// Metadata (and Stream) are still being extracted in the background
+	MetadataPending bool
 }
 
 // PlaylistEvent records a modification to the playlist
 type PlaylistEvent struct {
 	Version   uint32
-	Operation string // "add" or "clear"
+	Operation string // "add", "clear", or the queue edit that produced it ("move", "prio", ...)
 	Track     *Track // nil for clear operations
-	Position  int    // Position where track was added
+	Position  int    // Position where track was added or moved to
 }
 
 // InterruptEvent signals a playback interruption with notification info
@@ -32,13 +52,20 @@ type InterruptEvent struct {
 
 // Playlist manages a list of tracks to play
 type Playlist struct {
-	mu           sync.RWMutex
-	tracks       []Track
-	current      int
-	stagedNext   int             // Staged next track index (-1 means no staging)
-	version      uint32          // Increments on each playlist modification
-	history      []PlaylistEvent // Event log of all modifications
-	interruptCh  chan InterruptEvent // Channel to signal playback interruptions
+	mu          sync.RWMutex
+	tracks      []Track
+	current     int
+	stagedNext  int                 // Staged next track index (-1 means no staging)
+	version     uint32              // Increments on each playlist modification
+	nextID      int                 // Next song ID to assign
+	history     []PlaylistEvent     // Event log of all modifications
+	interruptCh chan InterruptEvent // Channel to signal playback interruptions
+	random      bool                // Play tracks in the shuffled order instead of queue order
+	order       []int               // Song IDs in random play order; tracks before current have played
+	repeat      bool                // Start over at the beginning after the last track
+
+	probing    map[int]chan struct{} // Song IDs being probed, each channel closed when done
+	onMetadata func(id int)          // Called when background probing fills in a track
 }
 
 // NewPlaylist creates a new empty playlist
@@ -46,8 +73,9 @@ func NewPlaylist() *Playlist {
 	return &Playlist{
 		tracks:      make([]Track, 0),
 		current:     -1,
-		stagedNext:  -1, // -1 means no staging
+		stagedNext:  -1,                           // -1 means no staging
 		interruptCh: make(chan InterruptEvent, 1), // Buffered to avoid blocking
+		probing:     make(map[int]chan struct{}),
 	}
 }
 
@@ -61,7 +89,7 @@ func (p *Playlist) GetInterruptChannel() <-chan InterruptEvent {
 func (p *Playlist) SignalInterrupt(shouldNotify, shouldExitLoop bool) bool {
 	select {
 	case p.interruptCh <- InterruptEvent{ShouldNotify: shouldNotify, ShouldExitLoop: shouldExitLoop}:
-        log.Printf("InterruptEvent: %s, %s", shouldNotify, shouldExitLoop)
+		log.Printf("InterruptEvent: %v, %v", shouldNotify, shouldExitLoop)
 		return true
 	default:
 		// Channel full, interrupt already pending
@@ -69,9 +97,9 @@ func (p *Playlist) SignalInterrupt(shouldNotify, shouldExitLoop bool) bool {
 	}
 }
 
-// Add adds a track to the playlist with metadata extraction
-func (p *Playlist) Add(url string) {
-	// Extract metadata using ffprobe
+// probeMetadata extracts track metadata using ffprobe
+// Falls back to the filename as title when the source has no title tag
+func probeMetadata(url string) map[string]string {
 	metadata, err := decoder.ProbeMetadata(url)
 	if err != nil {
 		log.Printf("Warning: failed to extract metadata for %s: %v", url, err)
@@ -80,22 +108,66 @@ func (p *Playlist) Add(url string) {
 
 	// If no title in metadata, use filename as fallback
 	if metadata["title"] == "" {
-		title := filepath.Base(url)
-		// Remove extension for cleaner display
-		if ext := filepath.Ext(title); ext != "" {
-			title = strings.TrimSuffix(title, ext)
+		metadata["title"] = filenameTitle(url)
+	}
+
+	return metadata
+}
+
+// filenameTitle returns a URL's file name without its extension, shown as the
+// title of tracks without a title tag and of tracks still being probed
+func filenameTitle(url string) string {
+	title := filepath.Base(url)
+	// Remove extension for cleaner display
+	if ext := filepath.Ext(title); ext != "" {
+		title = strings.TrimSuffix(title, ext)
+	}
+	return title
+}
+
+// probeTrack extracts a URL's metadata and whether it is a stream with no
+// known end: internet radio, or an HLS or DASH stream
+// A station is described by its headers, as probing it would never finish;
+// an HLS or DASH stream only by its URL. Only remote URLs can be stations
+func probeTrack(url string) (map[string]string, bool) {
+	remote := strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+	if remote {
+		if name, genre, err := icy.Probe(url); err == nil {
+			metadata := map[string]string{"name": name, "genre": genre}
+			if name == "" {
+				metadata["name"] = url
+			}
+			return metadata, true
 		}
-		metadata["title"] = title
 	}
+	if playlistfile.IsStreamManifest(url) {
+		return map[string]string{"name": url}, true
+	}
+	return probeMetadata(url), false
+}
 
+// NewTrack creates a track with extracted metadata that is not part of any playlist
+// Useful for describing stored playlist entries without queueing them
+func NewTrack(url string) Track {
+	metadata, stream := probeTrack(url)
+	return Track{
+		ID:       -1,
+		URL:      url,
+		Metadata: metadata,
+		Stream:   stream,
+	}
+}
+
+// Add adds a track to the playlist
+// Its metadata is extracted in the background (see probeQueue); until then
+// the track is titled after its file name
+func (p *Playlist) Add(url string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	position := len(p.tracks)
-	track := Track{
-		URL:      url,
-		Metadata: metadata,
-	}
+	track := p.newPendingTrack(url)
+	p.nextID++
 	p.tracks = append(p.tracks, track)
 
 	// If this is the first track, set current to 0
@@ -125,24 +197,8 @@ func (p *Playlist) AddMultiple(urls []string) {
 // AddAt adds a track at a specific position in the playlist
 // If position is out of bounds, adds at the end
 // Returns the actual position where the track was added
+// Metadata is extracted in the background, as for Add
 func (p *Playlist) AddAt(url string, position int) int {
-	// Extract metadata using ffprobe
-	metadata, err := decoder.ProbeMetadata(url)
-	if err != nil {
-		log.Printf("Warning: failed to extract metadata for %s: %v", url, err)
-		metadata = make(map[string]string)
-	}
-
-	// If no title in metadata, use filename as fallback
-	if metadata["title"] == "" {
-		title := filepath.Base(url)
-		// Remove extension for cleaner display
-		if ext := filepath.Ext(title); ext != "" {
-			title = strings.TrimSuffix(title, ext)
-		}
-		metadata["title"] = title
-	}
-
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -154,10 +210,8 @@ func (p *Playlist) AddAt(url string, position int) int {
 		position = len(p.tracks)
 	}
 
-	track := Track{
-		URL:      url,
-		Metadata: metadata,
-	}
+	track := p.newPendingTrack(url)
+	p.nextID++
 
 	// Insert at position
 	p.tracks = append(p.tracks[:position], append([]Track{track}, p.tracks[position:]...)...)
@@ -193,9 +247,199 @@ func (p *Playlist) Clear() {
 	p.current = -1
 	p.version = 0
 	p.history = make([]PlaylistEvent, 0)
+	p.order = nil
+}
+
+// Move moves the track at position from to position to
+// The current and staged indices follow the tracks they refer to
+func (p *Playlist) Move(from, to int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if from < 0 || from >= len(p.tracks) {
+		return fmt.Errorf("invalid source position: %d", from)
+	}
+	if to < 0 || to >= len(p.tracks) {
+		return fmt.Errorf("invalid destination position: %d", to)
+	}
+	if from == to {
+		return nil
+	}
+
+	// Remove the track and reinsert it at the destination
+	track := p.tracks[from]
+	p.tracks = append(p.tracks[:from], p.tracks[from+1:]...)
+	p.tracks = append(p.tracks[:to], append([]Track{track}, p.tracks[to:]...)...)
+
+	p.current = movedIndex(p.current, from, to)
+	p.stagedNext = movedIndex(p.stagedNext, from, to)
+
+	p.version++ // Increment version on playlist modification
+
+	// Record a move event for every track whose position changed
+	lo, hi := from, to
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	for pos := lo; pos <= hi; pos++ {
+		trackCopy := p.tracks[pos]
+		p.history = append(p.history, PlaylistEvent{
+			Version:   p.version,
+			Operation: "move",
+			Track:     &trackCopy,
+			Position:  pos,
+		})
+	}
+
+	return nil
+}
+
+// movedIndex returns where index ends up after moving a track from one position to another
+// Negative indices (unset) are returned unchanged
+func movedIndex(index, from, to int) int {
+	switch {
+	case index < 0:
+		return index
+	case index == from:
+		return to
+	case from < index && to >= index:
+		return index - 1
+	case from > index && to <= index:
+		return index + 1
+	}
+	return index
 }
 
-// Current returns the current track
+// Swap exchanges the tracks at positions pos1 and pos2
+// The current and staged indices follow the tracks they refer to
+func (p *Playlist) Swap(pos1, pos2 int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if pos1 < 0 || pos1 >= len(p.tracks) {
+		return fmt.Errorf("invalid track index: %d", pos1)
+	}
+	if pos2 < 0 || pos2 >= len(p.tracks) {
+		return fmt.Errorf("invalid track index: %d", pos2)
+	}
+	if pos1 == pos2 {
+		return nil
+	}
+
+	p.tracks[pos1], p.tracks[pos2] = p.tracks[pos2], p.tracks[pos1]
+
+	p.current = swappedIndex(p.current, pos1, pos2)
+	p.stagedNext = swappedIndex(p.stagedNext, pos1, pos2)
+
+	p.version++ // Increment version on playlist modification
+
+	// Record a swap event for both positions
+	for _, pos := range []int{pos1, pos2} {
+		trackCopy := p.tracks[pos]
+		p.history = append(p.history, PlaylistEvent{
+			Version:   p.version,
+			Operation: "swap",
+			Track:     &trackCopy,
+			Position:  pos,
+		})
+	}
+
+	return nil
+}
+
+// swappedIndex returns where index ends up after swapping the tracks at pos1 and pos2
+func swappedIndex(index, pos1, pos2 int) int {
+	switch index {
+	case pos1:
+		return pos2
+	case pos2:
+		return pos1
+	}
+	return index
+}
+
+// FindByID returns the position of the track with the given ID, or -1 if not found
+func (p *Playlist) FindByID(id int) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.indexOfID(id)
+}
+
+// TrackAt returns a copy of the track at the given position
+// Background probing replaces a track's fields under the lock, so callers get
+// their own copy rather than the playlist's element
+func (p *Playlist) TrackAt(position int) (*Track, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if position < 0 || position >= len(p.tracks) {
+		return nil, fmt.Errorf("invalid track index: %d", position)
+	}
+
+	track := p.tracks[position]
+	return &track, nil
+}
+
+// Shuffle randomizes the order of tracks in the range [start, end)
+// An end of -1 means the end of the playlist
+// The current and staged indices follow the tracks they refer to
+func (p *Playlist) Shuffle(start, end int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if end < 0 {
+		end = len(p.tracks)
+	}
+	if start < 0 || start > end || end > len(p.tracks) {
+		return fmt.Errorf("invalid range: %d:%d", start, end)
+	}
+	if end-start < 2 {
+		return nil // Nothing to shuffle
+	}
+
+	// Remember which tracks the indices point at so they survive the shuffle
+	currentID := p.idAt(p.current)
+	stagedID := p.idAt(p.stagedNext)
+
+	rand.Shuffle(end-start, func(i, j int) {
+		p.tracks[start+i], p.tracks[start+j] = p.tracks[start+j], p.tracks[start+i]
+	})
+
+	for i := start; i < end; i++ {
+		if currentID >= 0 && p.tracks[i].ID == currentID {
+			p.current = i
+		}
+		if stagedID >= 0 && p.tracks[i].ID == stagedID {
+			p.stagedNext = i
+		}
+	}
+
+	p.version++ // Increment version on playlist modification
+
+	// Record a shuffle event for every position in the range
+	for pos := start; pos < end; pos++ {
+		trackCopy := p.tracks[pos]
+		p.history = append(p.history, PlaylistEvent{
+			Version:   p.version,
+			Operation: "shuffle",
+			Track:     &trackCopy,
+			Position:  pos,
+		})
+	}
+
+	return nil
+}
+
+// idAt returns the ID of the track at index, or -1 if the index is out of range
+// Caller must hold the lock
+func (p *Playlist) idAt(index int) int {
+	if index < 0 || index >= len(p.tracks) {
+		return -1
+	}
+	return p.tracks[index].ID
+}
+
+// Current returns a copy of the current track (see TrackAt)
 func (p *Playlist) Current() (*Track, error) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
@@ -204,7 +448,8 @@ func (p *Playlist) Current() (*Track, error) {
 		return nil, fmt.Errorf("no current track")
 	}
 
-	return &p.tracks[p.current], nil
+	track := p.tracks[p.current]
+	return &track, nil
 }
 
 // Next stages the next track (doesn't modify current until CommitStaged is called)
@@ -216,14 +461,156 @@ func (p *Playlist) Next() error {
 		return fmt.Errorf("playlist is empty")
 	}
 
-	p.stagedNext = p.current + 1
+	p.stagedNext = p.nextIndex()
 	if p.stagedNext >= len(p.tracks) {
+		p.stagedNext = -1
 		return fmt.Errorf("end of playlist")
 	}
 
 	return nil
 }
 
+// nextIndex returns the index of the track that should play after current
+// In random mode this is the highest-priority unplayed track in the shuffled order
+// With repeat on the queue wraps around; otherwise returns len(tracks) when there is no next track
+// Caller must hold the lock
+func (p *Playlist) nextIndex() int {
+	if !p.random {
+		if p.repeat && p.current+1 >= len(p.tracks) {
+			return 0
+		}
+		return p.current + 1
+	}
+
+	indices := p.syncOrder()
+	pos := p.orderPosition()
+
+	// The earliest unplayed track with the highest priority wins
+	best := -1
+	for i := pos + 1; i < len(p.order); i++ {
+		if best < 0 || p.tracks[indices[p.order[i]]].Priority > p.tracks[indices[p.order[best]]].Priority {
+			best = i
+		}
+	}
+
+	if best < 0 {
+		// Every track has played; wrapping around starts a fresh shuffle
+		p.reshuffle()
+		if !p.repeat {
+			return len(p.tracks)
+		}
+		// The current track leads the new order, so the next one follows it
+		if len(p.order) > 1 {
+			return p.indexOfID(p.order[1])
+		}
+		return p.current
+	}
+
+	// Bring the chosen track forward so the order records what actually played
+	id := p.order[best]
+	copy(p.order[pos+2:best+1], p.order[pos+1:best])
+	p.order[pos+1] = id
+	return indices[id]
+}
+
+// reshuffle starts a new random cycle with the current track first
+// Caller must hold the lock
+func (p *Playlist) reshuffle() {
+	p.order = make([]int, 0, len(p.tracks))
+	if id := p.idAt(p.current); id >= 0 {
+		p.order = append(p.order, id)
+	}
+
+	rest := make([]int, 0, len(p.tracks))
+	for i := range p.tracks {
+		if i != p.current {
+			rest = append(rest, p.tracks[i].ID)
+		}
+	}
+	rand.Shuffle(len(rest), func(i, j int) {
+		rest[i], rest[j] = rest[j], rest[i]
+	})
+
+	p.order = append(p.order, rest...)
+}
+
+// syncOrder brings the random order in line with the queue after edits
+// Removed songs are dropped and added songs are placed at random unplayed positions
+// Returns the queue index of every song ID
+// Caller must hold the lock
+func (p *Playlist) syncOrder() map[int]int {
+	indices := make(map[int]int, len(p.tracks))
+	for i := range p.tracks {
+		indices[p.tracks[i].ID] = i
+	}
+
+	ordered := make(map[int]bool, len(p.order))
+	order := p.order[:0]
+	for _, id := range p.order {
+		if _, ok := indices[id]; ok {
+			order = append(order, id)
+			ordered[id] = true
+		}
+	}
+	p.order = order
+
+	// A current track missing from the order counts as the start of the cycle
+	if id := p.idAt(p.current); id >= 0 && !ordered[id] {
+		p.order = append([]int{id}, p.order...)
+		ordered[id] = true
+	}
+
+	for i := range p.tracks {
+		id := p.tracks[i].ID
+		if ordered[id] {
+			continue
+		}
+
+		first := p.orderPosition() + 1
+		at := first + rand.Intn(len(p.order)-first+1)
+		p.order = append(p.order, 0)
+		copy(p.order[at+1:], p.order[at:])
+		p.order[at] = id
+	}
+
+	return indices
+}
+
+// orderPosition returns the position of the current track in the random order, or -1
+// Caller must hold the lock
+func (p *Playlist) orderPosition() int {
+	id := p.idAt(p.current)
+	if id < 0 {
+		return -1
+	}
+	for i, orderID := range p.order {
+		if orderID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// promote makes the track at index the next one in the random order
+// Tracks that already played in this cycle keep their place, so previous can walk back
+// Caller must hold the lock
+func (p *Playlist) promote(index int) {
+	id := p.idAt(index)
+	if id < 0 {
+		return
+	}
+
+	p.syncOrder()
+	pos := p.orderPosition()
+	for at := pos + 2; at < len(p.order); at++ {
+		if p.order[at] == id {
+			copy(p.order[pos+2:at+1], p.order[pos+1:at])
+			p.order[pos+1] = id
+			return
+		}
+	}
+}
+
 // Previous stages the previous track (doesn't modify current until CommitStaged is called)
 func (p *Playlist) Previous() error {
 	p.mu.Lock()
@@ -233,7 +620,21 @@ func (p *Playlist) Previous() error {
 		return fmt.Errorf("playlist is empty")
 	}
 
+	// In random mode previous walks back through the tracks played this cycle
+	if p.random {
+		indices := p.syncOrder()
+		pos := p.orderPosition()
+		if pos <= 0 {
+			return fmt.Errorf("beginning of playlist")
+		}
+		p.stagedNext = indices[p.order[pos-1]]
+		return nil
+	}
+
 	p.stagedNext = p.current - 1
+	if p.stagedNext < 0 && p.repeat {
+		p.stagedNext = len(p.tracks) - 1
+	}
 	if p.stagedNext < 0 {
 		return fmt.Errorf("beginning of playlist")
 	}
@@ -266,17 +667,222 @@ func (p *Playlist) CommitStaged() error {
 			return fmt.Errorf("playlist is empty")
 		}
 
-		p.stagedNext = p.current + 1
+		p.stagedNext = p.nextIndex()
 		if p.stagedNext >= len(p.tracks) {
+			p.stagedNext = -1
 			return fmt.Errorf("end of playlist")
 		}
 	}
 
+	// A track picked out of turn plays next in the random order instead of being skipped later
+	if p.random {
+		p.promote(p.stagedNext)
+	}
+
 	p.current = p.stagedNext
 	p.stagedNext = -1 // Reset staging
 	return nil
 }
 
+// SetRandom enables or disables playing in a shuffled order
+// Enabling it starts a fresh shuffle with the current track first
+func (p *Playlist) SetRandom(random bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.random = random
+	p.order = nil
+	if random {
+		p.reshuffle()
+	}
+}
+
+// SetRepeat enables or disables starting over after the last track
+func (p *Playlist) SetRepeat(repeat bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.repeat = repeat
+}
+
+// SetPriority sets the priority of all tracks in the range [start, end)
+// An end of -1 means the end of the playlist
+func (p *Playlist) SetPriority(start, end, priority int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if end < 0 {
+		end = len(p.tracks)
+	}
+	if start < 0 || start > end || end > len(p.tracks) {
+		return fmt.Errorf("invalid range: %d:%d", start, end)
+	}
+
+	for pos := start; pos < end; pos++ {
+		p.setPriorityAt(pos, priority)
+	}
+	return nil
+}
+
+// SetPriorityByID sets the priority of the track with the given song ID
+func (p *Playlist) SetPriorityByID(id, priority int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for pos := range p.tracks {
+		if p.tracks[pos].ID == id {
+			p.setPriorityAt(pos, priority)
+			return nil
+		}
+	}
+	return fmt.Errorf("no such song: %d", id)
+}
+
+// SetRangeByID restricts playback of the track with the given song ID to [start, end) seconds
+// An end of 0 means play to the end of the track; start and end of 0 remove the range
+func (p *Playlist) SetRangeByID(id int, start, end float64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if start < 0 || end < 0 || (end > 0 && end <= start) {
+		return fmt.Errorf("invalid range: %.3f:%.3f", start, end)
+	}
+
+	for pos := range p.tracks {
+		if p.tracks[pos].ID != id {
+			continue
+		}
+
+		p.tracks[pos].RangeStart = start
+		p.tracks[pos].RangeEnd = end
+		p.version++ // Increment version on playlist modification
+
+		trackCopy := p.tracks[pos]
+		p.history = append(p.history, PlaylistEvent{
+			Version:   p.version,
+			Operation: "range",
+			Track:     &trackCopy,
+			Position:  pos,
+		})
+		return nil
+	}
+	return fmt.Errorf("no such song: %d", id)
+}
+
+// AddTagByID attaches a client-supplied tag to the track with the given song ID
+// Tags added this way take precedence over probed metadata
+func (p *Playlist) AddTagByID(id int, tag, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pos := p.indexOfID(id)
+	if pos < 0 {
+		return fmt.Errorf("no such song: %d", id)
+	}
+
+	// Copy on write so snapshots in the event log keep their own tags
+	tags := make(map[string]string, len(p.tracks[pos].Tags)+1)
+	for k, v := range p.tracks[pos].Tags {
+		tags[k] = v
+	}
+	tags[tag] = value
+	p.tracks[pos].Tags = tags
+
+	p.recordTagChange(pos)
+	return nil
+}
+
+// ClearTagsByID removes client-supplied tags from the track with the given song ID
+// An empty tag removes all of them
+func (p *Playlist) ClearTagsByID(id int, tag string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pos := p.indexOfID(id)
+	if pos < 0 {
+		return fmt.Errorf("no such song: %d", id)
+	}
+
+	tags := make(map[string]string, len(p.tracks[pos].Tags))
+	if tag != "" {
+		for k, v := range p.tracks[pos].Tags {
+			if k != tag {
+				tags[k] = v
+			}
+		}
+	}
+	p.tracks[pos].Tags = tags
+
+	p.recordTagChange(pos)
+	return nil
+}
+
+// SetMetadataByID replaces a probed metadata field of the track with the given song ID
+// Used for what internet radio reports while it plays, such as the title
+func (p *Playlist) SetMetadataByID(id int, key, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pos := p.indexOfID(id)
+	if pos < 0 {
+		return fmt.Errorf("no such song: %d", id)
+	}
+
+	// Copy on write, like tags
+	metadata := make(map[string]string, len(p.tracks[pos].Metadata)+1)
+	for k, v := range p.tracks[pos].Metadata {
+		metadata[k] = v
+	}
+	metadata[key] = value
+	p.tracks[pos].Metadata = metadata
+
+	p.recordTagChange(pos)
+	return nil
+}
+
+// recordTagChange bumps the version and records a tag event for the track at pos
+// Caller must hold the lock
+func (p *Playlist) recordTagChange(pos int) {
+	p.version++ // Increment version on playlist modification
+
+	trackCopy := p.tracks[pos]
+	p.history = append(p.history, PlaylistEvent{
+		Version:   p.version,
+		Operation: "tag",
+		Track:     &trackCopy,
+		Position:  pos,
+	})
+}
+
+// indexOfID returns the position of the track with the given ID, or -1 if not found
+// Caller must hold the lock
+func (p *Playlist) indexOfID(id int) int {
+	for i := range p.tracks {
+		if p.tracks[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// setPriorityAt sets the priority of the track at pos and records the change
+// Caller must hold the lock
+func (p *Playlist) setPriorityAt(pos, priority int) {
+	if p.tracks[pos].Priority == priority {
+		return
+	}
+
+	p.tracks[pos].Priority = priority
+	p.version++ // Increment version on playlist modification
+
+	trackCopy := p.tracks[pos]
+	p.history = append(p.history, PlaylistEvent{
+		Version:   p.version,
+		Operation: "prio",
+		Track:     &trackCopy,
+		Position:  pos,
+	})
+}
+
 // Length returns the number of tracks
 func (p *Playlist) Length() int {
 	p.mu.RLock()
@@ -295,10 +901,54 @@ func (p *Playlist) GetAll() []Track {
 	return tracks
 }
 
+// Upcoming returns copies of up to n tracks that will play after current, in play order
+// Queue edits can change what actually plays, so callers must check as playback advances
+func (p *Playlist) Upcoming(n int) []Track {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var upcoming []Track
+	if !p.random {
+		for i := p.current + 1; i < len(p.tracks) && len(upcoming) < n; i++ {
+			upcoming = append(upcoming, p.tracks[i])
+		}
+		// With repeat on the queue carries on from the beginning
+		for i := 0; p.repeat && i < p.current && len(upcoming) < n; i++ {
+			upcoming = append(upcoming, p.tracks[i])
+		}
+		return upcoming
+	}
+
+	// Settle the unplayed order by priority now, as nextIndex would one track at a time
+	indices := p.syncOrder()
+	rest := p.order[p.orderPosition()+1:]
+	sort.SliceStable(rest, func(i, j int) bool {
+		return p.tracks[indices[rest[i]]].Priority > p.tracks[indices[rest[j]]].Priority
+	})
+
+	for _, id := range rest {
+		if len(upcoming) >= n {
+			break
+		}
+		upcoming = append(upcoming, p.tracks[indices[id]])
+	}
+	return upcoming
+}
+
 // HasNext returns true if there are more tracks after current
+// In random mode this means unplayed tracks remain in the current cycle
+// With repeat on a non-empty queue always has a next track
 func (p *Playlist) HasNext() bool {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.repeat && len(p.tracks) > 0 {
+		return true
+	}
+	if p.random {
+		p.syncOrder()
+		return p.orderPosition()+1 < len(p.order)
+	}
 	return p.current+1 < len(p.tracks)
 }
 
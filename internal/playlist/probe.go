@@ -0,0 +1,129 @@
+package playlist
+
+import (
+	"sync"
+)
+
+// probeWorkers is how many tracks have their metadata extracted at the same time
+const probeWorkers = 4
+
+// probeJob is a queued track whose metadata is to be extracted
+type probeJob struct {
+	pl  *Playlist
+	id  int
+	url string
+}
+
+// probeQueue extracts metadata for added tracks with a fixed pool of workers
+// shared by every playlist, in the order the tracks were added
+type probeQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []probeJob
+	started bool
+}
+
+// probes is the queue every playlist adds its tracks to
+var probes = &probeQueue{}
+
+// add queues a track and starts the workers on first use
+func (q *probeQueue) add(job probeJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.started {
+		q.cond = sync.NewCond(&q.mu)
+		for i := 0; i < probeWorkers; i++ {
+			go q.worker()
+		}
+		q.started = true
+	}
+	q.pending = append(q.pending, job)
+	q.cond.Signal()
+}
+
+// worker probes queued tracks one at a time
+func (q *probeQueue) worker() {
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 {
+			q.cond.Wait()
+		}
+		job := q.pending[0]
+		q.pending = q.pending[1:]
+		q.mu.Unlock()
+
+		// A track removed while it waited needs no metadata
+		if job.pl.hasID(job.id) {
+			metadata, stream := probeTrack(job.url)
+			job.pl.finishProbe(job.id, metadata, stream)
+		} else {
+			job.pl.finishProbe(job.id, nil, false)
+		}
+	}
+}
+
+// newPendingTrack returns a track for url titled after its file name, with
+// the next song ID, and queues its metadata extraction
+// Caller must hold the lock
+func (p *Playlist) newPendingTrack(url string) Track {
+	p.probing[p.nextID] = make(chan struct{})
+	probes.add(probeJob{pl: p, id: p.nextID, url: url})
+	return Track{
+		ID:              p.nextID,
+		URL:             url,
+		Metadata:        map[string]string{"title": filenameTitle(url)},
+		MetadataPending: true,
+	}
+}
+
+// hasID reports whether the playlist still holds the track with the given song ID
+func (p *Playlist) hasID(id int) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.indexOfID(id) >= 0
+}
+
+// finishProbe stores the metadata extracted for a track and wakes whoever waits for it
+// A nil map leaves the track as it is; the track may also be gone by now
+func (p *Playlist) finishProbe(id int, metadata map[string]string, stream bool) {
+	p.mu.Lock()
+	if done, ok := p.probing[id]; ok {
+		close(done)
+		delete(p.probing, id)
+	}
+	pos := p.indexOfID(id)
+	if pos < 0 || metadata == nil {
+		p.mu.Unlock()
+		return
+	}
+	p.tracks[pos].Metadata = metadata
+	p.tracks[pos].Stream = stream
+	p.tracks[pos].MetadataPending = false
+	p.recordTagChange(pos)
+	onMetadata := p.onMetadata
+	p.mu.Unlock()
+
+	if onMetadata != nil {
+		onMetadata(id)
+	}
+}
+
+// WaitForMetadata blocks until the track with the given song ID has its
+// metadata, returning at once if it already has or is not in the playlist
+func (p *Playlist) WaitForMetadata(id int) {
+	p.mu.RLock()
+	done := p.probing[id]
+	p.mu.RUnlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// SetMetadataCallback sets a function called with the song ID of each track
+// background probing fills in the metadata of, for instance to wake idle
+// playlist clients
+func (p *Playlist) SetMetadataCallback(fn func(id int)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onMetadata = fn
+}
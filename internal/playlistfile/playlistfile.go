@@ -0,0 +1,267 @@
+package playlistfile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/famish99/direttampd/internal/config"
+	"github.com/famish99/direttampd/internal/httpclient"
+)
+
+var (
+	clientMu sync.Mutex
+	client   = http.DefaultClient
+)
+
+// ConfigureHTTP sets up the client remote playlists are fetched with from the http config
+func ConfigureHTTP(cfg config.HTTPConfig) error {
+	c, err := httpclient.New(cfg)
+	if err != nil {
+		return err
+	}
+
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	client = c
+	return nil
+}
+
+// currentClient returns the client set up by ConfigureHTTP
+func currentClient() *http.Client {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	return client
+}
+
+// Format identifies a playlist file format
+type Format int
+
+const (
+	FormatNone Format = iota // Not a playlist file
+	FormatM3U                // M3U / M3U8 (extended or plain)
+	FormatPLS                // PLS (INI-style)
+	FormatXSPF               // XSPF (XML Shareable Playlist Format)
+)
+
+// DetectFormat returns the playlist format implied by the URI's extension
+func DetectFormat(uri string) Format {
+	switch extension(uri) {
+	case ".m3u", ".m3u8":
+		return FormatM3U
+	case ".pls":
+		return FormatPLS
+	case ".xspf":
+		return FormatXSPF
+	default:
+		return FormatNone
+	}
+}
+
+// extension returns the lower-case extension of a URI's path
+func extension(uri string) string {
+	path := uri
+	if u, err := url.Parse(uri); err == nil && u.Scheme != "" && u.Path != "" {
+		path = u.Path
+	}
+	return strings.ToLower(filepath.Ext(path))
+}
+
+// IsPlaylist returns true if the URI refers to a playlist file
+// HLS playlists share the M3U8 extension; see IsStreamManifest
+func IsPlaylist(uri string) bool {
+	return DetectFormat(uri) != FormatNone
+}
+
+// IsStreamManifest reports whether the URI is one stream split into segments
+// rather than a list of tracks: an HLS playlist (M3U8 with #EXT-X- tags) or a
+// remote DASH manifest (.mpd). Such a URI is played as a single track
+func IsStreamManifest(uri string) bool {
+	switch extension(uri) {
+	case ".mpd":
+		return isRemote(uri)
+	case ".m3u", ".m3u8":
+		r, err := open(uri)
+		if err != nil {
+			return false
+		}
+		defer r.Close()
+		return isHLS(r)
+	default:
+		return false
+	}
+}
+
+// isHLS reports whether an M3U playlist carries HLS tags
+func isHLS(r io.Reader) bool {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if strings.HasPrefix(strings.TrimSpace(scanner.Text()), "#EXT-X-") {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand reads the playlist at uri and returns the track URIs it contains
+// Relative entries are resolved against the playlist's own location
+func Expand(uri string) ([]string, error) {
+	format := DetectFormat(uri)
+	if format == FormatNone {
+		return nil, fmt.Errorf("not a playlist file: %s", uri)
+	}
+
+	r, err := open(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	entries, err := Parse(r, format)
+	if err != nil {
+		return nil, err
+	}
+
+	uris := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		uris = append(uris, resolve(uri, entry))
+	}
+	return uris, nil
+}
+
+// Parse reads playlist entries in the given format from r
+// Entries are returned as written; no path resolution is performed
+func Parse(r io.Reader, format Format) ([]string, error) {
+	switch format {
+	case FormatM3U:
+		return parseM3U(r)
+	case FormatPLS:
+		return parsePLS(r)
+	case FormatXSPF:
+		entries, err := ParseXSPF(r)
+		if err != nil {
+			return nil, err
+		}
+		uris := make([]string, len(entries))
+		for i, entry := range entries {
+			uris[i] = entry.URI
+		}
+		return uris, nil
+	default:
+		return nil, fmt.Errorf("unsupported playlist format")
+	}
+}
+
+// parseM3U returns every non-comment line of an M3U playlist
+func parseM3U(r io.Reader) ([]string, error) {
+	var entries []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+
+		// Skip blank lines and #EXTM3U/#EXTINF directives
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read M3U playlist: %w", err)
+	}
+	return entries, nil
+}
+
+// parsePLS returns the FileN entries of a PLS playlist in order of N
+func parsePLS(r io.Reader) ([]string, error) {
+	files := make(map[int]string)
+	maxIndex := 0
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || len(key) <= 4 || !strings.EqualFold(key[:4], "file") {
+			continue
+		}
+
+		var index int
+		if _, err := fmt.Sscanf(key[4:], "%d", &index); err != nil || index < 1 {
+			continue
+		}
+
+		files[index] = strings.TrimSpace(value)
+		if index > maxIndex {
+			maxIndex = index
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read PLS playlist: %w", err)
+	}
+
+	entries := make([]string, 0, len(files))
+	for i := 1; i <= maxIndex; i++ {
+		if file, ok := files[i]; ok && file != "" {
+			entries = append(entries, file)
+		}
+	}
+	return entries, nil
+}
+
+// open returns a reader for a local or HTTP(S) playlist
+func open(uri string) (io.ReadCloser, error) {
+	if isRemote(uri) {
+		resp, err := currentClient().Get(uri)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch playlist: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to fetch playlist: HTTP %d", resp.StatusCode)
+		}
+		return resp.Body, nil
+	}
+
+	f, err := os.Open(strings.TrimPrefix(uri, "file://"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open playlist: %w", err)
+	}
+	return f, nil
+}
+
+// resolve makes a playlist entry absolute relative to the playlist's location
+func resolve(base, entry string) string {
+	if isRemote(entry) || strings.HasPrefix(entry, "file://") {
+		return entry
+	}
+
+	if isRemote(base) {
+		baseURL, err := url.Parse(base)
+		if err != nil {
+			return entry
+		}
+		ref, err := url.Parse(entry)
+		if err != nil {
+			return entry
+		}
+		return baseURL.ResolveReference(ref).String()
+	}
+
+	if filepath.IsAbs(entry) {
+		return entry
+	}
+	return filepath.Join(filepath.Dir(strings.TrimPrefix(base, "file://")), entry)
+}
+
+// isRemote returns true for HTTP(S) URLs
+func isRemote(uri string) bool {
+	return strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://")
+}
@@ -0,0 +1,260 @@
+package playlistfile
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want Format
+	}{
+		{"/music/list.m3u", FormatM3U},
+		{"/music/list.M3U8", FormatM3U},
+		{"relative/list.pls", FormatPLS},
+		{"/music/list.xspf", FormatXSPF},
+		{"file:///music/list.m3u", FormatM3U},
+		{"http://radio.example/listen.pls?sid=1", FormatPLS},
+		{"http://radio.example/stream", FormatNone},
+		{"/music/song.flac", FormatNone},
+		{"/music/m3u", FormatNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			if got := DetectFormat(tt.uri); got != tt.want {
+				t.Errorf("DetectFormat(%q) = %d, want %d", tt.uri, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		input  string
+		want   []string
+	}{
+		{
+			"plain M3U",
+			FormatM3U,
+			"a.flac\nsub/b.flac\n\n/abs/c.flac\n",
+			[]string{"a.flac", "sub/b.flac", "/abs/c.flac"},
+		},
+		{
+			"extended M3U",
+			FormatM3U,
+			"#EXTM3U\n#EXTINF:123,Artist - Title\nhttp://host/a.mp3\n# comment\n#EXTINF:-1,Radio\nhttp://host/live\n",
+			[]string{"http://host/a.mp3", "http://host/live"},
+		},
+		{
+			"M3U with BOM and CRLF",
+			FormatM3U,
+			"\ufeffa.flac\r\n  b.flac  \r\n",
+			[]string{"a.flac", "b.flac"},
+		},
+		{
+			"PLS",
+			FormatPLS,
+			"[playlist]\nNumberOfEntries=2\nFile1=http://host/a\nTitle1=A\nFile2=http://host/b\nVersion=2\n",
+			[]string{"http://host/a", "http://host/b"},
+		},
+		{
+			"PLS out of order with gaps",
+			FormatPLS,
+			"[playlist]\nfile3 = c.mp3\nFILE1=a.mp3\nFile0=zero.mp3\nFileX=x.mp3\nFile5=\n",
+			[]string{"a.mp3", "c.mp3"},
+		},
+		{
+			"XSPF",
+			FormatXSPF,
+			`<?xml version="1.0"?><playlist version="1" xmlns="http://xspf.org/ns/0/"><trackList>` +
+				`<track><location>file:///music/A%20B.flac</location></track>` +
+				`<track><title>No location</title></track>` +
+				`<track><location> http://host/c.mp3 </location></track>` +
+				`</trackList></playlist>`,
+			[]string{"/music/A B.flac", "http://host/c.mp3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tt.input), tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	if _, err := Parse(strings.NewReader("a.flac"), FormatNone); err == nil {
+		t.Error("Parse with FormatNone succeeded")
+	}
+	if _, err := Parse(strings.NewReader("<playlist><trackList>"), FormatXSPF); err == nil {
+		t.Error("Parse of truncated XSPF succeeded")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		base  string
+		entry string
+		want  string
+	}{
+		{"/music/lists/a.m3u", "song.flac", "/music/lists/song.flac"},
+		{"/music/lists/a.m3u", "../Album/song.flac", "/music/Album/song.flac"},
+		{"/music/lists/a.m3u", "/abs/song.flac", "/abs/song.flac"},
+		{"file:///music/lists/a.m3u", "song.flac", "/music/lists/song.flac"},
+		{"/music/lists/a.m3u", "http://host/stream", "http://host/stream"},
+		{"/music/lists/a.m3u", "file:///x/y.flac", "file:///x/y.flac"},
+		{"http://host/lists/a.pls", "b.mp3", "http://host/lists/b.mp3"},
+		{"http://host/lists/a.pls", "/root.mp3", "http://host/root.mp3"},
+		{"http://host/lists/a.pls", "https://other/c.mp3", "https://other/c.mp3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.base+" "+tt.entry, func(t *testing.T) {
+			if got := resolve(tt.base, tt.entry); got != tt.want {
+				t.Errorf("resolve(%q, %q) = %q, want %q", tt.base, tt.entry, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpand(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "list.m3u")
+	if err := os.WriteFile(local, []byte("#EXTM3U\none.flac\nsub/two.flac\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/radio.pls":
+			w.Write([]byte("[playlist]\nFile1=stream\nFile2=http://mirror/stream\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		uri  string
+		want []string
+	}{
+		{"local", local, []string{filepath.Join(dir, "one.flac"), filepath.Join(dir, "sub/two.flac")}},
+		{"file URI", "file://" + local, []string{filepath.Join(dir, "one.flac"), filepath.Join(dir, "sub/two.flac")}},
+		{"remote", server.URL + "/radio.pls", []string{server.URL + "/stream", "http://mirror/stream"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Expand(tt.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expand = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for _, uri := range []string{filepath.Join(dir, "song.flac"), filepath.Join(dir, "missing.m3u"), server.URL + "/missing.pls"} {
+		if _, err := Expand(uri); err == nil {
+			t.Errorf("Expand(%q) succeeded", uri)
+		}
+	}
+}
+
+func TestIsStreamManifest(t *testing.T) {
+	dir := t.TempDir()
+	hls := filepath.Join(dir, "live.m3u8")
+	if err := os.WriteFile(hls, []byte("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n#EXTINF:10,\nseg0.ts\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tracks := filepath.Join(dir, "tracks.m3u8")
+	if err := os.WriteFile(tracks, []byte("#EXTM3U\n#EXTINF:200,A\na.flac\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		uri  string
+		want bool
+	}{
+		{hls, true},
+		{tracks, false},
+		{filepath.Join(dir, "missing.m3u8"), false},
+		{"http://host/manifest.mpd", true},
+		{"/music/manifest.mpd", false},
+		{"/music/song.flac", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(filepath.Base(tt.uri), func(t *testing.T) {
+			if got := IsStreamManifest(tt.uri); got != tt.want {
+				t.Errorf("IsStreamManifest(%q) = %v, want %v", tt.uri, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestXSPFRoundTrip(t *testing.T) {
+	entries := []Entry{
+		{
+			URI: "/music/Artist/Album/01 Track & More.flac",
+			Metadata: map[string]string{
+				"title":    "Track & More",
+				"artist":   "Artist",
+				"album":    "Album",
+				"track":    "1/12",
+				"comment":  "<remastered>",
+				"duration": "201.500",
+			},
+		},
+		{URI: "http://host/stream", Metadata: map[string]string{}},
+		{URI: "Relative/song.flac", Metadata: map[string]string{"title": "Relative"}},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteXSPF(&buf, entries); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "<location>file:///music/Artist/Album/01%20Track%20&amp;%20More.flac</location>") {
+		t.Errorf("absolute path not written as a file:// location:\n%s", buf.String())
+	}
+
+	got, err := ParseXSPF(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := entries
+	want[0].Metadata["track"] = "1" // trackNum holds the number alone
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip = %+v, want %+v", got, want)
+	}
+}
+
+func TestWriteM3U(t *testing.T) {
+	var buf bytes.Buffer
+	entries := []Entry{{URI: "/a.flac", Metadata: map[string]string{"title": "A"}}, {URI: "http://host/b"}}
+	if err := WriteM3U(&buf, entries); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "/a.flac\nhttp://host/b\n"; got != want {
+		t.Errorf("WriteM3U = %q, want %q", got, want)
+	}
+}
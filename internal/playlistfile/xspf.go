@@ -0,0 +1,152 @@
+package playlistfile
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Entry is a playlist entry with the metadata a format can carry
+// Metadata uses the lowercase tag names of the playlist package
+type Entry struct {
+	URI      string
+	Metadata map[string]string
+}
+
+// xspfNamespace is the XML namespace of XSPF version 1
+const xspfNamespace = "http://xspf.org/ns/0/"
+
+// xspfPlaylist is the XML document of an XSPF playlist
+type xspfPlaylist struct {
+	XMLName   xml.Name    `xml:"playlist"`
+	Namespace string      `xml:"xmlns,attr"`
+	Version   string      `xml:"version,attr"`
+	Tracks    []xspfTrack `xml:"trackList>track"`
+}
+
+// xspfTrack is a single XSPF track element
+type xspfTrack struct {
+	Location   []string `xml:"location"`
+	Title      string   `xml:"title,omitempty"`
+	Creator    string   `xml:"creator,omitempty"`
+	Album      string   `xml:"album,omitempty"`
+	TrackNum   string   `xml:"trackNum,omitempty"`
+	Duration   string   `xml:"duration,omitempty"` // Milliseconds
+	Annotation string   `xml:"annotation,omitempty"`
+}
+
+// ParseXSPF reads the entries of an XSPF playlist with their metadata
+// Tracks without a location are skipped; file:// locations become local paths
+func ParseXSPF(r io.Reader) ([]Entry, error) {
+	var doc xspfPlaylist
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to parse XSPF playlist: %w", err)
+	}
+
+	entries := make([]Entry, 0, len(doc.Tracks))
+	for _, track := range doc.Tracks {
+		if len(track.Location) == 0 || strings.TrimSpace(track.Location[0]) == "" {
+			continue
+		}
+
+		metadata := make(map[string]string)
+		setIfPresent(metadata, "title", track.Title)
+		setIfPresent(metadata, "artist", track.Creator)
+		setIfPresent(metadata, "album", track.Album)
+		setIfPresent(metadata, "track", track.TrackNum)
+		setIfPresent(metadata, "comment", track.Annotation)
+		if ms, err := strconv.ParseFloat(strings.TrimSpace(track.Duration), 64); err == nil {
+			metadata["duration"] = strconv.FormatFloat(ms/1000, 'f', 3, 64)
+		}
+
+		entries = append(entries, Entry{
+			URI:      locationToURI(strings.TrimSpace(track.Location[0])),
+			Metadata: metadata,
+		})
+	}
+
+	return entries, nil
+}
+
+// WriteXSPF writes entries as an XSPF playlist, keeping their metadata
+func WriteXSPF(w io.Writer, entries []Entry) error {
+	doc := xspfPlaylist{
+		Namespace: xspfNamespace,
+		Version:   "1",
+		Tracks:    make([]xspfTrack, 0, len(entries)),
+	}
+
+	for _, entry := range entries {
+		track := xspfTrack{
+			Location:   []string{uriToLocation(entry.URI)},
+			Title:      entry.Metadata["title"],
+			Creator:    entry.Metadata["artist"],
+			Album:      entry.Metadata["album"],
+			TrackNum:   entry.Metadata["track"],
+			Annotation: entry.Metadata["comment"],
+		}
+
+		// XSPF trackNum must be a plain integer, so drop "3/12" style totals
+		if num, _, found := strings.Cut(track.TrackNum, "/"); found {
+			track.TrackNum = num
+		}
+		if secs, err := strconv.ParseFloat(entry.Metadata["duration"], 64); err == nil {
+			track.Duration = strconv.FormatInt(int64(secs*1000), 10)
+		}
+
+		doc.Tracks = append(doc.Tracks, track)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return fmt.Errorf("failed to write XSPF playlist: %w", err)
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// WriteM3U writes entries as a plain M3U playlist; metadata is not kept
+func WriteM3U(w io.Writer, entries []Entry) error {
+	for _, entry := range entries {
+		if _, err := io.WriteString(w, entry.URI+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setIfPresent stores value under key unless it is blank
+func setIfPresent(metadata map[string]string, key, value string) {
+	if value = strings.TrimSpace(value); value != "" {
+		metadata[key] = value
+	}
+}
+
+// locationToURI converts an XSPF location into a track URI
+func locationToURI(location string) string {
+	if !strings.HasPrefix(location, "file://") {
+		return location
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return strings.TrimPrefix(location, "file://")
+	}
+	return u.Path
+}
+
+// uriToLocation converts a track URI into an XSPF location
+// Absolute local paths become file:// URIs as the format requires
+func uriToLocation(uri string) string {
+	if !filepath.IsAbs(uri) {
+		return uri
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(uri)}).String()
+}
@@ -0,0 +1,103 @@
+package replaygain
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Mode selects which ReplayGain values are applied
+type Mode string
+
+const (
+	ModeOff   Mode = "off"
+	ModeTrack Mode = "track"
+	ModeAlbum Mode = "album"
+	ModeAuto  Mode = "auto" // Album gain, or track gain while random mode is on
+)
+
+// ParseMode parses a ReplayGain mode name
+// An empty name means off
+func ParseMode(name string) (Mode, error) {
+	switch mode := Mode(strings.ToLower(name)); mode {
+	case "":
+		return ModeOff, nil
+	case ModeOff, ModeTrack, ModeAlbum, ModeAuto:
+		return mode, nil
+	default:
+		return ModeOff, fmt.Errorf("unrecognized replay gain mode: %s", name)
+	}
+}
+
+// Resolve turns auto mode into track or album for the current random setting
+func (m Mode) Resolve(random bool) Mode {
+	if m != ModeAuto {
+		return m
+	}
+	if random {
+		return ModeTrack
+	}
+	return ModeAlbum
+}
+
+// Settings holds the adjustments applied on top of the tagged gain
+type Settings struct {
+	Preamp        float64 // dB added to tagged gain
+	MissingPreamp float64 // dB applied to tracks without ReplayGain tags
+	AllowClipping bool    // Skip lowering the gain to keep the peak below full scale
+}
+
+// r128Offset converts EBU R128 gain (-23 LUFS reference) to ReplayGain (-18 LUFS reference)
+const r128Offset = 5.0
+
+// Gain returns the gain in dB to apply to a track with the given metadata
+// mode must already be resolved (see Mode.Resolve)
+func Gain(metadata map[string]string, mode Mode, settings Settings) float64 {
+	if mode == ModeOff || mode == ModeAuto {
+		return 0
+	}
+
+	gain, peak, ok := tagged(metadata, string(mode))
+	if !ok && mode == ModeAlbum {
+		gain, peak, ok = tagged(metadata, "track") // Fall back to track gain
+	}
+	if !ok {
+		return settings.MissingPreamp
+	}
+
+	gain += settings.Preamp
+
+	// Keep the loudest sample at or below full scale
+	if !settings.AllowClipping && peak > 0 {
+		if limit := -20 * math.Log10(peak); gain > limit {
+			gain = limit
+		}
+	}
+
+	return gain
+}
+
+// tagged reads the gain and peak for scope ("track" or "album") from metadata
+// Vorbis/ID3 REPLAYGAIN_* tags are preferred over Opus R128_* tags
+func tagged(metadata map[string]string, scope string) (gain, peak float64, ok bool) {
+	if value, found := metadata["replaygain_"+scope+"_gain"]; found {
+		value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "dB"))
+		if g, err := strconv.ParseFloat(value, 64); err == nil {
+			gain, ok = g, true
+		}
+	} else if value, found := metadata["r128_"+scope+"_gain"]; found {
+		// Q7.8 fixed point
+		if q, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+			gain, ok = float64(q)/256+r128Offset, true
+		}
+	}
+
+	if value, found := metadata["replaygain_"+scope+"_peak"]; found {
+		if p, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+			peak = p
+		}
+	}
+
+	return gain, peak, ok
+}
@@ -0,0 +1,225 @@
+package statefile
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Playback states as written to the state file
+const (
+	StateStop  = "stop"
+	StatePlay  = "play"
+	StatePause = "pause"
+)
+
+// Song is a queue entry saved in the state file
+type Song struct {
+	URI        string
+	Priority   int
+	RangeStart float64
+	RangeEnd   float64
+	Tags       map[string]string // Client-supplied tags (addtagid)
+}
+
+// State is the daemon state persisted across restarts
+type State struct {
+	PlayState string  // One of StateStop, StatePlay, StatePause
+	Current   int     // Queue position of the current song (-1 if none)
+	Elapsed   float64 // Elapsed time in the current song in seconds
+	Random    bool
+	Repeat    bool
+	Volume    int // Software mixer volume (0-100), -1 if not saved
+	Crossfade int // Crossfade length in seconds
+	Songs     []Song
+}
+
+// Write saves the state to path in an MPD-style format
+// The file is replaced atomically so a crash never leaves a truncated state
+func Write(path string, state *State) error {
+	var b strings.Builder
+
+	b.WriteString(fmt.Sprintf("state: %s\n", state.PlayState))
+	if state.Current >= 0 {
+		b.WriteString(fmt.Sprintf("current: %d\n", state.Current))
+		b.WriteString(fmt.Sprintf("time: %.3f\n", state.Elapsed))
+	}
+	b.WriteString(fmt.Sprintf("random: %s\n", formatBool(state.Random)))
+	b.WriteString(fmt.Sprintf("repeat: %s\n", formatBool(state.Repeat)))
+	if state.Volume >= 0 {
+		b.WriteString(fmt.Sprintf("sw_volume: %d\n", state.Volume))
+	}
+	if state.Crossfade > 0 {
+		b.WriteString(fmt.Sprintf("crossfade: %d\n", state.Crossfade))
+	}
+
+	b.WriteString("playlist_begin\n")
+	for i, song := range state.Songs {
+		// Per-song attributes precede the song line they apply to
+		if song.Priority > 0 {
+			b.WriteString(fmt.Sprintf("Prio: %d\n", song.Priority))
+		}
+		if song.RangeStart > 0 || song.RangeEnd > 0 {
+			b.WriteString(fmt.Sprintf("Range: %.3f-%.3f\n", song.RangeStart, song.RangeEnd))
+		}
+		// Values are quoted so newlines in them cannot break the line format
+		names := make([]string, 0, len(song.Tags))
+		for name := range song.Tags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			b.WriteString(fmt.Sprintf("Tag: %s %s\n", name, strconv.Quote(song.Tags[name])))
+		}
+		b.WriteString(fmt.Sprintf("%d:%s\n", i, song.URI))
+	}
+	b.WriteString("playlist_end\n")
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create state file directory: %w", err)
+	}
+
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, []byte(b.String()), 0644); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to finalize state file: %w", err)
+	}
+
+	return nil
+}
+
+// Read loads the state from path
+// Returns nil without error if the file does not exist yet
+func Read(path string) (*State, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open state file: %w", err)
+	}
+	defer f.Close()
+
+	state := &State{PlayState: StateStop, Current: -1, Volume: -1}
+	inPlaylist := false
+	var pending Song // Attributes for the next song line
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		switch {
+		case line == "playlist_begin":
+			inPlaylist = true
+			continue
+		case line == "playlist_end":
+			inPlaylist = false
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		if inPlaylist {
+			switch key {
+			case "Prio":
+				pending.Priority, _ = strconv.Atoi(value)
+			case "Range":
+				pending.RangeStart, pending.RangeEnd = parseRange(value)
+			case "Tag":
+				if name, quoted, ok := strings.Cut(value, " "); ok {
+					if tagValue, err := strconv.Unquote(quoted); err == nil {
+						if pending.Tags == nil {
+							pending.Tags = make(map[string]string)
+						}
+						pending.Tags[name] = tagValue
+					}
+				}
+			default:
+				// Song lines are "POS:URI"; the URI itself may contain colons
+				if _, err := strconv.Atoi(key); err != nil {
+					continue
+				}
+				pending.URI = value
+				state.Songs = append(state.Songs, pending)
+				pending = Song{}
+			}
+			continue
+		}
+
+		switch key {
+		case "state":
+			state.PlayState = value
+		case "current":
+			if current, err := strconv.Atoi(value); err == nil {
+				state.Current = current
+			}
+		case "time":
+			if elapsed, err := strconv.ParseFloat(value, 64); err == nil {
+				state.Elapsed = elapsed
+			}
+		case "random":
+			state.Random = value == "1"
+		case "repeat":
+			state.Repeat = value == "1"
+		case "sw_volume":
+			if volume, err := strconv.Atoi(value); err == nil && volume >= 0 && volume <= 100 {
+				state.Volume = volume
+			}
+		case "crossfade":
+			if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+				state.Crossfade = seconds
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	// Drop a current position that no longer points into the queue
+	if state.Current >= len(state.Songs) {
+		state.Current = -1
+	}
+
+	return state, nil
+}
+
+// parseRange parses "START-END" in seconds; malformed values yield no range
+func parseRange(value string) (float64, float64) {
+	startStr, endStr, ok := strings.Cut(value, "-")
+	if !ok {
+		return 0, 0
+	}
+	start, err := strconv.ParseFloat(startStr, 64)
+	if err != nil {
+		return 0, 0
+	}
+	end, err := strconv.ParseFloat(endStr, 64)
+	if err != nil {
+		return 0, 0
+	}
+	return start, end
+}
+
+// formatBool formats a bool the way MPD does ("0" or "1")
+func formatBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// hrefPattern finds link targets in an HTML directory index
+var hrefPattern = regexp.MustCompile(`(?i)<a\s[^>]*href\s*=\s*["']([^"']+)["']`)
+
+// httpStorage browses a web server's HTML directory index pages
+// (Apache, nginx autoindex, lighttpd, python -m http.server, ...)
+type httpStorage struct {
+	uri    string
+	base   *url.URL
+	client *http.Client
+}
+
+// newHTTPStorage creates a storage for the directory index at u
+func newHTTPStorage(uri string, u *url.URL) *httpStorage {
+	base := *u
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	return &httpStorage{
+		uri:    uri,
+		base:   &base,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *httpStorage) URI() string {
+	return s.uri
+}
+
+func (s *httpStorage) List(path string) ([]Entry, error) {
+	dirURL := s.Locate(path)
+	if path != "" {
+		dirURL += "/"
+	}
+
+	resp, err := s.client.Get(dirURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch directory listing: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch directory listing: HTTP %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory listing: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	var entries []Entry
+	for _, match := range hrefPattern.FindAllStringSubmatch(string(body), -1) {
+		href := match[1]
+
+		// Only direct children: skip sort links, parent/absolute links and other hosts
+		if strings.HasPrefix(href, "?") || strings.HasPrefix(href, "#") ||
+			strings.HasPrefix(href, "/") || strings.HasPrefix(href, "..") ||
+			strings.Contains(href, "://") {
+			continue
+		}
+
+		isDir := strings.HasSuffix(href, "/")
+		name, err := url.PathUnescape(strings.TrimSuffix(href, "/"))
+		if err != nil || name == "" || name == "." || strings.Contains(name, "/") || seen[name] {
+			continue
+		}
+
+		seen[name] = true
+		entries = append(entries, Entry{Name: name, IsDir: isDir})
+	}
+	return entries, nil
+}
+
+func (s *httpStorage) Locate(path string) string {
+	return s.base.String() + escapePath(path)
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// localStorage is a directory on the local filesystem
+type localStorage struct {
+	uri  string
+	root string
+}
+
+// newLocalStorage creates a storage for the local directory at root
+func newLocalStorage(uri, root string) (*localStorage, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("cannot access %s: %w", root, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("not a directory: %s", root)
+	}
+	return &localStorage{uri: uri, root: root}, nil
+}
+
+func (s *localStorage) URI() string {
+	return s.uri
+}
+
+func (s *localStorage) List(path string) ([]Entry, error) {
+	dirEntries, err := os.ReadDir(s.Locate(path))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue // File vanished while listing
+		}
+		entries = append(entries, Entry{
+			Name:    dirEntry.Name(),
+			IsDir:   dirEntry.IsDir(),
+			ModTime: info.ModTime(),
+		})
+	}
+	return entries, nil
+}
+
+func (s *localStorage) Locate(path string) string {
+	return filepath.Join(s.root, filepath.FromSlash(path))
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// mountRoot is the directory NFS and SMB shares are mounted under
+var mountRoot = filepath.Join(os.TempDir(), "direttampd-mounts")
+
+// mountedStorage is an NFS or SMB share mounted read-only with the system
+// mount helpers (mount.nfs, mount.cifs), which needs root or CAP_SYS_ADMIN
+type mountedStorage struct {
+	*localStorage
+	dir string // Mount point on the local filesystem
+}
+
+// newMountedStorage mounts the share of an nfs:// or smb:// URI
+// nfs://host/export/dir mounts host:/export/dir; smb://[user[:password]@]host/share/dir
+// mounts //host/share, as a guest without credentials, and browses dir in it
+func newMountedStorage(uri string, u *url.URL) (*mountedStorage, error) {
+	// Errors are shown to clients, so they never include the password
+	redacted := u.Redacted()
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in %s", redacted)
+	}
+	share, sub, _ := strings.Cut(strings.Trim(u.Path, "/"), "/")
+	if share == "" && strings.EqualFold(u.Scheme, "smb") {
+		return nil, fmt.Errorf("missing share in %s (use smb://host/share)", redacted)
+	}
+
+	sum := sha1.Sum([]byte(uri))
+	dir := filepath.Join(mountRoot, hex.EncodeToString(sum[:8]))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create mount point: %w", err)
+	}
+
+	// A crash may have left the share mounted from a previous run
+	_ = exec.Command("umount", dir).Run()
+
+	var cmd *exec.Cmd
+	root := dir
+	switch strings.ToLower(u.Scheme) {
+	case "nfs":
+		export := "/" + strings.Trim(u.Path, "/")
+		cmd = exec.Command("mount", "-t", "nfs", "-o", "ro,nolock", u.Host+":"+export, dir)
+
+	case "smb":
+		options := "ro,guest"
+		if u.User != nil {
+			options = "ro,username=" + u.User.Username()
+		}
+		cmd = exec.Command("mount", "-t", "cifs", "-o", options, "//"+u.Hostname()+"/"+share, dir)
+		// mount.cifs reads the password from the environment, keeping it off the command line
+		if password, ok := u.User.Password(); ok {
+			cmd.Env = append(os.Environ(), "PASSWD="+password)
+		}
+		root = filepath.Join(dir, filepath.FromSlash(path.Clean("/"+sub)))
+	}
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(dir)
+		if message := firstLine(output); message != "" {
+			return nil, fmt.Errorf("failed to mount %s: %s", redacted, message)
+		}
+		return nil, fmt.Errorf("failed to mount %s: %w", redacted, err)
+	}
+
+	// listmounts shows the URI, so it keeps the password out of that too
+	local, err := newLocalStorage(redacted, root)
+	if err != nil {
+		unmountDir(dir)
+		return nil, err
+	}
+	return &mountedStorage{localStorage: local, dir: dir}, nil
+}
+
+// Close unmounts the share
+func (s *mountedStorage) Close() error {
+	return unmountDir(s.dir)
+}
+
+// unmountDir unmounts the share at dir and removes the mount point
+func unmountDir(dir string) error {
+	if output, err := exec.Command("umount", dir).CombinedOutput(); err != nil {
+		if message := firstLine(output); message != "" {
+			return fmt.Errorf("failed to unmount %s: %s", dir, message)
+		}
+		return fmt.Errorf("failed to unmount %s: %w", dir, err)
+	}
+	return os.Remove(dir)
+}
+
+// firstLine returns the first line of a mount helper's output, which holds the error
+func firstLine(output []byte) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+	return strings.TrimSpace(line)
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Entry is a file or directory in a storage listing
+type Entry struct {
+	Name    string
+	IsDir   bool
+	ModTime time.Time // Zero if the storage does not report it
+}
+
+// Storage is a browsable tree of files that can be mounted into the database
+// Paths are relative to the storage root and "/"-separated ("" is the root)
+// Storages holding system resources (mounted shares) also implement io.Closer
+type Storage interface {
+	// URI returns the URI the storage was created from
+	URI() string
+
+	// List returns the entries of the directory at path
+	List(path string) ([]Entry, error)
+
+	// Locate returns the local file path or URL the player can read path from
+	Locate(path string) string
+}
+
+// New creates the storage for a mount URI
+// Supported schemes: file://, http(s):// directory listings, dav(s):// WebDAV
+// servers, nfs:// and smb:// shares (mounted with the system mount helpers)
+// and upnp:// media servers
+func New(uri string) (Storage, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage URI: %w", err)
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "file":
+		return newLocalStorage(uri, u.Path)
+	case "http", "https":
+		return newHTTPStorage(uri, u), nil
+	case "dav", "davs":
+		return newWebDAVStorage(uri, u), nil
+	case "nfs", "smb":
+		return newMountedStorage(uri, u)
+	case "upnp":
+		return newUPnPStorage(uri, u)
+	default:
+		return nil, fmt.Errorf("unsupported storage scheme: %q", u.Scheme)
+	}
+}
+
+// joinPath joins a directory and a name into a storage path
+func joinPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// escapePath percent-escapes every segment of a storage path for use in a URL
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,447 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ssdpAddr is the SSDP multicast group
+const ssdpAddr = "239.255.255.250:1900"
+
+// upnpTimeout bounds finding the server and each Browse action
+const upnpTimeout = 5 * time.Second
+
+// browsePageSize is how many children each Browse action asks for
+const browsePageSize = 200
+
+// audioMimeExtensions maps the content formats of audio resources to the
+// extension the database recognises songs by
+var audioMimeExtensions = map[string]string{
+	"audio/flac":   ".flac",
+	"audio/x-flac": ".flac",
+	"audio/mpeg":   ".mp3",
+	"audio/wav":    ".wav",
+	"audio/x-wav":  ".wav",
+	"audio/mp4":    ".m4a",
+	"audio/x-m4a":  ".m4a",
+	"audio/ogg":    ".ogg",
+	"audio/x-aiff": ".aiff",
+	"audio/aiff":   ".aiff",
+}
+
+// upnpStorage browses the ContentDirectory of a UPnP media server
+// URIs name the server by its UUID (upnp://<uuid>/), which is looked up with
+// SSDP so the server may change address between mounts
+// Containers and items are listed by title; the object IDs behind the
+// titles are remembered as they are browsed
+type upnpStorage struct {
+	uri    string
+	uuid   string
+	root   string // Path below the server's root container the URI points at
+	client *http.Client
+
+	mu          sync.Mutex
+	controlURL  string // ContentDirectory control URL, empty until found
+	serviceType string
+	objects     map[string]upnpObject // Keyed by path below the server's root
+}
+
+// upnpObject is a container or item found while browsing
+type upnpObject struct {
+	id  string
+	url string // Resource URL of an item
+}
+
+// didlLite is a Browse result
+type didlLite struct {
+	Containers []didlObject `xml:"container"`
+	Items      []didlObject `xml:"item"`
+}
+
+// didlObject is a container or item in a Browse result
+type didlObject struct {
+	ID    string `xml:"id,attr"`
+	Title string `xml:"title"`
+	Res   []struct {
+		URL          string `xml:",chardata"`
+		ProtocolInfo string `xml:"protocolInfo,attr"`
+	} `xml:"res"`
+}
+
+// newUPnPStorage creates a storage for a upnp:// URI, checking the server can be found
+func newUPnPStorage(uri string, u *url.URL) (*upnpStorage, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing server UUID in %s", uri)
+	}
+	s := &upnpStorage{
+		uri:     uri,
+		uuid:    u.Host,
+		root:    strings.Trim(u.Path, "/"),
+		client:  &http.Client{Timeout: upnpTimeout},
+		objects: make(map[string]upnpObject),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.resolve(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *upnpStorage) URI() string {
+	return s.uri
+}
+
+func (s *upnpStorage) List(dir string) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.list(joinPath(s.root, dir))
+}
+
+func (s *upnpStorage) Locate(file string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	object, err := s.lookup(joinPath(s.root, file))
+	if err != nil {
+		return ""
+	}
+	return object.url
+}
+
+// list browses the container at full, a path below the server's root, and
+// remembers its children
+// Caller must hold the lock
+func (s *upnpStorage) list(full string) ([]Entry, error) {
+	container := upnpObject{id: "0"}
+	if full != "" {
+		var err error
+		if container, err = s.lookup(full); err != nil {
+			return nil, err
+		}
+		if container.url != "" {
+			return nil, fmt.Errorf("not a directory: %s", full)
+		}
+	}
+
+	result, err := s.browse(container.id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Titles need not be unique, nor free of slashes
+	taken := make(map[string]bool)
+	uniqueName := func(title, ext string) string {
+		base := strings.ReplaceAll(strings.TrimSpace(title), "/", "-")
+		if base == "" {
+			base = "Untitled"
+		}
+		name := base + ext
+		for n := 2; taken[name]; n++ {
+			name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+		}
+		taken[name] = true
+		return name
+	}
+
+	var entries []Entry
+	for _, c := range result.Containers {
+		name := uniqueName(c.Title, "")
+		s.objects[joinPath(full, name)] = upnpObject{id: c.ID}
+		entries = append(entries, Entry{Name: name, IsDir: true})
+	}
+	for _, item := range result.Items {
+		resource, ext := audioResource(item)
+		if resource == "" {
+			continue
+		}
+		name := uniqueName(item.Title, ext)
+		s.objects[joinPath(full, name)] = upnpObject{id: item.ID, url: resource}
+		entries = append(entries, Entry{Name: name})
+	}
+	return entries, nil
+}
+
+// lookup returns the object at full, browsing its parents if they were not yet
+// Caller must hold the lock
+func (s *upnpStorage) lookup(full string) (upnpObject, error) {
+	if object, ok := s.objects[full]; ok {
+		return object, nil
+	}
+
+	parent := ""
+	if i := strings.LastIndex(full, "/"); i >= 0 {
+		parent = full[:i]
+	}
+	if _, err := s.list(parent); err != nil {
+		return upnpObject{}, err
+	}
+	if object, ok := s.objects[full]; ok {
+		return object, nil
+	}
+	return upnpObject{}, fmt.Errorf("not found: %s", full)
+}
+
+// audioResource picks the audio resource of an item and the extension its
+// name needs for the database to pick it up as a song
+func audioResource(item didlObject) (string, string) {
+	for _, res := range item.Res {
+		// protocolInfo is "<protocol>:<network>:<content format>:<additional info>"
+		fields := strings.Split(res.ProtocolInfo, ":")
+		if len(fields) < 3 || !strings.HasPrefix(fields[2], "audio/") {
+			continue
+		}
+		resource := strings.TrimSpace(res.URL)
+
+		// The content format is more telling than the URL, which is often just an ID
+		if mimeType, _, err := mime.ParseMediaType(fields[2]); err == nil && audioMimeExtensions[mimeType] != "" {
+			return resource, audioMimeExtensions[mimeType]
+		}
+		if u, err := url.Parse(resource); err == nil {
+			return resource, strings.ToLower(path.Ext(u.Path))
+		}
+		return resource, ""
+	}
+	return "", ""
+}
+
+// browse lists the children of a container, a page at a time
+// Caller must hold the lock
+func (s *upnpStorage) browse(id string) (*didlLite, error) {
+	if err := s.resolve(); err != nil {
+		return nil, err
+	}
+
+	all := &didlLite{}
+	for start := 0; ; {
+		values, err := s.call("Browse",
+			"ObjectID", id,
+			"BrowseFlag", "BrowseDirectChildren",
+			"Filter", "*",
+			"StartingIndex", strconv.Itoa(start),
+			"RequestedCount", strconv.Itoa(browsePageSize),
+			"SortCriteria", "")
+		if err != nil {
+			// The server may have moved; find it again next time
+			s.controlURL = ""
+			return nil, err
+		}
+
+		var page didlLite
+		if err := xml.Unmarshal([]byte(values["Result"]), &page); err != nil {
+			return nil, fmt.Errorf("invalid Browse result: %w", err)
+		}
+		all.Containers = append(all.Containers, page.Containers...)
+		all.Items = append(all.Items, page.Items...)
+
+		returned, _ := strconv.Atoi(values["NumberReturned"])
+		total, _ := strconv.Atoi(values["TotalMatches"])
+		start += returned
+		if returned == 0 || start >= total {
+			return all, nil
+		}
+	}
+}
+
+// call invokes a ContentDirectory action with args given as name, value pairs
+// Returns the output arguments of the response by name
+// Caller must hold the lock
+func (s *upnpStorage) call(action string, args ...string) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?>`)
+	body.WriteString(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, s.serviceType)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&body, "<%s>", args[i])
+		xml.EscapeText(&body, []byte(args[i+1]))
+		fmt.Fprintf(&body, "</%s>", args[i])
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequest(http.MethodPost, s.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, s.serviceType, action))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", action, err)
+	}
+	defer resp.Body.Close()
+
+	values, err := soapValues(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", action, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if code := values["errorCode"]; code != "" {
+			return nil, fmt.Errorf("%s failed: UPnP error %s %s", action, code, values["errorDescription"])
+		}
+		return nil, fmt.Errorf("%s failed: %s", action, resp.Status)
+	}
+	return values, nil
+}
+
+// soapValues collects the text of every leaf element in a SOAP response by name
+func soapValues(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	decoder := xml.NewDecoder(r)
+
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid response: %w", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			values[t.Name.Local] = strings.TrimSpace(text.String())
+			text.Reset()
+		}
+	}
+}
+
+// upnpDevice is the part of a device description used to find the ContentDirectory service
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// contentDirectory finds the ContentDirectory service in the device or its
+// embedded devices, returning its type and control URL
+func (d *upnpDevice) contentDirectory() (string, string, bool) {
+	for _, service := range d.Services {
+		if strings.HasPrefix(service.ServiceType, "urn:schemas-upnp-org:service:ContentDirectory:") {
+			return service.ServiceType, service.ControlURL, true
+		}
+	}
+	for i := range d.Devices {
+		if serviceType, control, ok := d.Devices[i].contentDirectory(); ok {
+			return serviceType, control, true
+		}
+	}
+	return "", "", false
+}
+
+// resolve finds the server with SSDP and reads its ContentDirectory control URL
+// Caller must hold the lock
+func (s *upnpStorage) resolve() error {
+	if s.controlURL != "" {
+		return nil
+	}
+
+	location, err := ssdpLocation(s.uuid, upnpTimeout)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Get(location)
+	if err != nil {
+		return fmt.Errorf("failed to read device description: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("device description: %s", resp.Status)
+	}
+
+	var description struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&description); err != nil {
+		return fmt.Errorf("invalid device description: %w", err)
+	}
+
+	serviceType, control, ok := description.Device.contentDirectory()
+	if !ok {
+		return fmt.Errorf("%s is not a media server: no ContentDirectory service", s.uuid)
+	}
+
+	// Control URLs are relative to URLBase, or to the description without one
+	base := description.URLBase
+	if base == "" {
+		base = location
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return fmt.Errorf("invalid base URL: %w", err)
+	}
+	controlURL, err := baseURL.Parse(control)
+	if err != nil {
+		return fmt.Errorf("invalid control URL: %w", err)
+	}
+
+	s.serviceType = serviceType
+	s.controlURL = controlURL.String()
+	return nil
+}
+
+// ssdpLocation searches for the device with the given UUID and returns the
+// URL of its description
+func ssdpLocation(uuid string, timeout time.Duration) (string, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to open UDP socket: %w", err)
+	}
+	defer conn.Close()
+
+	group, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", err
+	}
+
+	request := fmt.Sprintf("M-SEARCH * HTTP/1.1\r\n"+
+		"HOST: %s\r\n"+
+		"MAN: \"ssdp:discover\"\r\n"+
+		"MX: 1\r\n"+
+		"ST: uuid:%s\r\n\r\n", ssdpAddr, uuid)
+	if _, err := conn.WriteToUDP([]byte(request), group); err != nil {
+		return "", fmt.Errorf("failed to send M-SEARCH: %w", err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 4096)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return "", fmt.Errorf("media server %s not found on the network", uuid)
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+
+		usn := strings.SplitN(resp.Header.Get("USN"), "::", 2)[0]
+		if location := resp.Header.Get("LOCATION"); location != "" && strings.EqualFold(usn, "uuid:"+uuid) {
+			return location, nil
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// propfindBody requests the properties needed for a directory listing
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><resourcetype/><getlastmodified/></prop></propfind>`
+
+// webdavStorage browses a WebDAV server with PROPFIND
+type webdavStorage struct {
+	uri    string
+	base   *url.URL // http(s) URL of the root collection
+	client *http.Client
+}
+
+// davMultistatus is the PROPFIND response document
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				LastModified string `xml:"getlastmodified"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// newWebDAVStorage creates a storage for a dav:// or davs:// URI
+func newWebDAVStorage(uri string, u *url.URL) *webdavStorage {
+	base := *u
+	base.Scheme = "http"
+	if strings.EqualFold(u.Scheme, "davs") {
+		base.Scheme = "https"
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	return &webdavStorage{
+		uri:    uri,
+		base:   &base,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *webdavStorage) URI() string {
+	return s.uri
+}
+
+func (s *webdavStorage) List(path string) ([]Entry, error) {
+	dirURL := s.Locate(path)
+	if path != "" {
+		dirURL += "/"
+	}
+
+	req, err := http.NewRequest("PROPFIND", dirURL, strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("PROPFIND failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("PROPFIND failed: HTTP %d", resp.StatusCode)
+	}
+
+	var status davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("invalid PROPFIND response: %w", err)
+	}
+
+	dirPath := strings.TrimSuffix(mustParseURL(dirURL).Path, "/")
+
+	var entries []Entry
+	for _, r := range status.Responses {
+		hrefURL, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+
+		// The response includes the directory itself; keep only its children
+		hrefPath := strings.TrimSuffix(hrefURL.Path, "/")
+		if hrefPath == dirPath || !strings.HasPrefix(hrefPath, dirPath+"/") {
+			continue
+		}
+		name := strings.TrimPrefix(hrefPath, dirPath+"/")
+		if strings.Contains(name, "/") {
+			continue
+		}
+
+		entry := Entry{Name: name}
+		for _, propstat := range r.Propstat {
+			if propstat.Prop.ResourceType.Collection != nil {
+				entry.IsDir = true
+			}
+			if t, err := http.ParseTime(propstat.Prop.LastModified); err == nil {
+				entry.ModTime = t
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (s *webdavStorage) Locate(path string) string {
+	return s.base.String() + escapePath(path)
+}
+
+// mustParseURL parses a URL built by this package
+func mustParseURL(raw string) *url.URL {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return &url.URL{}
+	}
+	return u
+}
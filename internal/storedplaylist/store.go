@@ -0,0 +1,391 @@
+package storedplaylist
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/famish99/direttampd/internal/playlistfile"
+)
+
+// Stored playlist file extensions; the extension selects the reader and writer
+const (
+	m3uExtension  = ".m3u"
+	xspfExtension = ".xspf"
+)
+
+// Supported stored playlist formats for newly created playlists
+const (
+	FormatM3U  = "m3u"
+	FormatXSPF = "xspf"
+)
+
+// Info describes a stored playlist
+type Info struct {
+	Name         string
+	LastModified time.Time
+}
+
+// Store manages stored playlists as M3U or XSPF files in a directory
+type Store struct {
+	dir       string
+	extension string // Extension used when creating new playlists
+}
+
+// NewStore creates a stored playlist store rooted at dir
+// An empty dir disables stored playlists; every operation then returns an error
+// format selects the file format of new playlists ("m3u" or "xspf"); existing
+// playlists keep the format they were created with
+func NewStore(dir, format string) *Store {
+	extension := m3uExtension
+	if strings.EqualFold(format, FormatXSPF) {
+		extension = xspfExtension
+	}
+	return &Store{dir: dir, extension: extension}
+}
+
+// Directory returns the playlist directory ("" if disabled)
+func (s *Store) Directory() string {
+	return s.dir
+}
+
+// checkEnabled returns an error if no playlist directory is configured
+func (s *Store) checkEnabled() error {
+	if s.dir == "" {
+		return fmt.Errorf("stored playlists are disabled (no playlist_directory configured)")
+	}
+	return nil
+}
+
+// validateName rejects names that would escape the playlist directory
+func validateName(name string) error {
+	if name == "" || name == "." || name == ".." ||
+		strings.ContainsAny(name, "/\\\r\n") {
+		return fmt.Errorf("invalid playlist name: %q", name)
+	}
+	return nil
+}
+
+// isPlaylistExtension returns true for extensions the store reads
+func isPlaylistExtension(ext string) bool {
+	return ext == m3uExtension || ext == xspfExtension
+}
+
+// path returns the file path of the named playlist
+// An existing file in either format wins; otherwise the default format is used
+func (s *Store) path(name string) (string, error) {
+	if err := s.checkEnabled(); err != nil {
+		return "", err
+	}
+	if err := validateName(name); err != nil {
+		return "", err
+	}
+
+	for _, ext := range []string{m3uExtension, xspfExtension} {
+		path := filepath.Join(s.dir, name+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return filepath.Join(s.dir, name+s.extension), nil
+}
+
+// List returns all stored playlists sorted by name
+func (s *Store) List() ([]Info, error) {
+	if err := s.checkEnabled(); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Info{}, nil
+		}
+		return nil, fmt.Errorf("failed to read playlist directory: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	playlists := make([]Info, 0, len(entries))
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || !isPlaylistExtension(ext) {
+			continue
+		}
+
+		// A name present in both formats is listed once
+		name := strings.TrimSuffix(entry.Name(), ext)
+		if seen[name] {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue // File vanished while listing
+		}
+
+		seen[name] = true
+		playlists = append(playlists, Info{
+			Name:         name,
+			LastModified: info.ModTime(),
+		})
+	}
+
+	sort.Slice(playlists, func(i, j int) bool {
+		return playlists[i].Name < playlists[j].Name
+	})
+
+	return playlists, nil
+}
+
+// Load returns the URIs in the named playlist
+func (s *Store) Load(name string) ([]string, error) {
+	entries, err := s.LoadEntries(name)
+	if err != nil {
+		return nil, err
+	}
+
+	uris := make([]string, len(entries))
+	for i, entry := range entries {
+		uris[i] = entry.URI
+	}
+	return uris, nil
+}
+
+// LoadEntries returns the entries in the named playlist with any stored metadata
+func (s *Store) LoadEntries(name string) ([]playlistfile.Entry, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no such playlist: %s", name)
+		}
+		return nil, fmt.Errorf("failed to open playlist: %w", err)
+	}
+	defer f.Close()
+
+	if filepath.Ext(path) == xspfExtension {
+		return playlistfile.ParseXSPF(f)
+	}
+
+	uris, err := playlistfile.Parse(f, playlistfile.FormatM3U)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]playlistfile.Entry, len(uris))
+	for i, uri := range uris {
+		entries[i] = playlistfile.Entry{URI: uri}
+	}
+	return entries, nil
+}
+
+// SaveMode controls how Save treats an existing playlist
+type SaveMode int
+
+const (
+	SaveCreate  SaveMode = iota // Fail if the playlist already exists
+	SaveAppend                  // Append to an existing playlist
+	SaveReplace                 // Overwrite an existing playlist
+)
+
+// Exists returns true if the named playlist exists
+func (s *Store) Exists(name string) bool {
+	path, err := s.path(name)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// Save writes the entries to the named playlist according to mode
+func (s *Store) Save(name string, entries []playlistfile.Entry, mode SaveMode) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+
+	exists := s.Exists(name)
+	switch mode {
+	case SaveCreate:
+		if exists {
+			return fmt.Errorf("playlist already exists: %s", name)
+		}
+	case SaveAppend:
+		if exists {
+			existing, err := s.LoadEntries(name)
+			if err != nil {
+				return err
+			}
+			entries = append(existing, entries...)
+		}
+	}
+
+	return s.write(path, entries)
+}
+
+// write atomically replaces the playlist file at path with the entries
+// The writer is picked from the file extension
+func (s *Store) write(path string, entries []playlistfile.Entry) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create playlist directory: %w", err)
+	}
+
+	var content bytes.Buffer
+	var err error
+	if filepath.Ext(path) == xspfExtension {
+		err = playlistfile.WriteXSPF(&content, entries)
+	} else {
+		err = playlistfile.WriteM3U(&content, entries)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file and rename so readers never see a partial playlist
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, content.Bytes(), 0644); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write playlist: %w", err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to finalize playlist: %w", err)
+	}
+
+	return nil
+}
+
+// Delete removes the named playlist
+func (s *Store) Delete(name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no such playlist: %s", name)
+		}
+		return fmt.Errorf("failed to remove playlist: %w", err)
+	}
+	return nil
+}
+
+// Rename renames a stored playlist; the destination must not exist
+// The playlist keeps its file format
+func (s *Store) Rename(from, to string) error {
+	fromPath, err := s.path(from)
+	if err != nil {
+		return err
+	}
+	if err := validateName(to); err != nil {
+		return err
+	}
+
+	if !s.Exists(from) {
+		return fmt.Errorf("no such playlist: %s", from)
+	}
+	if s.Exists(to) {
+		return fmt.Errorf("playlist already exists: %s", to)
+	}
+
+	toPath := filepath.Join(s.dir, to+filepath.Ext(fromPath))
+	if err := os.Rename(fromPath, toPath); err != nil {
+		return fmt.Errorf("failed to rename playlist: %w", err)
+	}
+	return nil
+}
+
+// update loads the named playlist, applies fn and writes the result back
+// If create is true a missing playlist is treated as empty
+func (s *Store) update(name string, create bool, fn func([]playlistfile.Entry) ([]playlistfile.Entry, error)) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+
+	var entries []playlistfile.Entry
+	if s.Exists(name) {
+		if entries, err = s.LoadEntries(name); err != nil {
+			return err
+		}
+	} else if !create {
+		return fmt.Errorf("no such playlist: %s", name)
+	}
+
+	if entries, err = fn(entries); err != nil {
+		return err
+	}
+
+	return s.write(path, entries)
+}
+
+// Add inserts URIs into the named playlist at pos, creating it if needed
+// A negative pos appends to the end
+func (s *Store) Add(name string, uris []string, pos int) error {
+	added := make([]playlistfile.Entry, len(uris))
+	for i, uri := range uris {
+		added[i] = playlistfile.Entry{URI: uri}
+	}
+
+	return s.update(name, true, func(existing []playlistfile.Entry) ([]playlistfile.Entry, error) {
+		if pos < 0 {
+			return append(existing, added...), nil
+		}
+		if pos > len(existing) {
+			return nil, fmt.Errorf("bad song index: %d", pos)
+		}
+
+		result := make([]playlistfile.Entry, 0, len(existing)+len(added))
+		result = append(result, existing[:pos]...)
+		result = append(result, added...)
+		return append(result, existing[pos:]...), nil
+	})
+}
+
+// Clear removes all songs from the named playlist, creating it if needed
+func (s *Store) Clear(name string) error {
+	return s.update(name, true, func([]playlistfile.Entry) ([]playlistfile.Entry, error) {
+		return nil, nil
+	})
+}
+
+// DeleteRange removes the songs in [start, end) from the named playlist
+// An end of -1 means through the end of the playlist
+func (s *Store) DeleteRange(name string, start, end int) error {
+	return s.update(name, false, func(existing []playlistfile.Entry) ([]playlistfile.Entry, error) {
+		if end < 0 {
+			end = len(existing)
+		}
+		if start < 0 || start >= end || end > len(existing) {
+			return nil, fmt.Errorf("bad song index: %d", start)
+		}
+		return append(existing[:start], existing[end:]...), nil
+	})
+}
+
+// Move moves the song at from to position to within the named playlist
+func (s *Store) Move(name string, from, to int) error {
+	return s.update(name, false, func(existing []playlistfile.Entry) ([]playlistfile.Entry, error) {
+		if from < 0 || from >= len(existing) {
+			return nil, fmt.Errorf("bad song index: %d", from)
+		}
+		if to < 0 || to >= len(existing) {
+			return nil, fmt.Errorf("bad song index: %d", to)
+		}
+
+		entry := existing[from]
+		existing = append(existing[:from], existing[from+1:]...)
+		existing = append(existing[:to], append([]playlistfile.Entry{entry}, existing[to:]...)...)
+		return existing, nil
+	})
+}
@@ -0,0 +1,228 @@
+package storedplaylist
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/famish99/direttampd/internal/playlistfile"
+)
+
+// entries makes playlist entries for URIs without metadata
+func entries(uris ...string) []playlistfile.Entry {
+	result := make([]playlistfile.Entry, len(uris))
+	for i, uri := range uris {
+		result[i] = playlistfile.Entry{URI: uri}
+	}
+	return result
+}
+
+// newTestStore returns a store in a fresh directory holding the playlist
+// "list" with the songs a to e
+func newTestStore(t *testing.T, format string) *Store {
+	t.Helper()
+	s := NewStore(filepath.Join(t.TempDir(), "playlists"), format)
+	if err := s.Save("list", entries("a", "b", "c", "d", "e"), SaveCreate); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	return s
+}
+
+func TestStoreEdit(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(s *Store) error
+		want []string
+	}{
+		{"append", func(s *Store) error { return s.Add("list", []string{"x", "y"}, -1) }, []string{"a", "b", "c", "d", "e", "x", "y"}},
+		{"insert at start", func(s *Store) error { return s.Add("list", []string{"x"}, 0) }, []string{"x", "a", "b", "c", "d", "e"}},
+		{"insert in the middle", func(s *Store) error { return s.Add("list", []string{"x", "y"}, 2) }, []string{"a", "b", "x", "y", "c", "d", "e"}},
+		{"insert at end", func(s *Store) error { return s.Add("list", []string{"x"}, 5) }, []string{"a", "b", "c", "d", "e", "x"}},
+		{"delete one", func(s *Store) error { return s.DeleteRange("list", 1, 2) }, []string{"a", "c", "d", "e"}},
+		{"delete range", func(s *Store) error { return s.DeleteRange("list", 1, 4) }, []string{"a", "e"}},
+		{"delete to end", func(s *Store) error { return s.DeleteRange("list", 3, -1) }, []string{"a", "b", "c"}},
+		{"move forward", func(s *Store) error { return s.Move("list", 0, 3) }, []string{"b", "c", "d", "a", "e"}},
+		{"move backward", func(s *Store) error { return s.Move("list", 4, 1) }, []string{"a", "e", "b", "c", "d"}},
+		{"move in place", func(s *Store) error { return s.Move("list", 2, 2) }, []string{"a", "b", "c", "d", "e"}},
+		{"clear", func(s *Store) error { return s.Clear("list") }, []string{}},
+		{"append mode", func(s *Store) error { return s.Save("list", entries("x"), SaveAppend) }, []string{"a", "b", "c", "d", "e", "x"}},
+		{"replace mode", func(s *Store) error { return s.Save("list", entries("x"), SaveReplace) }, []string{"x"}},
+	}
+
+	for _, format := range []string{FormatM3U, FormatXSPF} {
+		for _, tt := range tests {
+			t.Run(format+" "+tt.name, func(t *testing.T) {
+				s := newTestStore(t, format)
+				if err := tt.edit(s); err != nil {
+					t.Fatal(err)
+				}
+				got, err := s.Load("list")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("playlist = %q, want %q", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestStoreEditErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(s *Store) error
+		want string
+	}{
+		{"create over existing", func(s *Store) error { return s.Save("list", entries("x"), SaveCreate) }, "playlist already exists: list"},
+		{"insert past end", func(s *Store) error { return s.Add("list", []string{"x"}, 6) }, "bad song index: 6"},
+		{"delete past end", func(s *Store) error { return s.DeleteRange("list", 4, 6) }, "bad song index: 4"},
+		{"delete empty range", func(s *Store) error { return s.DeleteRange("list", 2, 2) }, "bad song index: 2"},
+		{"delete negative", func(s *Store) error { return s.DeleteRange("list", -1, 2) }, "bad song index: -1"},
+		{"move from past end", func(s *Store) error { return s.Move("list", 5, 0) }, "bad song index: 5"},
+		{"move to past end", func(s *Store) error { return s.Move("list", 0, 5) }, "bad song index: 5"},
+		{"delete from missing", func(s *Store) error { return s.DeleteRange("nosuch", 0, 1) }, "no such playlist: nosuch"},
+		{"move in missing", func(s *Store) error { return s.Move("nosuch", 0, 1) }, "no such playlist: nosuch"},
+		{"load missing", func(s *Store) error { _, err := s.Load("nosuch"); return err }, "no such playlist: nosuch"},
+		{"delete missing", func(s *Store) error { return s.Delete("nosuch") }, "no such playlist: nosuch"},
+		{"rename missing", func(s *Store) error { return s.Rename("nosuch", "other") }, "no such playlist: nosuch"},
+		{"rename over existing", func(s *Store) error { return s.Rename("list", "list") }, "playlist already exists: list"},
+		{"name with slash", func(s *Store) error { return s.Clear("../escape") }, `invalid playlist name: "../escape"`},
+		{"name with backslash", func(s *Store) error { return s.Clear(`a\b`) }, `invalid playlist name: "a\\b"`},
+		{"dot name", func(s *Store) error { return s.Clear("..") }, `invalid playlist name: ".."`},
+		{"empty name", func(s *Store) error { return s.Clear("") }, `invalid playlist name: ""`},
+		{"rename to invalid name", func(s *Store) error { return s.Rename("list", "a/b") }, `invalid playlist name: "a/b"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t, FormatM3U)
+			err := tt.edit(s)
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("error = %v, want %q", err, tt.want)
+			}
+
+			// A failed edit leaves the playlist as it was
+			got, _ := s.Load("list")
+			if want := []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("playlist = %q after the failed edit, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestStoreDisabled(t *testing.T) {
+	s := NewStore("", FormatM3U)
+	if _, err := s.List(); err == nil {
+		t.Error("List succeeded without a playlist directory")
+	}
+	if err := s.Save("list", entries("a"), SaveCreate); err == nil {
+		t.Error("Save succeeded without a playlist directory")
+	}
+	if s.Exists("list") {
+		t.Error("Exists reported a playlist without a playlist directory")
+	}
+}
+
+func TestStoreList(t *testing.T) {
+	s := NewStore(t.TempDir(), FormatM3U)
+
+	// A missing directory lists no playlists
+	if missing, err := NewStore(filepath.Join(t.TempDir(), "missing"), FormatM3U).List(); err != nil || len(missing) != 0 {
+		t.Errorf("List of a missing directory = %v, %v", missing, err)
+	}
+
+	for _, name := range []string{"zeta", "alpha", "both"} {
+		if err := s.Save(name, entries("a"), SaveCreate); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Other files and playlists in subdirectories are not listed
+	for _, name := range []string{"both.xspf", "mixed.xspf", "notes.txt", "list.m3u.tmp", "sub/inner.m3u"} {
+		path := filepath.Join(s.Directory(), name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range list {
+		names = append(names, info.Name)
+		if info.LastModified.IsZero() {
+			t.Errorf("%s has no modification time", info.Name)
+		}
+	}
+	if want := []string{"alpha", "both", "mixed", "zeta"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("List = %q, want %q", names, want)
+	}
+}
+
+func TestStoreFormats(t *testing.T) {
+	dir := t.TempDir()
+	saved := []playlistfile.Entry{
+		{URI: "/music/a.flac", Metadata: map[string]string{"title": "A", "artist": "Artist", "duration": "61.000"}},
+		{URI: "http://host/stream", Metadata: map[string]string{}},
+	}
+
+	// New playlists use the configured format; metadata survives only in XSPF
+	xspf := NewStore(dir, "XSPF")
+	if err := xspf.Save("rich", saved, SaveCreate); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "rich.xspf")); err != nil {
+		t.Fatalf("XSPF playlist not written: %v", err)
+	}
+	got, err := xspf.LoadEntries("rich")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, saved) {
+		t.Errorf("XSPF entries = %+v, want %+v", got, saved)
+	}
+
+	m3u := NewStore(dir, FormatM3U)
+	if err := m3u.Save("plain", saved, SaveCreate); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "plain.m3u"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "/music/a.flac\nhttp://host/stream\n"; got != want {
+		t.Errorf("M3U playlist = %q, want %q", got, want)
+	}
+
+	// An existing playlist keeps its format whatever the store creates
+	if err := m3u.Add("rich", []string{"/music/b.flac"}, -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := m3u.Rename("rich", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "renamed.xspf")); err != nil {
+		t.Fatalf("renamed playlist changed format: %v", err)
+	}
+	got, err = m3u.LoadEntries("renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0].Metadata["title"] != "A" || got[2].URI != "/music/b.flac" {
+		t.Errorf("renamed entries = %+v", got)
+	}
+
+	// No temporary files are left behind
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if len(matches) != 0 {
+		t.Errorf("temporary files left: %s", strings.Join(matches, ", "))
+	}
+}